@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of the access log
+const (
+	AccessLogText = "text"
+	AccessLogJSON = "json"
+	AccessLogOff  = "off"
+)
+
+// AccessLogConfig configures the line written per tunnel and per request
+// answered by the proxy
+type AccessLogConfig struct {
+	Format     string `json:"format"`      // "text" (default), "json" for one JSON object per line, or "off"
+	Path       string `json:"path"`        // File to append to; stdout if empty
+	MaxSizeMB  int    `json:"max_size_mb"` // Rotate the file once it reaches this size (default 100)
+	MaxBackups int    `json:"max_backups"` // Rotated files kept as path.1 to path.N (default 5)
+}
+
+// AccessLogEntry is a line of the access log: a tunnel when it closes or
+// is refused, or a request answered by the camouflage site
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"` // CONNECT, SOCKS5, or the method of a request
+	User      string    `json:"user,omitempty"`
+	RemoteIP  string    `json:"remote_ip"`
+	SNI       string    `json:"sni,omitempty"` // Server name the client's TLS handshake asked for
+	Host      string    `json:"host"`          // Target of a tunnel, the Host of a request
+	Path      string    `json:"path,omitempty"`
+	Status    int       `json:"status"`
+	Code      string    `json:"code,omitempty"` // Error code of a refusal
+	// Bytes from and to the client: sent to and received from the target
+	// for a tunnel, the request and response bodies for a request
+	Upload     uint64 `json:"upload"`
+	Download   uint64 `json:"download"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// AccessLog writes the access log
+type AccessLog struct {
+	mu     sync.Mutex
+	json   bool
+	out    io.Writer
+	file   *rotatingFile // nil on stdout
+	failed bool          // a write failed; reported once
+}
+
+// NewAccessLog returns nil if access_log.format is "off"
+func NewAccessLog(config *Config) *AccessLog {
+	ac := config.AccessLog
+	a := &AccessLog{out: os.Stdout}
+	switch ac.Format {
+	case "", AccessLogText:
+	case AccessLogJSON:
+		a.json = true
+	case AccessLogOff:
+		return nil
+	default:
+		log.Printf("access_log.format %q: not text, json or off, ignored", ac.Format)
+	}
+	if ac.Path != "" {
+		maxSize, backups := ac.MaxSizeMB, ac.MaxBackups
+		if maxSize <= 0 {
+			maxSize = 100
+		}
+		if backups <= 0 {
+			backups = 5
+		}
+		f, err := openRotatingFile(ac.Path, int64(maxSize)<<20, backups)
+		if err != nil {
+			log.Printf("access_log.path %q: %v; logging to stdout", ac.Path, err)
+		} else {
+			a.file, a.out = f, f
+		}
+	}
+	return a
+}
+
+// Log writes e as a line
+func (a *AccessLog) Log(e AccessLogEntry) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	var line []byte
+	if a.json {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = e.appendText(nil)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.out.Write(line); err != nil && !a.failed {
+		a.failed = true
+		log.Printf("Access log: %v", err)
+	}
+}
+
+// Close closes the log file
+func (a *AccessLog) Close() error {
+	if a == nil || a.file == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// appendText appends e in the text format: time, remote IP, user, request
+// line, status, bytes up and down, duration, then the optional fields as
+// key=value
+func (e AccessLogEntry) appendText(b []byte) []byte {
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	target := e.Host + e.Path
+	b = fmt.Appendf(b, "%s %s %s %q %d %d %d %dms req=%s",
+		e.Time.UTC().Format(time.RFC3339Nano), dash(e.RemoteIP), dash(e.User), e.Method+" "+target,
+		e.Status, e.Upload, e.Download, e.DurationMS, e.RequestID)
+	if e.SNI != "" {
+		b = append(b, " sni="...)
+		b = strconv.AppendQuote(b, e.SNI)
+	}
+	if e.Code != "" {
+		b = append(b, " code="...)
+		b = append(b, e.Code...)
+	}
+	return append(b, '\n')
+}
+
+// requestAccessEntry returns the entry of r, less its outcome
+func requestAccessEntry(r *http.Request, username string) AccessLogEntry {
+	e := AccessLogEntry{
+		RequestID: requestID(r),
+		Method:    r.Method,
+		User:      username,
+		RemoteIP:  r.RemoteAddr,
+		Host:      r.Host,
+	}
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.RemoteIP = h
+	}
+	if r.Method != http.MethodConnect {
+		e.Path = camouflagePath(r)
+	}
+	if r.TLS != nil {
+		e.SNI = r.TLS.ServerName
+	}
+	return e
+}
+
+// logRefused logs r as answered with an error before any tunnel or
+// camouflage request
+func (p *Proxy) logRefused(r *http.Request, username string, status int, code string) {
+	if p.AccessLog == nil {
+		return
+	}
+	e := requestAccessEntry(r, username)
+	e.Status, e.Code = status, code
+	p.AccessLog.Log(e)
+}
+
+// accessLogClient logs the refusals of a tunnel being opened
+type accessLogClient struct {
+	tunnelClient
+	log   *AccessLog
+	entry AccessLogEntry
+	start time.Time
+}
+
+func (c *accessLogClient) Refuse(status int, code, message string) {
+	c.tunnelClient.Refuse(status, code, message)
+	e := c.entry
+	e.Status, e.Code = status, code
+	e.DurationMS = time.Since(c.start).Milliseconds()
+	c.log.Log(e)
+}
+
+// tunnelAccessEntry returns the entry of t, less its outcome
+func tunnelAccessEntry(t tunnelRequest) AccessLogEntry {
+	method := strings.ToUpper(t.Protocol)
+	if method == "" {
+		method = http.MethodConnect
+	}
+	e := AccessLogEntry{
+		RequestID: t.ID,
+		Method:    method,
+		User:      t.Username,
+		RemoteIP:  t.ClientAddr,
+		SNI:       t.SNI,
+		Host:      net.JoinHostPort(t.Host, t.Port),
+	}
+	if h, _, err := net.SplitHostPort(t.ClientAddr); err == nil {
+		e.RemoteIP = h
+	}
+	return e
+}
+
+// rotatingFile appends to a file, renaming it to path.1 (and older ones to
+// path.2 and on) once it reaches maxSize
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// Write appends p, rotating first if p would take the file past maxSize.
+// Callers serialize writes.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups by one, dropping the oldest, and starts a new
+// file
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	os.Remove(r.path + "." + strconv.Itoa(r.backups))
+	for i := r.backups - 1; i >= 1; i-- {
+		os.Rename(r.path+"."+strconv.Itoa(i), r.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog_Formats(t *testing.T) {
+	entry := tunnelAccessEntry(tunnelRequest{ID: "abc", Username: "alice", ClientAddr: "203.0.113.5:40000",
+		Host: "example.com", Port: "443", Protocol: "socks5", SNI: "proxy.example.net"})
+	entry.Time = time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)
+	entry.Status, entry.Upload, entry.Download, entry.DurationMS = 200, 120, 4096, 1500
+
+	var out bytes.Buffer
+	cfg := &Config{}
+	cfg.AccessLog.Format = AccessLogJSON
+	a := NewAccessLog(cfg)
+	a.out = &out
+	a.Log(entry)
+	var got AccessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("%q: %v", out.String(), err)
+	}
+	if got != entry || got.Method != "SOCKS5" || got.RemoteIP != "203.0.113.5" || got.Host != "example.com:443" {
+		t.Errorf("logged %+v, want %+v", got, entry)
+	}
+
+	out.Reset()
+	cfg.AccessLog.Format = ""
+	a = NewAccessLog(cfg)
+	a.out = &out
+	entry.User, entry.Status, entry.Code = "", 403, ErrCodeDestinationBlocked
+	a.Log(entry)
+	want := `2026-10-17T08:00:00Z 203.0.113.5 - "SOCKS5 example.com:443" 403 120 4096 1500ms req=abc sni="proxy.example.net" code=destination_blocked` + "\n"
+	if out.String() != want {
+		t.Errorf("text line\n%q, want\n%q", out.String(), want)
+	}
+
+	cfg.AccessLog.Format = AccessLogOff
+	if NewAccessLog(cfg) != nil {
+		t.Error("access log on with format off")
+	}
+}
+
+func TestAccessLog_Rotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &AccessLog{json: true, out: f, file: f}
+	for i := 0; i < 5; i++ {
+		a.Log(AccessLogEntry{RequestID: strings.Repeat("x", 40), Status: i})
+	}
+	a.Close()
+
+	// One entry per file; the oldest two are gone
+	for name, status := range map[string]int{"access.log": 4, "access.log.1": 3, "access.log.2": 2} {
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(path), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e AccessLogEntry
+		if err := json.Unmarshal(data, &e); err != nil || e.Status != status {
+			t.Errorf("%s = %q (%v), want status %d", name, data, err, status)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("access.log.3 kept: %v", err)
+	}
+}
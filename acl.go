@@ -0,0 +1,685 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ACL rule actions and pattern types
+const (
+	ACLAllow    = "allow"
+	ACLDeny     = "deny"
+	ACLExact    = "exact"    // The host itself, e.g. example.com
+	ACLWildcard = "wildcard" // A glob over the host, e.g. *.example.com
+	ACLRegex    = "regex"    // A regular expression over the host
+
+	// Sources of an ACL rule
+	ACLSourceConfig = "config"
+	ACLSourceAPI    = "api"
+)
+
+// ACLConfig is the domain ACL of proxy.acl. Rules are checked by priority,
+// lowest first, then in order, and the first whose pattern matches the
+// target host decides; a user's own rules come before those of their group,
+// and both before the global ones.
+type ACLConfig struct {
+	Default string                     `json:"default"` // allow (default) or deny: the action when no rule matches
+	Rules   []ACLRuleConfig            `json:"rules"`   // For every user
+	Users   map[string][]ACLRuleConfig `json:"users"`   // By user or CN pattern
+}
+
+// ACLRuleConfig is an allow or deny rule for target hosts
+type ACLRuleConfig struct {
+	Action  string `json:"action"`  // allow or deny
+	Pattern string `json:"pattern"` // Host, glob or regular expression
+	// Type is exact, wildcard or regex; by default wildcard if the pattern
+	// has a "*", exact otherwise
+	Type     string `json:"type,omitempty"`
+	Priority int    `json:"priority,omitempty"` // Lower first; equal priorities keep their order
+}
+
+// ACLRule is a rule of the domain ACL
+type ACLRule struct {
+	ID        int64     `json:"id,omitempty"` // Rules added through the API; config rules have none
+	Source    string    `json:"source"`
+	User      string    `json:"user,omitempty"`  // User or CN pattern; empty for global rules
+	Group     string    `json:"group,omitempty"` // Set for rules of a group
+	Action    string    `json:"action"`
+	Type      string    `json:"type"`
+	Pattern   string    `json:"pattern"`
+	Priority  int       `json:"priority"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitzero"`
+
+	re *regexp.Regexp
+}
+
+// newACLRule checks c and returns it as a rule
+func newACLRule(c ACLRuleConfig) (*ACLRule, error) {
+	r := &ACLRule{Action: strings.ToLower(c.Action), Type: strings.ToLower(c.Type), Pattern: c.Pattern, Priority: c.Priority}
+	if err := r.compile(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// compile validates the rule and prepares its pattern
+func (r *ACLRule) compile() error {
+	if r.Action != ACLAllow && r.Action != ACLDeny {
+		return errors.New("action must be allow or deny")
+	}
+	if r.Pattern == "" {
+		return errors.New("pattern is empty")
+	}
+	if r.Type == "" {
+		r.Type = ACLExact
+		if strings.Contains(r.Pattern, "*") {
+			r.Type = ACLWildcard
+		}
+	}
+	switch r.Type {
+	case ACLExact:
+		r.Pattern = normalizeACLHost(r.Pattern)
+	case ACLWildcard:
+		r.Pattern = normalizeACLHost(r.Pattern)
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid wildcard %q", r.Pattern)
+		}
+	case ACLRegex:
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+		r.re = re
+	default:
+		return errors.New("type must be exact, wildcard or regex")
+	}
+	return nil
+}
+
+// normalizeACLHost lowercases a host and drops a trailing dot, so rules
+// and targets compare alike
+func normalizeACLHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Matches reports whether host, normalized, matches the rule's pattern
+func (r *ACLRule) Matches(host string) bool {
+	switch r.Type {
+	case ACLExact:
+		return host == r.Pattern
+	case ACLWildcard:
+		ok, _ := path.Match(r.Pattern, host)
+		return ok
+	case ACLRegex:
+		return r.re.MatchString(host)
+	}
+	return false
+}
+
+// String describes the rule for logs and recorded blocks
+func (r *ACLRule) String() string {
+	if r.ID != 0 {
+		return fmt.Sprintf("#%d %s", r.ID, r.key())
+	}
+	return r.key()
+}
+
+// key identifies the rule in its hit counts. It leaves out the ID, which
+// differs between databases, and the priority, which can change.
+func (r *ACLRule) key() string {
+	scope := "global"
+	switch {
+	case r.Group != "":
+		scope = "group " + r.Group
+	case r.User != "":
+		scope = "user " + r.User
+	}
+	return fmt.Sprintf("%s %s %s (%s, %s)", r.Action, r.Type, r.Pattern, scope, r.Source)
+}
+
+// insertACLRule adds r to list after the rules of lower or equal priority
+func insertACLRule(list []*ACLRule, r *ACLRule) []*ACLRule {
+	i := sort.Search(len(list), func(i int) bool { return list[i].Priority > r.Priority })
+	return slices.Insert(list, i, r)
+}
+
+// DomainACL decides which target hosts users may connect to. Rules come
+// from proxy.acl, the groups section and the admin API; those added
+// through the API are kept in the stats database. The requests each rule
+// decides are counted per hour, buffered and written to the stats
+// database every minute.
+type DomainACL struct {
+	db          *StatsDB
+	groups      *UserGroups
+	defaultDeny bool
+
+	mu      sync.RWMutex
+	global  []*ACLRule
+	users   map[string][]*ACLRule // By user or CN pattern
+	matcher *userPatterns         // Keys of users
+	blocked atomic.Uint64
+
+	hitsMu sync.Mutex
+	hits   map[aclHitKey]*aclHitAgg
+}
+
+// aclHitKey identifies the buffered hits of a rule in an hour
+type aclHitKey struct {
+	Rule string // ACLRule.key
+	Hour string // "2006-01-02T15:00:00", local time like hourly_stats
+}
+
+// aclHitAgg counts the buffered hits of a rule in an hour
+type aclHitAgg struct {
+	Hits    uint64
+	LastHit time.Time
+}
+
+// NewDomainACL parses proxy.acl and the groups' ACLs and loads the rules
+// added through the API. Invalid rules are logged and ignored. It returns
+// nil if there are no rules and none can be added.
+func NewDomainACL(config *Config, db *StatsDB, groups *UserGroups) *DomainACL {
+	ac := config.Proxy.ACL
+	a := &DomainACL{db: db, groups: groups, users: make(map[string][]*ACLRule), hits: make(map[aclHitKey]*aclHitAgg)}
+	switch strings.ToLower(ac.Default) {
+	case "", ACLAllow:
+	case ACLDeny:
+		a.defaultDeny = true
+	default:
+		log.Printf("proxy.acl.default %q: must be allow or deny, using allow", ac.Default)
+	}
+	add := func(where, user string, configs []ACLRuleConfig) {
+		for i, c := range configs {
+			r, err := newACLRule(c)
+			if err != nil {
+				log.Printf("%s[%d]: %v, ignored", where, i, err)
+				continue
+			}
+			r.Source, r.User = ACLSourceConfig, user
+			a.addLocked(r)
+		}
+	}
+	add("proxy.acl.rules", "", ac.Rules)
+	for user, configs := range ac.Users {
+		add("proxy.acl.users."+user, user, configs)
+	}
+
+	if db != nil {
+		rules, err := db.GetACLRules(context.Background())
+		if err != nil {
+			log.Printf("ACL rules: %v", err)
+		}
+		for _, r := range rules {
+			if err := r.compile(); err != nil {
+				log.Printf("ACL rule #%d: %v, ignored", r.ID, err)
+				continue
+			}
+			a.addLocked(r)
+		}
+	}
+	if db == nil && !a.defaultDeny && len(a.global) == 0 && len(a.users) == 0 && !groups.hasACL() {
+		return nil
+	}
+	a.rebuildLocked()
+
+	metrics.Gauge("https_proxy_acl_rules", "Domain ACL rules, from config and the API.", func() float64 {
+		return float64(len(a.Rules()))
+	})
+	metrics.Counter("https_proxy_acl_blocked_total", "Requests refused by the domain ACL.", func() float64 {
+		return float64(a.blocked.Load())
+	})
+	return a
+}
+
+func (a *DomainACL) addLocked(r *ACLRule) {
+	if r.User == "" {
+		a.global = insertACLRule(a.global, r)
+	} else {
+		a.users[r.User] = insertACLRule(a.users[r.User], r)
+	}
+}
+
+// rebuildLocked refreshes the matcher of the users with rules. Must be
+// called with mu held for writing.
+func (a *DomainACL) rebuildLocked() {
+	keys := make([]string, 0, len(a.users))
+	for user := range a.users {
+		keys = append(keys, user)
+	}
+	a.matcher, _ = newUserPatterns(keys)
+}
+
+// Match returns the rule that decides whether username may connect to
+// host, or nil if none matches and the default applies
+func (a *DomainACL) Match(username, host string) *ACLRule {
+	if a == nil {
+		return nil
+	}
+	host = normalizeACLHost(host)
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if key, ok := a.matcher.Match(username); ok {
+		for _, r := range a.users[key] {
+			if r.Matches(host) {
+				return r
+			}
+		}
+	}
+	if r := a.groups.ACLMatch(username, host); r != nil {
+		return r
+	}
+	for _, r := range a.global {
+		if r.Matches(host) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether username may connect to host, and the rule that
+// decided it (nil for the default)
+func (a *DomainACL) Allowed(username, host string) (bool, *ACLRule) {
+	if a == nil {
+		return true, nil
+	}
+	r := a.Match(username, host)
+	if r == nil {
+		return !a.defaultDeny, nil
+	}
+	return r.Action == ACLAllow, r
+}
+
+// Rules returns every rule: the global ones, then those of users by name,
+// each in the order they are checked. Group rules are listed with the
+// groups.
+func (a *DomainACL) Rules() []ACLRule {
+	if a == nil {
+		return []ACLRule{}
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	out := make([]ACLRule, 0, len(a.global))
+	for _, r := range a.global {
+		out = append(out, *r)
+	}
+	users := make([]string, 0, len(a.users))
+	for user := range a.users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		for _, r := range a.users[user] {
+			out = append(out, *r)
+		}
+	}
+	return out
+}
+
+var (
+	errACLNoDB       = errors.New("ACL rules can only be added with a stats database")
+	errACLRuleExists = errors.New("a rule for this pattern exists")
+	errNoACLRule     = errors.New("no such API rule")
+)
+
+// Add adds a rule for user (empty for every user) after the existing ones
+// of its priority, keeping it in the stats database
+func (a *DomainACL) Add(user string, c ACLRuleConfig, actor string, now time.Time) (ACLRule, error) {
+	if a == nil || a.db == nil {
+		return ACLRule{}, errACLNoDB
+	}
+	r, err := newACLRule(c)
+	if err != nil {
+		return ACLRule{}, err
+	}
+	r.Source, r.User, r.CreatedBy, r.CreatedAt = ACLSourceAPI, user, actor, now.UTC().Truncate(time.Second)
+	if r.ID, err = a.db.AddACLRule(*r); err != nil {
+		return ACLRule{}, err
+	}
+	a.mu.Lock()
+	a.addLocked(r)
+	a.rebuildLocked()
+	a.mu.Unlock()
+
+	changeFeed.Publish(ChangeEvent{Type: ChangeACL, User: user, Actor: actor, Detail: "added " + r.String()})
+	return *r, nil
+}
+
+// Delete removes the API rule id
+func (a *DomainACL) Delete(id int64, actor string) error {
+	if a == nil || a.db == nil {
+		return errNoACLRule
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key, i := a.findLocked(id)
+	if i < 0 {
+		return errNoACLRule
+	}
+	if err := a.db.DeleteACLRule(id); err != nil {
+		return err
+	}
+	rule := a.removeLocked(key, i)
+	a.rebuildLocked()
+	changeFeed.Publish(ChangeEvent{Type: ChangeACL, User: rule.User, Actor: actor, Detail: "removed " + rule.String()})
+	return nil
+}
+
+// SetPriority moves the API rule id among the rules of its scope
+func (a *DomainACL) SetPriority(id int64, priority int, actor string) (ACLRule, error) {
+	if a == nil || a.db == nil {
+		return ACLRule{}, errNoACLRule
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key, i := a.findLocked(id)
+	if i < 0 {
+		return ACLRule{}, errNoACLRule
+	}
+	if err := a.db.SetACLRulePriority(id, priority); err != nil {
+		return ACLRule{}, err
+	}
+	rule := a.removeLocked(key, i)
+	from := rule.Priority
+	rule.Priority = priority
+	a.addLocked(rule)
+	a.rebuildLocked()
+	changeFeed.Publish(ChangeEvent{Type: ChangeACL, User: rule.User, Actor: actor,
+		Detail: fmt.Sprintf("priority of %s changed from %d to %d", rule.String(), from, priority)})
+	return *rule, nil
+}
+
+// removeLocked takes the rule at index i of the user key (empty for global
+// rules) out of its list. Must be called with mu held for writing.
+func (a *DomainACL) removeLocked(key string, i int) *ACLRule {
+	if key == "" {
+		rule := a.global[i]
+		a.global = slices.Delete(a.global, i, i+1)
+		return rule
+	}
+	rule := a.users[key][i]
+	if a.users[key] = slices.Delete(a.users[key], i, i+1); len(a.users[key]) == 0 {
+		delete(a.users, key)
+	}
+	return rule
+}
+
+// findLocked returns the user key (empty for global rules) and index of
+// the API rule id, or -1 if there is none. Must be called with mu held.
+func (a *DomainACL) findLocked(id int64) (string, int) {
+	find := func(list []*ACLRule) int {
+		for i, r := range list {
+			if r.Source == ACLSourceAPI && r.ID == id {
+				return i
+			}
+		}
+		return -1
+	}
+	if i := find(a.global); i >= 0 {
+		return "", i
+	}
+	for user, list := range a.users {
+		if i := find(list); i >= 0 {
+			return user, i
+		}
+	}
+	return "", -1
+}
+
+// Hit counts a request of username to host for the rule that decides it,
+// and returns that rule (nil for the default)
+func (a *DomainACL) Hit(username, host string, now time.Time) *ACLRule {
+	if a == nil {
+		return nil
+	}
+	r := a.Match(username, host)
+	if r == nil || a.db == nil {
+		return r
+	}
+	key := aclHitKey{Rule: r.key(), Hour: now.Format("2006-01-02T15:00:00")}
+	a.hitsMu.Lock()
+	defer a.hitsMu.Unlock()
+	agg, ok := a.hits[key]
+	if !ok {
+		agg = &aclHitAgg{}
+		a.hits[key] = agg
+	}
+	agg.Hits++
+	if now.After(agg.LastHit) {
+		agg.LastHit = now
+	}
+	return r
+}
+
+// Flush writes the buffered hits. They are kept for the next flush if the
+// write fails.
+func (a *DomainACL) Flush(ctx context.Context) error {
+	if a == nil || a.db == nil {
+		return nil
+	}
+	a.hitsMu.Lock()
+	pending := a.hits
+	a.hits = make(map[aclHitKey]*aclHitAgg)
+	a.hitsMu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := a.db.UpsertACLRuleHits(ctx, pending); err != nil {
+		a.hitsMu.Lock()
+		for key, agg := range pending {
+			if cur, ok := a.hits[key]; ok {
+				cur.Hits += agg.Hits
+				if agg.LastHit.After(cur.LastHit) {
+					cur.LastHit = agg.LastHit
+				}
+			} else {
+				a.hits[key] = agg
+			}
+		}
+		a.hitsMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Run flushes the buffered hits every minute, forever
+func (a *DomainACL) Run() {
+	if a == nil || a.db == nil || a.db.ReadOnly() {
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := a.Flush(context.Background()); err != nil {
+			log.Printf("ACL rule hits: %v", err)
+		}
+	}
+}
+
+// ACLRuleHits is a rule with the requests it decided recently
+type ACLRuleHits struct {
+	ACLRule
+	Hits        uint64     `json:"hits"`          // In the window
+	HitsPerHour float64    `json:"hits_per_hour"` // Over the window
+	LastHit     *time.Time `json:"last_hit,omitempty"`
+}
+
+// HitRates returns every rule, group rules included, with its hits in the
+// hours up to now, least hit first so stale and shadowed rules lead. Rules
+// hit alike keep the order they are checked in.
+func (a *DomainACL) HitRates(ctx context.Context, hours int, now time.Time) ([]ACLRuleHits, error) {
+	if a == nil {
+		return []ACLRuleHits{}, nil
+	}
+	if a.db == nil {
+		return nil, errACLNoDB
+	}
+	if err := a.Flush(ctx); err != nil {
+		log.Printf("ACL rule hits: %v", err)
+	}
+	since := now.Add(-time.Duration(hours-1) * time.Hour).Format("2006-01-02T15:00:00")
+	counts, err := a.db.GetACLRuleHits(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+	rules := append(a.Rules(), a.groups.ACLRules()...)
+	out := make([]ACLRuleHits, 0, len(rules))
+	for _, r := range rules {
+		h := ACLRuleHits{ACLRule: r}
+		if c, ok := counts[r.key()]; ok {
+			h.Hits = c.Hits
+			last := c.LastHit
+			h.LastHit = &last
+		}
+		h.HitsPerHour = float64(h.Hits) / float64(hours)
+		out = append(out, h)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Hits < out[j].Hits })
+	return out, nil
+}
+
+// Record notes that username was refused host by rule (nil for the
+// default), keeping a count per user, domain and rule in the stats
+// database
+func (a *DomainACL) Record(reqID, username, host string, r *ACLRule, now time.Time) {
+	if a == nil {
+		return
+	}
+	a.blocked.Add(1)
+	rule := "default deny"
+	if r != nil {
+		rule = r.String()
+	}
+	log.Printf("[req %s] ACL refused %s -> %s: %s", reqID, username, host, rule)
+	if a.db != nil {
+		if err := a.db.RecordACLBlock(username, normalizeACLHost(host), rule, now); err != nil && !errors.Is(err, errStatsReadOnly) {
+			log.Printf("ACL blocks: %v", err)
+		}
+	}
+}
+
+// checkACL blocks targets the domain ACL denies the user
+func (e *PolicyEngine) checkACL(req PolicyRequest) PolicyCheck {
+	check := PolicyCheck{Rule: "acl", Allowed: true}
+	allowed, rule := e.ACL.Allowed(req.Username, req.Host)
+	if allowed {
+		if rule != nil {
+			check.Reason = "allowed by " + rule.String()
+		}
+		return check
+	}
+	check.Allowed = false
+	check.Reason = req.Host + " is not allowed by the access rules"
+	if rule != nil {
+		check.Reason = req.Host + " is denied by " + rule.String()
+	}
+	check.Code = ErrCodeDomainDenied
+	check.Status = http.StatusForbidden
+	return check
+}
+
+// handleACL serves /api/v2/acl: GET lists the rules and, with ?user= and
+// ?host=, what they decide for that request; POST {"user": "alice",
+// "action": "deny", "pattern": "*.example.com"} adds a rule (without user,
+// for everyone), PUT ?id=3 {"priority": 10} moves one added through the API
+// and DELETE ?id=3 removes it
+func handleACL(w http.ResponseWriter, r *http.Request, acl *DomainACL) {
+	if acl == nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Domain ACL not available"}, http.StatusServiceUnavailable)
+		return
+	}
+	actor := "api:" + adminName(r)
+	switch r.Method {
+	case http.MethodGet:
+		data := map[string]interface{}{"default": ACLAllow, "rules": acl.Rules()}
+		if acl.defaultDeny {
+			data["default"] = ACLDeny
+		}
+		if host := r.URL.Query().Get("host"); host != "" {
+			allowed, rule := acl.Allowed(r.URL.Query().Get("user"), host)
+			data["decision"] = map[string]interface{}{"allowed": allowed, "rule": rule}
+		}
+		writeJSONResponse(w, WebResponse{Success: true, Data: data}, http.StatusOK)
+	case http.MethodPost:
+		var req struct {
+			User string `json:"user"`
+			ACLRuleConfig
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "invalid JSON: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		rule, err := acl.Add(req.User, req.ACLRuleConfig, actor, time.Now())
+		if err != nil {
+			status := http.StatusBadRequest
+			switch {
+			case errors.Is(err, errACLRuleExists):
+				status = http.StatusConflict
+			case errors.Is(err, errACLNoDB), errors.Is(err, errStatsReadOnly):
+				status = http.StatusServiceUnavailable
+			}
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, status)
+			return
+		}
+		log.Printf("ACL rule %s added by %s", rule.String(), actor)
+		writeJSONResponse(w, WebResponse{Success: true, Data: rule}, http.StatusOK)
+	case http.MethodPut:
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "id required"}, http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Priority *int `json:"priority"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil || req.Priority == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "priority required"}, http.StatusBadRequest)
+			return
+		}
+		rule, err := acl.SetPriority(id, *req.Priority, actor)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case err == errNoACLRule:
+				status = http.StatusNotFound
+			case errors.Is(err, errStatsReadOnly):
+				status = http.StatusServiceUnavailable
+			}
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, status)
+			return
+		}
+		log.Printf("ACL rule %s moved to priority %d by %s", rule.String(), rule.Priority, actor)
+		writeJSONResponse(w, WebResponse{Success: true, Data: rule}, http.StatusOK)
+	case http.MethodDelete:
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "id required"}, http.StatusBadRequest)
+			return
+		}
+		if err := acl.Delete(id, actor); err != nil {
+			status := http.StatusInternalServerError
+			if err == errNoACLRule {
+				status = http.StatusNotFound
+			}
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, status)
+			return
+		}
+		log.Printf("ACL rule #%d removed by %s", id, actor)
+		writeJSONResponse(w, WebResponse{Success: true}, http.StatusOK)
+	default:
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+	}
+}
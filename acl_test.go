@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDomainACL_Match(t *testing.T) {
+	if NewDomainACL(&Config{}, nil, nil) != nil {
+		t.Error("ACL without rules or database")
+	}
+
+	cfg := &Config{}
+	cfg.Proxy.ACL = ACLConfig{
+		Rules: []ACLRuleConfig{
+			{Action: "deny", Pattern: "*.example.com"},
+			{Action: "deny", Pattern: `^ads[0-9]+\.`, Type: "regex"},
+			{Action: "deny", Pattern: "(", Type: "regex"}, // Ignored
+			{Action: "allow", Pattern: "status.example.com", Priority: -1},
+		},
+		Users: map[string][]ACLRuleConfig{
+			"ci-*": {{Action: "allow", Pattern: "api.example.com"}},
+		},
+	}
+	cfg.Groups = map[string]GroupConfig{
+		"staff": {Members: []string{"bob"}, ACL: []ACLRuleConfig{{Action: "allow", Pattern: "*.example.com"}}},
+	}
+	acl := NewDomainACL(cfg, nil, NewUserGroups(cfg, nil))
+
+	for _, tc := range []struct {
+		user, host string
+		allowed    bool
+	}{
+		{"alice", "example.com", true},
+		{"alice", "www.example.com", false},
+		{"alice", "WWW.Example.COM.", false},
+		{"alice", "ads12.example.net", false},
+		{"alice", "status.example.com", true},  // Listed last, checked first
+		{"ci-build", "api.example.com", true},  // Own rule first
+		{"ci-build", "www.example.com", false}, // Then the global ones
+		{"bob", "www.example.com", true},       // Group rule before the global ones
+		{"bob", "ads1.example.net", false},
+	} {
+		if allowed, rule := acl.Allowed(tc.user, tc.host); allowed != tc.allowed {
+			t.Errorf("%s -> %s: allowed %v by %v", tc.user, tc.host, allowed, rule)
+		}
+	}
+	if rules := acl.Rules(); len(rules) != 4 || rules[0].Pattern != "status.example.com" {
+		t.Errorf("rules = %+v", rules)
+	}
+
+	cfg.Proxy.ACL = ACLConfig{Default: "deny", Rules: []ACLRuleConfig{{Action: "allow", Pattern: "example.com"}}}
+	acl = NewDomainACL(cfg, nil, nil)
+	if ok, _ := acl.Allowed("alice", "example.com"); !ok {
+		t.Error("allowed host refused")
+	}
+	if ok, rule := acl.Allowed("alice", "example.net"); ok || rule != nil {
+		t.Errorf("default deny: %v, %v", ok, rule)
+	}
+	d := NewPolicyEngine(cfg, nil, nil).Evaluate(PolicyRequest{Username: "alice", Host: "example.net", Port: "443", Time: time.Now()})
+	if d.Allowed || d.Blocking.Code != ErrCodeDomainDenied || d.Blocking.Status != http.StatusForbidden {
+		t.Errorf("decision = %+v", d)
+	}
+}
+
+func TestDomainACL_API(t *testing.T) {
+	db := newExpiryTestDB(t)
+	cfg := &Config{}
+	engine := NewPolicyEngine(cfg, nil, db)
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, db, engine, nil)
+	do := func(method, path, body string) (int, json.RawMessage) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		var resp struct {
+			Data json.RawMessage `json:"data"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp.Data
+	}
+
+	if code, _ := do(http.MethodPost, "/api/v2/acl", `{"action": "block", "pattern": "example.com"}`); code != http.StatusBadRequest {
+		t.Errorf("unknown action: %d", code)
+	}
+	code, data := do(http.MethodPost, "/api/v2/acl", `{"user": "alice", "action": "deny", "pattern": "*.example.com"}`)
+	var rule ACLRule
+	json.Unmarshal(data, &rule)
+	if code != http.StatusOK || rule.ID == 0 || rule.Type != ACLWildcard || rule.Source != ACLSourceAPI {
+		t.Fatalf("POST: %d %s", code, data)
+	}
+	if code, _ := do(http.MethodPost, "/api/v2/acl", `{"user": "alice", "action": "allow", "pattern": "*.EXAMPLE.com"}`); code != http.StatusConflict {
+		t.Errorf("duplicate: %d", code)
+	}
+	if ok, _ := engine.ACL.Allowed("alice", "www.example.com"); ok {
+		t.Error("API rule not applied")
+	}
+	if ok, _ := engine.ACL.Allowed("bob", "www.example.com"); !ok {
+		t.Error("alice's rule applied to bob")
+	}
+	_, data = do(http.MethodGet, "/api/v2/acl?user=alice&host=www.example.com", "")
+	var list struct {
+		Rules    []ACLRule `json:"rules"`
+		Decision struct {
+			Allowed bool `json:"allowed"`
+		} `json:"decision"`
+	}
+	json.Unmarshal(data, &list)
+	if len(list.Rules) != 1 || list.Decision.Allowed {
+		t.Errorf("GET: %s", data)
+	}
+
+	// Refusals are counted per user, domain and rule
+	d := engine.Evaluate(PolicyRequest{Username: "alice", Host: "www.example.com", Port: "443", Time: time.Now()})
+	if d.Allowed || d.Blocking.Rule != "acl" {
+		t.Fatalf("decision = %+v", d)
+	}
+	for _, id := range []string{"1", "2"} {
+		engine.ACL.Record(id, "alice", "www.example.com", engine.ACL.Hit("alice", "www.example.com", time.Now()), time.Now())
+	}
+	blocks, err := db.GetACLBlocks(context.Background(), "alice", 10)
+	if err != nil || len(blocks) != 1 || blocks[0].Count != 2 || blocks[0].Rule != rule.String() {
+		t.Errorf("blocks = %+v, %v", blocks, err)
+	}
+
+	// A rule of lower priority is checked first
+	code, data = do(http.MethodPost, "/api/v2/acl", `{"user": "alice", "action": "allow", "pattern": "www.example.com", "priority": 5}`)
+	var allow ACLRule
+	json.Unmarshal(data, &allow)
+	if ok, _ := engine.ACL.Allowed("alice", "www.example.com"); code != http.StatusOK || ok {
+		t.Errorf("rule of priority 5 checked first: %d %s", code, data)
+	}
+	if code, _ := do(http.MethodPut, "/api/v2/acl?id="+strconv.FormatInt(allow.ID, 10), `{"priority": -1}`); code != http.StatusOK {
+		t.Errorf("PUT: %d", code)
+	}
+	if ok, r := engine.ACL.Allowed("alice", "www.example.com"); !ok || r.ID != allow.ID {
+		t.Errorf("after PUT: allowed %v by %v", ok, r)
+	}
+
+	// Rules are listed least hit first, with the counts kept in the
+	// database
+	engine.ACL.Hit("alice", "www.example.com", time.Now())
+	hits, err := NewDomainACL(cfg, db, nil).HitRates(context.Background(), 24, time.Now())
+	if err != nil || len(hits) != 2 {
+		t.Fatalf("hits = %+v, %v", hits, err)
+	}
+	if err := engine.ACL.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	hits, _ = NewDomainACL(cfg, db, nil).HitRates(context.Background(), 24, time.Now())
+	if hits[0].ID != allow.ID || hits[0].Hits != 1 || hits[1].Hits != 2 || hits[1].LastHit == nil || hits[1].HitsPerHour != 2.0/24 {
+		t.Errorf("hits = %+v", hits)
+	}
+	if code, _ := do(http.MethodGet, "/api/v2/acl/hits?hours=1", ""); code != http.StatusOK {
+		t.Errorf("GET hits: %d", code)
+	}
+
+	// API rules survive a restart, with their priorities
+	reloaded := NewDomainACL(cfg, db, nil)
+	if ok, _ := reloaded.Allowed("alice", "api.example.com"); ok {
+		t.Error("API rule not reloaded")
+	}
+	if ok, r := reloaded.Allowed("alice", "www.example.com"); !ok || r.Priority != -1 {
+		t.Errorf("reloaded: allowed %v by %v", ok, r)
+	}
+	if code, _ := do(http.MethodDelete, "/api/v2/acl?id=99", ""); code != http.StatusNotFound {
+		t.Errorf("DELETE unknown rule: %d", code)
+	}
+	if code, _ := do(http.MethodDelete, "/api/v2/acl?id="+strconv.FormatInt(rule.ID, 10), ""); code != http.StatusOK {
+		t.Errorf("DELETE: %d", code)
+	}
+	if ok, _ := NewDomainACL(cfg, db, nil).Allowed("alice", "api.example.com"); !ok {
+		t.Error("deleted rule reloaded")
+	}
+}
+
+func TestAuthorize_ACLHits(t *testing.T) {
+	db := newExpiryTestDB(t)
+	cfg := &Config{}
+	cfg.Proxy.ACL = ACLConfig{Rules: []ACLRuleConfig{{Action: "allow", Pattern: "www.example.com"}}}
+	p := &Proxy{Config: cfg, StatsDB: db, Policy: NewPolicyEngine(cfg, nil, db)}
+	hits := func() uint64 {
+		p.Policy.ACL.hitsMu.Lock()
+		defer p.Policy.ACL.hitsMu.Unlock()
+		var n uint64
+		for _, agg := range p.Policy.ACL.hits {
+			n += agg.Hits
+		}
+		return n
+	}
+	req := PolicyRequest{Username: "alice", Host: "www.example.com", Port: "443", Time: time.Now()}
+
+	// Requests that open no tunnel, such as camouflage GETs, are not hits
+	p.authorize("1", "203.0.113.5:1000", req, false)
+	if n := hits(); n != 0 {
+		t.Errorf("%d hits for a request without a tunnel", n)
+	}
+	p.authorize("2", "203.0.113.5:1000", req, true)
+	if n := hits(); n != 1 {
+		t.Errorf("%d hits for a tunnel", n)
+	}
+
+	// Nor are tunnels refused before the ACL decided
+	db.SetUserDisabled("alice", true)
+	if d := p.authorize("3", "203.0.113.5:1000", req, true); d.Allowed {
+		t.Fatal("disabled user allowed")
+	}
+	if n := hits(); n != 1 {
+		t.Errorf("%d hits after a refusal by user_status", n)
+	}
+}
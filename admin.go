@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
@@ -22,13 +24,22 @@ type AdminServer struct {
 	Config       *Config
 	StatsManager *StatsManager
 	StatsDB      *StatsDB
+	Policy       *PolicyEngine
+	History      *ConfigHistory
+	Settings     *SettingsUpdater
 	Server       *http.Server
 	Templates    *template.Template
 	CACertPool   *x509.CertPool
+
+	langCookies langCookies // signs each admin's panel language
+	apiTokens   []apiToken  // admin.api_tokens, usable instead of a client certificate
+	pseudonyms  pseudonyms  // usernames as shown to stats:pseudonymized holders
+	csrf        csrfTokens  // tokens of the panel's state-changing requests
+	usage       *AdminUsage // API calls per certificate and token
 }
 
 // NewAdminServer creates a new admin panel server
-func NewAdminServer(config *Config, statsManager *StatsManager, statsDB ...*StatsDB) (*AdminServer, error) {
+func NewAdminServer(config *Config, statsManager *StatsManager, statsDB *StatsDB, policy *PolicyEngine, history *ConfigHistory, settings *SettingsUpdater) (*AdminServer, error) {
 	if !config.Admin.Enabled {
 		return nil, nil
 	}
@@ -75,6 +86,7 @@ func NewAdminServer(config *Config, statsManager *StatsManager, statsDB ...*Stat
 		},
 		"timeElapsed": calculateTimeElapsed,
 		"formatBytes": formatBytes,
+		"asset":       staticAssets.URL,
 	}
 
 	// Parse templates
@@ -83,36 +95,41 @@ func NewAdminServer(config *Config, statsManager *StatsManager, statsDB ...*Stat
 		return nil, fmt.Errorf("failed to parse templates: %v", err)
 	}
 
-	// Get certificate configuration
-	certPath, keyPath, caPath := config.GetAdminCertificates()
-
-	// Load server certificate
-	serverCert, err := tls.LoadX509KeyPair(certPath, keyPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load admin certificate and key: %v", err)
-	}
-
-	// Load CA certificate
-	caCert, err := os.ReadFile(caPath)
+	// Load admin certificates
+	tlsConfig, caCertPool, err := loadAdminTLSConfig(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load admin CA certificate: %v", err)
-	}
-
-	// Create CA certificate pool
-	caCertPool := x509.NewCertPool()
-	if !caCertPool.AppendCertsFromPEM(caCert) {
-		return nil, fmt.Errorf("failed to parse admin CA certificate")
+		return nil, err
 	}
 
 	// Create admin panel server
 	adminServer := &AdminServer{
 		Config:       config,
 		StatsManager: statsManager,
+		StatsDB:      statsDB,
+		Policy:       policy,
+		History:      history,
+		Settings:     settings,
 		Templates:    templates,
 		CACertPool:   caCertPool,
+		langCookies:  newLangCookies(),
+		apiTokens:    loadAPITokens(config.Admin.APITokens),
+		pseudonyms:   newPseudonyms(secretValue(config.Admin.PseudonymSecret)),
+		csrf:         newCSRFTokens(),
+		usage:        NewAdminUsage(statsDB),
+	}
+	if config.Admin.PseudonymSecret == "" {
+		for _, t := range adminServer.apiTokens {
+			if t.scopes[ScopeStatsPseudonymized] && !t.scopes[ScopeStatsRead] {
+				log.Printf("admin.pseudonym_secret is not set: pseudonyms change on every restart")
+				break
+			}
+		}
 	}
-	if len(statsDB) > 0 && statsDB[0] != nil {
-		adminServer.StatsDB = statsDB[0]
+
+	// Token holders connect without a certificate; authenticate checks
+	// that every request has one or the other
+	if len(adminServer.apiTokens) > 0 {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
 	}
 
 	// Create routes
@@ -125,6 +142,9 @@ func NewAdminServer(config *Config, statsManager *StatsManager, statsDB ...*Stat
 		mux.HandleFunc("/api/config", adminServer.handleAPIConfig)
 		mux.HandleFunc("/api/user/enable/", adminServer.handleAPIEnableUser)
 		mux.HandleFunc("/api/user/disable/", adminServer.handleAPIDisableUser)
+		mux.HandleFunc("/api/v2/integrations", adminServer.handleAPIIntegrations)
+		mux.Handle("/metrics", metrics)
+		mux.HandleFunc("/readyz", handleReadyz)
 	}
 
 	// Web interface routes
@@ -133,23 +153,17 @@ func NewAdminServer(config *Config, statsManager *StatsManager, statsDB ...*Stat
 		mux.HandleFunc("/user/", adminServer.handleUserDetail)
 		mux.HandleFunc("/assets/", adminServer.handleAssets)
 		mux.HandleFunc("/dashboard/", adminServer.handleDashboardV2)
+		mux.HandleFunc("/integrations", adminServer.handleIntegrations)
 	}
 
-	// Register v2 API routes (always available if stats DB exists)
-	if adminServer.StatsDB != nil {
-		registerV2API(mux, adminServer.StatsDB)
-	}
+	// Register v2 API routes (stats routes return 503 without a stats DB)
+	registerV2API(mux, adminServer.Config, adminServer.StatsManager, adminServer.StatsDB, adminServer.Policy, adminServer.History)
 
 	// Create HTTPS server
 	server := &http.Server{
-		Addr: ":" + strconv.Itoa(config.Admin.Port),
-		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{serverCert},
-			ClientCAs:    caCertPool,
-			ClientAuth:   tls.RequireAndVerifyClientCert, // Require and verify client certificates
-			MinVersion:   tls.VersionTLS12,               // Minimum TLS 1.2
-		},
-		Handler: mux,
+		Addr:      ":" + strconv.Itoa(config.Admin.Port),
+		TLSConfig: tlsConfig,
+		Handler:   adminServer.securityHeaders(localizeErrors(adminServer.withLanguage(adminServer.authenticate(adminServer.checkCSRF(mux))))),
 	}
 
 	adminServer.Server = server
@@ -157,6 +171,38 @@ func NewAdminServer(config *Config, statsManager *StatsManager, statsDB ...*Stat
 	return adminServer, nil
 }
 
+// loadAdminTLSConfig builds the mutual TLS configuration shared by the admin
+// panel and the admin gRPC service.
+func loadAdminTLSConfig(config *Config) (*tls.Config, *x509.CertPool, error) {
+	// Get certificate configuration
+	certPath, keyPath, caPath := config.GetAdminCertificates()
+
+	// Load server certificate
+	serverCert, err := loadKeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load admin certificate and key: %v", err)
+	}
+
+	// Load CA certificate
+	caCert, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load admin CA certificate: %v", err)
+	}
+
+	// Create CA certificate pool
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return nil, nil, fmt.Errorf("failed to parse admin CA certificate")
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    caCertPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert, // Require and verify client certificates
+		MinVersion:   tls.VersionTLS12,               // Minimum TLS 1.2
+	}, caCertPool, nil
+}
+
 // calculateTimeElapsed is a helper function to calculate time differences
 func calculateTimeElapsed(startTime time.Time) string {
 	now := time.Now()
@@ -185,10 +231,17 @@ func (a *AdminServer) Start() {
 		return
 	}
 
+	go a.usage.Run()
+
 	// Start the server in a separate goroutine
 	go func() {
-		log.Printf("Starting admin panel server on port %d...\n", a.Config.Admin.Port)
-		if err := a.Server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		log.Printf("Starting admin panel server on %s...\n", listenAddrs(a.Config.Admin.BindAddresses, a.Config.Admin.Port))
+		ln, err := listenAll(a.Config.Admin.BindAddresses, a.Config.Admin.Port)
+		if err != nil {
+			log.Printf("Admin panel server error: %v\n", err)
+			return
+		}
+		if err := a.Server.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
 			log.Printf("Admin panel server error: %v\n", err)
 		}
 	}()
@@ -204,6 +257,9 @@ func (a *AdminServer) Stop() {
 	if err := a.Server.Close(); err != nil {
 		log.Printf("Error closing admin panel server: %v", err)
 	}
+	if err := a.usage.Flush(context.Background()); err != nil {
+		log.Printf("Error saving admin API usage: %v", err)
+	}
 }
 
 // pageData is the data passed to templates
@@ -212,9 +268,12 @@ type pageData struct {
 	LastUpdated  time.Time
 	Users        map[string]*UserStats
 	SelectedUser *UserStats
+	Expiries     map[string]*UserExpiry // by username, from the stats database
 	Config       *Config
 	Language     string
 	FormatBytes  func(uint64) string
+	CSRFToken    string // Sent with the page's state-changing requests
+	Integrations []AdminIntegration
 }
 
 // formatBytes formats bytes into a human-readable form
@@ -238,15 +297,33 @@ type WebResponse struct {
 	Success bool        `json:"success"`
 	Data    interface{} `json:"data"`
 	Error   string      `json:"error,omitempty"`
+	// Partial marks data cut short by stats.query limits
+	Partial bool `json:"partial,omitempty"`
 }
 
 // isAdmin verifies if the request is from an admin
 func (a *AdminServer) isAdmin(r *http.Request) bool {
 	// All users with valid client certificates are considered admins
-	// because we've already set client certificate verification in TLS config
+	// because we've already set client certificate verification in TLS config;
+	// API token holders were let through by authenticate
+	if _, ok := r.Context().Value(adminPrincipalKey{}).(*adminPrincipal); ok {
+		return true
+	}
 	return r.TLS != nil && len(r.TLS.PeerCertificates) > 0
 }
 
+// adminName returns the common name of the admin's client certificate, or
+// "token:<name>" for API token holders
+func adminName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		if p, ok := r.Context().Value(adminPrincipalKey{}).(*adminPrincipal); ok {
+			return p.name
+		}
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
 // Web API handlers
 
 // handleHome renders the homepage
@@ -256,22 +333,23 @@ func (a *AdminServer) handleHome(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check for language toggle
-	if r.URL.Query().Get("lang") != "" {
-		lang := r.URL.Query().Get("lang")
-		if lang == "en" || lang == "zh" {
-			a.Config.Admin.Language = lang
-		}
-	}
-
 	// Prepare page data
 	data := pageData{
 		Title:       "HTTPS Proxy - Admin Panel",
 		LastUpdated: time.Now(),
 		Users:       a.StatsManager.GetUserStats(),
 		Config:      a.Config,
-		Language:    a.Config.Admin.Language,
+		Language:    a.adminLanguage(r),
 		FormatBytes: formatBytes,
+		CSRFToken:   a.csrf.token(adminName(r)),
+	}
+	if a.StatsDB != nil {
+		if expiries, err := a.StatsDB.UserExpiries(r.Context(), time.Now()); err == nil {
+			data.Expiries = make(map[string]*UserExpiry, len(expiries))
+			for name, e := range expiries {
+				data.Expiries[name] = &e
+			}
+		}
 	}
 
 	// Render template
@@ -288,14 +366,6 @@ func (a *AdminServer) handleUserDetail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check for language toggle
-	if r.URL.Query().Get("lang") != "" {
-		lang := r.URL.Query().Get("lang")
-		if lang == "en" || lang == "zh" {
-			a.Config.Admin.Language = lang
-		}
-	}
-
 	// Get username from URL
 	username := r.URL.Path[len("/user/"):]
 	if username == "" {
@@ -317,8 +387,9 @@ func (a *AdminServer) handleUserDetail(w http.ResponseWriter, r *http.Request) {
 		Users:        a.StatsManager.GetUserStats(),
 		SelectedUser: user,
 		Config:       a.Config,
-		Language:     a.Config.Admin.Language,
+		Language:     a.adminLanguage(r),
 		FormatBytes:  formatBytes,
+		CSRFToken:    a.csrf.token(adminName(r)),
 	}
 
 	// Render template
@@ -328,11 +399,13 @@ func (a *AdminServer) handleUserDetail(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleAssets serves static assets
+// handleAssets serves the CSS and JS embedded from assets/
 func (a *AdminServer) handleAssets(w http.ResponseWriter, r *http.Request) {
-	// Handle CSS, JS, etc. static resources
-	// Since our implementation is embedded, we don't need to separately handle static resources
-	http.NotFound(w, r)
+	if !a.isAdmin(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	staticAssets.ServeHTTP(w, r)
 }
 
 // handleDashboardV2 serves the new modern dashboard
@@ -343,7 +416,8 @@ func (a *AdminServer) handleDashboardV2(w http.ResponseWriter, r *http.Request)
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	if err := a.Templates.ExecuteTemplate(w, "dashboard_v2.html", nil); err != nil {
+	data := pageData{CSRFToken: a.csrf.token(adminName(r))}
+	if err := a.Templates.ExecuteTemplate(w, "dashboard_v2.html", data); err != nil {
 		log.Printf("Error rendering dashboard v2 template: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
@@ -391,25 +465,56 @@ func (a *AdminServer) handleAPIUserStats(w http.ResponseWriter, r *http.Request)
 	}, http.StatusOK)
 }
 
-// handleAPIConfig returns server configuration
+// handleAPIConfig returns server configuration. PATCH changes the runtime
+// settings (see RuntimeSettingsPatch).
 func (a *AdminServer) handleAPIConfig(w http.ResponseWriter, r *http.Request) {
 	if !a.isAdmin(r) {
 		writeJSONResponse(w, WebResponse{Success: false, Error: "Unauthorized"}, http.StatusUnauthorized)
 		return
 	}
 
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		if a.Settings == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Runtime settings not available"}, http.StatusServiceUnavailable)
+			return
+		}
+		var patch RuntimeSettingsPatch
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&patch); err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "invalid request body: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if _, err := a.Settings.Apply(patch, "api:"+adminName(r)); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errSettingsNotSaved) {
+				status = http.StatusInternalServerError
+			}
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, status)
+			return
+		}
+	default:
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+
 	// For security reasons, only return partial configuration
 	safeConfig := struct {
-		ServerPort      int  `json:"server_port"`
-		AdminPort       int  `json:"admin_port"`
-		StatsEnabled    bool `json:"stats_enabled"`
-		StatsSavePeriod int  `json:"stats_save_period"`
+		ServerPort      int              `json:"server_port"`
+		AdminPort       int              `json:"admin_port"`
+		StatsEnabled    bool             `json:"stats_enabled"`
+		StatsSavePeriod int              `json:"stats_save_period"`
+		Runtime         *RuntimeSettings `json:"runtime,omitempty"`
 	}{
 		ServerPort:      a.Config.Server.Port,
 		AdminPort:       a.Config.Admin.Port,
 		StatsEnabled:    a.Config.Stats.Enabled,
 		StatsSavePeriod: a.Config.Stats.SavePeriod,
 	}
+	if a.Settings != nil {
+		current := a.Settings.Current()
+		safeConfig.Runtime = &current
+	}
 
 	writeJSONResponse(w, WebResponse{
 		Success: true,
@@ -439,7 +544,9 @@ func (a *AdminServer) handleAPIEnableUser(w http.ResponseWriter, r *http.Request
 	success := a.StatsManager.EnableUser(username)
 	if a.StatsDB != nil {
 		a.StatsDB.SetUserDisabled(username, false)
+		a.StatsDB.RecordUserEvent(username, EventUserEnabled, "web:"+adminName(r), "")
 	}
+	changeFeed.Publish(ChangeEvent{Type: EventUserEnabled, User: username, Actor: "web:" + adminName(r)})
 	writeJSONResponse(w, WebResponse{
 		Success: true,
 		Data: map[string]interface{}{
@@ -472,7 +579,9 @@ func (a *AdminServer) handleAPIDisableUser(w http.ResponseWriter, r *http.Reques
 	success := a.StatsManager.DisableUser(username)
 	if a.StatsDB != nil {
 		a.StatsDB.SetUserDisabled(username, true)
+		a.StatsDB.RecordUserEvent(username, EventUserDisabled, "web:"+adminName(r), "")
 	}
+	changeFeed.Publish(ChangeEvent{Type: EventUserDisabled, User: username, Actor: "web:" + adminName(r)})
 	writeJSONResponse(w, WebResponse{
 		Success: true,
 		Data: map[string]interface{}{
@@ -485,6 +594,12 @@ func (a *AdminServer) handleAPIDisableUser(w http.ResponseWriter, r *http.Reques
 
 // writeJSONResponse writes data as JSON to the response
 func writeJSONResponse(w http.ResponseWriter, data interface{}, statusCode int) {
+	if lw := localizedWriterOf(w); lw != nil {
+		if resp, ok := data.(WebResponse); ok && resp.Error != "" {
+			resp.Error = localizeMessage(lw.lang, resp.Error)
+			data = resp
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 
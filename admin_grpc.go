@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"https-proxy/adminpb"
+)
+
+// AdminGRPCServer exposes the admin operations over gRPC with mutual TLS.
+// It is the typed counterpart of the /api/v2 REST endpoints.
+type AdminGRPCServer struct {
+	adminpb.UnimplementedAdminServiceServer
+
+	Config       *Config
+	StatsManager *StatsManager
+	StatsDB      *StatsDB
+	Quotas       *UserQuotas // nil without a stats database
+	Server       *grpc.Server
+
+	usage *AdminUsage // Calls per certificate, shown on the integrations page
+}
+
+// NewAdminGRPCServer creates the gRPC admin service. It returns nil if the
+// service is not enabled in the configuration.
+func NewAdminGRPCServer(config *Config, statsManager *StatsManager, statsDB *StatsDB, quotas *UserQuotas) (*AdminGRPCServer, error) {
+	if !config.Admin.GRPC.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig, _, err := loadAdminTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &AdminGRPCServer{
+		Config:       config,
+		StatsManager: statsManager,
+		StatsDB:      statsDB,
+		Quotas:       quotas,
+		usage:        NewAdminUsage(statsDB),
+	}
+	s.Server = grpc.NewServer(append([]grpc.ServerOption{grpc.Creds(credentials.NewTLS(tlsConfig))}, grpcScopeInterceptors(s.usage)...)...)
+	adminpb.RegisterAdminServiceServer(s.Server, s)
+	return s, nil
+}
+
+// Start starts serving gRPC requests in a separate goroutine
+func (s *AdminGRPCServer) Start() {
+	if s == nil {
+		return
+	}
+
+	lis, err := listenAll(s.Config.Admin.BindAddresses, s.Config.Admin.GRPC.Port)
+	if err != nil {
+		log.Printf("Admin gRPC server error: %v", err)
+		return
+	}
+
+	go s.usage.Run()
+	go func() {
+		log.Printf("Starting admin gRPC server on %s...\n", listenAddrs(s.Config.Admin.BindAddresses, s.Config.Admin.GRPC.Port))
+		if err := s.Server.Serve(lis); err != nil && err != grpc.ErrServerStopped {
+			log.Printf("Admin gRPC server error: %v", err)
+		}
+	}()
+}
+
+// Stop stops the gRPC server, closing open streams
+func (s *AdminGRPCServer) Stop() {
+	if s == nil || s.Server == nil {
+		return
+	}
+
+	log.Println("Stopping admin gRPC server...")
+	s.Server.Stop()
+	if err := s.usage.Flush(context.Background()); err != nil {
+		log.Printf("Error saving admin API usage: %v", err)
+	}
+}
+
+// statsDBOrUnavailable mirrors the REST check wrapper for a missing database.
+func (s *AdminGRPCServer) statsDBOrUnavailable() (*StatsDB, error) {
+	if s.StatsDB == nil {
+		return nil, status.Error(codes.Unavailable, "stats database not available")
+	}
+	return s.StatsDB, nil
+}
+
+func (s *AdminGRPCServer) ListUsers(ctx context.Context, req *adminpb.ListUsersRequest) (*adminpb.ListUsersResponse, error) {
+	db, err := s.statsDBOrUnavailable()
+	if err != nil {
+		return nil, err
+	}
+	users, err := db.GetAllUsers(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &adminpb.ListUsersResponse{Users: make([]*adminpb.User, 0, len(users))}
+	for i := range users {
+		resp.Users = append(resp.Users, userToProto(&users[i]))
+	}
+	return resp, nil
+}
+
+func (s *AdminGRPCServer) GetUser(ctx context.Context, req *adminpb.GetUserRequest) (*adminpb.User, error) {
+	if req.GetUsername() == "" {
+		return nil, status.Error(codes.InvalidArgument, "username required")
+	}
+	db, err := s.statsDBOrUnavailable()
+	if err != nil {
+		return nil, err
+	}
+	user, err := db.GetUser(ctx, req.GetUsername())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	return userToProto(user), nil
+}
+
+func (s *AdminGRPCServer) SetUserDisabled(ctx context.Context, req *adminpb.SetUserDisabledRequest) (*adminpb.SetUserDisabledResponse, error) {
+	username := req.GetUsername()
+	if username == "" {
+		return nil, status.Error(codes.InvalidArgument, "username required")
+	}
+
+	changed, err := setUserDisabled(s.StatsManager, s.StatsDB, username, req.GetDisabled(), "grpc:"+grpcPeerName(ctx))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &adminpb.SetUserDisabledResponse{Username: username, Disabled: req.GetDisabled(), Changed: changed}, nil
+}
+
+func (s *AdminGRPCServer) GetOverview(ctx context.Context, req *adminpb.GetOverviewRequest) (*adminpb.Overview, error) {
+	db, err := s.statsDBOrUnavailable()
+	if err != nil {
+		return nil, err
+	}
+	return overviewProto(ctx, db)
+}
+
+func (s *AdminGRPCServer) GetTopDomains(ctx context.Context, req *adminpb.GetTopDomainsRequest) (*adminpb.GetTopDomainsResponse, error) {
+	db, err := s.statsDBOrUnavailable()
+	if err != nil {
+		return nil, err
+	}
+	limit := int(req.GetLimit())
+	if limit <= 0 {
+		limit = 50
+	}
+	domains, err := db.GetTopDomains(ctx, limit, req.GetUser())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &adminpb.GetTopDomainsResponse{Domains: make([]*adminpb.DomainStats, 0, len(domains))}
+	for _, d := range domains {
+		resp.Domains = append(resp.Domains, &adminpb.DomainStats{
+			User:      d.User,
+			Domain:    d.Domain,
+			Upload:    d.Upload,
+			Download:  d.Download,
+			ConnCount: d.ConnCount,
+			LastSeen:  d.LastSeen,
+		})
+	}
+	return resp, nil
+}
+
+func (s *AdminGRPCServer) GetTrends(ctx context.Context, req *adminpb.GetTrendsRequest) (*adminpb.GetTrendsResponse, error) {
+	db, err := s.statsDBOrUnavailable()
+	if err != nil {
+		return nil, err
+	}
+	rangeStr := req.GetRange()
+	if rangeStr == "" {
+		rangeStr = "1h"
+	}
+	trends, err := db.GetTrends(ctx, rangeStr)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &adminpb.GetTrendsResponse{Points: make([]*adminpb.TrendPoint, 0, len(trends))}
+	for _, p := range trends {
+		resp.Points = append(resp.Points, &adminpb.TrendPoint{
+			Time:        p.Time,
+			Upload:      p.Upload,
+			Download:    p.Download,
+			Connections: p.Conns,
+		})
+	}
+	return resp, nil
+}
+
+func (s *AdminGRPCServer) GetCountries(ctx context.Context, req *adminpb.GetCountriesRequest) (*adminpb.GetCountriesResponse, error) {
+	db, err := s.statsDBOrUnavailable()
+	if err != nil {
+		return nil, err
+	}
+	countries, err := db.GetCountryStats(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	resp := &adminpb.GetCountriesResponse{Countries: make([]*adminpb.CountryStats, 0, len(countries))}
+	for _, c := range countries {
+		resp.Countries = append(resp.Countries, &adminpb.CountryStats{
+			Country:     c.Country,
+			CountryName: c.CountryName,
+			Continent:   c.Continent,
+			Upload:      c.Upload,
+			Download:    c.Download,
+			ConnCount:   c.ConnCount,
+		})
+	}
+	return resp, nil
+}
+
+func (s *AdminGRPCServer) WatchOverview(req *adminpb.WatchOverviewRequest, stream grpc.ServerStreamingServer[adminpb.Overview]) error {
+	db, err := s.statsDBOrUnavailable()
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(req.GetIntervalSeconds()) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		overview, err := overviewProto(stream.Context(), db)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(overview); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// quotasOrUnavailable mirrors the REST check for quotas without a stats
+// database
+func (s *AdminGRPCServer) quotasOrUnavailable() (*UserQuotas, error) {
+	if s.Quotas == nil {
+		return nil, status.Error(codes.Unavailable, "quotas not available")
+	}
+	return s.Quotas, nil
+}
+
+func (s *AdminGRPCServer) GetUserQuota(ctx context.Context, req *adminpb.GetUserQuotaRequest) (*adminpb.QuotaStatus, error) {
+	if req.GetUsername() == "" {
+		return nil, status.Error(codes.InvalidArgument, "username required")
+	}
+	quotas, err := s.quotasOrUnavailable()
+	if err != nil {
+		return nil, err
+	}
+	st, ok := quotas.Status(req.GetUsername(), time.Now())
+	if !ok {
+		return nil, status.Error(codes.NotFound, errNoQuota.Error())
+	}
+	return quotaStatusProto(st), nil
+}
+
+func (s *AdminGRPCServer) SetUserQuota(ctx context.Context, req *adminpb.SetUserQuotaRequest) (*adminpb.QuotaStatus, error) {
+	username := req.GetUsername()
+	if username == "" {
+		return nil, status.Error(codes.InvalidArgument, "username required")
+	}
+	if req.GetQuotaBytes() == 0 {
+		return nil, status.Error(codes.InvalidArgument, "quota_bytes must be positive")
+	}
+	quotas, err := s.quotasOrUnavailable()
+	if err != nil {
+		return nil, err
+	}
+	period := req.GetPeriod()
+	if period == "" {
+		period = QuotaMonthly
+	}
+	actor := "grpc:" + grpcPeerName(ctx)
+	now := time.Now()
+	if _, err := quotas.Set(username, period, req.GetQuotaBytes(), actor, now); err != nil {
+		if err == errQuotaPeriod {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Printf("Quota of %s set to %s %s by %s", username, formatBytes(req.GetQuotaBytes()), period, actor)
+	st, _ := quotas.Status(username, now)
+	return quotaStatusProto(st), nil
+}
+
+func (s *AdminGRPCServer) DeleteUserQuota(ctx context.Context, req *adminpb.DeleteUserQuotaRequest) (*adminpb.DeleteUserQuotaResponse, error) {
+	username := req.GetUsername()
+	if username == "" {
+		return nil, status.Error(codes.InvalidArgument, "username required")
+	}
+	quotas, err := s.quotasOrUnavailable()
+	if err != nil {
+		return nil, err
+	}
+	actor := "grpc:" + grpcPeerName(ctx)
+	if err := quotas.Delete(username, actor); err != nil {
+		if err == errNoQuota {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	log.Printf("Quota of %s removed by %s", username, actor)
+	return &adminpb.DeleteUserQuotaResponse{}, nil
+}
+
+func (s *AdminGRPCServer) ListTunnels(ctx context.Context, req *adminpb.ListTunnelsRequest) (*adminpb.ListTunnelsResponse, error) {
+	return tunnelsProto(tunnels.List(time.Now(), req.GetUser(), req.GetExpiredOnly())), nil
+}
+
+func (s *AdminGRPCServer) WatchTunnels(req *adminpb.WatchTunnelsRequest, stream grpc.ServerStreamingServer[adminpb.ListTunnelsResponse]) error {
+	interval := time.Duration(req.GetIntervalSeconds()) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := stream.Send(tunnelsProto(tunnels.List(time.Now(), req.GetUser(), false))); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func overviewProto(ctx context.Context, db *StatsDB) (*adminpb.Overview, error) {
+	o, err := db.GetOverview(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("get overview: %v", err))
+	}
+	return &adminpb.Overview{
+		TotalUpload:      o.TotalUpload,
+		TotalDownload:    o.TotalDownload,
+		TotalConnections: o.TotalConns,
+		DomainCount:      int32(o.DomainCount),
+		UserCount:        int32(o.UserCount),
+		CountryCount:     int32(o.CountryCount),
+		Timestamp:        time.Now().Format(time.RFC3339),
+	}, nil
+}
+
+func userToProto(u *DBUserStats) *adminpb.User {
+	return &adminpb.User{
+		Username:      u.Username,
+		TotalUpload:   u.TotalUpload,
+		TotalDownload: u.TotalDownload,
+		ConnCount:     u.ConnCount,
+		RequestCount:  u.RequestCount,
+		FirstSeen:     u.FirstSeen,
+		LastAccess:    u.LastAccess,
+		Disabled:      u.Disabled,
+	}
+}
+
+func quotaStatusProto(st QuotaStatus) *adminpb.QuotaStatus {
+	return &adminpb.QuotaStatus{
+		Username:    st.Username,
+		Period:      st.Period,
+		QuotaBytes:  st.QuotaBytes,
+		Group:       st.Group,
+		UsedBytes:   st.UsedBytes,
+		PeriodStart: st.PeriodStart.Format(time.RFC3339),
+		ResetsAt:    st.ResetsAt.Format(time.RFC3339),
+		Exceeded:    st.Exceeded,
+		SetBy:       st.SetBy,
+		SetAt:       protoTime(st.SetAt),
+	}
+}
+
+func tunnelsProto(list []TunnelInfo) *adminpb.ListTunnelsResponse {
+	resp := &adminpb.ListTunnelsResponse{Tunnels: make([]*adminpb.Tunnel, 0, len(list))}
+	for _, t := range list {
+		pt := &adminpb.Tunnel{
+			Id:           t.ID,
+			RequestId:    t.RequestID,
+			Username:     t.Username,
+			ClientAddr:   t.ClientAddr,
+			Target:       t.Target,
+			Protocol:     t.Protocol,
+			Tag:          t.Tag,
+			Route:        t.Route,
+			Started:      protoTime(t.Started),
+			CertNotAfter: protoTime(t.CertNotAfter),
+			CertExpired:  t.CertExpired,
+			Upload:       t.Upload,
+			Download:     t.Download,
+		}
+		if t.TerminateAt != nil {
+			pt.TerminateAt = protoTime(*t.TerminateAt)
+		}
+		resp.Tunnels = append(resp.Tunnels, pt)
+	}
+	return resp
+}
+
+// protoTime formats t as RFC 3339, or as "" if it is unset
+func protoTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// grpcPeerName returns the common name of the caller's client certificate
+func grpcPeerName(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return ""
+	}
+	return info.State.PeerCertificates[0].Subject.CommonName
+}
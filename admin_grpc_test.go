@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"https-proxy/adminpb"
+)
+
+// testPKI is a throwaway CA with a server certificate written to disk and a
+// client certificate, with the given OUs, kept in memory
+type testPKI struct {
+	CAPath, CertPath, KeyPath string
+	CA                        *IssuedCert
+	Client                    tls.Certificate
+}
+
+func newTestPKI(t *testing.T, clientOUs ...string) *testPKI {
+	t.Helper()
+	dir := t.TempDir()
+
+	ca, err := GenerateCA("Test CA", time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+	server, err := IssueCert(ca.Cert, ca.Key, CertRequest{
+		CommonName:  "localhost",
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		Validity:    time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("IssueCert server: %v", err)
+	}
+	client, err := IssueCert(ca.Cert, ca.Key, CertRequest{
+		CommonName:  "admin",
+		OrgUnits:    clientOUs,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Validity:    time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("IssueCert client: %v", err)
+	}
+
+	p := &testPKI{
+		CAPath:   filepath.Join(dir, "ca.pem"),
+		CertPath: filepath.Join(dir, "cert.pem"),
+		KeyPath:  filepath.Join(dir, "key.pem"),
+		CA:       ca,
+	}
+	if err := ca.WriteFiles(p.CAPath, filepath.Join(dir, "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.WriteFiles(p.CertPath, p.KeyPath); err != nil {
+		t.Fatal(err)
+	}
+	if p.Client, err = tls.X509KeyPair(client.CertPEM, client.KeyPEM); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// startTestGRPC serves the admin service over an in-memory listener and
+// returns a client, presenting a certificate from the same CA, with the
+// given OUs, if withCert
+func startTestGRPC(t *testing.T, statsDB *StatsDB, withCert bool, clientOUs ...string) (adminpb.AdminServiceClient, *StatsManager) {
+	t.Helper()
+	pki := newTestPKI(t, clientOUs...)
+
+	cfg := &Config{}
+	cfg.Server.Certificates.CertPath = pki.CertPath
+	cfg.Server.Certificates.KeyPath = pki.KeyPath
+	cfg.Server.Certificates.CAPath = pki.CAPath
+	cfg.Admin.GRPC.Enabled = true
+
+	sm := NewStatsManager(cfg)
+	srv, err := NewAdminGRPCServer(cfg, sm, statsDB, NewUserQuotas(cfg, statsDB, nil))
+	if err != nil {
+		t.Fatalf("NewAdminGRPCServer: %v", err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	go srv.Server.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(pki.CA.Cert)
+	clientTLS := &tls.Config{ServerName: "localhost", RootCAs: roots}
+	if withCert {
+		clientTLS.Certificates = []tls.Certificate{pki.Client}
+	}
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)),
+	)
+	if err != nil {
+		t.Fatalf("grpc.NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return adminpb.NewAdminServiceClient(conn), sm
+}
+
+func newGRPCTestDB(t *testing.T) *StatsDB {
+	t.Helper()
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestAdminGRPC_RequiresClientCert(t *testing.T) {
+	client, _ := startTestGRPC(t, nil, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.GetOverview(ctx, &adminpb.GetOverviewRequest{}); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected handshake failure without client cert, got %v", err)
+	}
+}
+
+func TestAdminGRPC_SetUserDisabled(t *testing.T) {
+	db := newGRPCTestDB(t)
+	client, sm := startTestGRPC(t, db, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.SetUserDisabled(ctx, &adminpb.SetUserDisabledRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("empty username: got %v, want InvalidArgument", err)
+	}
+
+	resp, err := client.SetUserDisabled(ctx, &adminpb.SetUserDisabledRequest{Username: "alice", Disabled: true})
+	if err != nil {
+		t.Fatalf("SetUserDisabled: %v", err)
+	}
+	if !resp.GetDisabled() || !resp.GetChanged() {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	if !sm.IsUserDisabled("alice") || !db.IsUserDisabled("alice") {
+		t.Error("user should be disabled in memory and in the database")
+	}
+
+	if _, err := client.SetUserDisabled(ctx, &adminpb.SetUserDisabledRequest{Username: "alice"}); err != nil {
+		t.Fatalf("SetUserDisabled: %v", err)
+	}
+	if sm.IsUserDisabled("alice") || db.IsUserDisabled("alice") {
+		t.Error("user should be enabled again")
+	}
+}
+
+func TestAdminGRPC_SetUserDisabledLeavesMemoryOnDBFailure(t *testing.T) {
+	db := newGRPCTestDB(t)
+	client, sm := startTestGRPC(t, db, true)
+	db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.SetUserDisabled(ctx, &adminpb.SetUserDisabledRequest{Username: "alice", Disabled: true}); status.Code(err) != codes.Internal {
+		t.Fatalf("got %v, want Internal", err)
+	}
+	if sm.IsUserDisabled("alice") {
+		t.Error("in-memory state changed although the database write failed")
+	}
+}
+
+func TestAdminGRPC_WatchOverview(t *testing.T) {
+	db := newGRPCTestDB(t)
+	client, _ := startTestGRPC(t, db, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.WatchOverview(ctx, &adminpb.WatchOverviewRequest{IntervalSeconds: 1})
+	if err != nil {
+		t.Fatalf("WatchOverview: %v", err)
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if first.GetTotalUpload() != 0 {
+		t.Errorf("empty database reported upload %d", first.GetTotalUpload())
+	}
+
+	now := time.Now()
+	if err := db.BatchUpsert([]TrafficRecord{{
+		Username: "alice", Domain: "example.com", Upload: 100, Download: 200, ConnCount: 1,
+		Minute: now.Format("2006-01-02T15:04:00"), Hour: now.Format("2006-01-02T15:00:00"), Timestamp: now,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if next.GetTotalUpload() != 100 || next.GetTotalDownload() != 200 || next.GetUserCount() != 1 {
+		t.Errorf("stream did not pick up new traffic: %+v", next)
+	}
+}
+
+func TestAdminGRPC_UserQuota(t *testing.T) {
+	db := newGRPCTestDB(t)
+	client, _ := startTestGRPC(t, db, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.GetUserQuota(ctx, &adminpb.GetUserQuotaRequest{Username: "alice"}); status.Code(err) != codes.NotFound {
+		t.Errorf("no quota: got %v, want NotFound", err)
+	}
+	if _, err := client.SetUserQuota(ctx, &adminpb.SetUserQuotaRequest{Username: "alice", Period: "yearly", QuotaBytes: 1 << 20}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("bad period: got %v, want InvalidArgument", err)
+	}
+	if _, err := client.SetUserQuota(ctx, &adminpb.SetUserQuotaRequest{Username: "alice"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("zero quota: got %v, want InvalidArgument", err)
+	}
+
+	st, err := client.SetUserQuota(ctx, &adminpb.SetUserQuotaRequest{Username: "alice", QuotaBytes: 1 << 20})
+	if err != nil {
+		t.Fatalf("SetUserQuota: %v", err)
+	}
+	if st.GetPeriod() != QuotaMonthly || st.GetQuotaBytes() != 1<<20 || st.GetSetBy() != "grpc:admin" || st.GetExceeded() {
+		t.Errorf("set quota = %+v", st)
+	}
+	if got, err := client.GetUserQuota(ctx, &adminpb.GetUserQuotaRequest{Username: "alice"}); err != nil || got.GetQuotaBytes() != 1<<20 || got.GetResetsAt() == "" {
+		t.Errorf("GetUserQuota = %+v, %v", got, err)
+	}
+
+	if _, err := client.DeleteUserQuota(ctx, &adminpb.DeleteUserQuotaRequest{Username: "alice"}); err != nil {
+		t.Fatalf("DeleteUserQuota: %v", err)
+	}
+	if _, err := client.DeleteUserQuota(ctx, &adminpb.DeleteUserQuotaRequest{Username: "alice"}); status.Code(err) != codes.NotFound {
+		t.Errorf("deleted twice: got %v, want NotFound", err)
+	}
+}
+
+func TestAdminGRPC_QuotaScopes(t *testing.T) {
+	db := newGRPCTestDB(t)
+	client, _ := startTestGRPC(t, db, true, "scope:stats:read")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.SetUserQuota(ctx, &adminpb.SetUserQuotaRequest{Username: "alice", QuotaBytes: 1 << 20}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("SetUserQuota with stats:read: got %v, want PermissionDenied", err)
+	}
+	if _, err := client.GetUserQuota(ctx, &adminpb.GetUserQuotaRequest{Username: "alice"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetUserQuota with stats:read: got %v, want NotFound", err)
+	}
+	if _, err := client.ListTunnels(ctx, &adminpb.ListTunnelsRequest{}); err != nil {
+		t.Errorf("ListTunnels with stats:read: %v", err)
+	}
+}
+
+func TestAdminGRPC_QuotasWithoutStatsDB(t *testing.T) {
+	client, _ := startTestGRPC(t, nil, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.GetUserQuota(ctx, &adminpb.GetUserQuotaRequest{Username: "alice"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v, want Unavailable", err)
+	}
+}
+
+func TestAdminGRPC_Tunnels(t *testing.T) {
+	client, _ := startTestGRPC(t, nil, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	id := tunnels.Register(TunnelInfo{RequestID: "grpc-test", Username: "grpc-alice", Target: "example.com:443", Started: time.Now()})
+	t.Cleanup(func() { tunnels.Unregister(id) })
+	tunnels.setCounters(id, func() (uint64, uint64) { return 10, 20 })
+
+	list, err := client.ListTunnels(ctx, &adminpb.ListTunnelsRequest{User: "grpc-alice"})
+	if err != nil {
+		t.Fatalf("ListTunnels: %v", err)
+	}
+	if len(list.GetTunnels()) != 1 {
+		t.Fatalf("tunnels = %+v", list.GetTunnels())
+	}
+	if tn := list.GetTunnels()[0]; tn.GetId() != id || tn.GetTarget() != "example.com:443" || tn.GetUpload() != 10 || tn.GetDownload() != 20 || tn.GetCertNotAfter() != "" {
+		t.Errorf("tunnel = %+v", tn)
+	}
+	if list, err := client.ListTunnels(ctx, &adminpb.ListTunnelsRequest{User: "grpc-alice", ExpiredOnly: true}); err != nil || len(list.GetTunnels()) != 0 {
+		t.Errorf("expired only = %+v, %v", list, err)
+	}
+
+	stream, err := client.WatchTunnels(ctx, &adminpb.WatchTunnelsRequest{User: "grpc-alice", IntervalSeconds: 1})
+	if err != nil {
+		t.Fatalf("WatchTunnels: %v", err)
+	}
+	if first, err := stream.Recv(); err != nil || len(first.GetTunnels()) != 1 {
+		t.Fatalf("first update = %+v, %v", first, err)
+	}
+	tunnels.Unregister(id)
+	if next, err := stream.Recv(); err != nil || len(next.GetTunnels()) != 0 {
+		t.Errorf("after close = %+v, %v", next, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// adminLangCookie holds the panel language an admin picked with ?lang=,
+// for the browser session
+const adminLangCookie = "admin_lang"
+
+// adminLanguages are the languages the panel templates are written in
+var adminLanguages = map[string]bool{"en": true, "zh": true}
+
+type adminLangKey struct{}
+
+// langCookies signs the language cookie so it can only hold a value this
+// process set. The key is per process: after a restart the cookie is
+// ignored and admins see admin.language until they pick again.
+type langCookies struct {
+	key []byte
+}
+
+func newLangCookies() langCookies {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return langCookies{key: key}
+}
+
+func (c langCookies) mac(lang string) string {
+	m := hmac.New(sha256.New, c.key)
+	m.Write([]byte(adminLangCookie + "=" + lang))
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+// value returns the signed cookie value for lang
+func (c langCookies) value(lang string) string {
+	return lang + "." + c.mac(lang)
+}
+
+// parse returns the language of a signed cookie value
+func (c langCookies) parse(value string) (string, bool) {
+	lang, sig, ok := strings.Cut(value, ".")
+	if !ok || len(c.key) == 0 || !adminLanguages[lang] || !hmac.Equal([]byte(sig), []byte(c.mac(lang))) {
+		return "", false
+	}
+	return lang, true
+}
+
+// withLanguage puts the admin's language in the request context: a ?lang=
+// toggle, which is also stored in the cookie, else the cookie, else
+// admin.language. The shared config is never changed.
+func (a *AdminServer) withLanguage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lang := a.Config.Admin.Language
+		if q := r.URL.Query().Get("lang"); adminLanguages[q] {
+			lang = q
+			http.SetCookie(w, &http.Cookie{
+				Name:     adminLangCookie,
+				Value:    a.langCookies.value(q),
+				Path:     "/",
+				Secure:   true,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		} else if cookie, err := r.Cookie(adminLangCookie); err == nil {
+			if l, ok := a.langCookies.parse(cookie.Value); ok {
+				lang = l
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminLangKey{}, lang)))
+	})
+}
+
+// adminLanguage returns the language withLanguage resolved for r
+func (a *AdminServer) adminLanguage(r *http.Request) string {
+	if lang, ok := r.Context().Value(adminLangKey{}).(string); ok {
+		return lang
+	}
+	return a.Config.Admin.Language
+}
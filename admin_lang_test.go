@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminLanguage_PerSession(t *testing.T) {
+	cfg := &Config{}
+	cfg.Admin.Language = "en"
+	a := &AdminServer{Config: cfg, langCookies: newLangCookies()}
+	handler := a.withLanguage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(a.adminLanguage(r)))
+	}))
+	serve := func(url string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	// One admin switches to Chinese
+	rec := serve("/?lang=zh")
+	if rec.Body.String() != "zh" {
+		t.Fatalf("toggle language = %q", rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].Secure || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %+v", cookies)
+	}
+	if got := serve("/user/alice", cookies[0]).Body.String(); got != "zh" {
+		t.Errorf("language from cookie = %q", got)
+	}
+
+	// Other admins and the shared config are unaffected
+	if got := serve("/").Body.String(); got != "en" {
+		t.Errorf("other session language = %q", got)
+	}
+	if cfg.Admin.Language != "en" {
+		t.Errorf("config language changed to %q", cfg.Admin.Language)
+	}
+
+	// Forged, foreign and unsupported values fall back to the default
+	for _, value := range []string{"zh", "zh.0000", newLangCookies().value("zh"), "fr." + a.langCookies.mac("fr")} {
+		if got := serve("/", &http.Cookie{Name: adminLangCookie, Value: value}).Body.String(); got != "en" {
+			t.Errorf("cookie %q gave %q", value, got)
+		}
+	}
+	if got := serve("/?lang=fr").Body.String(); got != "en" {
+		t.Errorf("unsupported toggle gave %q", got)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Admin API scopes. Every admin endpoint requires one of them.
+const (
+	ScopeStatsRead   = "stats:read"   // Dashboards and every read-only endpoint
+	ScopeUsersWrite  = "users:write"  // Enabling, disabling and editing users
+	ScopeConfigWrite = "config:write" // Settings, maintenance, storage and other server changes
+	ScopeCertsIssue  = "certs:issue"  // Trial accounts and provisioning links, which issue certificates
+	// Stats with usernames replaced by pseudonyms, for sharing with third
+	// parties; only stats:read shows the names
+	ScopeStatsPseudonymized = "stats:pseudonymized"
+)
+
+var allScopes = []string{ScopeStatsRead, ScopeUsersWrite, ScopeConfigWrite, ScopeCertsIssue, ScopeStatsPseudonymized}
+
+// scopeOUPrefix marks the admin certificate OUs that grant a scope, e.g.
+// OU=scope:stats:read. A certificate without any has every scope, as admin
+// certificates had before scopes existed.
+const scopeOUPrefix = "scope:"
+
+// APITokenConfig is an admin API token. Requests send the token as
+// "Authorization: Bearer <token>" and need no client certificate.
+type APITokenConfig struct {
+	Name        string   `json:"name"`         // Shown as the actor in logs and user events
+	TokenSHA256 string   `json:"token_sha256"` // Hex SHA-256 of the token; the token itself is not stored
+	Scopes      []string `json:"scopes"`
+}
+
+// apiToken is a configured token ready for comparison
+type apiToken struct {
+	name   string
+	hash   []byte
+	scopes map[string]bool
+}
+
+// adminPrincipal is who an admin request was authenticated as
+type adminPrincipal struct {
+	name   string
+	scopes map[string]bool
+}
+
+type adminPrincipalKey struct{}
+
+// loadAPITokens parses the configured tokens. Tokens with an invalid hash
+// or unknown scopes are logged and ignored.
+func loadAPITokens(configs []APITokenConfig) []apiToken {
+	var tokens []apiToken
+	for _, c := range configs {
+		hash, err := hex.DecodeString(c.TokenSHA256)
+		if err != nil || len(hash) != sha256.Size {
+			log.Printf("admin.api_tokens %q: token_sha256 must be a hex SHA-256, ignored", c.Name)
+			continue
+		}
+		t := apiToken{name: c.Name, hash: hash, scopes: make(map[string]bool)}
+		valid := true
+		for _, s := range c.Scopes {
+			if !isScope(s) {
+				log.Printf("admin.api_tokens %q: unknown scope %q, ignored", c.Name, s)
+				valid = false
+				break
+			}
+			t.scopes[s] = true
+		}
+		if valid {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+func isScope(s string) bool {
+	for _, scope := range allScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// certScopes returns the scopes granted by an admin certificate's OUs
+func certScopes(cert *x509.Certificate) map[string]bool {
+	scopes := make(map[string]bool)
+	found := false
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if s, ok := strings.CutPrefix(ou, scopeOUPrefix); ok {
+			found = true
+			if isScope(s) {
+				scopes[s] = true
+			}
+		}
+	}
+	if !found {
+		for _, s := range allScopes {
+			scopes[s] = true
+		}
+	}
+	return scopes
+}
+
+// requiredScope returns the scope an admin request needs
+func requiredScope(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/api/v2/users/") && strings.HasSuffix(path, "/provision.png"),
+		path == "/api/v2/users/trial" && r.Method == http.MethodPost:
+		return ScopeCertsIssue
+	case strings.HasPrefix(path, "/api/v2/config/history"):
+		// Saved versions hold the whole config file, settings a reader of
+		// the stats has no business seeing
+		return ScopeConfigWrite
+	case r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions,
+		path == "/api/v2/policy/simulate":
+		return ScopeStatsRead
+	case strings.HasPrefix(path, "/api/v2/users") || strings.HasPrefix(path, "/api/user/"):
+		return ScopeUsersWrite
+	default:
+		return ScopeConfigWrite
+	}
+}
+
+// authenticate identifies the admin by client certificate or API token and
+// refuses requests lacking the endpoint's scope. Tokens only reach the API.
+// API calls, refused ones included, are counted per admin.
+func (a *AdminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var principal *adminPrincipal
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			cert := r.TLS.PeerCertificates[0]
+			principal = &adminPrincipal{name: cert.Subject.CommonName, scopes: certScopes(cert)}
+		} else if t := a.matchToken(r); t != nil {
+			if !strings.HasPrefix(r.URL.Path, "/api/") && r.URL.Path != "/metrics" && r.URL.Path != "/readyz" {
+				writeJSONResponse(w, WebResponse{Success: false, Error: "API tokens are limited to the API"}, http.StatusForbidden)
+				return
+			}
+			principal = &adminPrincipal{name: "token:" + t.name, scopes: t.scopes}
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Unauthorized"}, http.StatusUnauthorized)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), adminPrincipalKey{}, principal))
+		if a.usage != nil && isAdminAPIPath(r.URL.Path) {
+			uw := &usageWriter{ResponseWriter: w}
+			defer func() {
+				a.usage.Record(principal.name, r.Method, adminEndpoint(r.URL.Path), uw.status >= 400, time.Now())
+			}()
+			w = uw
+		}
+		scope := requiredScope(r)
+		if !principal.scopes[scope] && scope == ScopeStatsRead && principal.scopes[ScopeStatsPseudonymized] && pseudonymizable(r.URL.Path) {
+			a.servePseudonymized(w, r, next)
+			return
+		}
+		if !principal.scopes[scope] {
+			log.Printf("Admin %s denied %s %s: missing scope %s", principal.name, r.Method, r.URL.Path, scope)
+			writeJSONResponse(w, WebResponse{Success: false, Error: "missing scope: " + scope}, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// matchToken returns the token of the request's bearer credentials
+func (a *AdminServer) matchToken(r *http.Request) *apiToken {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || bearer == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(bearer)))
+	for i := range a.apiTokens {
+		if subtle.ConstantTimeCompare(sum[:], a.apiTokens[i].hash) == 1 {
+			return &a.apiTokens[i]
+		}
+	}
+	return nil
+}
+
+// grpcMethodScope returns the scope a gRPC admin method needs
+func grpcMethodScope(fullMethod string) string {
+	switch fullMethod[strings.LastIndex(fullMethod, "/")+1:] {
+	case "SetUserDisabled", "SetUserQuota", "DeleteUserQuota":
+		return ScopeUsersWrite
+	default:
+		return ScopeStatsRead
+	}
+}
+
+// grpcCheckScope refuses callers whose certificate lacks the method's
+// scope. It returns the caller's name, if it has a certificate.
+func grpcCheckScope(ctx context.Context, fullMethod string) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "client certificate required")
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return "", status.Error(codes.Unauthenticated, "client certificate required")
+	}
+	cert := info.State.PeerCertificates[0]
+	if scope := grpcMethodScope(fullMethod); !certScopes(cert)[scope] {
+		return cert.Subject.CommonName, status.Error(codes.PermissionDenied, "missing scope: "+scope)
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// grpcScopeInterceptors enforce scopes on unary and streaming admin calls
+// and count the calls of each certificate in usage
+func grpcScopeInterceptors(usage *AdminUsage) []grpc.ServerOption {
+	record := func(name, fullMethod string, err error) {
+		if name != "" {
+			usage.Record(name, "GRPC", fullMethod, err != nil, time.Now())
+		}
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			name, err := grpcCheckScope(ctx, info.FullMethod)
+			if err != nil {
+				record(name, info.FullMethod, err)
+				return nil, err
+			}
+			resp, err := handler(ctx, req)
+			record(name, info.FullMethod, err)
+			return resp, err
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			name, err := grpcCheckScope(ss.Context(), info.FullMethod)
+			if err == nil {
+				err = handler(srv, ss)
+			}
+			record(name, info.FullMethod, err)
+			return err
+		}),
+	}
+}
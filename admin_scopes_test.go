@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuthenticate_Scopes(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret"))
+	a := &AdminServer{apiTokens: loadAPITokens([]APITokenConfig{
+		{Name: "grafana", TokenSHA256: hex.EncodeToString(sum[:]), Scopes: []string{ScopeStatsRead}},
+		{Name: "broken", TokenSHA256: "not-hex", Scopes: []string{ScopeStatsRead}},
+		{Name: "typo", TokenSHA256: hex.EncodeToString(sum[:]), Scopes: []string{"stats:raed"}},
+	})}
+	if len(a.apiTokens) != 1 {
+		t.Fatalf("loaded %d tokens, want 1", len(a.apiTokens))
+	}
+	var actor string
+	handler := a.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actor = adminName(r)
+	}))
+	withCert := func(r *http.Request, ous ...string) *http.Request {
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "ops", OrganizationalUnit: ous}}}}
+		return r
+	}
+	withToken := func(r *http.Request, token string) *http.Request {
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+
+	for _, tc := range []struct {
+		name   string
+		req    *http.Request
+		status int
+		scope  string
+	}{
+		{"no credentials", httptest.NewRequest(http.MethodGet, "/api/v2/overview", nil), http.StatusUnauthorized, ""},
+		{"wrong token", withToken(httptest.NewRequest(http.MethodGet, "/api/v2/overview", nil), "guess"), http.StatusUnauthorized, ""},
+		{"token read", withToken(httptest.NewRequest(http.MethodGet, "/api/v2/overview", nil), "s3cret"), http.StatusOK, ""},
+		{"token write", withToken(httptest.NewRequest(http.MethodPost, "/api/v2/users/bulk", nil), "s3cret"), http.StatusForbidden, ScopeUsersWrite},
+		{"token web page", withToken(httptest.NewRequest(http.MethodGet, "/dashboard/", nil), "s3cret"), http.StatusForbidden, ""},
+		{"legacy cert", withCert(httptest.NewRequest(http.MethodPost, "/api/config", nil)), http.StatusOK, ""},
+		{"scoped cert", withCert(httptest.NewRequest(http.MethodPost, "/api/config", nil), "scope:stats:read", "scope:users:write"), http.StatusForbidden, ScopeConfigWrite},
+		{"scoped cert user", withCert(httptest.NewRequest(http.MethodPost, "/api/user/disable/bob", nil), "scope:users:write"), http.StatusOK, ""},
+		{"provision", withCert(httptest.NewRequest(http.MethodGet, "/api/v2/users/bob/provision.png", nil), "scope:stats:read"), http.StatusForbidden, ScopeCertsIssue},
+		{"trial", withCert(httptest.NewRequest(http.MethodPost, "/api/v2/users/trial", nil), "scope:users:write"), http.StatusForbidden, ScopeCertsIssue},
+		{"config history", withToken(httptest.NewRequest(http.MethodGet, "/api/v2/config/history", nil), "s3cret"), http.StatusForbidden, ScopeConfigWrite},
+		{"config version", withCert(httptest.NewRequest(http.MethodGet, "/api/v2/config/history/20260101T000000Z", nil), "scope:stats:read", "scope:users:write"), http.StatusForbidden, ScopeConfigWrite},
+		{"config version writer", withCert(httptest.NewRequest(http.MethodGet, "/api/v2/config/history/20260101T000000Z", nil), "scope:config:write"), http.StatusOK, ""},
+		{"simulate", withCert(httptest.NewRequest(http.MethodPost, "/api/v2/policy/simulate", nil), "scope:stats:read"), http.StatusOK, ""},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tc.req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, rec.Code, tc.status)
+			continue
+		}
+		if tc.scope != "" {
+			var resp WebResponse
+			json.NewDecoder(rec.Body).Decode(&resp)
+			if resp.Error != "missing scope: "+tc.scope {
+				t.Errorf("%s: error %q", tc.name, resp.Error)
+			}
+		}
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), withToken(httptest.NewRequest(http.MethodGet, "/metrics", nil), "s3cret"))
+	if actor != "token:grafana" {
+		t.Errorf("actor = %q", actor)
+	}
+
+	for method, want := range map[string]string{
+		"/httpsproxy.admin.v1.AdminService/SetUserDisabled": ScopeUsersWrite,
+		"/httpsproxy.admin.v1.AdminService/SetUserQuota":    ScopeUsersWrite,
+		"/httpsproxy.admin.v1.AdminService/DeleteUserQuota": ScopeUsersWrite,
+		"/httpsproxy.admin.v1.AdminService/GetUserQuota":    ScopeStatsRead,
+		"/httpsproxy.admin.v1.AdminService/ListTunnels":     ScopeStatsRead,
+		"/httpsproxy.admin.v1.AdminService/WatchTunnels":    ScopeStatsRead,
+		"/httpsproxy.admin.v1.AdminService/ListUsers":       ScopeStatsRead,
+	} {
+		if got := grpcMethodScope(method); got != want {
+			t.Errorf("gRPC %s scope = %s, want %s", method, got, want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// AdminSecurityConfig adjusts the security headers of admin responses, for
+// operators embedding the panel in other tooling
+type AdminSecurityConfig struct {
+	ContentSecurityPolicy string   `json:"content_security_policy"` // Replaces the built-in policy; "off" sends none
+	FrameAncestors        []string `json:"frame_ancestors"`         // Origins that may embed the panel, e.g. "https://grafana.example.com"; none by default
+	ReferrerPolicy        string   `json:"referrer_policy"`         // Default same-origin
+}
+
+// defaultAdminCSP allows the panel's inline scripts and styles and the
+// remote map resources of the Regions page, and nothing else
+const defaultAdminCSP = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline' https://unpkg.com; " +
+	"style-src 'self' 'unsafe-inline' https://unpkg.com; " +
+	"img-src 'self' data: https://unpkg.com https://*.basemaps.cartocdn.com; " +
+	"connect-src 'self' https://cdn.jsdelivr.net; " +
+	"object-src 'none'; base-uri 'self'; form-action 'self'"
+
+// csrfHeader carries the CSRF token of state-changing panel requests
+const csrfHeader = "X-CSRF-Token"
+
+// securityHeaders sets the standard security headers on every admin
+// response
+func (a *AdminServer) securityHeaders(next http.Handler) http.Handler {
+	sc := a.Config.Admin.Security
+	csp := sc.ContentSecurityPolicy
+	if csp == "" {
+		csp = defaultAdminCSP
+	}
+	ancestors := "'none'"
+	if len(sc.FrameAncestors) > 0 {
+		ancestors = strings.Join(sc.FrameAncestors, " ")
+	}
+	// A custom policy naming its own frame-ancestors keeps them
+	if csp != "off" && !strings.Contains(csp, "frame-ancestors") {
+		csp += "; frame-ancestors " + ancestors
+	}
+	referrer := sc.ReferrerPolicy
+	if referrer == "" {
+		referrer = "same-origin"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if csp != "off" {
+			h.Set("Content-Security-Policy", csp)
+		}
+		if len(sc.FrameAncestors) == 0 {
+			// For browsers predating frame-ancestors
+			h.Set("X-Frame-Options", "DENY")
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", referrer)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfTokens issues the CSRF tokens of the panel's pages: an HMAC of the
+// admin's certificate name, so a page only works for the admin it was
+// rendered for. The key is per process: pages opened before a restart
+// must be reloaded.
+type csrfTokens struct {
+	key []byte
+}
+
+func newCSRFTokens() csrfTokens {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return csrfTokens{key: key}
+}
+
+// token returns the CSRF token of admin
+func (c csrfTokens) token(admin string) string {
+	m := hmac.New(sha256.New, c.key)
+	m.Write([]byte("csrf:" + admin))
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+// valid reports whether token is admin's
+func (c csrfTokens) valid(admin, token string) bool {
+	return len(c.key) > 0 && hmac.Equal([]byte(token), []byte(c.token(admin)))
+}
+
+// checkCSRF refuses state-changing requests a browser sent with the
+// admin's client certificate but without the token of a panel page, as a
+// page on another site would. API tokens are never sent by browsers on
+// their own, and certificate holders' scripts send none of the headers
+// browsers add, so neither needs the token.
+func (a *AdminServer) checkCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		fromBrowser := r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != "" || r.Header.Get("Referer") != ""
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 && fromBrowser && !a.csrf.valid(adminName(r), r.Header.Get(csrfHeader)) {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "invalid CSRF token"}, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminCheckCSRF(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret"))
+	a := &AdminServer{
+		csrf:      newCSRFTokens(),
+		apiTokens: loadAPITokens([]APITokenConfig{{Name: "ci", TokenSHA256: hex.EncodeToString(sum[:]), Scopes: []string{ScopeUsersWrite}}}),
+	}
+	handler := a.authenticate(a.checkCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	req := func(method, cn string, header ...string) *http.Request {
+		r := httptest.NewRequest(method, "/api/user/disable/bob", nil)
+		if cn != "" {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}}}}
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		return r
+	}
+	token := a.csrf.token("ops")
+
+	for _, tc := range []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"read", req(http.MethodGet, "ops", "Origin", "https://evil.example"), http.StatusOK},
+		{"cross-site form", req(http.MethodPost, "ops", "Origin", "https://evil.example", "Sec-Fetch-Site", "cross-site"), http.StatusForbidden},
+		{"panel page", req(http.MethodPost, "ops", "Origin", "https://admin.example", csrfHeader, token), http.StatusOK},
+		{"another admin's page", req(http.MethodPost, "dev", "Sec-Fetch-Site", "same-origin", csrfHeader, token), http.StatusForbidden},
+		{"forged token", req(http.MethodPost, "ops", "Referer", "https://admin.example/user/bob", csrfHeader, "0000"), http.StatusForbidden},
+		{"certificate script", req(http.MethodPost, "ops"), http.StatusOK},
+		{"API token", req(http.MethodPost, "", "Authorization", "Bearer s3cret", "Origin", "https://evil.example"), http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, tc.req)
+		if rec.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", tc.name, rec.Code, tc.status)
+		}
+	}
+}
+
+func TestAdminSecurityHeaders(t *testing.T) {
+	get := func(sc AdminSecurityConfig) http.Header {
+		a := &AdminServer{Config: &Config{}}
+		a.Config.Admin.Security = sc
+		rec := httptest.NewRecorder()
+		a.securityHeaders(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rec.Header()
+	}
+
+	h := get(AdminSecurityConfig{})
+	if csp := h.Get("Content-Security-Policy"); !strings.HasPrefix(csp, defaultAdminCSP) || !strings.HasSuffix(csp, "frame-ancestors 'none'") {
+		t.Errorf("default CSP = %q", csp)
+	}
+	if h.Get("X-Frame-Options") != "DENY" || h.Get("X-Content-Type-Options") != "nosniff" || h.Get("Referrer-Policy") != "same-origin" {
+		t.Errorf("default headers = %v", h)
+	}
+
+	// Embedded in a Grafana panel
+	h = get(AdminSecurityConfig{FrameAncestors: []string{"'self'", "https://grafana.example.com"}, ReferrerPolicy: "no-referrer"})
+	if csp := h.Get("Content-Security-Policy"); !strings.HasSuffix(csp, "frame-ancestors 'self' https://grafana.example.com") {
+		t.Errorf("embedded CSP = %q", csp)
+	}
+	if h.Get("X-Frame-Options") != "" || h.Get("Referrer-Policy") != "no-referrer" {
+		t.Errorf("embedded headers = %v", h)
+	}
+
+	h = get(AdminSecurityConfig{ContentSecurityPolicy: "default-src 'self'; frame-ancestors https://tools.example"})
+	if csp := h.Get("Content-Security-Policy"); csp != "default-src 'self'; frame-ancestors https://tools.example" {
+		t.Errorf("custom CSP = %q", csp)
+	}
+	if h = get(AdminSecurityConfig{ContentSecurityPolicy: "off"}); h.Get("Content-Security-Policy") != "" || h.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("CSP off = %v", h)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	adminUsageFlush    = time.Minute // Time between writes of the buffered calls
+	adminUsageMaxKeys  = 1000        // Buffered endpoints before new ones go to adminUsageOther
+	adminEndpointMax   = 128
+	adminUsageOther    = "(other)"
+	adminUsageTokenPfx = "token:"
+	adminIdle          = 30 * 24 * time.Hour // Unused this long, a credential is likely forgotten
+)
+
+// adminEndpointParams are the API paths whose next segment names a user,
+// group, country or change rather than an endpoint
+var adminEndpointParams = []struct {
+	prefix, param string
+	fixed         []string // Endpoints under prefix that are not parameters
+}{
+	{"/api/v2/users/", "{user}", []string{"bulk", "trial", "certs"}},
+	{"/api/stats/user/", "{user}", nil},
+	{"/api/user/enable/", "{user}", nil},
+	{"/api/user/disable/", "{user}", nil},
+	{"/api/v2/groups/", "{group}", nil},
+	{"/api/v2/countries/", "{country}", nil},
+	{"/api/v2/config/history/", "{id}", nil},
+}
+
+// adminEndpoint returns the endpoint a request path is recorded under: the
+// path with user names, country codes and change IDs replaced, so usage
+// is counted per endpoint rather than per user
+func adminEndpoint(path string) string {
+	for _, p := range adminEndpointParams {
+		rest, ok := strings.CutPrefix(path, p.prefix)
+		if !ok || rest == "" {
+			continue
+		}
+		segment, tail, _ := strings.Cut(rest, "/")
+		if slices.Contains(p.fixed, segment) {
+			break
+		}
+		path = p.prefix + p.param
+		if tail != "" {
+			path += "/" + tail
+		}
+		break
+	}
+	if len(path) > adminEndpointMax {
+		path = path[:adminEndpointMax]
+	}
+	return path
+}
+
+// adminUsageKey identifies what the calls of an admin were made to
+type adminUsageKey struct {
+	Principal string // Certificate CN, or "token:" and the token's name
+	Method    string
+	Endpoint  string
+}
+
+// adminUsageAgg counts the buffered calls to an endpoint
+type adminUsageAgg struct {
+	Calls     uint64
+	Errors    uint64
+	FirstUsed time.Time
+	LastUsed  time.Time
+}
+
+// AdminUsage counts the admin API calls of each certificate and token, so
+// operators can find automation still holding credentials before revoking
+// them. Calls are buffered and written to the stats database every
+// minute.
+type AdminUsage struct {
+	db *StatsDB
+
+	mu      sync.Mutex
+	pending map[adminUsageKey]*adminUsageAgg
+}
+
+// NewAdminUsage returns nil without a writable stats database
+func NewAdminUsage(db *StatsDB) *AdminUsage {
+	if db == nil || db.ReadOnly() {
+		return nil
+	}
+	return &AdminUsage{db: db, pending: make(map[adminUsageKey]*adminUsageAgg)}
+}
+
+// Record counts a call of principal; failed calls were answered with an
+// error status
+func (u *AdminUsage) Record(principal, method, endpoint string, failed bool, now time.Time) {
+	if u == nil {
+		return
+	}
+	key := adminUsageKey{Principal: principal, Method: method, Endpoint: endpoint}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	agg, ok := u.pending[key]
+	if !ok && len(u.pending) >= adminUsageMaxKeys {
+		key.Method, key.Endpoint = "", adminUsageOther
+		agg, ok = u.pending[key]
+	}
+	if !ok {
+		agg = &adminUsageAgg{FirstUsed: now}
+		u.pending[key] = agg
+	}
+	agg.Calls++
+	if failed {
+		agg.Errors++
+	}
+	agg.LastUsed = now
+}
+
+// Flush writes the buffered calls. They are kept for the next flush if the
+// write fails.
+func (u *AdminUsage) Flush(ctx context.Context) error {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = make(map[adminUsageKey]*adminUsageAgg)
+	u.mu.Unlock()
+	if err := u.db.UpsertAdminUsage(ctx, pending); err != nil {
+		u.mu.Lock()
+		for key, agg := range pending {
+			if cur, ok := u.pending[key]; ok {
+				cur.Calls += agg.Calls
+				cur.Errors += agg.Errors
+				cur.FirstUsed = agg.FirstUsed
+			} else {
+				u.pending[key] = agg
+			}
+		}
+		u.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Run flushes the buffered calls every minute, forever
+func (u *AdminUsage) Run() {
+	if u == nil {
+		return
+	}
+	ticker := time.NewTicker(adminUsageFlush)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := u.Flush(context.Background()); err != nil {
+			log.Printf("Admin API usage: %v", err)
+		}
+	}
+}
+
+// usageWriter remembers the status of an admin response
+type usageWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *usageWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *usageWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *usageWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isAdminAPIPath reports whether path is one whose calls are counted
+func isAdminAPIPath(path string) bool {
+	return strings.HasPrefix(path, "/api/") || path == "/metrics" || path == "/readyz"
+}
+
+// AdminIntegration is a certificate or token and the API calls made with
+// it
+type AdminIntegration struct {
+	Name       string         `json:"name"` // Certificate CN, or "token:" and the token's name
+	Kind       string         `json:"kind"` // "certificate" or "token"
+	Configured bool           `json:"configured"`
+	Calls      uint64         `json:"calls"`
+	Errors     uint64         `json:"errors"`
+	FirstUsed  *time.Time     `json:"first_used,omitempty"`
+	LastUsed   *time.Time     `json:"last_used,omitempty"` // Absent for tokens never used
+	Endpoints  []DBAdminUsage `json:"endpoints"`
+}
+
+// Idle reports whether the credential was never used or not for a month,
+// making it a candidate for revocation
+func (in AdminIntegration) Idle() bool {
+	return in.LastUsed == nil || time.Since(*in.LastUsed) > adminIdle
+}
+
+// integrations returns the recorded callers of the API and the configured
+// tokens that never called it, those unused the longest first. Tokens
+// absent from admin.api_tokens are listed as not configured.
+func (a *AdminServer) integrations(ctx context.Context) ([]AdminIntegration, error) {
+	if err := a.usage.Flush(ctx); err != nil {
+		log.Printf("Admin API usage: %v", err)
+	}
+	usage, err := a.StatsDB.GetAdminUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	configured := make(map[string]bool)
+	for _, t := range a.apiTokens {
+		configured[adminUsageTokenPfx+t.name] = true
+	}
+
+	byName := make(map[string]*AdminIntegration)
+	var out []*AdminIntegration
+	get := func(name string) *AdminIntegration {
+		if in, ok := byName[name]; ok {
+			return in
+		}
+		in := &AdminIntegration{Name: name, Kind: "certificate", Configured: true, Endpoints: []DBAdminUsage{}}
+		if strings.HasPrefix(name, adminUsageTokenPfx) {
+			in.Kind, in.Configured = "token", configured[name]
+		}
+		byName[name] = in
+		out = append(out, in)
+		return in
+	}
+	for _, u := range usage {
+		in := get(u.Principal)
+		in.Calls += u.Calls
+		in.Errors += u.Errors
+		if in.FirstUsed == nil || u.FirstUsed.Before(*in.FirstUsed) {
+			in.FirstUsed = &u.FirstUsed
+		}
+		if in.LastUsed == nil || u.LastUsed.After(*in.LastUsed) {
+			in.LastUsed = &u.LastUsed
+		}
+		in.Endpoints = append(in.Endpoints, u)
+	}
+	for _, t := range a.apiTokens {
+		get(adminUsageTokenPfx + t.name)
+	}
+
+	slices.SortStableFunc(out, func(x, y *AdminIntegration) int {
+		switch {
+		case x.LastUsed == nil && y.LastUsed == nil:
+			return strings.Compare(x.Name, y.Name)
+		case x.LastUsed == nil:
+			return -1
+		case y.LastUsed == nil:
+			return 1
+		}
+		return x.LastUsed.Compare(*y.LastUsed)
+	})
+	list := make([]AdminIntegration, len(out))
+	for i, in := range out {
+		list[i] = *in
+	}
+	return list, nil
+}
+
+// handleAPIIntegrations returns the admin API usage of every certificate
+// and token
+func (a *AdminServer) handleAPIIntegrations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+	if a.StatsDB == nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Stats database not available"}, http.StatusServiceUnavailable)
+		return
+	}
+	list, err := a.integrations(r.Context())
+	if err != nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, WebResponse{Success: true, Data: list}, http.StatusOK)
+}
+
+// handleIntegrations renders the integrations page
+func (a *AdminServer) handleIntegrations(w http.ResponseWriter, r *http.Request) {
+	if !a.isAdmin(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	data := pageData{
+		Title:       "HTTPS Proxy - Integrations",
+		LastUpdated: time.Now(),
+		Config:      a.Config,
+		Language:    a.adminLanguage(r),
+		CSRFToken:   a.csrf.token(adminName(r)),
+	}
+	if a.StatsDB != nil {
+		list, err := a.integrations(r.Context())
+		if err != nil {
+			log.Printf("Error reading admin API usage: %v", err)
+		}
+		data.Integrations = list
+	}
+	if err := a.Templates.ExecuteTemplate(w, "integrations.html", data); err != nil {
+		log.Printf("Error rendering integrations template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminEndpoint(t *testing.T) {
+	for path, want := range map[string]string{
+		"/api/v2/overview":               "/api/v2/overview",
+		"/api/v2/users/alice":            "/api/v2/users/{user}",
+		"/api/v2/users/alice/quota":      "/api/v2/users/{user}/quota",
+		"/api/v2/users/bulk":             "/api/v2/users/bulk",
+		"/api/v2/users/":                 "/api/v2/users/",
+		"/api/user/disable/bob":          "/api/user/disable/{user}",
+		"/api/v2/countries/DE":           "/api/v2/countries/{country}",
+		"/api/v2/groups/family/quota":    "/api/v2/groups/{group}/quota",
+		"/api/v2/config/history/12/diff": "/api/v2/config/history/{id}/diff",
+	} {
+		if got := adminEndpoint(path); got != want {
+			t.Errorf("adminEndpoint(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestAdminUsage(t *testing.T) {
+	db := newExpiryTestDB(t)
+	token := func(name, secret string) APITokenConfig {
+		sum := sha256.Sum256([]byte(secret))
+		return APITokenConfig{Name: name, TokenSHA256: hex.EncodeToString(sum[:]), Scopes: []string{ScopeStatsRead}}
+	}
+	a := &AdminServer{
+		Config:    &Config{},
+		StatsDB:   db,
+		apiTokens: loadAPITokens([]APITokenConfig{token("grafana", "g"), token("old-ci", "c")}),
+		usage:     NewAdminUsage(db),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/users/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/api/v2/integrations", a.handleAPIIntegrations)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	handler := a.authenticate(mux)
+	call := func(method, path, bearer string) {
+		r := httptest.NewRequest(method, path, nil)
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		} else {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "ops"}}}}
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	call(http.MethodGet, "/api/v2/users/alice", "g")
+	call(http.MethodGet, "/api/v2/users/bob", "g")
+	call(http.MethodPost, "/api/v2/users/bob/disable", "g") // lacks users:write
+	call(http.MethodGet, "/api/v2/users/bob", "")
+	call(http.MethodGet, "/", "") // the panel itself is not counted
+	call(http.MethodGet, "/api/v2/users/x", "nope")
+	if err := a.usage.Flush(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	// A removed token's calls stay listed
+	db.UpsertAdminUsage(t.Context(), map[adminUsageKey]*adminUsageAgg{
+		{Principal: "token:legacy", Method: http.MethodGet, Endpoint: "/metrics"}: {Calls: 7, FirstUsed: time.Now().AddDate(0, -3, 0), LastUsed: time.Now().AddDate(0, -2, 0)},
+	})
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/v2/integrations", nil)
+	r.Header.Set("Authorization", "Bearer g")
+	handler.ServeHTTP(rec, r)
+	var resp struct {
+		Data []AdminIntegration `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("integrations: %d, %v", rec.Code, err)
+	}
+	list := resp.Data
+	if len(list) != 4 {
+		t.Fatalf("integrations = %+v", list)
+	}
+	// Unused the longest first
+	if in := list[0]; in.Name != "token:old-ci" || in.LastUsed != nil || !in.Configured || !in.Idle() {
+		t.Errorf("never used token = %+v", in)
+	}
+	if in := list[1]; in.Name != "token:legacy" || in.Configured || in.Calls != 7 || !in.Idle() {
+		t.Errorf("removed token = %+v", in)
+	}
+	byName := make(map[string]AdminIntegration)
+	for _, in := range list {
+		byName[in.Name] = in
+	}
+	grafana := byName["token:grafana"]
+	if grafana.Kind != "token" || grafana.Calls != 3 || grafana.Errors != 1 || len(grafana.Endpoints) != 2 || grafana.Idle() {
+		t.Errorf("grafana = %+v", grafana)
+	}
+	if e := grafana.Endpoints[0]; e.Method != http.MethodGet || e.Endpoint != "/api/v2/users/{user}" || e.Calls != 2 {
+		t.Errorf("grafana's busiest endpoint = %+v", e)
+	}
+	if ops := byName["ops"]; ops.Kind != "certificate" || ops.Calls != 1 {
+		t.Errorf("ops = %+v", ops)
+	}
+}
@@ -0,0 +1,1882 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        v5.29.3
+// source: admin.proto
+
+package adminpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type User struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	TotalUpload   uint64                 `protobuf:"varint,2,opt,name=total_upload,json=totalUpload,proto3" json:"total_upload,omitempty"`
+	TotalDownload uint64                 `protobuf:"varint,3,opt,name=total_download,json=totalDownload,proto3" json:"total_download,omitempty"`
+	ConnCount     uint64                 `protobuf:"varint,4,opt,name=conn_count,json=connCount,proto3" json:"conn_count,omitempty"`
+	RequestCount  uint64                 `protobuf:"varint,5,opt,name=request_count,json=requestCount,proto3" json:"request_count,omitempty"`
+	FirstSeen     string                 `protobuf:"bytes,6,opt,name=first_seen,json=firstSeen,proto3" json:"first_seen,omitempty"`
+	LastAccess    string                 `protobuf:"bytes,7,opt,name=last_access,json=lastAccess,proto3" json:"last_access,omitempty"`
+	Disabled      bool                   `protobuf:"varint,8,opt,name=disabled,proto3" json:"disabled,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *User) Reset() {
+	*x = User{}
+	mi := &file_admin_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *User) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*User) ProtoMessage() {}
+
+func (x *User) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use User.ProtoReflect.Descriptor instead.
+func (*User) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *User) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *User) GetTotalUpload() uint64 {
+	if x != nil {
+		return x.TotalUpload
+	}
+	return 0
+}
+
+func (x *User) GetTotalDownload() uint64 {
+	if x != nil {
+		return x.TotalDownload
+	}
+	return 0
+}
+
+func (x *User) GetConnCount() uint64 {
+	if x != nil {
+		return x.ConnCount
+	}
+	return 0
+}
+
+func (x *User) GetRequestCount() uint64 {
+	if x != nil {
+		return x.RequestCount
+	}
+	return 0
+}
+
+func (x *User) GetFirstSeen() string {
+	if x != nil {
+		return x.FirstSeen
+	}
+	return ""
+}
+
+func (x *User) GetLastAccess() string {
+	if x != nil {
+		return x.LastAccess
+	}
+	return ""
+}
+
+func (x *User) GetDisabled() bool {
+	if x != nil {
+		return x.Disabled
+	}
+	return false
+}
+
+type ListUsersRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListUsersRequest) Reset() {
+	*x = ListUsersRequest{}
+	mi := &file_admin_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListUsersRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListUsersRequest) ProtoMessage() {}
+
+func (x *ListUsersRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListUsersRequest.ProtoReflect.Descriptor instead.
+func (*ListUsersRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{1}
+}
+
+type ListUsersResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Users         []*User                `protobuf:"bytes,1,rep,name=users,proto3" json:"users,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListUsersResponse) Reset() {
+	*x = ListUsersResponse{}
+	mi := &file_admin_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListUsersResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListUsersResponse) ProtoMessage() {}
+
+func (x *ListUsersResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListUsersResponse.ProtoReflect.Descriptor instead.
+func (*ListUsersResponse) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ListUsersResponse) GetUsers() []*User {
+	if x != nil {
+		return x.Users
+	}
+	return nil
+}
+
+type GetUserRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetUserRequest) Reset() {
+	*x = GetUserRequest{}
+	mi := &file_admin_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetUserRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetUserRequest) ProtoMessage() {}
+
+func (x *GetUserRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetUserRequest.ProtoReflect.Descriptor instead.
+func (*GetUserRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *GetUserRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+type SetUserDisabledRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	Disabled      bool                   `protobuf:"varint,2,opt,name=disabled,proto3" json:"disabled,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetUserDisabledRequest) Reset() {
+	*x = SetUserDisabledRequest{}
+	mi := &file_admin_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetUserDisabledRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetUserDisabledRequest) ProtoMessage() {}
+
+func (x *SetUserDisabledRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetUserDisabledRequest.ProtoReflect.Descriptor instead.
+func (*SetUserDisabledRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *SetUserDisabledRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *SetUserDisabledRequest) GetDisabled() bool {
+	if x != nil {
+		return x.Disabled
+	}
+	return false
+}
+
+type SetUserDisabledResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	Disabled      bool                   `protobuf:"varint,2,opt,name=disabled,proto3" json:"disabled,omitempty"`
+	Changed       bool                   `protobuf:"varint,3,opt,name=changed,proto3" json:"changed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetUserDisabledResponse) Reset() {
+	*x = SetUserDisabledResponse{}
+	mi := &file_admin_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetUserDisabledResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetUserDisabledResponse) ProtoMessage() {}
+
+func (x *SetUserDisabledResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetUserDisabledResponse.ProtoReflect.Descriptor instead.
+func (*SetUserDisabledResponse) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *SetUserDisabledResponse) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *SetUserDisabledResponse) GetDisabled() bool {
+	if x != nil {
+		return x.Disabled
+	}
+	return false
+}
+
+func (x *SetUserDisabledResponse) GetChanged() bool {
+	if x != nil {
+		return x.Changed
+	}
+	return false
+}
+
+type GetOverviewRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetOverviewRequest) Reset() {
+	*x = GetOverviewRequest{}
+	mi := &file_admin_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetOverviewRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetOverviewRequest) ProtoMessage() {}
+
+func (x *GetOverviewRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetOverviewRequest.ProtoReflect.Descriptor instead.
+func (*GetOverviewRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{6}
+}
+
+type Overview struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	TotalUpload      uint64                 `protobuf:"varint,1,opt,name=total_upload,json=totalUpload,proto3" json:"total_upload,omitempty"`
+	TotalDownload    uint64                 `protobuf:"varint,2,opt,name=total_download,json=totalDownload,proto3" json:"total_download,omitempty"`
+	TotalConnections uint64                 `protobuf:"varint,3,opt,name=total_connections,json=totalConnections,proto3" json:"total_connections,omitempty"`
+	DomainCount      int32                  `protobuf:"varint,4,opt,name=domain_count,json=domainCount,proto3" json:"domain_count,omitempty"`
+	UserCount        int32                  `protobuf:"varint,5,opt,name=user_count,json=userCount,proto3" json:"user_count,omitempty"`
+	CountryCount     int32                  `protobuf:"varint,6,opt,name=country_count,json=countryCount,proto3" json:"country_count,omitempty"`
+	Timestamp        string                 `protobuf:"bytes,7,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *Overview) Reset() {
+	*x = Overview{}
+	mi := &file_admin_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Overview) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Overview) ProtoMessage() {}
+
+func (x *Overview) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Overview.ProtoReflect.Descriptor instead.
+func (*Overview) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *Overview) GetTotalUpload() uint64 {
+	if x != nil {
+		return x.TotalUpload
+	}
+	return 0
+}
+
+func (x *Overview) GetTotalDownload() uint64 {
+	if x != nil {
+		return x.TotalDownload
+	}
+	return 0
+}
+
+func (x *Overview) GetTotalConnections() uint64 {
+	if x != nil {
+		return x.TotalConnections
+	}
+	return 0
+}
+
+func (x *Overview) GetDomainCount() int32 {
+	if x != nil {
+		return x.DomainCount
+	}
+	return 0
+}
+
+func (x *Overview) GetUserCount() int32 {
+	if x != nil {
+		return x.UserCount
+	}
+	return 0
+}
+
+func (x *Overview) GetCountryCount() int32 {
+	if x != nil {
+		return x.CountryCount
+	}
+	return 0
+}
+
+func (x *Overview) GetTimestamp() string {
+	if x != nil {
+		return x.Timestamp
+	}
+	return ""
+}
+
+type GetTopDomainsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Limit         int32                  `protobuf:"varint,1,opt,name=limit,proto3" json:"limit,omitempty"`
+	User          string                 `protobuf:"bytes,2,opt,name=user,proto3" json:"user,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetTopDomainsRequest) Reset() {
+	*x = GetTopDomainsRequest{}
+	mi := &file_admin_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetTopDomainsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetTopDomainsRequest) ProtoMessage() {}
+
+func (x *GetTopDomainsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetTopDomainsRequest.ProtoReflect.Descriptor instead.
+func (*GetTopDomainsRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *GetTopDomainsRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *GetTopDomainsRequest) GetUser() string {
+	if x != nil {
+		return x.User
+	}
+	return ""
+}
+
+type DomainStats struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	User          string                 `protobuf:"bytes,1,opt,name=user,proto3" json:"user,omitempty"`
+	Domain        string                 `protobuf:"bytes,2,opt,name=domain,proto3" json:"domain,omitempty"`
+	Upload        uint64                 `protobuf:"varint,3,opt,name=upload,proto3" json:"upload,omitempty"`
+	Download      uint64                 `protobuf:"varint,4,opt,name=download,proto3" json:"download,omitempty"`
+	ConnCount     uint64                 `protobuf:"varint,5,opt,name=conn_count,json=connCount,proto3" json:"conn_count,omitempty"`
+	LastSeen      string                 `protobuf:"bytes,6,opt,name=last_seen,json=lastSeen,proto3" json:"last_seen,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DomainStats) Reset() {
+	*x = DomainStats{}
+	mi := &file_admin_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DomainStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DomainStats) ProtoMessage() {}
+
+func (x *DomainStats) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DomainStats.ProtoReflect.Descriptor instead.
+func (*DomainStats) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *DomainStats) GetUser() string {
+	if x != nil {
+		return x.User
+	}
+	return ""
+}
+
+func (x *DomainStats) GetDomain() string {
+	if x != nil {
+		return x.Domain
+	}
+	return ""
+}
+
+func (x *DomainStats) GetUpload() uint64 {
+	if x != nil {
+		return x.Upload
+	}
+	return 0
+}
+
+func (x *DomainStats) GetDownload() uint64 {
+	if x != nil {
+		return x.Download
+	}
+	return 0
+}
+
+func (x *DomainStats) GetConnCount() uint64 {
+	if x != nil {
+		return x.ConnCount
+	}
+	return 0
+}
+
+func (x *DomainStats) GetLastSeen() string {
+	if x != nil {
+		return x.LastSeen
+	}
+	return ""
+}
+
+type GetTopDomainsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Domains       []*DomainStats         `protobuf:"bytes,1,rep,name=domains,proto3" json:"domains,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetTopDomainsResponse) Reset() {
+	*x = GetTopDomainsResponse{}
+	mi := &file_admin_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetTopDomainsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetTopDomainsResponse) ProtoMessage() {}
+
+func (x *GetTopDomainsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetTopDomainsResponse.ProtoReflect.Descriptor instead.
+func (*GetTopDomainsResponse) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *GetTopDomainsResponse) GetDomains() []*DomainStats {
+	if x != nil {
+		return x.Domains
+	}
+	return nil
+}
+
+type GetTrendsRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// One of "30m", "1h", "24h", "7d". Defaults to "1h".
+	Range         string `protobuf:"bytes,1,opt,name=range,proto3" json:"range,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetTrendsRequest) Reset() {
+	*x = GetTrendsRequest{}
+	mi := &file_admin_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetTrendsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetTrendsRequest) ProtoMessage() {}
+
+func (x *GetTrendsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetTrendsRequest.ProtoReflect.Descriptor instead.
+func (*GetTrendsRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *GetTrendsRequest) GetRange() string {
+	if x != nil {
+		return x.Range
+	}
+	return ""
+}
+
+type TrendPoint struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Time          string                 `protobuf:"bytes,1,opt,name=time,proto3" json:"time,omitempty"`
+	Upload        uint64                 `protobuf:"varint,2,opt,name=upload,proto3" json:"upload,omitempty"`
+	Download      uint64                 `protobuf:"varint,3,opt,name=download,proto3" json:"download,omitempty"`
+	Connections   uint64                 `protobuf:"varint,4,opt,name=connections,proto3" json:"connections,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TrendPoint) Reset() {
+	*x = TrendPoint{}
+	mi := &file_admin_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TrendPoint) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TrendPoint) ProtoMessage() {}
+
+func (x *TrendPoint) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TrendPoint.ProtoReflect.Descriptor instead.
+func (*TrendPoint) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *TrendPoint) GetTime() string {
+	if x != nil {
+		return x.Time
+	}
+	return ""
+}
+
+func (x *TrendPoint) GetUpload() uint64 {
+	if x != nil {
+		return x.Upload
+	}
+	return 0
+}
+
+func (x *TrendPoint) GetDownload() uint64 {
+	if x != nil {
+		return x.Download
+	}
+	return 0
+}
+
+func (x *TrendPoint) GetConnections() uint64 {
+	if x != nil {
+		return x.Connections
+	}
+	return 0
+}
+
+type GetTrendsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Points        []*TrendPoint          `protobuf:"bytes,1,rep,name=points,proto3" json:"points,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetTrendsResponse) Reset() {
+	*x = GetTrendsResponse{}
+	mi := &file_admin_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetTrendsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetTrendsResponse) ProtoMessage() {}
+
+func (x *GetTrendsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetTrendsResponse.ProtoReflect.Descriptor instead.
+func (*GetTrendsResponse) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *GetTrendsResponse) GetPoints() []*TrendPoint {
+	if x != nil {
+		return x.Points
+	}
+	return nil
+}
+
+type GetCountriesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetCountriesRequest) Reset() {
+	*x = GetCountriesRequest{}
+	mi := &file_admin_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetCountriesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetCountriesRequest) ProtoMessage() {}
+
+func (x *GetCountriesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetCountriesRequest.ProtoReflect.Descriptor instead.
+func (*GetCountriesRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{14}
+}
+
+type CountryStats struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Country       string                 `protobuf:"bytes,1,opt,name=country,proto3" json:"country,omitempty"`
+	CountryName   string                 `protobuf:"bytes,2,opt,name=country_name,json=countryName,proto3" json:"country_name,omitempty"`
+	Continent     string                 `protobuf:"bytes,3,opt,name=continent,proto3" json:"continent,omitempty"`
+	Upload        uint64                 `protobuf:"varint,4,opt,name=upload,proto3" json:"upload,omitempty"`
+	Download      uint64                 `protobuf:"varint,5,opt,name=download,proto3" json:"download,omitempty"`
+	ConnCount     uint64                 `protobuf:"varint,6,opt,name=conn_count,json=connCount,proto3" json:"conn_count,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CountryStats) Reset() {
+	*x = CountryStats{}
+	mi := &file_admin_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CountryStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CountryStats) ProtoMessage() {}
+
+func (x *CountryStats) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CountryStats.ProtoReflect.Descriptor instead.
+func (*CountryStats) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *CountryStats) GetCountry() string {
+	if x != nil {
+		return x.Country
+	}
+	return ""
+}
+
+func (x *CountryStats) GetCountryName() string {
+	if x != nil {
+		return x.CountryName
+	}
+	return ""
+}
+
+func (x *CountryStats) GetContinent() string {
+	if x != nil {
+		return x.Continent
+	}
+	return ""
+}
+
+func (x *CountryStats) GetUpload() uint64 {
+	if x != nil {
+		return x.Upload
+	}
+	return 0
+}
+
+func (x *CountryStats) GetDownload() uint64 {
+	if x != nil {
+		return x.Download
+	}
+	return 0
+}
+
+func (x *CountryStats) GetConnCount() uint64 {
+	if x != nil {
+		return x.ConnCount
+	}
+	return 0
+}
+
+type GetCountriesResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Countries     []*CountryStats        `protobuf:"bytes,1,rep,name=countries,proto3" json:"countries,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetCountriesResponse) Reset() {
+	*x = GetCountriesResponse{}
+	mi := &file_admin_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetCountriesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetCountriesResponse) ProtoMessage() {}
+
+func (x *GetCountriesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetCountriesResponse.ProtoReflect.Descriptor instead.
+func (*GetCountriesResponse) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *GetCountriesResponse) GetCountries() []*CountryStats {
+	if x != nil {
+		return x.Countries
+	}
+	return nil
+}
+
+type WatchOverviewRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Seconds between updates. Defaults to 5, minimum 1.
+	IntervalSeconds int32 `protobuf:"varint,1,opt,name=interval_seconds,json=intervalSeconds,proto3" json:"interval_seconds,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *WatchOverviewRequest) Reset() {
+	*x = WatchOverviewRequest{}
+	mi := &file_admin_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchOverviewRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchOverviewRequest) ProtoMessage() {}
+
+func (x *WatchOverviewRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchOverviewRequest.ProtoReflect.Descriptor instead.
+func (*WatchOverviewRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *WatchOverviewRequest) GetIntervalSeconds() int32 {
+	if x != nil {
+		return x.IntervalSeconds
+	}
+	return 0
+}
+
+type GetUserQuotaRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetUserQuotaRequest) Reset() {
+	*x = GetUserQuotaRequest{}
+	mi := &file_admin_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetUserQuotaRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetUserQuotaRequest) ProtoMessage() {}
+
+func (x *GetUserQuotaRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetUserQuotaRequest.ProtoReflect.Descriptor instead.
+func (*GetUserQuotaRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *GetUserQuotaRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+type QuotaStatus struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Username string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	// "daily", "weekly" or "monthly"
+	Period     string `protobuf:"bytes,2,opt,name=period,proto3" json:"period,omitempty"`
+	QuotaBytes uint64 `protobuf:"varint,3,opt,name=quota_bytes,json=quotaBytes,proto3" json:"quota_bytes,omitempty"`
+	// Set if the quota is inherited from a group.
+	Group         string `protobuf:"bytes,4,opt,name=group,proto3" json:"group,omitempty"`
+	UsedBytes     uint64 `protobuf:"varint,5,opt,name=used_bytes,json=usedBytes,proto3" json:"used_bytes,omitempty"`
+	PeriodStart   string `protobuf:"bytes,6,opt,name=period_start,json=periodStart,proto3" json:"period_start,omitempty"`
+	ResetsAt      string `protobuf:"bytes,7,opt,name=resets_at,json=resetsAt,proto3" json:"resets_at,omitempty"`
+	Exceeded      bool   `protobuf:"varint,8,opt,name=exceeded,proto3" json:"exceeded,omitempty"`
+	SetBy         string `protobuf:"bytes,9,opt,name=set_by,json=setBy,proto3" json:"set_by,omitempty"`
+	SetAt         string `protobuf:"bytes,10,opt,name=set_at,json=setAt,proto3" json:"set_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *QuotaStatus) Reset() {
+	*x = QuotaStatus{}
+	mi := &file_admin_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QuotaStatus) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QuotaStatus) ProtoMessage() {}
+
+func (x *QuotaStatus) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QuotaStatus.ProtoReflect.Descriptor instead.
+func (*QuotaStatus) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *QuotaStatus) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *QuotaStatus) GetPeriod() string {
+	if x != nil {
+		return x.Period
+	}
+	return ""
+}
+
+func (x *QuotaStatus) GetQuotaBytes() uint64 {
+	if x != nil {
+		return x.QuotaBytes
+	}
+	return 0
+}
+
+func (x *QuotaStatus) GetGroup() string {
+	if x != nil {
+		return x.Group
+	}
+	return ""
+}
+
+func (x *QuotaStatus) GetUsedBytes() uint64 {
+	if x != nil {
+		return x.UsedBytes
+	}
+	return 0
+}
+
+func (x *QuotaStatus) GetPeriodStart() string {
+	if x != nil {
+		return x.PeriodStart
+	}
+	return ""
+}
+
+func (x *QuotaStatus) GetResetsAt() string {
+	if x != nil {
+		return x.ResetsAt
+	}
+	return ""
+}
+
+func (x *QuotaStatus) GetExceeded() bool {
+	if x != nil {
+		return x.Exceeded
+	}
+	return false
+}
+
+func (x *QuotaStatus) GetSetBy() string {
+	if x != nil {
+		return x.SetBy
+	}
+	return ""
+}
+
+func (x *QuotaStatus) GetSetAt() string {
+	if x != nil {
+		return x.SetAt
+	}
+	return ""
+}
+
+type SetUserQuotaRequest struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Username string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	// "daily", "weekly" or "monthly". Defaults to "monthly".
+	Period        string `protobuf:"bytes,2,opt,name=period,proto3" json:"period,omitempty"`
+	QuotaBytes    uint64 `protobuf:"varint,3,opt,name=quota_bytes,json=quotaBytes,proto3" json:"quota_bytes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetUserQuotaRequest) Reset() {
+	*x = SetUserQuotaRequest{}
+	mi := &file_admin_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetUserQuotaRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetUserQuotaRequest) ProtoMessage() {}
+
+func (x *SetUserQuotaRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetUserQuotaRequest.ProtoReflect.Descriptor instead.
+func (*SetUserQuotaRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *SetUserQuotaRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *SetUserQuotaRequest) GetPeriod() string {
+	if x != nil {
+		return x.Period
+	}
+	return ""
+}
+
+func (x *SetUserQuotaRequest) GetQuotaBytes() uint64 {
+	if x != nil {
+		return x.QuotaBytes
+	}
+	return 0
+}
+
+type DeleteUserQuotaRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      string                 `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteUserQuotaRequest) Reset() {
+	*x = DeleteUserQuotaRequest{}
+	mi := &file_admin_proto_msgTypes[21]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteUserQuotaRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteUserQuotaRequest) ProtoMessage() {}
+
+func (x *DeleteUserQuotaRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[21]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteUserQuotaRequest.ProtoReflect.Descriptor instead.
+func (*DeleteUserQuotaRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{21}
+}
+
+func (x *DeleteUserQuotaRequest) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+type DeleteUserQuotaResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteUserQuotaResponse) Reset() {
+	*x = DeleteUserQuotaResponse{}
+	mi := &file_admin_proto_msgTypes[22]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteUserQuotaResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteUserQuotaResponse) ProtoMessage() {}
+
+func (x *DeleteUserQuotaResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[22]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteUserQuotaResponse.ProtoReflect.Descriptor instead.
+func (*DeleteUserQuotaResponse) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{22}
+}
+
+type Tunnel struct {
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	Id         uint64                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	RequestId  string                 `protobuf:"bytes,2,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	Username   string                 `protobuf:"bytes,3,opt,name=username,proto3" json:"username,omitempty"`
+	ClientAddr string                 `protobuf:"bytes,4,opt,name=client_addr,json=clientAddr,proto3" json:"client_addr,omitempty"`
+	Target     string                 `protobuf:"bytes,5,opt,name=target,proto3" json:"target,omitempty"`
+	// "socks5" for tunnels opened over the SOCKS5 listener
+	Protocol     string `protobuf:"bytes,6,opt,name=protocol,proto3" json:"protocol,omitempty"`
+	Tag          string `protobuf:"bytes,7,opt,name=tag,proto3" json:"tag,omitempty"`
+	Route        string `protobuf:"bytes,8,opt,name=route,proto3" json:"route,omitempty"`
+	Started      string `protobuf:"bytes,9,opt,name=started,proto3" json:"started,omitempty"`
+	CertNotAfter string `protobuf:"bytes,10,opt,name=cert_not_after,json=certNotAfter,proto3" json:"cert_not_after,omitempty"`
+	CertExpired  bool   `protobuf:"varint,11,opt,name=cert_expired,json=certExpired,proto3" json:"cert_expired,omitempty"`
+	// When the tunnel will be closed for its expired certificate, if set.
+	TerminateAt   string `protobuf:"bytes,12,opt,name=terminate_at,json=terminateAt,proto3" json:"terminate_at,omitempty"`
+	Upload        uint64 `protobuf:"varint,13,opt,name=upload,proto3" json:"upload,omitempty"`
+	Download      uint64 `protobuf:"varint,14,opt,name=download,proto3" json:"download,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Tunnel) Reset() {
+	*x = Tunnel{}
+	mi := &file_admin_proto_msgTypes[23]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Tunnel) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Tunnel) ProtoMessage() {}
+
+func (x *Tunnel) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[23]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Tunnel.ProtoReflect.Descriptor instead.
+func (*Tunnel) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{23}
+}
+
+func (x *Tunnel) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Tunnel) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *Tunnel) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *Tunnel) GetClientAddr() string {
+	if x != nil {
+		return x.ClientAddr
+	}
+	return ""
+}
+
+func (x *Tunnel) GetTarget() string {
+	if x != nil {
+		return x.Target
+	}
+	return ""
+}
+
+func (x *Tunnel) GetProtocol() string {
+	if x != nil {
+		return x.Protocol
+	}
+	return ""
+}
+
+func (x *Tunnel) GetTag() string {
+	if x != nil {
+		return x.Tag
+	}
+	return ""
+}
+
+func (x *Tunnel) GetRoute() string {
+	if x != nil {
+		return x.Route
+	}
+	return ""
+}
+
+func (x *Tunnel) GetStarted() string {
+	if x != nil {
+		return x.Started
+	}
+	return ""
+}
+
+func (x *Tunnel) GetCertNotAfter() string {
+	if x != nil {
+		return x.CertNotAfter
+	}
+	return ""
+}
+
+func (x *Tunnel) GetCertExpired() bool {
+	if x != nil {
+		return x.CertExpired
+	}
+	return false
+}
+
+func (x *Tunnel) GetTerminateAt() string {
+	if x != nil {
+		return x.TerminateAt
+	}
+	return ""
+}
+
+func (x *Tunnel) GetUpload() uint64 {
+	if x != nil {
+		return x.Upload
+	}
+	return 0
+}
+
+func (x *Tunnel) GetDownload() uint64 {
+	if x != nil {
+		return x.Download
+	}
+	return 0
+}
+
+type ListTunnelsRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Only the tunnels of this user, if set.
+	User string `protobuf:"bytes,1,opt,name=user,proto3" json:"user,omitempty"`
+	// Only the tunnels that outlived their client certificate.
+	ExpiredOnly   bool `protobuf:"varint,2,opt,name=expired_only,json=expiredOnly,proto3" json:"expired_only,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListTunnelsRequest) Reset() {
+	*x = ListTunnelsRequest{}
+	mi := &file_admin_proto_msgTypes[24]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListTunnelsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListTunnelsRequest) ProtoMessage() {}
+
+func (x *ListTunnelsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[24]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListTunnelsRequest.ProtoReflect.Descriptor instead.
+func (*ListTunnelsRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{24}
+}
+
+func (x *ListTunnelsRequest) GetUser() string {
+	if x != nil {
+		return x.User
+	}
+	return ""
+}
+
+func (x *ListTunnelsRequest) GetExpiredOnly() bool {
+	if x != nil {
+		return x.ExpiredOnly
+	}
+	return false
+}
+
+type ListTunnelsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Tunnels       []*Tunnel              `protobuf:"bytes,1,rep,name=tunnels,proto3" json:"tunnels,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListTunnelsResponse) Reset() {
+	*x = ListTunnelsResponse{}
+	mi := &file_admin_proto_msgTypes[25]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListTunnelsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListTunnelsResponse) ProtoMessage() {}
+
+func (x *ListTunnelsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[25]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListTunnelsResponse.ProtoReflect.Descriptor instead.
+func (*ListTunnelsResponse) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{25}
+}
+
+func (x *ListTunnelsResponse) GetTunnels() []*Tunnel {
+	if x != nil {
+		return x.Tunnels
+	}
+	return nil
+}
+
+type WatchTunnelsRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Only the tunnels of this user, if set.
+	User string `protobuf:"bytes,1,opt,name=user,proto3" json:"user,omitempty"`
+	// Seconds between updates. Defaults to 5, minimum 1.
+	IntervalSeconds int32 `protobuf:"varint,2,opt,name=interval_seconds,json=intervalSeconds,proto3" json:"interval_seconds,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *WatchTunnelsRequest) Reset() {
+	*x = WatchTunnelsRequest{}
+	mi := &file_admin_proto_msgTypes[26]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchTunnelsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchTunnelsRequest) ProtoMessage() {}
+
+func (x *WatchTunnelsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_admin_proto_msgTypes[26]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchTunnelsRequest.ProtoReflect.Descriptor instead.
+func (*WatchTunnelsRequest) Descriptor() ([]byte, []int) {
+	return file_admin_proto_rawDescGZIP(), []int{26}
+}
+
+func (x *WatchTunnelsRequest) GetUser() string {
+	if x != nil {
+		return x.User
+	}
+	return ""
+}
+
+func (x *WatchTunnelsRequest) GetIntervalSeconds() int32 {
+	if x != nil {
+		return x.IntervalSeconds
+	}
+	return 0
+}
+
+var File_admin_proto protoreflect.FileDescriptor
+
+const file_admin_proto_rawDesc = "" +
+	"\n" +
+	"\vadmin.proto\x12\x13httpsproxy.admin.v1\"\x8c\x02\n" +
+	"\x04User\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12!\n" +
+	"\ftotal_upload\x18\x02 \x01(\x04R\vtotalUpload\x12%\n" +
+	"\x0etotal_download\x18\x03 \x01(\x04R\rtotalDownload\x12\x1d\n" +
+	"\n" +
+	"conn_count\x18\x04 \x01(\x04R\tconnCount\x12#\n" +
+	"\rrequest_count\x18\x05 \x01(\x04R\frequestCount\x12\x1d\n" +
+	"\n" +
+	"first_seen\x18\x06 \x01(\tR\tfirstSeen\x12\x1f\n" +
+	"\vlast_access\x18\a \x01(\tR\n" +
+	"lastAccess\x12\x1a\n" +
+	"\bdisabled\x18\b \x01(\bR\bdisabled\"\x12\n" +
+	"\x10ListUsersRequest\"D\n" +
+	"\x11ListUsersResponse\x12/\n" +
+	"\x05users\x18\x01 \x03(\v2\x19.httpsproxy.admin.v1.UserR\x05users\",\n" +
+	"\x0eGetUserRequest\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\"P\n" +
+	"\x16SetUserDisabledRequest\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x1a\n" +
+	"\bdisabled\x18\x02 \x01(\bR\bdisabled\"k\n" +
+	"\x17SetUserDisabledResponse\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x1a\n" +
+	"\bdisabled\x18\x02 \x01(\bR\bdisabled\x12\x18\n" +
+	"\achanged\x18\x03 \x01(\bR\achanged\"\x14\n" +
+	"\x12GetOverviewRequest\"\x86\x02\n" +
+	"\bOverview\x12!\n" +
+	"\ftotal_upload\x18\x01 \x01(\x04R\vtotalUpload\x12%\n" +
+	"\x0etotal_download\x18\x02 \x01(\x04R\rtotalDownload\x12+\n" +
+	"\x11total_connections\x18\x03 \x01(\x04R\x10totalConnections\x12!\n" +
+	"\fdomain_count\x18\x04 \x01(\x05R\vdomainCount\x12\x1d\n" +
+	"\n" +
+	"user_count\x18\x05 \x01(\x05R\tuserCount\x12#\n" +
+	"\rcountry_count\x18\x06 \x01(\x05R\fcountryCount\x12\x1c\n" +
+	"\ttimestamp\x18\a \x01(\tR\ttimestamp\"@\n" +
+	"\x14GetTopDomainsRequest\x12\x14\n" +
+	"\x05limit\x18\x01 \x01(\x05R\x05limit\x12\x12\n" +
+	"\x04user\x18\x02 \x01(\tR\x04user\"\xa9\x01\n" +
+	"\vDomainStats\x12\x12\n" +
+	"\x04user\x18\x01 \x01(\tR\x04user\x12\x16\n" +
+	"\x06domain\x18\x02 \x01(\tR\x06domain\x12\x16\n" +
+	"\x06upload\x18\x03 \x01(\x04R\x06upload\x12\x1a\n" +
+	"\bdownload\x18\x04 \x01(\x04R\bdownload\x12\x1d\n" +
+	"\n" +
+	"conn_count\x18\x05 \x01(\x04R\tconnCount\x12\x1b\n" +
+	"\tlast_seen\x18\x06 \x01(\tR\blastSeen\"S\n" +
+	"\x15GetTopDomainsResponse\x12:\n" +
+	"\adomains\x18\x01 \x03(\v2 .httpsproxy.admin.v1.DomainStatsR\adomains\"(\n" +
+	"\x10GetTrendsRequest\x12\x14\n" +
+	"\x05range\x18\x01 \x01(\tR\x05range\"v\n" +
+	"\n" +
+	"TrendPoint\x12\x12\n" +
+	"\x04time\x18\x01 \x01(\tR\x04time\x12\x16\n" +
+	"\x06upload\x18\x02 \x01(\x04R\x06upload\x12\x1a\n" +
+	"\bdownload\x18\x03 \x01(\x04R\bdownload\x12 \n" +
+	"\vconnections\x18\x04 \x01(\x04R\vconnections\"L\n" +
+	"\x11GetTrendsResponse\x127\n" +
+	"\x06points\x18\x01 \x03(\v2\x1f.httpsproxy.admin.v1.TrendPointR\x06points\"\x15\n" +
+	"\x13GetCountriesRequest\"\xbc\x01\n" +
+	"\fCountryStats\x12\x18\n" +
+	"\acountry\x18\x01 \x01(\tR\acountry\x12!\n" +
+	"\fcountry_name\x18\x02 \x01(\tR\vcountryName\x12\x1c\n" +
+	"\tcontinent\x18\x03 \x01(\tR\tcontinent\x12\x16\n" +
+	"\x06upload\x18\x04 \x01(\x04R\x06upload\x12\x1a\n" +
+	"\bdownload\x18\x05 \x01(\x04R\bdownload\x12\x1d\n" +
+	"\n" +
+	"conn_count\x18\x06 \x01(\x04R\tconnCount\"W\n" +
+	"\x14GetCountriesResponse\x12?\n" +
+	"\tcountries\x18\x01 \x03(\v2!.httpsproxy.admin.v1.CountryStatsR\tcountries\"A\n" +
+	"\x14WatchOverviewRequest\x12)\n" +
+	"\x10interval_seconds\x18\x01 \x01(\x05R\x0fintervalSeconds\"1\n" +
+	"\x13GetUserQuotaRequest\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\"\xa1\x02\n" +
+	"\vQuotaStatus\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x16\n" +
+	"\x06period\x18\x02 \x01(\tR\x06period\x12\x1f\n" +
+	"\vquota_bytes\x18\x03 \x01(\x04R\n" +
+	"quotaBytes\x12\x14\n" +
+	"\x05group\x18\x04 \x01(\tR\x05group\x12\x1d\n" +
+	"\n" +
+	"used_bytes\x18\x05 \x01(\x04R\tusedBytes\x12!\n" +
+	"\fperiod_start\x18\x06 \x01(\tR\vperiodStart\x12\x1b\n" +
+	"\tresets_at\x18\a \x01(\tR\bresetsAt\x12\x1a\n" +
+	"\bexceeded\x18\b \x01(\bR\bexceeded\x12\x15\n" +
+	"\x06set_by\x18\t \x01(\tR\x05setBy\x12\x15\n" +
+	"\x06set_at\x18\n" +
+	" \x01(\tR\x05setAt\"j\n" +
+	"\x13SetUserQuotaRequest\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\x12\x16\n" +
+	"\x06period\x18\x02 \x01(\tR\x06period\x12\x1f\n" +
+	"\vquota_bytes\x18\x03 \x01(\x04R\n" +
+	"quotaBytes\"4\n" +
+	"\x16DeleteUserQuotaRequest\x12\x1a\n" +
+	"\busername\x18\x01 \x01(\tR\busername\"\x19\n" +
+	"\x17DeleteUserQuotaResponse\"\x8a\x03\n" +
+	"\x06Tunnel\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x04R\x02id\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x02 \x01(\tR\trequestId\x12\x1a\n" +
+	"\busername\x18\x03 \x01(\tR\busername\x12\x1f\n" +
+	"\vclient_addr\x18\x04 \x01(\tR\n" +
+	"clientAddr\x12\x16\n" +
+	"\x06target\x18\x05 \x01(\tR\x06target\x12\x1a\n" +
+	"\bprotocol\x18\x06 \x01(\tR\bprotocol\x12\x10\n" +
+	"\x03tag\x18\a \x01(\tR\x03tag\x12\x14\n" +
+	"\x05route\x18\b \x01(\tR\x05route\x12\x18\n" +
+	"\astarted\x18\t \x01(\tR\astarted\x12$\n" +
+	"\x0ecert_not_after\x18\n" +
+	" \x01(\tR\fcertNotAfter\x12!\n" +
+	"\fcert_expired\x18\v \x01(\bR\vcertExpired\x12!\n" +
+	"\fterminate_at\x18\f \x01(\tR\vterminateAt\x12\x16\n" +
+	"\x06upload\x18\r \x01(\x04R\x06upload\x12\x1a\n" +
+	"\bdownload\x18\x0e \x01(\x04R\bdownload\"K\n" +
+	"\x12ListTunnelsRequest\x12\x12\n" +
+	"\x04user\x18\x01 \x01(\tR\x04user\x12!\n" +
+	"\fexpired_only\x18\x02 \x01(\bR\vexpiredOnly\"L\n" +
+	"\x13ListTunnelsResponse\x125\n" +
+	"\atunnels\x18\x01 \x03(\v2\x1b.httpsproxy.admin.v1.TunnelR\atunnels\"T\n" +
+	"\x13WatchTunnelsRequest\x12\x12\n" +
+	"\x04user\x18\x01 \x01(\tR\x04user\x12)\n" +
+	"\x10interval_seconds\x18\x02 \x01(\x05R\x0fintervalSeconds2\xee\t\n" +
+	"\fAdminService\x12Z\n" +
+	"\tListUsers\x12%.httpsproxy.admin.v1.ListUsersRequest\x1a&.httpsproxy.admin.v1.ListUsersResponse\x12I\n" +
+	"\aGetUser\x12#.httpsproxy.admin.v1.GetUserRequest\x1a\x19.httpsproxy.admin.v1.User\x12l\n" +
+	"\x0fSetUserDisabled\x12+.httpsproxy.admin.v1.SetUserDisabledRequest\x1a,.httpsproxy.admin.v1.SetUserDisabledResponse\x12U\n" +
+	"\vGetOverview\x12'.httpsproxy.admin.v1.GetOverviewRequest\x1a\x1d.httpsproxy.admin.v1.Overview\x12f\n" +
+	"\rGetTopDomains\x12).httpsproxy.admin.v1.GetTopDomainsRequest\x1a*.httpsproxy.admin.v1.GetTopDomainsResponse\x12Z\n" +
+	"\tGetTrends\x12%.httpsproxy.admin.v1.GetTrendsRequest\x1a&.httpsproxy.admin.v1.GetTrendsResponse\x12c\n" +
+	"\fGetCountries\x12(.httpsproxy.admin.v1.GetCountriesRequest\x1a).httpsproxy.admin.v1.GetCountriesResponse\x12[\n" +
+	"\rWatchOverview\x12).httpsproxy.admin.v1.WatchOverviewRequest\x1a\x1d.httpsproxy.admin.v1.Overview0\x01\x12Z\n" +
+	"\fGetUserQuota\x12(.httpsproxy.admin.v1.GetUserQuotaRequest\x1a .httpsproxy.admin.v1.QuotaStatus\x12Z\n" +
+	"\fSetUserQuota\x12(.httpsproxy.admin.v1.SetUserQuotaRequest\x1a .httpsproxy.admin.v1.QuotaStatus\x12l\n" +
+	"\x0fDeleteUserQuota\x12+.httpsproxy.admin.v1.DeleteUserQuotaRequest\x1a,.httpsproxy.admin.v1.DeleteUserQuotaResponse\x12`\n" +
+	"\vListTunnels\x12'.httpsproxy.admin.v1.ListTunnelsRequest\x1a(.httpsproxy.admin.v1.ListTunnelsResponse\x12d\n" +
+	"\fWatchTunnels\x12(.httpsproxy.admin.v1.WatchTunnelsRequest\x1a(.httpsproxy.admin.v1.ListTunnelsResponse0\x01B\x1dZ\x1bhttps-proxy/adminpb;adminpbb\x06proto3"
+
+var (
+	file_admin_proto_rawDescOnce sync.Once
+	file_admin_proto_rawDescData []byte
+)
+
+func file_admin_proto_rawDescGZIP() []byte {
+	file_admin_proto_rawDescOnce.Do(func() {
+		file_admin_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_admin_proto_rawDesc), len(file_admin_proto_rawDesc)))
+	})
+	return file_admin_proto_rawDescData
+}
+
+var file_admin_proto_msgTypes = make([]protoimpl.MessageInfo, 27)
+var file_admin_proto_goTypes = []any{
+	(*User)(nil),                    // 0: httpsproxy.admin.v1.User
+	(*ListUsersRequest)(nil),        // 1: httpsproxy.admin.v1.ListUsersRequest
+	(*ListUsersResponse)(nil),       // 2: httpsproxy.admin.v1.ListUsersResponse
+	(*GetUserRequest)(nil),          // 3: httpsproxy.admin.v1.GetUserRequest
+	(*SetUserDisabledRequest)(nil),  // 4: httpsproxy.admin.v1.SetUserDisabledRequest
+	(*SetUserDisabledResponse)(nil), // 5: httpsproxy.admin.v1.SetUserDisabledResponse
+	(*GetOverviewRequest)(nil),      // 6: httpsproxy.admin.v1.GetOverviewRequest
+	(*Overview)(nil),                // 7: httpsproxy.admin.v1.Overview
+	(*GetTopDomainsRequest)(nil),    // 8: httpsproxy.admin.v1.GetTopDomainsRequest
+	(*DomainStats)(nil),             // 9: httpsproxy.admin.v1.DomainStats
+	(*GetTopDomainsResponse)(nil),   // 10: httpsproxy.admin.v1.GetTopDomainsResponse
+	(*GetTrendsRequest)(nil),        // 11: httpsproxy.admin.v1.GetTrendsRequest
+	(*TrendPoint)(nil),              // 12: httpsproxy.admin.v1.TrendPoint
+	(*GetTrendsResponse)(nil),       // 13: httpsproxy.admin.v1.GetTrendsResponse
+	(*GetCountriesRequest)(nil),     // 14: httpsproxy.admin.v1.GetCountriesRequest
+	(*CountryStats)(nil),            // 15: httpsproxy.admin.v1.CountryStats
+	(*GetCountriesResponse)(nil),    // 16: httpsproxy.admin.v1.GetCountriesResponse
+	(*WatchOverviewRequest)(nil),    // 17: httpsproxy.admin.v1.WatchOverviewRequest
+	(*GetUserQuotaRequest)(nil),     // 18: httpsproxy.admin.v1.GetUserQuotaRequest
+	(*QuotaStatus)(nil),             // 19: httpsproxy.admin.v1.QuotaStatus
+	(*SetUserQuotaRequest)(nil),     // 20: httpsproxy.admin.v1.SetUserQuotaRequest
+	(*DeleteUserQuotaRequest)(nil),  // 21: httpsproxy.admin.v1.DeleteUserQuotaRequest
+	(*DeleteUserQuotaResponse)(nil), // 22: httpsproxy.admin.v1.DeleteUserQuotaResponse
+	(*Tunnel)(nil),                  // 23: httpsproxy.admin.v1.Tunnel
+	(*ListTunnelsRequest)(nil),      // 24: httpsproxy.admin.v1.ListTunnelsRequest
+	(*ListTunnelsResponse)(nil),     // 25: httpsproxy.admin.v1.ListTunnelsResponse
+	(*WatchTunnelsRequest)(nil),     // 26: httpsproxy.admin.v1.WatchTunnelsRequest
+}
+var file_admin_proto_depIdxs = []int32{
+	0,  // 0: httpsproxy.admin.v1.ListUsersResponse.users:type_name -> httpsproxy.admin.v1.User
+	9,  // 1: httpsproxy.admin.v1.GetTopDomainsResponse.domains:type_name -> httpsproxy.admin.v1.DomainStats
+	12, // 2: httpsproxy.admin.v1.GetTrendsResponse.points:type_name -> httpsproxy.admin.v1.TrendPoint
+	15, // 3: httpsproxy.admin.v1.GetCountriesResponse.countries:type_name -> httpsproxy.admin.v1.CountryStats
+	23, // 4: httpsproxy.admin.v1.ListTunnelsResponse.tunnels:type_name -> httpsproxy.admin.v1.Tunnel
+	1,  // 5: httpsproxy.admin.v1.AdminService.ListUsers:input_type -> httpsproxy.admin.v1.ListUsersRequest
+	3,  // 6: httpsproxy.admin.v1.AdminService.GetUser:input_type -> httpsproxy.admin.v1.GetUserRequest
+	4,  // 7: httpsproxy.admin.v1.AdminService.SetUserDisabled:input_type -> httpsproxy.admin.v1.SetUserDisabledRequest
+	6,  // 8: httpsproxy.admin.v1.AdminService.GetOverview:input_type -> httpsproxy.admin.v1.GetOverviewRequest
+	8,  // 9: httpsproxy.admin.v1.AdminService.GetTopDomains:input_type -> httpsproxy.admin.v1.GetTopDomainsRequest
+	11, // 10: httpsproxy.admin.v1.AdminService.GetTrends:input_type -> httpsproxy.admin.v1.GetTrendsRequest
+	14, // 11: httpsproxy.admin.v1.AdminService.GetCountries:input_type -> httpsproxy.admin.v1.GetCountriesRequest
+	17, // 12: httpsproxy.admin.v1.AdminService.WatchOverview:input_type -> httpsproxy.admin.v1.WatchOverviewRequest
+	18, // 13: httpsproxy.admin.v1.AdminService.GetUserQuota:input_type -> httpsproxy.admin.v1.GetUserQuotaRequest
+	20, // 14: httpsproxy.admin.v1.AdminService.SetUserQuota:input_type -> httpsproxy.admin.v1.SetUserQuotaRequest
+	21, // 15: httpsproxy.admin.v1.AdminService.DeleteUserQuota:input_type -> httpsproxy.admin.v1.DeleteUserQuotaRequest
+	24, // 16: httpsproxy.admin.v1.AdminService.ListTunnels:input_type -> httpsproxy.admin.v1.ListTunnelsRequest
+	26, // 17: httpsproxy.admin.v1.AdminService.WatchTunnels:input_type -> httpsproxy.admin.v1.WatchTunnelsRequest
+	2,  // 18: httpsproxy.admin.v1.AdminService.ListUsers:output_type -> httpsproxy.admin.v1.ListUsersResponse
+	0,  // 19: httpsproxy.admin.v1.AdminService.GetUser:output_type -> httpsproxy.admin.v1.User
+	5,  // 20: httpsproxy.admin.v1.AdminService.SetUserDisabled:output_type -> httpsproxy.admin.v1.SetUserDisabledResponse
+	7,  // 21: httpsproxy.admin.v1.AdminService.GetOverview:output_type -> httpsproxy.admin.v1.Overview
+	10, // 22: httpsproxy.admin.v1.AdminService.GetTopDomains:output_type -> httpsproxy.admin.v1.GetTopDomainsResponse
+	13, // 23: httpsproxy.admin.v1.AdminService.GetTrends:output_type -> httpsproxy.admin.v1.GetTrendsResponse
+	16, // 24: httpsproxy.admin.v1.AdminService.GetCountries:output_type -> httpsproxy.admin.v1.GetCountriesResponse
+	7,  // 25: httpsproxy.admin.v1.AdminService.WatchOverview:output_type -> httpsproxy.admin.v1.Overview
+	19, // 26: httpsproxy.admin.v1.AdminService.GetUserQuota:output_type -> httpsproxy.admin.v1.QuotaStatus
+	19, // 27: httpsproxy.admin.v1.AdminService.SetUserQuota:output_type -> httpsproxy.admin.v1.QuotaStatus
+	22, // 28: httpsproxy.admin.v1.AdminService.DeleteUserQuota:output_type -> httpsproxy.admin.v1.DeleteUserQuotaResponse
+	25, // 29: httpsproxy.admin.v1.AdminService.ListTunnels:output_type -> httpsproxy.admin.v1.ListTunnelsResponse
+	25, // 30: httpsproxy.admin.v1.AdminService.WatchTunnels:output_type -> httpsproxy.admin.v1.ListTunnelsResponse
+	18, // [18:31] is the sub-list for method output_type
+	5,  // [5:18] is the sub-list for method input_type
+	5,  // [5:5] is the sub-list for extension type_name
+	5,  // [5:5] is the sub-list for extension extendee
+	0,  // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_admin_proto_init() }
+func file_admin_proto_init() {
+	if File_admin_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_admin_proto_rawDesc), len(file_admin_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   27,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_admin_proto_goTypes,
+		DependencyIndexes: file_admin_proto_depIdxs,
+		MessageInfos:      file_admin_proto_msgTypes,
+	}.Build()
+	File_admin_proto = out.File
+	file_admin_proto_goTypes = nil
+	file_admin_proto_depIdxs = nil
+}
@@ -0,0 +1,624 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: admin.proto
+
+package adminpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	AdminService_ListUsers_FullMethodName       = "/httpsproxy.admin.v1.AdminService/ListUsers"
+	AdminService_GetUser_FullMethodName         = "/httpsproxy.admin.v1.AdminService/GetUser"
+	AdminService_SetUserDisabled_FullMethodName = "/httpsproxy.admin.v1.AdminService/SetUserDisabled"
+	AdminService_GetOverview_FullMethodName     = "/httpsproxy.admin.v1.AdminService/GetOverview"
+	AdminService_GetTopDomains_FullMethodName   = "/httpsproxy.admin.v1.AdminService/GetTopDomains"
+	AdminService_GetTrends_FullMethodName       = "/httpsproxy.admin.v1.AdminService/GetTrends"
+	AdminService_GetCountries_FullMethodName    = "/httpsproxy.admin.v1.AdminService/GetCountries"
+	AdminService_WatchOverview_FullMethodName   = "/httpsproxy.admin.v1.AdminService/WatchOverview"
+	AdminService_GetUserQuota_FullMethodName    = "/httpsproxy.admin.v1.AdminService/GetUserQuota"
+	AdminService_SetUserQuota_FullMethodName    = "/httpsproxy.admin.v1.AdminService/SetUserQuota"
+	AdminService_DeleteUserQuota_FullMethodName = "/httpsproxy.admin.v1.AdminService/DeleteUserQuota"
+	AdminService_ListTunnels_FullMethodName     = "/httpsproxy.admin.v1.AdminService/ListTunnels"
+	AdminService_WatchTunnels_FullMethodName    = "/httpsproxy.admin.v1.AdminService/WatchTunnels"
+)
+
+// AdminServiceClient is the client API for AdminService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// AdminService exposes the core admin operations of the proxy over gRPC.
+// It mirrors the /api/v2 REST endpoints and is served with mutual TLS
+// using the admin panel certificates.
+type AdminServiceClient interface {
+	// ListUsers returns all users ordered by total traffic.
+	ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*ListUsersResponse, error)
+	// GetUser returns a single user's statistics.
+	GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*User, error)
+	// SetUserDisabled enables or disables a user.
+	SetUserDisabled(ctx context.Context, in *SetUserDisabledRequest, opts ...grpc.CallOption) (*SetUserDisabledResponse, error)
+	// GetOverview returns global traffic totals.
+	GetOverview(ctx context.Context, in *GetOverviewRequest, opts ...grpc.CallOption) (*Overview, error)
+	// GetTopDomains returns the domain ranking, optionally for one user.
+	GetTopDomains(ctx context.Context, in *GetTopDomainsRequest, opts ...grpc.CallOption) (*GetTopDomainsResponse, error)
+	// GetTrends returns time-series traffic for the given range.
+	GetTrends(ctx context.Context, in *GetTrendsRequest, opts ...grpc.CallOption) (*GetTrendsResponse, error)
+	// GetCountries returns the country traffic ranking.
+	GetCountries(ctx context.Context, in *GetCountriesRequest, opts ...grpc.CallOption) (*GetCountriesResponse, error)
+	// WatchOverview streams the global overview at a fixed interval until
+	// the client cancels.
+	WatchOverview(ctx context.Context, in *WatchOverviewRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Overview], error)
+	// GetUserQuota returns the quota that applies to a user, their own or
+	// inherited, with this period's usage.
+	GetUserQuota(ctx context.Context, in *GetUserQuotaRequest, opts ...grpc.CallOption) (*QuotaStatus, error)
+	// SetUserQuota gives a user a quota of their own, replacing any other.
+	SetUserQuota(ctx context.Context, in *SetUserQuotaRequest, opts ...grpc.CallOption) (*QuotaStatus, error)
+	// DeleteUserQuota removes a user's own quota.
+	DeleteUserQuota(ctx context.Context, in *DeleteUserQuotaRequest, opts ...grpc.CallOption) (*DeleteUserQuotaResponse, error)
+	// ListTunnels returns the open tunnels, oldest first.
+	ListTunnels(ctx context.Context, in *ListTunnelsRequest, opts ...grpc.CallOption) (*ListTunnelsResponse, error)
+	// WatchTunnels streams the open tunnels at a fixed interval until the
+	// client cancels.
+	WatchTunnels(ctx context.Context, in *WatchTunnelsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ListTunnelsResponse], error)
+}
+
+type adminServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminServiceClient(cc grpc.ClientConnInterface) AdminServiceClient {
+	return &adminServiceClient{cc}
+}
+
+func (c *adminServiceClient) ListUsers(ctx context.Context, in *ListUsersRequest, opts ...grpc.CallOption) (*ListUsersResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListUsersResponse)
+	err := c.cc.Invoke(ctx, AdminService_ListUsers_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*User, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(User)
+	err := c.cc.Invoke(ctx, AdminService_GetUser_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) SetUserDisabled(ctx context.Context, in *SetUserDisabledRequest, opts ...grpc.CallOption) (*SetUserDisabledResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SetUserDisabledResponse)
+	err := c.cc.Invoke(ctx, AdminService_SetUserDisabled_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) GetOverview(ctx context.Context, in *GetOverviewRequest, opts ...grpc.CallOption) (*Overview, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Overview)
+	err := c.cc.Invoke(ctx, AdminService_GetOverview_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) GetTopDomains(ctx context.Context, in *GetTopDomainsRequest, opts ...grpc.CallOption) (*GetTopDomainsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetTopDomainsResponse)
+	err := c.cc.Invoke(ctx, AdminService_GetTopDomains_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) GetTrends(ctx context.Context, in *GetTrendsRequest, opts ...grpc.CallOption) (*GetTrendsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetTrendsResponse)
+	err := c.cc.Invoke(ctx, AdminService_GetTrends_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) GetCountries(ctx context.Context, in *GetCountriesRequest, opts ...grpc.CallOption) (*GetCountriesResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetCountriesResponse)
+	err := c.cc.Invoke(ctx, AdminService_GetCountries_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) WatchOverview(ctx context.Context, in *WatchOverviewRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Overview], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AdminService_ServiceDesc.Streams[0], AdminService_WatchOverview_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchOverviewRequest, Overview]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AdminService_WatchOverviewClient = grpc.ServerStreamingClient[Overview]
+
+func (c *adminServiceClient) GetUserQuota(ctx context.Context, in *GetUserQuotaRequest, opts ...grpc.CallOption) (*QuotaStatus, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(QuotaStatus)
+	err := c.cc.Invoke(ctx, AdminService_GetUserQuota_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) SetUserQuota(ctx context.Context, in *SetUserQuotaRequest, opts ...grpc.CallOption) (*QuotaStatus, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(QuotaStatus)
+	err := c.cc.Invoke(ctx, AdminService_SetUserQuota_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) DeleteUserQuota(ctx context.Context, in *DeleteUserQuotaRequest, opts ...grpc.CallOption) (*DeleteUserQuotaResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteUserQuotaResponse)
+	err := c.cc.Invoke(ctx, AdminService_DeleteUserQuota_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) ListTunnels(ctx context.Context, in *ListTunnelsRequest, opts ...grpc.CallOption) (*ListTunnelsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListTunnelsResponse)
+	err := c.cc.Invoke(ctx, AdminService_ListTunnels_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) WatchTunnels(ctx context.Context, in *WatchTunnelsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ListTunnelsResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &AdminService_ServiceDesc.Streams[1], AdminService_WatchTunnels_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchTunnelsRequest, ListTunnelsResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AdminService_WatchTunnelsClient = grpc.ServerStreamingClient[ListTunnelsResponse]
+
+// AdminServiceServer is the server API for AdminService service.
+// All implementations must embed UnimplementedAdminServiceServer
+// for forward compatibility.
+//
+// AdminService exposes the core admin operations of the proxy over gRPC.
+// It mirrors the /api/v2 REST endpoints and is served with mutual TLS
+// using the admin panel certificates.
+type AdminServiceServer interface {
+	// ListUsers returns all users ordered by total traffic.
+	ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error)
+	// GetUser returns a single user's statistics.
+	GetUser(context.Context, *GetUserRequest) (*User, error)
+	// SetUserDisabled enables or disables a user.
+	SetUserDisabled(context.Context, *SetUserDisabledRequest) (*SetUserDisabledResponse, error)
+	// GetOverview returns global traffic totals.
+	GetOverview(context.Context, *GetOverviewRequest) (*Overview, error)
+	// GetTopDomains returns the domain ranking, optionally for one user.
+	GetTopDomains(context.Context, *GetTopDomainsRequest) (*GetTopDomainsResponse, error)
+	// GetTrends returns time-series traffic for the given range.
+	GetTrends(context.Context, *GetTrendsRequest) (*GetTrendsResponse, error)
+	// GetCountries returns the country traffic ranking.
+	GetCountries(context.Context, *GetCountriesRequest) (*GetCountriesResponse, error)
+	// WatchOverview streams the global overview at a fixed interval until
+	// the client cancels.
+	WatchOverview(*WatchOverviewRequest, grpc.ServerStreamingServer[Overview]) error
+	// GetUserQuota returns the quota that applies to a user, their own or
+	// inherited, with this period's usage.
+	GetUserQuota(context.Context, *GetUserQuotaRequest) (*QuotaStatus, error)
+	// SetUserQuota gives a user a quota of their own, replacing any other.
+	SetUserQuota(context.Context, *SetUserQuotaRequest) (*QuotaStatus, error)
+	// DeleteUserQuota removes a user's own quota.
+	DeleteUserQuota(context.Context, *DeleteUserQuotaRequest) (*DeleteUserQuotaResponse, error)
+	// ListTunnels returns the open tunnels, oldest first.
+	ListTunnels(context.Context, *ListTunnelsRequest) (*ListTunnelsResponse, error)
+	// WatchTunnels streams the open tunnels at a fixed interval until the
+	// client cancels.
+	WatchTunnels(*WatchTunnelsRequest, grpc.ServerStreamingServer[ListTunnelsResponse]) error
+	mustEmbedUnimplementedAdminServiceServer()
+}
+
+// UnimplementedAdminServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedAdminServiceServer struct{}
+
+func (UnimplementedAdminServiceServer) ListUsers(context.Context, *ListUsersRequest) (*ListUsersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUsers not implemented")
+}
+func (UnimplementedAdminServiceServer) GetUser(context.Context, *GetUserRequest) (*User, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUser not implemented")
+}
+func (UnimplementedAdminServiceServer) SetUserDisabled(context.Context, *SetUserDisabledRequest) (*SetUserDisabledResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetUserDisabled not implemented")
+}
+func (UnimplementedAdminServiceServer) GetOverview(context.Context, *GetOverviewRequest) (*Overview, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetOverview not implemented")
+}
+func (UnimplementedAdminServiceServer) GetTopDomains(context.Context, *GetTopDomainsRequest) (*GetTopDomainsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTopDomains not implemented")
+}
+func (UnimplementedAdminServiceServer) GetTrends(context.Context, *GetTrendsRequest) (*GetTrendsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTrends not implemented")
+}
+func (UnimplementedAdminServiceServer) GetCountries(context.Context, *GetCountriesRequest) (*GetCountriesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCountries not implemented")
+}
+func (UnimplementedAdminServiceServer) WatchOverview(*WatchOverviewRequest, grpc.ServerStreamingServer[Overview]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchOverview not implemented")
+}
+func (UnimplementedAdminServiceServer) GetUserQuota(context.Context, *GetUserQuotaRequest) (*QuotaStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUserQuota not implemented")
+}
+func (UnimplementedAdminServiceServer) SetUserQuota(context.Context, *SetUserQuotaRequest) (*QuotaStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetUserQuota not implemented")
+}
+func (UnimplementedAdminServiceServer) DeleteUserQuota(context.Context, *DeleteUserQuotaRequest) (*DeleteUserQuotaResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteUserQuota not implemented")
+}
+func (UnimplementedAdminServiceServer) ListTunnels(context.Context, *ListTunnelsRequest) (*ListTunnelsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListTunnels not implemented")
+}
+func (UnimplementedAdminServiceServer) WatchTunnels(*WatchTunnelsRequest, grpc.ServerStreamingServer[ListTunnelsResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchTunnels not implemented")
+}
+func (UnimplementedAdminServiceServer) mustEmbedUnimplementedAdminServiceServer() {}
+func (UnimplementedAdminServiceServer) testEmbeddedByValue()                      {}
+
+// UnsafeAdminServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServiceServer will
+// result in compilation errors.
+type UnsafeAdminServiceServer interface {
+	mustEmbedUnimplementedAdminServiceServer()
+}
+
+func RegisterAdminServiceServer(s grpc.ServiceRegistrar, srv AdminServiceServer) {
+	// If the following call pancis, it indicates UnimplementedAdminServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&AdminService_ServiceDesc, srv)
+}
+
+func _AdminService_ListUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).ListUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_ListUsers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).ListUsers(ctx, req.(*ListUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_GetUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).GetUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_GetUser_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).GetUser(ctx, req.(*GetUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_SetUserDisabled_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetUserDisabledRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).SetUserDisabled(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_SetUserDisabled_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).SetUserDisabled(ctx, req.(*SetUserDisabledRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_GetOverview_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetOverviewRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).GetOverview(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_GetOverview_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).GetOverview(ctx, req.(*GetOverviewRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_GetTopDomains_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTopDomainsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).GetTopDomains(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_GetTopDomains_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).GetTopDomains(ctx, req.(*GetTopDomainsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_GetTrends_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTrendsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).GetTrends(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_GetTrends_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).GetTrends(ctx, req.(*GetTrendsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_GetCountries_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCountriesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).GetCountries(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_GetCountries_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).GetCountries(ctx, req.(*GetCountriesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_WatchOverview_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchOverviewRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AdminServiceServer).WatchOverview(m, &grpc.GenericServerStream[WatchOverviewRequest, Overview]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AdminService_WatchOverviewServer = grpc.ServerStreamingServer[Overview]
+
+func _AdminService_GetUserQuota_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserQuotaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).GetUserQuota(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_GetUserQuota_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).GetUserQuota(ctx, req.(*GetUserQuotaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_SetUserQuota_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetUserQuotaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).SetUserQuota(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_SetUserQuota_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).SetUserQuota(ctx, req.(*SetUserQuotaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_DeleteUserQuota_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteUserQuotaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).DeleteUserQuota(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_DeleteUserQuota_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).DeleteUserQuota(ctx, req.(*DeleteUserQuotaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_ListTunnels_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListTunnelsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).ListTunnels(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_ListTunnels_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).ListTunnels(ctx, req.(*ListTunnelsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_WatchTunnels_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchTunnelsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AdminServiceServer).WatchTunnels(m, &grpc.GenericServerStream[WatchTunnelsRequest, ListTunnelsResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type AdminService_WatchTunnelsServer = grpc.ServerStreamingServer[ListTunnelsResponse]
+
+// AdminService_ServiceDesc is the grpc.ServiceDesc for AdminService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var AdminService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "httpsproxy.admin.v1.AdminService",
+	HandlerType: (*AdminServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListUsers",
+			Handler:    _AdminService_ListUsers_Handler,
+		},
+		{
+			MethodName: "GetUser",
+			Handler:    _AdminService_GetUser_Handler,
+		},
+		{
+			MethodName: "SetUserDisabled",
+			Handler:    _AdminService_SetUserDisabled_Handler,
+		},
+		{
+			MethodName: "GetOverview",
+			Handler:    _AdminService_GetOverview_Handler,
+		},
+		{
+			MethodName: "GetTopDomains",
+			Handler:    _AdminService_GetTopDomains_Handler,
+		},
+		{
+			MethodName: "GetTrends",
+			Handler:    _AdminService_GetTrends_Handler,
+		},
+		{
+			MethodName: "GetCountries",
+			Handler:    _AdminService_GetCountries_Handler,
+		},
+		{
+			MethodName: "GetUserQuota",
+			Handler:    _AdminService_GetUserQuota_Handler,
+		},
+		{
+			MethodName: "SetUserQuota",
+			Handler:    _AdminService_SetUserQuota_Handler,
+		},
+		{
+			MethodName: "DeleteUserQuota",
+			Handler:    _AdminService_DeleteUserQuota_Handler,
+		},
+		{
+			MethodName: "ListTunnels",
+			Handler:    _AdminService_ListTunnels_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchOverview",
+			Handler:       _AdminService_WatchOverview_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchTunnels",
+			Handler:       _AdminService_WatchTunnels_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "admin.proto",
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // registerV2API registers all v2 REST API routes on the given mux.
-// The StatsDB must be non-nil; if it is nil the routes will return 503.
-func registerV2API(mux *http.ServeMux, statsDB *StatsDB) {
+// If the StatsDB is nil the stats routes will return 503.
+func registerV2API(mux *http.ServeMux, config *Config, statsManager *StatsManager, statsDB *StatsDB, policy *PolicyEngine, history *ConfigHistory) {
 	// Wrapper that checks StatsDB availability
 	check := func(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
@@ -21,38 +27,218 @@ func registerV2API(mux *http.ServeMux, statsDB *StatsDB) {
 	}
 
 	mux.HandleFunc("/api/v2/overview", check(func(w http.ResponseWriter, r *http.Request) {
-		overview, err := statsDB.GetOverview()
-		if err != nil {
-			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
-			return
-		}
-		writeJSONResponse(w, WebResponse{Success: true, Data: overview}, http.StatusOK)
+		overview, err := statsDB.GetOverview(r.Context())
+		writeStatsResponse(w, overview, err)
 	}))
 
 	mux.HandleFunc("/api/v2/users", check(func(w http.ResponseWriter, r *http.Request) {
-		users, err := statsDB.GetAllUsers()
-		if err != nil {
-			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
-			return
-		}
-		writeJSONResponse(w, WebResponse{Success: true, Data: users}, http.StatusOK)
+		users, err := statsDB.GetAllUsers(r.Context())
+		writeStatsResponse(w, users, err)
 	}))
 
-	mux.HandleFunc("/api/v2/users/", check(func(w http.ResponseWriter, r *http.Request) {
-		// Extract username from path: /api/v2/users/{username}
+	userHandler := check(func(w http.ResponseWriter, r *http.Request) {
+		// Extract username from path: /api/v2/users/{username}[/timeline|/expiry|/dial-failures|/throughput]
 		username := r.URL.Path[len("/api/v2/users/"):]
+		username, timeline := strings.CutSuffix(username, "/timeline")
+		username, expiry := strings.CutSuffix(username, "/expiry")
+		username, dialFailures := strings.CutSuffix(username, "/dial-failures")
+		username, throughput := strings.CutSuffix(username, "/throughput")
 		if username == "" {
 			writeJSONResponse(w, WebResponse{Success: false, Error: "username required"}, http.StatusBadRequest)
 			return
 		}
-		user, err := statsDB.GetUser(username)
+		if expiry {
+			handleUserExpiry(w, r, statsDB, username)
+			return
+		}
+		if dialFailures {
+			limit := 20
+			if l := r.URL.Query().Get("limit"); l != "" {
+				if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 1000 {
+					limit = n
+				}
+			}
+			failures, err := statsDB.GetDialFailures(r.Context(), username, limit)
+			writeStatsResponse(w, failures, err)
+			return
+		}
+		if throughput {
+			limit := 10
+			if l := r.URL.Query().Get("limit"); l != "" {
+				if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 100 {
+					limit = n
+				}
+			}
+			samples, err := statsDB.GetTunnelSamples(r.Context(), username, limit)
+			writeStatsResponse(w, samples, err)
+			return
+		}
+		if timeline {
+			limit := 100
+			if l := r.URL.Query().Get("limit"); l != "" {
+				if n, err := strconv.Atoi(l); err == nil && n > 0 && n <= 1000 {
+					limit = n
+				}
+			}
+			entries, err := statsDB.GetUserTimeline(r.Context(), username, limit)
+			writeStatsResponse(w, entries, err)
+			return
+		}
+		user, err := statsDB.GetUser(r.Context(), username)
 		if err != nil {
 			writeJSONResponse(w, WebResponse{Success: false, Error: "user not found"}, http.StatusNotFound)
 			return
 		}
 		writeJSONResponse(w, WebResponse{Success: true, Data: user}, http.StatusOK)
+	})
+	mux.HandleFunc("/api/v2/users/", func(w http.ResponseWriter, r *http.Request) {
+		// Onboarding needs no stats: users are set up before any traffic
+		if username, ok := strings.CutSuffix(r.URL.Path[len("/api/v2/users/"):], "/client-config"); ok && username != "" {
+			handleClientConfig(w, r, config, username)
+			return
+		}
+		if username, ok := strings.CutSuffix(r.URL.Path[len("/api/v2/users/"):], "/provision.png"); ok && username != "" {
+			handleProvision(w, r, config, provisioner, username)
+			return
+		}
+		// Rate limits live in the policy engine, not the stats
+		if username, ok := strings.CutSuffix(r.URL.Path[len("/api/v2/users/"):], "/rate-limit"); ok && username != "" {
+			var limits *UserRateLimits
+			if policy != nil {
+				limits = policy.RateLimits
+			}
+			handleUserRateLimit(w, r, config, history, limits, username)
+			return
+		}
+		if username, ok := strings.CutSuffix(r.URL.Path[len("/api/v2/users/"):], "/quota"); ok && username != "" {
+			var quotas *UserQuotas
+			if policy != nil {
+				quotas = policy.Quotas
+			}
+			handleUserQuota(w, r, quotas, username)
+			return
+		}
+		if username, ok := strings.CutSuffix(r.URL.Path[len("/api/v2/users/"):], "/groups"); ok && username != "" {
+			handleUserGroups(w, r, policy, username)
+			return
+		}
+		userHandler(w, r)
+	})
+
+	mux.HandleFunc("/api/v2/users/bulk", check(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+			return
+		}
+		var req BulkUserRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "invalid request body: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		results, err := runBulkUserAction(r.Context(), req, statsManager, statsDB, "api:"+adminName(r))
+		if err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		writeJSONResponse(w, WebResponse{Success: true, Data: results}, http.StatusOK)
 	}))
 
+	// Client certificates issued elsewhere, imported from a PEM bundle
+	mux.HandleFunc("/api/v2/users/certs", check(func(w http.ResponseWriter, r *http.Request) {
+		handleCertImport(w, r, config, statsDB)
+	}))
+
+	mux.HandleFunc("/api/v2/users/trial", check(func(w http.ResponseWriter, r *http.Request) {
+		if policy == nil || policy.Trials == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Trial accounts not available"}, http.StatusServiceUnavailable)
+			return
+		}
+		handleTrials(w, r, policy.Trials)
+	}))
+
+	// Per-user traffic quotas with this period's usage
+	mux.HandleFunc("/api/v2/quotas", check(func(w http.ResponseWriter, r *http.Request) {
+		if policy == nil || policy.Quotas == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Quotas not available"}, http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method != http.MethodGet {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSONResponse(w, WebResponse{Success: true, Data: policy.Quotas.List(time.Now())}, http.StatusOK)
+	}))
+
+	// Allow and deny rules for target hosts, and the requests they refused
+	mux.HandleFunc("/api/v2/acl", func(w http.ResponseWriter, r *http.Request) {
+		var acl *DomainACL
+		if policy != nil {
+			acl = policy.ACL
+		}
+		handleACL(w, r, acl)
+	})
+	mux.HandleFunc("/api/v2/acl/blocked", check(func(w http.ResponseWriter, r *http.Request) {
+		limit := 100
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+			limit = n
+		}
+		blocks, err := statsDB.GetACLBlocks(r.Context(), r.URL.Query().Get("user"), limit)
+		writeStatsResponse(w, blocks, err)
+	}))
+	mux.HandleFunc("/api/v2/acl/hits", check(func(w http.ResponseWriter, r *http.Request) {
+		if policy == nil || policy.ACL == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Domain ACL not available"}, http.StatusServiceUnavailable)
+			return
+		}
+		hours := 24
+		if n, err := strconv.Atoi(r.URL.Query().Get("hours")); err == nil && n > 0 {
+			hours = n
+		}
+		hits, err := policy.ACL.HitRates(r.Context(), hours, time.Now())
+		writeStatsResponse(w, hits, err)
+	}))
+
+	// Country rate limits, with the tunnels each paced
+	mux.HandleFunc("/api/v2/rate-limits/countries", func(w http.ResponseWriter, r *http.Request) {
+		if policy == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Policy engine not available"}, http.StatusServiceUnavailable)
+			return
+		}
+		hours := 24
+		if n, err := strconv.Atoi(r.URL.Query().Get("hours")); err == nil && n > 0 {
+			hours = n
+		}
+		limits, err := policy.CountryLimits.HitRates(r.Context(), hours, time.Now())
+		writeStatsResponse(w, limits, err)
+	})
+
+	// Groups with their inherited policies and API-assigned members
+	mux.HandleFunc("/api/v2/groups", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+			return
+		}
+		var groups *UserGroups
+		if policy != nil {
+			groups = policy.Groups
+		}
+		writeJSONResponse(w, WebResponse{Success: true, Data: groups.List()}, http.StatusOK)
+	})
+
+	// Usage of a group quota its members share
+	mux.HandleFunc("/api/v2/groups/", func(w http.ResponseWriter, r *http.Request) {
+		group, ok := strings.CutSuffix(r.URL.Path[len("/api/v2/groups/"):], "/quota")
+		if !ok || group == "" {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Not found"}, http.StatusNotFound)
+			return
+		}
+		var quotas *UserQuotas
+		if policy != nil {
+			quotas = policy.Quotas
+		}
+		handleGroupQuota(w, r, quotas, group)
+	})
+
 	mux.HandleFunc("/api/v2/domains", check(func(w http.ResponseWriter, r *http.Request) {
 		limit := 50
 		if l := r.URL.Query().Get("limit"); l != "" {
@@ -61,12 +247,8 @@ func registerV2API(mux *http.ServeMux, statsDB *StatsDB) {
 			}
 		}
 		user := r.URL.Query().Get("user")
-		domains, err := statsDB.GetTopDomains(limit, user)
-		if err != nil {
-			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
-			return
-		}
-		writeJSONResponse(w, WebResponse{Success: true, Data: domains}, http.StatusOK)
+		domains, err := statsDB.GetTopDomains(r.Context(), limit, user)
+		writeStatsResponse(w, domains, err)
 	}))
 
 	mux.HandleFunc("/api/v2/trends", check(func(w http.ResponseWriter, r *http.Request) {
@@ -74,28 +256,436 @@ func registerV2API(mux *http.ServeMux, statsDB *StatsDB) {
 		if rangeStr == "" {
 			rangeStr = "1h"
 		}
-		trends, err := statsDB.GetTrends(rangeStr)
+		trends, err := statsDB.GetTrends(r.Context(), rangeStr)
+		writeStatsResponse(w, trends, err)
+	}))
+
+	mux.HandleFunc("/api/v2/trends/countries", check(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		top := 10
+		if n, err := strconv.Atoi(q.Get("top")); err == nil && n > 0 && n <= 50 {
+			top = n
+		}
+		trends, err := statsDB.GetGeoTrends(r.Context(), q.Get("range"), q.Get("by"), top)
+		writeStatsResponse(w, trends, err)
+	}))
+
+	mux.HandleFunc("/api/v2/countries", check(func(w http.ResponseWriter, r *http.Request) {
+		countries, err := statsDB.GetCountryStats(r.Context())
+		writeStatsResponse(w, countries, err)
+	}))
+
+	mux.HandleFunc("/api/v2/countries/", check(func(w http.ResponseWriter, r *http.Request) {
+		// Extract ISO country code from path: /api/v2/countries/{code}
+		code := strings.ToUpper(r.URL.Path[len("/api/v2/countries/"):])
+		if len(code) != 2 || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "invalid country code"}, http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		limit, hours := 10, 24
+		if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 && n <= 100 {
+			limit = n
+		}
+		if n, err := strconv.Atoi(q.Get("hours")); err == nil && n > 0 && n <= 7*24 {
+			hours = n
+		}
+		detail, err := statsDB.GetCountryDetail(r.Context(), code, limit, hours)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "no traffic from country"}, http.StatusNotFound)
+			return
+		}
+		writeStatsResponse(w, detail, err)
+	}))
+
+	mux.HandleFunc("/api/v2/camouflage", check(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		hours, limit := 24, 10
+		if n, err := strconv.Atoi(q.Get("hours")); err == nil && n > 0 && n <= 7*24 {
+			hours = n
+		}
+		if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 && n <= 100 {
+			limit = n
+		}
+		stats, err := statsDB.GetCamouflageStats(r.Context(), hours, limit)
+		writeStatsResponse(w, stats, err)
+	}))
+
+	mux.HandleFunc("/api/v2/tags", check(func(w http.ResponseWriter, r *http.Request) {
+		tags, err := statsDB.GetTagStats(r.Context(), r.URL.Query().Get("user"))
+		writeStatsResponse(w, tags, err)
+	}))
+
+	// The users in the format of the legacy JSON stats file, for older tooling
+	mux.HandleFunc("/api/v2/export/legacy-json", check(func(w http.ResponseWriter, r *http.Request) {
+		stats, err := statsDB.ExportLegacyJSON(r.Context())
+		if errors.Is(err, ErrPartialResult) {
+			// The file has no room for the flag; a cut-short export is refused
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInsufficientStorage)
+			return
+		}
+		if err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		data, err := json.MarshalIndent(stats, "", "  ")
 		if err != nil {
 			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
 			return
 		}
-		writeJSONResponse(w, WebResponse{Success: true, Data: trends}, http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="stats.json"`)
+		w.Write(data)
 	}))
 
-	mux.HandleFunc("/api/v2/countries", check(func(w http.ResponseWriter, r *http.Request) {
-		countries, err := statsDB.GetCountryStats()
+	// Tunnel duration and time-to-first-byte histograms per user or domain
+	mux.HandleFunc("/api/v2/latency", check(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		scope := q.Get("scope")
+		if scope == "" {
+			scope = "user"
+		}
+		if scope != "user" && scope != "domain" {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "scope must be user or domain"}, http.StatusBadRequest)
+			return
+		}
+		limit := 50
+		if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+		hists, err := statsDB.GetLatencyHistograms(r.Context(), scope, q.Get("name"), limit)
+		writeStatsResponse(w, hists, err)
+	}))
+
+	// Proxy instances that recorded traffic, or with ?node= the users of
+	// one, over the last ?hours (default 24)
+	mux.HandleFunc("/api/v2/nodes", check(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		hours := 24
+		if n, err := strconv.Atoi(q.Get("hours")); err == nil && n > 0 && n <= 24*365 {
+			hours = n
+		}
+		since := time.Now().Add(-time.Duration(hours) * time.Hour)
+		if node := q.Get("node"); node != "" {
+			users, err := statsDB.GetNodeUsers(r.Context(), node, since)
+			writeStatsResponse(w, users, err)
+			return
+		}
+		nodes, err := statsDB.GetNodes(r.Context(), since)
+		writeStatsResponse(w, map[string]interface{}{"self": statsDB.Node(), "nodes": nodes}, err)
+	}))
+
+	mux.HandleFunc("/api/v2/storage", check(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			// Pause or resume writes, e.g. around a migration
+			var req struct {
+				ReadOnly *bool `json:"read_only"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ReadOnly == nil {
+				writeJSONResponse(w, WebResponse{Success: false, Error: "read_only is required"}, http.StatusBadRequest)
+				return
+			}
+			if err := statsDB.SetReadOnly(*req.ReadOnly); err != nil {
+				writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusConflict)
+				return
+			}
+			log.Printf("Stats database switched %s by %s", map[bool]string{true: "read-only", false: "read-write"}[*req.ReadOnly], adminName(r))
+		default:
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+			return
+		}
+		writeStorageStatus(w, r, config, statsDB)
+	}))
+
+	// Move the database file at runtime, e.g. off a filling disk:
+	// {"path": "/mnt/big/proxy_stats.db", "persist": true}. persist also
+	// sets stats.db_path in the config file, which a restart would
+	// otherwise reopen.
+	mux.HandleFunc("/api/v2/storage/move", check(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Path    string `json:"path"`
+			Persist bool   `json:"persist"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "path is required"}, http.StatusBadRequest)
+			return
+		}
+		if req.Persist && history == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "the configuration was not loaded from a file and cannot be persisted"}, http.StatusBadRequest)
+			return
+		}
+		actor := "api:" + adminName(r)
+		oldPath := statsDB.Path()
+		if err := statsDB.Move(req.Path); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errMoveRefused) {
+				status = http.StatusConflict
+			}
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, status)
+			return
+		}
+		config.mu.Lock()
+		config.Stats.DBPath = statsDB.Path()
+		config.mu.Unlock()
+		log.Printf("Stats database moved from %s to %s by %s", oldPath, statsDB.Path(), actor)
+		changeFeed.Publish(ChangeEvent{Type: ChangeSettings, Actor: actor, Detail: "stats.db_path"})
+		if req.Persist {
+			if err := editConfigFile(config, history, actor, func(set func(value interface{}, keys ...string)) {
+				set(statsDB.Path(), "stats", "db_path")
+			}); err != nil {
+				writeJSONResponse(w, WebResponse{Success: false, Error: "database moved but not saved: " + err.Error()}, http.StatusInternalServerError)
+				return
+			}
+		} else {
+			log.Printf("Warning: stats.db_path in the config file still names %s; update it before restarting", oldPath)
+		}
+		writeStorageStatus(w, r, config, statsDB)
+	}))
+
+	// Anomalies: users currently flagged for likely P2P traffic and the
+	// protocol violation / P2P events of the last ?hours (default 24)
+	mux.HandleFunc("/api/v2/anomalies", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		hours := 24
+		if n, err := strconv.Atoi(q.Get("hours")); err == nil && n > 0 && n <= 24*30 {
+			hours = n
+		}
+		limit := 100
+		if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+		now := time.Now()
+		resp := AnomaliesResponse{Flagged: []P2PFlag{}, Events: []UserEvent{}}
+		if policy != nil {
+			if flagged := policy.Protocols.P2PFlagged(now); flagged != nil {
+				resp.Flagged = flagged
+			}
+		}
+		if statsDB != nil {
+			events, err := statsDB.GetAnomalies(r.Context(), now.Add(-time.Duration(hours)*time.Hour), limit)
+			resp.Events = events
+			writeStatsResponse(w, resp, err)
+			return
+		}
+		writeJSONResponse(w, WebResponse{Success: true, Data: resp}, http.StatusOK)
+	})
+
+	// Open tunnels; ?expired=true lists only those outliving their certificate
+	mux.HandleFunc("/api/v2/reputation", func(w http.ResponseWriter, r *http.Request) {
+		var feeds *ReputationFeeds
+		if policy != nil {
+			feeds = policy.Reputation
+		}
+		handleReputation(w, r, feeds)
+	})
+
+	mux.HandleFunc("/api/v2/gate", func(w http.ResponseWriter, r *http.Request) {
+		var gate *KnockGate
+		if policy != nil {
+			gate = policy.Gate
+		}
+		handleGate(w, r, gate)
+	})
+
+	// Change notifications for sidecar automation
+	mux.HandleFunc("/api/v2/events", func(w http.ResponseWriter, r *http.Request) {
+		handleChangeEvents(w, r, changeFeed)
+	})
+
+	mux.HandleFunc("/api/v2/tls/tickets", func(w http.ResponseWriter, r *http.Request) {
+		handleSessionTickets(w, r, sessionTickets)
+	})
+
+	mux.HandleFunc("/api/v2/connections", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		expired, _ := strconv.ParseBool(q.Get("expired"))
+		writeJSONResponse(w, WebResponse{Success: true, Data: tunnels.List(time.Now(), q.Get("user"), expired)}, http.StatusOK)
+	})
+
+	// Every certificate the built-in CA issued, hash-chained
+	caLog := func(w http.ResponseWriter, r *http.Request) {
+		handleCALog(w, r, config)
+	}
+	mux.HandleFunc("/api/v2/ca/log", caLog)
+	mux.HandleFunc("/api/v2/ca/log/verify", caLog)
+
+	// Certificate, config and database checks, also printed by -doctor
+	mux.HandleFunc("/api/v2/diagnostics", func(w http.ResponseWriter, r *http.Request) {
+		handleDiagnostics(w, r, config, statsDB)
+	})
+
+	// Tunnels cut by the last crash or restart (proxy.tunnel_checkpoint)
+	mux.HandleFunc("/api/v2/connections/interrupted", func(w http.ResponseWriter, r *http.Request) {
+		handleInterruptedTunnels(w, r, tunnels)
+	})
+
+	// Maintenance mode status and control
+	mux.HandleFunc("/api/v2/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		if policy == nil || policy.Maintenance == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Policy engine not available"}, http.StatusServiceUnavailable)
+			return
+		}
+		m := policy.Maintenance
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req MaintenanceUpdate
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSONResponse(w, WebResponse{Success: false, Error: "invalid request body: " + err.Error()}, http.StatusBadRequest)
+				return
+			}
+			if req.Windows != nil {
+				if err := m.SetWindows(*req.Windows); err != nil {
+					writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusBadRequest)
+					return
+				}
+			}
+			if req.Enabled != nil {
+				m.SetManual(*req.Enabled, req.Until, req.Message)
+				log.Printf("Maintenance mode switched %s by %s", map[bool]string{true: "on", false: "off"}[*req.Enabled], adminName(r))
+			}
+			if req.Windows != nil || req.Enabled != nil {
+				detail := "windows updated"
+				if req.Enabled != nil {
+					detail = "switched " + map[bool]string{true: "on", false: "off"}[*req.Enabled]
+				}
+				changeFeed.Publish(ChangeEvent{Type: ChangeMaintenance, Actor: "api:" + adminName(r), Detail: detail})
+			}
+		default:
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSONResponse(w, WebResponse{Success: true, Data: m.Status(time.Now())}, http.StatusOK)
+	})
+
+	// Config version history, diffs against the current file and rollback
+	mux.HandleFunc("/api/v2/config/history", func(w http.ResponseWriter, r *http.Request) {
+		if history == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Config history not available"}, http.StatusServiceUnavailable)
+			return
+		}
+		versions, err := history.List()
 		if err != nil {
 			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
 			return
 		}
-		writeJSONResponse(w, WebResponse{Success: true, Data: countries}, http.StatusOK)
-	}))
+		writeJSONResponse(w, WebResponse{Success: true, Data: versions}, http.StatusOK)
+	})
+
+	mux.HandleFunc("/api/v2/config/history/", func(w http.ResponseWriter, r *http.Request) {
+		if history == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Config history not available"}, http.StatusServiceUnavailable)
+			return
+		}
+		// Extract version from path: /api/v2/config/history/{id}[/rollback]
+		id := r.URL.Path[len("/api/v2/config/history/"):]
+		id, rollback := strings.CutSuffix(id, "/rollback")
+		if rollback {
+			if r.Method != http.MethodPost {
+				writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+				return
+			}
+			if err := history.Rollback(id, "api:"+adminName(r)); err != nil {
+				writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusBadRequest)
+				return
+			}
+			log.Printf("Config rolled back to version %s by %s", id, adminName(r))
+			writeJSONResponse(w, WebResponse{Success: true, Data: map[string]interface{}{
+				"restored":         id,
+				"restart_required": true,
+			}}, http.StatusOK)
+			return
+		}
+
+		content, err := history.Read(id)
+		if err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "version not found"}, http.StatusNotFound)
+			return
+		}
+		diff, err := history.Diff(id)
+		if err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		writeJSONResponse(w, WebResponse{Success: true, Data: map[string]interface{}{
+			"id":      id,
+			"content": string(redactConfig(content)),
+			"diff":    diff,
+		}}, http.StatusOK)
+	})
+
+	// Dry-run a hypothetical request through the access policy
+	mux.HandleFunc("/api/v2/policy/simulate", func(w http.ResponseWriter, r *http.Request) {
+		if policy == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Policy engine not available"}, http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+			return
+		}
+		var req PolicyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "invalid request body: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if req.Username == "" {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "user required"}, http.StatusBadRequest)
+			return
+		}
+		if req.Port == "" {
+			req.Port = "443"
+		}
+		writeJSONResponse(w, WebResponse{Success: true, Data: policy.Evaluate(req)}, http.StatusOK)
+	})
 }
 
 // writeJSONResponseV2 is a helper that sets JSON content type and writes body.
 // We reuse writeJSONResponse from admin.go, but define an alias for clarity.
+// writeStatsResponse writes the result of a stats read: its data, flagged
+// partial if the query limits cut the read short, or its error
+func writeStatsResponse(w http.ResponseWriter, data interface{}, err error) {
+	switch {
+	case err == nil:
+		writeJSONResponse(w, WebResponse{Success: true, Data: data}, http.StatusOK)
+	case errors.Is(err, ErrPartialResult):
+		w.Header().Set("X-Partial-Result", "true")
+		writeJSONResponse(w, WebResponse{Success: true, Data: data, Partial: true}, http.StatusOK)
+	case errors.Is(err, context.DeadlineExceeded):
+		writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusGatewayTimeout)
+	default:
+		writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+	}
+}
+
 func writeJSONResponseV2(w http.ResponseWriter, data interface{}, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(data)
 }
+
+// writeStorageStatus answers /api/v2/storage requests with the database's
+// current state
+func writeStorageStatus(w http.ResponseWriter, r *http.Request, config *Config, statsDB *StatsDB) {
+	size, err := statsDB.Size()
+	if err != nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	status := StorageStatus{
+		SizeBytes:    size,
+		MaxBytes:     int64(config.Stats.Retention.MaxDBSizeMB) << 20,
+		LastPrune:    statsDB.LastSizePrune(),
+		LastArchive:  statsDB.LastArchive(),
+		LegacyImport: statsDB.LegacyImport(r.Context()),
+		ReadOnly:     statsDB.ReadOnly(),
+		Path:         statsDB.Path(),
+	}
+	writeJSONResponse(w, WebResponse{Success: true, Data: status}, http.StatusOK)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestV2API_PolicySimulate(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	db.SetUserDisabled("bob", true)
+
+	cfg := &Config{}
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, db, NewPolicyEngine(cfg, nil, db), nil)
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+		wantAllow  bool
+	}{
+		{"wrong method", http.MethodGet, "", http.StatusMethodNotAllowed, false},
+		{"invalid json", http.MethodPost, "{", http.StatusBadRequest, false},
+		{"missing user", http.MethodPost, `{"host":"example.com"}`, http.StatusBadRequest, false},
+		{"enabled user", http.MethodPost, `{"user":"alice","host":"example.com"}`, http.StatusOK, true},
+		{"disabled user", http.MethodPost, `{"user":"bob","host":"example.com"}`, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/v2/policy/simulate", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var resp struct {
+				Success bool           `json:"success"`
+				Data    PolicyDecision `json:"data"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Data.Allowed != tt.wantAllow {
+				t.Errorf("allowed = %v, want %v", resp.Data.Allowed, tt.wantAllow)
+			}
+			if !tt.wantAllow && (resp.Data.Blocking == nil || resp.Data.Blocking.Rule != "user_status") {
+				t.Errorf("blocking = %+v, want user_status", resp.Data.Blocking)
+			}
+		})
+	}
+}
+
+func TestV2API_PolicySimulateWithoutEngine(t *testing.T) {
+	mux := http.NewServeMux()
+	registerV2API(mux, &Config{}, nil, nil, nil, nil)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v2/policy/simulate", strings.NewReader(`{"user":"alice"}`)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rec.Code)
+	}
+}
+
+func TestV2API_UserTimeline(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	db.SetUserDisabled("alice", true)
+	db.RecordUserEvent("alice", EventUserDisabled, "web:admin", "")
+
+	mux := http.NewServeMux()
+	registerV2API(mux, &Config{}, nil, db, nil, nil)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/users/alice/timeline", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Data []TimelineEntry `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) == 0 || resp.Data[0].Type != EventUserDisabled {
+		t.Errorf("unexpected timeline: %+v", resp.Data)
+	}
+}
+
+func TestV2API_BulkUsers(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	for _, name := range []string{"team-a", "team-b", "solo"} {
+		db.SetUserDisabled(name, false)
+	}
+	sm := NewStatsManager(&Config{})
+
+	mux := http.NewServeMux()
+	registerV2API(mux, &Config{}, sm, db, nil, nil)
+	post := func(body string) (*httptest.ResponseRecorder, []BulkUserResult) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v2/users/bulk", strings.NewReader(body)))
+		var resp struct {
+			Data []BulkUserResult `json:"data"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec, resp.Data
+	}
+
+	for _, body := range []string{
+		`{"action":"delete","usernames":["solo"]}`,
+		`{"action":"disable"}`,
+		`{"action":"disable","usernames":["solo"],"filter":{"username":"team-*"}}`,
+		`{"action":"disable","filter":{"username":"["}}`,
+	} {
+		if rec, _ := post(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, rec.Code)
+		}
+	}
+
+	rec, results := post(`{"action":"disable","filter":{"username":"team-*"},"dry_run":true}`)
+	if rec.Code != http.StatusOK || len(results) != 2 {
+		t.Fatalf("dry run: status %d, results %+v", rec.Code, results)
+	}
+	if db.IsUserDisabled("team-a") {
+		t.Error("dry run changed state")
+	}
+
+	rec, results = post(`{"action":"disable","filter":{"username":"team-*"}}`)
+	if rec.Code != http.StatusOK || len(results) != 2 {
+		t.Fatalf("disable: status %d, results %+v", rec.Code, results)
+	}
+	for _, name := range []string{"team-a", "team-b"} {
+		if !db.IsUserDisabled(name) || !sm.IsUserDisabled(name) {
+			t.Errorf("%s should be disabled in the database and in memory", name)
+		}
+	}
+	if db.IsUserDisabled("solo") {
+		t.Error("filter matched solo")
+	}
+
+	_, results = post(`{"action":"enable","usernames":["team-a","team-a","new-user"]}`)
+	if len(results) != 2 || !results[0].OK || !results[0].Changed {
+		t.Errorf("enable by list: %+v", results)
+	}
+	if db.IsUserDisabled("team-a") {
+		t.Error("team-a should be enabled")
+	}
+}
+
+func TestV2API_CountryDetail(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	now := time.Now()
+	db.BatchUpsert([]TrafficRecord{{Username: "alice", Domain: "example.com", Country: "DE", Download: 10, ConnCount: 1,
+		Hour: now.Format("2006-01-02T15:00:00"), Timestamp: now}})
+
+	mux := http.NewServeMux()
+	registerV2API(mux, &Config{}, nil, db, nil, nil)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/api/v2/countries/de", http.StatusOK},
+		{"/api/v2/countries/JP", http.StatusNotFound},
+		{"/api/v2/countries/DEU", http.StatusBadRequest},
+		{"/api/v2/countries/", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", tt.path, rec.Code, tt.wantStatus, rec.Body)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			Data DBCountryDetail `json:"data"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data.Country != "DE" || len(resp.Data.TopUsers) != 1 || len(resp.Data.TopDomains) != 1 || len(resp.Data.Hourly) != 1 {
+			t.Errorf("unexpected detail: %+v", resp.Data)
+		}
+	}
+}
+
+func TestV2API_ExportLegacyJSON(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	db.BatchUpsert([]TrafficRecord{{Username: "alice", Upload: 10, Download: 30, ConnCount: 1, Timestamp: time.Now()}})
+
+	mux := http.NewServeMux()
+	registerV2API(mux, &Config{}, nil, db, nil, nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/export/legacy-json", nil))
+
+	// Same shape as the legacy stats file, readable by readStatsFile
+	var stats map[string]*UserStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if u := stats["alice"]; rec.Code != http.StatusOK || u == nil || u.TotalBytes != 40 || u.ConnectionCount != 1 {
+		t.Errorf("export = %d %+v", rec.Code, stats)
+	}
+}
+
+func TestV2API_Nodes(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	now := time.Now()
+	hour := now.Format("2006-01-02T15:00:00")
+
+	// Two instances writing to one database: traffic stays attributable
+	db.SetNode("edge-1", map[string]string{"region": "eu"})
+	db.BatchUpsert([]TrafficRecord{{Username: "alice", Upload: 10, ConnCount: 1, Hour: hour, Timestamp: now}})
+	db.SetNode("edge-2", nil)
+	db.BatchUpsert([]TrafficRecord{
+		{Username: "alice", Download: 20, ConnCount: 1, Hour: hour, Timestamp: now},
+		{Username: "bob", Download: 5, ConnCount: 1, Hour: hour, Timestamp: now},
+	})
+
+	mux := http.NewServeMux()
+	registerV2API(mux, &Config{}, nil, db, nil, nil)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/nodes", nil))
+	var resp struct {
+		Data struct {
+			Self  string        `json:"self"`
+			Nodes []DBNodeStats `json:"nodes"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	nodes := resp.Data.Nodes
+	if resp.Data.Self != "edge-2" || len(nodes) != 2 {
+		t.Fatalf("nodes = %+v", resp.Data)
+	}
+	if nodes[0].Name != "edge-1" || nodes[0].Labels["region"] != "eu" || nodes[0].Upload != 10 || nodes[0].Users != 1 {
+		t.Errorf("edge-1 = %+v", nodes[0])
+	}
+	if nodes[1].Download != 25 || nodes[1].Users != 2 {
+		t.Errorf("edge-2 = %+v", nodes[1])
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/nodes?node=edge-2", nil))
+	var users struct {
+		Data []DBNodeUserStats `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&users)
+	if len(users.Data) != 2 || users.Data[0].User != "alice" || users.Data[0].Download != 20 {
+		t.Errorf("edge-2 users = %+v", users.Data)
+	}
+}
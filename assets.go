@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed assets
+var assetsFS embed.FS
+
+// staticAsset is an embedded file together with its content hash
+type staticAsset struct {
+	name string
+	data []byte
+	hash string
+}
+
+// assetIndex maps both the plain name ("js/app.js") and the versioned name
+// ("js/app.3f2a1c9d.js") of every embedded asset to its content
+type assetIndex struct {
+	byName      map[string]*staticAsset
+	byVersioned map[string]*staticAsset
+}
+
+var staticAssets = mustIndexAssets(assetsFS)
+
+func mustIndexAssets(fsys fs.FS) *assetIndex {
+	idx := &assetIndex{
+		byName:      make(map[string]*staticAsset),
+		byVersioned: make(map[string]*staticAsset),
+	}
+	err := fs.WalkDir(fsys, "assets", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		a := &staticAsset{
+			name: strings.TrimPrefix(p, "assets/"),
+			data: data,
+			hash: hex.EncodeToString(sum[:4]),
+		}
+		idx.byName[a.name] = a
+		idx.byVersioned[versionedName(a.name, a.hash)] = a
+		return nil
+	})
+	if err != nil {
+		panic("index embedded assets: " + err.Error())
+	}
+	return idx
+}
+
+// versionedName inserts hash before the extension: app.js -> app.<hash>.js
+func versionedName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// URL returns the cache-busting URL of an asset for use in templates. Unknown
+// names are returned unversioned so a typo shows up as a 404 in the browser.
+func (idx *assetIndex) URL(name string) string {
+	if a, ok := idx.byName[name]; ok {
+		return "/assets/" + versionedName(a.name, a.hash)
+	}
+	return "/assets/" + name
+}
+
+// ServeHTTP serves embedded assets. Versioned URLs never change content and
+// are cached for a year; plain names must be revalidated via their ETag.
+func (idx *assetIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/assets/")
+	if a, ok := idx.byVersioned[name]; ok {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		idx.serve(w, r, a)
+		return
+	}
+	if a, ok := idx.byName[name]; ok {
+		w.Header().Set("Cache-Control", "no-cache")
+		idx.serve(w, r, a)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (idx *assetIndex) serve(w http.ResponseWriter, r *http.Request, a *staticAsset) {
+	w.Header().Set("ETag", `"`+a.hash+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, a.name, time.Time{}, bytes.NewReader(a.data))
+}
@@ -0,0 +1,514 @@
+// ── State ──
+let currentRange = '1h';
+let trendChart = null;
+let leafletMap = null;
+let geoLayer = null;
+let countryChart = null;
+
+// ── Helpers ──
+function formatBytes(bytes) {
+    if (!bytes || bytes === 0) return '0 B';
+    const k = 1024;
+    const sizes = ['B', 'KB', 'MB', 'GB', 'TB'];
+    const i = Math.floor(Math.log(bytes) / Math.log(k));
+    return parseFloat((bytes / Math.pow(k, i)).toFixed(1)) + ' ' + sizes[i];
+}
+
+function formatNumber(n) {
+    if (!n) return '0';
+    return n.toLocaleString();
+}
+
+function escapeHTML(s) {
+    return String(s).replace(/[&<>"']/g, c => ({ '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' })[c]);
+}
+
+function countryCodeToEmoji(code) {
+    if (!code || code.length !== 2) return '🌐';
+    return String.fromCodePoint(...[...code.toUpperCase()].map(c => 0x1F1E6 + c.charCodeAt(0) - 65));
+}
+
+// ── Theme ──
+function toggleTheme() {
+    const html = document.documentElement;
+    const isDark = html.getAttribute('data-theme') !== 'light';
+    html.setAttribute('data-theme', isDark ? 'light' : 'dark');
+    document.getElementById('themeBtn').textContent = isDark ? '☀️' : '🌙';
+    localStorage.setItem('theme', isDark ? 'light' : 'dark');
+    if (trendChart) updateChartTheme();
+}
+
+function initTheme() {
+    const saved = localStorage.getItem('theme') || 'dark';
+    document.documentElement.setAttribute('data-theme', saved);
+    document.getElementById('themeBtn').textContent = saved === 'dark' ? '🌙' : '☀️';
+}
+
+// ── Page Navigation ──
+function switchPage(page) {
+    document.querySelectorAll('.page').forEach(p => p.classList.remove('active'));
+    document.querySelectorAll('.nav-tab').forEach(t => t.classList.remove('active'));
+    document.getElementById('page-' + page).classList.add('active');
+    event.target.classList.add('active');
+    if (page === 'regions' && !leafletMap) initMap();
+    if (page === 'regions') loadCountries();
+    if (page === 'anomalies') loadAnomalies();
+    if (page === 'config') loadConfigHistory();
+}
+
+// ── API ──
+async function fetchJSON(url) {
+    try {
+        const res = await fetch(url);
+        const data = await res.json();
+        return data.success ? data.data : null;
+    } catch (e) { console.error('Fetch error:', url, e); return null; }
+}
+
+// ── Overview ──
+async function loadOverview() {
+    const data = await fetchJSON('/api/v2/overview');
+    if (!data) return;
+    document.getElementById('kpi-upload').textContent = formatBytes(data.total_upload);
+    document.getElementById('kpi-download').textContent = formatBytes(data.total_download);
+    document.getElementById('kpi-total').textContent = formatBytes(data.total_upload + data.total_download);
+    document.getElementById('kpi-conns').textContent = formatNumber(data.total_connections);
+    document.getElementById('kpi-domains').textContent = formatNumber(data.domain_count);
+    document.getElementById('kpi-countries').textContent = formatNumber(data.country_count);
+    document.getElementById('lastUpdate').textContent = 'Updated ' + new Date().toLocaleTimeString();
+}
+
+// ── Storage ──
+async function loadStorage() {
+    const data = await fetchJSON('/api/v2/storage');
+    const el = document.getElementById('storage-alert');
+    const p = data && data.last_prune;
+    // Only surface prunes from the last 24 hours
+    if (!p || Date.now() - new Date(p.time).getTime() > 86400000) {
+        el.classList.remove('visible');
+        return;
+    }
+    el.textContent = `⚠️ Stats database exceeded its ${formatBytes(p.max_size)} limit at ${new Date(p.time).toLocaleString()}: ` +
+        `pruned ${formatNumber(p.minute_rows)} minute rows and ${formatNumber(p.domain_rows)} domain rows` +
+        (p.oldest_minute ? `; minute data now starts at ${p.oldest_minute}` : '') +
+        (p.under_limit ? '.' : '. The database is still over its limit.');
+    el.classList.add('visible');
+}
+
+// ── Maintenance ──
+async function loadMaintenance() {
+    const data = await fetchJSON('/api/v2/maintenance');
+    const el = document.getElementById('maintenance-alert');
+    if (!data || (!data.active && !data.next)) {
+        el.classList.remove('visible');
+        return;
+    }
+    if (data.active) {
+        el.textContent = '🛠️ Maintenance mode is on: new connections from non-exempt users are refused' +
+            (data.until ? ` until ${new Date(data.until).toLocaleString()}` : '') + ` ("${data.message}").`;
+    } else {
+        el.textContent = `🛠️ Maintenance scheduled from ${new Date(data.next.start).toLocaleString()} ` +
+            `to ${new Date(data.next.end).toLocaleString()}.`;
+    }
+    el.classList.add('visible');
+}
+
+// ── Anomalies ──
+const anomalyLabels = { protocol_violation: 'Protocol', p2p_suspected: 'P2P', reputation_match: 'Reputation', dnsbl_listed: 'DNSBL', transfer_limit: 'Transfer limit' };
+
+async function loadAnomalies() {
+    const data = await fetchJSON('/api/v2/anomalies?hours=24');
+    const flagged = document.getElementById('anomaly-flagged');
+    const events = document.getElementById('anomaly-events');
+    if (!data || data.flagged.length === 0) {
+        flagged.innerHTML = '<div class="empty-state"><div class="empty-state-icon">✅</div><div class="empty-state-text">No user is flagged</div></div>';
+    } else {
+        flagged.innerHTML = data.flagged.map((f, i) => `<div class="ranking-item">
+        <span class="ranking-rank">${i + 1}</span>
+        <span class="ranking-name">${escapeHTML(f.username)} <span class="status-badge status-disabled">${escapeHTML(f.action)}</span></span>
+        <span class="ranking-value" title="${escapeHTML(f.detail)}">${escapeHTML(f.heuristic)} · until ${new Date(f.until).toLocaleTimeString()}</span>
+    </div>`).join('');
+    }
+    if (!data || data.events.length === 0) {
+        events.innerHTML = '<div class="empty-state"><div class="empty-state-icon">🛡️</div><div class="empty-state-text">No anomalies in the last 24 hours</div></div>';
+        return;
+    }
+    events.innerHTML = data.events.map((e, i) => `<div class="ranking-item">
+        <span class="ranking-rank">${i + 1}</span>
+        <span class="ranking-name">${escapeHTML(e.user)} <span class="status-badge status-disabled">${anomalyLabels[e.type] || escapeHTML(e.type)}</span>
+            <span class="anomaly-detail">${escapeHTML(e.detail)}</span></span>
+        <span class="ranking-value">${new Date(e.time).toLocaleString()}</span>
+    </div>`).join('');
+}
+
+// ── Config History ──
+async function loadConfigHistory() {
+    const data = await fetchJSON('/api/v2/config/history');
+    const container = document.getElementById('config-history');
+    if (!data || data.length === 0) {
+        container.innerHTML = '<div class="empty-state"><div class="empty-state-icon">🗂️</div><div class="empty-state-text">No config versions saved yet</div></div>';
+        return;
+    }
+    container.innerHTML = data.map((v, i) => `<div class="ranking-item">
+        <span class="ranking-rank">${i + 1}</span>
+        <span class="ranking-name">${new Date(v.time).toLocaleString()}${i === 0 ? ' <span class="status-badge status-active">Latest</span>' : ''}</span>
+        <button class="range-btn" onclick="showConfigDiff('${v.id}')">Diff</button>
+        ${i === 0 ? '' : `<button class="range-btn" onclick="rollbackConfig('${v.id}')">Rollback</button>`}
+    </div>`).join('');
+}
+
+async function showConfigDiff(id) {
+    const data = await fetchJSON('/api/v2/config/history/' + encodeURIComponent(id));
+    const el = document.getElementById('config-diff');
+    if (!data) { el.textContent = 'Version not found'; return; }
+    document.getElementById('config-diff-title').textContent = `Changes since ${new Date(formatVersionTime(id)).toLocaleString()}`;
+    el.replaceChildren(...data.diff.map(l => {
+        const line = document.createElement('div');
+        line.className = l.op === '+' ? 'diff-add' : l.op === '-' ? 'diff-del' : '';
+        line.textContent = l.op + ' ' + l.text;
+        return line;
+    }));
+}
+
+// Version ids are compact UTC timestamps: 20060102T150405.000Z
+function formatVersionTime(id) {
+    return id.replace(/^(\d{4})(\d{2})(\d{2})T(\d{2})(\d{2})(\d{2})/, '$1-$2-$3T$4:$5:$6');
+}
+
+async function rollbackConfig(id) {
+    if (!confirm(`Restore the config saved at ${new Date(formatVersionTime(id)).toLocaleString()}? The current file is kept as a version.`)) return;
+    try {
+        const res = await fetch('/api/v2/config/history/' + encodeURIComponent(id) + '/rollback', {
+            method: 'POST',
+            headers: { 'X-CSRF-Token': document.querySelector('meta[name="csrf-token"]').content }
+        });
+        const data = await res.json();
+        alert(data.success ? 'Config restored. Restart the proxy to apply it.' : 'Rollback failed: ' + data.error);
+    } catch (e) { alert('Rollback failed: ' + e); }
+    loadConfigHistory();
+}
+
+// ── Trends Chart ──
+function chartTheme() {
+    const style = getComputedStyle(document.documentElement);
+    return {
+        gridColor: style.getPropertyValue('--border').trim(),
+        textColor: style.getPropertyValue('--text-muted').trim(),
+    };
+}
+
+function updateChartTheme() {
+    if (trendChart) trendChart.update(chartTheme());
+    if (countryChart) countryChart.update(chartTheme());
+}
+
+async function loadTrends() {
+    const data = await fetchJSON('/api/v2/trends?range=' + currentRange);
+    const labels = (data || []).map(d => d.time.substring(11, 16)); // HH:MM
+    const datasets = [
+        { label: 'Upload', data: (data || []).map(d => d.upload || 0), color: '#f472b6', fill: 'rgba(244,114,182,0.1)' },
+        { label: 'Download', data: (data || []).map(d => d.download || 0), color: '#38bdf8', fill: 'rgba(56,189,248,0.1)' },
+    ];
+
+    if (trendChart) {
+        trendChart.update({ labels, datasets });
+        return;
+    }
+    trendChart = new LineChart(document.getElementById('trendChart'),
+        Object.assign({ labels, datasets, formatValue: formatBytes }, chartTheme()));
+}
+
+function setRange(r) {
+    currentRange = r;
+    document.querySelectorAll('.range-btn').forEach(b => b.classList.remove('active'));
+    event.target.classList.add('active');
+    loadTrends();
+}
+
+// ── Domain Ranking ──
+async function loadDomains() {
+    const data = await fetchJSON('/api/v2/domains?limit=10');
+    const container = document.getElementById('domain-ranking');
+    if (!data || data.length === 0) {
+        container.innerHTML = '<div class="empty-state"><div class="empty-state-icon">📊</div><div class="empty-state-text">No domain data yet</div></div>';
+        return;
+    }
+    const maxTraffic = data[0].upload + data[0].download;
+    container.innerHTML = data.map((d, i) => {
+        const total = d.upload + d.download;
+        const pct = maxTraffic > 0 ? (total / maxTraffic * 100) : 0;
+        return `<div class="ranking-item">
+        <span class="ranking-rank">${i + 1}</span>
+        <span class="ranking-name">${d.domain}</span>
+        <span class="ranking-value">${formatBytes(total)}</span>
+        <div class="ranking-bar-bg"><div class="ranking-bar" style="width:${pct}%"></div></div>
+    </div>`;
+    }).join('');
+}
+
+// ── User Ranking ──
+// Days left before the user's expiry date, if one is set
+function expiryBadge(u) {
+    if (u.days_remaining === undefined) return '';
+    const title = `Expires ${new Date(u.expires_at).toLocaleString()}`;
+    if (u.days_remaining < 0) return `<span class="status-badge status-disabled" title="${title}">Expired</span>`;
+    const cls = u.days_remaining < 7 ? 'status-expiring' : 'status-expiry';
+    return `<span class="status-badge ${cls}" title="${title}">${u.days_remaining}d left</span>`;
+}
+
+async function loadUsers() {
+    const data = await fetchJSON('/api/v2/users');
+    const container = document.getElementById('user-ranking');
+    if (!data || data.length === 0) {
+        container.innerHTML = '<div class="empty-state"><div class="empty-state-icon">👤</div><div class="empty-state-text">No user data yet</div></div>';
+        return;
+    }
+    const maxTraffic = Math.max(...data.map(u => u.total_upload + u.total_download));
+    container.innerHTML = data.map((u, i) => {
+        const total = u.total_upload + u.total_download;
+        const pct = maxTraffic > 0 ? (total / maxTraffic * 100) : 0;
+        const badge = u.disabled ? '<span class="status-badge status-disabled">Disabled</span>' : '<span class="status-badge status-active">Active</span>';
+        return `<div class="ranking-item">
+        <span class="ranking-rank">${i + 1}</span>
+        <span class="ranking-name">${u.username} ${badge} ${u.trial ? '<span class="status-badge status-expiry">Trial</span>' : ''} ${expiryBadge(u)}</span>
+        <span class="ranking-value">${formatBytes(total)}</span>
+        <div class="ranking-bar-bg"><div class="ranking-bar" style="width:${pct}%"></div></div>
+    </div>`;
+    }).join('');
+}
+
+// ── Countries / Map ──
+async function loadCountries() {
+    const data = await fetchJSON('/api/v2/countries');
+    const container = document.getElementById('country-list');
+    if (!data || data.length === 0) {
+        container.innerHTML = '<div class="empty-state"><div class="empty-state-icon">🌍</div><div class="empty-state-text">No regional data yet. Connect through the proxy to start collecting.</div></div>';
+        return;
+    }
+    const totalTraffic = data.reduce((s, c) => s + c.upload + c.download, 0);
+    const maxTraffic = data[0].upload + data[0].download;
+
+    container.innerHTML = data.map(c => {
+        const total = c.upload + c.download;
+        const pct = totalTraffic > 0 ? (total / totalTraffic * 100).toFixed(1) : '0';
+        const barPct = maxTraffic > 0 ? (total / maxTraffic * 100) : 0;
+        return `<div class="country-item clickable" onclick="showCountryDetail('${c.country}')">
+        <span class="country-flag">${countryCodeToEmoji(c.country)}</span>
+        <span class="country-name">${c.country_name || c.country}<span class="country-code">${c.country}</span></span>
+        <span class="country-traffic">${formatBytes(total)}</span>
+        <div class="country-bar-bg"><div class="country-bar" style="width:${barPct}%"></div></div>
+        <span class="country-pct">${pct}%</span>
+    </div>`;
+    }).join('');
+
+    // Update map
+    if (geoLayer) updateMapColors(data);
+}
+
+// Drill-down into one country: hourly trend, top users and top domains
+async function showCountryDetail(code) {
+    if (!code) return;
+    const data = await fetchJSON('/api/v2/countries/' + encodeURIComponent(code) + '?hours=24');
+    if (!data) return;
+    const panel = document.getElementById('country-detail');
+    panel.classList.add('open');
+    document.getElementById('country-detail-title').textContent =
+        `${countryCodeToEmoji(data.country)} ${data.country_name || data.country} · ${formatBytes(data.upload + data.download)} · ${formatNumber(data.user_count)} users`;
+
+    const labels = data.hourly.map(d => d.time.substring(5, 13).replace('T', ' ') + 'h');
+    const datasets = [
+        { label: 'Upload', data: data.hourly.map(d => d.upload || 0), color: '#f472b6', fill: 'rgba(244,114,182,0.1)' },
+        { label: 'Download', data: data.hourly.map(d => d.download || 0), color: '#38bdf8', fill: 'rgba(56,189,248,0.1)' },
+    ];
+    if (countryChart) {
+        countryChart.update({ labels, datasets });
+    } else {
+        countryChart = new LineChart(document.getElementById('countryChart'),
+            Object.assign({ labels, datasets, formatValue: formatBytes }, chartTheme()));
+    }
+
+    const ranking = (items, name) => {
+        if (items.length === 0) return '<div class="empty-state"><div class="empty-state-text">No data yet</div></div>';
+        const maxTraffic = items[0].upload + items[0].download;
+        return items.map((it, i) => {
+            const total = it.upload + it.download;
+            const pct = maxTraffic > 0 ? (total / maxTraffic * 100) : 0;
+            return `<div class="ranking-item">
+        <span class="ranking-rank">${i + 1}</span>
+        <span class="ranking-name">${name(it)}</span>
+        <span class="ranking-value">${formatBytes(total)}</span>
+        <div class="ranking-bar-bg"><div class="ranking-bar" style="width:${pct}%"></div></div>
+    </div>`;
+        }).join('');
+    };
+    document.getElementById('country-users').innerHTML = ranking(data.top_users, u => u.username);
+    document.getElementById('country-domains').innerHTML = ranking(data.top_domains, d => d.domain);
+    panel.scrollIntoView({ behavior: 'smooth', block: 'nearest' });
+}
+
+function closeCountryDetail() {
+    document.getElementById('country-detail').classList.remove('open');
+}
+
+// ISO alpha-2 code of a map feature, if the shape source provides one
+function featureISO(feature) {
+    const props = feature.properties || {};
+    return props.ISO_A2 || props.iso_a2 || props.id || '';
+}
+
+// Leaflet, its map tiles and the country shapes are remote resources, so the
+// map is only loaded when the Regions page is opened; without network access
+// the page falls back to the country list
+const LEAFLET_CSS = 'https://unpkg.com/leaflet@1.9.4/dist/leaflet.css';
+const LEAFLET_JS = 'https://unpkg.com/leaflet@1.9.4/dist/leaflet.js';
+
+function loadLeaflet() {
+    if (window.L) return Promise.resolve();
+    return new Promise((resolve, reject) => {
+        const css = document.createElement('link');
+        css.rel = 'stylesheet';
+        css.href = LEAFLET_CSS;
+        document.head.appendChild(css);
+
+        const js = document.createElement('script');
+        js.src = LEAFLET_JS;
+        js.onload = resolve;
+        js.onerror = reject;
+        document.head.appendChild(js);
+    });
+}
+
+async function initMap() {
+    leafletMap = true; // loading; don't start twice
+    try {
+        await loadLeaflet();
+    } catch (e) {
+        document.getElementById('map-container').classList.add('unavailable');
+        return;
+    }
+    leafletMap = L.map('map-container', {
+        center: [20, 0], zoom: 2,
+        minZoom: 2, maxZoom: 6,
+        zoomControl: true,
+        attributionControl: false
+    });
+
+    // Use a simple tile layer
+    L.tileLayer('https://{s}.basemaps.cartocdn.com/dark_all/{z}/{x}/{y}{r}.png', {
+        maxZoom: 19
+    }).addTo(leafletMap);
+
+    // Load GeoJSON for countries
+    fetch('https://cdn.jsdelivr.net/npm/world-atlas@2/countries-110m.json')
+        .then(r => r.json())
+        .then(topology => {
+            // Convert TopoJSON to GeoJSON
+            const countries = topojson_feature(topology, topology.objects.countries);
+            geoLayer = L.geoJSON(countries, {
+                style: { fillColor: '#2a2e42', fillOpacity: 0.6, weight: 1, color: '#3a3e52' },
+                onEachFeature: (feature, layer) => {
+                    layer.on('mouseover', function () { this.setStyle({ fillOpacity: 0.8 }); });
+                    layer.on('mouseout', function () { geoLayer.resetStyle(this); });
+                    layer.on('click', () => showCountryDetail(featureISO(feature)));
+                }
+            }).addTo(leafletMap);
+            loadCountries();
+        })
+        .catch(() => {
+            // Fallback: load simpler GeoJSON
+            fetch('https://cdn.jsdelivr.net/npm/@amcharts/amcharts5-geodata@5/worldLow.json')
+                .then(r => r.json())
+                .then(geojson => {
+                    geoLayer = L.geoJSON(geojson, {
+                        style: { fillColor: '#2a2e42', fillOpacity: 0.6, weight: 1, color: '#3a3e52' },
+                        onEachFeature: (feature, layer) => {
+                            layer.on('click', () => showCountryDetail(featureISO(feature)));
+                        }
+                    }).addTo(leafletMap);
+                    loadCountries();
+                }).catch(e => console.error('GeoJSON load failed:', e));
+        });
+}
+
+// Minimal TopoJSON → GeoJSON converter
+function topojson_feature(topology, object) {
+    const features = object.geometries.map(g => ({
+        type: 'Feature',
+        id: g.id,
+        properties: g.properties || {},
+        geometry: topojson_geometry(topology, g)
+    }));
+    return { type: 'FeatureCollection', features };
+}
+
+function topojson_geometry(topology, o) {
+    const arcs = topology.arcs;
+    const transform = topology.transform;
+
+    function decodeArc(arcIdx) {
+        const arc = arcs[arcIdx < 0 ? ~arcIdx : arcIdx];
+        const coords = [];
+        let x = 0, y = 0;
+        for (const [dx, dy] of arc) {
+            x += dx; y += dy;
+            const lon = transform ? x * transform.scale[0] + transform.translate[0] : x;
+            const lat = transform ? y * transform.scale[1] + transform.translate[1] : y;
+            coords.push([lon, lat]);
+        }
+        if (arcIdx < 0) coords.reverse();
+        return coords;
+    }
+
+    function decodeRing(arcIndices) {
+        let coords = [];
+        for (const idx of arcIndices) {
+            const arc = decodeArc(idx);
+            coords = coords.concat(arc.slice(coords.length ? 1 : 0));
+        }
+        return coords;
+    }
+
+    if (o.type === 'Polygon') {
+        return { type: 'Polygon', coordinates: o.arcs.map(decodeRing) };
+    } else if (o.type === 'MultiPolygon') {
+        return { type: 'MultiPolygon', coordinates: o.arcs.map(rings => rings.map(decodeRing)) };
+    }
+    return { type: o.type, coordinates: [] };
+}
+
+function updateMapColors(countryData) {
+    if (!geoLayer) return;
+    const trafficMap = {};
+    let maxVal = 0;
+    countryData.forEach(c => {
+        const total = c.upload + c.download;
+        // Map numeric IDs to ISO codes using a lookup
+        trafficMap[c.country] = total;
+        if (total > maxVal) maxVal = total;
+    });
+
+    geoLayer.eachLayer(layer => {
+        // Try to match by ISO alpha-2 code in properties
+        const iso = featureISO(layer.feature);
+        const traffic = trafficMap[iso] || 0;
+
+        if (traffic > 0 && maxVal > 0) {
+            const intensity = Math.log(traffic + 1) / Math.log(maxVal + 1);
+            const r = Math.round(99 + (16 - 99) * intensity);
+            const g = Math.round(102 + (185 - 102) * intensity);
+            const b = Math.round(241 + (129 - 241) * intensity);
+            layer.setStyle({ fillColor: `rgb(${r},${g},${b})`, fillOpacity: 0.7 + intensity * 0.3 });
+            layer.bindTooltip(`${iso}: ${formatBytes(traffic)}`, { sticky: true });
+        }
+    });
+}
+
+// ── Init ──
+initTheme();
+
+async function refreshAll() {
+    await Promise.all([loadOverview(), loadTrends(), loadDomains(), loadUsers(), loadStorage(), loadMaintenance()]);
+}
+
+refreshAll();
+setInterval(refreshAll, 30000);
@@ -0,0 +1,193 @@
+// Minimal canvas line chart for the dashboard trends panel. It covers what
+// the dashboard needs (filled smooth series, legend, index tooltip, themed
+// grid) without pulling a charting library from a CDN.
+(function () {
+    'use strict';
+
+    const PAD = { top: 36, right: 16, bottom: 28, left: 64 };
+
+    function niceStep(max, count) {
+        const raw = max / count;
+        const mag = Math.pow(10, Math.floor(Math.log10(raw)));
+        const norm = raw / mag;
+        return (norm <= 1 ? 1 : norm <= 2 ? 2 : norm <= 5 ? 5 : 10) * mag;
+    }
+
+    class LineChart {
+        // opts: { labels, datasets: [{label, data, color, fill}], gridColor,
+        //         textColor, formatValue, maxTicks }
+        constructor(canvas, opts) {
+            this.canvas = canvas;
+            this.ctx = canvas.getContext('2d');
+            this.opts = Object.assign({ maxTicks: 12, formatValue: v => String(v) }, opts);
+            this.hover = -1;
+
+            this.tooltip = document.createElement('div');
+            this.tooltip.className = 'linechart-tooltip';
+            canvas.parentNode.appendChild(this.tooltip);
+
+            this.onMove = e => this.handleMove(e);
+            this.onLeave = () => { this.hover = -1; this.draw(); };
+            this.onResize = () => this.draw();
+            canvas.addEventListener('mousemove', this.onMove);
+            canvas.addEventListener('mouseleave', this.onLeave);
+            window.addEventListener('resize', this.onResize);
+            this.draw();
+        }
+
+        update(opts) {
+            Object.assign(this.opts, opts);
+            this.draw();
+        }
+
+        destroy() {
+            this.canvas.removeEventListener('mousemove', this.onMove);
+            this.canvas.removeEventListener('mouseleave', this.onLeave);
+            window.removeEventListener('resize', this.onResize);
+            this.tooltip.remove();
+        }
+
+        layout() {
+            const rect = this.canvas.parentNode.getBoundingClientRect();
+            const dpr = window.devicePixelRatio || 1;
+            this.width = rect.width;
+            this.height = rect.height;
+            this.canvas.width = rect.width * dpr;
+            this.canvas.height = rect.height * dpr;
+            this.canvas.style.width = rect.width + 'px';
+            this.canvas.style.height = rect.height + 'px';
+            this.ctx.setTransform(dpr, 0, 0, dpr, 0, 0);
+
+            let max = 0;
+            for (const ds of this.opts.datasets) {
+                for (const v of ds.data) if (v > max) max = v;
+            }
+            this.step = max > 0 ? niceStep(max, 4) : 1;
+            this.max = Math.max(this.step, Math.ceil(max / this.step) * this.step);
+        }
+
+        x(i) {
+            const n = this.opts.labels.length;
+            const w = this.width - PAD.left - PAD.right;
+            return PAD.left + (n > 1 ? (i / (n - 1)) * w : w / 2);
+        }
+
+        y(v) {
+            const h = this.height - PAD.top - PAD.bottom;
+            return PAD.top + h - (v / this.max) * h;
+        }
+
+        draw() {
+            this.layout();
+            const { ctx, opts } = this;
+            ctx.clearRect(0, 0, this.width, this.height);
+            ctx.font = '11px sans-serif';
+            ctx.lineWidth = 1;
+
+            // Y grid and ticks
+            ctx.textAlign = 'right';
+            ctx.textBaseline = 'middle';
+            for (let v = 0; v <= this.max; v += this.step) {
+                const y = this.y(v);
+                ctx.strokeStyle = opts.gridColor;
+                ctx.beginPath();
+                ctx.moveTo(PAD.left, y);
+                ctx.lineTo(this.width - PAD.right, y);
+                ctx.stroke();
+                ctx.fillStyle = opts.textColor;
+                ctx.fillText(opts.formatValue(v), PAD.left - 8, y);
+            }
+
+            // X ticks, thinned to maxTicks
+            const n = opts.labels.length;
+            const every = Math.max(1, Math.ceil(n / opts.maxTicks));
+            ctx.textAlign = 'center';
+            ctx.textBaseline = 'top';
+            for (let i = 0; i < n; i += every) {
+                ctx.fillText(opts.labels[i], this.x(i), this.height - PAD.bottom + 8);
+            }
+
+            for (const ds of opts.datasets) this.drawSeries(ds);
+            this.drawLegend();
+
+            if (this.hover >= 0 && this.hover < n) {
+                const x = this.x(this.hover);
+                ctx.strokeStyle = opts.textColor;
+                ctx.beginPath();
+                ctx.moveTo(x, PAD.top);
+                ctx.lineTo(x, this.height - PAD.bottom);
+                ctx.stroke();
+            } else {
+                this.tooltip.style.display = 'none';
+            }
+        }
+
+        drawSeries(ds) {
+            const { ctx } = this;
+            const pts = ds.data.map((v, i) => [this.x(i), this.y(v || 0)]);
+            if (pts.length === 0) return;
+
+            ctx.beginPath();
+            ctx.moveTo(pts[0][0], pts[0][1]);
+            for (let i = 1; i < pts.length; i++) {
+                // Horizontal-tangent bezier keeps the curve smooth without overshooting zero
+                const [x0, y0] = pts[i - 1];
+                const [x1, y1] = pts[i];
+                const mx = (x0 + x1) / 2;
+                ctx.bezierCurveTo(mx, y0, mx, y1, x1, y1);
+            }
+            ctx.strokeStyle = ds.color;
+            ctx.lineWidth = 2;
+            ctx.stroke();
+
+            if (ds.fill) {
+                ctx.lineTo(pts[pts.length - 1][0], this.y(0));
+                ctx.lineTo(pts[0][0], this.y(0));
+                ctx.closePath();
+                ctx.fillStyle = ds.fill;
+                ctx.fill();
+            }
+            ctx.lineWidth = 1;
+        }
+
+        drawLegend() {
+            const { ctx, opts } = this;
+            ctx.font = '12px sans-serif';
+            ctx.textAlign = 'left';
+            ctx.textBaseline = 'middle';
+            const widths = opts.datasets.map(ds => ctx.measureText(ds.label).width + 32);
+            let x = (this.width - widths.reduce((a, b) => a + b, 0)) / 2;
+            opts.datasets.forEach((ds, i) => {
+                ctx.fillStyle = ds.color;
+                ctx.beginPath();
+                ctx.arc(x + 5, 14, 5, 0, Math.PI * 2);
+                ctx.fill();
+                ctx.fillStyle = opts.textColor;
+                ctx.fillText(ds.label, x + 14, 14);
+                x += widths[i];
+            });
+        }
+
+        handleMove(e) {
+            const n = this.opts.labels.length;
+            if (n === 0) return;
+            const rect = this.canvas.getBoundingClientRect();
+            const w = this.width - PAD.left - PAD.right;
+            const rel = (e.clientX - rect.left - PAD.left) / w;
+            const i = Math.round(Math.min(1, Math.max(0, rel)) * (n - 1));
+            if (i !== this.hover) {
+                this.hover = i;
+                this.draw();
+            }
+
+            const rows = this.opts.datasets.map(ds =>
+                `<div><span style="color:${ds.color}">●</span> ${ds.label}: ${this.opts.formatValue(ds.data[i] || 0)}</div>`);
+            this.tooltip.innerHTML = `<div class="linechart-tooltip-title">${this.opts.labels[i]}</div>` + rows.join('');
+            this.tooltip.style.left = Math.min(this.x(i) + 12, this.width - 160) + 'px';
+            this.tooltip.style.top = PAD.top + 'px';
+            this.tooltip.style.display = 'block';
+        }
+    }
+
+    window.LineChart = LineChart;
+})();
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAssets_VersionedAndPlain(t *testing.T) {
+	url := staticAssets.URL("js/dashboard_v2.js")
+	if url == "/assets/js/dashboard_v2.js" || !strings.HasSuffix(url, ".js") {
+		t.Fatalf("expected a versioned URL, got %q", url)
+	}
+
+	rec := httptest.NewRecorder()
+	staticAssets.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("versioned asset: status %d", rec.Code)
+	}
+	if cc := rec.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("versioned asset Cache-Control = %q", cc)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/javascript") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	etag := rec.Header().Get("ETag")
+
+	rec = httptest.NewRecorder()
+	staticAssets.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/assets/js/dashboard_v2.js", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("plain asset: status %d, Cache-Control %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/assets/js/dashboard_v2.js", nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	staticAssets.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("revalidation with ETag: status %d, want 304", rec.Code)
+	}
+}
+
+func TestAssets_NotFoundAndMethod(t *testing.T) {
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/assets/js/missing.js", http.StatusNotFound},
+		{http.MethodGet, "/assets/../admin.go", http.StatusNotFound},
+		{http.MethodPost, "/assets/js/dashboard_v2.js", http.StatusMethodNotAllowed},
+	} {
+		rec := httptest.NewRecorder()
+		staticAssets.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestAssets_TemplatesReferenceEmbeddedFiles(t *testing.T) {
+	data, err := templatesFS.ReadFile("templates/dashboard_v2.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range strings.Split(string(data), `{{asset "`)[1:] {
+		name := ref[:strings.Index(ref, `"`)]
+		if _, ok := staticAssets.byName[name]; !ok {
+			t.Errorf("dashboard_v2.html references missing asset %q", name)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// BlockPageConfig customizes the page browsers get when a policy rule
+// denies an authenticated user's request
+type BlockPageConfig struct {
+	Contact  string `json:"contact"`  // Shown on the page and in JSON errors, e.g. "it@example.com"
+	Template string `json:"template"` // html/template file replacing the built-in page
+}
+
+//go:embed templates/block/page.html
+var defaultBlockPage string
+
+// BlockPage renders policy denials as HTML
+type BlockPage struct {
+	tmpl    *template.Template
+	contact string
+}
+
+// blockPageData is the data the block page template is executed with. The
+// template can also call t to translate a message key into .Lang.
+type blockPageData struct {
+	ProxyError
+	Lang       string
+	RetryAfter int
+}
+
+// NewBlockPage parses the block page template. A custom template that
+// fails to load is logged and the built-in page is used.
+func NewBlockPage(config *Config) *BlockPage {
+	bc := config.Proxy.BlockPage
+	page := &BlockPage{contact: bc.Contact}
+	if bc.Template != "" {
+		text, err := os.ReadFile(bc.Template)
+		if err == nil {
+			page.tmpl, err = parseBlockPage(string(text))
+		}
+		if err == nil {
+			return page
+		}
+		log.Printf("Block page template: %v, using the built-in page", err)
+	}
+	page.tmpl, _ = parseBlockPage(defaultBlockPage)
+	return page
+}
+
+// parseBlockPage parses a block page template
+func parseBlockPage(text string) (*template.Template, error) {
+	return template.New("block").Funcs(template.FuncMap{
+		// Replaced per request with the client's language
+		"t": func(key string) string { return key },
+	}).Parse(text)
+}
+
+// wantsHTML reports whether r comes from a browser: CONNECT clients and
+// API tooling get JSON
+func wantsHTML(r *http.Request) bool {
+	return r.Method != http.MethodConnect && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// write sends e as the block page, reporting false if the template failed
+// so the caller can fall back to JSON
+func (b *BlockPage) write(w http.ResponseWriter, e ProxyError, retryAfter int) bool {
+	tmpl, err := b.tmpl.Clone()
+	if err != nil {
+		return false
+	}
+	tmpl.Funcs(template.FuncMap{"t": func(key string) string { return localizeMessage(e.lang, key) }})
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, blockPageData{ProxyError: e, Lang: e.lang, RetryAfter: retryAfter}); err != nil {
+		log.Printf("[req %s] Block page: %v", e.RequestID, err)
+		return false
+	}
+	e.setHeaders(w.Header())
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(e.Status)
+	w.Write(buf.Bytes())
+	return true
+}
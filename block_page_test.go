@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWritePolicyError_BlockPage(t *testing.T) {
+	cfg := &Config{}
+	cfg.Proxy.BlockPage.Contact = "it@example.com"
+	page := NewBlockPage(cfg)
+	check := &PolicyCheck{Rule: "maintenance", Code: ErrCodeMaintenance, Status: http.StatusServiceUnavailable, Reason: "Proxy is under maintenance", RetryAfter: 120}
+
+	// Browsers get the page in their language
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "https://proxy.example.com/", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	r.Header.Set("Accept-Language", "zh-CN")
+	writePolicyError(rec, r, check, page)
+	body := rec.Body.String()
+	if rec.Code != http.StatusServiceUnavailable || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{`lang="zh"`, "访问被阻止", "代理正在维护中", "Proxy is under maintenance", "maintenance", "120", "it@example.com"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("block page lacks %q", want)
+		}
+	}
+	if rec.Header().Get("Retry-After") != "120" || rec.Header().Get("X-Request-Id") == "" {
+		t.Errorf("headers = %v", rec.Header())
+	}
+
+	// CONNECT clients get JSON and a Proxy-Status header they can parse
+	rec = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+	r.Header.Set("Accept", "text/html")
+	writePolicyError(rec, r, check, page)
+	var e ProxyError
+	if err := json.NewDecoder(rec.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Rule != "maintenance" || e.Contact != "it@example.com" || e.Code != ErrCodeMaintenance {
+		t.Errorf("error = %+v", e)
+	}
+	want := `https-proxy; error=http_request_denied; details="Proxy is under maintenance"; code="maintenance"; rule="maintenance"`
+	if got := rec.Header().Get("Proxy-Status"); got != want {
+		t.Errorf("Proxy-Status = %s, want %s", got, want)
+	}
+}
+
+func TestBlockPage_CustomTemplate(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{}
+	cfg.Proxy.BlockPage.Template = filepath.Join(dir, "block.html")
+	os.WriteFile(cfg.Proxy.BlockPage.Template, []byte(`<p>{{t "Access blocked"}}: {{.Code}} ({{.Rule}})</p>`), 0644)
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept", "text/html")
+	writePolicyError(rec, r, &PolicyCheck{Rule: "user_status", Code: ErrCodeUserDisabled, Status: http.StatusForbidden}, NewBlockPage(cfg))
+	if got := rec.Body.String(); got != "<p>Access blocked: user_disabled (user_status)</p>" {
+		t.Errorf("custom page = %q", got)
+	}
+
+	// A broken template falls back to the built-in page
+	os.WriteFile(cfg.Proxy.BlockPage.Template, []byte(`{{.Code`), 0644)
+	rec = httptest.NewRecorder()
+	writePolicyError(rec, r, &PolicyCheck{Rule: "user_status", Code: ErrCodeUserDisabled, Status: http.StatusForbidden}, NewBlockPage(cfg))
+	if !strings.Contains(rec.Body.String(), "<h1>Access blocked</h1>") {
+		t.Errorf("fallback page = %q", rec.Body.String())
+	}
+}
+
+func TestProxyStatus_DialErrors(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeProxyError(rec, httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil), http.StatusGatewayTimeout, ErrCodeDialTimeout, `dial "x": i/o timeout`)
+	want := `https-proxy; error=connection_timeout; details="dial \"x\": i/o timeout"; code="dial_timeout"`
+	if got := rec.Header().Get("Proxy-Status"); got != want {
+		t.Errorf("Proxy-Status = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The issuance log records every certificate the built-in CA signs, one
+// JSON entry per line in ca-issuance.jsonl next to the CA certificate. Each
+// entry carries the hash of the one before, so an entry removed or edited
+// after the fact breaks the chain, and tenants holding an earlier head
+// hash can tell the log was not rewritten since.
+const caLogFile = "ca-issuance.jsonl"
+
+// Issuance log events
+const (
+	CALogIssued = "issued"
+)
+
+// Issuance log sources
+const (
+	CALogSetup        = "setup"
+	CALogProvisioning = "provisioning"
+	CALogTrial        = "trial"
+)
+
+// caLogGenesis is the previous hash of the first entry
+var caLogGenesis = strings.Repeat("0", 64)
+
+// CALogEntry is one line of the issuance log
+type CALogEntry struct {
+	Seq      uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Serial   string    `json:"serial"` // Hex
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"not_after"`
+	SHA256   string    `json:"sha256"` // Fingerprint of the certificate's DER
+	Source   string    `json:"source"`
+	Actor    string    `json:"actor,omitempty"`
+	Prev     string    `json:"prev"` // Hash of the previous entry
+	Hash     string    `json:"hash"` // SHA-256 of this entry with Hash empty
+}
+
+// hash returns the entry's chain hash
+func (e CALogEntry) hash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// caLogMu serializes appends within the process
+var caLogMu sync.Mutex
+
+// caLogPath returns the issuance log of the CA whose certificate is at caPath
+func caLogPath(caPath string) string {
+	return filepath.Join(filepath.Dir(caPath), caLogFile)
+}
+
+// appendCALog records that cert was issued. The log is checked before the
+// entry is added, so a broken chain is reported instead of extended.
+func appendCALog(path string, cert *x509.Certificate, source, actor string, now time.Time) error {
+	caLogMu.Lock()
+	defer caLogMu.Unlock()
+
+	v, err := VerifyCALog(path)
+	if err != nil {
+		return err
+	}
+	if !v.Valid {
+		return fmt.Errorf("issuance log %s: %s", path, v.Error)
+	}
+	sum := sha256.Sum256(cert.Raw)
+	entry := CALogEntry{
+		Seq:      v.Entries + 1,
+		Time:     now.UTC(),
+		Event:    CALogIssued,
+		Serial:   fmt.Sprintf("%x", cert.SerialNumber),
+		Subject:  cert.Subject.CommonName,
+		NotAfter: cert.NotAfter.UTC(),
+		SHA256:   hex.EncodeToString(sum[:]),
+		Source:   source,
+		Actor:    actor,
+		Prev:     v.Head,
+	}
+	entry.Hash = entry.hash()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// CALogVerification is the result of checking the issuance log's chain
+type CALogVerification struct {
+	Valid   bool   `json:"valid"`
+	Entries uint64 `json:"entries"`
+	Head    string `json:"head"`            // Hash of the last entry
+	Error   string `json:"error,omitempty"` // First break in the chain
+}
+
+// VerifyCALog checks every entry of the log at path against its hash and
+// its predecessor. A missing log is a valid, empty one.
+func VerifyCALog(path string) (CALogVerification, error) {
+	v := CALogVerification{Valid: true, Head: caLogGenesis}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	}
+	if err != nil {
+		return v, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var e CALogEntry
+		switch {
+		case json.Unmarshal(line, &e) != nil:
+			v.Error = fmt.Sprintf("entry %d is not valid JSON", v.Entries+1)
+		case e.Seq != v.Entries+1:
+			v.Error = fmt.Sprintf("entry %d has sequence number %d", v.Entries+1, e.Seq)
+		case e.Prev != v.Head:
+			v.Error = fmt.Sprintf("entry %d does not follow entry %d", e.Seq, v.Entries)
+		case e.Hash != e.hash():
+			v.Error = fmt.Sprintf("entry %d does not match its hash", e.Seq)
+		}
+		if v.Error != "" {
+			v.Valid = false
+			return v, nil
+		}
+		v.Entries, v.Head = e.Seq, e.Hash
+	}
+	return v, scanner.Err()
+}
+
+// handleCALog serves /api/v2/ca/log, the issuance log as JSON lines for
+// export, and /api/v2/ca/log/verify, the result of checking its chain
+func handleCALog(w http.ResponseWriter, r *http.Request, config *Config) {
+	if r.Method != http.MethodGet {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+	path := caLogPath(config.Server.Certificates.CAPath)
+	if strings.HasSuffix(r.URL.Path, "/verify") {
+		v, err := VerifyCALog(path)
+		if err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		writeJSONResponse(w, WebResponse{Success: true, Data: v}, http.StatusOK)
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+caLogFile+`"`)
+	w.Write(data)
+}
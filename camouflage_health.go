@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CamouflageHealthConfig checks the camouflage site (proxy.default_site)
+// and serves a local static site while it is down, so probers see a web
+// site rather than errors
+type CamouflageHealthConfig struct {
+	IntervalSeconds  int    `json:"interval_seconds"`  // Time between checks; 0 disables checking
+	TimeoutSeconds   int    `json:"timeout_seconds"`   // Per check (default 5)
+	Path             string `json:"path"`              // Path requested (default /)
+	FailureThreshold int    `json:"failure_threshold"` // Failed checks in a row before the site is down (default 2)
+	FallbackDir      string `json:"fallback_dir"`      // Static site served while it is down
+}
+
+// CamouflageStatus is the outcome of the camouflage site's checks
+type CamouflageStatus struct {
+	Up        bool      `json:"up"`
+	Site      string    `json:"site"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+	Failures  int       `json:"consecutive_failures"`
+	Since     time.Time `json:"since"`    // When the site last went up or down
+	Fallback  bool      `json:"fallback"` // A fallback site is served while down
+}
+
+// CamouflageHealth checks the camouflage site. A nil CamouflageHealth
+// takes the site as up.
+type CamouflageHealth struct {
+	config    *Config
+	interval  time.Duration
+	path      string
+	threshold int
+	client    *http.Client
+	fallback  http.Handler
+
+	mu     sync.Mutex
+	status CamouflageStatus
+
+	fallbacks atomic.Uint64
+}
+
+// camouflage checks the camouflage site for the proxy and /readyz
+var camouflage *CamouflageHealth
+
+// NewCamouflageHealth parses proxy.camouflage_health; it returns nil if
+// checking is disabled. A fallback directory that cannot be read is logged
+// and ignored.
+func NewCamouflageHealth(config *Config) *CamouflageHealth {
+	hc := config.Proxy.CamouflageHealth
+	if hc.IntervalSeconds <= 0 {
+		return nil
+	}
+	h := &CamouflageHealth{
+		config:    config,
+		interval:  time.Duration(hc.IntervalSeconds) * time.Second,
+		path:      "/" + strings.TrimLeft(hc.Path, "/"),
+		threshold: firstPositive(hc.FailureThreshold, 2),
+		client: &http.Client{
+			Timeout: time.Duration(firstPositive(hc.TimeoutSeconds, 5)) * time.Second,
+			// A redirect answers the check; following it may leave the site
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		status: CamouflageStatus{Up: true},
+	}
+	if hc.FallbackDir != "" {
+		if info, err := os.Stat(hc.FallbackDir); err != nil || !info.IsDir() {
+			log.Printf("Camouflage fallback_dir %s is not a readable directory, ignored", hc.FallbackDir)
+		} else {
+			h.fallback = http.FileServer(http.FS(staticSiteFS{os.DirFS(hc.FallbackDir)}))
+			h.status.Fallback = true
+		}
+	}
+
+	metrics.Gauge("https_proxy_camouflage_up", "Whether the camouflage site passed its health checks.", func() float64 {
+		if h.Up() {
+			return 1
+		}
+		return 0
+	})
+	metrics.Counter("https_proxy_camouflage_fallback_total", "Requests answered by the fallback site while the camouflage site was down.", func() float64 {
+		return float64(h.fallbacks.Load())
+	})
+	return h
+}
+
+// Run checks the site every interval, forever
+func (h *CamouflageHealth) Run() {
+	if h == nil {
+		return
+	}
+	h.Check(time.Now())
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		h.Check(now)
+	}
+}
+
+// Check requests the site once. Any answer below 500 means it is up; a
+// reverse proxy in front of a dead site answers 502 or 503.
+func (h *CamouflageHealth) Check(now time.Time) {
+	site := h.config.defaultSite()
+	resp, err := h.client.Get(site + h.path)
+	if err == nil {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+	}
+	h.record(site, err, now)
+}
+
+// record notes the outcome of a check or of a forwarded request
+func (h *CamouflageHealth) record(site string, err error, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := &h.status
+	st.Site, st.LastCheck = site, now
+	if err == nil {
+		if !st.Up {
+			log.Printf("Camouflage site %s is up again", site)
+			st.Up, st.Since = true, now
+		}
+		st.Failures, st.LastError = 0, ""
+		return
+	}
+	st.Failures++
+	st.LastError = err.Error()
+	if st.Up && st.Failures >= h.threshold {
+		if st.Fallback {
+			log.Printf("Camouflage site %s is down (%v), serving the fallback site", site, err)
+		} else {
+			log.Printf("Camouflage site %s is down (%v)", site, err)
+		}
+		st.Up, st.Since = false, now
+	}
+}
+
+// Failed notes that a request forwarded to the site got no answer, so
+// the fallback takes over without waiting for the next check
+func (h *CamouflageHealth) Failed(err error, now time.Time) {
+	if h == nil {
+		return
+	}
+	h.record(h.config.defaultSite(), err, now)
+}
+
+// Up reports whether the site passed its last checks
+func (h *CamouflageHealth) Up() bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status.Up
+}
+
+// Status returns the outcome of the checks
+func (h *CamouflageHealth) Status() CamouflageStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
+}
+
+// ServeFallback answers r from the fallback site if the camouflage site
+// is down, and reports whether it did
+func (h *CamouflageHealth) ServeFallback(w http.ResponseWriter, r *http.Request) bool {
+	if h == nil || h.fallback == nil || h.Up() {
+		return false
+	}
+	h.fallbacks.Add(1)
+	h.fallback.ServeHTTP(w, r)
+	return true
+}
+
+// staticSiteFS hides directories without an index.html, so the fallback
+// answers 404 where a web server would rather than listing files
+type staticSiteFS struct {
+	fs.FS
+}
+
+func (s staticSiteFS) Open(name string) (fs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		index, err := s.FS.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, fs.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
+
+// handleReadyz serves /readyz: 200 when the proxy can serve as expected,
+// 503 with the checks otherwise. A camouflage site that is down does not
+// fail the check while a fallback site stands in for it.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+	checks := make(map[string]interface{})
+	ready := true
+	if camouflage != nil {
+		st := camouflage.Status()
+		checks["camouflage"] = st
+		ready = st.Up || st.Fallback
+	}
+	data := map[string]interface{}{"ready": ready, "checks": checks}
+	if !ready {
+		writeJSONResponse(w, WebResponse{Success: false, Data: data, Error: "not ready"}, http.StatusServiceUnavailable)
+		return
+	}
+	writeJSONResponse(w, WebResponse{Success: true, Data: data}, http.StatusOK)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCamouflageHealth(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer site.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<h1>fallback</h1>"), 0644)
+	os.Mkdir(filepath.Join(dir, "private"), 0755)
+	os.WriteFile(filepath.Join(dir, "private", "notes.txt"), []byte("x"), 0644)
+
+	cfg := &Config{}
+	if NewCamouflageHealth(cfg) != nil {
+		t.Fatal("health checks built without an interval")
+	}
+	cfg.Proxy.DefaultSite = site.URL
+	cfg.Proxy.CamouflageHealth = CamouflageHealthConfig{IntervalSeconds: 30, FallbackDir: dir}
+	h := NewCamouflageHealth(cfg)
+
+	serve := func(path string) (bool, *httptest.ResponseRecorder) {
+		w := httptest.NewRecorder()
+		return h.ServeFallback(w, httptest.NewRequest(http.MethodGet, path, nil)), w
+	}
+	readyz := func() (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		handleReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var resp struct{ Data map[string]interface{} }
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Data
+	}
+	defer func(prev *CamouflageHealth) { camouflage = prev }(camouflage)
+	camouflage = h
+
+	now := time.Now()
+	h.Check(now)
+	if served, _ := serve("/"); served || !h.Up() {
+		t.Fatal("fallback served while the site is up")
+	}
+
+	// A 502 from the site's own reverse proxy is a failure; the site is
+	// down after two in a row
+	status.Store(http.StatusBadGateway)
+	h.Check(now.Add(time.Minute))
+	if !h.Up() {
+		t.Fatal("down after a single failure")
+	}
+	h.Failed(errors.New("connection refused"), now.Add(time.Minute))
+	if h.Up() {
+		t.Fatal("still up after two failures")
+	}
+	if served, w := serve("/"); !served || w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "fallback") {
+		t.Errorf("fallback: served %v, %d %q", served, w.Code, w.Body.String())
+	}
+	if _, w := serve("/private/"); w.Code != http.StatusNotFound {
+		t.Errorf("directory without index.html: %d, want 404", w.Code)
+	}
+	if code, data := readyz(); code != http.StatusOK || data["ready"] != true {
+		t.Errorf("readyz with a fallback: %d %v", code, data)
+	}
+
+	// Without a fallback the proxy is not ready
+	h.status.Fallback, h.fallback = false, nil
+	code, data := readyz()
+	if code != http.StatusServiceUnavailable || data["ready"] != false {
+		t.Errorf("readyz while down: %d %v", code, data)
+	}
+	if c, _ := data["checks"].(map[string]interface{})["camouflage"].(map[string]interface{}); c["up"] != false || c["consecutive_failures"] != float64(2) {
+		t.Errorf("camouflage check = %v", c)
+	}
+
+	status.Store(http.StatusNotFound)
+	h.Check(now.Add(2 * time.Minute))
+	if st := h.Status(); !st.Up || st.Failures != 0 || !st.Since.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("after recovery: %+v", st)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CamouflageLimitsConfig bounds what clients without a certificate may
+// pull through the camouflage site, so it cannot be used as a free relay
+type CamouflageLimitsConfig struct {
+	MaxResponseKB int `json:"max_response_kb"` // Response body relayed per request; 0: no limit
+	IPKBps        int `json:"ip_kbps"`         // Bandwidth per client address, request and response together; 0: no limit
+	IPBurstKB     int `json:"ip_burst_kb"`     // Bytes that may pass at once (default one second's worth)
+}
+
+// camouflageIdle is how long a client address keeps its bucket after its
+// last request
+const camouflageIdle = 5 * time.Minute
+
+// errResponseTooLarge ends a camouflage response at max_response_kb
+var errResponseTooLarge = errors.New("camouflage response too large")
+
+// CamouflageLimits enforces proxy.camouflage_limits on the requests
+// forwarded to default_site
+type CamouflageLimits struct {
+	maxBytes int64
+	rate     RateDirection
+
+	mu        sync.Mutex
+	buckets   map[netip.Prefix]*tokenBucket // by client address, /64 for IPv6
+	lastSweep time.Time
+
+	truncated atomic.Uint64
+	waitNanos atomic.Int64
+}
+
+// NewCamouflageLimits parses proxy.camouflage_limits; it returns nil if no
+// limit is configured. Negative values are logged and ignored.
+func NewCamouflageLimits(config *Config) *CamouflageLimits {
+	cc := config.Proxy.CamouflageLimits
+	for name, v := range map[string]int{"max_response_kb": cc.MaxResponseKB, "ip_kbps": cc.IPKBps, "ip_burst_kb": cc.IPBurstKB} {
+		if v < 0 {
+			log.Printf("Camouflage limits: %s must be 0 or more, ignored", name)
+		}
+	}
+	l := &CamouflageLimits{
+		maxBytes: int64(max(cc.MaxResponseKB, 0)) << 10,
+		rate:     newRateDirection(max(cc.IPKBps, 0), max(cc.IPBurstKB, 0)),
+		buckets:  make(map[netip.Prefix]*tokenBucket),
+	}
+	if l.maxBytes == 0 && l.rate.RateBytes == 0 {
+		return nil
+	}
+
+	metrics.Counter("https_proxy_camouflage_truncated_total", "Camouflage responses cut off at max_response_kb.", func() float64 {
+		return float64(l.truncated.Load())
+	})
+	metrics.Counter("https_proxy_camouflage_wait_seconds_total", "Time camouflage requests waited for their client address's bandwidth limit.", func() float64 {
+		return time.Duration(l.waitNanos.Load()).Seconds()
+	})
+	return l
+}
+
+// TooLarge reports whether a response announcing contentLength bytes is
+// over the limit, so it is refused before any of it is relayed
+func (l *CamouflageLimits) TooLarge(contentLength int64) bool {
+	return l != nil && l.maxBytes > 0 && contentLength > l.maxBytes
+}
+
+// Request wraps the request body of a client at remoteAddr so it draws on
+// the address's bandwidth
+func (l *CamouflageLimits) Request(remoteAddr string, body io.Reader) io.Reader {
+	if l == nil || l.rate.RateBytes == 0 {
+		return body
+	}
+	return &rateLimitedReader{r: body, b: l.bucket(remoteAddr, time.Now()), waited: &l.waitNanos}
+}
+
+// Response wraps a response body relayed to a client at remoteAddr: it
+// draws on the address's bandwidth and fails with errResponseTooLarge
+// past max_response_kb
+func (l *CamouflageLimits) Response(remoteAddr string, body io.Reader) io.Reader {
+	if l == nil {
+		return body
+	}
+	if l.maxBytes > 0 {
+		body = &sizeLimitedReader{r: body, left: l.maxBytes}
+	}
+	return l.Request(remoteAddr, body)
+}
+
+// Truncated records a response cut off at the limit
+func (l *CamouflageLimits) Truncated(reqID, remoteAddr, path string) {
+	l.truncated.Add(1)
+	log.Printf("[req %s] Camouflage response to %s for %s cut off at %d KB", reqID, remoteAddr, path, l.maxBytes>>10)
+}
+
+// bucket returns the bucket of the client address in remoteAddr, dropping
+// the buckets of addresses idle for a while
+func (l *CamouflageLimits) bucket(remoteAddr string, now time.Time) *tokenBucket {
+	key := camouflageClientKey(remoteAddr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > camouflageIdle {
+		for k, b := range l.buckets {
+			b.mu.Lock()
+			idle := now.Sub(b.last) > camouflageIdle
+			b.mu.Unlock()
+			if idle {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{}
+		b.setRate(l.rate)
+		b.last = now
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// camouflageClientKey returns the address a client is limited by. IPv6
+// clients share their /64, which a single host can otherwise rotate
+// through at will.
+func camouflageClientKey(remoteAddr string) netip.Prefix {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Prefix{}
+	}
+	addr = addr.Unmap()
+	bits := addr.BitLen()
+	if addr.Is6() {
+		bits = 64
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+// sizeLimitedReader reads at most left bytes of r, then fails with
+// errResponseTooLarge if r has more
+type sizeLimitedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (c *sizeLimitedReader) Read(p []byte) (int, error) {
+	if c.left <= 0 {
+		// Only fail if there really is more
+		var one [1]byte
+		if n, err := c.r.Read(one[:]); n == 0 {
+			return 0, err
+		}
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCamouflageLimits(t *testing.T) {
+	if NewCamouflageLimits(&Config{}) != nil {
+		t.Fatal("limits built without a limit")
+	}
+
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/known":
+			w.Header().Set("Content-Length", "12288")
+			w.Write([]byte(strings.Repeat("k", 12288)))
+		case "/stream":
+			// Flushed first, so it goes out without a Content-Length
+			w.Write([]byte(strings.Repeat("s", 1024)))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(strings.Repeat("s", 16384)))
+		default:
+			w.Write([]byte(strings.Repeat("x", 8192)))
+		}
+	}))
+	defer site.Close()
+	cfg := &Config{}
+	cfg.Proxy.DefaultSite = site.URL
+	cfg.Proxy.CamouflageLimits = CamouflageLimitsConfig{MaxResponseKB: 8}
+	p := &Proxy{Config: cfg, ForwardedFor: NewForwardedForPolicy(cfg), CamouflageLimits: NewCamouflageLimits(cfg)}
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.proxyUnauthorizedRequest(w, r, "")
+	}))
+	defer front.Close()
+
+	get := func(path string) (int, int, error) {
+		resp, err := http.Get(front.URL + path)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, len(body), err
+	}
+	if code, n, err := get("/"); code != http.StatusOK || n != 8192 || err != nil {
+		t.Errorf("response at the limit: %d, %d bytes, %v", code, n, err)
+	}
+	if code, _, err := get("/known"); code != http.StatusNotFound || err != nil {
+		t.Errorf("announced oversize response: %d, %v", code, err)
+	}
+	if _, n, err := get("/stream"); err == nil {
+		t.Errorf("oversize stream ended cleanly after %d bytes", n)
+	}
+	if got := p.CamouflageLimits.truncated.Load(); got != 2 {
+		t.Errorf("%d responses counted as truncated, want 2", got)
+	}
+}
+
+func TestCamouflageLimits_PerAddress(t *testing.T) {
+	cfg := &Config{}
+	cfg.Proxy.CamouflageLimits = CamouflageLimitsConfig{IPKBps: 10, MaxResponseKB: -1}
+	l := NewCamouflageLimits(cfg)
+	if l == nil || l.maxBytes != 0 || l.rate != (RateDirection{10 << 10, 10 << 10}) {
+		t.Fatalf("limits = %+v", l)
+	}
+	now := time.Now()
+
+	// Addresses in the same IPv6 /64 share a bucket; IPv4 ones do not
+	if l.bucket("[2001:db8::1]:443", now) != l.bucket("[2001:db8::ffff]:80", now) {
+		t.Error("IPv6 /64 not shared")
+	}
+	if l.bucket("[2001:db8:0:1::1]:443", now) == l.bucket("[2001:db8::1]:443", now) {
+		t.Error("different /64s share a bucket")
+	}
+	if l.bucket("192.0.2.1:443", now) == l.bucket("192.0.2.2:443", now) {
+		t.Error("IPv4 addresses share a bucket")
+	}
+	if l.bucket("192.0.2.1:443", now) != l.bucket("[::ffff:192.0.2.1]:80", now) {
+		t.Error("IPv4-mapped address not unmapped")
+	}
+
+	b := l.bucket("192.0.2.1:1", now)
+	if wait := b.take(10<<10, now); wait != 0 {
+		t.Errorf("burst waited %v", wait)
+	}
+	if wait := l.bucket("192.0.2.1:2", now).take(5<<10, now); wait != 500*time.Millisecond {
+		t.Errorf("second request waits %v, want 500ms", wait)
+	}
+
+	// Idle addresses are forgotten
+	later := now.Add(2 * camouflageIdle)
+	if l.bucket("192.0.2.9:1", later); len(l.buckets) != 1 {
+		t.Errorf("%d buckets after the sweep, want 1", len(l.buckets))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// hopHeaders describe a single connection and are not passed between the
+// client and the camouflage site (RFC 9110 7.6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // sent by clients configured with us as their proxy
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, including those
+// named by its Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// camouflageURL returns the URL on the camouflage site that r maps to. Only
+// the path and query of the client's target are kept, appended to the path
+// of site, whatever form the target had: origin-form ("/a?b"),
+// absolute-form ("http://other.example/a?b", sent by clients that take us
+// for a forward proxy) or the "*" of OPTIONS, which asks the site about
+// itself.
+func camouflageURL(site string, r *http.Request) (*url.URL, error) {
+	u, err := url.Parse(site)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("default_site %q is not an absolute URL", site)
+	}
+	u.Fragment, u.RawFragment = "", ""
+	if r.RequestURI == "*" {
+		u.Path, u.RawPath, u.RawQuery = "", "", ""
+		u.Opaque = "*"
+		return u, nil
+	}
+
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	base := strings.TrimSuffix(u.Path, "/")
+	rawBase := strings.TrimSuffix(u.EscapedPath(), "/")
+	u.Path = base + path
+	u.RawPath = ""
+	if r.URL.RawPath != "" {
+		u.RawPath = rawBase + r.URL.RawPath
+	}
+	u.RawQuery, u.ForceQuery = r.URL.RawQuery, r.URL.ForceQuery
+	return u, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCamouflageURL(t *testing.T) {
+	tests := []struct {
+		site, target, want string
+	}{
+		{"http://127.0.0.1:8080", "/a/b?c=d", "http://127.0.0.1:8080/a/b?c=d"},
+		{"http://127.0.0.1:8080/", "/a", "http://127.0.0.1:8080/a"},
+		{"http://127.0.0.1:8080/blog/", "/a?", "http://127.0.0.1:8080/blog/a?"},
+		{"http://127.0.0.1:8080", "http://other.example", "http://127.0.0.1:8080/"},
+		{"http://127.0.0.1:8080", "http://other.example:81/x%2Fy?q", "http://127.0.0.1:8080/x%2Fy?q"},
+		{"http://127.0.0.1:8080", "//evil.example/x", "http://127.0.0.1:8080//evil.example/x"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		u, err := camouflageURL(tt.site, r)
+		if err != nil || u.String() != tt.want {
+			t.Errorf("%s + %s = %v, %v, want %s", tt.site, tt.target, u, err, tt.want)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodOptions, "*", nil)
+	if u, err := camouflageURL("http://127.0.0.1:8080/blog", r); err != nil || u.RequestURI() != "*" || u.Host != "127.0.0.1:8080" {
+		t.Errorf("OPTIONS * = %+v, %v", u, err)
+	}
+	if _, err := camouflageURL("127.0.0.1:8080", httptest.NewRequest(http.MethodGet, "/", nil)); err == nil {
+		t.Error("relative default_site accepted")
+	}
+}
+
+// TestCamouflage_ClientBehaviors replays what real clients and scanners
+// send to a proxy port they know nothing about
+func TestCamouflage_ClientBehaviors(t *testing.T) {
+	site := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-Site", "yes")
+		fmt.Fprintf(w, "%s %s host=%s conn=%q proxy-conn=%q auth=%q len=%d body=%s",
+			r.Method, r.RequestURI, r.Host, r.Header.Get("Connection"), r.Header.Get("Proxy-Connection"),
+			r.Header.Get("Proxy-Authorization"), r.ContentLength, body)
+	}))
+	site.Config.DisableGeneralOptionsHandler = true
+	site.Start()
+	defer site.Close()
+	cfg := &Config{}
+	cfg.Proxy.DefaultSite = site.URL + "/www/"
+	p := &Proxy{Config: cfg, ForwardedFor: NewForwardedForPolicy(cfg)}
+	front := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.proxyUnauthorizedRequest(w, r, "")
+	}))
+	front.Config.DisableGeneralOptionsHandler = true
+	front.Start()
+	defer front.Close()
+	siteHost := strings.TrimPrefix(site.URL, "http://")
+
+	tests := []struct {
+		name, request, want string
+	}{
+		{"curl", "GET /index.html HTTP/1.1\r\nHost: proxy.example\r\nUser-Agent: curl/8.5.0\r\n\r\n",
+			"GET /www/index.html host=" + siteHost + ` conn="" proxy-conn="" auth="" len=0 body=`},
+		{"curl -x", "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nProxy-Connection: Keep-Alive\r\nProxy-Authorization: Basic dTpw\r\n\r\n",
+			"GET /www/ host=" + siteHost + ` conn="" proxy-conn="" auth="" len=0 body=`},
+		{"wget over HTTP/1.0", "GET /robots.txt HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n",
+			"GET /www/robots.txt host=" + siteHost + ` conn="" proxy-conn="" auth="" len=0 body=`},
+		{"HTTP/1.0 form post", "POST /login HTTP/1.0\r\nContent-Length: 7\r\n\r\nuser=me",
+			"POST /www/login host=" + siteHost + ` conn="" proxy-conn="" auth="" len=7 body=user=me`},
+		{"absolute-form without path", "HEAD http://198.51.100.7 HTTP/1.1\r\nHost: 198.51.100.7\r\n\r\n", ""},
+		{"OPTIONS *", "OPTIONS * HTTP/1.1\r\nHost: proxy.example\r\n\r\n",
+			"OPTIONS * host=" + siteHost + ` conn="" proxy-conn="" auth="" len=0 body=`},
+	}
+	for _, tt := range tests {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, tt.request)
+		method := strings.Fields(tt.request)[0]
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: method})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			conn.Close()
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		conn.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != tt.want {
+			t.Errorf("%s: %d %q, want %q", tt.name, resp.StatusCode, body, tt.want)
+		}
+		if resp.Header.Get("X-Site") != "yes" || resp.Header.Get("Keep-Alive") != "" {
+			t.Errorf("%s: response headers %v", tt.name, resp.Header)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Outcomes of importing a certificate
+const (
+	CertImported    = "imported"
+	CertWouldImport = "would_import" // In a dry run
+	CertExists      = "exists"       // Already in the inventory
+	CertInvalid     = "invalid"
+)
+
+// maxCertImportBytes caps an import through the API
+const maxCertImportBytes = 16 << 20
+
+// certImportExts are the files of a directory an import reads
+var certImportExts = []string{".pem", ".crt", ".cer", ".der"}
+
+// CertImportResult is the outcome for one certificate of an import
+type CertImportResult struct {
+	Source   string    `json:"source"`             // File, and the certificate's position in it
+	Username string    `json:"username,omitempty"` // Subject CN
+	SHA256   string    `json:"sha256,omitempty"`
+	Serial   string    `json:"serial,omitempty"` // Hex
+	NotAfter time.Time `json:"not_after,omitzero"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// bundleCert is a certificate read for an import, with where it came from
+type bundleCert struct {
+	source string
+	cert   *x509.Certificate
+}
+
+// readCertBundle returns the certificates of a PEM bundle, or of a single
+// DER certificate, named name. Blocks other than certificates, such as
+// private keys, are skipped; certificates that do not parse are returned
+// as invalid results.
+func readCertBundle(name string, data []byte) ([]bundleCert, []CertImportResult) {
+	var certs []bundleCert
+	var invalid []CertImportResult
+	rest, n := data, 0
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		n++
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		source := name + "#" + strconv.Itoa(n)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			invalid = append(invalid, CertImportResult{Source: source, Status: CertInvalid, Error: err.Error()})
+			continue
+		}
+		certs = append(certs, bundleCert{source: source, cert: cert})
+	}
+	if n == 0 {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, []CertImportResult{{Source: name, Status: CertInvalid, Error: "no PEM or DER certificate found"}}
+		}
+		certs = append(certs, bundleCert{source: name, cert: cert})
+	}
+	return certs, invalid
+}
+
+// readCertPath reads the certificates of a bundle file, or of the .pem,
+// .crt, .cer and .der files of a directory
+func readCertPath(path string) ([]bundleCert, []CertImportResult, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = files[:0]
+		for _, e := range entries {
+			if e.Type().IsRegular() && slices.Contains(certImportExts, strings.ToLower(filepath.Ext(e.Name()))) {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+	var certs []bundleCert
+	var invalid []CertImportResult
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			invalid = append(invalid, CertImportResult{Source: f, Status: CertInvalid, Error: err.Error()})
+			continue
+		}
+		c, bad := readCertBundle(f, data)
+		certs = append(certs, c...)
+		invalid = append(invalid, bad...)
+	}
+	return certs, invalid, nil
+}
+
+// certImportOptions control how certificates are imported
+type certImportOptions struct {
+	Roots     *x509.CertPool // If set, certificates must chain to it
+	SetExpiry bool           // Record the latest NotAfter as the user's expiry (user_expiry.from_cert)
+	DryRun    bool
+	Actor     string
+	Now       time.Time
+}
+
+// checkClientCert returns why cert cannot log in to the proxy, if it
+// cannot
+func checkClientCert(cert *x509.Certificate, roots *x509.CertPool, now time.Time) error {
+	if cert.Subject.CommonName == "" {
+		return errors.New("no subject CN")
+	}
+	if cert.IsCA {
+		return errors.New("CA certificate")
+	}
+	if len(cert.ExtKeyUsage) > 0 && !slices.Contains(cert.ExtKeyUsage, x509.ExtKeyUsageClientAuth) && !slices.Contains(cert.ExtKeyUsage, x509.ExtKeyUsageAny) {
+		return errors.New("not for client authentication")
+	}
+	if roots != nil {
+		// Expired certificates are still inventoried; check them as of the
+		// end of their validity
+		at := now
+		if at.After(cert.NotAfter) {
+			at = cert.NotAfter
+		}
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, CurrentTime: at, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+			return fmt.Errorf("not signed by the proxy's CA: %v", err)
+		}
+	}
+	return nil
+}
+
+// importClientCerts adds certificates issued outside the built-in CA to
+// the inventory in client_certs, registering each CN as a user. Users get
+// a cert_imported event per certificate and, with SetExpiry, the latest
+// NotAfter of their certificates as expiry date.
+func importClientCerts(ctx context.Context, db *StatsDB, certs []bundleCert, opts certImportOptions) []CertImportResult {
+	results := make([]CertImportResult, 0, len(certs))
+	seen := make(map[string]bool)
+	var users []string
+	for _, bc := range certs {
+		c := bc.cert
+		sum := sha256.Sum256(c.Raw)
+		res := CertImportResult{Source: bc.source, Username: c.Subject.CommonName, SHA256: hex.EncodeToString(sum[:]),
+			Serial: c.SerialNumber.Text(16), NotAfter: c.NotAfter.UTC()}
+		if err := checkClientCert(c, opts.Roots, opts.Now); err != nil {
+			res.Status, res.Error = CertInvalid, err.Error()
+			results = append(results, res)
+			continue
+		}
+		if seen[res.SHA256] {
+			res.Status = CertExists
+			results = append(results, res)
+			continue
+		}
+		seen[res.SHA256] = true
+
+		if opts.DryRun {
+			res.Status = CertWouldImport
+			if exists, err := db.HasClientCert(ctx, res.SHA256); err != nil {
+				res.Status, res.Error = CertInvalid, err.Error()
+			} else if exists {
+				res.Status = CertExists
+			}
+			results = append(results, res)
+			continue
+		}
+		added, err := db.AddClientCert(DBClientCert{
+			SHA256:    res.SHA256,
+			Username:  res.Username,
+			Serial:    res.Serial,
+			Issuer:    c.Issuer.String(),
+			NotBefore: c.NotBefore.UTC(),
+			NotAfter:  res.NotAfter,
+			Source:    ClientCertImported,
+			AddedBy:   opts.Actor,
+			AddedAt:   opts.Now.UTC(),
+		})
+		switch {
+		case err != nil:
+			res.Status, res.Error = CertInvalid, err.Error()
+		case !added:
+			res.Status = CertExists
+		default:
+			res.Status = CertImported
+			db.EnsureUser(res.Username)
+			db.RecordUserEvent(res.Username, EventCertImported, opts.Actor,
+				fmt.Sprintf("serial %s, sha256 %s, expires %s", res.Serial, res.SHA256, res.NotAfter.Format(time.RFC3339)))
+			if !slices.Contains(users, res.Username) {
+				users = append(users, res.Username)
+			}
+		}
+		results = append(results, res)
+	}
+
+	if opts.SetExpiry {
+		for _, user := range users {
+			latest, err := db.LatestClientCert(ctx, user)
+			if err == nil && !latest.IsZero() {
+				err = db.SetUserExpiry(user, latest, ExpirySourceCert)
+			}
+			if err != nil {
+				log.Printf("Certificate import: expiry of %s: %v", user, err)
+			}
+		}
+	}
+	return results
+}
+
+// certImportCounts tallies the results by status
+func certImportCounts(results []CertImportResult) map[string]int {
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Status]++
+	}
+	return counts
+}
+
+// loadCertRoots returns the pool of the CA certificate at path, or nil if
+// it cannot be read
+func loadCertRoots(path string) *x509.CertPool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil
+	}
+	return pool
+}
+
+// ImportCertsCLI imports the certificates at path into the stats database
+// at dbPath, for the -import-certs flag, and prints the outcome of each
+func ImportCertsCLI(cfg *Config, dbPath, path string) error {
+	certs, invalid, err := readCertPath(path)
+	if err != nil {
+		return err
+	}
+	db, err := NewStatsDB(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	results := append(invalid, importClientCerts(context.Background(), db, certs, certImportOptions{
+		Roots:     loadCertRoots(cfg.Server.Certificates.CAPath),
+		SetExpiry: cfg.UserExpiry.FromCert,
+		Actor:     "cli",
+		Now:       time.Now(),
+	})...)
+	for _, r := range results {
+		line := fmt.Sprintf("%-12s %-24s %s", r.Status, r.Username, r.Source)
+		if r.Error != "" {
+			line += ": " + r.Error
+		}
+		fmt.Println(line)
+	}
+	counts := certImportCounts(results)
+	fmt.Printf("Imported %d certificates into %s, %d already there, %d invalid\n", counts[CertImported], dbPath, counts[CertExists], counts[CertInvalid])
+	return nil
+}
+
+// handleCertImport serves /api/v2/users/certs: GET lists the certificate
+// inventory (?user= for one user's) and POST with a PEM bundle as body
+// imports it (?dry_run=true to only check it)
+func handleCertImport(w http.ResponseWriter, r *http.Request, config *Config, db *StatsDB) {
+	switch r.Method {
+	case http.MethodGet:
+		certs, err := db.GetClientCerts(r.Context(), r.URL.Query().Get("user"))
+		writeStatsResponse(w, certs, err)
+	case http.MethodPost:
+		if db.ReadOnly() {
+			writeJSONResponse(w, WebResponse{Success: false, Error: errStatsReadOnly.Error()}, http.StatusServiceUnavailable)
+			return
+		}
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCertImportBytes))
+		if err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		certs, invalid := readCertBundle("body", data)
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+		actor := "api:" + adminName(r)
+		results := append(invalid, importClientCerts(r.Context(), db, certs, certImportOptions{
+			Roots:     loadCertRoots(config.Server.Certificates.CAPath),
+			SetExpiry: config.UserExpiry.FromCert,
+			DryRun:    dryRun,
+			Actor:     actor,
+			Now:       time.Now(),
+		})...)
+		counts := certImportCounts(results)
+		if !dryRun && counts[CertImported] > 0 {
+			log.Printf("%d client certificates imported by %s", counts[CertImported], actor)
+		}
+		writeJSONResponse(w, WebResponse{Success: true, Data: map[string]interface{}{"counts": counts, "results": results}}, http.StatusOK)
+	default:
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestImportClientCerts(t *testing.T) {
+	db := newExpiryTestDB(t)
+	ca, err := GenerateCA("Test CA", 365*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(cn string, validity time.Duration, usage ...x509.ExtKeyUsage) *IssuedCert {
+		c, err := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: cn, ExtKeyUsage: usage, Validity: validity})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	alice1 := issue("alice", 30*24*time.Hour, x509.ExtKeyUsageClientAuth)
+	alice2 := issue("alice", 90*24*time.Hour, x509.ExtKeyUsageClientAuth)
+	server := issue("proxy.example.com", 90*24*time.Hour, x509.ExtKeyUsageServerAuth)
+
+	dir := t.TempDir()
+	bundle := append(append(append([]byte{}, alice1.CertPEM...), alice1.KeyPEM...), alice2.CertPEM...)
+	os.WriteFile(filepath.Join(dir, "alice.pem"), bundle, 0600)
+	os.WriteFile(filepath.Join(dir, "server.crt"), server.CertPEM, 0600)
+	os.WriteFile(filepath.Join(dir, "ca.der"), ca.Cert.Raw, 0600)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a certificate"), 0600)
+
+	certs, invalid, err := readCertPath(dir)
+	if err != nil || len(certs) != 4 || len(invalid) != 0 {
+		t.Fatalf("read %d certificates, %v invalid, %v", len(certs), invalid, err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	opts := certImportOptions{Roots: roots, SetExpiry: true, Actor: "cli", Now: time.Now()}
+	counts := certImportCounts(importClientCerts(context.Background(), db, certs, opts))
+	if counts[CertImported] != 2 || counts[CertInvalid] != 2 {
+		t.Fatalf("counts = %v", counts)
+	}
+
+	list, err := db.GetClientCerts(context.Background(), "alice")
+	if err != nil || len(list) != 2 || !list[0].NotAfter.Equal(alice2.Cert.NotAfter.Truncate(time.Second)) || list[0].AddedBy != "cli" {
+		t.Fatalf("inventory = %+v, %v", list, err)
+	}
+	if u, err := db.GetUser(context.Background(), "alice"); err != nil || u == nil {
+		t.Errorf("alice not registered: %v", err)
+	}
+	if e, _ := db.GetUserExpiry(context.Background(), "alice", time.Now()); e == nil || !e.ExpiresAt.Equal(list[0].NotAfter) || e.Source != ExpirySourceCert {
+		t.Errorf("expiry = %+v", e)
+	}
+
+	// Certificates of another CA are refused once the proxy's CA is known
+	other, _ := GenerateCA("Other CA", 365*24*time.Hour)
+	bob, _ := IssueCert(other.Cert, other.Key, CertRequest{CommonName: "bob", Validity: 24 * time.Hour})
+	certs, _ = readCertBundle("bob.pem", bob.CertPEM)
+	if res := importClientCerts(context.Background(), db, certs, opts); res[0].Status != CertInvalid {
+		t.Errorf("bob = %+v", res[0])
+	}
+
+	// Through the API, a second import finds the certificates in the
+	// inventory
+	cfg := &Config{}
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, db, NewPolicyEngine(cfg, nil, db), nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v2/users/certs?dry_run=true", bytes.NewReader(bundle)))
+	var resp struct {
+		Data struct {
+			Counts  map[string]int     `json:"counts"`
+			Results []CertImportResult `json:"results"`
+		} `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.Data.Counts[CertExists] != 2 || len(resp.Data.Results) != 2 {
+		t.Fatalf("dry run = %d %+v", rec.Code, resp.Data)
+	}
+	if n, _ := db.GetClientCerts(context.Background(), ""); len(n) != 2 {
+		t.Errorf("%d certificates in the inventory", len(n))
+	}
+}
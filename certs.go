@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// CertRequest describes a certificate to be issued by the proxy's CA
+type CertRequest struct {
+	CommonName   string
+	Organization []string // Subject O
+	OrgUnits     []string // Subject OU
+	DNSNames     []string
+	IPAddresses  []net.IP
+	ExtKeyUsage  []x509.ExtKeyUsage
+	Validity     time.Duration
+}
+
+// IssuedCert holds an issued certificate and its private key, both parsed
+// and PEM encoded
+type IssuedCert struct {
+	Cert    *x509.Certificate
+	Key     crypto.Signer
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// newSerialNumber returns a random 128-bit certificate serial number
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// GenerateCA creates a self-signed CA certificate with an ECDSA P-256 key
+func GenerateCA(commonName string, validity time.Duration) (*IssuedCert, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate CA key: %w", err)
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, fmt.Errorf("generate serial: %w", err)
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("create CA certificate: %w", err)
+	}
+	return newIssuedCert(der, key)
+}
+
+// IssueCert signs a new leaf certificate for req with the given CA
+func IssueCert(ca *x509.Certificate, caKey crypto.Signer, req CertRequest) (*IssuedCert, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, fmt.Errorf("generate serial: %w", err)
+	}
+
+	now := time.Now()
+	notAfter := now.Add(req.Validity)
+	if notAfter.After(ca.NotAfter) {
+		notAfter = ca.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         req.CommonName,
+			Organization:       req.Organization,
+			OrganizationalUnit: req.OrgUnits,
+		},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           req.ExtKeyUsage,
+		DNSNames:              req.DNSNames,
+		IPAddresses:           req.IPAddresses,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, fmt.Errorf("create certificate for %s: %w", req.CommonName, err)
+	}
+	return newIssuedCert(der, key)
+}
+
+func newIssuedCert(der []byte, key *ecdsa.PrivateKey) (*IssuedCert, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse issued certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal key: %w", err)
+	}
+	return &IssuedCert{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// WriteFiles writes the certificate and key PEM files. The key is written
+// with owner-only permissions.
+func (c *IssuedCert) WriteFiles(certPath, keyPath string) error {
+	if err := os.WriteFile(certPath, c.CertPEM, 0644); err != nil {
+		return fmt.Errorf("write %s: %w", certPath, err)
+	}
+	if err := os.WriteFile(keyPath, c.KeyPEM, 0600); err != nil {
+		return fmt.Errorf("write %s: %w", keyPath, err)
+	}
+	return nil
+}
+
+// LoadCA reads a CA certificate and its private key from PEM files
+func LoadCA(certPath, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read CA certificate: %w", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no PEM data in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse CA certificate: %w", err)
+	}
+
+	keyPEM, err := readKeyFile(keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read CA key: %w", err)
+	}
+	key, err := parsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse CA key: %w", err)
+	}
+	return cert, key, nil
+}
+
+// parsePrivateKeyPEM accepts PKCS#8, PKCS#1 (RSA), and SEC 1 (EC) keys, which
+// covers both keys written by GenerateCA and by the openssl scripts
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported PKCS#8 key type %T", key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported private key format %q", block.Type)
+}
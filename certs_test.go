@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssueCert_VerifiesAgainstCA(t *testing.T) {
+	ca, err := GenerateCA("Test CA", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	server, err := IssueCert(ca.Cert, ca.Key, CertRequest{
+		CommonName:  "proxy.example.com",
+		DNSNames:    []string{"proxy.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		Validity:    time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("IssueCert server: %v", err)
+	}
+	if _, err := server.Cert.Verify(x509.VerifyOptions{DNSName: "proxy.example.com", Roots: roots}); err != nil {
+		t.Errorf("server certificate does not verify: %v", err)
+	}
+
+	client, err := IssueCert(ca.Cert, ca.Key, CertRequest{
+		CommonName:  "alice",
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Validity:    365 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("IssueCert client: %v", err)
+	}
+	if _, err := client.Cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		t.Errorf("client certificate does not verify: %v", err)
+	}
+	if client.Cert.Subject.CommonName != "alice" {
+		t.Errorf("CN = %q, want alice", client.Cert.Subject.CommonName)
+	}
+	if client.Cert.NotAfter.After(ca.Cert.NotAfter) {
+		t.Error("leaf validity must be clamped to the CA's")
+	}
+}
+
+func TestLoadCA_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := GenerateCA("Test CA", time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateCA: %v", err)
+	}
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	if err := ca.WriteFiles(certPath, keyPath); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, key, err := LoadCA(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("LoadCA: %v", err)
+	}
+	if !cert.Equal(ca.Cert) {
+		t.Error("loaded CA certificate differs")
+	}
+
+	// The loaded key must be able to sign leaves that chain to the CA
+	leaf, err := IssueCert(cert, key, CertRequest{CommonName: "bob", Validity: time.Hour})
+	if err != nil {
+		t.Fatalf("IssueCert with loaded CA: %v", err)
+	}
+	if err := leaf.Cert.CheckSignatureFrom(ca.Cert); err != nil {
+		t.Errorf("leaf not signed by CA: %v", err)
+	}
+}
+
+func TestCALog_Chain(t *testing.T) {
+	ca, err := GenerateCA("Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := caLogPath(filepath.Join(t.TempDir(), "ca.pem"))
+	if v, err := VerifyCALog(path); err != nil || !v.Valid || v.Entries != 0 {
+		t.Fatalf("missing log: %+v, %v", v, err)
+	}
+	for _, cn := range []string{"alice", "bob", "carol"} {
+		issued, err := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: cn, Validity: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := appendCALog(path, issued.Cert, CALogTrial, "admin", time.Now()); err != nil {
+			t.Fatalf("appendCALog: %v", err)
+		}
+	}
+	v, err := VerifyCALog(path)
+	if err != nil || !v.Valid || v.Entries != 3 {
+		t.Fatalf("after three issuances: %+v, %v", v, err)
+	}
+
+	// Rewriting an entry breaks the chain, and nothing is appended to a
+	// broken chain
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, bytes.Replace(data, []byte(`"subject":"bob"`), []byte(`"subject":"eve"`), 1), 0600)
+	if v, _ := VerifyCALog(path); v.Valid || !strings.Contains(v.Error, "entry 2") {
+		t.Errorf("edited entry not detected: %+v", v)
+	}
+	if err := appendCALog(path, ca.Cert, CALogSetup, "", time.Now()); err == nil {
+		t.Error("entry appended to a broken chain")
+	}
+
+	// Removing an entry breaks it too
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	os.WriteFile(path, append(lines[0], lines[2]...), 0600)
+	if v, _ := VerifyCALog(path); v.Valid {
+		t.Errorf("removed entry not detected: %+v", v)
+	}
+}
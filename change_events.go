@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Change event types streamed by /api/v2/events, besides EventUserEnabled
+// and EventUserDisabled
+const (
+	ChangeQuota       = "quota_changed"       // A user's traffic or rate limits were set or lifted
+	ChangeSettings    = "settings_changed"    // Runtime settings were changed through the API
+	ChangeConfig      = "config_rolled_back"  // The config file was restored from history
+	ChangeMaintenance = "maintenance_changed" // Maintenance mode or windows were changed
+	ChangeACL         = "acl_changed"         // A domain ACL rule was added or removed
+)
+
+// changeFeedBacklog is how many recent events are kept for clients
+// resuming with Last-Event-ID
+const changeFeedBacklog = 256
+
+// changeKeepalive is how often an idle stream gets a comment line, so
+// proxies between it and the client do not time it out
+const changeKeepalive = 15 * time.Second
+
+// ChangeEvent is a change to users, limits or configuration, for automation
+// mirroring the proxy's state, e.g. into a billing system
+type ChangeEvent struct {
+	ID     uint64    `json:"id"`
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	User   string    `json:"user,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// ChangeFeed fans change events out to the open /api/v2/events streams
+type ChangeFeed struct {
+	mu     sync.Mutex
+	nextID uint64
+	recent []ChangeEvent // oldest first
+	subs   map[chan ChangeEvent]struct{}
+}
+
+// changeFeed is the process-wide feed
+var changeFeed = NewChangeFeed()
+
+// NewChangeFeed creates a feed with no events
+func NewChangeFeed() *ChangeFeed {
+	f := &ChangeFeed{nextID: 1, subs: make(map[chan ChangeEvent]struct{})}
+	metrics.Gauge("https_proxy_change_event_streams", "Open /api/v2/events streams.", func() float64 {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return float64(len(f.subs))
+	})
+	return f
+}
+
+// Publish numbers e and sends it to every stream. A stream too slow to take
+// it is closed; its client resumes from the backlog with Last-Event-ID.
+func (f *ChangeFeed) Publish(e ChangeEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e.ID = f.nextID
+	f.nextID++
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	f.recent = append(f.recent, e)
+	if len(f.recent) > changeFeedBacklog {
+		f.recent = f.recent[len(f.recent)-changeFeedBacklog:]
+	}
+	for ch := range f.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the kept events after lastID and a channel of new ones
+func (f *ChangeFeed) Subscribe(lastID uint64) ([]ChangeEvent, <-chan ChangeEvent, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var replay []ChangeEvent
+	for _, e := range f.recent {
+		if e.ID > lastID {
+			replay = append(replay, e)
+		}
+	}
+	ch := make(chan ChangeEvent, 64)
+	f.subs[ch] = struct{}{}
+	cancel := func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.subs[ch]; ok {
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+	return replay, ch, cancel
+}
+
+// handleChangeEvents serves /api/v2/events as server-sent events. ?types=
+// limits the stream to a comma-separated list of event types; Last-Event-ID
+// (or ?last_event_id=) replays what a reconnecting client missed.
+func handleChangeEvents(w http.ResponseWriter, r *http.Request, feed *ChangeFeed) {
+	if r.Method != http.MethodGet {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+	types := make(map[string]bool)
+	for _, t := range strings.Split(r.URL.Query().Get("types"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	since, _ := strconv.ParseUint(lastID, 10, 64)
+
+	replay, events, cancel := feed.Subscribe(since)
+	defer cancel()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	send := func(e ChangeEvent) error {
+		if len(types) > 0 && !types[e.Type] {
+			return nil
+		}
+		data, _ := json.Marshal(e)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	for _, e := range replay {
+		if send(e) != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(changeKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok || send(e) != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
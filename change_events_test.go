@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readChangeEvent reads the next event off an SSE stream
+func readChangeEvent(t *testing.T, r *bufio.Reader) ChangeEvent {
+	t.Helper()
+	var e ChangeEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read stream: %v", err)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if line == "\n" && e.ID != 0 {
+			return e
+		}
+	}
+}
+
+func TestChangeEvents_Stream(t *testing.T) {
+	feed := NewChangeFeed()
+	feed.Publish(ChangeEvent{Type: EventUserDisabled, User: "bob", Actor: "web:ops"})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleChangeEvents(w, r, feed)
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?types=user_disabled,quota_changed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	stream := bufio.NewReader(resp.Body)
+
+	// Events from before the client connected are replayed
+	if e := readChangeEvent(t, stream); e.ID != 1 || e.User != "bob" {
+		t.Errorf("replayed %+v", e)
+	}
+	feed.Publish(ChangeEvent{Type: ChangeSettings, Detail: "default_site"})
+	feed.Publish(ChangeEvent{Type: ChangeQuota, User: "bob", Detail: "trial limits lifted"})
+	if e := readChangeEvent(t, stream); e.ID != 3 || e.Type != ChangeQuota {
+		t.Errorf("streamed %+v, want the quota change only", e)
+	}
+
+	// A reconnecting client only gets what it missed
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Last-Event-ID", "2")
+	resp2, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	if e := readChangeEvent(t, bufio.NewReader(resp2.Body)); e.ID != 3 {
+		t.Errorf("resumed at %+v", e)
+	}
+}
+
+func TestChangeEvents_UserDisabled(t *testing.T) {
+	_, events, cancel := changeFeed.Subscribe(^uint64(0))
+	defer cancel()
+	if _, err := setUserDisabled(nil, nil, "carol", true, "api:ops"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		if e.Type != EventUserDisabled || e.User != "carol" || e.Actor != "api:ops" {
+			t.Errorf("event = %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event published")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ClientConfig holds ready-to-use proxy settings for one user. File names
+// are those the user is expected to save their certificate bundle under.
+type ClientConfig struct {
+	Username string            `json:"username"`
+	Host     string            `json:"host"`
+	Port     int               `json:"port"`
+	ProxyURL string            `json:"proxy_url"`
+	Files    ClientConfigFiles `json:"files"`
+	// Snippets maps a client (curl, chrome, pac, firefox, clash, surge) to
+	// its configuration
+	Snippets map[string]string `json:"snippets"`
+}
+
+// ClientConfigFiles names the certificate files the snippets reference
+type ClientConfigFiles struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	CA   string `json:"ca"`
+	P12  string `json:"p12"`
+}
+
+// clientConfigFormats are the snippets that can be downloaded on their own
+// with ?format=
+var clientConfigFormats = map[string]string{
+	"curl":    "text/plain; charset=utf-8",
+	"chrome":  "text/plain; charset=utf-8",
+	"pac":     "application/x-ns-proxy-autoconfig",
+	"firefox": "text/plain; charset=utf-8",
+	"clash":   "application/yaml",
+	"surge":   "text/plain; charset=utf-8",
+}
+
+// NewClientConfig builds the settings for username connecting to host:port
+func NewClientConfig(username, host string, port int) *ClientConfig {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	files := ClientConfigFiles{
+		Cert: username + ".pem",
+		Key:  username + ".key",
+		CA:   "ca.pem",
+		P12:  username + ".p12",
+	}
+	pac := fmt.Sprintf(`function FindProxyForURL(url, host) { return "HTTPS %s"; }`, addr)
+	name := strconv.Quote(username)
+	return &ClientConfig{
+		Username: username,
+		Host:     host,
+		Port:     port,
+		ProxyURL: "https://" + addr,
+		Files:    files,
+		Snippets: map[string]string{
+			"curl": fmt.Sprintf("curl --proxy https://%s --proxy-cert %s --proxy-key %s --proxy-cacert %s https://example.com\n",
+				addr, files.Cert, files.Key, files.CA),
+			"chrome": fmt.Sprintf("# Import %s into the OS keychain and trust %s, then start Chrome/Edge with\n--proxy-server=https://%s\n",
+				files.P12, files.CA, addr),
+			"pac": pac + "\n",
+			"firefox": fmt.Sprintf("# Settings > Certificates: import %s under Your Certificates and %s under Authorities\n"+
+				"# Settings > Network Settings > Automatic proxy configuration URL: a PAC file containing\n%s\n",
+				files.P12, files.CA, pac),
+			"clash": fmt.Sprintf("proxies:\n  - name: %[1]s\n    type: http\n    server: %[2]s\n    port: %[3]d\n    tls: true\n"+
+				"    certificate: ./%[4]s\n    private-key: ./%[5]s\nproxy-groups:\n  - name: Proxy\n    type: select\n    proxies: [%[1]s]\n"+
+				"rules:\n  - MATCH,Proxy\n", name, host, port, files.Cert, files.Key),
+			"surge": fmt.Sprintf("[Proxy]\n%[1]s = https, %[2]s, %[3]d, client-cert=%[1]s-cert\n\n"+
+				"[Keystore]\n%[1]s-cert = type = PKCS12, password = <p12 password>, base64 = <base64 of %[4]s>\n",
+				strings.ReplaceAll(username, " ", "-"), host, port, files.P12),
+		},
+	}
+}
+
+// clientConfigHost returns the host clients should connect to: ?host=, else
+// the first name on the server certificate, else the host the admin API was
+// reached on
+func clientConfigHost(cfg *Config, r *http.Request) string {
+	if h := r.URL.Query().Get("host"); h != "" {
+		return h
+	}
+	if data, err := os.ReadFile(cfg.Server.Certificates.CertPath); err == nil {
+		if block, _ := pem.Decode(data); block != nil {
+			if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+				if len(cert.DNSNames) > 0 {
+					return cert.DNSNames[0]
+				}
+				if len(cert.IPAddresses) > 0 {
+					return cert.IPAddresses[0].String()
+				}
+			}
+		}
+	}
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		return h
+	}
+	return r.Host
+}
+
+// handleClientConfig serves /api/v2/users/{name}/client-config: every
+// snippet as JSON, or one of them as a download with ?format=
+func handleClientConfig(w http.ResponseWriter, r *http.Request, cfg *Config, username string) {
+	if r.Method != http.MethodGet {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+	cc := NewClientConfig(username, clientConfigHost(cfg, r), cfg.Server.Port)
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		writeJSONResponse(w, WebResponse{Success: true, Data: cc}, http.StatusOK)
+		return
+	}
+	contentType, ok := clientConfigFormats[format]
+	if !ok {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "unknown format: " + format}, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(cc.Snippets[format]))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientConfig(t *testing.T) {
+	cfg := &Config{}
+	cfg.Server.Port = 8443
+	mux := http.NewServeMux()
+	// No stats database: onboarding does not depend on it
+	registerV2API(mux, cfg, nil, nil, nil, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v2/users/alice/client-config", nil)
+	req.Host = "admin.example.com:9444"
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	var resp struct {
+		Data ClientConfig `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	cc := resp.Data
+	if cc.ProxyURL != "https://admin.example.com:8443" {
+		t.Errorf("ProxyURL = %q", cc.ProxyURL)
+	}
+	if !strings.Contains(cc.Snippets["curl"], "--proxy-cert alice.pem --proxy-key alice.key") {
+		t.Errorf("curl = %q", cc.Snippets["curl"])
+	}
+	for _, format := range []string{"curl", "chrome", "pac", "firefox", "clash", "surge"} {
+		if cc.Snippets[format] == "" {
+			t.Errorf("no %s snippet", format)
+		}
+	}
+
+	// A single snippet as a download, for an explicit host
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/users/alice/client-config?format=clash&host=proxy.example.com", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/yaml" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "server: proxy.example.com") || !strings.Contains(body, "port: 8443") {
+		t.Errorf("clash = %q", body)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/users/alice/client-config?format=ini", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: status %d", rec.Code)
+	}
+
+	// Other user routes still need the database
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/users/alice", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("user without database: status %d", rec.Code)
+	}
+}
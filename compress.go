@@ -0,0 +1,161 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Defaults for the camouflage response compression guardrails
+const (
+	defaultCompressionMinSize = 1024
+	defaultCompressionLevel   = gzip.BestSpeed
+)
+
+// responseCompressor gzips responses relayed from the default site when the
+// client accepts it. Only compressible, not yet encoded bodies are touched,
+// and at most maxActive responses are compressed at once so compression
+// cannot starve tunnel traffic of CPU; beyond that bodies pass through as is.
+type responseCompressor struct {
+	minSize int64
+	active  chan struct{}
+	pool    sync.Pool
+
+	compressed  atomic.Uint64
+	skippedBusy atomic.Uint64
+}
+
+// newResponseCompressor returns nil when compression is disabled
+func newResponseCompressor(config *Config) *responseCompressor {
+	perf := config.Server.Performance
+	if !perf.EnableCompression {
+		return nil
+	}
+
+	level := perf.CompressionLevel
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		level = defaultCompressionLevel
+	}
+	maxActive := perf.MaxConcurrentCompressions
+	if maxActive <= 0 {
+		maxActive = runtime.NumCPU()
+	}
+	minSize := int64(perf.CompressionMinSize)
+	if minSize <= 0 {
+		minSize = defaultCompressionMinSize
+	}
+
+	c := &responseCompressor{
+		minSize: minSize,
+		active:  make(chan struct{}, maxActive),
+	}
+	c.pool.New = func() interface{} {
+		gz, _ := gzip.NewWriterLevel(io.Discard, level)
+		return gz
+	}
+
+	metrics.Counter("https_proxy_compressed_responses_total", "Camouflage responses gzip-compressed by the proxy",
+		func() float64 { return float64(c.compressed.Load()) })
+	metrics.Counter("https_proxy_compression_skipped_busy_total", "Compressible responses sent uncompressed because the compression limit was reached",
+		func() float64 { return float64(c.skippedBusy.Load()) })
+	return c
+}
+
+// Start decides whether resp should be compressed for r. If so it rewrites
+// the response headers in w and returns the writer for the body and a
+// function that must be called after the body was written. Otherwise it
+// returns w unchanged and a no-op.
+func (c *responseCompressor) Start(w http.ResponseWriter, r *http.Request, resp *http.Response) (io.Writer, func() error) {
+	noop := func() error { return nil }
+	if c == nil || !c.eligible(r, resp) {
+		return w, noop
+	}
+
+	select {
+	case c.active <- struct{}{}:
+	default:
+		c.skippedBusy.Add(1)
+		return w, noop
+	}
+	c.compressed.Add(1)
+
+	h := w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Add("Vary", "Accept-Encoding")
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// The encoded body is no longer byte-identical to the original
+		h.Set("ETag", "W/"+etag)
+	}
+
+	gz := c.pool.Get().(*gzip.Writer)
+	gz.Reset(w)
+	return gz, func() error {
+		err := gz.Close()
+		gz.Reset(io.Discard)
+		c.pool.Put(gz)
+		<-c.active
+		return err
+	}
+}
+
+func (c *responseCompressor) eligible(r *http.Request, resp *http.Response) bool {
+	if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		return false
+	}
+	switch {
+	case resp.StatusCode < 200, resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusPartialContent, resp.StatusCode == http.StatusNotModified:
+		return false
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < c.minSize {
+		return false
+	}
+	return isCompressibleType(resp.Header.Get("Content-Type"))
+}
+
+// acceptsGzip parses an Accept-Encoding header for gzip (or *) with q > 0
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+// isCompressibleType reports whether a Content-Type is text-like
+func isCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml",
+		"application/wasm", "application/manifest+json", "image/svg+xml":
+		return true
+	}
+	return false
+}
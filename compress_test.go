@@ -0,0 +1,103 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestCompressor(t *testing.T, maxActive int) *responseCompressor {
+	t.Helper()
+	cfg := &Config{}
+	cfg.Server.Performance.EnableCompression = true
+	cfg.Server.Performance.MaxConcurrentCompressions = maxActive
+	return newResponseCompressor(cfg)
+}
+
+func compressTestResponse(contentType, encoding string, length int64) *http.Response {
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, ContentLength: length}
+	resp.Header.Set("Content-Type", contentType)
+	if encoding != "" {
+		resp.Header.Set("Content-Encoding", encoding)
+	}
+	return resp
+}
+
+func TestResponseCompressor_RoundTrip(t *testing.T) {
+	c := newTestCompressor(t, 1)
+	body := strings.Repeat("<p>hello camouflage</p>", 200)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "br, gzip;q=0.8")
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Length", "4600")
+	rec.Header().Set("ETag", `"abc"`)
+
+	w, finish := c.Start(rec, r, compressTestResponse("text/html; charset=utf-8", "", int64(len(body))))
+	io.WriteString(w, body)
+	if err := finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := rec.Header()
+	if h.Get("Content-Encoding") != "gzip" || h.Get("Content-Length") != "" || h.Get("ETag") != `W/"abc"` {
+		t.Errorf("unexpected headers: %v", h)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(gz)
+	if string(got) != body {
+		t.Error("decompressed body differs")
+	}
+	if len(c.active) != 0 {
+		t.Error("compression slot not released")
+	}
+}
+
+func TestResponseCompressor_Skips(t *testing.T) {
+	c := newTestCompressor(t, 1)
+	tests := []struct {
+		name   string
+		accept string
+		method string
+		resp   *http.Response
+	}{
+		{"client refuses", "gzip;q=0", http.MethodGet, compressTestResponse("text/html", "", -1)},
+		{"no accept header", "", http.MethodGet, compressTestResponse("text/html", "", -1)},
+		{"already encoded", "gzip", http.MethodGet, compressTestResponse("text/html", "br", -1)},
+		{"binary type", "gzip", http.MethodGet, compressTestResponse("image/png", "", -1)},
+		{"too small", "gzip", http.MethodGet, compressTestResponse("application/json", "", 100)},
+		{"head", "gzip", http.MethodHead, compressTestResponse("text/html", "", -1)},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/", nil)
+		r.Header.Set("Accept-Encoding", tt.accept)
+		rec := httptest.NewRecorder()
+		if w, _ := c.Start(rec, r, tt.resp); w != rec || rec.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s: response was compressed", tt.name)
+		}
+	}
+
+	// The slot is taken: the next eligible response passes through
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	_, finish := c.Start(httptest.NewRecorder(), r, compressTestResponse("text/css", "", -1))
+	rec := httptest.NewRecorder()
+	if w, _ := c.Start(rec, r, compressTestResponse("text/css", "", -1)); w != rec {
+		t.Error("compressed beyond the concurrency limit")
+	}
+	finish()
+	if c.skippedBusy.Load() != 1 {
+		t.Errorf("skippedBusy = %d, want 1", c.skippedBusy.Load())
+	}
+
+	var disabled *responseCompressor
+	if w, _ := disabled.Start(rec, r, compressTestResponse("text/css", "", -1)); w != rec {
+		t.Error("nil compressor must pass through")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
+	"time"
 )
 
 // ServerConfig contains the server configuration
@@ -15,6 +17,9 @@ type ServerConfig struct {
 		CertPath string `json:"cert_path"`
 		KeyPath  string `json:"key_path"`
 		CAPath   string `json:"ca_path"`
+		// Revoked client certificates, re-read when the file changes
+		CRLPath          string `json:"crl_path"`
+		CRLReloadSeconds int    `json:"crl_reload_seconds"` // Time between checks for changes (default 300)
 	} `json:"certificates"`
 	Performance struct {
 		BufferSize         int  `json:"buffer_size"`          // 缓冲区大小，以字节为单位
@@ -22,15 +27,72 @@ type ServerConfig struct {
 		ReadBufferSize     int  `json:"read_buffer_size"`     // TCP读缓冲区大小
 		WriteBufferSize    int  `json:"write_buffer_size"`    // TCP写缓冲区大小
 		MaxConcurrentConns int  `json:"max_concurrent_conns"` // 最大并发连接数
-		EnableCompression  bool `json:"enable_compression"`   // 是否启用压缩
+		EnableCompression  bool `json:"enable_compression"`   // 是否对伪装站点的响应启用gzip压缩
 		NoDelay            bool `json:"no_delay"`             // 是否禁用Nagle算法
+		// Compression guardrails, only used with enable_compression
+		CompressionLevel          int `json:"compression_level"`           // gzip级别1-9（默认1）
+		CompressionMinSize        int `json:"compression_min_size"`        // 小于该字节数的响应不压缩（默认1024）
+		MaxConcurrentCompressions int `json:"max_concurrent_compressions"` // 同时压缩的响应数上限（默认CPU核数）
 	} `json:"performance"`
+	TLS            TLSProfileConfig     `json:"tls"`             // Handshake fingerprint, see TLSProfileConfig
+	SessionTickets SessionTicketsConfig `json:"session_tickets"` // Ticket key rotation
+	Fairness       FairnessConfig       `json:"fairness"`        // Weighted egress sharing between users
+	Multiplex      MultiplexConfig      `json:"multiplex"`       // Tunnels as HTTP/2 streams
+	OCSP           OCSPConfig           `json:"ocsp"`            // Stapling and client certificate status
+	SOCKS5         SOCKS5Config         `json:"socks5"`          // SOCKS5 listener for clients without CONNECT
+	ProxyAuth      ProxyAuthConfig      `json:"proxy_auth"`      // Basic logins answered with 407, for clients without certificates
+	Listener       struct {
+		HandshakeTimeout        int     `json:"handshake_timeout_seconds"` // TLS握手超时（默认10秒）
+		MaxConcurrentHandshakes int     `json:"max_concurrent_handshakes"` // 同时进行的握手上限（默认1024）
+		PerIPAcceptRate         float64 `json:"per_ip_accept_rate"`        // 每个来源IP每秒新建连接数，0为不限制
+		PerIPAcceptBurst        int     `json:"per_ip_accept_burst"`       // 每个来源IP的突发连接数
+		QueueSize               int     `json:"queue_size"`                // 超过max_concurrent_conns后排队等待的连接数上限，0为直接拒绝
+		QueueTimeoutMs          int     `json:"queue_timeout_ms"`          // 排队等待的最长时间（默认2000毫秒）
+		MaxHeaderBytes          int     `json:"max_header_bytes"`          // 请求行与请求头的字节上限（默认1MB）
+	} `json:"listener"`
+	// Addresses to listen on, e.g. a WireGuard interface IP; empty for
+	// every interface
+	BindAddresses []string `json:"bind_addresses"`
 }
 
 // ProxyConfig contains the proxy settings
 type ProxyConfig struct {
 	DefaultSite string `json:"default_site"`
 	Enabled     bool   `json:"enabled"`
+	// Client-supplied CONNECT tags recorded as a stats dimension
+	Tags struct {
+		Header  string   `json:"header"`  // Request header carrying the tag (default X-Proxy-Tag)
+		Allowed []string `json:"allowed"` // Accepted tags (glob patterns); empty disables tagging
+	} `json:"tags"`
+	// Tunnels that outlive the client certificate that opened them
+	CertExpiry struct {
+		Terminate    bool `json:"terminate"`     // Close tunnels once the certificate expired
+		GraceSeconds int  `json:"grace_seconds"` // Time after expiry before closing
+	} `json:"cert_expiry"`
+	// Protocols selected users may carry through their tunnels
+	Protocols ProtocolsConfig `json:"protocols"`
+	// Page shown to browsers whose request a policy rule denied
+	BlockPage BlockPageConfig `json:"block_page"`
+	// Compressed tunnels for clients that ask for them
+	TunnelCompression TunnelCompressionConfig `json:"tunnel_compression"`
+	// Open tunnels saved periodically, to list after a crash
+	TunnelCheckpoint TunnelCheckpointConfig `json:"tunnel_checkpoint"`
+	// Bytes a single tunnel may carry before it is closed
+	TunnelTransferLimit TunnelTransferLimitConfig `json:"tunnel_transfer_limit"`
+	// Client addresses disclosed to the camouflage site
+	ForwardedFor ForwardedForConfig `json:"forwarded_for"`
+	// Egress routes for groups of domains, e.g. region-locked streaming
+	Routes []EgressRouteConfig `json:"routes"`
+	// Health checks of default_site, with a static fallback while it is down
+	CamouflageHealth CamouflageHealthConfig `json:"camouflage_health"`
+	// Response size and per-address bandwidth of the camouflage site
+	CamouflageLimits CamouflageLimitsConfig `json:"camouflage_limits"`
+	// Bandwidth each user's tunnels share, per direction
+	RateLimit UserRateLimitConfig `json:"rate_limit"`
+	// Limits of the users whose certificate has OU=tier-<name>, by name
+	Tiers map[string]TierConfig `json:"tiers"`
+	// Allow and deny rules for target hosts, global and per user
+	ACL ACLConfig `json:"acl"`
 }
 
 // StatsConfig contains statistics settings
@@ -40,10 +102,42 @@ type StatsConfig struct {
 	DBPath        string `json:"db_path"`             // SQLite database path
 	SavePeriod    int    `json:"save_period_seconds"` // Legacy; now controls flush interval
 	FlushInterval int    `json:"flush_interval_seconds"`
-	Retention     struct {
+	// ReadOnly serves queries from an existing database without writing to
+	// it, e.g. a viewer instance on a replicated file; see also
+	// POST /api/v2/storage to pause writes at runtime
+	ReadOnly bool `json:"read_only"`
+	// Memory bounds: least recently active entries are flushed and evicted
+	MaxUsersInMemory int `json:"max_users_in_memory"` // Legacy stats manager users (default 10000)
+	MaxBufferEntries int `json:"max_buffer_entries"`  // Collector aggregation buckets (default 5000)
+	Retention        struct {
 		MinuteStatsDays int `json:"minute_stats_days"`
 		HourlyStatsDays int `json:"hourly_stats_days"`
+		// Size cap for the SQLite file; oldest minute rows, then domain rows of
+		// inactive users, are pruned when exceeded (0 disables)
+		MaxDBSizeMB int `json:"max_db_size_mb"`
 	} `json:"retention"`
+	// Guardrails for reads; results cut short are flagged partial
+	Query struct {
+		TimeoutSeconds int `json:"timeout_seconds"` // Per query (default 30)
+		MaxRows        int `json:"max_rows"`        // Per query (default 100000)
+	} `json:"query"`
+	// Bound on the last flush at shutdown; what is not written by then is
+	// spilled to <db_path>.spill.json and written on the next start
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds"` // default 10
+	// Open tunnels report their traffic every so often instead of only at
+	// close, so dashboards keep up with long downloads (0 disables)
+	TunnelReportSeconds int `json:"tunnel_report_seconds"`
+	// Throughput of large tunnels over time, for the user detail page
+	TunnelSamples TunnelSamplesConfig `json:"tunnel_samples"`
+	// Complete months of aggregates moved to S3-compatible storage
+	Archive StatsArchiveConfig `json:"archive"`
+}
+
+// NodeConfig identifies this proxy instance in stats shared with, or merged
+// with, other instances
+type NodeConfig struct {
+	Name   string            `json:"name"`   // Defaults to the host name
+	Labels map[string]string `json:"labels"` // Free-form, e.g. {"region": "eu-west"}
 }
 
 // GeoIPConfig contains GeoIP lookup settings
@@ -61,22 +155,67 @@ type AdminConfig struct {
 		Web bool `json:"web"`
 		API bool `json:"api"`
 	} `json:"interfaces"`
-	Certificates *struct {
+	GRPC struct {
+		Enabled bool `json:"enabled"`
+		Port    int  `json:"port"`
+	} `json:"grpc"`
+	APITokens []APITokenConfig `json:"api_tokens"` // Bearer tokens with scopes, for automation without a client certificate
+	// Key of the pseudonyms shown to stats:pseudonymized holders (random per
+	// process if unset, so pseudonyms then change on restart)
+	PseudonymSecret string `json:"pseudonym_secret"`
+	Certificates    *struct {
 		// Admin panel can specify its own certificate configuration
 		// If not specified, it will use the server's certificates
 		CertPath string `json:"cert_path"`
 		KeyPath  string `json:"key_path"`
 		CAPath   string `json:"ca_path"`
 	} `json:"certificates,omitempty"`
+	// Addresses the admin panel and gRPC server listen on; empty for every
+	// interface
+	BindAddresses []string `json:"bind_addresses"`
+	// Security headers of admin responses
+	Security AdminSecurityConfig `json:"security"`
+}
+
+// MaintenanceConfig contains the maintenance mode settings
+type MaintenanceConfig struct {
+	Message     string              `json:"message"`             // Body of the 503 sent to blocked clients
+	ExemptUsers []string            `json:"exempt_users"`        // Users or CN patterns ("ops-*") that may connect during maintenance
+	RetryAfter  int                 `json:"retry_after_seconds"` // Retry-After header value (default 300)
+	Windows     []MaintenanceWindow `json:"windows"`             // Scheduled maintenance periods
+}
+
+// ConfigBackupsConfig contains the config version history settings
+type ConfigBackupsConfig struct {
+	Dir         string `json:"dir"`          // Backup directory (default config_backups next to the config file)
+	MaxVersions int    `json:"max_versions"` // Versions kept (default 50)
 }
 
 // Config represents the application configuration
 type Config struct {
-	Server ServerConfig `json:"server"`
-	Proxy  ProxyConfig  `json:"proxy"`
-	Stats  StatsConfig  `json:"stats"`
-	Admin  AdminConfig  `json:"admin"`
-	GeoIP  GeoIPConfig  `json:"geoip"`
+	Server        ServerConfig        `json:"server"`
+	Proxy         ProxyConfig         `json:"proxy"`
+	Stats         StatsConfig         `json:"stats"`
+	Admin         AdminConfig         `json:"admin"`
+	GeoIP         GeoIPConfig         `json:"geoip"`
+	Reputation    ReputationConfig    `json:"reputation"`
+	DNSBL         DNSBLConfig         `json:"dnsbl"`
+	Gate          GateConfig          `json:"gate"`
+	I18n          I18nConfig          `json:"i18n"`
+	Node          NodeConfig          `json:"node"`
+	Maintenance   MaintenanceConfig   `json:"maintenance"`
+	ServingHours  ServingHoursConfig  `json:"serving_hours"`
+	UserExpiry    UserExpiryConfig    `json:"user_expiry"`
+	Trials        TrialConfig         `json:"trials"`
+	Provisioning  ProvisioningConfig  `json:"provisioning"`
+	ConfigBackups ConfigBackupsConfig `json:"config_backups"`
+	Secrets       SecretsConfig       `json:"secrets"` // Where env:, file: and vault: references are resolved
+	AccessLog     AccessLogConfig     `json:"access_log"`
+	// Policies that members inherit, by group name
+	Groups map[string]GroupConfig `json:"groups"`
+
+	path string       // base config file the configuration was loaded from
+	mu   sync.RWMutex // guards the settings changed at runtime, see SettingsUpdater
 }
 
 // LoadConfig loads the configuration from a file
@@ -90,6 +229,19 @@ func LoadConfig() (*Config, error) {
 	adminEnabled := flag.Bool("admin", false, "Enable admin panel (overrides config file)")
 	adminPort := flag.Int("admin-port", 0, "Admin panel port (overrides config file)")
 	language := flag.String("language", "", "Admin panel language (en/zh)")
+	profile := flag.String("profile", "", "Config profile to layer over the base config, e.g. prod loads config.prod.json (or set "+ProfileEnvVar+")")
+	printEffective := flag.Bool("print-effective-config", false, "Print the merged configuration with the source of each field and exit")
+	setup := flag.Bool("setup", false, "Run first-run setup: generate certificates, write a starter config, and initialise the stats database")
+	setupDir := flag.String("setup-dir", "", "Certificate output directory for -setup (default ./certs)")
+	setupHost := flag.String("setup-host", "", "Server hostname or IP for -setup certificates")
+	setupClient := flag.String("setup-client", "", "First client username (certificate CN) for -setup")
+	setupSite := flag.String("setup-default-site", "", "Camouflage site written by -setup")
+	setupYes := flag.Bool("setup-yes", false, "Accept defaults for every -setup question (non-interactive)")
+	setupForce := flag.Bool("setup-force", false, "Allow -setup to overwrite existing certificates and config")
+	serviceAction := flag.String("service", "", "Manage the system service: install, uninstall, start, stop (Windows/macOS), or plist to print a launchd definition")
+	mergeDB := flag.String("merge-db", "", "Merge another instance's stats database into stats.db_path and exit, e.g. when retiring a node")
+	importCerts := flag.String("import-certs", "", "Import the client certificates of a PEM bundle or directory into the stats database's inventory and exit")
+	doctor := flag.Bool("doctor", false, "Check certificates, config, GeoIP and stats databases, print a pass/warn/fail report and exit (1 if a check fails)")
 
 	flag.Parse()
 
@@ -103,40 +255,83 @@ func LoadConfig() (*Config, error) {
 		os.Exit(0)
 	}
 
-	// Load the configuration file
-	data, err := os.ReadFile(*configPath)
+	if *setup {
+		err := RunSetup(SetupOptions{
+			ConfigPath:     *configPath,
+			CertDir:        *setupDir,
+			Host:           *setupHost,
+			ClientCN:       *setupClient,
+			DefaultSite:    *setupSite,
+			Port:           *serverPort,
+			AdminPort:      *adminPort,
+			AssumeDefaults: *setupYes,
+			Force:          *setupForce,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Setup failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *serviceAction != "" {
+		if err := ControlService(*serviceAction, *configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Service %s failed: %v\n", *serviceAction, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *profile == "" {
+		*profile = os.Getenv(ProfileEnvVar)
+	}
+
+	// Load the configuration file, layering the profile on top
+	layers, err := loadConfigLayers(*configPath, *profile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(layers.merged)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %v", err)
+		return nil, fmt.Errorf("failed to merge config layers: %v", err)
 	}
 
 	var cfg Config
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %v", err)
 	}
+	cfg.path = *configPath
 
 	// Override configuration with command line arguments if provided
+	flagSources := make(map[string]string)
 	if *serverPort > 0 {
 		cfg.Server.Port = *serverPort
+		flagSources["server.port"] = "port"
 	}
 
 	if *statsEnabled {
 		cfg.Stats.Enabled = true
+		flagSources["stats.enabled"] = "stats"
 	}
 
 	if *statsPath != "" {
 		cfg.Stats.FilePath = *statsPath
+		flagSources["stats.file_path"] = "stats-path"
 	}
 
 	if *adminEnabled {
 		cfg.Admin.Enabled = true
+		flagSources["admin.enabled"] = "admin"
 	}
 
 	if *adminPort > 0 {
 		cfg.Admin.Port = *adminPort
+		flagSources["admin.port"] = "admin-port"
 	}
 
 	if *language != "" {
 		cfg.Admin.Language = *language
+		flagSources["admin.language"] = "language"
 	}
 
 	// Set default values if not specified
@@ -149,6 +344,10 @@ func LoadConfig() (*Config, error) {
 		cfg.Admin.Port = 9444 // Default port 9444
 	}
 
+	if cfg.Admin.GRPC.Enabled && cfg.Admin.GRPC.Port == 0 {
+		cfg.Admin.GRPC.Port = 9445 // Default port 9445
+	}
+
 	if cfg.Admin.Enabled && !cfg.Admin.Interfaces.Web && !cfg.Admin.Interfaces.API {
 		// Default enable web interface
 		cfg.Admin.Interfaces.Web = true
@@ -177,9 +376,78 @@ func LoadConfig() (*Config, error) {
 		cfg.Stats.Retention.HourlyStatsDays = 90
 	}
 
+	if *mergeDB != "" {
+		dbPath := cfg.Stats.DBPath
+		if dbPath == "" {
+			dbPath = "./stats/proxy_stats.db"
+		}
+		if err := MergeStatsDB(dbPath, *mergeDB); err != nil {
+			fmt.Fprintf(os.Stderr, "Merge failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *importCerts != "" {
+		dbPath := cfg.Stats.DBPath
+		if dbPath == "" {
+			dbPath = "./stats/proxy_stats.db"
+		}
+		if err := ImportCertsCLI(&cfg, dbPath, *importCerts); err != nil {
+			fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *printEffective {
+		if err := printEffectiveConfig(os.Stdout, &cfg, layers, flagSources); err != nil {
+			return nil, fmt.Errorf("failed to print effective config: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if *profile != "" {
+		log.Printf("Using config profile %q", *profile)
+	}
+	for _, w := range cfg.deprecationWarnings() {
+		log.Printf("Config warning: %s", w)
+	}
+
+	secrets.Configure(cfg.Secrets)
+	if err := cfg.checkSecrets(); err != nil {
+		return nil, fmt.Errorf("failed to resolve secret: %v", err)
+	}
+
+	if *doctor {
+		report := RunDiagnostics(&cfg, nil, time.Now())
+		report.Print(os.Stdout)
+		if report.Status == DiagFail {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	return &cfg, nil
 }
 
+// deprecationWarnings lists settings that still work but are on their way
+// out, with what to use instead
+func (cfg *Config) deprecationWarnings() []string {
+	var warnings []string
+	if cfg.Stats.FilePath != "" {
+		if cfg.Stats.Enabled {
+			warnings = append(warnings, "stats.file_path (-stats-path) is deprecated: the JSON stats file is imported into the SQLite database (stats.db_path) once and will stop being written in a future release; tooling that reads it can use /api/v2/export/legacy-json")
+		} else {
+			warnings = append(warnings, "stats.file_path (-stats-path) has no effect while stats.enabled is false; enable stats to use the SQLite database")
+		}
+	}
+	if cfg.Stats.SavePeriod > 0 {
+		warnings = append(warnings, "stats.save_period_seconds is deprecated, use stats.flush_interval_seconds")
+	}
+	return warnings
+}
+
 // GetAdminCertificates returns certificate paths for admin panel
 func (cfg *Config) GetAdminCertificates() (certPath, keyPath, caPath string) {
 	// If admin panel doesn't have its own certificate configuration, use the server's
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for the config backup history
+const (
+	defaultConfigBackupVersions = 50
+	configBackupTimeLayout      = "20060102T150405.000Z"
+)
+
+// configSecretField matches the string settings of a config file that hold
+// a secret, or a hash an attacker could brute-force, with their values
+var configSecretField = regexp.MustCompile(`("(?:secret_access_key|token_sha256|password_sha256|password_bcrypt|token_secret|pseudonym_secret|token)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// redactConfig replaces the values of secret settings in a config file,
+// leaving its layout as it was so diffs still line up
+func redactConfig(data []byte) []byte {
+	return configSecretField.ReplaceAll(data, []byte(`${1}"<redacted>"`))
+}
+
+// ConfigVersion is one saved copy of the config file
+type ConfigVersion struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// ConfigDiffLine is one line of a line-based diff. Op is " " for unchanged
+// lines, "-" for lines only in the old version and "+" for lines only in the
+// new one.
+type ConfigDiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// ConfigHistory keeps timestamped copies of the config file in a backups
+// directory. A copy is only written when the content differs from the newest
+// one, and the oldest copies beyond the configured limit are removed.
+type ConfigHistory struct {
+	mu          sync.Mutex
+	path        string // the base config file
+	dir         string
+	maxVersions int
+}
+
+// NewConfigHistory returns nil when the config was not loaded from a file
+func NewConfigHistory(config *Config) *ConfigHistory {
+	if config.path == "" {
+		return nil
+	}
+	h := &ConfigHistory{
+		path:        config.path,
+		dir:         config.ConfigBackups.Dir,
+		maxVersions: config.ConfigBackups.MaxVersions,
+	}
+	if h.dir == "" {
+		h.dir = filepath.Join(filepath.Dir(config.path), "config_backups")
+	}
+	if h.maxVersions <= 0 {
+		h.maxVersions = defaultConfigBackupVersions
+	}
+	return h
+}
+
+// Snapshot backs up the current config file if it changed since the newest
+// backup. It is called at startup so edits made by hand are captured too.
+func (h *ConfigHistory) Snapshot(actor string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return err
+	}
+	return h.backupLocked(data, actor)
+}
+
+// Write replaces the config file with data and backs up the new version
+func (h *ConfigHistory) Write(data []byte, actor string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.writeLocked(data, actor)
+}
+
+func (h *ConfigHistory) writeLocked(data []byte, actor string) error {
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+	return h.backupLocked(data, actor)
+}
+
+func (h *ConfigHistory) backupLocked(data []byte, actor string) error {
+	versions, err := h.listLocked()
+	if err != nil {
+		return err
+	}
+	if len(versions) > 0 {
+		latest, err := os.ReadFile(h.versionPath(versions[0].ID))
+		if err == nil && bytes.Equal(latest, data) {
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create config backup directory: %v", err)
+	}
+	now := time.Now().UTC()
+	id := now.Format(configBackupTimeLayout)
+	for _, v := range versions {
+		if v.ID == id {
+			// Two saves within the same millisecond
+			now = now.Add(time.Millisecond)
+			id = now.Format(configBackupTimeLayout)
+		}
+	}
+	if err := os.WriteFile(h.versionPath(id), data, 0600); err != nil {
+		return fmt.Errorf("failed to write config backup: %v", err)
+	}
+	log.Printf("Config version %s saved (%s)", id, actor)
+
+	versions = append([]ConfigVersion{{ID: id}}, versions...)
+	for _, v := range versions[min(len(versions), h.maxVersions):] {
+		os.Remove(h.versionPath(v.ID))
+	}
+	return nil
+}
+
+// List returns the saved versions, newest first
+func (h *ConfigHistory) List() ([]ConfigVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.listLocked()
+}
+
+func (h *ConfigHistory) listLocked() ([]ConfigVersion, error) {
+	entries, err := os.ReadDir(h.dir)
+	if os.IsNotExist(err) {
+		return []ConfigVersion{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions := []ConfigVersion{}
+	for _, e := range entries {
+		id, ok := configVersionID(e.Name())
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(configBackupTimeLayout, id)
+		if err != nil {
+			continue
+		}
+		v := ConfigVersion{ID: id, Time: t}
+		if info, err := e.Info(); err == nil {
+			v.Size = info.Size()
+		}
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Time.After(versions[j].Time) })
+	return versions, nil
+}
+
+// Read returns the content of a saved version
+func (h *ConfigHistory) Read(id string) ([]byte, error) {
+	if _, err := time.Parse(configBackupTimeLayout, id); err != nil {
+		return nil, fmt.Errorf("invalid version id %q", id)
+	}
+	return os.ReadFile(h.versionPath(id))
+}
+
+// Diff compares a saved version with the current config file, with secret
+// values redacted from both
+func (h *ConfigHistory) Diff(id string) ([]ConfigDiffLine, error) {
+	old, err := h.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	current, err := os.ReadFile(h.path)
+	h.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return diffLines(string(redactConfig(old)), string(redactConfig(current))), nil
+}
+
+// Rollback restores a saved version as the config file. The restored content
+// is recorded as a new version so the rollback itself can be undone.
+func (h *ConfigHistory) Rollback(id, actor string) error {
+	data, err := h.Read(id)
+	if err != nil {
+		return err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("version %s is not a valid config: %v", id, err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Keep whatever is on disk now, even if it was edited by hand
+	if current, err := os.ReadFile(h.path); err == nil {
+		if err := h.backupLocked(current, actor); err != nil {
+			return err
+		}
+	}
+	if err := h.writeLocked(data, actor+" rollback to "+id); err != nil {
+		return err
+	}
+	changeFeed.Publish(ChangeEvent{Type: ChangeConfig, Actor: actor, Detail: "restored version " + id})
+	return nil
+}
+
+func (h *ConfigHistory) versionPath(id string) string {
+	return filepath.Join(h.dir, "config-"+id+".json")
+}
+
+func configVersionID(filename string) (string, bool) {
+	id, ok := strings.CutPrefix(filename, "config-")
+	if !ok {
+		return "", false
+	}
+	return strings.CutSuffix(id, ".json")
+}
+
+// diffLines returns a line diff of a and b based on their longest common
+// subsequence. Config files are small, so the quadratic table is fine.
+func diffLines(a, b string) []ConfigDiffLine {
+	x := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	y := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+
+	// lcs[i][j] is the LCS length of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	diff := make([]ConfigDiffLine, 0, max(len(x), len(y)))
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			diff = append(diff, ConfigDiffLine{Op: " ", Text: x[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, ConfigDiffLine{Op: "-", Text: x[i]})
+			i++
+		default:
+			diff = append(diff, ConfigDiffLine{Op: "+", Text: y[j]})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		diff = append(diff, ConfigDiffLine{Op: "-", Text: x[i]})
+	}
+	for ; j < len(y); j++ {
+		diff = append(diff, ConfigDiffLine{Op: "+", Text: y[j]})
+	}
+	return diff
+}
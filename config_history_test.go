@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestConfigHistory(t *testing.T, maxVersions int) (*ConfigHistory, string) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &Config{path: filepath.Join(dir, "config.json")}
+	cfg.ConfigBackups.MaxVersions = maxVersions
+	if err := os.WriteFile(cfg.path, []byte("{\n  \"proxy\": {}\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return NewConfigHistory(cfg), cfg.path
+}
+
+func TestConfigHistory_SnapshotOnlyOnChange(t *testing.T) {
+	h, path := newTestConfigHistory(t, 0)
+
+	for i := 0; i < 2; i++ {
+		if err := h.Snapshot("startup"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, _ := h.List()
+	if len(versions) != 1 {
+		t.Fatalf("unchanged file should be saved once, got %d versions", len(versions))
+	}
+
+	// A hand edit is picked up by the next snapshot
+	os.WriteFile(path, []byte("{\n  \"proxy\": {\"default_site\": \"https://example.com\"}\n}\n"), 0644)
+	h.Snapshot("startup")
+	versions, _ = h.List()
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions after edit, got %d", len(versions))
+	}
+	if !versions[0].Time.After(versions[1].Time) {
+		t.Errorf("versions should be newest first: %+v", versions)
+	}
+}
+
+func TestConfigHistory_Prune(t *testing.T) {
+	h, _ := newTestConfigHistory(t, 2)
+	for _, site := range []string{"a", "b", "c"} {
+		if err := h.Write([]byte(`{"proxy": {"default_site": "`+site+`"}}`), "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, _ := h.List()
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions kept, got %d", len(versions))
+	}
+	data, _ := h.Read(versions[1].ID)
+	if string(data) != `{"proxy": {"default_site": "b"}}` {
+		t.Errorf("oldest kept version = %s", data)
+	}
+}
+
+func TestConfigHistory_RollbackAndDiff(t *testing.T) {
+	h, path := newTestConfigHistory(t, 0)
+	h.Snapshot("startup")
+	original, _ := h.List()
+
+	h.Write([]byte("{\n  \"proxy\": {\"default_site\": \"https://example.com\"}\n}\n"), "test")
+
+	diff, err := h.Diff(original[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var added, removed int
+	for _, l := range diff {
+		switch l.Op {
+		case "+":
+			added++
+		case "-":
+			removed++
+		}
+	}
+	if added != 1 || removed != 1 || len(diff) != 4 {
+		t.Errorf("unexpected diff: %+v", diff)
+	}
+
+	if err := h.Rollback(original[0].ID, "test"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "{\n  \"proxy\": {}\n}\n" {
+		t.Errorf("config after rollback = %q", data)
+	}
+	versions, _ := h.List()
+	if len(versions) != 3 {
+		t.Errorf("rollback should be recorded as a new version, got %d versions", len(versions))
+	}
+
+	// Versions that are not valid configs are refused
+	os.WriteFile(h.versionPath("20200101T000000.000Z"), []byte("not json"), 0600)
+	if err := h.Rollback("20200101T000000.000Z", "test"); err == nil {
+		t.Error("expected rollback of an invalid config to fail")
+	}
+	if _, err := h.Read("../config"); err == nil {
+		t.Error("expected invalid version id to be rejected")
+	}
+}
+
+func TestV2API_ConfigHistory(t *testing.T) {
+	h, _ := newTestConfigHistory(t, 0)
+	h.Snapshot("startup")
+	h.Write([]byte(`{"proxy": {"default_site": "https://example.com"}, "stats": {"archive": {"secret_access_key": "s3cr\"et"}}}`), "test")
+
+	mux := http.NewServeMux()
+	registerV2API(mux, &Config{}, nil, nil, nil, h)
+
+	req := httptest.NewRequest("GET", "/api/v2/config/history", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var list struct {
+		Success bool            `json:"success"`
+		Data    []ConfigVersion `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&list)
+	if !list.Success || len(list.Data) != 2 {
+		t.Fatalf("expected 2 versions, got %+v", list)
+	}
+	oldest := list.Data[1].ID
+
+	req = httptest.NewRequest("GET", "/api/v2/config/history/"+oldest, nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	// Secrets are redacted from versions and diffs
+	if body := w.Body.String(); strings.Contains(body, "s3cr") || !strings.Contains(body, "redacted") {
+		t.Errorf("secret not redacted from the diff: %s", body)
+	}
+	req = httptest.NewRequest("GET", "/api/v2/config/history/"+list.Data[0].ID, nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	var version struct {
+		Data struct {
+			Content string `json:"content"`
+		} `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&version)
+	if want := `{"proxy": {"default_site": "https://example.com"}, "stats": {"archive": {"secret_access_key": "<redacted>"}}}`; version.Data.Content != want {
+		t.Errorf("content = %s, want %s", version.Data.Content, want)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v2/config/history/"+oldest+"/rollback", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET rollback, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/api/v2/config/history/"+oldest+"/rollback", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/v2/config/history/20200101T000000.000Z", nil)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown version, got %d", w.Code)
+	}
+}
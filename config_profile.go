@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ProfileEnvVar selects a config profile when -profile is not given
+const ProfileEnvVar = "HTTPS_PROXY_PROFILE"
+
+// configLayers holds the deep-merged raw configuration together with the
+// source of every leaf value, used to annotate -print-effective-config.
+type configLayers struct {
+	merged  map[string]interface{}
+	sources map[string]string // dotted path -> source description
+}
+
+// validateProfileName rejects profile names that could point outside the
+// base config's directory, e.g. "../../etc/x"
+func validateProfileName(profile string) error {
+	if strings.ContainsAny(profile, `/\`) || strings.Contains(profile, "..") || filepath.Base(profile) != profile {
+		return fmt.Errorf("invalid profile name %q: must not contain path separators or \"..\"", profile)
+	}
+	return nil
+}
+
+// profileConfigPath returns the profile file that sits next to the base
+// config, e.g. config.json + "prod" -> config.prod.json.
+func profileConfigPath(basePath, profile string) string {
+	ext := filepath.Ext(basePath)
+	return strings.TrimSuffix(basePath, ext) + "." + profile + ext
+}
+
+// loadConfigLayers reads the base config and, if profile is non-empty, deep
+// merges the profile file on top of it. Objects are merged key by key;
+// scalars and arrays in the profile replace the base value.
+func loadConfigLayers(basePath, profile string) (*configLayers, error) {
+	layers := &configLayers{
+		merged:  make(map[string]interface{}),
+		sources: make(map[string]string),
+	}
+
+	base, err := readConfigLayer(basePath)
+	if err != nil {
+		return nil, err
+	}
+	mergeConfigLayer(layers.merged, base, "", basePath, layers.sources)
+
+	if profile != "" {
+		if err := validateProfileName(profile); err != nil {
+			return nil, err
+		}
+		profilePath := profileConfigPath(basePath, profile)
+		overlay, err := readConfigLayer(profilePath)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %v", profile, err)
+		}
+		mergeConfigLayer(layers.merged, overlay, "", "profile "+profilePath, layers.sources)
+	}
+	return layers, nil
+}
+
+func readConfigLayer(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	var layer map[string]interface{}
+	if err := json.Unmarshal(data, &layer); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return layer, nil
+}
+
+// mergeConfigLayer deep merges src into dst, recording source for every leaf
+// path it sets.
+func mergeConfigLayer(dst, src map[string]interface{}, prefix, source string, sources map[string]string) {
+	for key, srcVal := range src {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+
+		srcMap, srcIsMap := srcVal.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			mergeConfigLayer(dstMap, srcMap, path, source, sources)
+			continue
+		}
+
+		// Replacing a subtree drops the sources recorded beneath it
+		for p := range sources {
+			if strings.HasPrefix(p, path+".") {
+				delete(sources, p)
+			}
+		}
+		if srcIsMap {
+			dstMap = make(map[string]interface{})
+			dst[key] = dstMap
+			mergeConfigLayer(dstMap, srcMap, path, source, sources)
+			continue
+		}
+		dst[key] = srcVal
+		sources[path] = source
+	}
+}
+
+// flattenConfig converts a config value into dotted leaf paths and values
+func flattenConfig(v interface{}, prefix string, out map[string]interface{}) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		if prefix != "" {
+			out[prefix] = v
+		}
+		return
+	}
+	for key, val := range m {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		flattenConfig(val, path, out)
+	}
+}
+
+// printEffectiveConfig writes every effective setting with the layer it came
+// from: the base file, the profile file, a command line flag, or a default.
+func printEffectiveConfig(w io.Writer, cfg *Config, layers *configLayers, flagSources map[string]string) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	var effective map[string]interface{}
+	if err := json.Unmarshal(data, &effective); err != nil {
+		return err
+	}
+
+	values := make(map[string]interface{})
+	flattenConfig(effective, "", values)
+	fileValues := make(map[string]interface{})
+	flattenConfig(layers.merged, "", fileValues)
+
+	paths := make([]string, 0, len(values))
+	for p := range values {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, p := range paths {
+		val, _ := json.Marshal(values[p])
+
+		source := "default"
+		if flag, ok := flagSources[p]; ok {
+			source = "flag -" + flag
+		} else if src, ok := layers.sources[p]; ok {
+			fileVal, _ := json.Marshal(fileValues[p])
+			if string(fileVal) == string(val) {
+				source = src
+			}
+		}
+		fmt.Fprintf(tw, "%s\t= %s\t# %s\n", p, val, source)
+	}
+	return tw.Flush()
+}
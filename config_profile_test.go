@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigLayers_DeepMerge(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "config.json")
+	os.WriteFile(base, []byte(`{"server":{"port":9443,"performance":{"no_delay":true,"buffer_size":1024}},"proxy":{"default_site":"https://a.example"}}`), 0644)
+	os.WriteFile(filepath.Join(dir, "config.prod.json"), []byte(`{"server":{"performance":{"no_delay":false}},"proxy":{"default_site":"https://b.example"}}`), 0644)
+
+	layers, err := loadConfigLayers(base, "prod")
+	if err != nil {
+		t.Fatalf("loadConfigLayers: %v", err)
+	}
+
+	values := make(map[string]interface{})
+	flattenConfig(layers.merged, "", values)
+
+	if values["server.port"] != float64(9443) {
+		t.Errorf("server.port = %v, want 9443 from base", values["server.port"])
+	}
+	if values["server.performance.buffer_size"] != float64(1024) {
+		t.Errorf("buffer_size = %v, want 1024 kept from base", values["server.performance.buffer_size"])
+	}
+	if values["server.performance.no_delay"] != false {
+		t.Errorf("no_delay = %v, want false from profile", values["server.performance.no_delay"])
+	}
+	if values["proxy.default_site"] != "https://b.example" {
+		t.Errorf("default_site = %v, want profile value", values["proxy.default_site"])
+	}
+
+	if src := layers.sources["server.port"]; src != base {
+		t.Errorf("server.port source = %q, want %q", src, base)
+	}
+	if src := layers.sources["server.performance.no_delay"]; src != "profile "+filepath.Join(dir, "config.prod.json") {
+		t.Errorf("no_delay source = %q, want profile file", src)
+	}
+}
+
+func TestLoadConfigLayers_MissingProfile(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "config.json")
+	os.WriteFile(base, []byte(`{}`), 0644)
+
+	if _, err := loadConfigLayers(base, "staging"); err == nil {
+		t.Fatal("expected error for missing profile file")
+	}
+}
+
+func TestLoadConfigLayers_RejectsPathProfiles(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "sub", "config.json")
+	os.MkdirAll(filepath.Dir(base), 0755)
+	os.WriteFile(base, []byte(`{}`), 0644)
+	// A file outside the config directory that traversal would reach
+	os.WriteFile(filepath.Join(dir, "x.json"), []byte(`{}`), 0644)
+
+	for _, profile := range []string{"../x", "..", "a/b", `a\b`, "prod/../../x"} {
+		if _, err := loadConfigLayers(base, profile); err == nil || !strings.Contains(err.Error(), "invalid profile name") {
+			t.Errorf("profile %q: got %v, want invalid profile name error", profile, err)
+		}
+	}
+	if err := validateProfileName("prod-eu_1"); err != nil {
+		t.Errorf("valid profile rejected: %v", err)
+	}
+}
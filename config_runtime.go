@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RuntimeSettings is the subset of the configuration that can be changed
+// while the proxy is running
+type RuntimeSettings struct {
+	DefaultSite     string `json:"default_site"`
+	FlushInterval   int    `json:"flush_interval_seconds"`
+	MinuteStatsDays int    `json:"minute_stats_days"`
+	HourlyStatsDays int    `json:"hourly_stats_days"`
+	GeoIPPath       string `json:"geoip_db_path"`
+}
+
+// RuntimeSettingsPatch is the body of PATCH /api/config. Omitted fields are
+// left unchanged; Persist also writes the changes to the config file.
+type RuntimeSettingsPatch struct {
+	DefaultSite     *string `json:"default_site,omitempty"`
+	FlushInterval   *int    `json:"flush_interval_seconds,omitempty"`
+	MinuteStatsDays *int    `json:"minute_stats_days,omitempty"`
+	HourlyStatsDays *int    `json:"hourly_stats_days,omitempty"`
+	GeoIPPath       *string `json:"geoip_db_path,omitempty"`
+	Persist         bool    `json:"persist,omitempty"`
+}
+
+// Limits for runtime settings
+const (
+	maxFlushIntervalSeconds = 3600
+	maxRetentionDays        = 3650
+)
+
+// errSettingsNotSaved is wrapped by Apply when the live settings changed but
+// writing them to the config file failed
+var errSettingsNotSaved = errors.New("settings applied but not saved")
+
+// SettingsUpdater applies runtime setting changes to the live configuration
+// and the components that cache them. The stats collector and GeoIP service
+// are nil when stats are disabled.
+type SettingsUpdater struct {
+	mu        sync.Mutex // serializes updates so persisted edits are not lost
+	config    *Config
+	history   *ConfigHistory
+	collector *StatsCollector
+	geoIP     *GeoIPService
+}
+
+// NewSettingsUpdater creates a settings updater
+func NewSettingsUpdater(config *Config, history *ConfigHistory, collector *StatsCollector, geoIP *GeoIPService) *SettingsUpdater {
+	return &SettingsUpdater{config: config, history: history, collector: collector, geoIP: geoIP}
+}
+
+// Current returns the live runtime settings
+func (u *SettingsUpdater) Current() RuntimeSettings {
+	cfg := u.config
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return RuntimeSettings{
+		DefaultSite:     cfg.Proxy.DefaultSite,
+		FlushInterval:   cfg.Stats.FlushInterval,
+		MinuteStatsDays: cfg.Stats.Retention.MinuteStatsDays,
+		HourlyStatsDays: cfg.Stats.Retention.HourlyStatsDays,
+		GeoIPPath:       cfg.GeoIP.DBPath,
+	}
+}
+
+// Apply validates every field of the patch before changing anything, then
+// updates the live configuration and, if requested, the config file
+func (u *SettingsUpdater) Apply(p RuntimeSettingsPatch, actor string) (RuntimeSettings, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if p.DefaultSite != nil {
+		site, err := validateDefaultSite(*p.DefaultSite)
+		if err != nil {
+			return RuntimeSettings{}, err
+		}
+		p.DefaultSite = &site
+	}
+	if p.FlushInterval != nil && (*p.FlushInterval < 1 || *p.FlushInterval > maxFlushIntervalSeconds) {
+		return RuntimeSettings{}, fmt.Errorf("flush_interval_seconds must be between 1 and %d", maxFlushIntervalSeconds)
+	}
+	for name, days := range map[string]*int{"minute_stats_days": p.MinuteStatsDays, "hourly_stats_days": p.HourlyStatsDays} {
+		if days != nil && (*days < 1 || *days > maxRetentionDays) {
+			return RuntimeSettings{}, fmt.Errorf("%s must be between 1 and %d", name, maxRetentionDays)
+		}
+	}
+	if p.GeoIPPath != nil && u.geoIP == nil {
+		return RuntimeSettings{}, fmt.Errorf("GeoIP is not enabled; enable it in the config file and restart")
+	}
+	if p.Persist && u.history == nil {
+		return RuntimeSettings{}, fmt.Errorf("the configuration was not loaded from a file and cannot be persisted")
+	}
+
+	// The GeoIP database is the only change that can fail; open it first
+	if p.GeoIPPath != nil {
+		if err := u.geoIP.Reload(*p.GeoIPPath); err != nil {
+			return RuntimeSettings{}, fmt.Errorf("failed to open GeoIP database: %v", err)
+		}
+	}
+	if p.FlushInterval != nil && u.collector != nil {
+		u.collector.SetFlushInterval(time.Duration(*p.FlushInterval) * time.Second)
+	}
+
+	cfg := u.config
+	cfg.mu.Lock()
+	var changed []string
+	if p.DefaultSite != nil {
+		cfg.Proxy.DefaultSite = *p.DefaultSite
+		changed = append(changed, "default_site")
+	}
+	if p.FlushInterval != nil {
+		cfg.Stats.FlushInterval = *p.FlushInterval
+		changed = append(changed, "flush_interval_seconds")
+	}
+	if p.MinuteStatsDays != nil {
+		cfg.Stats.Retention.MinuteStatsDays = *p.MinuteStatsDays
+		changed = append(changed, "minute_stats_days")
+	}
+	if p.HourlyStatsDays != nil {
+		cfg.Stats.Retention.HourlyStatsDays = *p.HourlyStatsDays
+		changed = append(changed, "hourly_stats_days")
+	}
+	if p.GeoIPPath != nil {
+		cfg.GeoIP.DBPath = *p.GeoIPPath
+		changed = append(changed, "geoip_db_path")
+	}
+	cfg.mu.Unlock()
+
+	if len(changed) > 0 {
+		log.Printf("Runtime settings changed by %s: %s", actor, strings.Join(changed, ", "))
+		changeFeed.Publish(ChangeEvent{Type: ChangeSettings, Actor: actor, Detail: strings.Join(changed, ", ")})
+	}
+	if p.Persist {
+		if err := u.persist(p, actor); err != nil {
+			return u.Current(), fmt.Errorf("%w: %v", errSettingsNotSaved, err)
+		}
+	}
+	return u.Current(), nil
+}
+
+// persist writes the patched fields into the base config file
+func (u *SettingsUpdater) persist(p RuntimeSettingsPatch, actor string) error {
+	return editConfigFile(u.config, u.history, actor, func(set func(value interface{}, keys ...string)) {
+		if p.DefaultSite != nil {
+			set(*p.DefaultSite, "proxy", "default_site")
+		}
+		if p.FlushInterval != nil {
+			set(*p.FlushInterval, "stats", "flush_interval_seconds")
+		}
+		if p.MinuteStatsDays != nil {
+			set(*p.MinuteStatsDays, "stats", "retention", "minute_stats_days")
+		}
+		if p.HourlyStatsDays != nil {
+			set(*p.HourlyStatsDays, "stats", "retention", "hourly_stats_days")
+		}
+		if p.GeoIPPath != nil {
+			set(*p.GeoIPPath, "geoip", "db_path")
+		}
+	})
+}
+
+// editConfigFile sets values in the base config file through history. The
+// file is edited as a JSON document so settings that only come from
+// defaults, profiles or flags are not written back.
+func editConfigFile(config *Config, history *ConfigHistory, actor string, edit func(set func(value interface{}, keys ...string))) error {
+	if history == nil {
+		return errors.New("the configuration was not loaded from a file and cannot be persisted")
+	}
+	data, err := os.ReadFile(config.path)
+	if err != nil {
+		return err
+	}
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config file: %v", err)
+	}
+
+	edit(func(value interface{}, keys ...string) {
+		m := doc
+		for _, k := range keys[:len(keys)-1] {
+			next, ok := m[k].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				m[k] = next
+			}
+			m = next
+		}
+		m[keys[len(keys)-1]] = value
+	})
+
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return history.Write(append(out, '\n'), actor)
+}
+
+// validateDefaultSite checks that site is an absolute http(s) URL without a
+// path and returns it without a trailing slash, since the request URI is
+// appended to it
+func validateDefaultSite(site string) (string, error) {
+	parsed, err := url.Parse(site)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("default_site must be an absolute http or https URL")
+	}
+	if strings.Trim(parsed.Path, "/") != "" || parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", fmt.Errorf("default_site must not contain a path, query or fragment")
+	}
+	return parsed.Scheme + "://" + parsed.Host, nil
+}
+
+// defaultSite returns the camouflage site
+func (cfg *Config) defaultSite() string {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.Proxy.DefaultSite
+}
+
+// retentionDays returns the minute and hourly stats retention
+func (cfg *Config) retentionDays() (minute, hourly int) {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.Stats.Retention.MinuteStatsDays, cfg.Stats.Retention.HourlyStatsDays
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSettingsUpdater_ApplyValidates(t *testing.T) {
+	cfg := &Config{}
+	cfg.Proxy.DefaultSite = "https://www.example.com"
+	cfg.Stats.FlushInterval = 30
+	u := NewSettingsUpdater(cfg, nil, nil, nil)
+
+	bad := []RuntimeSettingsPatch{
+		{DefaultSite: ptr("ftp://example.com")},
+		{DefaultSite: ptr("https://example.com/path")},
+		{DefaultSite: ptr("example.com")},
+		{FlushInterval: ptr(0)},
+		{MinuteStatsDays: ptr(5000)},
+		{GeoIPPath: ptr("/tmp/GeoLite2.mmdb")}, // GeoIP not enabled
+		{Persist: true},                        // no config file
+		// One invalid field rejects the whole patch
+		{FlushInterval: ptr(60), HourlyStatsDays: ptr(-1)},
+	}
+	for _, p := range bad {
+		if _, err := u.Apply(p, "test"); err == nil {
+			t.Errorf("expected %+v to be rejected", p)
+		}
+	}
+	if cfg.Stats.FlushInterval != 30 {
+		t.Errorf("rejected patch changed flush interval to %d", cfg.Stats.FlushInterval)
+	}
+
+	got, err := u.Apply(RuntimeSettingsPatch{DefaultSite: ptr("http://127.0.0.1:8080/"), MinuteStatsDays: ptr(3)}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DefaultSite != "http://127.0.0.1:8080" || cfg.defaultSite() != "http://127.0.0.1:8080" {
+		t.Errorf("default site = %q", got.DefaultSite)
+	}
+	if minute, _ := cfg.retentionDays(); minute != 3 {
+		t.Errorf("minute retention = %d, want 3", minute)
+	}
+}
+
+func TestSettingsUpdater_Persist(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	os.WriteFile(path, []byte(`{"server": {"port": 8443}, "stats": {"enabled": true, "retention": {"max_db_size_mb": 100}}}`), 0644)
+	cfg := &Config{path: path}
+	history := NewConfigHistory(cfg)
+	u := NewSettingsUpdater(cfg, history, nil, nil)
+
+	// Without persist the file is untouched
+	u.Apply(RuntimeSettingsPatch{FlushInterval: ptr(10)}, "test")
+	if versions, _ := history.List(); len(versions) != 0 {
+		t.Fatalf("expected no versions without persist, got %d", len(versions))
+	}
+
+	if _, err := u.Apply(RuntimeSettingsPatch{HourlyStatsDays: ptr(30), DefaultSite: ptr("https://example.org"), Persist: true}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	var saved Config
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.Server.Port != 8443 || saved.Stats.Retention.MaxDBSizeMB != 100 || !saved.Stats.Enabled {
+		t.Errorf("unrelated settings were lost: %s", data)
+	}
+	if saved.Stats.Retention.HourlyStatsDays != 30 || saved.Proxy.DefaultSite != "https://example.org" {
+		t.Errorf("patched settings not saved: %s", data)
+	}
+	// Only the patched fields are written, not the whole live config
+	if saved.Stats.FlushInterval != 0 {
+		t.Errorf("unpersisted flush interval was written: %s", data)
+	}
+	if versions, _ := history.List(); len(versions) != 1 {
+		t.Errorf("expected the saved file to be recorded as a version, got %d", len(versions))
+	}
+}
+
+func TestStatsCollector_SetFlushInterval(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	collector := NewStatsCollector(db, nil, 3600, 0)
+	defer collector.Stop()
+	collector.SetFlushInterval(100 * time.Millisecond)
+
+	collector.Record(TrafficEvent{Username: "alice", Domain: "example.com", Upload: 100, Timestamp: time.Now()})
+	time.Sleep(500 * time.Millisecond)
+
+	overview, err := db.GetOverview(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overview.TotalUpload != 100 {
+		t.Errorf("TotalUpload = %d, want 100 after the shortened interval", overview.TotalUpload)
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/x509"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TunnelInfo describes an open CONNECT tunnel
+type TunnelInfo struct {
+	ID         uint64 `json:"id"`
+	RequestID  string `json:"request_id"`
+	Username   string `json:"username"`
+	ClientAddr string `json:"client_addr"`
+	Target     string `json:"target"`
+	// Protocol is "socks5" for tunnels opened over the SOCKS5 listener
+	Protocol string `json:"protocol,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+	// Reputation is the feed match of a flagged destination
+	Reputation string `json:"reputation,omitempty"`
+	// Route is the proxy.routes entry the tunnel goes out through, if any
+	Route        string    `json:"route,omitempty"`
+	Started      time.Time `json:"started"`
+	CertNotAfter time.Time `json:"cert_not_after"`
+	// CertExpired is set once the client certificate has expired while the
+	// tunnel is still open
+	CertExpired bool `json:"cert_expired"`
+	// TerminateAt is when the tunnel will be closed for the expired
+	// certificate, if proxy.cert_expiry.terminate is on
+	TerminateAt *time.Time `json:"terminate_at,omitempty"`
+	// Bytes carried so far to and from the target
+	Upload   uint64 `json:"upload"`
+	Download uint64 `json:"download"`
+
+	counters func() (upload, download uint64)
+	samples  *throughputSamples
+}
+
+// tunnelRegistry tracks the open CONNECT tunnels
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	nextID  uint64
+	tunnels map[uint64]*TunnelInfo
+
+	// Checkpoints of the open tunnels, see StartCheckpoints
+	checkpointFile string
+	interrupted    []InterruptedTunnel
+
+	// Width of the throughput samples, see StartSampling; 0 while off
+	sampleInterval time.Duration
+}
+
+// tunnels is the process-wide registry of open tunnels
+var tunnels = newTunnelRegistry()
+
+func newTunnelRegistry() *tunnelRegistry {
+	reg := &tunnelRegistry{tunnels: make(map[uint64]*TunnelInfo)}
+	metrics.Gauge("https_proxy_open_tunnels", "CONNECT tunnels currently open", func() float64 {
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+		return float64(len(reg.tunnels))
+	})
+	metrics.Gauge("https_proxy_open_tunnels_cert_expired", "Open tunnels whose client certificate has expired", func() float64 {
+		return float64(len(reg.List(time.Now(), "", true)))
+	})
+	return reg
+}
+
+// Register adds a tunnel and returns its id
+func (reg *tunnelRegistry) Register(info TunnelInfo) uint64 {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.nextID++
+	info.ID = reg.nextID
+	reg.tunnels[info.ID] = &info
+	return info.ID
+}
+
+// Unregister removes a closed tunnel
+func (reg *tunnelRegistry) Unregister(id uint64) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.tunnels, id)
+}
+
+// setTerminateAt records when an open tunnel is going to be cut
+func (reg *tunnelRegistry) setTerminateAt(id uint64, at time.Time) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if t, ok := reg.tunnels[id]; ok {
+		t.TerminateAt = &at
+	}
+}
+
+// setCounters makes the tunnel's byte counts visible while it is open
+func (reg *tunnelRegistry) setCounters(id uint64, counters func() (upload, download uint64)) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if t, ok := reg.tunnels[id]; ok {
+		t.counters = counters
+		if reg.sampleInterval > 0 {
+			t.samples = newThroughputSamples(reg.sampleInterval)
+		}
+	}
+}
+
+// List returns the open tunnels at now, oldest first, optionally limited to
+// one user and to tunnels that outlived their client certificate
+func (reg *tunnelRegistry) List(now time.Time, username string, expiredOnly bool) []TunnelInfo {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	list := []TunnelInfo{}
+	for _, t := range reg.tunnels {
+		info := *t
+		info.CertExpired = !info.CertNotAfter.IsZero() && now.After(info.CertNotAfter)
+		if info.counters != nil {
+			info.Upload, info.Download = info.counters()
+		}
+		if (username != "" && info.Username != username) || (expiredOnly && !info.CertExpired) {
+			continue
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// watchCertExpiry closes a tunnel once its client certificate has been
+// expired for the configured grace period. It returns a function that stops
+// the watch when the tunnel ends on its own.
+func (p *Proxy) watchCertExpiry(id uint64, reqID, clientAddr string, cert *x509.Certificate, closeTunnel func()) (stop func()) {
+	cfg := p.Config.Proxy.CertExpiry
+	if !cfg.Terminate || cert.NotAfter.IsZero() {
+		return func() {}
+	}
+	at := cert.NotAfter.Add(time.Duration(cfg.GraceSeconds) * time.Second)
+	tunnels.setTerminateAt(id, at)
+	timer := time.AfterFunc(time.Until(at), func() {
+		log.Printf("[req %s] Closing tunnel %d (%s, CN: %s): client certificate expired at %s",
+			reqID, id, clientAddr, cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+		closeTunnel()
+	})
+	return func() { timer.Stop() }
+}
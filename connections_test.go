@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTunnelRegistry_ListExpired(t *testing.T) {
+	reg := newTunnelRegistry()
+	now := time.Now()
+	a := reg.Register(TunnelInfo{Username: "alice", Target: "example.com:443", CertNotAfter: now.Add(time.Hour)})
+	b := reg.Register(TunnelInfo{Username: "bob", Target: "example.org:443", CertNotAfter: now.Add(-time.Minute)})
+
+	if got := reg.List(now, "", false); len(got) != 2 || got[0].ID != a {
+		t.Fatalf("expected both tunnels oldest first, got %+v", got)
+	}
+	expired := reg.List(now, "", true)
+	if len(expired) != 1 || expired[0].ID != b || !expired[0].CertExpired {
+		t.Fatalf("expected only bob's tunnel as expired, got %+v", expired)
+	}
+	if got := reg.List(now, "alice", false); len(got) != 1 || got[0].CertExpired {
+		t.Errorf("unexpected tunnels for alice: %+v", got)
+	}
+
+	reg.Unregister(b)
+	if got := reg.List(now, "", true); len(got) != 0 {
+		t.Errorf("closed tunnel still listed: %+v", got)
+	}
+}
+
+func TestProxy_WatchCertExpiry(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, NotAfter: time.Now().Add(50 * time.Millisecond)}
+
+	// Off by default: tunnels are only flagged
+	p := &Proxy{Config: &Config{}}
+	closed := make(chan struct{})
+	stop := p.watchCertExpiry(1, "test", "192.0.2.1:4000", cert, func() { close(closed) })
+	select {
+	case <-closed:
+		t.Fatal("tunnel closed although termination is disabled")
+	case <-time.After(150 * time.Millisecond):
+	}
+	stop()
+
+	p.Config.Proxy.CertExpiry.Terminate = true
+	id := tunnels.Register(TunnelInfo{Username: "alice", CertNotAfter: cert.NotAfter})
+	defer tunnels.Unregister(id)
+	closed = make(chan struct{})
+	cert.NotAfter = time.Now().Add(50 * time.Millisecond)
+	defer p.watchCertExpiry(id, "test", "192.0.2.1:4000", cert, func() { close(closed) })()
+	if list := tunnels.List(time.Now(), "alice", false); len(list) != 1 || list[0].TerminateAt == nil {
+		t.Errorf("termination time not recorded: %+v", list)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("tunnel not closed after certificate expiry")
+	}
+}
+
+func TestV2API_Connections(t *testing.T) {
+	id := tunnels.Register(TunnelInfo{Username: "carol", Target: "example.net:443", CertNotAfter: time.Now().Add(-time.Hour)})
+	defer tunnels.Unregister(id)
+
+	mux := http.NewServeMux()
+	registerV2API(mux, &Config{}, nil, nil, nil, nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/connections?user=carol&expired=true", nil))
+	var resp struct {
+		Success bool         `json:"success"`
+		Data    []TunnelInfo `json:"data"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if !resp.Success || len(resp.Data) != 1 || !resp.Data[0].CertExpired {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
+
+func TestTunnelRegistry_Checkpoint(t *testing.T) {
+	cfg := TunnelCheckpointConfig{File: filepath.Join(t.TempDir(), "tunnels.json")}
+	reg := newTunnelRegistry()
+	reg.StartCheckpoints(cfg)
+	id := reg.Register(TunnelInfo{Username: "alice", Target: "example.com:443"})
+	reg.Register(TunnelInfo{Username: "bob", Target: "example.org:443"})
+	reg.setCounters(id, func() (uint64, uint64) { return 100, 2000 })
+	now := time.Now()
+	reg.Checkpoint(now)
+
+	// The next run lists the tunnels as interrupted, with their byte counts
+	next := newTunnelRegistry()
+	next.StartCheckpoints(cfg)
+	got := next.Interrupted("alice")
+	if len(got) != 1 || got[0].Upload != 100 || got[0].Download != 2000 || !got[0].LastCheckpoint.Equal(now.UTC().Round(0)) {
+		t.Fatalf("unexpected interrupted tunnels for alice: %+v", got)
+	}
+	if len(next.Interrupted("")) != 2 {
+		t.Errorf("expected both tunnels interrupted, got %+v", next.Interrupted(""))
+	}
+
+	w := httptest.NewRecorder()
+	handleInterruptedTunnels(w, httptest.NewRequest(http.MethodDelete, "/api/v2/connections/interrupted", nil), next)
+	if w.Code != http.StatusOK || len(next.Interrupted("")) != 0 {
+		t.Errorf("dismiss: status %d, %d left", w.Code, len(next.Interrupted("")))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RevocationStatus describes the loaded certificate revocation lists
+type RevocationStatus struct {
+	Path       string    `json:"path"`
+	Revoked    int       `json:"revoked"`     // Serial numbers revoked
+	LoadedAt   time.Time `json:"loaded_at"`   // When the file was last read
+	NextUpdate time.Time `json:"next_update"` // Earliest next update announced by the CRLs
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// CertRevocation rejects client certificates revoked by the CRLs in
+// server.certificates.crl_path. The file is re-read when it changes; one
+// that fails to load keeps the previous lists in force.
+type CertRevocation struct {
+	path     string
+	interval time.Duration
+	cas      []*x509.Certificate
+
+	mu      sync.RWMutex
+	revoked map[string]bool // issuer DER + serial number
+	modTime time.Time
+	status  RevocationStatus
+
+	rejected atomic.Uint64
+}
+
+// NewCertRevocation loads server.certificates.crl_path; it returns nil if
+// no CRL is configured. A CRL that cannot be loaded is an error, so the
+// proxy does not start accepting revoked certificates.
+func NewCertRevocation(config *Config) (*CertRevocation, error) {
+	if config.Server.Certificates.CRLPath == "" {
+		return nil, nil
+	}
+	c, err := loadCertRevocation(config, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	metrics.Gauge("https_proxy_crl_revoked", "Client certificate serial numbers revoked by the loaded CRLs.", func() float64 {
+		return float64(c.Status().Revoked)
+	})
+	metrics.Counter("https_proxy_crl_rejected_total", "Client certificates rejected as revoked.", func() float64 {
+		return float64(c.rejected.Load())
+	})
+	return c, nil
+}
+
+// loadCertRevocation reads the CRLs of config at now
+func loadCertRevocation(config *Config, now time.Time) (*CertRevocation, error) {
+	cc := config.Server.Certificates
+	cas, err := readCertificates(cc.CAPath)
+	if err != nil {
+		return nil, fmt.Errorf("CA %s: %w", cc.CAPath, err)
+	}
+	c := &CertRevocation{
+		path:     cc.CRLPath,
+		interval: time.Duration(firstPositive(cc.CRLReloadSeconds, 300)) * time.Second,
+		cas:      cas,
+		status:   RevocationStatus{Path: cc.CRLPath},
+	}
+	if err := c.Reload(now); err != nil {
+		return nil, fmt.Errorf("CRL %s: %w", cc.CRLPath, err)
+	}
+	return c, nil
+}
+
+// Run re-reads the file every interval, if it changed, forever
+func (c *CertRevocation) Run() {
+	if c == nil {
+		return
+	}
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if err := c.Reload(now); err != nil {
+			log.Printf("CRL %s: %v; keeping the previous lists", c.path, err)
+		}
+	}
+}
+
+// Reload reads the file if it changed since it was last loaded. The file
+// holds one or more CRLs, PEM ("X509 CRL") or a single DER one, each
+// signed by a certificate of server.certificates.ca_path.
+func (c *CertRevocation) Reload(now time.Time) error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return c.failed(err)
+	}
+	c.mu.RLock()
+	unchanged := info.ModTime().Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		return c.failed(err)
+	}
+
+	var ders [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{data}
+	}
+	revoked := make(map[string]bool)
+	var nextUpdate time.Time
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return c.failed(err)
+		}
+		if err := c.checkSignature(crl); err != nil {
+			return c.failed(err)
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[string(crl.RawIssuer)+entry.SerialNumber.String()] = true
+		}
+		if nextUpdate.IsZero() || (!crl.NextUpdate.IsZero() && crl.NextUpdate.Before(nextUpdate)) {
+			nextUpdate = crl.NextUpdate
+		}
+	}
+	if !nextUpdate.IsZero() && now.After(nextUpdate) {
+		log.Printf("CRL %s is past its next update (%s); is it still being refreshed?", c.path, nextUpdate.Format(time.RFC3339))
+	}
+
+	c.mu.Lock()
+	c.revoked = revoked
+	c.modTime = info.ModTime()
+	c.status = RevocationStatus{Path: c.path, Revoked: len(revoked), LoadedAt: now, NextUpdate: nextUpdate}
+	c.mu.Unlock()
+	log.Printf("CRL %s loaded: %d revoked certificates", c.path, len(revoked))
+	return nil
+}
+
+// checkSignature verifies crl against the CA certificates
+func (c *CertRevocation) checkSignature(crl *x509.RevocationList) error {
+	var err error
+	for _, ca := range c.cas {
+		if err = crl.CheckSignatureFrom(ca); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("CRL of %s not signed by the CA: %w", crl.Issuer, err)
+}
+
+func (c *CertRevocation) failed(err error) error {
+	c.mu.Lock()
+	c.status.LastError = err.Error()
+	c.mu.Unlock()
+	return err
+}
+
+var errCertRevoked = errors.New("certificate revoked")
+
+// Check returns errCertRevoked if cert is on a loaded CRL
+func (c *CertRevocation) Check(cert *x509.Certificate) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.RLock()
+	revoked := c.revoked[string(cert.RawIssuer)+cert.SerialNumber.String()]
+	c.mu.RUnlock()
+	if revoked {
+		c.rejected.Add(1)
+		return errCertRevoked
+	}
+	return nil
+}
+
+// Status returns what is loaded
+func (c *CertRevocation) Status() RevocationStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.status
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCertRevocation(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := GenerateCA("Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{}
+	cfg.Server.Certificates.CAPath = filepath.Join(dir, "ca.crt")
+	cfg.Server.Certificates.CRLPath = filepath.Join(dir, "ca.crl")
+	os.WriteFile(cfg.Server.Certificates.CAPath, ca.CertPEM, 0644)
+	issue := func(cn string) *x509.Certificate {
+		c, err := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: cn, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, Validity: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Cert
+	}
+	bob, carol := issue("bob"), issue("carol")
+	now := time.Now()
+	writeCRL := func(issuer *IssuedCert, number int64, modTime time.Time, revoked ...*x509.Certificate) {
+		list := &x509.RevocationList{Number: big.NewInt(number), ThisUpdate: now, NextUpdate: now.Add(24 * time.Hour)}
+		for _, c := range revoked {
+			list.RevokedCertificateEntries = append(list.RevokedCertificateEntries, x509.RevocationListEntry{SerialNumber: c.SerialNumber, RevocationTime: now})
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, list, issuer.Cert, issuer.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(cfg.Server.Certificates.CRLPath, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+		os.Chtimes(cfg.Server.Certificates.CRLPath, modTime, modTime)
+	}
+
+	if _, err := NewCertRevocation(cfg); err == nil {
+		t.Fatal("missing CRL loaded")
+	}
+	writeCRL(ca, 1, now, bob)
+	rev, err := NewCertRevocation(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev.Check(bob) != errCertRevoked || rev.Check(carol) != nil {
+		t.Errorf("bob %v, carol %v", rev.Check(bob), rev.Check(carol))
+	}
+
+	// Revoked clients get a structured error instead of their tunnel
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	sm := NewStatsManager(cfg)
+	p := &Proxy{Config: cfg, CACertPool: pool, StatsManager: sm, Policy: NewPolicyEngine(cfg, sm, nil), Revocation: rev}
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{bob}}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	var e ProxyError
+	if json.NewDecoder(w.Body).Decode(&e); w.Code != http.StatusMethodNotAllowed || e.Code != ErrCodeCertRevoked {
+		t.Errorf("revoked CONNECT: %d %+v", w.Code, e)
+	}
+
+	// A changed file is picked up; an untouched one is not re-read
+	writeCRL(ca, 2, now.Add(time.Minute), bob, carol)
+	if err := rev.Reload(now); err != nil || rev.Check(carol) != errCertRevoked || rev.Status().Revoked != 2 {
+		t.Errorf("reload: %v, %+v", err, rev.Status())
+	}
+	loaded := rev.Status().LoadedAt
+	if rev.Reload(now.Add(time.Hour)); !rev.Status().LoadedAt.Equal(loaded) {
+		t.Error("unchanged CRL re-read")
+	}
+
+	// A CRL from another CA is refused and the previous lists stay
+	other, _ := GenerateCA("Other CA", time.Hour)
+	writeCRL(other, 3, now.Add(2*time.Minute))
+	if err := rev.Reload(now); err == nil || rev.Check(carol) != errCertRevoked || rev.Status().LastError == "" {
+		t.Errorf("foreign CRL: %v, %+v", err, rev.Status())
+	}
+
+	writeCRL(ca, 4, now.Add(3*time.Minute), carol)
+	report := RunDiagnostics(cfg, nil, now.Add(48*time.Hour))
+	if i := slices.IndexFunc(report.Checks, func(c DiagnosticCheck) bool { return c.Name == "server.crl" }); i < 0 || report.Checks[i].Status != DiagWarn {
+		t.Errorf("stale CRL not reported: %+v", report.Checks)
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -13,12 +16,46 @@ import (
 
 // StatsDB wraps the SQLite database for traffic statistics storage.
 type StatsDB struct {
-	db *sql.DB
+	// file is the open database and its path; Move replaces it
+	file atomic.Pointer[statsFile]
+	// readOnly makes writes fail with errStatsReadOnly while queries are
+	// still served; openedRO is set when SQLite itself opened the file
+	// read-only, so it cannot be made writable
+	readOnly atomic.Bool
+	openedRO bool
+	// node is the name of this proxy instance, recorded with the traffic it
+	// flushes; set by SetNode before the collector starts
+	node string
+	// limits bound reads made through query and queryRow
+	limits atomic.Pointer[QueryLimits]
 }
 
+type statsFile struct {
+	db   *sql.DB
+	path string
+}
+
+// errStatsReadOnly is returned by writes while the database is read-only
+var errStatsReadOnly = errors.New("stats database is read-only")
+
 // NewStatsDB opens (or creates) a SQLite database at dbPath and initialises
 // all required tables and indexes.
 func NewStatsDB(dbPath string) (*StatsDB, error) {
+	db, err := openSQLite(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	sdb := &StatsDB{}
+	sdb.file.Store(&statsFile{db: db, path: dbPath})
+	if err := sdb.initTables(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sdb, nil
+}
+
+// openSQLite opens the database file at dbPath for reading and writing
+func openSQLite(dbPath string) (*sql.DB, error) {
 	// Ensure parent directory exists
 	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
 		return nil, fmt.Errorf("create db dir: %w", err)
@@ -31,6 +68,7 @@ func NewStatsDB(dbPath string) (*StatsDB, error) {
 
 	// Performance pragmas
 	for _, pragma := range []string{
+		"PRAGMA auto_vacuum=INCREMENTAL", // only takes effect on new databases; see reclaim
 		"PRAGMA journal_mode=WAL",
 		"PRAGMA synchronous=NORMAL",
 		"PRAGMA cache_size=-16000", // 16 MB page cache
@@ -42,15 +80,56 @@ func NewStatsDB(dbPath string) (*StatsDB, error) {
 			return nil, fmt.Errorf("exec %s: %w", pragma, err)
 		}
 	}
+	return db, nil
+}
 
-	sdb := &StatsDB{db: db}
-	if err := sdb.initTables(); err != nil {
+// sqlDB returns the open database
+func (s *StatsDB) sqlDB() *sql.DB {
+	return s.file.Load().db
+}
+
+// Path returns the path of the database file
+func (s *StatsDB) Path() string {
+	return s.file.Load().path
+}
+
+// NewReadOnlyStatsDB opens an existing database for queries only, e.g. a
+// replicated copy served by a stats viewer instance. No table is created or
+// migrated, and SQLite refuses any write.
+func NewReadOnlyStatsDB(dbPath string) (*StatsDB, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?mode=ro&_pragma=busy_timeout(5000)&_pragma=query_only(1)")
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+	if err := db.Ping(); err != nil {
 		db.Close()
-		return nil, err
+		return nil, fmt.Errorf("open sqlite: %w", err)
 	}
+	sdb := &StatsDB{openedRO: true}
+	sdb.file.Store(&statsFile{db: db, path: dbPath})
+	sdb.readOnly.Store(true)
 	return sdb, nil
 }
 
+// ReadOnly reports whether writes are currently refused
+func (s *StatsDB) ReadOnly() bool {
+	return s.readOnly.Load()
+}
+
+// SetReadOnly turns read-only mode on or off at runtime, e.g. while another
+// process migrates the database. Stats collected meanwhile stay buffered in
+// memory, within max_buffer_entries, until writes resume.
+func (s *StatsDB) SetReadOnly(readOnly bool) error {
+	if !readOnly && s.openedRO {
+		return errors.New("stats database was opened read-only (stats.read_only)")
+	}
+	s.readOnly.Store(readOnly)
+	return nil
+}
+
 func (s *StatsDB) initTables() error {
 	stmts := []string{
 		`CREATE TABLE IF NOT EXISTS user_stats (
@@ -81,6 +160,7 @@ func (s *StatsDB) initTables() error {
 			conn_count INTEGER DEFAULT 0,
 			PRIMARY KEY (user, minute)
 		)`,
+		`CREATE INDEX IF NOT EXISTS idx_minute_stats_minute ON minute_stats(minute)`,
 		`CREATE TABLE IF NOT EXISTS hourly_stats (
 			user       TEXT NOT NULL,
 			hour       TEXT NOT NULL,
@@ -100,13 +180,197 @@ func (s *StatsDB) initTables() error {
 			last_seen    DATETIME,
 			PRIMARY KEY (user, country)
 		)`,
+		`CREATE TABLE IF NOT EXISTS country_domain_stats (
+			country    TEXT NOT NULL,
+			domain     TEXT NOT NULL,
+			upload     INTEGER DEFAULT 0,
+			download   INTEGER DEFAULT 0,
+			conn_count INTEGER DEFAULT 0,
+			last_seen  DATETIME,
+			PRIMARY KEY (country, domain)
+		)`,
+		`CREATE TABLE IF NOT EXISTS country_hourly_stats (
+			country    TEXT NOT NULL,
+			hour       TEXT NOT NULL,
+			upload     INTEGER DEFAULT 0,
+			download   INTEGER DEFAULT 0,
+			conn_count INTEGER DEFAULT 0,
+			PRIMARY KEY (country, hour)
+		)`,
+		`CREATE TABLE IF NOT EXISTS tag_stats (
+			user       TEXT NOT NULL,
+			tag        TEXT NOT NULL,
+			upload     INTEGER DEFAULT 0,
+			download   INTEGER DEFAULT 0,
+			conn_count INTEGER DEFAULT 0,
+			last_seen  DATETIME,
+			PRIMARY KEY (user, tag)
+		)`,
+		`CREATE TABLE IF NOT EXISTS latency_histograms (
+			scope  TEXT NOT NULL,
+			name   TEXT NOT NULL,
+			metric TEXT NOT NULL,
+			b0     INTEGER DEFAULT 0,
+			b1     INTEGER DEFAULT 0,
+			b2     INTEGER DEFAULT 0,
+			b3     INTEGER DEFAULT 0,
+			b4     INTEGER DEFAULT 0,
+			b5     INTEGER DEFAULT 0,
+			b6     INTEGER DEFAULT 0,
+			b7     INTEGER DEFAULT 0,
+			sum    REAL DEFAULT 0,
+			count  INTEGER DEFAULT 0,
+			PRIMARY KEY (scope, name, metric)
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_events (
+			id     INTEGER PRIMARY KEY AUTOINCREMENT,
+			user   TEXT NOT NULL,
+			time   DATETIME NOT NULL,
+			type   TEXT NOT NULL,
+			actor  TEXT,
+			detail TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_user_events_user ON user_events(user, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_user_events_type ON user_events(type, id)`,
 		`CREATE TABLE IF NOT EXISTS retention_config (
 			key   TEXT PRIMARY KEY,
 			value TEXT
 		)`,
+		`CREATE TABLE IF NOT EXISTS user_trials (
+			username    TEXT PRIMARY KEY,
+			created_at  TEXT NOT NULL,
+			created_by  TEXT,
+			quota_bytes INTEGER NOT NULL,
+			rate_bytes  INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_quotas (
+			username    TEXT PRIMARY KEY,
+			period      TEXT NOT NULL,
+			quota_bytes INTEGER NOT NULL,
+			set_by      TEXT,
+			set_at      TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_groups (
+			username    TEXT NOT NULL,
+			group_name  TEXT NOT NULL,
+			assigned_by TEXT,
+			assigned_at TEXT NOT NULL,
+			PRIMARY KEY (username, group_name)
+		)`,
+		`CREATE TABLE IF NOT EXISTS admin_api_usage (
+			principal  TEXT NOT NULL,
+			method     TEXT NOT NULL,
+			endpoint   TEXT NOT NULL,
+			calls      INTEGER DEFAULT 0,
+			errors     INTEGER DEFAULT 0,
+			first_used TEXT NOT NULL,
+			last_used  TEXT NOT NULL,
+			PRIMARY KEY (principal, method, endpoint)
+		)`,
+		`CREATE TABLE IF NOT EXISTS nodes (
+			name       TEXT PRIMARY KEY,
+			labels     TEXT,
+			first_seen TEXT NOT NULL,
+			last_seen  TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS node_hourly_stats (
+			node       TEXT NOT NULL,
+			user       TEXT NOT NULL,
+			hour       TEXT NOT NULL,
+			upload     INTEGER DEFAULT 0,
+			download   INTEGER DEFAULT 0,
+			conn_count INTEGER DEFAULT 0,
+			PRIMARY KEY (node, user, hour)
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_expiry (
+			username   TEXT PRIMARY KEY,
+			expires_at TEXT NOT NULL,
+			source     TEXT NOT NULL,
+			warned     INTEGER DEFAULT 0,
+			expired    INTEGER DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS camouflage_stats (
+			hour         TEXT NOT NULL,
+			path         TEXT NOT NULL,
+			country      TEXT NOT NULL,
+			country_name TEXT,
+			requests     INTEGER DEFAULT 0,
+			upload       INTEGER DEFAULT 0,
+			download     INTEGER DEFAULT 0,
+			PRIMARY KEY (hour, path, country)
+		)`,
+		`CREATE TABLE IF NOT EXISTS dial_failures (
+			user        TEXT NOT NULL,
+			domain      TEXT NOT NULL,
+			error_class TEXT NOT NULL,
+			count       INTEGER DEFAULT 0,
+			first_seen  TEXT,
+			last_seen   TEXT,
+			PRIMARY KEY (user, domain, error_class)
+		)`,
+		`CREATE TABLE IF NOT EXISTS acl_rules (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			username   TEXT NOT NULL DEFAULT '',
+			action     TEXT NOT NULL,
+			type       TEXT NOT NULL,
+			pattern    TEXT NOT NULL,
+			priority   INTEGER DEFAULT 0,
+			created_by TEXT,
+			created_at TEXT NOT NULL,
+			UNIQUE (username, type, pattern)
+		)`,
+		`CREATE TABLE IF NOT EXISTS acl_blocks (
+			user       TEXT NOT NULL,
+			domain     TEXT NOT NULL,
+			rule       TEXT NOT NULL,
+			count      INTEGER DEFAULT 0,
+			first_seen TEXT,
+			last_seen  TEXT,
+			PRIMARY KEY (user, domain, rule)
+		)`,
+		`CREATE TABLE IF NOT EXISTS client_certs (
+			sha256     TEXT PRIMARY KEY,
+			username   TEXT NOT NULL,
+			serial     TEXT NOT NULL,
+			issuer     TEXT,
+			not_before TEXT NOT NULL,
+			not_after  TEXT NOT NULL,
+			source     TEXT NOT NULL,
+			added_by   TEXT,
+			added_at   TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_client_certs_user ON client_certs(username, not_after)`,
+		`CREATE TABLE IF NOT EXISTS tunnel_samples (
+			id               INTEGER PRIMARY KEY AUTOINCREMENT,
+			user             TEXT NOT NULL,
+			target           TEXT NOT NULL,
+			started          TEXT NOT NULL,
+			ended            TEXT NOT NULL,
+			interval_seconds INTEGER NOT NULL,
+			upload           INTEGER DEFAULT 0,
+			download         INTEGER DEFAULT 0,
+			upload_cap       INTEGER DEFAULT 0,
+			download_cap     INTEGER DEFAULT 0,
+			samples          TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_tunnel_samples_user ON tunnel_samples(user, ended)`,
+		`CREATE TABLE IF NOT EXISTS acl_rule_hits (
+			rule     TEXT NOT NULL,
+			hour     TEXT NOT NULL,
+			hits     INTEGER DEFAULT 0,
+			last_hit TEXT,
+			PRIMARY KEY (rule, hour)
+		)`,
+		`CREATE TABLE IF NOT EXISTS country_rate_hits (
+			country  TEXT NOT NULL,
+			hour     TEXT NOT NULL,
+			hits     INTEGER DEFAULT 0,
+			last_hit TEXT,
+			PRIMARY KEY (country, hour)
+		)`,
 	}
 	for _, stmt := range stmts {
-		if _, err := s.db.Exec(stmt); err != nil {
+		if _, err := s.sqlDB().Exec(stmt); err != nil {
 			return fmt.Errorf("init table: %w\nSQL: %s", err, stmt)
 		}
 	}
@@ -115,7 +379,7 @@ func (s *StatsDB) initTables() error {
 
 // Close closes the database connection.
 func (s *StatsDB) Close() error {
-	return s.db.Close()
+	return s.sqlDB().Close()
 }
 
 // ---------------------------------------------------------------------------
@@ -126,6 +390,7 @@ func (s *StatsDB) Close() error {
 type TrafficRecord struct {
 	Username    string
 	Domain      string
+	Tag         string
 	Upload      uint64
 	Download    uint64
 	ConnCount   int
@@ -140,13 +405,22 @@ type TrafficRecord struct {
 // BatchUpsert writes a slice of TrafficRecords into all stat tables inside a
 // single transaction for maximum throughput.
 func (s *StatsDB) BatchUpsert(records []TrafficRecord) error {
-	tx, err := s.db.Begin()
+	return s.BatchUpsertContext(context.Background(), records)
+}
+
+// BatchUpsertContext is BatchUpsert rolled back, with nothing written, if
+// ctx is done before it commits
+func (s *StatsDB) BatchUpsertContext(ctx context.Context, records []TrafficRecord) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	tx, err := s.sqlDB().BeginTx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("begin tx: %w", err)
 	}
 	defer tx.Rollback() //nolint: will be committed below
 
-	stmtUser, err := tx.Prepare(`INSERT INTO user_stats (username, total_upload, total_download, conn_count, first_seen, last_access)
+	stmtUser, err := tx.PrepareContext(ctx, `INSERT INTO user_stats (username, total_upload, total_download, conn_count, first_seen, last_access)
 		VALUES (?, ?, ?, ?, ?, ?)
 		ON CONFLICT(username) DO UPDATE SET
 			total_upload   = total_upload   + excluded.total_upload,
@@ -158,7 +432,7 @@ func (s *StatsDB) BatchUpsert(records []TrafficRecord) error {
 	}
 	defer stmtUser.Close()
 
-	stmtDomain, err := tx.Prepare(`INSERT INTO domain_stats (user, domain, upload, download, conn_count, last_seen)
+	stmtDomain, err := tx.PrepareContext(ctx, `INSERT INTO domain_stats (user, domain, upload, download, conn_count, last_seen)
 		VALUES (?, ?, ?, ?, ?, ?)
 		ON CONFLICT(user, domain) DO UPDATE SET
 			upload     = upload     + excluded.upload,
@@ -170,7 +444,7 @@ func (s *StatsDB) BatchUpsert(records []TrafficRecord) error {
 	}
 	defer stmtDomain.Close()
 
-	stmtMinute, err := tx.Prepare(`INSERT INTO minute_stats (user, minute, upload, download, conn_count)
+	stmtMinute, err := tx.PrepareContext(ctx, `INSERT INTO minute_stats (user, minute, upload, download, conn_count)
 		VALUES (?, ?, ?, ?, ?)
 		ON CONFLICT(user, minute) DO UPDATE SET
 			upload     = upload     + excluded.upload,
@@ -181,7 +455,7 @@ func (s *StatsDB) BatchUpsert(records []TrafficRecord) error {
 	}
 	defer stmtMinute.Close()
 
-	stmtHour, err := tx.Prepare(`INSERT INTO hourly_stats (user, hour, upload, download, conn_count)
+	stmtHour, err := tx.PrepareContext(ctx, `INSERT INTO hourly_stats (user, hour, upload, download, conn_count)
 		VALUES (?, ?, ?, ?, ?)
 		ON CONFLICT(user, hour) DO UPDATE SET
 			upload     = upload     + excluded.upload,
@@ -192,7 +466,7 @@ func (s *StatsDB) BatchUpsert(records []TrafficRecord) error {
 	}
 	defer stmtHour.Close()
 
-	stmtCountry, err := tx.Prepare(`INSERT INTO country_stats (user, country, country_name, continent, upload, download, conn_count, last_seen)
+	stmtCountry, err := tx.PrepareContext(ctx, `INSERT INTO country_stats (user, country, country_name, continent, upload, download, conn_count, last_seen)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(user, country) DO UPDATE SET
 			country_name = COALESCE(excluded.country_name, country_name),
@@ -206,35 +480,109 @@ func (s *StatsDB) BatchUpsert(records []TrafficRecord) error {
 	}
 	defer stmtCountry.Close()
 
+	stmtCountryDomain, err := tx.PrepareContext(ctx, `INSERT INTO country_domain_stats (country, domain, upload, download, conn_count, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(country, domain) DO UPDATE SET
+			upload     = upload     + excluded.upload,
+			download   = download   + excluded.download,
+			conn_count = conn_count + excluded.conn_count,
+			last_seen  = excluded.last_seen`)
+	if err != nil {
+		return fmt.Errorf("prepare country_domain_stats: %w", err)
+	}
+	defer stmtCountryDomain.Close()
+
+	stmtCountryHour, err := tx.PrepareContext(ctx, `INSERT INTO country_hourly_stats (country, hour, upload, download, conn_count)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(country, hour) DO UPDATE SET
+			upload     = upload     + excluded.upload,
+			download   = download   + excluded.download,
+			conn_count = conn_count + excluded.conn_count`)
+	if err != nil {
+		return fmt.Errorf("prepare country_hourly_stats: %w", err)
+	}
+	defer stmtCountryHour.Close()
+
+	stmtTag, err := tx.PrepareContext(ctx, `INSERT INTO tag_stats (user, tag, upload, download, conn_count, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user, tag) DO UPDATE SET
+			upload     = upload     + excluded.upload,
+			download   = download   + excluded.download,
+			conn_count = conn_count + excluded.conn_count,
+			last_seen  = excluded.last_seen`)
+	if err != nil {
+		return fmt.Errorf("prepare tag_stats: %w", err)
+	}
+	defer stmtTag.Close()
+
+	stmtNode, err := tx.PrepareContext(ctx, `INSERT INTO node_hourly_stats (node, user, hour, upload, download, conn_count)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(node, user, hour) DO UPDATE SET
+			upload     = upload     + excluded.upload,
+			download   = download   + excluded.download,
+			conn_count = conn_count + excluded.conn_count`)
+	if err != nil {
+		return fmt.Errorf("prepare node_hourly_stats: %w", err)
+	}
+	defer stmtNode.Close()
+
 	for _, r := range records {
 		ts := r.Timestamp.Format(time.RFC3339)
 
-		if _, err := stmtUser.Exec(r.Username, r.Upload, r.Download, r.ConnCount, ts, ts); err != nil {
+		if _, err := stmtUser.ExecContext(ctx, r.Username, r.Upload, r.Download, r.ConnCount, ts, ts); err != nil {
 			return fmt.Errorf("exec user_stats (%s): %w", r.Username, err)
 		}
 
 		if r.Domain != "" {
-			if _, err := stmtDomain.Exec(r.Username, r.Domain, r.Upload, r.Download, r.ConnCount, ts); err != nil {
+			if _, err := stmtDomain.ExecContext(ctx, r.Username, r.Domain, r.Upload, r.Download, r.ConnCount, ts); err != nil {
 				return fmt.Errorf("exec domain_stats (%s/%s): %w", r.Username, r.Domain, err)
 			}
 		}
 
 		if r.Minute != "" {
-			if _, err := stmtMinute.Exec(r.Username, r.Minute, r.Upload, r.Download, r.ConnCount); err != nil {
+			if _, err := stmtMinute.ExecContext(ctx, r.Username, r.Minute, r.Upload, r.Download, r.ConnCount); err != nil {
 				return fmt.Errorf("exec minute_stats: %w", err)
 			}
 		}
 
 		if r.Hour != "" {
-			if _, err := stmtHour.Exec(r.Username, r.Hour, r.Upload, r.Download, r.ConnCount); err != nil {
+			if _, err := stmtHour.ExecContext(ctx, r.Username, r.Hour, r.Upload, r.Download, r.ConnCount); err != nil {
 				return fmt.Errorf("exec hourly_stats: %w", err)
 			}
 		}
 
 		if r.Country != "" {
-			if _, err := stmtCountry.Exec(r.Username, r.Country, r.CountryName, r.Continent, r.Upload, r.Download, r.ConnCount, ts); err != nil {
+			if _, err := stmtCountry.ExecContext(ctx, r.Username, r.Country, r.CountryName, r.Continent, r.Upload, r.Download, r.ConnCount, ts); err != nil {
 				return fmt.Errorf("exec country_stats: %w", err)
 			}
+			if r.Domain != "" {
+				if _, err := stmtCountryDomain.ExecContext(ctx, r.Country, r.Domain, r.Upload, r.Download, r.ConnCount, ts); err != nil {
+					return fmt.Errorf("exec country_domain_stats: %w", err)
+				}
+			}
+			if r.Hour != "" {
+				if _, err := stmtCountryHour.ExecContext(ctx, r.Country, r.Hour, r.Upload, r.Download, r.ConnCount); err != nil {
+					return fmt.Errorf("exec country_hourly_stats: %w", err)
+				}
+			}
+		}
+
+		if r.Tag != "" {
+			if _, err := stmtTag.ExecContext(ctx, r.Username, r.Tag, r.Upload, r.Download, r.ConnCount, ts); err != nil {
+				return fmt.Errorf("exec tag_stats: %w", err)
+			}
+		}
+
+		if s.node != "" && r.Hour != "" {
+			if _, err := stmtNode.ExecContext(ctx, s.node, r.Username, r.Hour, r.Upload, r.Download, r.ConnCount); err != nil {
+				return fmt.Errorf("exec node_hourly_stats: %w", err)
+			}
+		}
+	}
+
+	if s.node != "" && len(records) > 0 {
+		if _, err := tx.ExecContext(ctx, `UPDATE nodes SET last_seen = ? WHERE name = ?`, time.Now().UTC().Format(time.RFC3339), s.node); err != nil {
+			return fmt.Errorf("update nodes: %w", err)
 		}
 	}
 
@@ -253,17 +601,23 @@ type OverviewStats struct {
 	DomainCount   int    `json:"domain_count"`
 	UserCount     int    `json:"user_count"`
 	CountryCount  int    `json:"country_count"`
+	// Requests answered on behalf of the camouflage site in the last 24
+	// hours, and their response bytes
+	CamouflageRequests uint64 `json:"camouflage_requests_24h"`
+	CamouflageBytes    uint64 `json:"camouflage_bytes_24h"`
 }
 
-func (s *StatsDB) GetOverview() (*OverviewStats, error) {
+func (s *StatsDB) GetOverview(ctx context.Context) (*OverviewStats, error) {
 	o := &OverviewStats{}
-	err := s.db.QueryRow(`SELECT COALESCE(SUM(total_upload),0), COALESCE(SUM(total_download),0), COALESCE(SUM(conn_count),0), COUNT(*) FROM user_stats`).
+	err := s.queryRow(ctx, `SELECT COALESCE(SUM(total_upload),0), COALESCE(SUM(total_download),0), COALESCE(SUM(conn_count),0), COUNT(*) FROM user_stats`).
 		Scan(&o.TotalUpload, &o.TotalDownload, &o.TotalConns, &o.UserCount)
 	if err != nil {
 		return nil, err
 	}
-	s.db.QueryRow(`SELECT COUNT(DISTINCT domain) FROM domain_stats`).Scan(&o.DomainCount)
-	s.db.QueryRow(`SELECT COUNT(DISTINCT country) FROM country_stats`).Scan(&o.CountryCount)
+	s.queryRow(ctx, `SELECT COUNT(DISTINCT domain) FROM domain_stats`).Scan(&o.DomainCount)
+	s.queryRow(ctx, `SELECT COUNT(DISTINCT country) FROM country_stats`).Scan(&o.CountryCount)
+	s.queryRow(ctx, `SELECT COALESCE(SUM(requests),0), COALESCE(SUM(download),0) FROM camouflage_stats WHERE hour>=?`,
+		time.Now().Add(-23*time.Hour).Format("2006-01-02T15:00:00")).Scan(&o.CamouflageRequests, &o.CamouflageBytes)
 	return o, nil
 }
 
@@ -277,10 +631,34 @@ type DBUserStats struct {
 	FirstSeen     string `json:"first_seen"`
 	LastAccess    string `json:"last_access"`
 	Disabled      bool   `json:"disabled"`
+	// Expiry date, if set, and the whole days left before it
+	ExpiresAt     string `json:"expires_at,omitempty"`
+	DaysRemaining *int   `json:"days_remaining,omitempty"`
+	Trial         bool   `json:"trial,omitempty"`
+}
+
+// userColumns selects a DBUserStats row, joined with the user's expiry and
+// trial flag
+const userColumns = `SELECT u.username, u.total_upload, u.total_download, u.conn_count, u.request_count,
+	COALESCE(u.first_seen,''), COALESCE(u.last_access,''), u.disabled, COALESCE(e.expires_at,''), t.username IS NOT NULL
+	FROM user_stats u LEFT JOIN user_expiry e ON e.username = u.username LEFT JOIN user_trials t ON t.username = u.username`
+
+// scanUser scans a userColumns row
+func scanUser(row interface{ Scan(...interface{}) error }, u *DBUserStats) error {
+	var dis int
+	if err := row.Scan(&u.Username, &u.TotalUpload, &u.TotalDownload, &u.ConnCount, &u.RequestCount, &u.FirstSeen, &u.LastAccess, &dis, &u.ExpiresAt, &u.Trial); err != nil {
+		return err
+	}
+	u.Disabled = dis != 0
+	if t, err := time.Parse(time.RFC3339, u.ExpiresAt); err == nil {
+		days := daysRemaining(t, time.Now())
+		u.DaysRemaining = &days
+	}
+	return nil
 }
 
-func (s *StatsDB) GetAllUsers() ([]DBUserStats, error) {
-	rows, err := s.db.Query(`SELECT username, total_upload, total_download, conn_count, request_count, COALESCE(first_seen,''), COALESCE(last_access,''), disabled FROM user_stats ORDER BY total_upload+total_download DESC`)
+func (s *StatsDB) GetAllUsers(ctx context.Context) ([]DBUserStats, error) {
+	rows, err := s.query(ctx, userColumns+` ORDER BY u.total_upload+u.total_download DESC`)
 	if err != nil {
 		return nil, err
 	}
@@ -288,25 +666,19 @@ func (s *StatsDB) GetAllUsers() ([]DBUserStats, error) {
 	var users []DBUserStats
 	for rows.Next() {
 		var u DBUserStats
-		var dis int
-		if err := rows.Scan(&u.Username, &u.TotalUpload, &u.TotalDownload, &u.ConnCount, &u.RequestCount, &u.FirstSeen, &u.LastAccess, &dis); err != nil {
+		if err := scanUser(rows, &u); err != nil {
 			return nil, err
 		}
-		u.Disabled = dis != 0
 		users = append(users, u)
 	}
 	return users, rows.Err()
 }
 
-func (s *StatsDB) GetUser(username string) (*DBUserStats, error) {
+func (s *StatsDB) GetUser(ctx context.Context, username string) (*DBUserStats, error) {
 	u := &DBUserStats{}
-	var dis int
-	err := s.db.QueryRow(`SELECT username, total_upload, total_download, conn_count, request_count, COALESCE(first_seen,''), COALESCE(last_access,''), disabled FROM user_stats WHERE username=?`, username).
-		Scan(&u.Username, &u.TotalUpload, &u.TotalDownload, &u.ConnCount, &u.RequestCount, &u.FirstSeen, &u.LastAccess, &dis)
-	if err != nil {
+	if err := scanUser(s.queryRow(ctx, userColumns+` WHERE u.username=?`, username), u); err != nil {
 		return nil, err
 	}
-	u.Disabled = dis != 0
 	return u, nil
 }
 
@@ -320,7 +692,7 @@ type DBDomainStats struct {
 	LastSeen  string `json:"last_seen"`
 }
 
-func (s *StatsDB) GetTopDomains(limit int, user string) ([]DBDomainStats, error) {
+func (s *StatsDB) GetTopDomains(ctx context.Context, limit int, user string) ([]DBDomainStats, error) {
 	q := `SELECT user, domain, upload, download, conn_count, COALESCE(last_seen,'') FROM domain_stats`
 	var args []interface{}
 	if user != "" {
@@ -330,7 +702,7 @@ func (s *StatsDB) GetTopDomains(limit int, user string) ([]DBDomainStats, error)
 	q += ` ORDER BY upload+download DESC LIMIT ?`
 	args = append(args, limit)
 
-	rows, err := s.db.Query(q, args...)
+	rows, err := s.query(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -355,7 +727,7 @@ type DBTrendPoint struct {
 }
 
 // GetTrends fetches time-series data. rangeStr is one of "30m","1h","24h","7d".
-func (s *StatsDB) GetTrends(rangeStr string) ([]DBTrendPoint, error) {
+func (s *StatsDB) GetTrends(ctx context.Context, rangeStr string) ([]DBTrendPoint, error) {
 	var table, since string
 	now := time.Now()
 	switch rangeStr {
@@ -383,7 +755,7 @@ func (s *StatsDB) GetTrends(rangeStr string) ([]DBTrendPoint, error) {
 	}
 
 	q := fmt.Sprintf(`SELECT %s, SUM(upload), SUM(download), SUM(conn_count) FROM %s WHERE %s>=? GROUP BY %s ORDER BY %s`, timeCol, table, timeCol, timeCol, timeCol)
-	rows, err := s.db.Query(q, since)
+	rows, err := s.query(ctx, q, since)
 	if err != nil {
 		return nil, err
 	}
@@ -409,8 +781,8 @@ type DBCountryStats struct {
 	ConnCount   uint64 `json:"conn_count"`
 }
 
-func (s *StatsDB) GetCountryStats() ([]DBCountryStats, error) {
-	rows, err := s.db.Query(`SELECT country, COALESCE(country_name,''), COALESCE(continent,''), SUM(upload), SUM(download), SUM(conn_count) FROM country_stats GROUP BY country ORDER BY SUM(upload)+SUM(download) DESC`)
+func (s *StatsDB) GetCountryStats(ctx context.Context) ([]DBCountryStats, error) {
+	rows, err := s.query(ctx, `SELECT country, COALESCE(country_name,''), COALESCE(continent,''), SUM(upload), SUM(download), SUM(conn_count) FROM country_stats GROUP BY country ORDER BY SUM(upload)+SUM(download) DESC`)
 	if err != nil {
 		return nil, err
 	}
@@ -426,22 +798,64 @@ func (s *StatsDB) GetCountryStats() ([]DBCountryStats, error) {
 	return out, rows.Err()
 }
 
+// DBTagStats holds traffic per client-supplied connection tag.
+type DBTagStats struct {
+	User      string `json:"user,omitempty"`
+	Tag       string `json:"tag"`
+	Upload    uint64 `json:"upload"`
+	Download  uint64 `json:"download"`
+	ConnCount uint64 `json:"conn_count"`
+	LastSeen  string `json:"last_seen"`
+}
+
+// GetTagStats returns traffic per tag, summed over all users unless user is set.
+func (s *StatsDB) GetTagStats(ctx context.Context, user string) ([]DBTagStats, error) {
+	q := `SELECT '', tag, SUM(upload), SUM(download), SUM(conn_count), COALESCE(MAX(last_seen),'') FROM tag_stats
+		GROUP BY tag ORDER BY SUM(upload)+SUM(download) DESC`
+	var args []interface{}
+	if user != "" {
+		q = `SELECT user, tag, upload, download, conn_count, COALESCE(last_seen,'') FROM tag_stats
+			WHERE user=? ORDER BY upload+download DESC`
+		args = append(args, user)
+	}
+	rows, err := s.query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []DBTagStats
+	for rows.Next() {
+		var t DBTagStats
+		if err := rows.Scan(&t.User, &t.Tag, &t.Upload, &t.Download, &t.ConnCount, &t.LastSeen); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
 // ---------------------------------------------------------------------------
 // User management helpers (disable/enable)
 // ---------------------------------------------------------------------------
 
 func (s *StatsDB) SetUserDisabled(username string, disabled bool) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
 	val := 0
 	if disabled {
 		val = 1
 	}
-	_, err := s.db.Exec(`INSERT INTO user_stats (username, disabled, first_seen, last_access) VALUES (?, ?, datetime('now'), datetime('now')) ON CONFLICT(username) DO UPDATE SET disabled=excluded.disabled`, username, val)
+	_, err := s.sqlDB().Exec(`INSERT INTO user_stats (username, disabled, first_seen, last_access) VALUES (?, ?, datetime('now'), datetime('now')) ON CONFLICT(username) DO UPDATE SET disabled=excluded.disabled`, username, val)
 	return err
 }
 
+// IsUserDisabled is checked on every proxy request, not on behalf of an
+// admin, so it has no request context to follow
 func (s *StatsDB) IsUserDisabled(username string) bool {
+	ctx := context.Background()
 	var dis int
-	err := s.db.QueryRow(`SELECT disabled FROM user_stats WHERE username=?`, username).Scan(&dis)
+	err := s.queryRow(ctx, `SELECT disabled FROM user_stats WHERE username=?`, username).Scan(&dis)
 	if err != nil {
 		return false
 	}
@@ -449,7 +863,10 @@ func (s *StatsDB) IsUserDisabled(username string) bool {
 }
 
 func (s *StatsDB) IncrementRequestCount(username string) {
-	s.db.Exec(`INSERT INTO user_stats (username, request_count, first_seen, last_access) VALUES (?, 1, datetime('now'), datetime('now')) ON CONFLICT(username) DO UPDATE SET request_count=request_count+1, last_access=datetime('now')`, username)
+	if s.ReadOnly() {
+		return
+	}
+	s.sqlDB().Exec(`INSERT INTO user_stats (username, request_count, first_seen, last_access) VALUES (?, 1, datetime('now'), datetime('now')) ON CONFLICT(username) DO UPDATE SET request_count=request_count+1, last_access=datetime('now')`, username)
 }
 
 // ---------------------------------------------------------------------------
@@ -457,11 +874,22 @@ func (s *StatsDB) IncrementRequestCount(username string) {
 // ---------------------------------------------------------------------------
 
 func (s *StatsDB) CleanupOldData(minuteDays, hourlyDays int) {
+	if s.ReadOnly() {
+		return
+	}
 	minuteCutoff := time.Now().AddDate(0, 0, -minuteDays).Format("2006-01-02T15:04:00")
 	hourlyCutoff := time.Now().AddDate(0, 0, -hourlyDays).Format("2006-01-02T15:00:00")
 
-	res1, _ := s.db.Exec(`DELETE FROM minute_stats WHERE minute < ?`, minuteCutoff)
-	res2, _ := s.db.Exec(`DELETE FROM hourly_stats WHERE hour < ?`, hourlyCutoff)
+	res1, _ := s.sqlDB().Exec(`DELETE FROM minute_stats WHERE minute < ?`, minuteCutoff)
+	res2, _ := s.sqlDB().Exec(`DELETE FROM hourly_stats WHERE hour < ?`, hourlyCutoff)
+	s.sqlDB().Exec(`DELETE FROM country_hourly_stats WHERE hour < ?`, hourlyCutoff)
+	s.sqlDB().Exec(`DELETE FROM node_hourly_stats WHERE hour < ?`, hourlyCutoff)
+	s.sqlDB().Exec(`DELETE FROM acl_rule_hits WHERE hour < ?`, hourlyCutoff)
+	s.sqlDB().Exec(`DELETE FROM country_rate_hits WHERE hour < ?`, hourlyCutoff)
+	s.sqlDB().Exec(`DELETE FROM camouflage_stats WHERE hour < ?`, hourlyCutoff)
+	s.sqlDB().Exec(`DELETE FROM dial_failures WHERE last_seen < ?`, time.Now().AddDate(0, 0, -hourlyDays).Format(time.RFC3339))
+	s.sqlDB().Exec(`DELETE FROM acl_blocks WHERE last_seen < ?`, time.Now().AddDate(0, 0, -hourlyDays).UTC().Format(time.RFC3339))
+	s.sqlDB().Exec(`DELETE FROM tunnel_samples WHERE ended < ?`, time.Now().AddDate(0, 0, -hourlyDays).UTC().Format(time.RFC3339))
 
 	del1, _ := res1.RowsAffected()
 	del2, _ := res2.RowsAffected()
@@ -472,7 +900,10 @@ func (s *StatsDB) CleanupOldData(minuteDays, hourlyDays int) {
 
 // MigrateFromJSON imports legacy JSON stats into SQLite.
 func (s *StatsDB) MigrateFromJSON(userStats map[string]*UserStats) error {
-	tx, err := s.db.Begin()
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	tx, err := s.sqlDB().Begin()
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// AddACLRule records an ACL rule added through the API and returns its ID
+func (s *StatsDB) AddACLRule(r ACLRule) (int64, error) {
+	if s.ReadOnly() {
+		return 0, errStatsReadOnly
+	}
+	res, err := s.sqlDB().Exec(`INSERT INTO acl_rules (username, action, type, pattern, priority, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		r.User, r.Action, r.Type, r.Pattern, r.Priority, r.CreatedBy, r.CreatedAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return 0, errACLRuleExists
+		}
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// DeleteACLRule removes the API rule id
+func (s *StatsDB) DeleteACLRule(id int64) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`DELETE FROM acl_rules WHERE id = ?`, id)
+	return err
+}
+
+// SetACLRulePriority changes the priority of the API rule id
+func (s *StatsDB) SetACLRulePriority(id int64, priority int) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`UPDATE acl_rules SET priority = ? WHERE id = ?`, priority, id)
+	return err
+}
+
+// GetACLRules returns the rules added through the API, oldest first
+func (s *StatsDB) GetACLRules(ctx context.Context) ([]*ACLRule, error) {
+	rows, err := s.query(ctx, `SELECT id, username, action, type, pattern, COALESCE(priority,0), COALESCE(created_by,''), created_at FROM acl_rules ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*ACLRule
+	for rows.Next() {
+		r := &ACLRule{Source: ACLSourceAPI}
+		var createdAt string
+		if err := rows.Scan(&r.ID, &r.User, &r.Action, &r.Type, &r.Pattern, &r.Priority, &r.CreatedBy, &createdAt); err != nil {
+			return nil, err
+		}
+		r.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// DBACLBlock counts the requests of a user refused a domain by an ACL rule
+type DBACLBlock struct {
+	User      string    `json:"user"`
+	Domain    string    `json:"domain"`
+	Rule      string    `json:"rule"`
+	Count     uint64    `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// RecordACLBlock counts a request of user refused domain by rule
+func (s *StatsDB) RecordACLBlock(user, domain, rule string, t time.Time) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	ts := t.UTC().Format(time.RFC3339)
+	_, err := s.sqlDB().Exec(`INSERT INTO acl_blocks (user, domain, rule, count, first_seen, last_seen) VALUES (?, ?, ?, 1, ?, ?)
+		ON CONFLICT(user, domain, rule) DO UPDATE SET count = count + 1, last_seen = MAX(last_seen, excluded.last_seen)`,
+		user, domain, rule, ts, ts)
+	return err
+}
+
+// GetACLBlocks returns the refused requests, most recent first, optionally
+// of one user
+func (s *StatsDB) GetACLBlocks(ctx context.Context, user string, limit int) ([]DBACLBlock, error) {
+	query := `SELECT user, domain, rule, count, first_seen, last_seen FROM acl_blocks`
+	args := []interface{}{}
+	if user != "" {
+		query += ` WHERE user = ?`
+		args = append(args, user)
+	}
+	query += ` ORDER BY last_seen DESC, count DESC LIMIT ?`
+	args = append(args, limit)
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []DBACLBlock{}
+	for rows.Next() {
+		var b DBACLBlock
+		var first, last string
+		if err := rows.Scan(&b.User, &b.Domain, &b.Rule, &b.Count, &first, &last); err != nil {
+			return nil, err
+		}
+		b.FirstSeen, _ = time.Parse(time.RFC3339, first)
+		b.LastSeen, _ = time.Parse(time.RFC3339, last)
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// UpsertACLRuleHits adds the buffered hits of ACL rules in one transaction
+func (s *StatsDB) UpsertACLRuleHits(ctx context.Context, hits map[aclHitKey]*aclHitAgg) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	tx, err := s.sqlDB().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO acl_rule_hits (rule, hour, hits, last_hit) VALUES (?, ?, ?, ?)
+		ON CONFLICT(rule, hour) DO UPDATE SET hits = hits + excluded.hits, last_hit = MAX(last_hit, excluded.last_hit)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for key, agg := range hits {
+		if _, err := stmt.ExecContext(ctx, key.Rule, key.Hour, agg.Hits, agg.LastHit.UTC().Format(time.RFC3339)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DBACLRuleHits counts the requests an ACL rule decided
+type DBACLRuleHits struct {
+	Hits    uint64
+	LastHit time.Time
+}
+
+// GetACLRuleHits returns the hits of each rule, by ACLRule.key, in the
+// hours from since on
+func (s *StatsDB) GetACLRuleHits(ctx context.Context, since string) (map[string]DBACLRuleHits, error) {
+	rows, err := s.query(ctx, `SELECT rule, SUM(hits), MAX(last_hit) FROM acl_rule_hits WHERE hour >= ? GROUP BY rule`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]DBACLRuleHits)
+	for rows.Next() {
+		var rule, last string
+		var h DBACLRuleHits
+		if err := rows.Scan(&rule, &h.Hits, &last); err != nil {
+			return nil, err
+		}
+		h.LastHit, _ = time.Parse(time.RFC3339, last)
+		out[rule] = h
+	}
+	return out, rows.Err()
+}
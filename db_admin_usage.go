@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DBAdminUsage is how often an admin called one endpoint
+type DBAdminUsage struct {
+	Principal string    `json:"-"`
+	Method    string    `json:"method"`
+	Endpoint  string    `json:"endpoint"` // Path with names and IDs replaced, e.g. /api/v2/users/{user}
+	Calls     uint64    `json:"calls"`
+	Errors    uint64    `json:"errors"` // Calls answered with a 4xx or 5xx status
+	FirstUsed time.Time `json:"first_used"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// UpsertAdminUsage adds the buffered calls to admin_api_usage
+func (s *StatsDB) UpsertAdminUsage(ctx context.Context, m map[adminUsageKey]*adminUsageAgg) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	tx, err := s.sqlDB().BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO admin_api_usage (principal, method, endpoint, calls, errors, first_used, last_used)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(principal, method, endpoint) DO UPDATE SET
+			calls     = calls + excluded.calls,
+			errors    = errors + excluded.errors,
+			last_used = MAX(last_used, excluded.last_used)`)
+	if err != nil {
+		return fmt.Errorf("prepare admin_api_usage: %w", err)
+	}
+	defer stmt.Close()
+
+	for key, agg := range m {
+		if _, err := stmt.ExecContext(ctx, key.Principal, key.Method, key.Endpoint, agg.Calls, agg.Errors,
+			agg.FirstUsed.UTC().Format(time.RFC3339), agg.LastUsed.UTC().Format(time.RFC3339)); err != nil {
+			return fmt.Errorf("exec admin_api_usage: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// GetAdminUsage returns the recorded admin API calls, by principal and
+// endpoint
+func (s *StatsDB) GetAdminUsage(ctx context.Context) ([]DBAdminUsage, error) {
+	rows, err := s.query(ctx, `SELECT principal, method, endpoint, calls, errors, first_used, last_used
+		FROM admin_api_usage ORDER BY principal, calls DESC, endpoint, method`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []DBAdminUsage
+	for rows.Next() {
+		var u DBAdminUsage
+		var first, last string
+		if err := rows.Scan(&u.Principal, &u.Method, &u.Endpoint, &u.Calls, &u.Errors, &first, &last); err != nil {
+			return nil, err
+		}
+		u.FirstUsed, _ = time.Parse(time.RFC3339, first)
+		u.LastUsed, _ = time.Parse(time.RFC3339, last)
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// archiveKey is the retention_config key holding the last archive report
+const archiveKey = "archive_last"
+
+// ArchiveReport records the last month moved to the stats archive
+type ArchiveReport struct {
+	Time       time.Time `json:"time"`
+	Month      string    `json:"month"` // "2006-01"
+	Objects    []string  `json:"objects"`
+	UserRows   int64     `json:"user_rows"`
+	DomainRows int64     `json:"domain_rows"`
+}
+
+// oldestArchivable returns the month of the oldest hourly row or domain row,
+// and false if both tables are empty
+func (s *StatsDB) oldestArchivable(ctx context.Context) (time.Time, bool, error) {
+	var hour, lastSeen sql.NullString
+	if err := s.sqlDB().QueryRowContext(ctx, `SELECT MIN(hour) FROM hourly_stats`).Scan(&hour); err != nil {
+		return time.Time{}, false, err
+	}
+	if err := s.sqlDB().QueryRowContext(ctx, `SELECT MIN(last_seen) FROM domain_stats`).Scan(&lastSeen); err != nil {
+		return time.Time{}, false, err
+	}
+	var oldest time.Time
+	if t, err := time.ParseInLocation("2006-01-02T15:00:00", hour.String, time.Local); err == nil {
+		oldest = t
+	}
+	if t, err := time.Parse(time.RFC3339, lastSeen.String); err == nil && (oldest.IsZero() || t.Before(oldest)) {
+		oldest = t.Local()
+	}
+	if oldest.IsZero() {
+		return time.Time{}, false, nil
+	}
+	start, _ := calendarMonth(oldest)
+	return start, true, nil
+}
+
+// writeUserHourlyCSV writes the hourly rows of [start, end) to w. The
+// query limits do not apply: archived rows are deleted, so the export must
+// be complete.
+func (s *StatsDB) writeUserHourlyCSV(ctx context.Context, w io.Writer, start, end time.Time) (int64, error) {
+	rows, err := s.sqlDB().QueryContext(ctx, `SELECT user, hour, upload, download, conn_count FROM hourly_stats
+		WHERE hour >= ? AND hour < ? ORDER BY hour, user`,
+		start.Format("2006-01-02T15:00:00"), end.Format("2006-01-02T15:00:00"))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"user", "hour", "upload", "download", "conn_count"})
+	var n int64
+	for rows.Next() {
+		var user, hour string
+		var upload, download, conns int64
+		if err := rows.Scan(&user, &hour, &upload, &download, &conns); err != nil {
+			return n, err
+		}
+		cw.Write([]string{user, hour, strconv.FormatInt(upload, 10), strconv.FormatInt(download, 10), strconv.FormatInt(conns, 10)})
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	cw.Flush()
+	return n, cw.Error()
+}
+
+// writeDomainCSV writes the domain rows last seen before end to w: their
+// totals are final unless the user visits the domain again
+func (s *StatsDB) writeDomainCSV(ctx context.Context, w io.Writer, end time.Time) (int64, error) {
+	rows, err := s.sqlDB().QueryContext(ctx, `SELECT user, domain, upload, download, conn_count, COALESCE(last_seen,'')
+		FROM domain_stats WHERE last_seen < ? ORDER BY user, domain`, end.Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"user", "domain", "upload", "download", "conn_count", "last_seen"})
+	var n int64
+	for rows.Next() {
+		var user, domain, lastSeen string
+		var upload, download, conns int64
+		if err := rows.Scan(&user, &domain, &upload, &download, &conns, &lastSeen); err != nil {
+			return n, err
+		}
+		cw.Write([]string{user, domain, strconv.FormatInt(upload, 10), strconv.FormatInt(download, 10), strconv.FormatInt(conns, 10), lastSeen})
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	cw.Flush()
+	return n, cw.Error()
+}
+
+// pruneArchived deletes the rows written by writeUserHourlyCSV and
+// writeDomainCSV for the same bounds, and records report
+func (s *StatsDB) pruneArchived(ctx context.Context, start, end time.Time, report ArchiveReport) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	tx, err := s.sqlDB().BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM hourly_stats WHERE hour >= ? AND hour < ?`,
+		start.Format("2006-01-02T15:00:00"), end.Format("2006-01-02T15:00:00")); err != nil {
+		return fmt.Errorf("delete hourly_stats: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM domain_stats WHERE last_seen < ?`, end.Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("delete domain_stats: %w", err)
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO retention_config (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, archiveKey, string(data)); err != nil {
+		return fmt.Errorf("record archive: %w", err)
+	}
+	return tx.Commit()
+}
+
+// LastArchive returns the report of the last archived month, or nil if
+// nothing was archived yet
+func (s *StatsDB) LastArchive() *ArchiveReport {
+	var value string
+	if err := s.sqlDB().QueryRow(`SELECT value FROM retention_config WHERE key = ?`, archiveKey).Scan(&value); err != nil {
+		return nil
+	}
+	var report ArchiveReport
+	if err := json.Unmarshal([]byte(value), &report); err != nil {
+		return nil
+	}
+	return &report
+}
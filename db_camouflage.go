@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// UpsertCamouflageContext adds the camouflage buckets to camouflage_stats,
+// rolled back if ctx is done before it commits
+func (s *StatsDB) UpsertCamouflageContext(ctx context.Context, m map[camouflageKey]*camouflageAgg) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	tx, err := s.sqlDB().BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO camouflage_stats (hour, path, country, country_name, requests, upload, download)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(hour, path, country) DO UPDATE SET
+			requests = requests + excluded.requests,
+			upload   = upload   + excluded.upload,
+			download = download + excluded.download`)
+	if err != nil {
+		return fmt.Errorf("prepare camouflage_stats: %w", err)
+	}
+	defer stmt.Close()
+
+	for key, agg := range m {
+		if _, err := stmt.ExecContext(ctx, key.Hour, key.Path, key.Country, agg.CountryName, agg.Requests, agg.Upload, agg.Download); err != nil {
+			return fmt.Errorf("exec camouflage_stats: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// DBCamouflageStats summarizes the requests answered on behalf of the
+// camouflage site: clients without a valid certificate, mostly scanners
+type DBCamouflageStats struct {
+	Hours        int                 `json:"hours"`
+	Requests     uint64              `json:"requests"`
+	Upload       uint64              `json:"upload"`   // Request bytes
+	Download     uint64              `json:"download"` // Response bytes
+	TopPaths     []DBCamouflageEntry `json:"top_paths"`
+	TopCountries []DBCamouflageEntry `json:"top_countries"` // Of the clients
+	Hourly       []DBTrendPoint      `json:"hourly"`        // connections holds the requests
+}
+
+// DBCamouflageEntry is the camouflage traffic of one path or country
+type DBCamouflageEntry struct {
+	Key      string `json:"key"`
+	Name     string `json:"name,omitempty"`
+	Requests uint64 `json:"requests"`
+	Upload   uint64 `json:"upload"`
+	Download uint64 `json:"download"`
+}
+
+// GetCamouflageStats returns the camouflage traffic of the last hours, with
+// the limit busiest paths and client countries
+func (s *StatsDB) GetCamouflageStats(ctx context.Context, hours, limit int) (*DBCamouflageStats, error) {
+	c := &DBCamouflageStats{Hours: hours, TopPaths: []DBCamouflageEntry{}, TopCountries: []DBCamouflageEntry{}, Hourly: []DBTrendPoint{}}
+	since := time.Now().Add(-time.Duration(hours-1) * time.Hour).Format("2006-01-02T15:00:00")
+	err := s.queryRow(ctx, `SELECT COALESCE(SUM(requests),0), COALESCE(SUM(upload),0), COALESCE(SUM(download),0)
+		FROM camouflage_stats WHERE hour>=?`, since).Scan(&c.Requests, &c.Upload, &c.Download)
+	if err != nil {
+		return nil, err
+	}
+
+	var partial error
+	for _, part := range []struct {
+		query string
+		out   *[]DBCamouflageEntry
+	}{
+		{`SELECT path, '', SUM(requests), SUM(upload), SUM(download) FROM camouflage_stats
+			WHERE hour>=? GROUP BY path ORDER BY SUM(requests) DESC, path LIMIT ?`, &c.TopPaths},
+		{`SELECT country, COALESCE(MAX(country_name),''), SUM(requests), SUM(upload), SUM(download) FROM camouflage_stats
+			WHERE hour>=? GROUP BY country ORDER BY SUM(requests) DESC, country LIMIT ?`, &c.TopCountries},
+	} {
+		rows, err := s.query(ctx, part.query, since, limit)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var e DBCamouflageEntry
+			if err := rows.Scan(&e.Key, &e.Name, &e.Requests, &e.Upload, &e.Download); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			*part.out = append(*part.out, e)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			if !errors.Is(err, ErrPartialResult) {
+				return nil, err
+			}
+			partial = err
+		}
+	}
+
+	rows, err := s.query(ctx, `SELECT hour, SUM(upload), SUM(download), SUM(requests) FROM camouflage_stats
+		WHERE hour>=? GROUP BY hour ORDER BY hour`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p DBTrendPoint
+		if err := rows.Scan(&p.Time, &p.Upload, &p.Download, &p.Conns); err != nil {
+			return nil, err
+		}
+		c.Hourly = append(c.Hourly, p)
+	}
+	if err := rows.Err(); err != nil {
+		return c, err
+	}
+	return c, partial
+}
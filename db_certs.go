@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Sources of a certificate in the inventory
+const (
+	ClientCertImported = "import" // Issued elsewhere and imported
+)
+
+// DBClientCert is a client certificate in the inventory
+type DBClientCert struct {
+	SHA256    string    `json:"sha256"` // Fingerprint of the DER
+	Username  string    `json:"username"`
+	Serial    string    `json:"serial"` // Hex
+	Issuer    string    `json:"issuer"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Source    string    `json:"source"`
+	AddedBy   string    `json:"added_by,omitempty"`
+	AddedAt   time.Time `json:"added_at"`
+}
+
+// AddClientCert adds c to the inventory. It reports false if a certificate
+// with the same fingerprint is there already.
+func (s *StatsDB) AddClientCert(c DBClientCert) (bool, error) {
+	if s.ReadOnly() {
+		return false, errStatsReadOnly
+	}
+	res, err := s.sqlDB().Exec(`INSERT INTO client_certs (sha256, username, serial, issuer, not_before, not_after, source, added_by, added_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(sha256) DO NOTHING`,
+		c.SHA256, c.Username, c.Serial, c.Issuer, c.NotBefore.UTC().Format(time.RFC3339), c.NotAfter.UTC().Format(time.RFC3339),
+		c.Source, c.AddedBy, c.AddedAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// HasClientCert reports whether the certificate with fingerprint sha256 is
+// in the inventory
+func (s *StatsDB) HasClientCert(ctx context.Context, sha256 string) (bool, error) {
+	rows, err := s.query(ctx, `SELECT 1 FROM client_certs WHERE sha256 = ?`, sha256)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), rows.Err()
+}
+
+// LatestClientCert returns the latest NotAfter of username's certificates
+// in the inventory, zero without any
+func (s *StatsDB) LatestClientCert(ctx context.Context, username string) (time.Time, error) {
+	rows, err := s.query(ctx, `SELECT COALESCE(MAX(not_after), '') FROM client_certs WHERE username = ?`, username)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer rows.Close()
+	var latest string
+	if rows.Next() {
+		if err := rows.Scan(&latest); err != nil {
+			return time.Time{}, err
+		}
+	}
+	t, _ := time.Parse(time.RFC3339, latest)
+	return t, rows.Err()
+}
+
+// GetClientCerts returns the inventory, or username's part of it, by user
+// and latest expiry first
+func (s *StatsDB) GetClientCerts(ctx context.Context, username string) ([]DBClientCert, error) {
+	query := `SELECT sha256, username, serial, COALESCE(issuer,''), not_before, not_after, source, COALESCE(added_by,''), added_at FROM client_certs`
+	args := []interface{}{}
+	if username != "" {
+		query += ` WHERE username = ?`
+		args = append(args, username)
+	}
+	rows, err := s.query(ctx, query+` ORDER BY username, not_after DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []DBClientCert{}
+	for rows.Next() {
+		var c DBClientCert
+		var notBefore, notAfter, addedAt string
+		if err := rows.Scan(&c.SHA256, &c.Username, &c.Serial, &c.Issuer, &notBefore, &notAfter, &c.Source, &c.AddedBy, &addedAt); err != nil {
+			return nil, err
+		}
+		c.NotBefore, _ = time.Parse(time.RFC3339, notBefore)
+		c.NotAfter, _ = time.Parse(time.RFC3339, notAfter)
+		c.AddedAt, _ = time.Parse(time.RFC3339, addedAt)
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// EnsureUser registers username in user_stats if it has no row yet, so
+// users show up before their first connection
+func (s *StatsDB) EnsureUser(username string) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`INSERT INTO user_stats (username, first_seen, last_access) VALUES (?, datetime('now'), datetime('now')) ON CONFLICT(username) DO NOTHING`, username)
+	return err
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// DBCountryUser is one user's traffic from a country
+type DBCountryUser struct {
+	Username  string `json:"username"`
+	Upload    uint64 `json:"upload"`
+	Download  uint64 `json:"download"`
+	ConnCount uint64 `json:"conn_count"`
+	LastSeen  string `json:"last_seen"`
+}
+
+// DBCountryDetail is the drill-down view of a single country
+type DBCountryDetail struct {
+	DBCountryStats
+	UserCount  int             `json:"user_count"`
+	TopUsers   []DBCountryUser `json:"top_users"`
+	TopDomains []DBDomainStats `json:"top_domains"`
+	Hourly     []DBTrendPoint  `json:"hourly"`
+}
+
+// GetCountryDetail returns the totals, top users and top domains of a country
+// and its hourly traffic over the last hours. It returns sql.ErrNoRows if no
+// traffic has been seen from the country.
+func (s *StatsDB) GetCountryDetail(ctx context.Context, code string, limit, hours int) (*DBCountryDetail, error) {
+	d := &DBCountryDetail{TopUsers: []DBCountryUser{}, TopDomains: []DBDomainStats{}, Hourly: []DBTrendPoint{}}
+	err := s.queryRow(ctx, `SELECT country, COALESCE(MAX(country_name),''), COALESCE(MAX(continent),''),
+		SUM(upload), SUM(download), SUM(conn_count), COUNT(*) FROM country_stats WHERE country=? GROUP BY country`, code).
+		Scan(&d.Country, &d.CountryName, &d.Continent, &d.Upload, &d.Download, &d.ConnCount, &d.UserCount)
+	if err != nil {
+		return nil, err
+	}
+
+	// A part cut short by the query limits leaves the others whole; the
+	// result is still reported partial
+	var partial error
+	rows, err := s.query(ctx, `SELECT user, upload, download, conn_count, COALESCE(last_seen,'') FROM country_stats
+		WHERE country=? ORDER BY upload+download DESC LIMIT ?`, code, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u DBCountryUser
+		if err := rows.Scan(&u.Username, &u.Upload, &u.Download, &u.ConnCount, &u.LastSeen); err != nil {
+			return nil, err
+		}
+		d.TopUsers = append(d.TopUsers, u)
+	}
+	if err := rows.Err(); err != nil {
+		if !errors.Is(err, ErrPartialResult) {
+			return nil, err
+		}
+		partial = err
+	}
+
+	rows, err = s.query(ctx, `SELECT domain, upload, download, conn_count, COALESCE(last_seen,'') FROM country_domain_stats
+		WHERE country=? ORDER BY upload+download DESC LIMIT ?`, code, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dom DBDomainStats
+		if err := rows.Scan(&dom.Domain, &dom.Upload, &dom.Download, &dom.ConnCount, &dom.LastSeen); err != nil {
+			return nil, err
+		}
+		d.TopDomains = append(d.TopDomains, dom)
+	}
+	if err := rows.Err(); err != nil {
+		if !errors.Is(err, ErrPartialResult) {
+			return nil, err
+		}
+		partial = err
+	}
+
+	since := time.Now().Add(-time.Duration(hours) * time.Hour).Format("2006-01-02T15:00:00")
+	rows, err = s.query(ctx, `SELECT hour, upload, download, conn_count FROM country_hourly_stats
+		WHERE country=? AND hour>=? ORDER BY hour`, code, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p DBTrendPoint
+		if err := rows.Scan(&p.Time, &p.Upload, &p.Download, &p.Conns); err != nil {
+			return nil, err
+		}
+		d.Hourly = append(d.Hourly, p)
+	}
+	if err := rows.Err(); err != nil {
+		return d, err
+	}
+	return d, partial
+}
+
+// DBGeoTrends is hourly traffic per country or continent, the top ones
+// by traffic with the rest summed up as "other"
+type DBGeoTrends struct {
+	Range  string             `json:"range"`
+	By     string             `json:"by"`    // country or continent
+	Hours  []string           `json:"hours"` // Buckets, oldest first; every series has a point for each
+	Series []DBGeoTrendSeries `json:"series"`
+}
+
+// DBGeoTrendSeries is the traffic of one country, continent or "other"
+type DBGeoTrendSeries struct {
+	Key      string         `json:"key"` // Country or continent code, "other" or "unknown"
+	Name     string         `json:"name,omitempty"`
+	Upload   uint64         `json:"upload"`
+	Download uint64         `json:"download"`
+	Conns    uint64         `json:"connections"`
+	Points   []DBTrendPoint `json:"points"`
+}
+
+// geoTrendRanges are the hours covered by each range of GetGeoTrends
+var geoTrendRanges = map[string]int{"24h": 24, "7d": 7 * 24}
+
+// GetGeoTrends returns the hourly traffic over rangeStr ("24h" or "7d") of
+// the top countries, or continents if by is "continent", with the others
+// as one "other" series
+func (s *StatsDB) GetGeoTrends(ctx context.Context, rangeStr, by string, top int) (*DBGeoTrends, error) {
+	hours, ok := geoTrendRanges[rangeStr]
+	if !ok {
+		rangeStr, hours = "24h", 24
+	}
+	if by != "continent" {
+		by = "country"
+	}
+	end := time.Now().Truncate(time.Hour)
+	start := end.Add(-time.Duration(hours-1) * time.Hour)
+	t := &DBGeoTrends{Range: rangeStr, By: by, Series: []DBGeoTrendSeries{}}
+	index := make(map[string]int, hours)
+	for h := start; !h.After(end); h = h.Add(time.Hour) {
+		index[h.Format("2006-01-02T15:00:00")] = len(t.Hours)
+		t.Hours = append(t.Hours, h.Format("2006-01-02T15:00:00"))
+	}
+
+	// Names and continents are kept per user in country_stats
+	rows, err := s.query(ctx, `SELECT h.hour, h.country, COALESCE(c.name,''), COALESCE(c.continent,''), h.upload, h.download, h.conn_count
+		FROM country_hourly_stats h LEFT JOIN (SELECT country, MAX(country_name) AS name, MAX(continent) AS continent
+			FROM country_stats GROUP BY country) c ON c.country=h.country
+		WHERE h.hour>=? ORDER BY h.hour`, t.Hours[0])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	series := make(map[string]*DBGeoTrendSeries)
+	for rows.Next() {
+		var hour, country, name, continent string
+		var up, down, conns uint64
+		if err := rows.Scan(&hour, &country, &name, &continent, &up, &down, &conns); err != nil {
+			return nil, err
+		}
+		i, ok := index[hour]
+		if !ok {
+			continue
+		}
+		key := country
+		if by == "continent" {
+			key, name = continent, ""
+		}
+		if key == "" {
+			key = "unknown"
+		}
+		sr := series[key]
+		if sr == nil {
+			sr = &DBGeoTrendSeries{Key: key, Name: name, Points: make([]DBTrendPoint, len(t.Hours))}
+			series[key] = sr
+		}
+		sr.addPoint(i, up, down, conns)
+	}
+	partial := rows.Err()
+	if partial != nil && !errors.Is(partial, ErrPartialResult) {
+		return nil, partial
+	}
+
+	all := make([]*DBGeoTrendSeries, 0, len(series))
+	for _, sr := range series {
+		all = append(all, sr)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if a, b := all[i].Upload+all[i].Download, all[j].Upload+all[j].Download; a != b {
+			return a > b
+		}
+		return all[i].Key < all[j].Key
+	})
+	var other *DBGeoTrendSeries
+	for i, sr := range all {
+		if i < top {
+			t.Series = append(t.Series, *sr)
+			continue
+		}
+		if other == nil {
+			other = &DBGeoTrendSeries{Key: "other", Points: make([]DBTrendPoint, len(t.Hours))}
+		}
+		for j, p := range sr.Points {
+			other.addPoint(j, p.Upload, p.Download, p.Conns)
+		}
+	}
+	if other != nil {
+		t.Series = append(t.Series, *other)
+	}
+	for i := range t.Series {
+		for j := range t.Series[i].Points {
+			t.Series[i].Points[j].Time = t.Hours[j]
+		}
+	}
+	return t, partial
+}
+
+// addPoint adds traffic to the series' i-th hour and its totals
+func (sr *DBGeoTrendSeries) addPoint(i int, up, down, conns uint64) {
+	p := &sr.Points[i]
+	p.Upload += up
+	p.Download += down
+	p.Conns += conns
+	sr.Upload += up
+	sr.Download += down
+	sr.Conns += conns
+}
+
+// UpsertCountryRateHits adds the buffered hits of country rate limits in
+// one transaction
+func (s *StatsDB) UpsertCountryRateHits(ctx context.Context, hits map[countryHitKey]*countryHitAgg) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	tx, err := s.sqlDB().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO country_rate_hits (country, hour, hits, last_hit) VALUES (?, ?, ?, ?)
+		ON CONFLICT(country, hour) DO UPDATE SET hits = hits + excluded.hits, last_hit = MAX(last_hit, excluded.last_hit)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for key, agg := range hits {
+		if _, err := stmt.ExecContext(ctx, key.Country, key.Hour, agg.Hits, agg.LastHit.UTC().Format(time.RFC3339)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DBCountryRateHits counts the tunnels a country's rate limit paced
+type DBCountryRateHits struct {
+	Hits    uint64
+	LastHit time.Time
+}
+
+// GetCountryRateHits returns the hits of each country's rate limit in the
+// hours from since on
+func (s *StatsDB) GetCountryRateHits(ctx context.Context, since string) (map[string]DBCountryRateHits, error) {
+	rows, err := s.query(ctx, `SELECT country, SUM(hits), MAX(last_hit) FROM country_rate_hits WHERE hour >= ? GROUP BY country`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]DBCountryRateHits)
+	for rows.Next() {
+		var country, last string
+		var h DBCountryRateHits
+		if err := rows.Scan(&country, &h.Hits, &last); err != nil {
+			return nil, err
+		}
+		h.LastHit, _ = time.Parse(time.RFC3339, last)
+		out[country] = h
+	}
+	return out, rows.Err()
+}
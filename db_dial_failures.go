@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// UpsertDialFailuresContext adds the failed-dial buckets to dial_failures,
+// rolled back if ctx is done before it commits
+func (s *StatsDB) UpsertDialFailuresContext(ctx context.Context, m map[dialFailureKey]*dialFailureAgg) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	tx, err := s.sqlDB().BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO dial_failures (user, domain, error_class, count, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user, domain, error_class) DO UPDATE SET
+			count     = count + excluded.count,
+			last_seen = MAX(last_seen, excluded.last_seen)`)
+	if err != nil {
+		return fmt.Errorf("prepare dial_failures: %w", err)
+	}
+	defer stmt.Close()
+
+	for key, agg := range m {
+		if _, err := stmt.ExecContext(ctx, key.Username, key.Domain, key.Class, agg.Count,
+			agg.FirstSeen.Format(time.RFC3339), agg.LastSeen.Format(time.RFC3339)); err != nil {
+			return fmt.Errorf("exec dial_failures: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// DBDialFailure is a user's failed dials to one destination with one error
+type DBDialFailure struct {
+	Domain    string `json:"domain"`
+	Class     string `json:"error_class"` // dial_timeout, dns_failure or dial_failed
+	Count     uint64 `json:"count"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+}
+
+// GetDialFailures returns the limit destinations username failed to reach
+// most often
+func (s *StatsDB) GetDialFailures(ctx context.Context, username string, limit int) ([]DBDialFailure, error) {
+	rows, err := s.query(ctx, `SELECT domain, error_class, count, COALESCE(first_seen,''), COALESCE(last_seen,'')
+		FROM dial_failures WHERE user = ? ORDER BY count DESC, domain LIMIT ?`, username, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failures := []DBDialFailure{}
+	for rows.Next() {
+		var f DBDialFailure
+		if err := rows.Scan(&f.Domain, &f.Class, &f.Count, &f.FirstSeen, &f.LastSeen); err != nil {
+			return nil, err
+		}
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// User event types recorded in user_events. Activity and first-seen entries
+// in the timeline are derived from the traffic tables instead.
+const (
+	EventUserDisabled = "user_disabled"
+	EventUserEnabled  = "user_enabled"
+	// A TLS-only user's tunnel carried another protocol
+	EventProtocolViolation = "protocol_violation"
+	// A user was flagged for likely BitTorrent / P2P traffic
+	EventP2PSuspected = "p2p_suspected"
+	// An admin set or cleared a user's expiry date
+	EventExpirySet = "expiry_set"
+	// A user's expiry date is within the warning period
+	EventExpiryWarning = "expiry_warning"
+	// A trial account was created, or converted to a regular user
+	EventTrialCreated   = "trial_created"
+	EventTrialConverted = "trial_converted"
+	// A tunnel went to a destination on a reputation feed
+	EventReputationMatch = "reputation_match"
+	// A user connected from an address on a DNS blocklist
+	EventDNSBLListed = "dnsbl_listed"
+	// A tunnel was closed for carrying more than its transfer limit
+	EventTransferLimit = "transfer_limit"
+	// An admin set or removed a user's traffic quota
+	EventQuotaSet = "quota_set"
+	// A user used up their quota and is refused until the period resets
+	EventQuotaExceeded = "quota_exceeded"
+	// An admin put a user in a group or took them out
+	EventGroupChanged = "group_changed"
+	// A client certificate of the user issued elsewhere was imported
+	EventCertImported = "cert_imported"
+)
+
+// anomalyEventTypes are the user events listed in the anomalies view
+var anomalyEventTypes = []string{EventProtocolViolation, EventP2PSuspected, EventReputationMatch, EventDNSBLListed, EventTransferLimit}
+
+// timelineSessionGap is the idle time that splits minute_stats rows into
+// separate activity sessions
+const timelineSessionGap = 5 * time.Minute
+
+// TimelineEntry is one item of a user's activity feed
+type TimelineEntry struct {
+	Time      string `json:"time"`
+	End       string `json:"end,omitempty"`
+	Type      string `json:"type"`
+	Actor     string `json:"actor,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+	Upload    uint64 `json:"upload,omitempty"`
+	Download  uint64 `json:"download,omitempty"`
+	ConnCount uint64 `json:"conn_count,omitempty"`
+}
+
+// RecordUserEvent appends an event (admin action, alert, ...) to the user's
+// history. actor identifies who or what caused it, e.g. "web:admin".
+func (s *StatsDB) RecordUserEvent(username, eventType, actor, detail string) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`INSERT INTO user_events (user, time, type, actor, detail) VALUES (?, ?, ?, ?, ?)`,
+		username, time.Now().UTC().Format(time.RFC3339), eventType, actor, detail)
+	return err
+}
+
+// UserEvent is a recorded user event
+type UserEvent struct {
+	User   string `json:"user"`
+	Time   string `json:"time"`
+	Type   string `json:"type"`
+	Actor  string `json:"actor,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// GetAnomalies returns the anomaly events (protocol violations, suspected
+// P2P use) of all users since the given time, newest first
+func (s *StatsDB) GetAnomalies(ctx context.Context, since time.Time, limit int) ([]UserEvent, error) {
+	args := make([]interface{}, 0, len(anomalyEventTypes)+2)
+	for _, t := range anomalyEventTypes {
+		args = append(args, t)
+	}
+	args = append(args, since.UTC().Format(time.RFC3339), limit)
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(anomalyEventTypes)), ",")
+	rows, err := s.query(ctx, `SELECT user, time, type, COALESCE(actor,''), COALESCE(detail,'') FROM user_events
+		WHERE type IN (`+placeholders+`) AND time >= ? ORDER BY id DESC LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []UserEvent{}
+	for rows.Next() {
+		var e UserEvent
+		if err := rows.Scan(&e.User, &e.Time, &e.Type, &e.Actor, &e.Detail); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// GetUserTimeline returns the user's recorded events, activity sessions built
+// from minute_stats and the first-seen marker, newest first
+func (s *StatsDB) GetUserTimeline(ctx context.Context, username string, limit int) ([]TimelineEntry, error) {
+	var entries []TimelineEntry
+
+	rows, err := s.query(ctx, `SELECT time, type, COALESCE(actor,''), COALESCE(detail,'') FROM user_events
+		WHERE user=? ORDER BY id DESC LIMIT ?`, username, limit)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var e TimelineEntry
+		if err := rows.Scan(&e.Time, &e.Type, &e.Actor, &e.Detail); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	// Parts cut short by the query limits still fill the timeline, which
+	// is then reported partial
+	var partial error
+	if err := rows.Err(); err != nil {
+		if !errors.Is(err, ErrPartialResult) {
+			return nil, err
+		}
+		partial = err
+	}
+
+	sessions, err := s.activitySessions(ctx, username)
+	if err != nil {
+		if !errors.Is(err, ErrPartialResult) {
+			return nil, err
+		}
+		partial = err
+	}
+	entries = append(entries, sessions...)
+
+	var firstSeen string
+	s.queryRow(ctx, `SELECT COALESCE(first_seen,'') FROM user_stats WHERE username=?`, username).Scan(&firstSeen)
+	if firstSeen != "" {
+		entries = append(entries, TimelineEntry{Time: normalizeTimelineTime(firstSeen), Type: "first_seen"})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time > entries[j].Time })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, partial
+}
+
+// activitySessions folds consecutive minute_stats rows into sessions
+func (s *StatsDB) activitySessions(ctx context.Context, username string) ([]TimelineEntry, error) {
+	rows, err := s.query(ctx, `SELECT minute, upload, download, conn_count FROM minute_stats WHERE user=? ORDER BY minute`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []TimelineEntry
+	var last time.Time
+	for rows.Next() {
+		var minute string
+		var up, down, conns uint64
+		if err := rows.Scan(&minute, &up, &down, &conns); err != nil {
+			return nil, err
+		}
+		t, err := time.ParseInLocation("2006-01-02T15:04:05", minute, time.Local)
+		if err != nil {
+			continue
+		}
+		if len(sessions) == 0 || t.Sub(last) > timelineSessionGap {
+			sessions = append(sessions, TimelineEntry{Time: t.UTC().Format(time.RFC3339), Type: "activity"})
+		}
+		cur := &sessions[len(sessions)-1]
+		cur.End = t.Add(time.Minute).UTC().Format(time.RFC3339)
+		cur.Upload += up
+		cur.Download += down
+		cur.ConnCount += conns
+		last = t
+	}
+	return sessions, rows.Err()
+}
+
+// normalizeTimelineTime converts the timestamp formats stored by the stats
+// tables to UTC RFC3339 so entries sort chronologically
+func normalizeTimelineTime(v string) string {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.UTC().Format(time.RFC3339)
+		}
+	}
+	return v
+}
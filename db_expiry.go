@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Sources of a user's expiry date
+const (
+	ExpirySourceAPI  = "api"  // set by an admin
+	ExpirySourceCert = "cert" // the NotAfter of the user's client certificate
+	// the end of a trial account, replaced only by an admin
+	ExpirySourceTrial = "trial"
+)
+
+// UserExpiry is the date after which a user is disabled automatically
+type UserExpiry struct {
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Source    string    `json:"source"`
+	// DaysRemaining is counted from when the expiry was read; negative once
+	// expired
+	DaysRemaining int  `json:"days_remaining"`
+	Warned        bool `json:"warned"`
+	Expired       bool `json:"expired"`
+}
+
+// daysRemaining counts whole days left before t, rounding down
+func daysRemaining(t, now time.Time) int {
+	return int(math.Floor(t.Sub(now).Hours() / 24))
+}
+
+// SetUserExpiry sets when username expires. A date from the certificate
+// never replaces one set by an admin. Moving the date re-arms the warning
+// and the automatic disable.
+func (s *StatsDB) SetUserExpiry(username string, expiresAt time.Time, source string) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`INSERT INTO user_expiry (username, expires_at, source) VALUES (?, ?, ?)
+		ON CONFLICT(username) DO UPDATE SET
+			warned     = CASE WHEN expires_at = excluded.expires_at THEN warned ELSE 0 END,
+			expired    = CASE WHEN expires_at = excluded.expires_at THEN expired ELSE 0 END,
+			expires_at = excluded.expires_at,
+			source     = excluded.source
+		WHERE excluded.source = ? OR user_expiry.source = ?`,
+		username, expiresAt.UTC().Format(time.RFC3339), source, ExpirySourceAPI, ExpirySourceCert)
+	return err
+}
+
+// ClearUserExpiry removes username's expiry date
+func (s *StatsDB) ClearUserExpiry(username string) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`DELETE FROM user_expiry WHERE username = ?`, username)
+	return err
+}
+
+// GetUserExpiry returns username's expiry, or nil if none is set
+func (s *StatsDB) GetUserExpiry(ctx context.Context, username string, now time.Time) (*UserExpiry, error) {
+	all, err := s.queryExpiries(ctx, `WHERE username = ?`, username)
+	if err != nil || len(all) == 0 {
+		return nil, err
+	}
+	e := all[0]
+	e.DaysRemaining = daysRemaining(e.ExpiresAt, now)
+	return &e, nil
+}
+
+// UserExpiries returns every expiry date by username
+func (s *StatsDB) UserExpiries(ctx context.Context, now time.Time) (map[string]UserExpiry, error) {
+	all, err := s.queryExpiries(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]UserExpiry, len(all))
+	for _, e := range all {
+		e.DaysRemaining = daysRemaining(e.ExpiresAt, now)
+		out[e.Username] = e
+	}
+	return out, nil
+}
+
+func (s *StatsDB) queryExpiries(ctx context.Context, where string, args ...interface{}) ([]UserExpiry, error) {
+	rows, err := s.query(ctx, `SELECT username, expires_at, source, warned, expired FROM user_expiry `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []UserExpiry
+	for rows.Next() {
+		var e UserExpiry
+		var at string
+		var warned, expired int
+		if err := rows.Scan(&e.Username, &at, &e.Source, &warned, &expired); err != nil {
+			return nil, err
+		}
+		e.ExpiresAt, _ = time.Parse(time.RFC3339, at)
+		e.Warned, e.Expired = warned != 0, expired != 0
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// markExpiryWarned records that the advance warning for username was sent
+func (s *StatsDB) markExpiryWarned(username string) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`UPDATE user_expiry SET warned = 1 WHERE username = ?`, username)
+	return err
+}
+
+// markExpired records that username was disabled for expiring, so an admin
+// re-enabling the user is not undone
+func (s *StatsDB) markExpired(username string) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`UPDATE user_expiry SET warned = 1, expired = 1 WHERE username = ?`, username)
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// AssignUserGroup puts username in group
+func (s *StatsDB) AssignUserGroup(username, group, actor string) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`INSERT INTO user_groups (username, group_name, assigned_by, assigned_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(username, group_name) DO NOTHING`,
+		username, group, actor, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// UnassignUserGroup takes username out of group
+func (s *StatsDB) UnassignUserGroup(username, group string) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`DELETE FROM user_groups WHERE username = ? AND group_name = ?`, username, group)
+	return err
+}
+
+// GetGroupAssignments returns the groups users were put in through the
+// admin API, by username
+func (s *StatsDB) GetGroupAssignments(ctx context.Context) (map[string][]string, error) {
+	rows, err := s.query(ctx, `SELECT username, group_name FROM user_groups ORDER BY username, group_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string][]string)
+	for rows.Next() {
+		var username, group string
+		if err := rows.Scan(&username, &group); err != nil {
+			return nil, err
+		}
+		out[username] = append(out[username], group)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// LatencyBucket is one histogram bucket: observations at or below LE seconds
+type LatencyBucket struct {
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// DBLatencyHistogram is a persisted histogram with estimated percentiles
+type DBLatencyHistogram struct {
+	Scope   string          `json:"scope"`
+	Name    string          `json:"name"`
+	Metric  string          `json:"metric"`
+	Buckets []LatencyBucket `json:"buckets"`
+	Sum     float64         `json:"sum"`
+	Count   uint64          `json:"count"`
+	P50     float64         `json:"p50"`
+	P95     float64         `json:"p95"`
+}
+
+// UpsertLatency adds the histograms in h to the stored ones
+func (s *StatsDB) UpsertLatency(h map[latencyKey]*LatencyHistogram) error {
+	return s.UpsertLatencyContext(context.Background(), h)
+}
+
+// UpsertLatencyContext is UpsertLatency rolled back if ctx is done before it
+// commits
+func (s *StatsDB) UpsertLatencyContext(ctx context.Context, h map[latencyKey]*LatencyHistogram) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	if len(h) == 0 {
+		return nil
+	}
+	tx, err := s.sqlDB().BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO latency_histograms (scope, name, metric, b0, b1, b2, b3, b4, b5, b6, b7, sum, count)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(scope, name, metric) DO UPDATE SET
+			b0 = b0 + excluded.b0, b1 = b1 + excluded.b1, b2 = b2 + excluded.b2, b3 = b3 + excluded.b3,
+			b4 = b4 + excluded.b4, b5 = b5 + excluded.b5, b6 = b6 + excluded.b6, b7 = b7 + excluded.b7,
+			sum   = sum   + excluded.sum,
+			count = count + excluded.count`)
+	if err != nil {
+		return fmt.Errorf("prepare latency_histograms: %w", err)
+	}
+	defer stmt.Close()
+
+	for key, hist := range h {
+		args := []interface{}{key.Scope, key.Name, key.Metric}
+		for _, c := range hist.Counts {
+			args = append(args, c)
+		}
+		args = append(args, hist.Sum, hist.Count)
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return fmt.Errorf("exec latency_histograms (%s/%s): %w", key.Scope, key.Name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// GetLatencyHistograms returns the histograms of a scope ("user" or
+// "domain"), for one name if set, busiest first
+func (s *StatsDB) GetLatencyHistograms(ctx context.Context, scope, name string, limit int) ([]DBLatencyHistogram, error) {
+	q := `SELECT scope, name, metric, b0, b1, b2, b3, b4, b5, b6, b7, sum, count FROM latency_histograms WHERE scope=?`
+	args := []interface{}{scope}
+	if name != "" {
+		q += ` AND name=?`
+		args = append(args, name)
+	}
+	q += ` ORDER BY count DESC, name, metric LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []DBLatencyHistogram{}
+	for rows.Next() {
+		var d DBLatencyHistogram
+		var h LatencyHistogram
+		if err := rows.Scan(&d.Scope, &d.Name, &d.Metric, &h.Counts[0], &h.Counts[1], &h.Counts[2], &h.Counts[3],
+			&h.Counts[4], &h.Counts[5], &h.Counts[6], &h.Counts[7], &h.Sum, &h.Count); err != nil {
+			return nil, err
+		}
+		for i, c := range h.Counts {
+			d.Buckets = append(d.Buckets, LatencyBucket{LE: latencyBucketLabel(d.Metric, i), Count: c})
+		}
+		d.Sum, d.Count = h.Sum, h.Count
+		d.P50, d.P95 = h.quantile(d.Metric, 0.5), h.quantile(d.Metric, 0.95)
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
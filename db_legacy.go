@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// legacyImportKey is the retention_config key recording the one-time import
+// of the legacy JSON stats file
+const legacyImportKey = "legacy_json_import"
+
+// LegacyImport records when the legacy JSON stats were imported
+type LegacyImport struct {
+	Time  time.Time `json:"time"`
+	File  string    `json:"file"`
+	Users int       `json:"users"`
+	// Assumed is set when the database already held users imported by a
+	// release that re-imported the file on every start
+	Assumed bool `json:"assumed,omitempty"`
+}
+
+// LegacyImport returns the import record, or nil if the legacy stats have
+// not been imported yet
+func (s *StatsDB) LegacyImport(ctx context.Context) *LegacyImport {
+	var value string
+	if err := s.queryRow(ctx, `SELECT value FROM retention_config WHERE key = ?`, legacyImportKey).Scan(&value); err != nil {
+		return nil
+	}
+	var imp LegacyImport
+	if err := json.Unmarshal([]byte(value), &imp); err != nil {
+		return nil
+	}
+	return &imp
+}
+
+// SetLegacyImport stores the import record so the file is not imported again
+func (s *StatsDB) SetLegacyImport(imp LegacyImport) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	data, err := json.Marshal(imp)
+	if err != nil {
+		return err
+	}
+	_, err = s.sqlDB().Exec(`INSERT INTO retention_config (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value`, legacyImportKey, string(data))
+	return err
+}
+
+// ExportLegacyJSON returns the users in the format of the legacy JSON stats
+// file, for tooling that still reads it. Upload and download are summed into
+// total_bytes, which is all the legacy format tracked.
+func (s *StatsDB) ExportLegacyJSON(ctx context.Context) (map[string]*UserStats, error) {
+	rows, err := s.query(ctx, `SELECT username, total_upload + total_download, request_count, conn_count,
+		COALESCE(first_seen,''), COALESCE(last_access,''), disabled FROM user_stats`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]*UserStats)
+	for rows.Next() {
+		var us UserStats
+		var firstSeen, lastAccess string
+		var dis int
+		if err := rows.Scan(&us.Username, &us.TotalBytes, &us.RequestsCount, &us.ConnectionCount, &firstSeen, &lastAccess, &dis); err != nil {
+			return nil, err
+		}
+		us.ConnectedSince, _ = time.Parse(time.RFC3339, normalizeTimelineTime(firstSeen))
+		us.LastAccess, _ = time.Parse(time.RFC3339, normalizeTimelineTime(lastAccess))
+		us.Disabled = dis != 0
+		out[us.Username] = &us
+	}
+	return out, rows.Err()
+}
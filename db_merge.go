@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// mergeTable is how MergeFrom folds one table of another database into
+// this one
+type mergeTable struct {
+	name    string
+	columns string
+	// conflict is the ON CONFLICT clause; empty appends the rows
+	conflict string
+}
+
+// laterOf and earlierOf keep the later/earlier of a column's two
+// timestamps, or whichever is not NULL
+func laterOf(table, col string) string {
+	return fmt.Sprintf("COALESCE(MAX(%[1]s.%[2]s, excluded.%[2]s), %[1]s.%[2]s, excluded.%[2]s)", table, col)
+}
+
+func earlierOf(table, col string) string {
+	return fmt.Sprintf("COALESCE(MIN(%[1]s.%[2]s, excluded.%[2]s), %[1]s.%[2]s, excluded.%[2]s)", table, col)
+}
+
+// sumTraffic adds the traffic counters of a conflicting row
+const sumTraffic = `upload = %[1]s.upload + excluded.upload, download = %[1]s.download + excluded.download,
+	conn_count = %[1]s.conn_count + excluded.conn_count`
+
+// mergeTables lists every table MergeFrom copies. Counters are summed and
+// first/last seen times widened; settings-like tables only gain the rows
+// missing here.
+var mergeTables = []mergeTable{
+	{"user_stats", "username, total_upload, total_download, conn_count, request_count, first_seen, last_access, disabled",
+		`(username) DO UPDATE SET total_upload = user_stats.total_upload + excluded.total_upload,
+		total_download = user_stats.total_download + excluded.total_download,
+		conn_count = user_stats.conn_count + excluded.conn_count,
+		request_count = user_stats.request_count + excluded.request_count,
+		first_seen = ` + earlierOf("user_stats", "first_seen") + `,
+		last_access = ` + laterOf("user_stats", "last_access") + `,
+		disabled = MAX(user_stats.disabled, excluded.disabled)`},
+	{"domain_stats", "user, domain, upload, download, conn_count, last_seen",
+		`(user, domain) DO UPDATE SET ` + fmt.Sprintf(sumTraffic, "domain_stats") + `, last_seen = ` + laterOf("domain_stats", "last_seen")},
+	{"minute_stats", "user, minute, upload, download, conn_count",
+		`(user, minute) DO UPDATE SET ` + fmt.Sprintf(sumTraffic, "minute_stats")},
+	{"hourly_stats", "user, hour, upload, download, conn_count",
+		`(user, hour) DO UPDATE SET ` + fmt.Sprintf(sumTraffic, "hourly_stats")},
+	{"country_stats", "user, country, country_name, continent, upload, download, conn_count, last_seen",
+		`(user, country) DO UPDATE SET ` + fmt.Sprintf(sumTraffic, "country_stats") + `, last_seen = ` + laterOf("country_stats", "last_seen")},
+	{"country_domain_stats", "country, domain, upload, download, conn_count, last_seen",
+		`(country, domain) DO UPDATE SET ` + fmt.Sprintf(sumTraffic, "country_domain_stats") + `, last_seen = ` + laterOf("country_domain_stats", "last_seen")},
+	{"country_hourly_stats", "country, hour, upload, download, conn_count",
+		`(country, hour) DO UPDATE SET ` + fmt.Sprintf(sumTraffic, "country_hourly_stats")},
+	{"camouflage_stats", "hour, path, country, country_name, requests, upload, download",
+		`(hour, path, country) DO UPDATE SET requests = camouflage_stats.requests + excluded.requests,
+		upload = camouflage_stats.upload + excluded.upload, download = camouflage_stats.download + excluded.download`},
+	{"dial_failures", "user, domain, error_class, count, first_seen, last_seen",
+		`(user, domain, error_class) DO UPDATE SET count = dial_failures.count + excluded.count,
+		first_seen = ` + earlierOf("dial_failures", "first_seen") + `, last_seen = ` + laterOf("dial_failures", "last_seen")},
+	{"acl_blocks", "user, domain, rule, count, first_seen, last_seen",
+		`(user, domain, rule) DO UPDATE SET count = acl_blocks.count + excluded.count,
+		first_seen = ` + earlierOf("acl_blocks", "first_seen") + `, last_seen = ` + laterOf("acl_blocks", "last_seen")},
+	{"acl_rule_hits", "rule, hour, hits, last_hit",
+		`(rule, hour) DO UPDATE SET hits = acl_rule_hits.hits + excluded.hits, last_hit = ` + laterOf("acl_rule_hits", "last_hit")},
+	{"country_rate_hits", "country, hour, hits, last_hit",
+		`(country, hour) DO UPDATE SET hits = country_rate_hits.hits + excluded.hits, last_hit = ` + laterOf("country_rate_hits", "last_hit")},
+	{"tag_stats", "user, tag, upload, download, conn_count, last_seen",
+		`(user, tag) DO UPDATE SET ` + fmt.Sprintf(sumTraffic, "tag_stats") + `, last_seen = ` + laterOf("tag_stats", "last_seen")},
+	{"latency_histograms", "scope, name, metric, b0, b1, b2, b3, b4, b5, b6, b7, sum, count",
+		`(scope, name, metric) DO UPDATE SET b0 = b0 + excluded.b0, b1 = b1 + excluded.b1, b2 = b2 + excluded.b2,
+		b3 = b3 + excluded.b3, b4 = b4 + excluded.b4, b5 = b5 + excluded.b5, b6 = b6 + excluded.b6,
+		b7 = b7 + excluded.b7, sum = sum + excluded.sum, count = count + excluded.count`},
+	{"user_events", "user, time, type, actor, detail", ""},
+	{"tunnel_samples", "user, target, started, ended, interval_seconds, upload, download, upload_cap, download_cap, samples", ""},
+	{"nodes", "name, labels, first_seen, last_seen",
+		`(name) DO UPDATE SET first_seen = ` + earlierOf("nodes", "first_seen") + `, last_seen = ` + laterOf("nodes", "last_seen")},
+	{"node_hourly_stats", "node, user, hour, upload, download, conn_count",
+		`(node, user, hour) DO UPDATE SET ` + fmt.Sprintf(sumTraffic, "node_hourly_stats")},
+	{"retention_config", "key, value", `DO NOTHING`},
+	{"user_trials", "username, created_at, created_by, quota_bytes, rate_bytes", `DO NOTHING`},
+	{"user_quotas", "username, period, quota_bytes, set_by, set_at", `DO NOTHING`},
+	{"user_groups", "username, group_name, assigned_by, assigned_at", `DO NOTHING`},
+	{"admin_api_usage", "principal, method, endpoint, calls, errors, first_used, last_used",
+		`(principal, method, endpoint) DO UPDATE SET calls = admin_api_usage.calls + excluded.calls,
+		errors = admin_api_usage.errors + excluded.errors,
+		first_used = ` + earlierOf("admin_api_usage", "first_used") + `, last_used = ` + laterOf("admin_api_usage", "last_used")},
+	{"user_expiry", "username, expires_at, source, warned, expired", `DO NOTHING`},
+	{"acl_rules", "username, action, type, pattern, priority, created_by, created_at", `DO NOTHING`},
+	{"client_certs", "sha256, username, serial, issuer, not_before, not_after, source, added_by, added_at", `DO NOTHING`},
+}
+
+// MergeFrom adds the stats of the database at path, e.g. a decommissioned
+// node's, to this one in a single transaction and returns the rows read per
+// table. Tables the other database lacks are skipped. Merging the same file
+// twice counts its traffic twice.
+func (s *StatsDB) MergeFrom(path string) (map[string]int64, error) {
+	if s.ReadOnly() {
+		return nil, errStatsReadOnly
+	}
+	// ATTACH would create a missing file, and merging a file into itself
+	// doubles every counter
+	other, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if self, err := os.Stat(s.Path()); err == nil && os.SameFile(self, other) {
+		return nil, fmt.Errorf("%s is the stats database itself", path)
+	}
+
+	// ATTACH applies to one connection and cannot run inside a transaction
+	ctx := context.Background()
+	conn, err := s.sqlDB().Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS merge_src`, path); err != nil {
+		return nil, fmt.Errorf("attach %s: %w", path, err)
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE merge_src`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	counts := make(map[string]int64)
+	for _, t := range mergeTables {
+		var exists int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM merge_src.sqlite_master WHERE type = 'table' AND name = ?`, t.name).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+		if exists == 0 {
+			continue
+		}
+		// WHERE true keeps SQLite from reading ON CONFLICT as a join constraint
+		q := fmt.Sprintf(`INSERT INTO main.%[1]s (%[2]s) SELECT %[2]s FROM merge_src.%[1]s WHERE true`, t.name, t.columns)
+		if t.conflict != "" {
+			q += " ON CONFLICT " + t.conflict
+		}
+		res, err := tx.Exec(q)
+		if err != nil {
+			return nil, fmt.Errorf("merge %s: %w", t.name, err)
+		}
+		counts[t.name], _ = res.RowsAffected()
+	}
+	return counts, tx.Commit()
+}
+
+// MergeStatsDB merges the stats database at other into the one at dbPath,
+// for the -merge-db flag. The proxy should not be running against dbPath.
+func MergeStatsDB(dbPath, other string) error {
+	db, err := NewStatsDB(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	counts, err := db.MergeFrom(other)
+	if err != nil {
+		return err
+	}
+	abs, _ := filepath.Abs(other)
+	fmt.Printf("Merged %s into %s\n", abs, dbPath)
+	for _, t := range mergeTables {
+		if n, ok := counts[t.name]; ok {
+			fmt.Printf("  %-22s %d rows\n", t.name, n)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// moveMu serializes Move calls
+var moveMu sync.Mutex
+
+// errMoveRefused is wrapped by Move for targets it will not move to
+var errMoveRefused = errors.New("move refused")
+
+// Move relocates the database to newPath, e.g. off a filling disk, without
+// restarting the proxy. Writes pause meanwhile, so the collector keeps its
+// buffer; queries are served from the old file until the new one is open.
+//
+// The copy is made with VACUUM INTO while a write transaction is held, so
+// it includes everything committed, WAL frames too. The old file and its
+// -wal and -shm companions are removed once the new file is in use.
+func (s *StatsDB) Move(newPath string) error {
+	if s.openedRO {
+		return errors.New("stats database was opened read-only (stats.read_only)")
+	}
+	moveMu.Lock()
+	defer moveMu.Unlock()
+
+	oldPath := s.Path()
+	newPath = filepath.Clean(newPath)
+	if newAbs, err := filepath.Abs(newPath); err != nil {
+		return err
+	} else if oldAbs, err := filepath.Abs(oldPath); err == nil && newAbs == oldAbs {
+		return fmt.Errorf("%w: %s is the current stats database path", errMoveRefused, newPath)
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		return fmt.Errorf("%w: %s already exists", errMoveRefused, newPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return fmt.Errorf("create db dir: %w", err)
+	}
+
+	wasReadOnly := s.readOnly.Swap(true)
+	defer s.readOnly.Store(wasReadOnly)
+
+	old := s.sqlDB()
+	ctx := context.Background()
+	// Writes in progress finish before the lock is granted, and none can
+	// commit to the old file while it is copied
+	lock, err := old.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := lock.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		lock.Close()
+		return fmt.Errorf("lock database: %w", err)
+	}
+	unlock := func() {
+		lock.ExecContext(ctx, `ROLLBACK`)
+		lock.Close()
+	}
+
+	if _, err := old.ExecContext(ctx, `VACUUM INTO ?`, newPath); err != nil {
+		unlock()
+		os.Remove(newPath)
+		return fmt.Errorf("copy to %s: %w", newPath, err)
+	}
+	db, err := openSQLite(newPath)
+	if err != nil {
+		unlock()
+		os.Remove(newPath)
+		return err
+	}
+	s.file.Store(&statsFile{db: db, path: newPath})
+
+	// The old file is closed before it is removed, which Windows requires
+	unlock()
+	if err := old.Close(); err != nil {
+		log.Printf("[DB] Closing %s after the move: %v", oldPath, err)
+	}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(oldPath + suffix); err != nil && !os.IsNotExist(err) {
+			log.Printf("[DB] Removing %s after the move: %v", oldPath+suffix, err)
+		}
+	}
+	log.Printf("[DB] Stats database moved from %s to %s", oldPath, newPath)
+	return nil
+}
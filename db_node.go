@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// DBNodeStats is a proxy instance that recorded traffic into the database,
+// with its traffic over the requested window
+type DBNodeStats struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	FirstSeen time.Time         `json:"first_seen"`
+	LastSeen  time.Time         `json:"last_seen"`
+	Upload    uint64            `json:"upload"`
+	Download  uint64            `json:"download"`
+	ConnCount uint64            `json:"conn_count"`
+	Users     int               `json:"users"`
+}
+
+// DBNodeUserStats is one user's traffic through a node
+type DBNodeUserStats struct {
+	User      string `json:"user"`
+	Upload    uint64 `json:"upload"`
+	Download  uint64 `json:"download"`
+	ConnCount uint64 `json:"conn_count"`
+}
+
+// SetNode registers this proxy instance and its labels, and records its
+// name with the traffic flushed from now on
+func (s *StatsDB) SetNode(name string, labels map[string]string) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err := s.sqlDB().Exec(`INSERT INTO nodes (name, labels, first_seen, last_seen) VALUES (?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET labels = excluded.labels, last_seen = excluded.last_seen`, name, string(data), now, now); err != nil {
+		return err
+	}
+	s.node = name
+	return nil
+}
+
+// Node returns the name set by SetNode
+func (s *StatsDB) Node() string {
+	return s.node
+}
+
+// GetNodes returns the nodes with their traffic in the hours since since
+func (s *StatsDB) GetNodes(ctx context.Context, since time.Time) ([]DBNodeStats, error) {
+	rows, err := s.query(ctx, `SELECT n.name, COALESCE(n.labels,''), n.first_seen, n.last_seen,
+			COALESCE(SUM(h.upload),0), COALESCE(SUM(h.download),0), COALESCE(SUM(h.conn_count),0), COUNT(DISTINCT h.user)
+		FROM nodes n LEFT JOIN node_hourly_stats h ON h.node = n.name AND h.hour >= ?
+		GROUP BY n.name ORDER BY n.name`, since.Format("2006-01-02T15:00:00"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []DBNodeStats
+	for rows.Next() {
+		var n DBNodeStats
+		var labels, first, last string
+		if err := rows.Scan(&n.Name, &labels, &first, &last, &n.Upload, &n.Download, &n.ConnCount, &n.Users); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(labels), &n.Labels)
+		n.FirstSeen, _ = time.Parse(time.RFC3339, first)
+		n.LastSeen, _ = time.Parse(time.RFC3339, last)
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
+
+// GetNodeUsers returns the traffic of each user through node in the hours
+// since since, heaviest first
+func (s *StatsDB) GetNodeUsers(ctx context.Context, node string, since time.Time) ([]DBNodeUserStats, error) {
+	rows, err := s.query(ctx, `SELECT user, SUM(upload), SUM(download), SUM(conn_count) FROM node_hourly_stats
+		WHERE node = ? AND hour >= ? GROUP BY user ORDER BY SUM(upload)+SUM(download) DESC`, node, since.Format("2006-01-02T15:00:00"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []DBNodeUserStats
+	for rows.Next() {
+		var u DBNodeUserStats
+		if err := rows.Scan(&u.User, &u.Upload, &u.Download, &u.ConnCount); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
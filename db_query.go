@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrPartialResult is returned, wrapped, with the rows a read got before
+// the row limit or the query timeout cut it short. Callers may use the rows
+// but must not take them for the whole result.
+var ErrPartialResult = errors.New("partial result")
+
+// QueryLimits bound every read of the stats database, so a query over a
+// huge database cannot hold an API worker indefinitely
+type QueryLimits struct {
+	Timeout time.Duration // 0 leaves reads unbounded in time
+	MaxRows int           // 0 leaves reads unbounded in rows
+}
+
+// SetQueryLimits applies l to the reads that follow
+func (s *StatsDB) SetQueryLimits(l QueryLimits) {
+	s.limits.Store(&l)
+}
+
+// readContext returns the context of one read: ctx, typically the admin
+// request's, under the query timeout
+func (s *StatsDB) readContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if l := s.limits.Load(); l != nil && l.Timeout > 0 {
+		return context.WithTimeout(ctx, l.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// boundedRows stops a read at the row limit or timeout
+type boundedRows struct {
+	*sql.Rows
+	cancel  context.CancelFunc
+	max     int
+	n       int
+	limited bool
+}
+
+// query runs a read under the query limits; it stops when ctx is done
+func (s *StatsDB) query(ctx context.Context, q string, args ...interface{}) (*boundedRows, error) {
+	ctx, cancel := s.readContext(ctx)
+	rows, err := s.sqlDB().QueryContext(ctx, q, args...)
+	if err != nil {
+		cancel()
+		return nil, queryError(err)
+	}
+	r := &boundedRows{Rows: rows, cancel: cancel}
+	if l := s.limits.Load(); l != nil {
+		r.max = l.MaxRows
+	}
+	return r, nil
+}
+
+// Next is false once the row limit is reached
+func (r *boundedRows) Next() bool {
+	if r.max > 0 && r.n >= r.max {
+		r.limited = r.Rows.Next()
+		return false
+	}
+	r.n++
+	return r.Rows.Next()
+}
+
+// Err reports a read cut short as ErrPartialResult, unless the timeout hit
+// before any row arrived
+func (r *boundedRows) Err() error {
+	if r.limited {
+		return fmt.Errorf("%w: more than %d rows", ErrPartialResult, r.max)
+	}
+	err := r.Rows.Err()
+	if errors.Is(err, context.DeadlineExceeded) && r.n > 1 {
+		return fmt.Errorf("%w: query timed out", ErrPartialResult)
+	}
+	return queryError(err)
+}
+
+func (r *boundedRows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
+
+// boundedRow is a single-row read under the query timeout
+type boundedRow struct {
+	row    *sql.Row
+	cancel context.CancelFunc
+}
+
+// queryRow runs a single-row read under the query timeout; it stops when
+// ctx is done
+func (s *StatsDB) queryRow(ctx context.Context, q string, args ...interface{}) boundedRow {
+	ctx, cancel := s.readContext(ctx)
+	return boundedRow{row: s.sqlDB().QueryRowContext(ctx, q, args...), cancel: cancel}
+}
+
+func (r boundedRow) Scan(dest ...interface{}) error {
+	defer r.cancel()
+	return queryError(r.row.Scan(dest...))
+}
+
+// queryError names a read that ran out of time
+func queryError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("stats query timed out: %w", err)
+	}
+	return err
+}
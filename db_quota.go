@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// UserQuota is a cap on the traffic a user may transfer per period
+type UserQuota struct {
+	Username   string    `json:"username"`
+	Period     string    `json:"period"` // daily, weekly or monthly
+	QuotaBytes uint64    `json:"quota_bytes"`
+	SetBy      string    `json:"set_by,omitempty"`
+	SetAt      time.Time `json:"set_at"`
+}
+
+// SetUserQuota records q, replacing the user's previous quota
+func (s *StatsDB) SetUserQuota(q UserQuota) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`INSERT INTO user_quotas (username, period, quota_bytes, set_by, set_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(username) DO UPDATE SET period = excluded.period, quota_bytes = excluded.quota_bytes,
+			set_by = excluded.set_by, set_at = excluded.set_at`,
+		q.Username, q.Period, q.QuotaBytes, q.SetBy, q.SetAt.UTC().Format(time.RFC3339))
+	return err
+}
+
+// DeleteUserQuota removes username's quota
+func (s *StatsDB) DeleteUserQuota(username string) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`DELETE FROM user_quotas WHERE username = ?`, username)
+	return err
+}
+
+// GetUserQuotas returns every user quota
+func (s *StatsDB) GetUserQuotas(ctx context.Context) ([]UserQuota, error) {
+	rows, err := s.query(ctx, `SELECT username, period, quota_bytes, COALESCE(set_by,''), set_at FROM user_quotas ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []UserQuota
+	for rows.Next() {
+		var q UserQuota
+		var setAt string
+		if err := rows.Scan(&q.Username, &q.Period, &q.QuotaBytes, &q.SetBy, &setAt); err != nil {
+			return nil, err
+		}
+		q.SetAt, _ = time.Parse(time.RFC3339, setAt)
+		out = append(out, q)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// sizePruneKey is the retention_config key holding the last size prune report
+const sizePruneKey = "size_prune_last"
+
+// SizePruneReport records what was removed to bring the stats database back
+// under its configured size cap.
+type SizePruneReport struct {
+	Time       time.Time `json:"time"`
+	SizeBefore int64     `json:"size_before"`
+	SizeAfter  int64     `json:"size_after"`
+	MaxSize    int64     `json:"max_size"`
+	MinuteRows int64     `json:"minute_rows"`
+	DomainRows int64     `json:"domain_rows"`
+	// OldestMinute is the oldest minute_stats row left after pruning
+	OldestMinute string `json:"oldest_minute,omitempty"`
+	UnderLimit   bool   `json:"under_limit"`
+}
+
+// StorageStatus is returned by /api/v2/storage
+type StorageStatus struct {
+	SizeBytes int64            `json:"size_bytes"`
+	MaxBytes  int64            `json:"max_bytes"`
+	LastPrune *SizePruneReport `json:"last_prune,omitempty"`
+	// LastArchive is the last month moved to stats.archive
+	LastArchive *ArchiveReport `json:"last_archive,omitempty"`
+	// LegacyImport is set once the legacy JSON stats have been imported
+	LegacyImport *LegacyImport `json:"legacy_import,omitempty"`
+	ReadOnly     bool          `json:"read_only"`
+	Path         string        `json:"path"`
+}
+
+var (
+	prunedMinuteRows atomic.Uint64
+	prunedDomainRows atomic.Uint64
+)
+
+func init() {
+	metrics.Collect("https_proxy_db_pruned_rows_total", "Rows removed by stats database size management.", "counter", func() []MetricSample {
+		return []MetricSample{
+			{Labels: map[string]string{"table": "minute_stats"}, Value: float64(prunedMinuteRows.Load())},
+			{Labels: map[string]string{"table": "domain_stats"}, Value: float64(prunedDomainRows.Load())},
+		}
+	})
+}
+
+// Size returns the on-disk size of the database: the main file plus its
+// write-ahead log.
+func (s *StatsDB) Size() (int64, error) {
+	info, err := os.Stat(s.Path())
+	if err != nil {
+		return 0, fmt.Errorf("stat database: %w", err)
+	}
+	size := info.Size()
+	if wal, err := os.Stat(s.Path() + "-wal"); err == nil {
+		size += wal.Size()
+	}
+	return size, nil
+}
+
+// liveSize returns the bytes used by pages that hold data. Deleted rows only
+// move pages to the freelist; reclaim returns them to the filesystem.
+func (s *StatsDB) liveSize() (int64, error) {
+	var pageCount, freePages, pageSize int64
+	if err := s.sqlDB().QueryRow(`PRAGMA page_count`).Scan(&pageCount); err != nil {
+		return 0, fmt.Errorf("page_count: %w", err)
+	}
+	if err := s.sqlDB().QueryRow(`PRAGMA freelist_count`).Scan(&freePages); err != nil {
+		return 0, fmt.Errorf("freelist_count: %w", err)
+	}
+	if err := s.sqlDB().QueryRow(`PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return 0, fmt.Errorf("page_size: %w", err)
+	}
+	return (pageCount - freePages) * pageSize, nil
+}
+
+// reclaim truncates free pages off the database file and checkpoints the
+// write-ahead log so the file sizes on disk drop. Databases created before
+// incremental auto-vacuum was enabled are converted with a one-time VACUUM.
+func (s *StatsDB) reclaim() error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	ctx := context.Background()
+	// auto_vacuum and VACUUM must run on the same connection
+	conn, err := s.sqlDB().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var mode int
+	if err := conn.QueryRowContext(ctx, `PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return fmt.Errorf("auto_vacuum: %w", err)
+	}
+	if mode != 2 { // 2 = INCREMENTAL
+		log.Printf("[DB] Converting database to incremental auto-vacuum (one-time VACUUM)")
+		if _, err := conn.ExecContext(ctx, `PRAGMA auto_vacuum=INCREMENTAL`); err != nil {
+			return fmt.Errorf("set auto_vacuum: %w", err)
+		}
+		if _, err := conn.ExecContext(ctx, `VACUUM`); err != nil {
+			return fmt.Errorf("vacuum: %w", err)
+		}
+	} else {
+		// incremental_vacuum frees one page per step, so drain every row
+		rows, err := conn.QueryContext(ctx, `PRAGMA incremental_vacuum`)
+		if err != nil {
+			return fmt.Errorf("incremental_vacuum: %w", err)
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("incremental_vacuum: %w", err)
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return fmt.Errorf("wal_checkpoint: %w", err)
+	}
+	return nil
+}
+
+// EnforceSizeLimit keeps the database file and its WAL within maxBytes. The
+// oldest minute_stats rows are deleted first; if that is not enough,
+// domain_stats rows of users with no access since inactiveBefore are removed,
+// least recently seen first. Freed pages are then returned to the filesystem.
+// It returns nil when the database is already under the cap.
+func (s *StatsDB) EnforceSizeLimit(maxBytes int64, inactiveBefore time.Time) (*SizePruneReport, error) {
+	if s.ReadOnly() {
+		return nil, errStatsReadOnly
+	}
+	size, err := s.Size()
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes <= 0 || size <= maxBytes {
+		return nil, nil
+	}
+
+	report := &SizePruneReport{Time: time.Now(), SizeBefore: size, MaxSize: maxBytes}
+
+	// last_access is written both as local RFC3339 and as SQLite's UTC
+	// datetime('now'); datetime() normalises both sides to UTC
+	phases := []struct {
+		rows  *int64
+		query string
+		args  []interface{}
+	}{
+		{&report.MinuteRows, `DELETE FROM minute_stats WHERE rowid IN (
+			SELECT rowid FROM minute_stats ORDER BY minute LIMIT ?)`, nil},
+		{&report.DomainRows, `DELETE FROM domain_stats WHERE rowid IN (
+			SELECT d.rowid FROM domain_stats d JOIN user_stats u ON u.username = d.user
+			WHERE datetime(u.last_access) < datetime(?) ORDER BY d.last_seen LIMIT ?)`,
+			[]interface{}{inactiveBefore.Format(time.RFC3339)}},
+	}
+
+	// Delete until the live data fits; the file only shrinks on reclaim
+	live, err := s.liveSize()
+	if err != nil {
+		return nil, err
+	}
+	const batch = 1000
+	for _, phase := range phases {
+		for live > maxBytes {
+			res, err := s.sqlDB().Exec(phase.query, append(phase.args, batch)...)
+			if err != nil {
+				return report, fmt.Errorf("prune: %w", err)
+			}
+			n, _ := res.RowsAffected()
+			if n == 0 {
+				break
+			}
+			*phase.rows += n
+			if live, err = s.liveSize(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	prunedMinuteRows.Add(uint64(report.MinuteRows))
+	prunedDomainRows.Add(uint64(report.DomainRows))
+
+	if err := s.reclaim(); err != nil {
+		log.Printf("[DB] Failed to reclaim free pages: %v", err)
+	}
+
+	var oldest sql.NullString
+	s.sqlDB().QueryRow(`SELECT MIN(minute) FROM minute_stats`).Scan(&oldest)
+	report.OldestMinute = oldest.String
+
+	if data, err := json.Marshal(report); err == nil {
+		s.sqlDB().Exec(`INSERT INTO retention_config (key, value) VALUES (?, ?)
+			ON CONFLICT(key) DO UPDATE SET value = excluded.value`, sizePruneKey, string(data))
+	}
+	if size, err = s.Size(); err != nil {
+		return report, err
+	}
+	report.SizeAfter = size
+	report.UnderLimit = size <= maxBytes
+	return report, nil
+}
+
+// LastSizePrune returns the most recent size prune report, or nil if the
+// database has never exceeded its cap.
+func (s *StatsDB) LastSizePrune() *SizePruneReport {
+	var value string
+	if err := s.sqlDB().QueryRow(`SELECT value FROM retention_config WHERE key = ?`, sizePruneKey).Scan(&value); err != nil {
+		return nil
+	}
+	var report SizePruneReport
+	if err := json.Unmarshal([]byte(value), &report); err != nil {
+		return nil
+	}
+	return &report
+}
+
+// WatchSize checks the database size every interval and prunes it when it
+// exceeds maxBytes. Users idle for inactiveDays lose their domain rows only
+// after all minute rows are gone; it is read on every check so retention
+// changes made at runtime apply.
+func (s *StatsDB) WatchSize(maxBytes int64, inactiveDays func() int, interval time.Duration) {
+	check := func() {
+		if s.ReadOnly() {
+			return
+		}
+		report, err := s.EnforceSizeLimit(maxBytes, time.Now().AddDate(0, 0, -inactiveDays()))
+		if err != nil {
+			log.Printf("[DB] Size limit enforcement failed: %v", err)
+		}
+		if report == nil {
+			return
+		}
+		log.Printf("[DB] Size limit exceeded (%s > %s): pruned %d minute rows and %d domain rows of inactive users, now %s",
+			formatBytes(uint64(report.SizeBefore)), formatBytes(uint64(report.MaxSize)),
+			report.MinuteRows, report.DomainRows, formatBytes(uint64(report.SizeAfter)))
+		if !report.UnderLimit {
+			log.Printf("[DB] WARNING: database is still over its %s size limit after pruning; raise stats.retention.max_db_size_mb or shorten retention",
+				formatBytes(uint64(report.MaxSize)))
+		}
+	}
+
+	metrics.Gauge("https_proxy_db_size_bytes", "Bytes the stats database and its write-ahead log take on disk.", func() float64 {
+		size, _ := s.Size()
+		return float64(size)
+	})
+
+	check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		check()
+	}
+}
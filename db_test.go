@@ -1,8 +1,17 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -72,7 +81,7 @@ func TestStatsDB_InitAndUpsert(t *testing.T) {
 	}
 
 	// Test GetOverview
-	overview, err := db.GetOverview()
+	overview, err := db.GetOverview(context.Background())
 	if err != nil {
 		t.Fatalf("GetOverview: %v", err)
 	}
@@ -93,7 +102,7 @@ func TestStatsDB_InitAndUpsert(t *testing.T) {
 	}
 
 	// Test GetAllUsers
-	users, err := db.GetAllUsers()
+	users, err := db.GetAllUsers(context.Background())
 	if err != nil {
 		t.Fatalf("GetAllUsers: %v", err)
 	}
@@ -109,7 +118,7 @@ func TestStatsDB_InitAndUpsert(t *testing.T) {
 	}
 
 	// Test GetTopDomains
-	domains, err := db.GetTopDomains(10, "")
+	domains, err := db.GetTopDomains(context.Background(), 10, "")
 	if err != nil {
 		t.Fatalf("GetTopDomains: %v", err)
 	}
@@ -118,7 +127,7 @@ func TestStatsDB_InitAndUpsert(t *testing.T) {
 	}
 
 	// Test GetTopDomains with user filter
-	domains, err = db.GetTopDomains(10, "alice")
+	domains, err = db.GetTopDomains(context.Background(), 10, "alice")
 	if err != nil {
 		t.Fatalf("GetTopDomains(alice): %v", err)
 	}
@@ -127,7 +136,7 @@ func TestStatsDB_InitAndUpsert(t *testing.T) {
 	}
 
 	// Test GetCountryStats
-	countries, err := db.GetCountryStats()
+	countries, err := db.GetCountryStats(context.Background())
 	if err != nil {
 		t.Fatalf("GetCountryStats: %v", err)
 	}
@@ -139,7 +148,7 @@ func TestStatsDB_InitAndUpsert(t *testing.T) {
 	}
 
 	// Test GetTrends
-	trends, err := db.GetTrends("1h")
+	trends, err := db.GetTrends(context.Background(), "1h")
 	if err != nil {
 		t.Fatalf("GetTrends: %v", err)
 	}
@@ -182,7 +191,7 @@ func TestStatsDB_UpsertAccumulation(t *testing.T) {
 		ConnCount: 1, Minute: minute, Hour: hour, Timestamp: now,
 	}})
 
-	user, err := db.GetUser("alice")
+	user, err := db.GetUser(context.Background(), "alice")
 	if err != nil {
 		t.Fatalf("GetUser: %v", err)
 	}
@@ -205,7 +214,7 @@ func TestStatsCollector_AggregateAndFlush(t *testing.T) {
 	}
 	defer db.Close()
 
-	collector := NewStatsCollector(db, nil, 1) // 1 second flush interval
+	collector := NewStatsCollector(db, nil, 1, 0) // 1 second flush interval
 	defer collector.Stop()
 
 	// Send several events
@@ -222,7 +231,7 @@ func TestStatsCollector_AggregateAndFlush(t *testing.T) {
 	// Wait for flush
 	time.Sleep(2 * time.Second)
 
-	overview, err := db.GetOverview()
+	overview, err := db.GetOverview(context.Background())
 	if err != nil {
 		t.Fatalf("GetOverview: %v", err)
 	}
@@ -233,3 +242,853 @@ func TestStatsCollector_AggregateAndFlush(t *testing.T) {
 		t.Errorf("TotalDownload = %d, want 10000", overview.TotalDownload)
 	}
 }
+
+func TestStatsCollector_EvictsOldestBuckets(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewStatsDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	// Long flush interval so only eviction writes to the DB
+	collector := NewStatsCollector(db, nil, 3600, 10)
+	defer collector.Stop()
+
+	base := time.Now()
+	for i := 0; i < 10; i++ {
+		collector.Record(TrafficEvent{
+			Username:  "alice",
+			Domain:    fmt.Sprintf("site%d.com", i),
+			Upload:    100,
+			Timestamp: base.Add(time.Duration(i) * time.Millisecond),
+		})
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for collector.evicted.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	domains, err := db.GetTopDomains(context.Background(), 10, "alice")
+	if err != nil {
+		t.Fatalf("GetTopDomains: %v", err)
+	}
+	if len(domains) != 1 || domains[0].Domain != "site0.com" {
+		t.Errorf("evicted domains = %+v, want only the oldest bucket site0.com", domains)
+	}
+	if n := collector.bufferLen(); n != 9 {
+		t.Errorf("bufferLen = %d, want 9", n)
+	}
+}
+
+func TestStatsCollector_EvictionBacksOffOnWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewStatsDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	// Every write fails from here on
+	db.Close()
+
+	collector := NewStatsCollector(db, nil, 3600, 10)
+	defer collector.Stop()
+
+	for i := 0; i < 200; i++ {
+		collector.Record(TrafficEvent{Username: "alice", Domain: fmt.Sprintf("site%d.com", i), Upload: 1, Timestamp: time.Now()})
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(collector.eventCh) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// One failed eviction, then no more attempts until the next tick
+	if n := collector.writeErrors.Load(); n != 1 {
+		t.Errorf("write attempts after failure = %d, want 1", n)
+	}
+}
+
+func TestStatsDB_EnforceSizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewStatsDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	base := time.Now().Add(-48 * time.Hour)
+	var records []TrafficRecord
+	for i := 0; i < 2000; i++ {
+		ts := base.Add(time.Duration(i) * time.Minute)
+		records = append(records, TrafficRecord{
+			Username: "alice", Domain: fmt.Sprintf("d%d.example.com", i%50),
+			Upload: 1, Download: 1, ConnCount: 1,
+			Minute: ts.Format("2006-01-02T15:04:00"), Hour: ts.Format("2006-01-02T15:00:00"),
+			Timestamp: ts,
+		})
+	}
+	if err := db.BatchUpsert(records); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Under the live pages, which the file and its WAL hold about twice
+	live, err := db.liveSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := live * 3 / 4
+	report, err := db.EnforceSizeLimit(limit, time.Now().AddDate(0, 0, -7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report == nil || report.MinuteRows == 0 {
+		t.Fatalf("expected minute rows to be pruned, got %+v", report)
+	}
+	if report.DomainRows != 0 {
+		t.Errorf("active user's domain rows were pruned: %+v", report)
+	}
+	if report.SizeAfter >= report.SizeBefore || !report.UnderLimit {
+		t.Errorf("database file did not shrink under the cap: %+v", report)
+	}
+	if after, _ := db.Size(); after > limit {
+		t.Errorf("on-disk size %d still above cap %d", after, limit)
+	}
+	if last := db.LastSizePrune(); last == nil || last.MinuteRows != report.MinuteRows {
+		t.Errorf("last prune report not persisted: %+v", last)
+	}
+
+	if report, _ := db.EnforceSizeLimit(size*2, time.Now()); report != nil {
+		t.Errorf("expected no pruning under the cap, got %+v", report)
+	}
+}
+
+func TestStatsDB_EnforceSizeLimitInactiveUsers(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	var records []TrafficRecord
+	for _, user := range []string{"idle", "active"} {
+		for i := 0; i < 3000; i++ {
+			records = append(records, TrafficRecord{
+				Username: user, Domain: fmt.Sprintf("d%d.%s.example.com", i, user),
+				Upload: 1, Download: 1, ConnCount: 1,
+				Minute: now.Format("2006-01-02T15:04:00"), Hour: now.Format("2006-01-02T15:00:00"),
+				Timestamp: now,
+			})
+		}
+	}
+	if err := db.BatchUpsert(records); err != nil {
+		t.Fatal(err)
+	}
+	// Mix the two timestamp formats last_access is written in
+	if _, err := db.sqlDB().Exec(`UPDATE user_stats SET last_access = datetime('now', '-30 days') WHERE username = 'idle'`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.sqlDB().Exec(`UPDATE user_stats SET last_access = ? WHERE username = 'active'`, now.Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.sqlDB().Exec(`DELETE FROM minute_stats`); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := db.EnforceSizeLimit(size/2, now.AddDate(0, 0, -7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report == nil || report.DomainRows == 0 {
+		t.Fatalf("expected the idle user's domain rows to be pruned, got %+v", report)
+	}
+	var idle, active int
+	db.sqlDB().QueryRow(`SELECT COUNT(*) FROM domain_stats WHERE user = 'idle'`).Scan(&idle)
+	db.sqlDB().QueryRow(`SELECT COUNT(*) FROM domain_stats WHERE user = 'active'`).Scan(&active)
+	if active != 3000 {
+		t.Errorf("active user lost domain rows: %d left", active)
+	}
+	if idle == 3000 {
+		t.Error("idle user's domain rows were not pruned")
+	}
+}
+
+func TestMigrateLegacyStats_BeyondMemoryCap(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{}
+	cfg.Stats.Enabled = true
+	cfg.Stats.FilePath = filepath.Join(dir, "stats.json")
+	cfg.Stats.MaxUsersInMemory = 10
+
+	legacy := make(map[string]*UserStats)
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("user%02d", i)
+		legacy[name] = &UserStats{Username: name, TotalBytes: 100, LastAccess: time.Now().Add(time.Duration(i) * time.Second)}
+	}
+	if err := writeStatsFile(cfg.Stats.FilePath, legacy); err != nil {
+		t.Fatal(err)
+	}
+	sm := NewStatsManager(cfg)
+
+	db, err := NewStatsDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	migrated, err := migrateLegacyStats(sm, db)
+	if err != nil {
+		t.Fatalf("migrateLegacyStats: %v", err)
+	}
+	if migrated != 25 {
+		t.Errorf("migrated %d users, want 25", migrated)
+	}
+	users, _ := db.GetAllUsers(context.Background())
+	if len(users) != 25 {
+		t.Errorf("database holds %d users, want 25", len(users))
+	}
+}
+
+func TestImportLegacyStats_Once(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{}
+	cfg.Stats.Enabled = true
+	cfg.Stats.FilePath = filepath.Join(dir, "stats.json")
+	last := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	legacy := map[string]*UserStats{
+		"alice": {Username: "alice", TotalBytes: 100, RequestsCount: 3, ConnectionCount: 2, LastAccess: last, ConnectedSince: last, Disabled: true},
+	}
+	if err := writeStatsFile(cfg.Stats.FilePath, legacy); err != nil {
+		t.Fatal(err)
+	}
+	sm := NewStatsManager(cfg)
+
+	db, err := NewStatsDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := importLegacyStats(sm, db, cfg.Stats.FilePath); err != nil {
+			t.Fatalf("import %d: %v", i, err)
+		}
+	}
+	if imp := db.LegacyImport(context.Background()); imp == nil || imp.Users != 1 || imp.Assumed {
+		t.Errorf("import record = %+v", imp)
+	}
+
+	// The exported file matches the imported one, not twice its totals
+	exported, err := db.ExportLegacyJSON(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := exported["alice"]
+	if got == nil || got.TotalBytes != 100 || got.RequestsCount != 3 || got.ConnectionCount != 2 || !got.Disabled || !got.LastAccess.Equal(last) {
+		t.Errorf("exported alice = %+v", got)
+	}
+}
+
+func TestImportLegacyStats_AlreadyImportedByEarlierRelease(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	db.MigrateFromJSON(map[string]*UserStats{"alice": {Username: "alice", TotalBytes: 100}})
+
+	if n, err := importLegacyStats(NewStatsManager(&Config{}), db, "stats.json"); err != nil || n != 0 {
+		t.Fatalf("import = %d, %v", n, err)
+	}
+	if imp := db.LegacyImport(context.Background()); imp == nil || !imp.Assumed {
+		t.Errorf("import record = %+v", imp)
+	}
+}
+
+func TestStatsDB_UserTimeline(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	// Two sessions separated by an hour of idle time
+	base := time.Now().Add(-3 * time.Hour).Truncate(time.Minute)
+	var records []TrafficRecord
+	for _, start := range []time.Time{base, base.Add(time.Hour)} {
+		for i := 0; i < 3; i++ {
+			ts := start.Add(time.Duration(i) * time.Minute)
+			records = append(records, TrafficRecord{
+				Username: "alice", Domain: "example.com", Upload: 10, Download: 20, ConnCount: 1,
+				Minute: ts.Format("2006-01-02T15:04:00"), Hour: ts.Format("2006-01-02T15:00:00"), Timestamp: ts,
+			})
+		}
+	}
+	if err := db.BatchUpsert(records); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordUserEvent("alice", EventUserDisabled, "web:admin", ""); err != nil {
+		t.Fatal(err)
+	}
+	db.RecordUserEvent("bob", EventUserDisabled, "web:admin", "")
+
+	entries, err := db.GetUserTimeline(context.Background(), "alice", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, e := range entries {
+		types = append(types, e.Type)
+	}
+	want := []string{EventUserDisabled, "activity", "activity", "first_seen"}
+	if fmt.Sprint(types) != fmt.Sprint(want) {
+		t.Fatalf("timeline types = %v, want %v", types, want)
+	}
+	if s := entries[1]; s.Upload != 30 || s.Download != 60 || s.ConnCount != 3 {
+		t.Errorf("session totals wrong: %+v", s)
+	}
+	if entries[0].Actor != "web:admin" {
+		t.Errorf("event actor = %q", entries[0].Actor)
+	}
+
+	if limited, _ := db.GetUserTimeline(context.Background(), "alice", 2); len(limited) != 2 {
+		t.Errorf("limit not applied: %d entries", len(limited))
+	}
+}
+
+func TestStatsDB_TagStats(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	rec := func(user, tag string, up uint64) TrafficRecord {
+		return TrafficRecord{Username: user, Domain: "example.com", Tag: tag, Upload: up, ConnCount: 1,
+			Minute: now.Format("2006-01-02T15:04:00"), Hour: now.Format("2006-01-02T15:00:00"), Timestamp: now}
+	}
+	if err := db.BatchUpsert([]TrafficRecord{rec("alice", "ci", 10), rec("bob", "ci", 20), rec("alice", "backup", 100), rec("alice", "", 5)}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := db.GetTagStats(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Tag != "backup" || all[1].Tag != "ci" || all[1].Upload != 30 || all[1].ConnCount != 2 {
+		t.Errorf("tag totals = %+v", all)
+	}
+	alice, _ := db.GetTagStats(context.Background(), "alice")
+	if len(alice) != 2 || alice[1].Upload != 10 {
+		t.Errorf("alice's tags = %+v", alice)
+	}
+}
+
+func TestStatsDB_CountryDetail(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	rec := func(user, domain, country string, down uint64, at time.Time) TrafficRecord {
+		return TrafficRecord{Username: user, Domain: domain, Country: country, CountryName: "Germany", Download: down, ConnCount: 1,
+			Minute: at.Format("2006-01-02T15:04:00"), Hour: at.Format("2006-01-02T15:00:00"), Timestamp: at}
+	}
+	if err := db.BatchUpsert([]TrafficRecord{
+		rec("alice", "a.example", "DE", 100, now),
+		rec("bob", "a.example", "DE", 300, now),
+		rec("bob", "b.example", "DE", 50, old),
+		rec("carol", "c.example", "FR", 1000, now),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := db.GetCountryDetail(context.Background(), "DE", 10, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Download != 450 || d.UserCount != 2 || d.CountryName != "Germany" {
+		t.Errorf("totals = %+v", d.DBCountryStats)
+	}
+	if len(d.TopUsers) != 2 || d.TopUsers[0].Username != "bob" || d.TopUsers[0].Download != 350 {
+		t.Errorf("top users = %+v", d.TopUsers)
+	}
+	if len(d.TopDomains) != 2 || d.TopDomains[0].Domain != "a.example" || d.TopDomains[0].Download != 400 {
+		t.Errorf("top domains = %+v", d.TopDomains)
+	}
+	// The 48h old record is outside the trend window
+	if len(d.Hourly) != 1 || d.Hourly[0].Download != 400 {
+		t.Errorf("hourly = %+v", d.Hourly)
+	}
+
+	if d, _ := db.GetCountryDetail(context.Background(), "DE", 1, 24); len(d.TopUsers) != 1 || len(d.TopDomains) != 1 {
+		t.Errorf("limit not applied: %+v", d)
+	}
+	if _, err := db.GetCountryDetail(context.Background(), "JP", 10, 24); err != sql.ErrNoRows {
+		t.Errorf("unknown country: err = %v", err)
+	}
+}
+
+func TestStatsDB_GeoTrends(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	rec := func(country, continent string, down uint64, at time.Time) TrafficRecord {
+		return TrafficRecord{Username: "alice", Domain: "a.example", Country: country, CountryName: country + " name", Continent: continent,
+			Download: down, ConnCount: 1, Minute: at.Format("2006-01-02T15:04:00"), Hour: at.Format("2006-01-02T15:00:00"), Timestamp: at}
+	}
+	if err := db.BatchUpsert([]TrafficRecord{
+		rec("DE", "EU", 300, now),
+		rec("DE", "EU", 100, now.Add(-2*time.Hour)),
+		rec("FR", "EU", 200, now),
+		rec("US", "NA", 50, now.Add(-time.Hour)),
+		rec("JP", "AS", 10, now),
+		rec("BR", "SA", 999, now.Add(-48*time.Hour)), // outside 24h
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := db.GetGeoTrends(context.Background(), "", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Range != "24h" || g.By != "country" || len(g.Hours) != 24 || g.Hours[23] != now.Truncate(time.Hour).Format("2006-01-02T15:00:00") {
+		t.Fatalf("buckets = %s %s %d %v", g.Range, g.By, len(g.Hours), g.Hours[len(g.Hours)-1])
+	}
+	keys := make([]string, len(g.Series))
+	for i, sr := range g.Series {
+		keys[i] = sr.Key
+		if len(sr.Points) != 24 {
+			t.Errorf("%s has %d points", sr.Key, len(sr.Points))
+		}
+	}
+	if strings.Join(keys, ",") != "DE,FR,other" {
+		t.Fatalf("series = %v", keys)
+	}
+	de, other := g.Series[0], g.Series[2]
+	if de.Name != "DE name" || de.Download != 400 || de.Points[23].Download != 300 || de.Points[21].Download != 100 || de.Points[21].Time != g.Hours[21] {
+		t.Errorf("DE = %+v", de)
+	}
+	if other.Download != 60 || other.Conns != 2 || other.Points[22].Download != 50 {
+		t.Errorf("other = %+v", other)
+	}
+
+	g, err = db.GetGeoTrends(context.Background(), "7d", "continent", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Hours) != 7*24 || len(g.Series) != 4 || g.Series[0].Key != "SA" || g.Series[1].Key != "EU" || g.Series[1].Download != 600 || g.Series[1].Name != "" {
+		t.Errorf("continents = %d hours, %d series", len(g.Hours), len(g.Series))
+	}
+}
+
+func TestStatsDB_ReadOnly(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewStatsDB(dbPath)
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	// Stats recorded while writes are paused are held until they resume
+	collector := NewStatsCollector(db, nil, 1, 0)
+	defer collector.Stop()
+	db.SetReadOnly(true)
+	collector.Record(TrafficEvent{Username: "alice", Domain: "google.com", Upload: 1000, Timestamp: time.Now()})
+	time.Sleep(2 * time.Second)
+	if overview, _ := db.GetOverview(context.Background()); overview.TotalUpload != 0 {
+		t.Errorf("TotalUpload while read-only = %d, want 0", overview.TotalUpload)
+	}
+	if err := db.SetUserDisabled("alice", true); err != errStatsReadOnly {
+		t.Errorf("SetUserDisabled while read-only: %v", err)
+	}
+	if n := collector.writeErrors.Load(); n != 0 {
+		t.Errorf("write errors = %d, want 0", n)
+	}
+	db.SetReadOnly(false)
+	time.Sleep(2 * time.Second)
+	if overview, _ := db.GetOverview(context.Background()); overview.TotalUpload != 1000 {
+		t.Errorf("TotalUpload after resuming = %d, want 1000", overview.TotalUpload)
+	}
+
+	// A viewer opens the same file read-only and cannot be made writable
+	viewer, err := NewReadOnlyStatsDB(dbPath)
+	if err != nil {
+		t.Fatalf("NewReadOnlyStatsDB: %v", err)
+	}
+	defer viewer.Close()
+	if users, err := viewer.GetAllUsers(context.Background()); err != nil || len(users) != 1 {
+		t.Errorf("GetAllUsers = %v, %v", users, err)
+	}
+	if err := viewer.SetReadOnly(false); err == nil {
+		t.Error("database opened read-only was made writable")
+	}
+	if _, err := viewer.sqlDB().Exec(`DELETE FROM user_stats`); err == nil {
+		t.Error("SQLite accepted a write on a read-only database")
+	}
+	if _, err := NewReadOnlyStatsDB(filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		t.Error("opened a missing database read-only")
+	}
+}
+
+func TestStatsDB_MergeFrom(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	minute := now.Truncate(time.Minute).Format("2006-01-02T15:04:00")
+	hour := now.Truncate(time.Hour).Format("2006-01-02T15:00:00")
+
+	db, err := NewStatsDB(filepath.Join(dir, "local.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	db.SetNode("edge-1", nil)
+	db.BatchUpsert([]TrafficRecord{{
+		Username: "alice", Domain: "google.com", Upload: 100, Download: 200,
+		ConnCount: 1, Minute: minute, Hour: hour, Timestamp: now,
+	}})
+
+	otherPath := filepath.Join(dir, "retired.db")
+	other, err := NewStatsDB(otherPath)
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	other.SetNode("edge-2", nil)
+	other.BatchUpsert([]TrafficRecord{
+		{Username: "alice", Domain: "google.com", Upload: 300, Download: 400, ConnCount: 1, Minute: minute, Hour: hour, Timestamp: now.Add(time.Minute)},
+		{Username: "bob", Domain: "github.com", Upload: 50, ConnCount: 1, Minute: minute, Hour: hour, Timestamp: now},
+	})
+	other.SetUserDisabled("bob", true)
+	other.Close()
+
+	if _, err := db.MergeFrom(otherPath); err != nil {
+		t.Fatalf("MergeFrom: %v", err)
+	}
+	alice, err := db.GetUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if alice.TotalUpload != 400 || alice.TotalDownload != 600 || alice.ConnCount != 2 {
+		t.Errorf("alice = %+v, want summed counters", alice)
+	}
+	if bob, err := db.GetUser(context.Background(), "bob"); err != nil || !bob.Disabled {
+		t.Errorf("bob = %+v, %v", bob, err)
+	}
+	if domains, _ := db.GetTopDomains(context.Background(), 10, "alice"); len(domains) != 1 || domains[0].Upload != 400 {
+		t.Errorf("domains = %+v", domains)
+	}
+	if nodes, _ := db.GetNodes(context.Background(), now.Add(-time.Hour)); len(nodes) != 2 || nodes[1].Upload != 350 {
+		t.Errorf("nodes = %+v", nodes)
+	}
+
+	if _, err := db.MergeFrom(filepath.Join(dir, "local.db")); err == nil {
+		t.Error("merged the database into itself")
+	}
+	if _, err := db.MergeFrom(filepath.Join(dir, "missing.db")); err == nil {
+		t.Error("merged a missing database")
+	}
+}
+
+func TestStatsDB_QueryLimits(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	for _, u := range []string{"alice", "bob", "carol"} {
+		db.SetUserDisabled(u, false)
+	}
+
+	db.SetQueryLimits(QueryLimits{MaxRows: 2})
+	users, err := db.GetAllUsers(context.Background())
+	if !errors.Is(err, ErrPartialResult) || len(users) != 2 {
+		t.Errorf("row limit: %d users, err %v; want 2 and a partial result", len(users), err)
+	}
+	db.SetQueryLimits(QueryLimits{MaxRows: 3})
+	if users, err := db.GetAllUsers(context.Background()); err != nil || len(users) != 3 {
+		t.Errorf("at the limit: %d users, err %v", len(users), err)
+	}
+
+	// A query that would run forever stops at the timeout with what it got
+	db.SetQueryLimits(QueryLimits{Timeout: 100 * time.Millisecond})
+	rows, err := db.query(context.Background(), `WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c) SELECT x FROM c`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	rows.Close()
+	if err := rows.Err(); !errors.Is(err, ErrPartialResult) || n == 0 {
+		t.Errorf("timeout: %d rows, err %v; want rows and a partial result", n, err)
+	}
+}
+
+func TestStatsDB_ReadCancelled(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	db.SetUserDisabled("alice", false)
+
+	// A read for an admin request that has gone away is abandoned
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.GetAllUsers(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetAllUsers with a cancelled context: err %v, want context.Canceled", err)
+	}
+	if _, err := db.GetOverview(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetOverview with a cancelled context: err %v, want context.Canceled", err)
+	}
+}
+
+func TestStatsCollector_ShutdownSpill(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewStatsDB(dbPath)
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	// Another process holds the database locked
+	other, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	lock, err := other.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lock.Exec(`INSERT INTO retention_config (key, value) VALUES ('lock', '1')`); err != nil {
+		t.Fatal(err)
+	}
+
+	collector := NewStatsCollector(db, nil, 3600, 0)
+	collector.SetShutdownTimeout(200 * time.Millisecond)
+	collector.Record(TrafficEvent{Username: "alice", Domain: "example.com", Upload: 100, Timestamp: time.Now()})
+	start := time.Now()
+	collector.Stop()
+	if d := time.Since(start); d > 200*time.Millisecond+collectorSpillGrace+time.Second {
+		t.Errorf("Stop took %v with the database locked", d)
+	}
+	if _, err := os.Stat(dbPath + ".spill.json"); err != nil {
+		t.Fatalf("no spill file: %v", err)
+	}
+	lock.Rollback()
+
+	// The next start writes the spilled bucket, once
+	NewStatsCollector(db, nil, 3600, 0).Stop()
+	if _, err := os.Stat(dbPath + ".spill.json"); !os.IsNotExist(err) {
+		t.Errorf("spill file left after restore: %v", err)
+	}
+	u, err := db.GetUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if u.TotalUpload != 100 {
+		t.Errorf("TotalUpload = %d, want 100", u.TotalUpload)
+	}
+}
+
+func TestStatsCollector_TunnelReports(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	collector := NewStatsCollector(db, nil, 3600, 0)
+
+	p := &Proxy{Config: &Config{}, StatsCollector: collector}
+	if p.startTunnelReports(TrafficEvent{}, nil, nil) != nil {
+		t.Fatal("reports started although disabled")
+	}
+	p.Config.Stats.TunnelReportSeconds = 3600 // reports are driven by hand below
+	var up, down uint64
+	tr := p.startTunnelReports(TrafficEvent{Username: "alice", Domain: "example.com"},
+		func() uint64 { return up }, func() uint64 { return down })
+	up, down = 100, 1000
+	tr.report(time.Now())
+	up, down = 150, 3000
+	tr.report(time.Now())
+	final := tr.Close(TrafficEvent{Username: "alice", Domain: "example.com", Upload: 160, Download: 3500, Timestamp: time.Now()})
+	if final.Upload != 10 || final.Download != 500 {
+		t.Errorf("closing event carries %d/%d, want the unreported 10/500", final.Upload, final.Download)
+	}
+	collector.Record(final)
+	collector.Stop()
+
+	u, err := db.GetUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if u.TotalUpload != 160 || u.TotalDownload != 3500 || u.ConnCount != 1 {
+		t.Errorf("got %d/%d in %d connections, want 160/3500 in one", u.TotalUpload, u.TotalDownload, u.ConnCount)
+	}
+}
+
+func TestStatsCollector_Camouflage(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	collector := NewStatsCollector(db, nil, 3600, 0)
+
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && len(r.TransferEncoding) > 0 {
+			t.Errorf("GET forwarded with %v", r.TransferEncoding)
+		}
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("not found here"))
+	}))
+	defer site.Close()
+	p, _ := newErrorTestProxy(t)
+	p.Config.Proxy.DefaultSite = site.URL
+	p.StatsCollector = collector
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	for _, path := range []string{"/wp-login.php", "/wp-login.php?x=1", "/.env"} {
+		resp, err := http.Get(front.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	resp, err := http.Post(front.URL+"/xmlrpc.php", "text/xml", strings.NewReader("<methodCall/>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	collector.Record(TrafficEvent{Camouflage: true, Path: "/", Country: "CN", CountryName: "China", Timestamp: time.Now()})
+	collector.Stop()
+
+	c, err := db.GetCamouflageStats(context.Background(), 24, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Requests != 5 || c.Upload != 13 || c.Download != 4*14 {
+		t.Errorf("totals = %d requests, %d/%d bytes", c.Requests, c.Upload, c.Download)
+	}
+	if len(c.TopPaths) != 4 || c.TopPaths[0].Key != "/wp-login.php" || c.TopPaths[0].Requests != 2 {
+		t.Errorf("top paths = %+v", c.TopPaths)
+	}
+	if len(c.TopCountries) != 2 || c.TopCountries[1].Key != "CN" || c.TopCountries[1].Name != "China" {
+		t.Errorf("top countries = %+v", c.TopCountries)
+	}
+	if len(c.Hourly) != 1 || c.Hourly[0].Conns != 5 {
+		t.Errorf("hourly = %+v", c.Hourly)
+	}
+	if o, _ := db.GetOverview(context.Background()); o.CamouflageRequests != 5 || o.CamouflageBytes != 56 {
+		t.Errorf("overview = %+v", o)
+	}
+
+	// Random paths beyond the buffer cap share one bucket
+	m := make(map[camouflageKey]*camouflageAgg)
+	for _, path := range []string{"/a", "/b", "/c", "/d", "/a"} {
+		observeCamouflage(m, TrafficEvent{Path: path}, "h", 2)
+	}
+	if len(m) != 3 || m[camouflageKey{Hour: "h", Path: "/a"}].Requests != 2 || m[camouflageKey{Hour: "h", Path: camouflageOtherPath}].Requests != 2 {
+		t.Errorf("capped buckets = %d", len(m))
+	}
+}
+
+func TestStatsCollector_DialFailures(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	collector := NewStatsCollector(db, nil, 3600, 0)
+	p := &Proxy{StatsCollector: collector}
+	for i := 0; i < 3; i++ {
+		p.recordDialFailure("alice", "blocked.example", ErrCodeDialTimeout)
+	}
+	p.recordDialFailure("alice", "blocked.example", ErrCodeDNSFailure)
+	p.recordDialFailure("alice", "gone.example", ErrCodeDNSFailure)
+	p.recordDialFailure("bob", "blocked.example", ErrCodeDialFailed)
+	collector.Stop()
+
+	mux := http.NewServeMux()
+	registerV2API(mux, &Config{}, nil, db, nil, nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/users/alice/dial-failures", nil))
+	var resp struct {
+		Data []DBDialFailure `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	f := resp.Data
+	if rec.Code != http.StatusOK || len(f) != 3 {
+		t.Fatalf("dial failures: %d %+v", rec.Code, f)
+	}
+	if f[0].Domain != "blocked.example" || f[0].Class != ErrCodeDialTimeout || f[0].Count != 3 || f[0].LastSeen == "" {
+		t.Errorf("top failure = %+v", f[0])
+	}
+	if o, _ := db.GetTrends(context.Background(), "24h"); len(o) != 0 {
+		t.Errorf("failed dials counted as traffic: %+v", o)
+	}
+
+	// Random destinations beyond the buffer cap share one bucket
+	m := make(map[dialFailureKey]*dialFailureAgg)
+	for _, host := range []string{"a", "b", "c", "a"} {
+		observeDialFailure(m, TrafficEvent{Username: "u", Domain: host, DialError: ErrCodeDNSFailure}, time.Now(), 2)
+	}
+	if len(m) != 3 || m[dialFailureKey{"u", dialFailureOtherDomain, ErrCodeDNSFailure}].Count != 1 {
+		t.Errorf("capped buckets = %d", len(m))
+	}
+}
+
+func TestStatsDB_Move(t *testing.T) {
+	dir := t.TempDir()
+	oldPath := filepath.Join(dir, "old", "test.db")
+	db, err := NewStatsDB(oldPath)
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	db.BatchUpsert([]TrafficRecord{{Username: "alice", Upload: 100, ConnCount: 1, Timestamp: time.Now()}})
+
+	if err := db.Move(oldPath); !errors.Is(err, errMoveRefused) {
+		t.Errorf("move onto itself: err %v, want errMoveRefused", err)
+	}
+	newPath := filepath.Join(dir, "new", "test.db")
+	if err := db.Move(newPath); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if db.Path() != newPath || db.ReadOnly() {
+		t.Errorf("after move: path %s, read-only %v", db.Path(), db.ReadOnly())
+	}
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("old file left behind: %v", err)
+	}
+
+	// The moved database keeps its data and takes writes
+	db.BatchUpsert([]TrafficRecord{{Username: "alice", Upload: 50, ConnCount: 1, Timestamp: time.Now()}})
+	u, err := db.GetUser(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if u.TotalUpload != 150 {
+		t.Errorf("TotalUpload = %d, want 150", u.TotalUpload)
+	}
+}
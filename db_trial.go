@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Trial is a trial account and the limits it was created with
+type Trial struct {
+	Username   string    `json:"username"`
+	CreatedAt  time.Time `json:"created_at"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	QuotaBytes uint64    `json:"quota_bytes"` // Traffic allowed over the whole trial
+	RateBytes  int64     `json:"rate_bytes"`  // Per-direction tunnel rate, bytes per second
+}
+
+// CreateTrial records a trial account
+func (s *StatsDB) CreateTrial(t Trial) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`INSERT INTO user_trials (username, created_at, created_by, quota_bytes, rate_bytes) VALUES (?, ?, ?, ?, ?)`,
+		t.Username, t.CreatedAt.UTC().Format(time.RFC3339), t.CreatedBy, t.QuotaBytes, t.RateBytes)
+	return err
+}
+
+// DeleteTrial turns a trial account into a regular user
+func (s *StatsDB) DeleteTrial(username string) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	_, err := s.sqlDB().Exec(`DELETE FROM user_trials WHERE username = ?`, username)
+	return err
+}
+
+// GetTrials returns every trial account
+func (s *StatsDB) GetTrials(ctx context.Context) ([]Trial, error) {
+	rows, err := s.query(ctx, `SELECT username, created_at, COALESCE(created_by,''), quota_bytes, rate_bytes FROM user_trials ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Trial
+	for rows.Next() {
+		var t Trial
+		var created string
+		if err := rows.Scan(&t.Username, &created, &t.CreatedBy, &t.QuotaBytes, &t.RateBytes); err != nil {
+			return nil, err
+		}
+		t.CreatedAt, _ = time.Parse(time.RFC3339, created)
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// UserTraffic returns the upload plus download bytes recorded for username
+func (s *StatsDB) UserTraffic(username string) uint64 {
+	ctx := context.Background() // checked by the proxy, not for an admin
+	var total uint64
+	s.queryRow(ctx, `SELECT total_upload + total_download FROM user_stats WHERE username = ?`, username).Scan(&total)
+	return total
+}
+
+// UserTrafficSince returns the bytes username transferred since the hour
+// of since, from the hourly stats
+func (s *StatsDB) UserTrafficSince(username string, since time.Time) uint64 {
+	ctx := context.Background() // checked by the proxy, not for an admin
+	var total uint64
+	s.queryRow(ctx, `SELECT COALESCE(SUM(upload + download), 0) FROM hourly_stats WHERE user = ? AND hour >= ?`,
+		username, since.Format("2006-01-02T15:00:00")).Scan(&total)
+	return total
+}
+
+// UsersTrafficSince returns the bytes each user transferred since the hour
+// of since, from the hourly stats, read in one query
+func (s *StatsDB) UsersTrafficSince(ctx context.Context, since time.Time) (map[string]uint64, error) {
+	rows, err := s.query(ctx, `SELECT user, SUM(upload + download) FROM hourly_stats WHERE hour >= ? GROUP BY user`,
+		since.Format("2006-01-02T15:00:00"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]uint64)
+	for rows.Next() {
+		var username string
+		var total uint64
+		if err := rows.Scan(&username, &total); err != nil {
+			return nil, err
+		}
+		out[username] = total
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// DBTunnelSamples is the throughput of a closed tunnel over time
+type DBTunnelSamples struct {
+	ID              int64     `json:"id"`
+	User            string    `json:"user"`
+	Target          string    `json:"target"`
+	Started         time.Time `json:"started"`
+	Ended           time.Time `json:"ended"`
+	IntervalSeconds int       `json:"interval_seconds"` // Width of a sample
+	// Bytes carried to and from the target
+	Upload   uint64 `json:"upload"`
+	Download uint64 `json:"download"`
+	// Tightest rate limits that applied at close, in bytes per second; 0
+	// for none
+	UploadCap   int64 `json:"upload_cap"`
+	DownloadCap int64 `json:"download_cap"`
+	// Bytes up and down per interval, the last one likely shorter
+	Samples [][2]uint64 `json:"samples"`
+}
+
+// RecordTunnelSamples keeps the throughput of a closed tunnel
+func (s *StatsDB) RecordTunnelSamples(t DBTunnelSamples) error {
+	if s.ReadOnly() {
+		return errStatsReadOnly
+	}
+	samples, err := json.Marshal(t.Samples)
+	if err != nil {
+		return err
+	}
+	_, err = s.sqlDB().Exec(`INSERT INTO tunnel_samples (user, target, started, ended, interval_seconds, upload, download, upload_cap, download_cap, samples)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.User, t.Target, t.Started.UTC().Format(time.RFC3339), t.Ended.UTC().Format(time.RFC3339), t.IntervalSeconds,
+		t.Upload, t.Download, t.UploadCap, t.DownloadCap, string(samples))
+	return err
+}
+
+// GetTunnelSamples returns the limit most recently closed sampled tunnels
+// of username
+func (s *StatsDB) GetTunnelSamples(ctx context.Context, username string, limit int) ([]DBTunnelSamples, error) {
+	rows, err := s.query(ctx, `SELECT id, user, target, started, ended, interval_seconds, upload, download, upload_cap, download_cap, samples
+		FROM tunnel_samples WHERE user = ? ORDER BY ended DESC, id DESC LIMIT ?`, username, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []DBTunnelSamples{}
+	for rows.Next() {
+		var t DBTunnelSamples
+		var started, ended, samples string
+		if err := rows.Scan(&t.ID, &t.User, &t.Target, &started, &ended, &t.IntervalSeconds,
+			&t.Upload, &t.Download, &t.UploadCap, &t.DownloadCap, &samples); err != nil {
+			return nil, err
+		}
+		t.Started, _ = time.Parse(time.RFC3339, started)
+		t.Ended, _ = time.Parse(time.RFC3339, ended)
+		json.Unmarshal([]byte(samples), &t.Samples)
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Outcomes of a diagnostic check, from best to worst
+const (
+	DiagPass = "pass"
+	DiagWarn = "warn"
+	DiagFail = "fail"
+)
+
+const (
+	diagCertWarnAge  = 30 * 24 * time.Hour // Certificates expiring sooner warn
+	diagGeoIPWarnAge = 60 * 24 * time.Hour // GeoLite2 is rebuilt weekly; older databases warn
+	// The embedded data is as old as the binary; upgrades refresh it
+	diagGeoFallbackWarnAge = 365 * 24 * time.Hour
+)
+
+// DiagnosticCheck is the outcome of one check
+type DiagnosticCheck struct {
+	Name    string `json:"name"` // e.g. server.certificate
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// DiagnosticsReport is the outcome of every check, for /api/v2/diagnostics
+// and -doctor
+type DiagnosticsReport struct {
+	Status string            `json:"status"` // The worst of the checks
+	Time   time.Time         `json:"time"`
+	Checks []DiagnosticCheck `json:"checks"`
+}
+
+func (r *DiagnosticsReport) add(name, status, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, DiagnosticCheck{Name: name, Status: status, Message: fmt.Sprintf(format, args...)})
+	if diagRank(status) > diagRank(r.Status) {
+		r.Status = status
+	}
+}
+
+func diagRank(status string) int {
+	return slices.Index([]string{DiagPass, DiagWarn, DiagFail}, status)
+}
+
+// RunDiagnostics checks the certificates, paths and ports of config, the
+// GeoIP database and the stats database. statsDB is the open database, or
+// nil to open stats.db_path read-only for the check.
+func RunDiagnostics(config *Config, statsDB *StatsDB, now time.Time) *DiagnosticsReport {
+	r := &DiagnosticsReport{Status: DiagPass, Time: now}
+	config.mu.RLock()
+	geoIPPath := config.GeoIP.DBPath
+	config.mu.RUnlock()
+
+	sc := config.Server.Certificates
+	r.checkCertificate("server.certificate", sc.CertPath, sc.KeyPath, sc.CAPath, now)
+	r.checkCA("server.ca", sc.CAPath, now)
+	if sc.CRLPath != "" {
+		r.checkCRL(config, now)
+	}
+	if config.Admin.Enabled {
+		certPath, keyPath, caPath := config.GetAdminCertificates()
+		if certPath != sc.CertPath || keyPath != sc.KeyPath {
+			r.checkCertificate("admin.certificate", certPath, keyPath, caPath, now)
+		}
+		if caPath != sc.CAPath {
+			r.checkCA("admin.ca", caPath, now)
+		}
+	}
+	r.checkPaths(config, geoIPPath)
+	r.checkPorts(config)
+	if config.GeoIP.Enabled && geoIPPath != "" {
+		r.checkGeoIP(geoIPPath, now)
+	} else if config.GeoIP.Enabled {
+		r.checkGeoFallback(embeddedGeoData(), now)
+	}
+	if config.Stats.Enabled {
+		r.checkStatsDB(config.Stats.DBPath, statsDB)
+	}
+	return r
+}
+
+// checkCertificate checks that the certificate at certPath is valid, matches
+// its key and chains up to the system roots or caPath
+func (r *DiagnosticsReport) checkCertificate(name, certPath, keyPath, caPath string, now time.Time) {
+	pair, err := loadKeyPair(certPath, keyPath)
+	if err != nil {
+		r.add(name, DiagFail, "%s / %s: %v", certPath, keyPath, err)
+		return
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		r.add(name, DiagFail, "%s: %v", certPath, err)
+		return
+	}
+	if status, msg := certValidity(leaf, now); status != DiagPass {
+		r.add(name, status, "%s: %s", certPath, msg)
+		return
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if cas, err := readCertificates(caPath); err == nil {
+		for _, ca := range cas {
+			roots.AddCert(ca)
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range pair.Certificate[1:] {
+		if cert, err := x509.ParseCertificate(der); err == nil {
+			intermediates.AddCert(cert)
+		}
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, CurrentTime: now, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	if err != nil {
+		r.add(name, DiagWarn, "%s: chain incomplete, clients may reject it: %v", certPath, err)
+		return
+	}
+	_, msg := certValidity(leaf, now)
+	r.add(name, DiagPass, "%s: %s", certPath, msg)
+}
+
+// checkCA checks the CA certificates that client certificates are verified
+// against
+func (r *DiagnosticsReport) checkCA(name, caPath string, now time.Time) {
+	cas, err := readCertificates(caPath)
+	if err != nil {
+		r.add(name, DiagFail, "%s: %v", caPath, err)
+		return
+	}
+	status, msgs := DiagPass, make([]string, 0, len(cas))
+	for _, ca := range cas {
+		s, msg := certValidity(ca, now)
+		if !ca.IsCA {
+			s, msg = DiagWarn, ca.Subject.CommonName+" is not a CA certificate"
+		}
+		if diagRank(s) > diagRank(status) {
+			status = s
+		}
+		msgs = append(msgs, msg)
+	}
+	r.add(name, status, "%s: %s", caPath, strings.Join(msgs, "; "))
+}
+
+// checkCRL checks that the client certificate CRLs load and are current
+func (r *DiagnosticsReport) checkCRL(config *Config, now time.Time) {
+	c, err := loadCertRevocation(config, now)
+	if err != nil {
+		r.add("server.crl", DiagFail, "%v", err)
+		return
+	}
+	st := c.Status()
+	if !st.NextUpdate.IsZero() && now.After(st.NextUpdate) {
+		r.add("server.crl", DiagWarn, "%s: %d revoked, past its next update %s", st.Path, st.Revoked, st.NextUpdate.Format(time.RFC3339))
+		return
+	}
+	r.add("server.crl", DiagPass, "%s: %d revoked", st.Path, st.Revoked)
+}
+
+// certValidity describes cert's validity period at now
+func certValidity(cert *x509.Certificate, now time.Time) (string, string) {
+	subject := cert.Subject.CommonName
+	switch left := cert.NotAfter.Sub(now); {
+	case now.Before(cert.NotBefore):
+		return DiagFail, fmt.Sprintf("%s is not valid before %s", subject, cert.NotBefore.Format(time.RFC3339))
+	case left <= 0:
+		return DiagFail, fmt.Sprintf("%s expired %s", subject, cert.NotAfter.Format(time.RFC3339))
+	case left < diagCertWarnAge:
+		return DiagWarn, fmt.Sprintf("%s expires %s, in %d days", subject, cert.NotAfter.Format(time.RFC3339), int(left.Hours()/24))
+	default:
+		return DiagPass, fmt.Sprintf("%s valid until %s", subject, cert.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// readCertificates parses every certificate of a PEM file
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return certs, nil
+}
+
+// checkPaths checks that the files and directories the config refers to
+// exist
+func (r *DiagnosticsReport) checkPaths(config *Config, geoIPPath string) {
+	paths := [][2]string{}
+	if config.Stats.Enabled && !config.Stats.ReadOnly {
+		paths = append(paths, [2]string{"stats.db_path", filepath.Dir(config.Stats.DBPath)})
+	}
+	if config.GeoIP.Enabled && geoIPPath != "" {
+		paths = append(paths, [2]string{"geoip.db_path", geoIPPath})
+	}
+	if dir := config.I18n.CatalogDir; dir != "" {
+		paths = append(paths, [2]string{"i18n.catalog_dir", dir})
+	}
+	if dir := config.Proxy.CamouflageHealth.FallbackDir; dir != "" {
+		paths = append(paths, [2]string{"proxy.camouflage_health.fallback_dir", dir})
+	}
+
+	var missing []string
+	for _, p := range paths {
+		if _, err := os.Stat(p[1]); err != nil {
+			missing = append(missing, fmt.Sprintf("%s (%s): %v", p[0], p[1], err))
+		}
+	}
+	if len(missing) > 0 {
+		r.add("config.paths", DiagFail, "%s", strings.Join(missing, "; "))
+		return
+	}
+	if len(paths) == 0 {
+		r.add("config.paths", DiagPass, "no paths configured")
+		return
+	}
+	names := make([]string, len(paths))
+	for i, p := range paths {
+		names[i] = p[0]
+	}
+	r.add("config.paths", DiagPass, "%s exist", strings.Join(names, ", "))
+}
+
+// checkPorts checks that the configured listeners do not claim the same
+// port on the same addresses
+func (r *DiagnosticsReport) checkPorts(config *Config) {
+	type listener struct {
+		name  string
+		port  int
+		addrs []string
+	}
+	listeners := []listener{{"server.port", config.Server.Port, config.Server.BindAddresses}}
+	if config.Admin.Enabled {
+		listeners = append(listeners, listener{"admin.port", config.Admin.Port, config.Admin.BindAddresses})
+	}
+	if config.Admin.GRPC.Enabled {
+		listeners = append(listeners, listener{"admin.grpc.port", config.Admin.GRPC.Port, config.Admin.BindAddresses})
+	}
+
+	var conflicts []string
+	for i, a := range listeners {
+		if a.port <= 0 || a.port > 65535 {
+			conflicts = append(conflicts, fmt.Sprintf("%s %d is out of range", a.name, a.port))
+		}
+		for _, b := range listeners[i+1:] {
+			if a.port == b.port && addrsOverlap(a.addrs, b.addrs) {
+				conflicts = append(conflicts, fmt.Sprintf("%s and %s both use %d", a.name, b.name, a.port))
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		r.add("config.ports", DiagFail, "%s", strings.Join(conflicts, "; "))
+		return
+	}
+	r.add("config.ports", DiagPass, "%d listeners without conflicts", len(listeners))
+}
+
+// addrsOverlap reports whether two bind_addresses lists share an address;
+// an empty list is every interface
+func addrsOverlap(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	for _, addr := range a {
+		if slices.Contains(b, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGeoIP checks that the GeoIP database opens and was built recently
+func (r *DiagnosticsReport) checkGeoIP(path string, now time.Time) {
+	reader, err := geoip2.Open(path)
+	if err != nil {
+		r.add("geoip.database", DiagFail, "%s: %v", path, err)
+		return
+	}
+	defer reader.Close()
+	meta := reader.Metadata()
+	built := time.Unix(int64(meta.BuildEpoch), 0)
+	status, age := DiagPass, now.Sub(built)
+	if age > diagGeoIPWarnAge {
+		status = DiagWarn
+	}
+	r.add("geoip.database", status, "%s: %s built %s, %d days old", path, meta.DatabaseType, built.Format("2006-01-02"), int(age.Hours()/24))
+}
+
+// checkGeoFallback checks the embedded country dataset used without a
+// GeoIP database
+func (r *DiagnosticsReport) checkGeoFallback(d *geoData, now time.Time) {
+	if d == nil {
+		r.add("geoip.database", DiagWarn, "no db_path and no embedded country data in this build: country stats stay empty")
+		return
+	}
+	status, age := DiagPass, now.Sub(d.Built)
+	if age > diagGeoFallbackWarnAge {
+		status = DiagWarn
+	}
+	r.add("geoip.database", status, "no db_path, using the embedded country data: %d ranges from %s, built %s, %d days old",
+		d.Ranges(), d.Source, d.Built.Format("2006-01-02"), int(age.Hours()/24))
+}
+
+// checkStatsDB runs SQLite's quick_check on the stats database
+func (r *DiagnosticsReport) checkStatsDB(path string, db *StatsDB) {
+	if db == nil {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			r.add("stats.database", DiagWarn, "%s does not exist yet and will be created on start", path)
+			return
+		}
+		var err error
+		if db, err = NewReadOnlyStatsDB(path); err != nil {
+			r.add("stats.database", DiagFail, "%v", err)
+			return
+		}
+		defer db.Close()
+	}
+	path = db.Path()
+	rows, err := db.sqlDB().Query(`PRAGMA quick_check`)
+	if err != nil {
+		r.add("stats.database", DiagFail, "%s: %v", path, err)
+		return
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			r.add("stats.database", DiagFail, "%s: %v", path, err)
+			return
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		r.add("stats.database", DiagFail, "%s: %s", path, strings.Join(problems, "; "))
+		return
+	}
+	r.add("stats.database", DiagPass, "%s: integrity ok", path)
+}
+
+// Print writes the report for -doctor, one check per line
+func (r *DiagnosticsReport) Print(w io.Writer) {
+	for _, c := range r.Checks {
+		fmt.Fprintf(w, "%-4s  %-20s  %s\n", strings.ToUpper(c.Status), c.Name, c.Message)
+	}
+	fmt.Fprintf(w, "\nOverall: %s\n", strings.ToUpper(r.Status))
+}
+
+// handleDiagnostics serves GET /api/v2/diagnostics. It answers 200 even when
+// checks fail; the report's status tells.
+func handleDiagnostics(w http.ResponseWriter, r *http.Request, config *Config, statsDB *StatsDB) {
+	if r.Method != http.MethodGet {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSONResponse(w, WebResponse{Success: true, Data: RunDiagnostics(config, statsDB, time.Now())}, http.StatusOK)
+}
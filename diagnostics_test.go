@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunDiagnostics(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := GenerateCA("Test CA", 365*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "ca.crt"), ca.CertPEM, 0644)
+	server, err := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: "proxy.example", DNSNames: []string{"proxy.example"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, Validity: 90 * 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.WriteFiles(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	other, _ := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: "other", Validity: 10 * 24 * time.Hour})
+	other.WriteFiles(filepath.Join(dir, "other.crt"), filepath.Join(dir, "other.key"))
+
+	cfg := &Config{}
+	cfg.Server.Port = 8443
+	cfg.Server.Certificates.CertPath = filepath.Join(dir, "server.crt")
+	cfg.Server.Certificates.KeyPath = filepath.Join(dir, "server.key")
+	cfg.Server.Certificates.CAPath = filepath.Join(dir, "ca.crt")
+	cfg.Stats.Enabled = true
+	cfg.Stats.DBPath = filepath.Join(dir, "stats.db")
+	statuses := func(r *DiagnosticsReport) map[string]string {
+		m := make(map[string]string)
+		for _, c := range r.Checks {
+			m[c.Name] = c.Status
+		}
+		return m
+	}
+
+	// The database is created on start; everything else is fine
+	r := RunDiagnostics(cfg, nil, time.Now())
+	if got := statuses(r); r.Status != DiagWarn || got["server.certificate"] != DiagPass || got["server.ca"] != DiagPass ||
+		got["config.paths"] != DiagPass || got["config.ports"] != DiagPass || got["stats.database"] != DiagWarn {
+		t.Errorf("fresh setup: %+v", r)
+	}
+	db, err := NewStatsDB(cfg.Stats.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if r := RunDiagnostics(cfg, db, time.Now()); r.Status != DiagPass {
+		t.Errorf("with the database: %+v", r)
+	}
+
+	// Admin certificate with another certificate's key, a port taken twice,
+	// a missing GeoIP database
+	cfg.Admin.Enabled = true
+	cfg.Admin.Port = 8443
+	cfg.Admin.Certificates = &struct {
+		CertPath string `json:"cert_path"`
+		KeyPath  string `json:"key_path"`
+		CAPath   string `json:"ca_path"`
+	}{filepath.Join(dir, "other.crt"), filepath.Join(dir, "server.key"), cfg.Server.Certificates.CAPath}
+	cfg.GeoIP.Enabled = true
+	cfg.GeoIP.DBPath = filepath.Join(dir, "GeoLite2-Country.mmdb")
+	r = RunDiagnostics(cfg, db, time.Now())
+	got := statuses(r)
+	if r.Status != DiagFail || got["admin.certificate"] != DiagFail || got["config.ports"] != DiagFail ||
+		got["config.paths"] != DiagFail || got["geoip.database"] != DiagFail {
+		t.Errorf("broken setup: %+v", r)
+	}
+	if _, ok := got["admin.ca"]; ok {
+		t.Error("shared CA checked twice")
+	}
+
+	// The other certificate's key matches, but it expires within the month
+	cfg.Admin.Certificates.KeyPath = filepath.Join(dir, "other.key")
+	cfg.Admin.BindAddresses = []string{"10.0.0.1"}
+	cfg.Server.BindAddresses = []string{"10.0.0.2"}
+	cfg.GeoIP.Enabled = false
+	if r := RunDiagnostics(cfg, db, time.Now()); statuses(r)["admin.certificate"] != DiagWarn || statuses(r)["config.ports"] != DiagPass {
+		t.Errorf("expiring certificate: %+v", r)
+	}
+	if r := RunDiagnostics(cfg, db, time.Now().Add(100*24*time.Hour)); statuses(r)["server.certificate"] != DiagFail {
+		t.Errorf("expired certificate: %+v", r)
+	}
+
+	var out bytes.Buffer
+	r.Print(&out)
+	if !strings.Contains(out.String(), "FAIL  admin.certificate") || !strings.HasSuffix(out.String(), "Overall: FAIL\n") {
+		t.Errorf("printed report:\n%s", out.String())
+	}
+}
+
+func TestV2API_Diagnostics(t *testing.T) {
+	cfg := &Config{}
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, nil, nil, nil)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/diagnostics", nil))
+	var resp struct {
+		Data DiagnosticsReport `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET: %d %v", rec.Code, err)
+	}
+	if resp.Data.Status != DiagFail || len(resp.Data.Checks) == 0 {
+		t.Errorf("report without certificates: %+v", resp.Data)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v2/diagnostics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: %d", rec.Code)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSBL actions for clients connecting from a listed address
+const (
+	DNSBLLog    = "log"    // log and record a user event
+	DNSBLReauth = "reauth" // also require a full TLS handshake on every connection
+	DNSBLReject = "reject" // refuse the client's requests
+)
+
+// DNSBLConfig checks client source addresses against DNS blocklists
+type DNSBLConfig struct {
+	Zones        []string `json:"zones"`         // Blocklist zones, e.g. ["zen.spamhaus.org"]
+	Action       string   `json:"action"`        // log, reauth or reject (default log)
+	CacheMinutes int      `json:"cache_minutes"` // How long a lookup result is kept (default 60)
+	TimeoutMs    int      `json:"timeout_ms"`    // Lookup timeout per zone (default 2000)
+	ExemptUsers  []string `json:"exempt_users"`  // Users or CN patterns never checked
+}
+
+// dnsblEntry is a cached lookup result; zone is empty for clean addresses
+type dnsblEntry struct {
+	zone    string
+	expires time.Time
+}
+
+// DNSBL looks client addresses up on DNS blocklists, caching the results
+type DNSBL struct {
+	zones   []string
+	action  string
+	ttl     time.Duration
+	timeout time.Duration
+	exempt  *userPatterns
+	lookup  func(ctx context.Context, host string) ([]string, error)
+
+	mu      sync.Mutex
+	cache   map[string]dnsblEntry
+	noted   map[string]time.Time // user and address pairs recorded, until
+	results map[string]uint64    // lookups by result
+}
+
+// NewDNSBL parses the dnsbl settings; it returns nil if no zone is configured
+func NewDNSBL(config *Config) *DNSBL {
+	dc := config.DNSBL
+	if len(dc.Zones) == 0 {
+		return nil
+	}
+	d := &DNSBL{
+		zones:   dc.Zones,
+		action:  DNSBLLog,
+		ttl:     time.Duration(dc.CacheMinutes) * time.Minute,
+		timeout: time.Duration(dc.TimeoutMs) * time.Millisecond,
+		lookup:  net.DefaultResolver.LookupHost,
+		cache:   make(map[string]dnsblEntry),
+		noted:   make(map[string]time.Time),
+		results: make(map[string]uint64),
+	}
+	switch dc.Action {
+	case DNSBLLog, DNSBLReauth, DNSBLReject:
+		d.action = dc.Action
+	case "":
+	default:
+		log.Printf("DNSBL action: unknown action %q, using log", dc.Action)
+	}
+	if d.ttl <= 0 {
+		d.ttl = time.Hour
+	}
+	if d.timeout <= 0 {
+		d.timeout = 2 * time.Second
+	}
+	var err error
+	if d.exempt, err = newUserPatterns(dc.ExemptUsers); err != nil {
+		log.Printf("DNSBL exempt_users: %v", err)
+	}
+
+	metrics.Collect("https_proxy_dnsbl_lookups_total", "DNSBL lookups of client addresses, by result.", "counter", func() []MetricSample {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		names := make([]string, 0, len(d.results))
+		for name := range d.results {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		samples := make([]MetricSample, 0, len(names))
+		for _, name := range names {
+			samples = append(samples, MetricSample{Labels: map[string]string{"result": name}, Value: float64(d.results[name])})
+		}
+		return samples
+	})
+	return d
+}
+
+// dnsblQuery returns the name looked up for ip on zone: the address's bytes
+// (nibbles for IPv6) reversed, then the zone
+func dnsblQuery(ip netip.Addr, zone string) string {
+	var labels []string
+	if ip.Is4() {
+		b := ip.As4()
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(b[i]))
+		}
+	} else {
+		b := ip.As16()
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%x", b[i]&0x0f), fmt.Sprintf("%x", b[i]>>4))
+		}
+	}
+	return strings.Join(labels, ".") + "." + zone
+}
+
+// Listed returns the first zone listing clientIP, or "" if none does.
+// Private, loopback and unparsable addresses are never looked up; failed
+// lookups count as not listed and are not cached.
+func (d *DNSBL) Listed(clientIP string) string {
+	ip, err := netip.ParseAddr(clientIP)
+	if err != nil || ip.Unmap().IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return ""
+	}
+	ip = ip.Unmap()
+	key := ip.String()
+	if zone, ok := d.Cached(key); ok {
+		return zone
+	}
+
+	listed, failed := "", false
+	for _, zone := range d.zones {
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		addrs, err := d.lookup(ctx, dnsblQuery(ip, zone))
+		cancel()
+		if err != nil {
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				failed = true
+			}
+			continue
+		}
+		// Blocklists answer with 127.0.0.x; anything else is an error
+		// reply, such as a refusal to serve public resolvers
+		for _, a := range addrs {
+			if strings.HasPrefix(a, "127.") {
+				listed = zone
+			}
+		}
+		if listed != "" {
+			break
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case listed != "":
+		d.results["listed"]++
+		log.Printf("Client address %s is listed by %s (action %s)", key, listed, d.action)
+	case failed:
+		d.results["error"]++
+		return ""
+	default:
+		d.results["clean"]++
+	}
+	d.cache[key] = dnsblEntry{zone: listed, expires: time.Now().Add(d.ttl)}
+	return listed
+}
+
+// Cached returns the cached result for ip, without looking it up
+func (d *DNSBL) Cached(ip string) (zone string, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.cache[ip]
+	if !ok || time.Now().After(e.expires) {
+		delete(d.cache, ip)
+		return "", false
+	}
+	return e.zone, true
+}
+
+// Note reports whether username's requests from the listed clientIP should
+// be logged and recorded now: once per cache period for each pair
+func (d *DNSBL) Note(username, clientIP string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	key := username + " " + clientIP
+	if until, ok := d.noted[key]; ok && now.Before(until) {
+		return false
+	}
+	for k, until := range d.noted {
+		if !now.Before(until) {
+			delete(d.noted, k)
+		}
+	}
+	d.noted[key] = now.Add(d.ttl)
+	return true
+}
+
+// TLSConfig returns base with session tickets disabled for clients whose
+// address is listed when the action is reauth, so each of their connections
+// proves possession of the certificate's key again
+func (d *DNSBL) TLSConfig(base *tls.Config) *tls.Config {
+	if d == nil || d.action != DNSBLReauth {
+		return base
+	}
+	noTickets := base.Clone()
+	noTickets.SessionTicketsDisabled = true
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if host, _, err := net.SplitHostPort(hello.Conn.RemoteAddr().String()); err == nil {
+			if zone, _ := d.Cached(host); zone != "" {
+				return noTickets, nil
+			}
+		}
+		return nil, nil
+	}
+	return cfg
+}
+
+// noteDNSBL logs and records, once per cache period, that username connects
+// from an address the DNSBL check found listed
+func (p *Proxy) noteDNSBL(reqID string, req PolicyRequest, decision PolicyDecision) {
+	for _, check := range decision.Checks {
+		if check.Rule != "dnsbl" || check.Reason == "" || !p.Policy.DNSBL.Note(req.Username, req.ClientIP) {
+			continue
+		}
+		log.Printf("[req %s] %s (CN: %s)", reqID, check.Reason, req.Username)
+		if p.StatsDB != nil {
+			p.StatsDB.RecordUserEvent(req.Username, EventDNSBLListed, "policy", check.Reason)
+		}
+	}
+}
+
+// checkDNSBL applies the DNSBL action to clients connecting from a listed
+// address
+func (e *PolicyEngine) checkDNSBL(req PolicyRequest) PolicyCheck {
+	check := PolicyCheck{Rule: "dnsbl", Allowed: true}
+	d := e.DNSBL
+	if d == nil {
+		return check
+	}
+	if _, exempt := d.exempt.Match(req.Username); exempt {
+		return check
+	}
+	zone := d.Listed(req.ClientIP)
+	if zone == "" {
+		return check
+	}
+	check.Reason = fmt.Sprintf("Client address %s is listed by %s", req.ClientIP, zone)
+	switch {
+	case d.action == DNSBLReject:
+		check.Allowed = false
+		check.Code = ErrCodeClientBlocklisted
+		check.Status = http.StatusForbidden
+	case d.action == DNSBLReauth && req.Resumed:
+		check.Allowed = false
+		check.Reason += "; reconnect without resuming the TLS session"
+		check.Code = ErrCodeReauthRequired
+		check.Status = http.StatusForbidden
+	}
+	return check
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestDNSBLQuery(t *testing.T) {
+	if got := dnsblQuery(netip.MustParseAddr("192.0.2.99"), "zen.example"); got != "99.2.0.192.zen.example" {
+		t.Errorf("IPv4 query = %s", got)
+	}
+	want := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.bl.example"
+	if got := dnsblQuery(netip.MustParseAddr("2001:db8::1"), "bl.example"); got != want {
+		t.Errorf("IPv6 query = %s", got)
+	}
+}
+
+func TestPolicyEngine_DNSBL(t *testing.T) {
+	cfg := &Config{}
+	cfg.DNSBL = DNSBLConfig{Zones: []string{"a.example", "b.example"}, Action: DNSBLReauth, ExemptUsers: []string{"ops-*"}}
+	engine := NewPolicyEngine(cfg, nil, nil)
+	lookups := 0
+	engine.DNSBL.lookup = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		switch host {
+		case "7.2.0.192.b.example":
+			return []string{"127.0.0.2"}, nil
+		case "8.2.0.192.a.example":
+			return nil, &net.DNSError{Err: "timeout", IsTimeout: true}
+		case "9.2.0.192.a.example":
+			return []string{"192.0.2.1"}, nil // error reply, not a listing
+		}
+		return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+	}
+
+	listed := PolicyRequest{Username: "alice", ClientIP: "192.0.2.7"}
+	if d := engine.Evaluate(listed); !d.Allowed || d.Checks[len(d.Checks)-1].Reason == "" {
+		t.Fatalf("full handshake from a listed address: %+v", d)
+	}
+	listed.Resumed = true
+	if d := engine.Evaluate(listed); d.Allowed || d.Blocking.Code != ErrCodeReauthRequired {
+		t.Errorf("resumed session from a listed address: %+v", d.Blocking)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "ops-1", ClientIP: "192.0.2.7", Resumed: true}); !d.Allowed {
+		t.Error("exempt user blocked")
+	}
+	if lookups != 2 {
+		t.Errorf("lookups = %d, want 2 (results cached)", lookups)
+	}
+	for _, ip := range []string{"192.0.2.8", "192.0.2.9", "10.0.0.7", "::1"} {
+		if zone := engine.DNSBL.Listed(ip); zone != "" {
+			t.Errorf("%s listed by %s", ip, zone)
+		}
+	}
+	if _, cached := engine.DNSBL.Cached("192.0.2.8"); cached {
+		t.Error("failed lookup was cached")
+	}
+	if !engine.DNSBL.Note("alice", "192.0.2.7") || engine.DNSBL.Note("alice", "192.0.2.7") {
+		t.Error("listing should be noted once per cache period")
+	}
+
+	// Listed addresses get a configuration without session tickets
+	base := &tls.Config{}
+	getConfig := engine.DNSBL.TLSConfig(base).GetConfigForClient
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if c, _ := getConfig(&tls.ClientHelloInfo{Conn: fakeAddrConn{server, "192.0.2.7:4000"}}); c == nil || !c.SessionTicketsDisabled {
+		t.Error("listed address kept session tickets")
+	}
+	if c, _ := getConfig(&tls.ClientHelloInfo{Conn: fakeAddrConn{server, "192.0.2.10:4000"}}); c != nil {
+		t.Error("clean address got a different configuration")
+	}
+
+	cfg.DNSBL.Action = DNSBLReject
+	engine = NewPolicyEngine(cfg, nil, nil)
+	engine.DNSBL.lookup = func(ctx context.Context, host string) ([]string, error) { return []string{"127.0.0.4"}, nil }
+	if d := engine.Evaluate(PolicyRequest{Username: "alice", ClientIP: "198.51.100.1"}); d.Allowed || d.Blocking.Code != ErrCodeClientBlocklisted {
+		t.Errorf("reject action: %+v", d.Blocking)
+	}
+}
+
+// fakeAddrConn is a net.Conn reporting addr as its remote address
+type fakeAddrConn struct {
+	net.Conn
+	addr string
+}
+
+func (c fakeAddrConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
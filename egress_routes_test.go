@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEgressRoutes_Match(t *testing.T) {
+	cfg := &Config{}
+	if NewEgressRoutes(cfg) != nil {
+		t.Fatal("routes built without configuration")
+	}
+	cfg.Proxy.Routes = []EgressRouteConfig{
+		{Name: "uk", Domains: []string{"bbc.co.uk", "*.itv.com"}, SourceIP: "127.0.0.1"},
+		{Name: "us", Domains: []string{"netflix.com"}, Upstream: "http://us.example.net:3128"},
+		{Name: "bad", Domains: []string{"example.org"}, Upstream: "socks5://x"},
+	}
+	er := NewEgressRoutes(cfg)
+	for host, want := range map[string]string{
+		"www.bbc.co.uk": "uk", "itv.com": "uk", "NETFLIX.COM.": "us", "example.org": "", "co.uk": "",
+	} {
+		if got := er.Match(host).Name(); got != want {
+			t.Errorf("Match(%s) = %q, want %q", host, got, want)
+		}
+	}
+	if !er.Match("netflix.com").viaUpstream() || er.Match("bbc.co.uk").viaUpstream() {
+		t.Error("upstream routes not told apart")
+	}
+}
+
+func TestEgressRoute_Upstream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// An upstream proxy that accepts one CONNECT, greets with the target's
+	// first bytes right after its response, and echoes
+	got := make(chan *http.Request, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		got <- req
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nSSH-2.0-x\r\n")
+		io.Copy(conn, br)
+	}()
+
+	cfg := &Config{}
+	cfg.Proxy.Routes = []EgressRouteConfig{{Name: "us", Domains: []string{"example.com"}, Upstream: "http://u:p@" + ln.Addr().String()}}
+	route := NewEgressRoutes(cfg).Match("example.com")
+	conn, err := route.Dial(&net.Dialer{Timeout: 2 * time.Second}, "example.com:22")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	req := <-got
+	if req.Method != http.MethodConnect || req.Host != "example.com:22" || req.Header.Get("Proxy-Authorization") != "Basic dTpw" {
+		t.Errorf("unexpected CONNECT: %s %s %v", req.Method, req.Host, req.Header)
+	}
+	io.WriteString(conn, "ping")
+	buf := make([]byte, len("SSH-2.0-x\r\nping"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "SSH-2.0-x\r\nping" {
+		t.Errorf("tunnel read %q, %v", buf, err)
+	}
+}
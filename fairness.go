@@ -0,0 +1,206 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FairnessConfig shares the server's egress between users when it is
+// saturated. Without it tunnels write as fast as they can, so a few heavy
+// users can starve everyone else.
+type FairnessConfig struct {
+	EgressKBps   int                `json:"egress_kbps"`   // Total egress the tunnels may use, in KB/s; 0 disables the scheduler
+	Weights      map[string]float64 `json:"weights"`       // Share of users or CN patterns relative to the default of 1, e.g. {"vip-*": 2}
+	QuantumBytes int                `json:"quantum_bytes"` // Largest write granted at a time (default 16384)
+}
+
+// fairRequest is a tunnel waiting to write up to n bytes
+type fairRequest struct {
+	n       int
+	granted chan int
+}
+
+// fairUser is a user's place in the schedule. vtime is the service the
+// user has received divided by its weight; the lowest goes next.
+type fairUser struct {
+	weight  float64
+	vtime   float64
+	pending []*fairRequest
+}
+
+// FairScheduler paces all tunnel writes to the configured egress and grants
+// them in weighted fair order across users, so each active user gets a share
+// proportional to its weight whatever the number of its tunnels
+type FairScheduler struct {
+	rate    float64 // bytes per second
+	quantum int
+	weights map[string]float64
+	users   *userPatterns
+
+	mu     sync.Mutex
+	queue  map[string]*fairUser
+	vclock float64 // vtime of the last grant; users joining start here
+	wake   chan struct{}
+
+	waitNanos atomic.Int64
+}
+
+// NewFairScheduler returns nil when no egress capacity is configured
+func NewFairScheduler(config *Config) *FairScheduler {
+	fc := config.Server.Fairness
+	if fc.EgressKBps <= 0 {
+		return nil
+	}
+	s := &FairScheduler{
+		rate:    float64(fc.EgressKBps) * 1024,
+		quantum: firstPositive(fc.QuantumBytes, 16384),
+		weights: make(map[string]float64),
+		queue:   make(map[string]*fairUser),
+		wake:    make(chan struct{}, 1),
+	}
+	var entries []string
+	for entry, weight := range fc.Weights {
+		if weight <= 0 {
+			log.Printf("Fairness weight %q: %v must be positive, ignored", entry, weight)
+			continue
+		}
+		s.weights[entry] = weight
+		entries = append(entries, entry)
+	}
+	var err error
+	if s.users, err = newUserPatterns(entries); err != nil {
+		log.Printf("Fairness weights: %v", err)
+	}
+	metrics.Gauge("https_proxy_fairness_waiting_users", "Users with tunnel writes waiting for their fair share of egress.", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		n := 0
+		for _, u := range s.queue {
+			if len(u.pending) > 0 {
+				n++
+			}
+		}
+		return float64(n)
+	})
+	metrics.Counter("https_proxy_fairness_wait_seconds_total", "Time tunnel writes spent waiting for the fair scheduler.", func() float64 {
+		return time.Duration(s.waitNanos.Load()).Seconds()
+	})
+	go s.run()
+	return s
+}
+
+// weight returns username's configured weight, 1 by default
+func (s *FairScheduler) weight(username string) float64 {
+	if s.users != nil {
+		if entry, ok := s.users.Match(username); ok {
+			return s.weights[entry]
+		}
+	}
+	return 1
+}
+
+// acquire blocks until username may write, and returns how many of the n
+// bytes it may write now
+func (s *FairScheduler) acquire(username string, n int) int {
+	req := &fairRequest{n: n, granted: make(chan int, 1)}
+	start := time.Now()
+	s.mu.Lock()
+	u := s.queue[username]
+	if u == nil {
+		u = &fairUser{weight: s.weight(username)}
+		s.queue[username] = u
+	}
+	if len(u.pending) == 0 && u.vtime < s.vclock {
+		// Idle time earns no credit over users who kept sending
+		u.vtime = s.vclock
+	}
+	u.pending = append(u.pending, req)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	g := <-req.granted
+	s.waitNanos.Add(int64(time.Since(start)))
+	return g
+}
+
+// next grants the longest-waiting write of the user with the least weighted
+// service, returning the bytes granted (0 if nothing waits)
+func (s *FairScheduler) next() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var best *fairUser
+	for name, u := range s.queue {
+		if len(u.pending) == 0 {
+			if u.vtime <= s.vclock {
+				delete(s.queue, name) // caught up; forget it
+			}
+			continue
+		}
+		if best == nil || u.vtime < best.vtime {
+			best = u
+		}
+	}
+	if best == nil {
+		return 0
+	}
+	req := best.pending[0]
+	best.pending = best.pending[1:]
+	g := min(req.n, s.quantum)
+	s.vclock = best.vtime
+	best.vtime += float64(g) / best.weight
+	req.granted <- g
+	return g
+}
+
+// run hands out grants paced to the egress rate
+func (s *FairScheduler) run() {
+	var next time.Time
+	for {
+		g := s.next()
+		if g == 0 {
+			<-s.wake
+			continue
+		}
+		now := time.Now()
+		if next.Before(now) {
+			next = now
+		}
+		next = next.Add(time.Duration(float64(g) / s.rate * float64(time.Second)))
+		if wait := time.Until(next); wait > time.Millisecond {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// Writer wraps a tunnel writer of username so its writes wait for their
+// fair share; without a scheduler w is returned as is
+func (s *FairScheduler) Writer(username string, w io.Writer) io.Writer {
+	if s == nil {
+		return w
+	}
+	return &fairWriter{w: w, s: s, user: username}
+}
+
+type fairWriter struct {
+	w    io.Writer
+	s    *FairScheduler
+	user string
+}
+
+func (fw *fairWriter) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		g := fw.s.acquire(fw.user, len(b)-written)
+		n, err := fw.w.Write(b[written : written+g])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFairScheduler_Disabled(t *testing.T) {
+	var s *FairScheduler
+	if NewFairScheduler(&Config{}) != nil {
+		t.Fatal("scheduler created without egress_kbps")
+	}
+	if w := s.Writer("alice", io.Discard); w != io.Discard {
+		t.Error("nil scheduler should return the writer as is")
+	}
+}
+
+func TestFairScheduler_WeightedShares(t *testing.T) {
+	cfg := &Config{}
+	cfg.Server.Fairness = FairnessConfig{
+		EgressKBps:   2048,
+		QuantumBytes: 4096,
+		Weights:      map[string]float64{"vip-*": 3},
+	}
+	s := NewFairScheduler(cfg)
+
+	// bob opens four tunnels against vip-alice's one; weights, not tunnel
+	// counts, decide the shares
+	var alice, bob atomic.Int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	send := func(user string, counter *atomic.Int64) {
+		defer wg.Done()
+		w := s.Writer(user, io.Discard)
+		buf := make([]byte, 32*1024)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			n, _ := w.Write(buf)
+			counter.Add(int64(n))
+		}
+	}
+	wg.Add(5)
+	go send("vip-alice", &alice)
+	for i := 0; i < 4; i++ {
+		go send("bob", &bob)
+	}
+	time.Sleep(500 * time.Millisecond)
+	a, b := alice.Load(), bob.Load()
+	close(stop)
+	wg.Wait()
+
+	if b == 0 {
+		t.Fatalf("bob got no bandwidth (alice %d)", a)
+	}
+	if ratio := float64(a) / float64(b); ratio < 2 || ratio > 4.5 {
+		t.Errorf("alice/bob = %d/%d = %.2f, want about 3", a, b, ratio)
+	}
+	// Pacing keeps the total near 2048 KB/s over 0.5s
+	if total := a + b; total > 1536*1024 {
+		t.Errorf("total %d bytes exceeds the egress capacity", total)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Client address disclosure modes for requests forwarded to the camouflage
+// site. Tunnels carry the client's own TLS, so nothing can be added to them.
+const (
+	ForwardedOmit    = "omit"    // Remove X-Forwarded-For, Forwarded and X-Real-IP
+	ForwardedAppend  = "append"  // Add the client's address to the headers it sent
+	ForwardedReplace = "replace" // Send only the client's address
+)
+
+// ForwardedForConfig decides whether the camouflage site learns the
+// addresses of the clients whose requests are forwarded to it
+type ForwardedForConfig struct {
+	Mode  string            `json:"mode"`  // omit (default), append or replace
+	Users map[string]string `json:"users"` // Mode per user or CN pattern, for clients with a valid certificate
+}
+
+// ForwardedForPolicy applies proxy.forwarded_for. A nil policy omits the
+// headers.
+type ForwardedForPolicy struct {
+	mode  string
+	users *userPatterns
+	modes map[string]string // by users entry
+}
+
+// NewForwardedForPolicy parses proxy.forwarded_for; it returns nil if every
+// client's address is omitted
+func NewForwardedForPolicy(config *Config) *ForwardedForPolicy {
+	fc := config.Proxy.ForwardedFor
+	f := &ForwardedForPolicy{mode: ForwardedOmit, modes: make(map[string]string)}
+	if validForwardedMode(fc.Mode) {
+		f.mode = fc.Mode
+	} else if fc.Mode != "" {
+		log.Printf("Forwarded-for mode %q unknown, omitting client addresses", fc.Mode)
+	}
+	entries := make([]string, 0, len(fc.Users))
+	for entry, mode := range fc.Users {
+		if !validForwardedMode(mode) {
+			log.Printf("Forwarded-for mode %q for %s unknown, ignored", mode, entry)
+			continue
+		}
+		f.modes[entry] = mode
+		entries = append(entries, entry)
+	}
+	var err error
+	if f.users, err = newUserPatterns(entries); err != nil {
+		log.Printf("Forwarded-for users: %v", err)
+	}
+	if f.mode == ForwardedOmit && len(entries) == 0 {
+		return nil
+	}
+	return f
+}
+
+func validForwardedMode(mode string) bool {
+	return mode == ForwardedOmit || mode == ForwardedAppend || mode == ForwardedReplace
+}
+
+// Mode returns the disclosure mode for username; clients without a valid
+// certificate have no username and get the default mode
+func (f *ForwardedForPolicy) Mode(username string) string {
+	if f == nil {
+		return ForwardedOmit
+	}
+	if entry, ok := f.users.Match(username); ok {
+		return f.modes[entry]
+	}
+	return f.mode
+}
+
+// Apply sets the client address headers of req, forwarded on behalf of r
+func (f *ForwardedForPolicy) Apply(req, r *http.Request, username string) {
+	// X-Real-IP is never passed on: its single address cannot be appended
+	// to, and one sent by the client cannot be told from ours
+	req.Header.Del("X-Real-Ip")
+	mode := f.Mode(username)
+	if mode == ForwardedOmit {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("Forwarded")
+		return
+	}
+
+	clientIP := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientIP = h
+	}
+	node := clientIP
+	if strings.Contains(node, ":") {
+		node = `"[` + node + `]"`
+	}
+	xff, fwd := clientIP, "for="+node
+	if mode == ForwardedAppend {
+		if prior := strings.Join(req.Header.Values("X-Forwarded-For"), ", "); prior != "" {
+			xff = prior + ", " + xff
+		}
+		if prior := strings.Join(req.Header.Values("Forwarded"), ", "); prior != "" {
+			fwd = prior + ", " + fwd
+		}
+	}
+	req.Header.Set("X-Forwarded-For", xff)
+	req.Header.Set("Forwarded", fwd)
+}
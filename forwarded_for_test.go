@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedForPolicy(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "[2001:db8::1]:4711"
+	forward := func(f *ForwardedForPolicy, username string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		req.Header.Set("Forwarded", "for=10.0.0.1")
+		req.Header.Set("X-Real-Ip", "10.0.0.1")
+		f.Apply(req, r, username)
+		return req.Header
+	}
+
+	// Omitted by default, including what the client sent
+	cfg := &Config{}
+	f := NewForwardedForPolicy(cfg)
+	if f != nil {
+		t.Fatal("policy built for the default")
+	}
+	if h := forward(f, "alice"); len(h.Values("X-Forwarded-For"))+len(h.Values("Forwarded"))+len(h.Values("X-Real-Ip")) != 0 {
+		t.Errorf("addresses disclosed by default: %v", h)
+	}
+
+	cfg.Proxy.ForwardedFor.Mode = ForwardedReplace
+	cfg.Proxy.ForwardedFor.Users = map[string]string{"ops-*": ForwardedAppend, "alice": ForwardedOmit, "bob": "bogus"}
+	f = NewForwardedForPolicy(cfg)
+	h := forward(f, "")
+	if h.Get("X-Forwarded-For") != "2001:db8::1" || h.Get("Forwarded") != `for="[2001:db8::1]"` || h.Get("X-Real-Ip") != "" {
+		t.Errorf("replace: %v", h)
+	}
+	h = forward(f, "ops-eu")
+	if h.Get("X-Forwarded-For") != "10.0.0.1, 2001:db8::1" || h.Get("Forwarded") != `for=10.0.0.1, for="[2001:db8::1]"` {
+		t.Errorf("append: %v", h)
+	}
+	if h := forward(f, "alice"); h.Get("X-Forwarded-For") != "" {
+		t.Errorf("omit for alice: %v", h)
+	}
+	if f.Mode("bob") != ForwardedReplace {
+		t.Errorf("unknown mode for bob not ignored: %s", f.Mode("bob"))
+	}
+}
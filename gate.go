@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GateConfig puts a knock in front of client certificate authentication:
+// the proxy only asks a source address for a certificate after a request to
+// the secret path from it. Everyone else gets the camouflage site without
+// the handshake revealing that certificates are accepted.
+type GateConfig struct {
+	Enabled            bool     `json:"enabled"`
+	Path               string   `json:"path"`                 // Secret knock path, e.g. "/k-3f9c2a"
+	TokenSecret        string   `json:"token_secret"`         // If set, the knock is Path + "/" + the current rotating token
+	TokenPeriodSeconds int      `json:"token_period_seconds"` // How often the token changes (default 3600)
+	OpenMinutes        int      `json:"open_minutes"`         // How long a knock opens the address, renewed by authorized requests (default 10)
+	AllowNetworks      []string `json:"allow_networks"`       // CIDRs that never need to knock
+}
+
+// KnockGate tracks the source addresses that knocked
+type KnockGate struct {
+	path    string
+	secret  []byte
+	period  time.Duration
+	open    time.Duration
+	allowed []netip.Prefix
+
+	mu    sync.Mutex
+	until map[netip.Addr]time.Time
+
+	knocks atomic.Uint64
+}
+
+// GateStatus is the payload of /api/v2/gate
+type GateStatus struct {
+	Open []GateAddress `json:"open"`
+	// Token and TokenExpires are set when the knock needs a rotating token
+	Token        string    `json:"token,omitempty"`
+	TokenExpires time.Time `json:"token_expires,omitempty"`
+}
+
+// GateAddress is a source address that may present a client certificate
+type GateAddress struct {
+	Address string    `json:"address"`
+	Until   time.Time `json:"until"`
+}
+
+// NewKnockGate parses the gate settings; it returns nil when the gate is
+// off or has no path
+func NewKnockGate(config *Config) *KnockGate {
+	gc := config.Gate
+	if !gc.Enabled {
+		return nil
+	}
+	if !strings.HasPrefix(gc.Path, "/") || len(gc.Path) < 2 {
+		log.Printf("Gate: path must be a secret absolute path, gate disabled")
+		return nil
+	}
+	g := &KnockGate{
+		path:   strings.TrimSuffix(gc.Path, "/"),
+		secret: []byte(secretValue(gc.TokenSecret)),
+		period: time.Duration(gc.TokenPeriodSeconds) * time.Second,
+		open:   time.Duration(gc.OpenMinutes) * time.Minute,
+		until:  make(map[netip.Addr]time.Time),
+	}
+	if g.period <= 0 {
+		g.period = time.Hour
+	}
+	if g.open <= 0 {
+		g.open = 10 * time.Minute
+	}
+	for _, cidr := range gc.AllowNetworks {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			log.Printf("Gate allow_networks: %v, ignored", err)
+			continue
+		}
+		g.allowed = append(g.allowed, p.Masked())
+	}
+
+	metrics.Counter("https_proxy_gate_knocks_total", "Valid knocks that opened a source address.", func() float64 {
+		return float64(g.knocks.Load())
+	})
+	metrics.Gauge("https_proxy_gate_open_addresses", "Source addresses currently asked for a client certificate", func() float64 {
+		return float64(len(g.Status(time.Now()).Open))
+	})
+	return g
+}
+
+// token returns the rotating token of the period containing t
+func (g *KnockGate) token(t time.Time) string {
+	mac := hmac.New(sha256.New, g.secret)
+	binary.Write(mac, binary.BigEndian, t.Unix()/int64(g.period/time.Second))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// Knock opens the request's source address if r is a valid knock. The
+// token of the previous period is still accepted, so a token delivered
+// just before it rotates works.
+func (g *KnockGate) Knock(r *http.Request, now time.Time) bool {
+	if g == nil {
+		return false
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, g.path)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return false
+	}
+	rest = strings.Trim(rest, "/")
+	if len(g.secret) == 0 {
+		if rest != "" {
+			return false
+		}
+	} else if !hmac.Equal([]byte(rest), []byte(g.token(now))) && !hmac.Equal([]byte(rest), []byte(g.token(now.Add(-g.period)))) {
+		return false
+	}
+	addr, ok := remoteAddr(r.RemoteAddr)
+	if !ok {
+		return false
+	}
+	g.mu.Lock()
+	g.until[addr] = now.Add(g.open)
+	g.mu.Unlock()
+	g.knocks.Add(1)
+	return true
+}
+
+// Renew extends the window of an open address after an authorized request
+func (g *KnockGate) Renew(remote string, now time.Time) {
+	addr, ok := remoteAddr(remote)
+	if g == nil || !ok {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if until, open := g.until[addr]; open && now.Before(until) {
+		g.until[addr] = now.Add(g.open)
+	}
+}
+
+// IsOpen reports whether the source address remote ("host:port") may
+// present a client certificate
+func (g *KnockGate) IsOpen(remote string, now time.Time) bool {
+	if g == nil {
+		return true
+	}
+	addr, ok := remoteAddr(remote)
+	if !ok {
+		return false
+	}
+	for _, p := range g.allowed {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	until, open := g.until[addr]
+	if open && !now.Before(until) {
+		delete(g.until, addr)
+		open = false
+	}
+	return open
+}
+
+// remoteAddr parses the address of a "host:port" remote address
+func remoteAddr(remote string) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+// TLSConfig returns base set up to ask only open addresses for a client
+// certificate
+func (g *KnockGate) TLSConfig(base *tls.Config) *tls.Config {
+	if g == nil {
+		return base
+	}
+	inner := base.GetConfigForClient
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		chosen := base
+		if inner != nil {
+			c, err := inner(hello)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				chosen = c
+			}
+		}
+		if g.IsOpen(hello.Conn.RemoteAddr().String(), time.Now()) {
+			if chosen == base {
+				return nil, nil
+			}
+			return chosen, nil
+		}
+		closed := chosen.Clone()
+		closed.GetConfigForClient = nil
+		closed.ClientAuth = tls.NoClientCert
+		return closed, nil
+	}
+	return cfg
+}
+
+// Status returns the open addresses and the current token
+func (g *KnockGate) Status(now time.Time) GateStatus {
+	var st GateStatus
+	g.mu.Lock()
+	for addr, until := range g.until {
+		if now.Before(until) {
+			st.Open = append(st.Open, GateAddress{Address: addr.String(), Until: until})
+		}
+	}
+	g.mu.Unlock()
+	sort.Slice(st.Open, func(i, j int) bool { return st.Open[i].Address < st.Open[j].Address })
+	if len(g.secret) > 0 {
+		st.Token = g.token(now)
+		period := int64(g.period / time.Second)
+		st.TokenExpires = time.Unix((now.Unix()/period+1)*period, 0)
+	}
+	return st
+}
+
+// handleGate serves /api/v2/gate: GET returns the open addresses and the
+// current knock token, for delivery to users out of band
+func handleGate(w http.ResponseWriter, r *http.Request, g *KnockGate) {
+	if r.Method != http.MethodGet {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+	if g == nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Gate is not enabled"}, http.StatusNotFound)
+		return
+	}
+	writeJSONResponse(w, WebResponse{Success: true, Data: g.Status(time.Now())}, http.StatusOK)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKnockGate(t *testing.T) {
+	cfg := &Config{}
+	cfg.Gate = GateConfig{Enabled: true, Path: "/k-secret", TokenSecret: "s3cret", OpenMinutes: 5, AllowNetworks: []string{"10.0.0.0/8"}}
+	g := NewKnockGate(cfg)
+	now := time.Date(2026, 5, 1, 12, 30, 0, 0, time.UTC)
+	knock := func(path, remote string, at time.Time) bool {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remote
+		return g.Knock(r, at)
+	}
+
+	if g.IsOpen("192.0.2.1:5000", now) || !g.IsOpen("10.1.2.3:5000", now) {
+		t.Fatal("only allowed networks are open before a knock")
+	}
+	for _, path := range []string{"/k-secret", "/k-secret/wrong", "/k-secretx/" + g.token(now), "/other/" + g.token(now)} {
+		if knock(path, "192.0.2.1:5000", now) {
+			t.Errorf("%s accepted as a knock", path)
+		}
+	}
+	if !knock("/k-secret/"+g.token(now.Add(-time.Hour)), "192.0.2.1:5000", now) {
+		t.Fatal("previous period's token rejected")
+	}
+	if !g.IsOpen("192.0.2.1:6000", now.Add(4*time.Minute)) || g.IsOpen("192.0.2.2:5000", now) {
+		t.Error("knock should open its source address only")
+	}
+	g.Renew("192.0.2.1:6000", now.Add(4*time.Minute))
+	if !g.IsOpen("192.0.2.1:6000", now.Add(8*time.Minute)) || g.IsOpen("192.0.2.1:6000", now.Add(10*time.Minute)) {
+		t.Error("renewal should extend the window by open_minutes")
+	}
+	if knock("/k-secret/"+g.token(now.Add(-2*time.Hour)), "192.0.2.3:5000", now) {
+		t.Error("expired token accepted")
+	}
+	if st := g.Status(now); st.Token != g.token(now) || !st.TokenExpires.Equal(time.Date(2026, 5, 1, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("status = %+v", st)
+	}
+
+	cfg.Gate.Path = "k-secret"
+	if NewKnockGate(cfg) != nil {
+		t.Error("relative path should disable the gate")
+	}
+}
+
+func TestKnockGate_Handshake(t *testing.T) {
+	ca, err := GenerateCA("Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: "proxy", ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, Validity: time.Hour})
+	client, _ := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: "alice", ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, Validity: time.Hour})
+
+	cfg := &Config{}
+	cfg.Gate = GateConfig{Enabled: true, Path: "/knock"}
+	g := NewKnockGate(cfg)
+	serverCfg := g.TLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Cert.Raw}, PrivateKey: server.Key}},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	peerCerts := func() int {
+		c, s := net.Pipe()
+		defer c.Close()
+		defer s.Close()
+		conn := tls.Server(fakeAddrConn{s, "192.0.2.1:4000"}, serverCfg)
+		done := make(chan int)
+		go func() {
+			conn.Handshake()
+			done <- len(conn.ConnectionState().PeerCertificates)
+		}()
+		tls.Client(c, &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{{Certificate: [][]byte{client.Cert.Raw}, PrivateKey: client.Key}},
+		}).Handshake()
+		return <-done
+	}
+
+	if n := peerCerts(); n != 0 {
+		t.Errorf("certificate requested before the knock (%d sent)", n)
+	}
+	r := httptest.NewRequest("GET", "/knock", nil)
+	r.RemoteAddr = "192.0.2.1:3999"
+	g.Knock(r, time.Now())
+	if n := peerCerts(); n != 1 {
+		t.Errorf("certificate not requested after the knock (%d sent)", n)
+	}
+}
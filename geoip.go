@@ -8,10 +8,12 @@ import (
 	"github.com/oschwald/geoip2-golang"
 )
 
-// GeoIPService provides country lookup from IP addresses using MaxMind GeoLite2.
+// GeoIPService provides country lookup from IP addresses using MaxMind
+// GeoLite2, or the dataset embedded in the binary without one.
 type GeoIPService struct {
-	mu     sync.RWMutex
-	reader *geoip2.Reader
+	mu       sync.RWMutex
+	reader   *geoip2.Reader
+	fallback *geoData // Used while no database is open
 }
 
 // GeoResult holds the result of a GeoIP lookup.
@@ -22,27 +24,39 @@ type GeoResult struct {
 }
 
 // NewGeoIPService opens the MaxMind GeoLite2 database at dbPath.
-// If dbPath is empty or the file cannot be opened, a nil-safe service is
-// returned that always produces empty results (GeoIP is optional).
+// If dbPath is empty or the file cannot be opened, the embedded country
+// dataset is used instead; without one, a nil-safe service is returned
+// that always produces empty results (GeoIP is optional).
 func NewGeoIPService(dbPath string) *GeoIPService {
 	if dbPath == "" {
-		log.Println("[GeoIP] No database path configured, GeoIP disabled")
-		return &GeoIPService{}
+		log.Println("[GeoIP] No database path configured")
+		return newFallbackGeoIP()
 	}
 
 	reader, err := geoip2.Open(dbPath)
 	if err != nil {
-		log.Printf("[GeoIP] Failed to open database %s: %v (GeoIP disabled)", dbPath, err)
-		return &GeoIPService{}
+		log.Printf("[GeoIP] Failed to open database %s: %v", dbPath, err)
+		return newFallbackGeoIP()
 	}
 	log.Printf("[GeoIP] Loaded database: %s", dbPath)
 	return &GeoIPService{reader: reader}
 }
 
+// newFallbackGeoIP returns a service answering from the embedded dataset
+func newFallbackGeoIP() *GeoIPService {
+	d := embeddedGeoData()
+	if d == nil {
+		log.Println("[GeoIP] No embedded country data in this build, GeoIP disabled")
+		return &GeoIPService{}
+	}
+	log.Printf("[GeoIP] Using the embedded country data: %d ranges from %s, built %s", d.Ranges(), d.Source, d.Built.Format("2006-01-02"))
+	return &GeoIPService{fallback: d}
+}
+
 // Lookup resolves an IP string to a GeoResult.
 // Returns nil if GeoIP is disabled or the lookup fails.
 func (g *GeoIPService) Lookup(ipStr string) *GeoResult {
-	if g == nil || g.reader == nil {
+	if g == nil {
 		return nil
 	}
 
@@ -53,6 +67,12 @@ func (g *GeoIPService) Lookup(ipStr string) *GeoResult {
 
 	g.mu.RLock()
 	defer g.mu.RUnlock()
+	if g.reader == nil {
+		if g.fallback == nil {
+			return nil
+		}
+		return g.fallback.Lookup(ip)
+	}
 
 	record, err := g.reader.Country(ip)
 	if err != nil {
@@ -66,9 +86,34 @@ func (g *GeoIPService) Lookup(ipStr string) *GeoResult {
 	}
 }
 
+// Reload switches to the database at dbPath. The current database stays in
+// use if the new one cannot be opened.
+func (g *GeoIPService) Reload(dbPath string) error {
+	reader, err := geoip2.Open(dbPath)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	old := g.reader
+	g.reader = reader
+	g.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	log.Printf("[GeoIP] Loaded database: %s", dbPath)
+	return nil
+}
+
 // Close releases the GeoIP database resources.
 func (g *GeoIPService) Close() {
-	if g != nil && g.reader != nil {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.reader != nil {
 		g.reader.Close()
 	}
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// geoDataFile is the IP-to-country dataset built into the binary, used when
+// no MaxMind database is configured. It is generated from a free CSV
+// dataset by "make geodata" (see scripts/geodata); a tree without one
+// embeds an empty dataset.
+//
+//go:embed geodata/countries.bin.gz
+var geoDataFile []byte
+
+// geoDataMagic starts the decompressed dataset, followed by (big endian):
+// the build time (int64 Unix seconds), the source (uint8 length and text,
+// shown as its attribution), the country codes (uint16 count and 2 bytes
+// each), the IPv4 ranges (uint32 count, then uint32 first address and
+// uint16 country index each) and the IPv6 ranges (uint32 count, then the
+// uint64 first /64 and uint16 country index each). Ranges are sorted and
+// cover the address space from their first address to the next range's;
+// index geoDataNone marks unassigned space.
+const (
+	geoDataMagic = "HPGEO1"
+	geoDataNone  = 0xFFFF
+)
+
+// geoData is a loaded IP-to-country dataset
+type geoData struct {
+	Built     time.Time
+	Source    string
+	countries []string
+	v4        []uint32
+	v4Country []uint16
+	v6        []uint64
+	v6Country []uint16
+}
+
+var (
+	embeddedGeoOnce sync.Once
+	embeddedGeo     *geoData
+)
+
+// embeddedGeoData returns the dataset built into the binary, or nil if it
+// holds no ranges. It is decompressed on first use.
+func embeddedGeoData() *geoData {
+	embeddedGeoOnce.Do(func() {
+		d, err := parseGeoData(geoDataFile)
+		if err != nil {
+			log.Printf("[GeoIP] Embedded country data unreadable: %v", err)
+			return
+		}
+		if d.Ranges() > 0 {
+			embeddedGeo = d
+		}
+	})
+	return embeddedGeo
+}
+
+// parseGeoData reads a gzipped dataset
+func parseGeoData(data []byte) (*geoData, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(raw)
+	magic := make([]byte, len(geoDataMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != geoDataMagic {
+		return nil, errors.New("not a country dataset")
+	}
+
+	d := &geoData{}
+	var built int64
+	var sourceLen uint8
+	var n16 uint16
+	read := func(v any) {
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, v)
+		}
+	}
+	read(&built)
+	read(&sourceLen)
+	source := make([]byte, sourceLen)
+	read(source)
+	read(&n16)
+	codes := make([]byte, 2*int(n16))
+	read(codes)
+	var n4 uint32
+	read(&n4)
+	if err == nil && int(n4)*6 > r.Len() {
+		return nil, errors.New("truncated IPv4 ranges")
+	}
+	d.v4, d.v4Country = make([]uint32, n4), make([]uint16, n4)
+	for i := range d.v4 {
+		read(&d.v4[i])
+		read(&d.v4Country[i])
+	}
+	var n6 uint32
+	read(&n6)
+	if err == nil && int(n6)*10 > r.Len() {
+		return nil, errors.New("truncated IPv6 ranges")
+	}
+	d.v6, d.v6Country = make([]uint64, n6), make([]uint16, n6)
+	for i := range d.v6 {
+		read(&d.v6[i])
+		read(&d.v6Country[i])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("truncated country dataset: %w", err)
+	}
+
+	d.Built, d.Source = time.Unix(built, 0), string(source)
+	for i := 0; i < len(codes); i += 2 {
+		d.countries = append(d.countries, string(codes[i:i+2]))
+	}
+	for _, idx := range append(append([]uint16{}, d.v4Country...), d.v6Country...) {
+		if idx != geoDataNone && int(idx) >= len(d.countries) {
+			return nil, fmt.Errorf("country index %d out of range", idx)
+		}
+	}
+	return d, nil
+}
+
+// Ranges returns the number of address ranges of the dataset
+func (d *geoData) Ranges() int {
+	return len(d.v4) + len(d.v6)
+}
+
+// Lookup returns the country of ip, or nil for unassigned space
+func (d *geoData) Lookup(ip net.IP) *GeoResult {
+	idx := uint16(geoDataNone)
+	if v4 := ip.To4(); v4 != nil {
+		a := binary.BigEndian.Uint32(v4)
+		if i := sort.Search(len(d.v4), func(i int) bool { return d.v4[i] > a }) - 1; i >= 0 {
+			idx = d.v4Country[i]
+		}
+	} else if v6 := ip.To16(); v6 != nil {
+		a := binary.BigEndian.Uint64(v6[:8])
+		if i := sort.Search(len(d.v6), func(i int) bool { return d.v6[i] > a }) - 1; i >= 0 {
+			idx = d.v6Country[i]
+		}
+	}
+	if idx == geoDataNone {
+		return nil
+	}
+	code := d.countries[idx]
+	c := countryInfo(code)
+	return &GeoResult{Country: code, CountryName: c.Name, Continent: c.Continent}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// testGeoData encodes a dataset as scripts/geodata writes it
+func testGeoData(countries []string, v4 []uint32, v4Country []uint16, v6 []uint64, v6Country []uint16) []byte {
+	var raw bytes.Buffer
+	raw.WriteString(geoDataMagic)
+	write := func(v any) { binary.Write(&raw, binary.BigEndian, v) }
+	write(time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC).Unix())
+	write(uint8(len("test data")))
+	raw.WriteString("test data")
+	write(uint16(len(countries)))
+	for _, c := range countries {
+		raw.WriteString(c)
+	}
+	write(uint32(len(v4)))
+	for i := range v4 {
+		write(v4[i])
+		write(v4Country[i])
+	}
+	write(uint32(len(v6)))
+	for i := range v6 {
+		write(v6[i])
+		write(v6Country[i])
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(raw.Bytes())
+	zw.Close()
+	return gz.Bytes()
+}
+
+func TestGeoData(t *testing.T) {
+	if _, err := parseGeoData(geoDataFile); err != nil {
+		t.Fatalf("embedded dataset: %v", err)
+	}
+
+	data := testGeoData([]string{"AU", "CN", "DE", "QQ"},
+		[]uint32{0x01000000, 0x01000100, 0x01000400, 0x01000800, 0x02000000}, []uint16{0, 1, 0, geoDataNone, 3},
+		[]uint64{0x20010db800000000, 0x20010db900000000}, []uint16{2, geoDataNone})
+	d, err := parseGeoData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Ranges() != 7 || d.Source != "test data" || d.Built.Year() != 2026 {
+		t.Fatalf("dataset = %+v", d)
+	}
+	g := &GeoIPService{fallback: d}
+	for ip, want := range map[string]string{
+		"0.255.255.255":         "",
+		"1.0.0.1":               "AU",
+		"1.0.1.255":             "CN",
+		"1.0.7.255":             "AU",
+		"1.0.8.0":               "",
+		"::ffff:1.0.1.1":        "CN",
+		"2001:db8::1":           "DE",
+		"2001:db8:ffff::1":      "DE",
+		"2001:db9::1":           "",
+		"2001:db7:ffff:ffff::1": "",
+		"not an address":        "",
+	} {
+		got := g.Lookup(ip)
+		if code := ""; got != nil {
+			code = got.Country
+			if code != want {
+				t.Errorf("%s = %+v, want %s", ip, got, want)
+			}
+		} else if want != "" {
+			t.Errorf("%s not found, want %s", ip, want)
+		}
+	}
+	if got := g.Lookup("1.0.0.1"); got.CountryName != "Australia" || got.Continent != "OC" {
+		t.Errorf("AU = %+v", got)
+	}
+	if got := g.Lookup("2.0.0.1"); got.CountryName != "QQ" || got.Continent != "" {
+		t.Errorf("unknown code = %+v", got)
+	}
+
+	for name, bad := range map[string][]byte{
+		"not gzip":  []byte("HPGEO1"),
+		"truncated": data[:len(data)-8],
+		"bad index": testGeoData([]string{"AU"}, []uint32{0}, []uint16{1}, nil, nil),
+	} {
+		if _, err := parseGeoData(bad); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+}
+
+func TestEmbeddedGeoData(t *testing.T) {
+	d := embeddedGeoData()
+	if d == nil {
+		t.Skip("the tree embeds the empty placeholder dataset; run make geodata-dbip and commit geodata/countries.bin.gz")
+	}
+	if d.Source == "" {
+		t.Error("embedded dataset has no attribution")
+	}
+	g := &GeoIPService{fallback: d}
+	for ip, want := range map[string]string{"8.8.8.8": "US", "2001:4860:4860::8888": "US"} {
+		if got := g.Lookup(ip); got == nil || got.Country != want {
+			t.Errorf("%s = %+v, want %s", ip, got, want)
+		}
+	}
+}
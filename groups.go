@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// groupOUPrefix marks the client certificate OUs naming the user's groups,
+// e.g. "group-staff"
+const groupOUPrefix = "group-"
+
+// GroupConfig is a group in the groups section. Members inherit the
+// group's policies unless they have their own.
+type GroupConfig struct {
+	Members      []string            `json:"members"`                 // Users or CN patterns in the group
+	RateLimit    *RateLimitRule      `json:"rate_limit,omitempty"`    // Used when proxy.rate_limit.users has no entry for the user
+	Quota        *GroupQuotaConfig   `json:"quota,omitempty"`         // Used when the user has no quota of their own
+	ServingHours *ServingHoursConfig `json:"serving_hours,omitempty"` // Replaces the server-wide curfews; no curfews: always open
+	ACL          []ACLRuleConfig     `json:"acl,omitempty"`           // Checked after the user's own ACL rules, before the global ones
+}
+
+// GroupQuotaConfig is the traffic quota each member of a group gets, or
+// that they share if it is pooled
+type GroupQuotaConfig struct {
+	Period  string `json:"period"` // daily, weekly or monthly (default monthly)
+	QuotaMB int64  `json:"quota_mb"`
+	Pooled  bool   `json:"pooled"` // Members share quota_mb instead of each getting it
+	// The most a member may use of a pooled quota, unless member_quotas_mb
+	// has an entry for them; 0 for no cap
+	MemberQuotaMB  int64            `json:"member_quota_mb,omitempty"`
+	MemberQuotasMB map[string]int64 `json:"member_quotas_mb,omitempty"` // By username
+}
+
+// userQuota returns the quota c describes, set by setBy, or nil after
+// logging what is wrong with it
+func (c *GroupQuotaConfig) userQuota(what, setBy string) *UserQuota {
+	period := c.Period
+	if period == "" {
+		period = QuotaMonthly
+	}
+	switch {
+	case period != QuotaDaily && period != QuotaWeekly && period != QuotaMonthly:
+		log.Printf("%s: %v, ignored", what, errQuotaPeriod)
+	case c.QuotaMB <= 0:
+		log.Printf("%s: quota_mb must be positive, ignored", what)
+	default:
+		return &UserQuota{Period: period, QuotaBytes: uint64(c.QuotaMB) << 20, SetBy: setBy}
+	}
+	return nil
+}
+
+// quotaPool holds the caps of the members of a group sharing its quota
+type quotaPool struct {
+	memberCap  uint64
+	memberCaps map[string]uint64
+}
+
+// quotaPool returns the pool c describes, or nil if it is not pooled.
+// Invalid caps are logged and ignored.
+func (c *GroupQuotaConfig) quotaPool(what string) *quotaPool {
+	if !c.Pooled {
+		if c.MemberQuotaMB != 0 || len(c.MemberQuotasMB) > 0 {
+			log.Printf("%s: member quotas need pooled, ignored", what)
+		}
+		return nil
+	}
+	p := &quotaPool{memberCaps: make(map[string]uint64)}
+	switch {
+	case c.MemberQuotaMB < 0:
+		log.Printf("%s: member_quota_mb must not be negative, ignored", what)
+	case c.MemberQuotaMB > 0:
+		p.memberCap = uint64(c.MemberQuotaMB) << 20
+	}
+	for username, mb := range c.MemberQuotasMB {
+		if mb <= 0 {
+			log.Printf("%s: member_quotas_mb %s must be positive, ignored", what, username)
+			continue
+		}
+		p.memberCaps[username] = uint64(mb) << 20
+	}
+	return p
+}
+
+// capOf returns the most username may use of the pool, or 0 for no cap
+func (p *quotaPool) capOf(username string) uint64 {
+	if c, ok := p.memberCaps[username]; ok {
+		return c
+	}
+	return p.memberCap
+}
+
+// Sources of a group membership
+const (
+	GroupSourceConfig = "config" // groups.<name>.members
+	GroupSourceAPI    = "api"    // assigned through the admin API
+	GroupSourceCert   = "cert"   // a group- OU of the user's certificate
+)
+
+// GroupMembership is a group a user belongs to and how they got in it
+type GroupMembership struct {
+	Group  string `json:"group"`
+	Source string `json:"source"`
+}
+
+// GroupInfo is a configured group with the users assigned to it through the
+// admin API
+type GroupInfo struct {
+	Name string `json:"name"`
+	GroupConfig
+	Assigned []string `json:"assigned"`
+}
+
+// userGroup is a parsed GroupConfig
+type userGroup struct {
+	name         string
+	config       GroupConfig
+	members      *userPatterns
+	rateLimit    *RateLimitRule
+	quota        *UserQuota
+	pool         *quotaPool // set if the members share quota
+	servingHours *ServingHours
+	hasSchedule  bool
+	acl          []*ACLRule
+}
+
+// UserGroups resolves the groups users belong to and the policies they
+// inherit from them. A user in several groups inherits each policy from the
+// first of them, by name, that sets it.
+type UserGroups struct {
+	groups []*userGroup // by name
+	db     *StatsDB
+
+	mu       sync.RWMutex
+	assigned map[string]map[string]bool // groups assigned through the API, by username
+	certs    map[string][]string        // groups named by the user's last certificate
+}
+
+// NewUserGroups parses the groups section and loads the assignments made
+// through the API. Invalid policies are logged and ignored; it returns nil
+// if no group is configured.
+func NewUserGroups(config *Config, db *StatsDB) *UserGroups {
+	if len(config.Groups) == 0 {
+		return nil
+	}
+	ug := &UserGroups{db: db, assigned: make(map[string]map[string]bool), certs: make(map[string][]string)}
+	for name, gc := range config.Groups {
+		g := &userGroup{name: name, config: gc}
+		var err error
+		if g.members, err = newUserPatterns(gc.Members); err != nil {
+			log.Printf("Group %s members: %v", name, err)
+		}
+		if gc.RateLimit != nil {
+			if err := gc.RateLimit.validate(); err != nil {
+				log.Printf("Group %s rate limit: %v, ignored", name, err)
+			} else {
+				g.rateLimit = gc.RateLimit
+			}
+		}
+		if gc.Quota != nil {
+			g.quota = gc.Quota.userQuota("Group "+name+" quota", "group:"+name)
+			if g.quota != nil {
+				g.pool = gc.Quota.quotaPool("Group " + name + " quota")
+			}
+		}
+		if gc.ServingHours != nil {
+			g.hasSchedule = true
+			g.servingHours = parseServingHours(*gc.ServingHours, "Group "+name+" serving hours")
+		}
+		for i, c := range gc.ACL {
+			r, err := newACLRule(c)
+			if err != nil {
+				log.Printf("Group %s acl[%d]: %v, ignored", name, i, err)
+				continue
+			}
+			r.Source, r.Group = ACLSourceConfig, name
+			g.acl = insertACLRule(g.acl, r)
+		}
+		ug.groups = append(ug.groups, g)
+	}
+	sort.Slice(ug.groups, func(i, j int) bool { return ug.groups[i].name < ug.groups[j].name })
+
+	if db != nil {
+		assigned, err := db.GetGroupAssignments(context.Background())
+		if err != nil {
+			log.Printf("Group assignments: %v", err)
+		}
+		for username, groups := range assigned {
+			for _, group := range groups {
+				if ug.group(group) == nil {
+					log.Printf("%s is assigned to group %s, which is not configured", username, group)
+					continue
+				}
+				ug.assignLocked(username, group)
+			}
+		}
+	}
+	return ug
+}
+
+func (ug *UserGroups) group(name string) *userGroup {
+	for _, g := range ug.groups {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+func (ug *UserGroups) assignLocked(username, group string) {
+	if ug.assigned[username] == nil {
+		ug.assigned[username] = make(map[string]bool)
+	}
+	ug.assigned[username][group] = true
+}
+
+// Memberships returns the groups username belongs to, by name
+func (ug *UserGroups) Memberships(username string) []GroupMembership {
+	if ug == nil || username == "" {
+		return nil
+	}
+	ug.mu.RLock()
+	defer ug.mu.RUnlock()
+	var out []GroupMembership
+	for _, g := range ug.groups {
+		if source := ug.sourceLocked(g, username); source != "" {
+			out = append(out, GroupMembership{Group: g.name, Source: source})
+		}
+	}
+	return out
+}
+
+// sourceLocked returns how username got in g, or "". Must be called with mu
+// held.
+func (ug *UserGroups) sourceLocked(g *userGroup, username string) string {
+	switch {
+	case ug.assigned[username][g.name]:
+		return GroupSourceAPI
+	case slices.Contains(ug.certs[username], g.name):
+		return GroupSourceCert
+	}
+	if _, ok := g.members.Match(username); ok {
+		return GroupSourceConfig
+	}
+	return ""
+}
+
+// firstGroup returns the first group of username for which has is true
+func (ug *UserGroups) firstGroup(username string, has func(*userGroup) bool) *userGroup {
+	if ug == nil || username == "" {
+		return nil
+	}
+	ug.mu.RLock()
+	defer ug.mu.RUnlock()
+	for _, g := range ug.groups {
+		if has(g) && ug.sourceLocked(g, username) != "" {
+			return g
+		}
+	}
+	return nil
+}
+
+// ObserveCert records the groups named by the group- OUs of username's
+// certificate, reporting whether they changed. Groups that are not
+// configured are ignored.
+func (ug *UserGroups) ObserveCert(username string, cert *x509.Certificate) bool {
+	if ug == nil {
+		return false
+	}
+	var groups []string
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if name, ok := strings.CutPrefix(ou, groupOUPrefix); ok && ug.group(name) != nil {
+			groups = append(groups, name)
+		}
+	}
+	ug.mu.Lock()
+	defer ug.mu.Unlock()
+	if slices.Equal(ug.certs[username], groups) {
+		return false
+	}
+	if len(groups) == 0 {
+		delete(ug.certs, username)
+	} else {
+		ug.certs[username] = groups
+	}
+	return true
+}
+
+var (
+	errUnknownGroup = errors.New("group not configured")
+	errNotInGroup   = errors.New("user not assigned to the group")
+)
+
+// Assign puts username in group. Assignments are kept in the stats
+// database.
+func (ug *UserGroups) Assign(username, group, actor string) error {
+	if ug.group(group) == nil {
+		return errUnknownGroup
+	}
+	if err := ug.db.AssignUserGroup(username, group, actor); err != nil {
+		return err
+	}
+	ug.mu.Lock()
+	ug.assignLocked(username, group)
+	ug.mu.Unlock()
+
+	ug.db.RecordUserEvent(username, EventGroupChanged, actor, "added to "+group)
+	changeFeed.Publish(ChangeEvent{Type: ChangeQuota, User: username, Actor: actor, Detail: "added to group " + group})
+	return nil
+}
+
+// Unassign takes username out of a group they were assigned to through the
+// API. Members by config or certificate stay in.
+func (ug *UserGroups) Unassign(username, group, actor string) error {
+	ug.mu.RLock()
+	assigned := ug.assigned[username][group]
+	ug.mu.RUnlock()
+	if !assigned {
+		return errNotInGroup
+	}
+	if err := ug.db.UnassignUserGroup(username, group); err != nil {
+		return err
+	}
+	ug.mu.Lock()
+	delete(ug.assigned[username], group)
+	if len(ug.assigned[username]) == 0 {
+		delete(ug.assigned, username)
+	}
+	ug.mu.Unlock()
+
+	ug.db.RecordUserEvent(username, EventGroupChanged, actor, "removed from "+group)
+	changeFeed.Publish(ChangeEvent{Type: ChangeQuota, User: username, Actor: actor, Detail: "removed from group " + group})
+	return nil
+}
+
+// RateLimit returns the rate limit username inherits and its group
+func (ug *UserGroups) RateLimit(username string) (RateLimitRule, string, bool) {
+	g := ug.firstGroup(username, func(g *userGroup) bool { return g.rateLimit != nil })
+	if g == nil {
+		return RateLimitRule{}, "", false
+	}
+	return *g.rateLimit, g.name, true
+}
+
+// Quota returns the quota username inherits and its group
+func (ug *UserGroups) Quota(username string) (UserQuota, string, bool) {
+	g := ug.firstGroup(username, func(g *userGroup) bool { return g.quota != nil })
+	if g == nil {
+		return UserQuota{}, "", false
+	}
+	q := *g.quota
+	q.Username = username
+	return q, g.name, true
+}
+
+// pool returns the quota pool of group, or nil if its members do not share
+// one
+func (ug *UserGroups) pool(group string) *quotaPool {
+	if ug == nil {
+		return nil
+	}
+	if g := ug.group(group); g != nil {
+		return g.pool
+	}
+	return nil
+}
+
+// knownMembers returns the users known by name to be in group, or to have
+// a cap in its pool: those assigned through the API, named in its config or
+// by a certificate seen since startup. Callers check they still are.
+func (ug *UserGroups) knownMembers(group string) []string {
+	g := ug.group(group)
+	if g == nil {
+		return nil
+	}
+	names := make(map[string]bool)
+	if g.members != nil {
+		for name := range g.members.exact {
+			names[name] = true
+		}
+	}
+	if g.pool != nil {
+		for name := range g.pool.memberCaps {
+			names[name] = true
+		}
+	}
+	ug.mu.RLock()
+	for name, groups := range ug.assigned {
+		if groups[group] {
+			names[name] = true
+		}
+	}
+	for name, groups := range ug.certs {
+		if slices.Contains(groups, group) {
+			names[name] = true
+		}
+	}
+	ug.mu.RUnlock()
+	out := make([]string, 0, len(names))
+	for name := range names {
+		out = append(out, name)
+	}
+	return out
+}
+
+// ServingHours returns the schedule username inherits and its group. The
+// schedule is nil for a group whose serving hours have no curfew.
+func (ug *UserGroups) ServingHours(username string) (*ServingHours, string, bool) {
+	g := ug.firstGroup(username, func(g *userGroup) bool { return g.hasSchedule })
+	if g == nil {
+		return nil, "", false
+	}
+	return g.servingHours, g.name, true
+}
+
+// hasACL reports whether any group has ACL rules
+func (ug *UserGroups) hasACL() bool {
+	if ug == nil {
+		return false
+	}
+	for _, g := range ug.groups {
+		if len(g.acl) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ACLMatch returns the rule of the ACL username inherits that matches
+// host, already normalized, or nil
+func (ug *UserGroups) ACLMatch(username, host string) *ACLRule {
+	g := ug.firstGroup(username, func(g *userGroup) bool { return len(g.acl) > 0 })
+	if g == nil {
+		return nil
+	}
+	for _, r := range g.acl {
+		if r.Matches(host) {
+			return r
+		}
+	}
+	return nil
+}
+
+// ACLRules returns the ACL rules of every group, by group name
+func (ug *UserGroups) ACLRules() []ACLRule {
+	if ug == nil {
+		return nil
+	}
+	var out []ACLRule
+	for _, g := range ug.groups {
+		for _, r := range g.acl {
+			out = append(out, *r)
+		}
+	}
+	return out
+}
+
+// List returns the groups by name
+func (ug *UserGroups) List() []GroupInfo {
+	if ug == nil {
+		return []GroupInfo{}
+	}
+	ug.mu.RLock()
+	defer ug.mu.RUnlock()
+	out := make([]GroupInfo, 0, len(ug.groups))
+	for _, g := range ug.groups {
+		info := GroupInfo{Name: g.name, GroupConfig: g.config, Assigned: []string{}}
+		for username, groups := range ug.assigned {
+			if groups[g.name] {
+				info.Assigned = append(info.Assigned, username)
+			}
+		}
+		sort.Strings(info.Assigned)
+		out = append(out, info)
+	}
+	return out
+}
+
+// handleUserGroups serves /api/v2/users/{username}/groups: GET lists the
+// user's groups, POST {"group": "staff"} assigns them to a group and DELETE
+// ?group=staff takes them out again
+func handleUserGroups(w http.ResponseWriter, r *http.Request, policy *PolicyEngine, username string) {
+	var groups *UserGroups
+	if policy != nil {
+		groups = policy.Groups
+	}
+	if groups == nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "No groups configured"}, http.StatusServiceUnavailable)
+		return
+	}
+	actor := "api:" + adminName(r)
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		writeJSONResponse(w, WebResponse{Success: true, Data: groups.Memberships(username)}, http.StatusOK)
+		return
+	case http.MethodPost:
+		var req struct {
+			Group string `json:"group"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "invalid JSON: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if groups.db == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "Group assignments need stats enabled"}, http.StatusServiceUnavailable)
+			return
+		}
+		if err = groups.Assign(username, req.Group, actor); err == nil {
+			log.Printf("%s added to group %s by %s", username, req.Group, actor)
+		}
+	case http.MethodDelete:
+		group := r.URL.Query().Get("group")
+		if err = groups.Unassign(username, group, actor); err == nil {
+			log.Printf("%s removed from group %s by %s", username, group, actor)
+		}
+	default:
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case errUnknownGroup:
+			status = http.StatusBadRequest
+		case errNotInGroup:
+			status = http.StatusNotFound
+		}
+		writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, status)
+		return
+	}
+	// Inherited rate limits apply to open tunnels too
+	policy.RateLimits.Refresh(username)
+	writeJSONResponse(w, WebResponse{Success: true, Data: groups.Memberships(username)}, http.StatusOK)
+}
+
+// groupDetail describes where an inherited policy came from
+func groupDetail(group string) string {
+	if group == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (group %s)", group)
+}
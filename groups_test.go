@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUserGroups(t *testing.T) {
+	db := newExpiryTestDB(t)
+	cfg := &Config{}
+	cfg.Proxy.RateLimit = UserRateLimitConfig{
+		Default: RateLimitRule{KBps: 100},
+		Users:   map[string]RateLimitRule{"dev-boss": {KBps: 5000}},
+	}
+	cfg.ServingHours = ServingHoursConfig{Curfews: []CurfewWindow{{Start: "00:00", End: "24:00"}}}
+	cfg.Groups = map[string]GroupConfig{
+		"dev": {
+			Members:   []string{"dev-*"},
+			RateLimit: &RateLimitRule{KBps: 1000},
+			Quota:     &GroupQuotaConfig{Period: QuotaDaily, QuotaMB: 1},
+			// Developers work around the clock
+			ServingHours: &ServingHoursConfig{},
+		},
+		"ops": {
+			RateLimit: &RateLimitRule{KBps: 2000},
+			Quota:     &GroupQuotaConfig{QuotaMB: -1}, // invalid, ignored
+		},
+	}
+	engine := NewPolicyEngine(cfg, nil, db)
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, db, engine, nil)
+	do := func(method, path, body string) (int, []GroupMembership) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		var resp struct {
+			Data []GroupMembership `json:"data"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp.Data
+	}
+	now := time.Now()
+
+	// Members inherit the group's policies; their own entries win
+	if got := engine.RateLimits.Limit("dev-alice"); got.Source != "group:dev" || got.Download.RateBytes != 1000<<10 {
+		t.Errorf("dev-alice rate limit = %+v", got)
+	}
+	if got := engine.RateLimits.Limit("dev-boss"); got.Source != "dev-boss" {
+		t.Errorf("own entry overridden: %+v", got)
+	}
+	if st, ok := engine.Quotas.Status("dev-alice", now); !ok || st.Group != "dev" || st.Period != QuotaDaily || st.QuotaBytes != 1<<20 {
+		t.Errorf("dev-alice quota = %+v, %v", st, ok)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "dev-alice", Time: now}); !d.Allowed {
+		t.Errorf("group serving hours not applied: %+v", d.Blocking)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "carol", Time: now}); d.Allowed || d.Blocking.Rule != "serving_hours" {
+		t.Errorf("server curfew not applied to carol: %+v", d.Blocking)
+	}
+
+	// Group quota is enforced per member
+	db.BatchUpsert([]TrafficRecord{{Username: "dev-alice", Domain: "example.com", Download: 2 << 20, ConnCount: 1, Hour: now.Format("2006-01-02T15:00:00"), Timestamp: now}})
+	if d := engine.Evaluate(PolicyRequest{Username: "dev-alice", Time: now}); d.Allowed || d.Blocking.Rule != "quota" {
+		t.Errorf("dev-alice over group quota: %+v", d.Blocking)
+	}
+	if _, err := engine.Quotas.Set("dev-alice", QuotaDaily, 10<<20, "test", now); err != nil {
+		t.Fatal(err)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "dev-alice", Time: now}); !d.Allowed {
+		t.Errorf("own quota did not override the group's: %+v", d.Blocking)
+	}
+
+	// Certificate OUs put users in configured groups
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "dave", OrganizationalUnit: []string{"group-ops", "group-nope"}}}
+	if !engine.Groups.ObserveCert("dave", cert) || engine.Groups.ObserveCert("dave", cert) {
+		t.Error("ObserveCert should report only the first change")
+	}
+	if got := engine.Groups.Memberships("dave"); len(got) != 1 || got[0] != (GroupMembership{Group: "ops", Source: GroupSourceCert}) {
+		t.Errorf("dave memberships = %+v", got)
+	}
+	if _, ok := engine.Quotas.Status("dave", now); ok {
+		t.Error("invalid group quota applied")
+	}
+
+	// Assignments through the API
+	if code, _ := do(http.MethodPost, "/api/v2/users/carol/groups", `{"group": "nope"}`); code != http.StatusBadRequest {
+		t.Errorf("unknown group: %d", code)
+	}
+	code, got := do(http.MethodPost, "/api/v2/users/carol/groups", `{"group": "dev"}`)
+	if code != http.StatusOK || len(got) != 1 || got[0].Source != GroupSourceAPI {
+		t.Fatalf("POST: %d %+v", code, got)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "carol", Time: now}); !d.Allowed {
+		t.Errorf("assigned user not inheriting serving hours: %+v", d.Blocking)
+	}
+	if got := NewUserGroups(cfg, db).Memberships("carol"); len(got) != 1 || got[0].Group != "dev" {
+		t.Errorf("assignment not reloaded: %+v", got)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/groups", nil))
+	var list struct {
+		Data []GroupInfo `json:"data"`
+	}
+	if json.NewDecoder(rec.Body).Decode(&list); len(list.Data) != 2 || list.Data[0].Name != "dev" || len(list.Data[0].Assigned) != 1 {
+		t.Errorf("groups = %+v", list.Data)
+	}
+	if code, _ := do(http.MethodDelete, "/api/v2/users/dev-alice/groups?group=dev", ""); code != http.StatusNotFound {
+		t.Errorf("removing a config member: %d", code)
+	}
+	if code, got := do(http.MethodDelete, "/api/v2/users/carol/groups?group=dev", ""); code != http.StatusOK || len(got) != 0 {
+		t.Errorf("DELETE: %d %+v", code, got)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// I18nConfig adds message catalogs to the built-in English and Chinese ones
+type I18nConfig struct {
+	// CatalogDir holds <language>.json files mapping message keys to text,
+	// e.g. ja.json; entries override the built-in catalog of that language
+	CatalogDir string `json:"catalog_dir"`
+}
+
+// MessageCatalog maps message keys to text in one language. Keys are proxy
+// error codes and the English text of admin API errors; for errors with a
+// detail after a colon ("invalid request body: EOF") the part before it.
+type MessageCatalog map[string]string
+
+// defaultLanguage is used when Accept-Language names no catalog. Messages
+// are written in English, so its catalog is empty unless a file fills it.
+const defaultLanguage = "en"
+
+var zhMessages = MessageCatalog{
+	ErrCodeCertExpired:        "客户端证书已过期",
+	ErrCodeCertInvalid:        "客户端证书无效",
+	ErrCodeCertRevoked:        "客户端证书已被吊销",
+	ErrCodeUserDisabled:       "用户已被禁用",
+	ErrCodeMaintenance:        "代理正在维护中，请稍后再试",
+	ErrCodeOutsideHours:       "当前不在服务时间内",
+	ErrCodeInvalidTag:         "标签不被允许",
+	ErrCodeP2PBlocked:         "已阻止 P2P 流量",
+	ErrCodeTrialQuota:         "试用流量已用完",
+	ErrCodeTierQuota:          "本月流量已用完",
+	ErrCodeQuotaExceeded:      "本周期流量配额已用完",
+	ErrCodeDestinationBlocked: "目标地址已被信誉源列入黑名单",
+	ErrCodeDomainDenied:       "访问规则不允许连接该目标域名",
+	ErrCodeClientBlocklisted:  "客户端地址已被 DNS 黑名单收录",
+	ErrCodeReauthRequired:     "请重新连接并完成完整的 TLS 握手",
+	ErrCodeProxyAuthRequired:  "需要代理身份验证",
+	ErrCodeDialTimeout:        "连接目标超时",
+	ErrCodeDNSFailure:         "目标域名解析失败",
+	ErrCodeDialFailed:         "无法连接目标",
+	ErrCodeInternalError:      "代理内部错误",
+
+	"Method not allowed":                         "不支持该请求方法",
+	"Unauthorized":                               "未授权",
+	"not ready":                                  "未就绪",
+	"invalid CSRF token":                         "CSRF 令牌无效",
+	"invalid request body":                       "请求体无效",
+	"invalid JSON":                               "JSON 格式无效",
+	"Username required":                          "缺少用户名",
+	"username required":                          "缺少用户名",
+	"user required":                              "缺少用户",
+	"User not found":                             "用户不存在",
+	"user not found":                             "用户不存在",
+	"version not found":                          "版本不存在",
+	"no expiry set":                              "未设置到期时间",
+	"invalid country code":                       "国家代码无效",
+	"no traffic from country":                    "该国家/地区没有流量",
+	"unknown format":                             "未知格式",
+	"scope must be user or domain":               "scope 必须为 user 或 domain",
+	"read_only is required":                      "缺少 read_only",
+	"path is required":                           "缺少 path",
+	"move refused":                               "拒绝迁移",
+	"database moved but not saved":               "数据库已迁移但未保存到配置文件",
+	"rate limit applied but not saved":           "带宽限制已生效但未保存到配置文件",
+	"rates and bursts must be 0 or more":         "速率和突发量不能为负数",
+	"expires_at must be RFC3339 or YYYY-MM-DD":   "expires_at 必须为 RFC3339 或 YYYY-MM-DD 格式",
+	"Stats database not available":               "统计数据库不可用",
+	"stats database is read-only":                "统计数据库为只读",
+	"Policy engine not available":                "策略引擎不可用",
+	"Config history not available":               "配置历史不可用",
+	"Runtime settings not available":             "运行时设置不可用",
+	"Trial accounts not available":               "试用账户不可用",
+	"Quotas not available":                       "流量配额不可用",
+	"Domain ACL not available":                   "域名访问规则不可用",
+	"period must be daily, weekly or monthly":    "period 必须为 daily、weekly 或 monthly",
+	"quota_mb must be positive":                  "quota_mb 必须为正数",
+	"no quota set":                               "未设置流量配额",
+	"No groups configured":                       "未配置用户组",
+	"Group assignments need stats enabled":       "分配用户组需要启用统计",
+	"group not configured":                       "用户组未配置",
+	"user not assigned to the group":             "用户未被分配到该组",
+	"No reputation feeds configured":             "未配置信誉源",
+	"Provisioning is not enabled":                "未启用二维码配置",
+	"missing scope":                              "缺少权限范围",
+	"API tokens are limited to the API":          "API 令牌仅可用于 API",
+	"Gate is not enabled":                        "未启用敲门",
+	"Session ticket key rotation is not enabled": "未启用会话票据密钥轮换",
+	"Response cannot be pseudonymized":           "响应无法假名化",
+	"stats query timed out":                      "统计查询超时",
+	"partial result":                             "结果不完整",
+
+	// Block page
+	"Access blocked":        "访问被阻止",
+	"Rule":                  "规则",
+	"Code":                  "错误码",
+	"Retry after (seconds)": "重试等待（秒）",
+	"Request ID":            "请求 ID",
+	"Questions? Contact":    "如有疑问，请联系",
+}
+
+// messageCatalogs holds the catalog of each language, keyed by lower-case
+// language tag
+var messageCatalogs = struct {
+	sync.RWMutex
+	m map[string]MessageCatalog
+}{m: map[string]MessageCatalog{defaultLanguage: {}, "zh": zhMessages}}
+
+// RegisterCatalog adds messages to the catalog of lang, creating it if needed
+func RegisterCatalog(lang string, messages MessageCatalog) {
+	lang = strings.ToLower(lang)
+	messageCatalogs.Lock()
+	defer messageCatalogs.Unlock()
+	c := make(MessageCatalog, len(messageCatalogs.m[lang])+len(messages))
+	for k, v := range messageCatalogs.m[lang] {
+		c[k] = v
+	}
+	for k, v := range messages {
+		c[k] = v
+	}
+	messageCatalogs.m[lang] = c
+}
+
+// LoadMessageCatalogs registers the <language>.json catalogs in dir.
+// Unreadable files are logged and skipped.
+func LoadMessageCatalogs(dir string) {
+	if dir == "" {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil || len(files) == 0 {
+		log.Printf("i18n catalog_dir: no catalogs in %s", dir)
+		return
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Printf("i18n catalog %s: %v, ignored", file, err)
+			continue
+		}
+		var messages MessageCatalog
+		if err := json.Unmarshal(data, &messages); err != nil {
+			log.Printf("i18n catalog %s: %v, ignored", file, err)
+			continue
+		}
+		lang := strings.TrimSuffix(filepath.Base(file), ".json")
+		RegisterCatalog(lang, messages)
+		log.Printf("Loaded %d %s messages from %s", len(messages), lang, file)
+	}
+}
+
+// negotiateLanguage returns the language of the most preferred catalog in
+// an Accept-Language header: an exact tag first ("zh-tw"), then its primary
+// subtag ("zh")
+func negotiateLanguage(header string) string {
+	type pref struct {
+		tag string
+		q   float64
+	}
+	var prefs []pref
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" && tag != "*" && q > 0 {
+			prefs = append(prefs, pref{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	messageCatalogs.RLock()
+	defer messageCatalogs.RUnlock()
+	for _, p := range prefs {
+		if _, ok := messageCatalogs.m[p.tag]; ok {
+			return p.tag
+		}
+		primary, _, _ := strings.Cut(p.tag, "-")
+		if _, ok := messageCatalogs.m[primary]; ok {
+			return primary
+		}
+	}
+	return defaultLanguage
+}
+
+// translate returns the text of key in lang, or "" if its catalog has none
+func translate(lang, key string) string {
+	messageCatalogs.RLock()
+	defer messageCatalogs.RUnlock()
+	return messageCatalogs.m[lang][key]
+}
+
+// localizeMessage translates an admin API error: the whole message, or else
+// the part before ": " with the detail kept as is
+func localizeMessage(lang, msg string) string {
+	if text := translate(lang, msg); text != "" {
+		return text
+	}
+	if prefix, detail, ok := strings.Cut(msg, ": "); ok {
+		if text := translate(lang, prefix); text != "" {
+			return text + ": " + detail
+		}
+	}
+	return msg
+}
+
+// localizedWriter carries the language negotiated for an admin request to
+// writeJSONResponse
+type localizedWriter struct {
+	http.ResponseWriter
+	lang string
+}
+
+func (w *localizedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// localizedWriterOf finds the localizedWriter beneath w's wrappers
+func localizedWriterOf(w http.ResponseWriter) *localizedWriter {
+	for {
+		switch v := w.(type) {
+		case *localizedWriter:
+			return v
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// localizeErrors makes the errors of the admin API handlers in next follow
+// the request's Accept-Language
+func localizeErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Language")
+		next.ServeHTTP(&localizedWriter{ResponseWriter: w, lang: negotiateLanguage(r.Header.Get("Accept-Language"))}, r)
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "en"},
+		{"zh-CN,zh;q=0.9,en;q=0.8", "zh"},
+		{"en-US,en;q=0.9,zh;q=0.8", "en"},
+		{"fr-FR, zh;q=0.5", "zh"},
+		{"zh;q=0.2, en;q=0.7", "en"},
+		{"zh;q=0, fr", "en"},
+		{"*", "en"},
+	}
+	for _, tt := range tests {
+		if got := negotiateLanguage(tt.header); got != tt.want {
+			t.Errorf("negotiateLanguage(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestLocalizeMessage(t *testing.T) {
+	if got := localizeMessage("zh", "invalid request body: EOF"); got != "请求体无效: EOF" {
+		t.Errorf("prefixed message = %q", got)
+	}
+	if got := localizeMessage("zh", "something new"); got != "something new" {
+		t.Errorf("unknown message = %q", got)
+	}
+	if got := localizeMessage("en", "Method not allowed"); got != "Method not allowed" {
+		t.Errorf("english message = %q", got)
+	}
+}
+
+func TestLoadMessageCatalogs(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "x-test.json"), []byte(`{"user_disabled": "disabled (test)"}`), 0644)
+	os.WriteFile(filepath.Join(dir, "broken.json"), []byte(`{`), 0644)
+	LoadMessageCatalogs(dir)
+
+	if got := negotiateLanguage("X-Test"); got != "x-test" {
+		t.Fatalf("catalog not registered, negotiated %q", got)
+	}
+	if negotiateLanguage("broken") != "en" {
+		t.Error("broken catalog was registered")
+	}
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+	r.Header.Set("Accept-Language", "x-test")
+	writeProxyError(rec, r, http.StatusForbidden, ErrCodeUserDisabled, "user alice is disabled")
+	var e ProxyError
+	json.NewDecoder(rec.Body).Decode(&e)
+	if e.Message != "disabled (test)" || e.Detail != "user alice is disabled" || rec.Header().Get("Content-Language") != "x-test" {
+		t.Errorf("error = %+v, Content-Language %q", e, rec.Header().Get("Content-Language"))
+	}
+}
+
+func TestProxyError_Localized(t *testing.T) {
+	for _, tt := range []struct{ lang, message, detail string }{
+		{"", "client certificate expired", ""},
+		{"zh-CN,zh;q=0.9", "客户端证书已过期", "client certificate expired"},
+	} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+		if tt.lang != "" {
+			r.Header.Set("Accept-Language", tt.lang)
+		}
+		writeProxyError(rec, r, http.StatusMethodNotAllowed, ErrCodeCertExpired, "client certificate expired")
+		var e ProxyError
+		json.NewDecoder(rec.Body).Decode(&e)
+		if e.Message != tt.message || e.Detail != tt.detail || e.Code != ErrCodeCertExpired {
+			t.Errorf("Accept-Language %q: error = %+v", tt.lang, e)
+		}
+	}
+}
+
+func TestAdminAPI_LocalizedErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	registerV2API(mux, &Config{}, nil, nil, nil, nil)
+	handler := localizeErrors(mux)
+
+	for _, tt := range []struct{ lang, want string }{
+		{"en", "Gate is not enabled"},
+		{"zh-TW,zh;q=0.8", "未启用敲门"},
+	} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/api/v2/gate", nil)
+		r.Header.Set("Accept-Language", tt.lang)
+		handler.ServeHTTP(rec, r)
+		var resp WebResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if rec.Code != http.StatusNotFound || resp.Error != tt.want {
+			t.Errorf("Accept-Language %q: %d %q, want %q", tt.lang, rec.Code, resp.Error, tt.want)
+		}
+		if rec.Header().Get("Vary") != "Accept-Language" {
+			t.Errorf("Vary = %q", rec.Header().Get("Vary"))
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Latency metrics recorded per tunnel
+const (
+	LatencyDuration = "duration" // how long the tunnel stayed open
+	LatencyTTFB     = "ttfb"     // from tunnel established to the target's first byte
+)
+
+// Histogram upper bounds in seconds; a final +Inf bucket follows. They are
+// persisted by position, so only append to these lists.
+var latencyBounds = map[string][]float64{
+	LatencyDuration: {1, 5, 30, 60, 300, 1800, 3600},
+	LatencyTTFB:     {0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+}
+
+// latencyBucketCount is the number of buckets including +Inf
+const latencyBucketCount = 8
+
+// LatencyHistogram counts observations (in seconds) per bucket. Counts are
+// per bucket, not cumulative.
+type LatencyHistogram struct {
+	Counts [latencyBucketCount]uint64
+	Sum    float64
+	Count  uint64
+}
+
+func (h *LatencyHistogram) observe(metric string, seconds float64) {
+	bounds := latencyBounds[metric]
+	i := sort.SearchFloat64s(bounds, seconds)
+	h.Counts[i]++
+	h.Sum += seconds
+	h.Count++
+}
+
+func (h *LatencyHistogram) merge(o *LatencyHistogram) {
+	for i, c := range o.Counts {
+		h.Counts[i] += c
+	}
+	h.Sum += o.Sum
+	h.Count += o.Count
+}
+
+// quantile estimates the q-quantile by linear interpolation within the
+// bucket it falls in, the way Prometheus' histogram_quantile does
+func (h *LatencyHistogram) quantile(metric string, q float64) float64 {
+	bounds := latencyBounds[metric]
+	if h.Count == 0 || len(bounds) == 0 {
+		return 0
+	}
+	rank := q * float64(h.Count)
+	var seen uint64
+	for i, c := range h.Counts {
+		if c == 0 || float64(seen+c) < rank {
+			seen += c
+			continue
+		}
+		if i == len(bounds) {
+			// Falls in +Inf: the largest finite bound is the best estimate
+			return bounds[len(bounds)-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = bounds[i-1]
+		}
+		return lower + (bounds[i]-lower)*(rank-float64(seen))/float64(c)
+	}
+	return bounds[len(bounds)-1]
+}
+
+// latencyBucketLabel is the upper bound of bucket i as a Prometheus "le" value
+func latencyBucketLabel(metric string, i int) string {
+	bounds := latencyBounds[metric]
+	if i >= len(bounds) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bounds[i], 'g', -1, 64)
+}
+
+// latencyKey identifies a histogram: a metric for one user or one domain
+type latencyKey struct {
+	Scope  string // "user" or "domain"
+	Name   string
+	Metric string
+}
+
+// observeTunnel adds a closed tunnel's duration and time to first byte to
+// the histograms in h. A zero ttfb means the target never sent anything.
+func observeTunnel(h map[latencyKey]*LatencyHistogram, username, domain string, duration, ttfb time.Duration) {
+	add := func(scope, name, metric string, d time.Duration) {
+		key := latencyKey{scope, name, metric}
+		hist, ok := h[key]
+		if !ok {
+			hist = &LatencyHistogram{}
+			h[key] = hist
+		}
+		hist.observe(metric, d.Seconds())
+	}
+	for _, sn := range [][2]string{{"user", username}, {"domain", domain}} {
+		if sn[1] == "" {
+			continue
+		}
+		if duration > 0 {
+			add(sn[0], sn[1], LatencyDuration, duration)
+		}
+		if ttfb > 0 {
+			add(sn[0], sn[1], LatencyTTFB, ttfb)
+		}
+	}
+}
+
+// latencyRecorder keeps per-user histograms since process start for
+// Prometheus. Per-domain histograms are only served from the database to
+// keep label cardinality bounded.
+type latencyRecorder struct {
+	mu    sync.Mutex
+	hists map[latencyKey]*LatencyHistogram
+}
+
+// tunnelLatency is the process-wide recorder behind the latency metrics
+var tunnelLatency = newLatencyRecorder()
+
+func newLatencyRecorder() *latencyRecorder {
+	rec := &latencyRecorder{hists: make(map[latencyKey]*LatencyHistogram)}
+	metrics.Collect("https_proxy_tunnel_duration_seconds", "How long CONNECT tunnels stayed open, per user.", "histogram", func() []MetricSample {
+		return rec.samples(LatencyDuration)
+	})
+	metrics.Collect("https_proxy_tunnel_ttfb_seconds", "Time from tunnel establishment to the first byte from the target, per user.", "histogram", func() []MetricSample {
+		return rec.samples(LatencyTTFB)
+	})
+	return rec
+}
+
+// Observe records a closed tunnel of username
+func (rec *latencyRecorder) Observe(username string, duration, ttfb time.Duration) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	observeTunnel(rec.hists, username, "", duration, ttfb)
+}
+
+func (rec *latencyRecorder) samples(metric string) []MetricSample {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	users := make([]string, 0, len(rec.hists))
+	for key := range rec.hists {
+		if key.Metric == metric {
+			users = append(users, key.Name)
+		}
+	}
+	sort.Strings(users)
+
+	var out []MetricSample
+	for _, user := range users {
+		h := rec.hists[latencyKey{"user", user, metric}]
+		var cum uint64
+		for i, c := range h.Counts {
+			cum += c
+			out = append(out, MetricSample{Suffix: "_bucket", Labels: map[string]string{"user": user, "le": latencyBucketLabel(metric, i)}, Value: float64(cum)})
+		}
+		out = append(out,
+			MetricSample{Suffix: "_sum", Labels: map[string]string{"user": user}, Value: h.Sum},
+			MetricSample{Suffix: "_count", Labels: map[string]string{"user": user}, Value: float64(h.Count)})
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram_Quantile(t *testing.T) {
+	var h LatencyHistogram
+	for _, s := range []float64{0.01, 0.02, 0.07, 0.2, 0.3, 0.4, 0.6, 0.9, 2, 9} {
+		h.observe(LatencyTTFB, s)
+	}
+	want := [latencyBucketCount]uint64{2, 1, 1, 2, 2, 1, 0, 1}
+	if h.Counts != want || h.Count != 10 {
+		t.Fatalf("counts = %v, want %v", h.Counts, want)
+	}
+	// The 5th observation is the 1st of 2 in (0.25, 0.5]
+	if p50 := h.quantile(LatencyTTFB, 0.5); math.Abs(p50-0.375) > 1e-9 {
+		t.Errorf("p50 = %v, want 0.375", p50)
+	}
+	// Beyond the last finite bound the estimate is capped at it
+	if p99 := h.quantile(LatencyTTFB, 0.99); p99 != 5 {
+		t.Errorf("p99 = %v, want 5", p99)
+	}
+}
+
+func TestLatencyRecorder_Metrics(t *testing.T) {
+	reg := metrics
+	metrics = NewMetricsRegistry()
+	defer func() { metrics = reg }()
+
+	rec := newLatencyRecorder()
+	rec.Observe("alice", 2*time.Second, 80*time.Millisecond)
+	rec.Observe("alice", 90*time.Minute, 0)
+
+	var buf bytes.Buffer
+	metrics.Render(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE https_proxy_tunnel_duration_seconds histogram",
+		`https_proxy_tunnel_duration_seconds_bucket{le="1",user="alice"} 0`,
+		`https_proxy_tunnel_duration_seconds_bucket{le="5",user="alice"} 1`,
+		`https_proxy_tunnel_duration_seconds_bucket{le="+Inf",user="alice"} 2`,
+		`https_proxy_tunnel_duration_seconds_count{user="alice"} 2`,
+		`https_proxy_tunnel_ttfb_seconds_bucket{le="0.1",user="alice"} 1`,
+		`https_proxy_tunnel_ttfb_seconds_count{user="alice"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+}
+
+func TestStatsCollector_FlushesLatency(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	collector := NewStatsCollector(db, nil, 3600, 0)
+	for _, ev := range []TrafficEvent{
+		{Username: "alice", Domain: "a.example", Duration: 3 * time.Second, TTFB: 40 * time.Millisecond},
+		{Username: "alice", Domain: "b.example", Duration: 10 * time.Second, TTFB: 700 * time.Millisecond},
+		{Username: "bob", Domain: "a.example", Duration: 2 * time.Hour},
+	} {
+		collector.Record(ev)
+	}
+	collector.Stop()
+
+	users, err := db.GetLatencyHistograms(context.Background(), "user", "alice", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("alice's histograms = %+v", users)
+	}
+	for _, h := range users {
+		if h.Count != 2 || len(h.Buckets) != latencyBucketCount {
+			t.Errorf("%s histogram = %+v", h.Metric, h)
+		}
+		if h.Metric == LatencyDuration && (h.Buckets[1].LE != "5" || h.Buckets[1].Count != 1 || h.Buckets[2].Count != 1) {
+			t.Errorf("duration buckets = %+v", h.Buckets)
+		}
+	}
+
+	// bob's tunnel never received a byte, so only its duration is recorded
+	domains, _ := db.GetLatencyHistograms(context.Background(), "domain", "a.example", 10)
+	for _, h := range domains {
+		if (h.Metric == LatencyDuration && (h.Count != 2 || h.Buckets[7].Count != 1)) || (h.Metric == LatencyTTFB && h.Count != 1) {
+			t.Errorf("a.example %s histogram = %+v", h.Metric, h)
+		}
+	}
+	if len(domains) != 2 {
+		t.Errorf("a.example histograms = %+v", domains)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenAll listens on port at each of addrs, or on every interface if
+// addrs is empty, and returns one listener accepting from all of them. An
+// IPv6 address, "::" included, only accepts IPv6: list "0.0.0.0" as well
+// to serve both families on every interface.
+func listenAll(addrs []string, port int) (net.Listener, error) {
+	p := strconv.Itoa(port)
+	if len(addrs) == 0 {
+		return net.Listen("tcp", ":"+p)
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		network := "tcp"
+		if ip := net.ParseIP(host); ip != nil {
+			network = "tcp4"
+			if ip.To4() == nil {
+				network = "tcp6"
+			}
+		}
+		ln, err := net.Listen(network, net.JoinHostPort(host, p))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+	return newMultiListener(listeners), nil
+}
+
+// listenAddrs describes where listenAll listens, for log lines
+func listenAddrs(addrs []string, port int) string {
+	if len(addrs) == 0 {
+		return "port " + strconv.Itoa(port)
+	}
+	hosts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		hosts[i] = net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), strconv.Itoa(port))
+	}
+	return strings.Join(hosts, ", ")
+}
+
+// multiListener accepts connections from several listeners
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, len(listeners)),
+		done:      make(chan struct{}),
+	}
+	for _, ln := range listeners {
+		go m.acceptLoop(ln)
+	}
+	return m
+}
+
+func (m *multiListener) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			// Temporary errors such as running out of descriptors are
+			// passed on for the caller to back off; others end the loop
+			select {
+			case m.errs <- err:
+			case <-m.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		select {
+		case m.conns <- conn:
+		case <-m.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Accept returns the next connection from any of the listeners, or an
+// error one of them returned
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes every listener
+func (m *multiListener) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, ln := range m.listeners {
+			if e := ln.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the first listener's address
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestListenAll(t *testing.T) {
+	ln, err := listenAll([]string{"127.0.0.1", "[127.0.0.2]"}, 0)
+	if err != nil {
+		t.Skipf("second loopback address unavailable: %v", err)
+	}
+	m, ok := ln.(*multiListener)
+	if !ok {
+		t.Fatalf("got %T for two addresses", ln)
+	}
+	for _, inner := range m.listeners {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		accepted, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		if accepted.LocalAddr().String() != inner.Addr().String() {
+			t.Errorf("accepted on %s, want %s", accepted.LocalAddr(), inner.Addr())
+		}
+		accepted.Close()
+	}
+
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close: %v", err)
+	}
+	if _, err := listenAll([]string{"127.0.0.1", "192.0.2.1"}, 0); err == nil {
+		t.Error("listening on an address of no interface succeeded")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerOptions configures the accept-loop hardening of the proxy listener
+type ListenerOptions struct {
+	HandshakeTimeout        time.Duration
+	MaxConcurrentHandshakes int
+	PerIPAcceptRate         float64 // new connections per second per source IP; 0 disables
+	PerIPAcceptBurst        int
+	// MaxConns is the soft cap on open connections; 0 disables. Beyond it up
+	// to QueueSize connections wait QueueTimeout for a slot, and only
+	// connections beyond that hard cap are closed at once.
+	MaxConns     int
+	QueueSize    int
+	QueueTimeout time.Duration
+}
+
+// hardenedListener accepts TCP connections, applies per-IP accept rate
+// limiting, and completes the TLS handshake under a timeout and a cap on
+// concurrent handshakes before handing the *tls.Conn to http.Server. Slow or
+// flooding clients are closed without holding goroutines or descriptors for
+// longer than the handshake timeout.
+type hardenedListener struct {
+	net.Listener
+	tlsConfig *tls.Config
+	opts      ListenerOptions
+	limiter   *ipRateLimiter
+	sem       chan struct{}
+	slots     chan struct{} // open connections, nil without MaxConns
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+
+	rateLimited  atomic.Uint64
+	capRejected  atomic.Uint64
+	connRejected atomic.Uint64
+	queueTimeout atomic.Uint64
+	queued       atomic.Int64
+	queueWaits   atomic.Uint64
+	queueWaitNs  atomic.Uint64
+	failed       atomic.Uint64
+	inHandshake  atomic.Int64
+	acceptedConn atomic.Uint64
+}
+
+// newHardenedListener wraps inner and starts its accept loop
+func newHardenedListener(inner net.Listener, tlsConfig *tls.Config, opts ListenerOptions) *hardenedListener {
+	if opts.HandshakeTimeout <= 0 {
+		opts.HandshakeTimeout = 10 * time.Second
+	}
+	if opts.MaxConcurrentHandshakes <= 0 {
+		opts.MaxConcurrentHandshakes = 1024
+	}
+	if opts.QueueTimeout <= 0 {
+		opts.QueueTimeout = 2 * time.Second
+	}
+
+	l := &hardenedListener{
+		Listener:  inner,
+		tlsConfig: tlsConfig,
+		opts:      opts,
+		sem:       make(chan struct{}, opts.MaxConcurrentHandshakes),
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, 1),
+		done:      make(chan struct{}),
+	}
+	if opts.PerIPAcceptRate > 0 {
+		l.limiter = newIPRateLimiter(opts.PerIPAcceptRate, opts.PerIPAcceptBurst)
+	}
+	if opts.MaxConns > 0 {
+		l.slots = make(chan struct{}, opts.MaxConns)
+	}
+
+	metrics.Counter("https_proxy_listener_accepted_total", "Connections that completed the TLS handshake.", func() float64 {
+		return float64(l.acceptedConn.Load())
+	})
+	metrics.Collect("https_proxy_listener_rejected_total", "Connections closed before or during the TLS handshake.", "counter", func() []MetricSample {
+		return []MetricSample{
+			{Labels: map[string]string{"reason": "ip_rate"}, Value: float64(l.rateLimited.Load())},
+			{Labels: map[string]string{"reason": "handshake_cap"}, Value: float64(l.capRejected.Load())},
+			{Labels: map[string]string{"reason": "handshake_failed"}, Value: float64(l.failed.Load())},
+			{Labels: map[string]string{"reason": "conn_cap"}, Value: float64(l.connRejected.Load())},
+			{Labels: map[string]string{"reason": "queue_timeout"}, Value: float64(l.queueTimeout.Load())},
+		}
+	})
+	metrics.Gauge("https_proxy_listener_handshakes_in_progress", "TLS handshakes currently in progress.", func() float64 {
+		return float64(l.inHandshake.Load())
+	})
+	metrics.Gauge("https_proxy_listener_open_connections", "Connections holding a slot under max_concurrent_conns.", func() float64 {
+		return float64(len(l.slots))
+	})
+	metrics.Gauge("https_proxy_listener_queue_depth", "Connections waiting for a slot under max_concurrent_conns.", func() float64 {
+		return float64(l.queued.Load())
+	})
+	metrics.Counter("https_proxy_listener_queue_wait_seconds_sum", "Time queued connections waited before getting a slot.", func() float64 {
+		return time.Duration(l.queueWaitNs.Load()).Seconds()
+	})
+	metrics.Counter("https_proxy_listener_queue_wait_seconds_count", "Queued connections that got a slot.", func() float64 {
+		return float64(l.queueWaits.Load())
+	})
+
+	go l.acceptLoop()
+	return l
+}
+
+func (l *hardenedListener) acceptLoop() {
+	var backoff time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			// Back off on temporary errors such as running out of descriptors
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+				log.Printf("Accept error: %v; retrying in %v", err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			select {
+			case l.errs <- err:
+			case <-l.done:
+			}
+			return
+		}
+		backoff = 0
+
+		if l.limiter != nil && !l.limiter.Allow(remoteIP(conn.RemoteAddr())) {
+			l.rateLimited.Add(1)
+			conn.Close()
+			continue
+		}
+
+		if l.slots != nil {
+			select {
+			case l.slots <- struct{}{}:
+				conn = &slotConn{Conn: conn, slots: l.slots}
+			default:
+				// Over the soft cap: queue if there is room, else reject
+				if l.queued.Add(1) > int64(l.opts.QueueSize) {
+					l.queued.Add(-1)
+					l.connRejected.Add(1)
+					conn.Close()
+				} else {
+					go l.wait(conn)
+				}
+				continue
+			}
+		}
+		l.startHandshake(conn)
+	}
+}
+
+// wait holds a connection accepted over the soft cap until a slot frees up,
+// closing it after the queue timeout
+func (l *hardenedListener) wait(conn net.Conn) {
+	defer l.queued.Add(-1)
+	start := time.Now()
+	timer := time.NewTimer(l.opts.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		l.queueWaits.Add(1)
+		l.queueWaitNs.Add(uint64(time.Since(start)))
+		l.startHandshake(&slotConn{Conn: conn, slots: l.slots})
+	case <-timer.C:
+		l.queueTimeout.Add(1)
+		conn.Close()
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// startHandshake hands conn to a handshake goroutine, or closes it when too
+// many handshakes are in progress
+func (l *hardenedListener) startHandshake(conn net.Conn) {
+	select {
+	case l.sem <- struct{}{}:
+		go l.handshake(conn)
+	default:
+		l.capRejected.Add(1)
+		conn.Close()
+	}
+}
+
+// slotConn frees its connection slot when closed
+type slotConn struct {
+	net.Conn
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (c *slotConn) Close() error {
+	c.once.Do(func() { <-c.slots })
+	return c.Conn.Close()
+}
+
+func (l *hardenedListener) handshake(conn net.Conn) {
+	l.inHandshake.Add(1)
+	defer func() {
+		l.inHandshake.Add(-1)
+		<-l.sem
+	}()
+
+	tlsConn := tls.Server(conn, l.tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), l.opts.HandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		l.failed.Add(1)
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- tlsConn:
+		l.acceptedConn.Add(1)
+	case <-l.done:
+		tlsConn.Close()
+	}
+}
+
+// Accept returns the next connection that completed its TLS handshake
+func (l *hardenedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting and closes the underlying listener
+func (l *hardenedListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// remoteIP returns the IP part of a connection address
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// ipRateLimiter is a per-IP token bucket limiter
+type ipRateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*ipBucket
+	lastPrune time.Time
+}
+
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newIPRateLimiter(rate float64, burst int) *ipRateLimiter {
+	if burst < 1 {
+		burst = int(rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &ipRateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*ipBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// Allow reports whether ip may open another connection now
+func (rl *ipRateLimiter) Allow(ip string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastPrune) > time.Minute {
+		// Buckets idle long enough to be full again carry no state
+		for k, b := range rl.buckets {
+			if now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastPrune = now
+	}
+
+	b, ok := rl.buckets[ip]
+	if !ok {
+		b = &ipBucket{tokens: rl.burst, last: now}
+		rl.buckets[ip] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rl.rate
+		if b.tokens > rl.burst {
+			b.tokens = rl.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIPRateLimiter_Burst(t *testing.T) {
+	rl := newIPRateLimiter(1, 3)
+	for i := 0; i < 3; i++ {
+		if !rl.Allow("10.0.0.1") {
+			t.Fatalf("connection %d within burst was rejected", i+1)
+		}
+	}
+	if rl.Allow("10.0.0.1") {
+		t.Error("connection beyond burst was allowed")
+	}
+	if !rl.Allow("10.0.0.2") {
+		t.Error("other IP should have its own bucket")
+	}
+}
+
+func TestHardenedListener_HandshakeTimeout(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newHardenedListener(inner, &tls.Config{}, ListenerOptions{
+		HandshakeTimeout:        100 * time.Millisecond,
+		MaxConcurrentHandshakes: 1,
+	})
+	defer ln.Close()
+
+	// A client that never speaks TLS must be dropped after the timeout
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected connection to be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("handshake timeout was not enforced")
+	}
+	// The handshake closes the connection before the failure is counted
+	deadline := time.Now().Add(time.Second)
+	for ln.failed.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := ln.failed.Load(); got != 1 {
+		t.Errorf("failed handshakes = %d, want 1", got)
+	}
+}
+
+func TestHardenedListener_ConnQueue(t *testing.T) {
+	ca, err := GenerateCA("Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: "proxy", ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, Validity: time.Hour})
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newHardenedListener(inner, &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{leaf.Cert.Raw}, PrivateKey: leaf.Key}}}, ListenerOptions{
+		MaxConns:     1,
+		QueueSize:    1,
+		QueueTimeout: 300 * time.Millisecond,
+	})
+	defer ln.Close()
+
+	dial := func() chan error {
+		done := make(chan error, 1)
+		go func() {
+			conn, err := tls.Dial("tcp", inner.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+			if err == nil {
+				conn.Close()
+			}
+			done <- err
+		}()
+		return done
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// The first connection takes the only slot and keeps it until closed
+	first := dial()
+	held, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+
+	// The second waits in the queue, the third is over the hard cap
+	queued := dial()
+	waitFor("queued connection", func() bool { return ln.queued.Load() == 1 })
+	if err := <-dial(); err == nil {
+		t.Error("connection beyond the queue completed its handshake")
+	}
+	waitFor("cap rejection", func() bool { return ln.connRejected.Load() == 1 })
+
+	// Closing the first hands its slot to the queued connection
+	held.Close()
+	next, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	if err := <-queued; err != nil {
+		t.Errorf("queued connection: %v", err)
+	}
+	if ln.queueWaits.Load() != 1 || ln.queued.Load() != 0 {
+		t.Errorf("queue waits = %d, depth = %d", ln.queueWaits.Load(), ln.queued.Load())
+	}
+
+	// With the slot still taken a queued connection gives up after the timeout
+	if err := <-dial(); err == nil {
+		t.Error("connection completed its handshake without a slot")
+	}
+	waitFor("queue timeout", func() bool { return ln.queueTimeout.Load() == 1 })
+}
@@ -1,18 +1,20 @@
 package main
 
 import (
-	"compress/gzip"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"strconv"
-	"strings"
 	"syscall"
 	"time"
 )
@@ -26,54 +28,60 @@ const (
 // Proxy represents the HTTPS proxy server
 type Proxy struct {
 	Config         *Config
-	CACertPool     *x509.CertPool  // Certificate Authority certificate pool
-	StatsManager   *StatsManager   // Legacy statistics manager
-	StatsCollector *StatsCollector // New async stats collector
-	StatsDB        *StatsDB        // SQLite stats database
-	GeoIP          *GeoIPService   // GeoIP lookup service
+	CACertPool     *x509.CertPool      // Certificate Authority certificate pool
+	StatsManager   *StatsManager       // Legacy statistics manager
+	StatsCollector *StatsCollector     // New async stats collector
+	StatsDB        *StatsDB            // SQLite stats database
+	GeoIP          *GeoIPService       // GeoIP lookup service
+	Policy         *PolicyEngine       // Access policy evaluation
+	Compressor     *responseCompressor // Camouflage response compression (nil if disabled)
+	Expiry         *UserExpiryJob      // Automatic user expiry (nil without a stats database)
+	BlockPage      *BlockPage          // HTML page for policy denials seen by browsers
+	Provisioner    *Provisioner        // One-time certificate bundle downloads (nil if disabled)
+	Camouflage     *CamouflageHealth   // Camouflage site health and fallback (nil if unchecked)
+	Fairness       *FairScheduler      // Weighted egress sharing between users (nil if disabled)
+	ForwardedFor   *ForwardedForPolicy // Client addresses disclosed to the camouflage site (nil: none)
+	Routes         *EgressRoutes       // Egress routes by target domain (nil if none)
+	Revocation     *CertRevocation     // Revoked client certificates (nil without a CRL)
+	OCSP           *OCSPVerifier       // Client certificate status from OCSP responders
+	ProxyAuth      *ProxyAuth          // Basic logins on the compatibility listener (nil if disabled)
+	AccessLog      *AccessLog          // A line per tunnel and request (nil if off)
+	// Bounds on what the camouflage site relays (nil if unlimited)
+	CamouflageLimits *CamouflageLimits
 }
 
-// GzipResponseWriter 提供gzip压缩支持
-type GzipResponseWriter struct {
-	io.WriteCloser
-	http.ResponseWriter
-}
-
-// Write 使用gzip压缩写入数据
-func (w *GzipResponseWriter) Write(b []byte) (int, error) {
-	return w.WriteCloser.Write(b)
-}
+// shutdownSignals triggers graceful shutdown; OS signals and service
+// managers both deliver here
+var shutdownSignals = make(chan os.Signal, 1)
 
-// Close 关闭gzip写入器
-func (w *GzipResponseWriter) Close() error {
-	return w.WriteCloser.Close()
-}
+// shutdownComplete is closed once graceful shutdown has finished
+var shutdownComplete = make(chan struct{})
 
-// NewGzipResponseWriter 创建一个新的gzip响应写入器
-func NewGzipResponseWriter(w http.ResponseWriter) *GzipResponseWriter {
-	// 设置Content-Encoding头
-	w.Header().Set("Content-Encoding", "gzip")
-	w.Header().Set("Vary", "Accept-Encoding")
+// exitOnShutdown makes the shutdown handler exit the process. Service
+// managers clear it so they can report the stop before the process ends.
+var exitOnShutdown = true
 
-	// 创建gzip写入器
-	gz := gzip.NewWriter(w)
-
-	// 返回包装的响应写入器
-	return &GzipResponseWriter{
-		WriteCloser:    gz,
-		ResponseWriter: w,
+func main() {
+	// Hand control to the service manager when started by it
+	if runAsService(run) {
+		return
 	}
+	run()
 }
 
-func main() {
+// run starts the proxy and blocks until the HTTPS server stops
+func run() {
 	// Load configuration
 	cfg, err := LoadConfig()
 	if err != nil {
 		log.Fatalf("failed to load configuration: %v", err)
 	}
 
+	// Error message translations beyond the built-in catalogs
+	LoadMessageCatalogs(cfg.I18n.CatalogDir)
+
 	// Load server's certificate and private key
-	serverCert, err := tls.LoadX509KeyPair(cfg.Server.Certificates.CertPath, cfg.Server.Certificates.KeyPath)
+	serverCert, err := loadKeyPair(cfg.Server.Certificates.CertPath, cfg.Server.Certificates.KeyPath)
 	if err != nil {
 		log.Fatalf("failed to load server certificate and key: %v", err)
 	}
@@ -90,6 +98,13 @@ func main() {
 		log.Fatalf("failed to parse CA certificate")
 	}
 
+	// Load the CRL of revoked client certificates and watch it for changes
+	revocation, err := NewCertRevocation(cfg)
+	if err != nil {
+		log.Fatalf("failed to load client certificate CRL: %v", err)
+	}
+	go revocation.Run()
+
 	// Create statistics manager (legacy, kept for compatibility)
 	statsManager := NewStatsManager(cfg)
 
@@ -100,11 +115,34 @@ func main() {
 
 	if cfg.Stats.Enabled {
 		var err2 error
-		statsDB, err2 = NewStatsDB(cfg.Stats.DBPath)
+		if cfg.Stats.ReadOnly {
+			statsDB, err2 = NewReadOnlyStatsDB(cfg.Stats.DBPath)
+		} else {
+			statsDB, err2 = NewStatsDB(cfg.Stats.DBPath)
+		}
 		if err2 != nil {
 			log.Fatalf("failed to init stats database: %v", err2)
 		}
-		log.Printf("Stats database opened: %s", cfg.Stats.DBPath)
+		if cfg.Stats.ReadOnly {
+			log.Printf("Stats database opened: %s (read-only)", cfg.Stats.DBPath)
+		} else {
+			log.Printf("Stats database opened: %s", cfg.Stats.DBPath)
+		}
+		statsDB.SetQueryLimits(QueryLimits{
+			Timeout: time.Duration(firstPositive(cfg.Stats.Query.TimeoutSeconds, 30)) * time.Second,
+			MaxRows: firstPositive(cfg.Stats.Query.MaxRows, 100000),
+		})
+
+		// Attribute this instance's traffic to it in shared or merged databases
+		if !cfg.Stats.ReadOnly {
+			node := cfg.Node.Name
+			if node == "" {
+				node, _ = os.Hostname()
+			}
+			if err := statsDB.SetNode(node, cfg.Node.Labels); err != nil {
+				log.Printf("Warning: failed to register node %q: %v", node, err)
+			}
+		}
 
 		// Initialize GeoIP
 		if cfg.GeoIP.Enabled {
@@ -112,16 +150,16 @@ func main() {
 		}
 
 		// Create async collector
-		statsCollector = NewStatsCollector(statsDB, geoIP, cfg.Stats.FlushInterval)
-
-		// Migrate from legacy JSON if it exists
-		if cfg.Stats.FilePath != "" {
-			if legacyStats := statsManager.GetUserStats(); len(legacyStats) > 0 {
-				if err := statsDB.MigrateFromJSON(legacyStats); err != nil {
-					log.Printf("Warning: JSON migration failed: %v", err)
-				} else {
-					log.Printf("Migrated %d users from legacy JSON stats", len(legacyStats))
-				}
+		statsCollector = NewStatsCollector(statsDB, geoIP, cfg.Stats.FlushInterval, cfg.Stats.MaxBufferEntries)
+		statsCollector.SetShutdownTimeout(time.Duration(cfg.Stats.ShutdownTimeoutSeconds) * time.Second)
+
+		// Import the legacy JSON stats once. Read the saved file and
+		// evicted users rather than the in-memory map, which is capped.
+		if cfg.Stats.FilePath != "" && !cfg.Stats.ReadOnly {
+			if migrated, err := importLegacyStats(statsManager, statsDB, cfg.Stats.FilePath); err != nil {
+				log.Printf("Warning: JSON migration failed: %v", err)
+			} else if migrated > 0 {
+				log.Printf("Migrated %d users from legacy JSON stats", migrated)
 			}
 		}
 
@@ -130,17 +168,64 @@ func main() {
 			ticker := time.NewTicker(6 * time.Hour)
 			defer ticker.Stop()
 			for range ticker.C {
-				statsDB.CleanupOldData(cfg.Stats.Retention.MinuteStatsDays, cfg.Stats.Retention.HourlyStatsDays)
+				statsDB.CleanupOldData(cfg.retentionDays())
 			}
 		}()
+
+		// Keep the database under its size cap
+		if cfg.Stats.Retention.MaxDBSizeMB > 0 {
+			go statsDB.WatchSize(int64(cfg.Stats.Retention.MaxDBSizeMB)<<20, func() int {
+				minuteDays, _ := cfg.retentionDays()
+				return minuteDays
+			}, 10*time.Minute)
+		}
+
+		// Move complete months of aggregates to object storage
+		go NewStatsArchiver(cfg, statsDB).Run()
 	}
 
+	// Create the access policy engine shared by the proxy and admin API
+	policy := NewPolicyEngine(cfg, statsManager, statsDB)
+
+	// Disable users once their expiry date has passed
+	expiry := NewUserExpiryJob(cfg, statsManager, statsDB)
+	go expiry.Run()
+
+	// Download the destination reputation feeds and keep them fresh
+	go policy.Reputation.Run()
+
+	// Save the domain ACL's hit counts
+	go policy.ACL.Run()
+	go policy.CountryLimits.Run()
+
+	// Keep a copy of every config version, including edits made by hand
+	history := NewConfigHistory(cfg)
+	if history != nil {
+		if err := history.Snapshot("startup"); err != nil {
+			log.Printf("Warning: Failed to back up config: %v", err)
+		}
+	}
+
+	// One-time certificate bundle links for QR-code provisioning
+	provisioner = NewProvisioner(cfg)
+
+	// Watch the camouflage site, standing in for it while it is down
+	camouflage = NewCamouflageHealth(cfg)
+	go camouflage.Run()
+
 	// Create admin panel server
-	adminServer, err := NewAdminServer(cfg, statsManager, statsDB)
+	settings := NewSettingsUpdater(cfg, history, statsCollector, geoIP)
+	adminServer, err := NewAdminServer(cfg, statsManager, statsDB, policy, history, settings)
 	if err != nil {
 		log.Printf("Warning: Failed to create admin server: %v", err)
 	}
 
+	// Create admin gRPC server
+	adminGRPC, err := NewAdminGRPCServer(cfg, statsManager, statsDB, policy.Quotas)
+	if err != nil {
+		log.Printf("Warning: Failed to create admin gRPC server: %v", err)
+	}
+
 	// Create a proxy with the configuration
 	prx := &Proxy{
 		Config:         cfg,
@@ -149,6 +234,21 @@ func main() {
 		StatsCollector: statsCollector,
 		StatsDB:        statsDB,
 		GeoIP:          geoIP,
+		Policy:         policy,
+		Compressor:     newResponseCompressor(cfg),
+		BlockPage:      NewBlockPage(cfg),
+		Provisioner:    provisioner,
+		Camouflage:     camouflage,
+		Fairness:       NewFairScheduler(cfg),
+		ForwardedFor:   NewForwardedForPolicy(cfg),
+		Routes:         NewEgressRoutes(cfg),
+		Revocation:     revocation,
+		OCSP:           NewOCSPVerifier(cfg),
+		Expiry:         expiry,
+		ProxyAuth:      NewProxyAuth(cfg),
+		AccessLog:      NewAccessLog(cfg),
+
+		CamouflageLimits: NewCamouflageLimits(cfg),
 	}
 
 	// Create an HTTPS server with the TLS config
@@ -158,8 +258,7 @@ func main() {
 			Certificates:          []tls.Certificate{serverCert},
 			ClientCAs:             caCertPool,
 			ClientAuth:            tls.RequestClientCert, // Request but do not require client certificates
-			NextProtos:            []string{"http/1.1"},
-			VerifyPeerCertificate: nil, // We verify certificates ourselves in ServeHTTP
+			VerifyPeerCertificate: nil,                   // We verify certificates ourselves in ServeHTTP
 		},
 		Handler: prx,
 		// 优化HTTP服务器配置
@@ -167,55 +266,121 @@ func main() {
 		WriteTimeout:      60 * time.Second, // 更长的写超时
 		IdleTimeout:       120 * time.Second,
 		ReadHeaderTimeout: 10 * time.Second,
-		MaxHeaderBytes:    1 << 20, // 1 MB
-	}
-
-	// 如果配置中启用了压缩，则添加压缩中间件
-	if cfg.Server.Performance.EnableCompression {
-		// 使用压缩处理器包装原始处理器
-		compressedHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// 检查Accept-Encoding头是否包含gzip
-			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-				// 创建gzip响应写入器
-				gzw := NewGzipResponseWriter(w)
-				defer gzw.Close()
-
-				// 使用gzip响应写入器
-				prx.ServeHTTP(gzw, r)
-			} else {
-				// 不支持压缩，使用原始处理器
-				prx.ServeHTTP(w, r)
-			}
-		})
-
-		server.Handler = compressedHandler
+		MaxHeaderBytes:    firstPositive(cfg.Server.Listener.MaxHeaderBytes, 1<<20), // 1 MB
+		// OPTIONS * goes to the camouflage site like any other request,
+		// rather than getting the empty 200 that gives Go's server away
+		DisableGeneralOptionsHandler: true,
 	}
 
 	// Start the admin panel server (if configured)
 	if adminServer != nil {
 		adminServer.Start()
 	}
+	adminGRPC.Start()
+
+	tunnels.StartCheckpoints(cfg.Proxy.TunnelCheckpoint)
+	if statsDB != nil {
+		tunnels.StartSampling(cfg.Stats.TunnelSamples)
+	}
 
 	// Set up graceful shutdown
-	setupGracefulShutdown(server, statsManager, adminServer, statsCollector, statsDB, geoIP)
+	setupGracefulShutdown(server, statsManager, adminServer, adminGRPC, statsCollector, policy, statsDB, geoIP, prx.AccessLog)
+
+	// Make the handshake resemble the configured web server's, offer
+	// HTTP/2 for multiplexed tunnels, staple OCSP responses and rotate the
+	// session ticket keys (before the configs below are derived)
+	cfg.Server.TLS.Apply(server.TLSConfig)
+	cfg.Server.Multiplex.Apply(server)
+	stapler := NewOCSPStapler(cfg, serverCert)
+	stapler.Install(server.TLSConfig)
+	go stapler.Run()
+	sessionTickets = NewTicketKeys(cfg.Server.SessionTickets)
+	sessionTickets.Install(server.TLSConfig)
+	go sessionTickets.Run()
+
+	// Clients on a DNS blocklist may have to complete a full handshake on
+	// every connection, and only addresses that knocked are asked for a
+	// client certificate. The other listeners apply the same checks to
+	// their copies of base.
+	base := server.TLSConfig
+	server.TLSConfig = policy.TLSConfig(base)
+
+	// SOCKS5 clients share the server certificate, CA and session tickets
+	if socks := NewSOCKS5Server(cfg, prx, base); socks != nil {
+		log.Printf("Starting SOCKS5 server on %s...\n", listenAddrs(cfg.Server.BindAddresses, socks.Port()))
+		socksLn, err := listenAll(cfg.Server.BindAddresses, socks.Port())
+		if err != nil {
+			log.Fatalf("failed to start SOCKS5 server: %v", err)
+		}
+		go func() {
+			if err := socks.Serve(socksLn); err != nil {
+				log.Printf("SOCKS5 server stopped: %v", err)
+			}
+		}()
+	}
 
-	// Start the HTTPS server
-	log.Printf("Starting HTTPS server on port %d...\n", cfg.Server.Port)
-	err = server.ListenAndServeTLS("", "")
+	// Clients without certificates may log in with Basic credentials, on
+	// a listener of their own or on the main one
+	if auth := prx.ProxyAuth; auth != nil && auth.Port() == 0 {
+		server.Handler = auth.Handler(prx)
+	} else if auth != nil {
+		compat := &http.Server{
+			Handler:           auth.Handler(prx),
+			ReadHeaderTimeout: server.ReadHeaderTimeout,
+			IdleTimeout:       server.IdleTimeout,
+			MaxHeaderBytes:    server.MaxHeaderBytes,
+		}
+		scheme := "HTTP"
+		compatLn, err := listenAll(cfg.Server.BindAddresses, auth.Port())
+		if err != nil {
+			log.Fatalf("failed to start the Basic authentication listener: %v", err)
+		}
+		if auth.TLS() {
+			scheme = "HTTPS"
+			tlsConfig := base.Clone()
+			tlsConfig.NextProtos = nil
+			compatLn = tls.NewListener(compatLn, policy.TLSConfig(tlsConfig))
+		}
+		log.Printf("Starting %s proxy with Basic authentication on %s...\n", scheme, listenAddrs(cfg.Server.BindAddresses, auth.Port()))
+		go func() {
+			if err := compat.Serve(compatLn); err != nil {
+				log.Printf("Basic authentication listener stopped: %v", err)
+			}
+		}()
+	}
+
+	// Start the HTTPS server behind the hardened accept loop
+	log.Printf("Starting HTTPS server on %s...\n", listenAddrs(cfg.Server.BindAddresses, cfg.Server.Port))
+	ln, err := listenAll(cfg.Server.BindAddresses, cfg.Server.Port)
+	if err != nil {
+		log.Fatalf("failed to start HTTPS server: %v", err)
+	}
+	hardened := newHardenedListener(ln, server.TLSConfig, ListenerOptions{
+		HandshakeTimeout:        time.Duration(cfg.Server.Listener.HandshakeTimeout) * time.Second,
+		MaxConcurrentHandshakes: cfg.Server.Listener.MaxConcurrentHandshakes,
+		PerIPAcceptRate:         cfg.Server.Listener.PerIPAcceptRate,
+		PerIPAcceptBurst:        cfg.Server.Listener.PerIPAcceptBurst,
+		MaxConns:                cfg.Server.Performance.MaxConcurrentConns,
+		QueueSize:               cfg.Server.Listener.QueueSize,
+		QueueTimeout:            time.Duration(cfg.Server.Listener.QueueTimeoutMs) * time.Millisecond,
+	})
+	err = server.Serve(hardened)
 	if err != nil && err != http.ErrServerClosed {
 		log.Fatalf("failed to start HTTPS server: %v", err)
 	}
 }
 
 // setupGracefulShutdown sets up graceful shutdown to ensure statistics are saved
-func setupGracefulShutdown(server *http.Server, statsManager *StatsManager, adminServer *AdminServer, statsCollector *StatsCollector, statsDB *StatsDB, geoIP *GeoIPService) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+func setupGracefulShutdown(server *http.Server, statsManager *StatsManager, adminServer *AdminServer, adminGRPC *AdminGRPCServer, statsCollector *StatsCollector, policy *PolicyEngine, statsDB *StatsDB, geoIP *GeoIPService, accessLog *AccessLog) {
+	signal.Notify(shutdownSignals, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
-		<-c
+		<-shutdownSignals
 		log.Println("Shutting down server...")
 
+		// Record the tunnels the exit is about to cut
+		tunnels.Checkpoint(time.Now())
+
 		// Close HTTP server
 		if err := server.Close(); err != nil {
 			log.Printf("Error closing server: %v", err)
@@ -226,11 +391,24 @@ func setupGracefulShutdown(server *http.Server, statsManager *StatsManager, admi
 			adminServer.Stop()
 		}
 
-		// Stop new stats collector (flushes remaining data)
+		// Stop admin gRPC server
+		adminGRPC.Stop()
+
+		// Stop new stats collector (flushes remaining data, spilling what
+		// the database does not take within the shutdown timeout)
 		if statsCollector != nil {
 			statsCollector.Stop()
 		}
 
+		// Save the ACL rule and country rate limit hits counted since the
+		// last flush
+		if err := policy.ACL.Flush(context.Background()); err != nil {
+			log.Printf("Error saving ACL rule hits: %v", err)
+		}
+		if err := policy.CountryLimits.Flush(context.Background()); err != nil {
+			log.Printf("Error saving country rate limit hits: %v", err)
+		}
+
 		// Close stats database
 		if statsDB != nil {
 			statsDB.Close()
@@ -243,14 +421,74 @@ func setupGracefulShutdown(server *http.Server, statsManager *StatsManager, admi
 
 		// Stop legacy statistics manager and save data
 		statsManager.Stop()
+		accessLog.Close()
 
 		log.Println("Server shutdown complete")
-		os.Exit(0)
+		close(shutdownComplete)
+		if exitOnShutdown {
+			os.Exit(0)
+		}
 	}()
 }
 
-// verifyClientCert verifies if the client certificate is issued by a trusted CA
-func (p *Proxy) verifyClientCert(cert *x509.Certificate) bool {
+// importLegacyStats migrates the legacy stats into SQLite unless that was
+// done before. Earlier releases re-imported the file on every start without
+// recording it, so a database that already has users is taken as imported
+// rather than having the totals added again.
+func importLegacyStats(sm *StatsManager, db *StatsDB, file string) (int, error) {
+	if db.LegacyImport(context.Background()) != nil {
+		return 0, nil
+	}
+	overview, err := db.GetOverview(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	if overview.UserCount > 0 {
+		log.Printf("Stats database already holds %d users; not importing %s again", overview.UserCount, file)
+		return 0, db.SetLegacyImport(LegacyImport{Time: time.Now(), File: file, Assumed: true})
+	}
+
+	migrated, err := migrateLegacyStats(sm, db)
+	if err != nil {
+		return migrated, err
+	}
+	return migrated, db.SetLegacyImport(LegacyImport{Time: time.Now(), File: file, Users: migrated})
+}
+
+// migrateLegacyStats imports every user saved by the legacy stats manager
+// into SQLite in batches, returning the number of users migrated
+func migrateLegacyStats(sm *StatsManager, db *StatsDB) (int, error) {
+	const batchSize = 1000
+	migrated := 0
+	batch := make(map[string]*UserStats, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := db.MigrateFromJSON(batch); err != nil {
+			return err
+		}
+		migrated += len(batch)
+		batch = make(map[string]*UserStats, batchSize)
+		return nil
+	}
+
+	err := sm.ForEachSavedUser(func(us *UserStats) error {
+		batch[us.Username] = us
+		if len(batch) >= batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return migrated, err
+}
+
+// verifyClientCert verifies if the client certificate is issued by a trusted
+// CA and not revoked, by the CRL or its OCSP responder
+func (p *Proxy) verifyClientCert(cert *x509.Certificate) error {
 	// Create verification options
 	opts := x509.VerifyOptions{
 		Roots:     p.CACertPool,
@@ -258,14 +496,29 @@ func (p *Proxy) verifyClientCert(cert *x509.Certificate) bool {
 	}
 
 	// Verify certificate chain
-	_, err := cert.Verify(opts)
+	chains, err := cert.Verify(opts)
 	if err != nil {
 		log.Printf("Certificate verification failed: %v", err)
-		return false
+		return err
+	}
+
+	// Check the CRL
+	if err := p.Revocation.Check(cert); err != nil {
+		log.Printf("Certificate of %s (serial %s) is revoked", cert.Subject.CommonName, cert.SerialNumber)
+		return err
+	}
+
+	// Ask the OCSP responder, about certificates issued by a CA rather
+	// than trusted themselves
+	if chain := chains[0]; len(chain) > 1 {
+		if err := p.OCSP.Check(cert, chain[1]); err != nil {
+			log.Printf("OCSP check of the certificate of %s (serial %s) failed: %v", cert.Subject.CommonName, cert.SerialNumber, err)
+			return err
+		}
 	}
 
 	// Certificate verification passed
-	return true
+	return nil
 }
 
 // getUsernameFromCert extracts the username from the certificate
@@ -274,18 +527,85 @@ func getUsernameFromCert(cert *x509.Certificate) string {
 	return cert.Subject.CommonName
 }
 
+// observeClientCert notes the validity and groups of a verified client
+// certificate
+func (p *Proxy) observeClientCert(username string, cert *x509.Certificate) {
+	p.Expiry.ObserveCert(username, cert.NotAfter)
+	if p.Policy.Groups.ObserveCert(username, cert) {
+		p.Policy.RateLimits.Refresh(username)
+	}
+}
+
+// authorize evaluates the access policy (disabled users, ...) for an
+// authenticated client's request, logging and recording a refusal. tunnel
+// is set for requests opening a tunnel, the only ones the ACL hits count.
+func (p *Proxy) authorize(reqID, clientAddr string, req PolicyRequest, tunnel bool) PolicyDecision {
+	decision := p.Policy.Evaluate(req)
+	p.noteDNSBL(reqID, req, decision)
+	var aclRule *ACLRule
+	if tunnel && decision.reached("acl") {
+		aclRule = p.Policy.ACL.Hit(req.Username, req.Host, req.Time)
+	} else if decision.Blocking != nil && decision.Blocking.Rule == "acl" {
+		aclRule = p.Policy.ACL.Match(req.Username, req.Host)
+	}
+	if decision.Allowed {
+		return decision
+	}
+	log.Printf("[req %s] Policy %s rejected: %s, CN: %s", reqID, decision.Blocking.Rule, clientAddr, req.Username)
+	if decision.Blocking.Rule == "reputation" {
+		p.Policy.Reputation.Record(reqID, req.Username, net.JoinHostPort(req.Host, req.Port), p.Policy.Reputation.Match(req.Username, req.Host, netip.Addr{}), p.StatsDB)
+	}
+	if decision.Blocking.Rule == "quota" {
+		p.Policy.Quotas.Record(reqID, req.Username, req.Time)
+	}
+	if decision.Blocking.Rule == "acl" {
+		p.Policy.ACL.Record(reqID, req.Username, req.Host, aclRule, req.Time)
+	}
+	return decision
+}
+
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Check if the client provided a certificate
-	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
-		log.Println("No client certificate provided")
-		fmt.Println("Unauthorized request (no certificate): ", r.Method, r.RequestURI, r.RemoteAddr)
+	// Correlates this request's log lines, errors and tunnel
+	r = withRequestID(r)
+	reqID := requestID(r)
+
+	// Framing the parser let through but no client of ours sends
+	if rejectMalformed(w, r) {
+		log.Printf("[req %s] Malformed request from %s: %s %q", reqID, r.RemoteAddr, r.Method, r.RequestURI)
+		return
+	}
+	closeAfterChunked(w, r)
+
+	// A knock opens the source address; the knock itself gets the
+	// camouflage site like any request without a certificate
+	if p.Policy.Gate.Knock(r, time.Now()) {
+		log.Printf("[req %s] Gate opened for %s", reqID, r.RemoteAddr)
+	}
+
+	// Check if the client provided a certificate, and may present one from
+	// its address
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || !p.Policy.Gate.IsOpen(r.RemoteAddr, time.Now()) {
+		log.Printf("[req %s] No client certificate provided", reqID)
 
 		if r.Method == http.MethodConnect {
+			// Listeners taking Basic logins challenge the client instead,
+			// once its address may log in at all: a password is no way
+			// around the gate
+			if auth := proxyAuthFor(r); auth != nil && p.Policy.Gate.IsOpen(r.RemoteAddr, time.Now()) {
+				p.serveBasicConnect(w, r, auth)
+				return
+			}
 			http.Error(w, "Client certificate required", http.StatusMethodNotAllowed)
+			p.logRefused(r, "", http.StatusMethodNotAllowed, "")
 			return
 		}
 
-		p.proxyUnauthorizedRequest(w, r)
+		// A phone fetching its bundle has no certificate yet
+		if p.Provisioner.ServeBundle(w, r) {
+			return
+		}
+
+		p.proxyUnauthorizedRequest(w, r, "")
 		return
 	}
 
@@ -296,19 +616,21 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	username := getUsernameFromCert(clientCert)
 
 	// Verify client certificate
-	isValid := p.verifyClientCert(clientCert)
+	certErr := p.verifyClientCert(clientCert)
+	isValid := certErr == nil
 
-	// Check if user is disabled (check new DB first, then legacy)
+	// Evaluate access policy (disabled users, ...) for verified clients
 	if isValid {
-		disabled := false
-		if p.StatsDB != nil {
-			disabled = p.StatsDB.IsUserDisabled(username)
-		} else {
-			disabled = p.StatsManager.IsUserDisabled(username)
-		}
-		if disabled {
-			log.Printf("Disabled user rejected: %s, CN: %s", r.RemoteAddr, username)
-			http.Error(w, "Access denied: Your account has been disabled", http.StatusForbidden)
+		p.Policy.Gate.Renew(r.RemoteAddr, time.Now())
+		p.observeClientCert(username, clientCert)
+		decision := p.authorize(reqID, r.RemoteAddr, newPolicyRequest(r, username), r.Method == http.MethodConnect)
+		if !decision.Allowed {
+			if decision.Blocking.Code == ErrCodeReauthRequired {
+				// The client has to reconnect for a full handshake
+				w.Header().Set("Connection", "close")
+			}
+			writePolicyError(w, r, decision.Blocking, p.BlockPage)
+			p.logRefused(r, username, decision.Blocking.Status, decision.Blocking.Code)
 			return
 		}
 	}
@@ -318,15 +640,16 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// Record connection
 			p.StatsManager.RecordConnection(username)
 
-			log.Printf("Authorized client: %s, CN: %s", r.RemoteAddr, clientCert.Subject.CommonName)
-			fmt.Printf("Authorized request: %s %s %s\n", r.Method, r.RequestURI, r.RemoteAddr)
+			log.Printf("[req %s] Authorized client: %s, CN: %s", reqID, r.RemoteAddr, clientCert.Subject.CommonName)
 
 			// Handle connection and track traffic
-			p.handleConnectWithStats(w, r, username)
+			p.handleConnectWithStats(w, r, username, clientCert)
 			return
 		} else {
-			log.Printf("Unauthorized client: %s, CN: %s", r.RemoteAddr, clientCert.Subject.CommonName)
-			http.Error(w, "Invalid client certificate", http.StatusMethodNotAllowed)
+			log.Printf("[req %s] Unauthorized client: %s, CN: %s", reqID, r.RemoteAddr, clientCert.Subject.CommonName)
+			code := certErrorCode(clientCert, certErr, time.Now())
+			writeProxyError(w, r, http.StatusMethodNotAllowed, code, "Invalid client certificate")
+			p.logRefused(r, "", http.StatusMethodNotAllowed, code)
 			return
 		}
 	}
@@ -339,40 +662,107 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	fmt.Println("Unauthorized request: ", r.Method, r.RequestURI, r.RemoteAddr)
-	p.proxyUnauthorizedRequest(w, r)
+	if !isValid {
+		username = ""
+	}
+	p.proxyUnauthorizedRequest(w, r, username)
 }
 
-func (p *Proxy) proxyUnauthorizedRequest(w http.ResponseWriter, r *http.Request) {
-	url := p.Config.Proxy.DefaultSite + r.RequestURI
-	req, err := http.NewRequest(r.Method, url, r.Body)
+// proxyUnauthorizedRequest forwards r to the camouflage site. username is
+// the client's if it has a valid certificate, and decides with
+// proxy.forwarded_for whether the site learns the client's address.
+func (p *Proxy) proxyUnauthorizedRequest(w http.ResponseWriter, r *http.Request, username string) {
+	// Measure what scanners and the camouflage site cost
+	cw := &camouflageWriter{ResponseWriter: w}
+	w = cw
+	reqBody := NewCountingReader(r.Body)
+	started := time.Now()
+	defer func() {
+		p.recordCamouflage(r, reqBody.BytesRead(), cw.written)
+		if p.AccessLog != nil {
+			e := requestAccessEntry(r, username)
+			e.Status, e.Upload, e.Download = cw.Status(), reqBody.BytesRead(), cw.written
+			e.DurationMS = time.Since(started).Milliseconds()
+			p.AccessLog.Log(e)
+		}
+	}()
+	// A request without a body is forwarded without one, not chunked
+	var outBody io.Reader = http.NoBody
+	if r.Body != nil && r.Body != http.NoBody {
+		outBody = p.CamouflageLimits.Request(r.RemoteAddr, reqBody)
+	}
+
+	if p.Camouflage.ServeFallback(w, r) {
+		return
+	}
+	// Whatever form the client's target had, the request goes to the
+	// camouflage site's own host
+	site := p.Config.defaultSite()
+	u, err := camouflageURL(site, r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Page not found"))
+		log.Printf("[req %s] Camouflage request: %v", requestID(r), err)
+		return
+	}
+	target := u.RequestURI()
+	req, err := http.NewRequest(r.Method, site, outBody)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Page not found"))
-		fmt.Println("newRequest: ", err)
+		log.Printf("[req %s] Camouflage request: %v", requestID(r), err)
 		return
 	}
+	req.URL = u
+	if outBody != http.NoBody {
+		// Sent with its length when known, so HTTP/1.0 sites can read it
+		req.ContentLength = r.ContentLength
+	}
 
-	// Copy headers from the original request
+	// Copy headers from the original request, except those about the
+	// client's connection to us
 	for k, v := range r.Header {
 		req.Header[k] = v
 	}
+	removeHopHeaders(req.Header)
+	p.ForwardedFor.Apply(req, r, username)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		fmt.Println("do: ", err)
+		log.Printf("[req %s] Camouflage site: %v", requestID(r), err)
+		p.Camouflage.Failed(err, time.Now())
+		if p.Camouflage.ServeFallback(w, r) {
+			return
+		}
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("Page not found"))
 		return
 	}
 	defer resp.Body.Close()
 
-	for k, v := range resp.Header {
+	// A download too large for the decoy is refused before it starts
+	if p.CamouflageLimits.TooLarge(resp.ContentLength) {
+		p.CamouflageLimits.Truncated(requestID(r), r.RemoteAddr, target)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Page not found"))
+		return
+	}
+
+	header := resp.Header.Clone()
+	removeHopHeaders(header)
+	for k, v := range header {
 		w.Header()[k] = v
 	}
+	body, finish := p.Compressor.Start(w, r, resp)
 	w.WriteHeader(resp.StatusCode)
 
-	io.Copy(w, resp.Body)
+	if _, err := io.Copy(body, p.CamouflageLimits.Response(r.RemoteAddr, resp.Body)); err == errResponseTooLarge {
+		// Abort rather than end the response, so the client sees it is
+		// incomplete
+		p.CamouflageLimits.Truncated(requestID(r), r.RemoteAddr, target)
+		panic(http.ErrAbortHandler)
+	}
+	finish()
 }
 
 // 获取配置的缓冲区大小，如果配置中未指定，则使用默认值
@@ -412,8 +802,10 @@ func (p *Proxy) getNoDelay() bool {
 	return p.Config.Server.Performance.NoDelay
 }
 
-// handleConnectWithStats handles CONNECT requests and tracks traffic statistics
-func (p *Proxy) handleConnectWithStats(w http.ResponseWriter, r *http.Request, username string) {
+// handleConnectWithStats handles CONNECT requests and tracks traffic
+// statistics. cert is the client's verified certificate, nil for Basic
+// logins.
+func (p *Proxy) handleConnectWithStats(w http.ResponseWriter, r *http.Request, username string, cert *x509.Certificate) {
 	// Extract the host and port from the request URI
 	host := r.URL.Hostname()
 	port := r.URL.Port()
@@ -421,6 +813,130 @@ func (p *Proxy) handleConnectWithStats(w http.ResponseWriter, r *http.Request, u
 		port = "443"
 	}
 
+	tag, err := p.connectionTag(r)
+	if err != nil {
+		writeProxyError(w, r, http.StatusBadRequest, ErrCodeInvalidTag, err.Error())
+		return
+	}
+	reqID := requestID(r)
+	if tag != "" {
+		log.Printf("[req %s] Tunnel %s -> %s:%s tagged %q", reqID, username, host, port, tag)
+	}
+	tier := ""
+	if cert != nil {
+		tier = certTier(cert)
+	}
+	sni := ""
+	if r.TLS != nil {
+		sni = r.TLS.ServerName
+	}
+
+	p.tunnel(tunnelRequest{
+		ID:          reqID,
+		Username:    username,
+		ClientAddr:  r.RemoteAddr,
+		Host:        host,
+		Port:        port,
+		Tag:         tag,
+		Tier:        tier,
+		Cert:        cert,
+		Compression: p.negotiateTunnelCompression(r),
+		SNI:         sni,
+	}, &connectClient{w: w, r: r})
+}
+
+// tunnelRequest is a tunnel an authorized client asked for, over HTTP
+// CONNECT or SOCKS5
+type tunnelRequest struct {
+	ID         string // Request ID correlating the log lines
+	Username   string
+	ClientAddr string
+	Host       string
+	Port       string
+	Tag        string
+	Tier       string
+	// Cert is the client certificate, nil for clients that logged in with
+	// a password
+	Cert        *x509.Certificate
+	Compression string // Tunnel compression agreed with the client
+	Protocol    string // "socks5" for SOCKS tunnels, empty for CONNECT
+	SNI         string // Server name of the client's TLS handshake with us
+}
+
+// tunnelClient is the client end of a tunnel being opened
+type tunnelClient interface {
+	// Refuse answers the request with an error; nothing was relayed
+	Refuse(status int, code, message string)
+	// Establish tells the client the tunnel is open and returns the
+	// connection to relay
+	Establish(header http.Header) (net.Conn, error)
+}
+
+// connectClient is the client of an HTTP CONNECT request. HTTP/2 clients
+// tunnel over the request's stream, leaving the connection to their other
+// tunnels; HTTP/1 clients hand us theirs.
+type connectClient struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+func (c *connectClient) Refuse(status int, code, message string) {
+	writeProxyError(c.w, c.r, status, code, message)
+}
+
+func (c *connectClient) Establish(header http.Header) (net.Conn, error) {
+	if c.r.ProtoMajor == 2 {
+		stream := newStreamConn(c.w, c.r)
+		if err := stream.Establish(header); err != nil {
+			stream.Close()
+			return nil, fmt.Errorf("tunnel stream: %w", err)
+		}
+		multiplexedTunnels.Add(1)
+		return stream, nil
+	}
+	hijacker, ok := c.w.(http.Hijacker)
+	if !ok {
+		c.Refuse(http.StatusInternalServerError, ErrCodeInternalError, "hijacking not supported")
+		return nil, errors.New("hijacking not supported")
+	}
+	hijacked, _, err := hijacker.Hijack()
+	if err != nil {
+		c.Refuse(http.StatusInternalServerError, ErrCodeInternalError, err.Error())
+		return nil, err
+	}
+	var head bytes.Buffer
+	head.WriteString("HTTP/1.0 200 Connection established\r\n")
+	header.Write(&head)
+	head.WriteString("\r\n")
+	hijacked.Write(head.Bytes())
+	return hijacked, nil
+}
+
+// tunnel dials the target of t and relays between it and the client,
+// under the user's limits and policies, and records the traffic
+func (p *Proxy) tunnel(t tunnelRequest, client tunnelClient) {
+	reqID, username, host, port, tag := t.ID, t.Username, t.Host, t.Port, t.Tag
+	access := tunnelAccessEntry(t)
+	if p.AccessLog != nil {
+		client = &accessLogClient{tunnelClient: client, log: p.AccessLog, entry: access, start: time.Now()}
+	}
+
+	// Tunnels run at the rate of the user's tier, trial accounts at their
+	// preset rate; users flagged for likely P2P traffic are throttled or
+	// refused
+	throttle := &tunnelThrottle{}
+	tier, _ := p.Policy.Tiers.Get(t.Tier)
+	if tier != nil && tier.RateBytes > 0 {
+		throttle.Limit(tier.RateBytes)
+	}
+	if trial, ok := p.Policy.Trials.Get(username); ok {
+		throttle.Limit(trial.RateBytes)
+	}
+	if action, flag := p.Policy.Protocols.ObserveP2P(username, host, port, "", time.Now()); p.applyP2P(reqID, action, flag, throttle) {
+		client.Refuse(http.StatusForbidden, ErrCodeP2PBlocked, "peer-to-peer traffic is not allowed")
+		return
+	}
+
 	// 创建自定义的TCP连接配置来优化性能
 	dialer := &net.Dialer{
 		Timeout:   30 * time.Second,
@@ -428,18 +944,49 @@ func (p *Proxy) handleConnectWithStats(w http.ResponseWriter, r *http.Request, u
 		DualStack: true, // 启用IPv4/IPv6双栈
 	}
 
-	// 使用自定义配置的连接
-	conn, err := dialer.Dial("tcp", net.JoinHostPort(host, port))
+	// 使用自定义配置的连接，目标域名配置了路由时经由该路由
+	route := p.Routes.Match(host)
+	conn, err := route.Dial(dialer, net.JoinHostPort(host, port))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to connect to target host: %v", err), http.StatusBadGateway)
+		status, code := dialError(err)
+		log.Printf("[req %s] Dial %s:%s failed: %v", reqID, host, port, err)
+		p.recordDialFailure(username, host, code)
+		client.Refuse(status, code, fmt.Sprintf("failed to connect to target host: %v", err))
 		return
 	}
 	defer conn.Close()
 
 	// Extract the remote IP for GeoIP lookup
 	targetIP := ""
-	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+	var targetAddr netip.Addr
+	if route != nil {
+		log.Printf("[req %s] Routing %s:%s through %s", reqID, host, port, route.Name())
+	}
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !route.viaUpstream() {
 		targetIP = tcpAddr.IP.String()
+		targetAddr = tcpAddr.AddrPort().Addr()
+	}
+
+	// Targets in a country with a rate limit are paced by it as well; the
+	// lookup is handed on to the stats rather than repeated there
+	var geo GeoResult
+	if p.Policy.CountryLimits != nil {
+		if g := p.GeoIP.Lookup(targetIP); g != nil {
+			geo = *g
+		}
+	}
+	countryLimited := p.Policy.CountryLimits.Hit(geo.Country, time.Now())
+
+	// Destinations on a reputation feed are flagged, or refused when the
+	// resolved address is on a block feed (listed names were refused by
+	// the policy already)
+	reputation := p.Policy.Reputation.Match(username, host, targetAddr)
+	if reputation != nil {
+		p.Policy.Reputation.Record(reqID, username, net.JoinHostPort(host, port), reputation, p.StatsDB)
+		if reputation.Action == ReputationBlock {
+			client.Refuse(http.StatusForbidden, ErrCodeDestinationBlocked, "destination is listed by "+reputation.Feed)
+			return
+		}
 	}
 
 	// 设置TCP参数以优化性能
@@ -455,22 +1002,60 @@ func (p *Proxy) handleConnectWithStats(w http.ResponseWriter, r *http.Request, u
 		tcpConn.SetWriteBuffer(p.getWriteBufferSize())
 	}
 
-	// Send a 200 OK response to the client
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
-		return
+	// Send connection established message, with the tunnel compression
+	// the client asked for and we agreed to
+	compression := t.Compression
+	established := http.Header{"X-Request-Id": {reqID}}
+	if compression != "" {
+		established.Set(tunnelCompressionHeader, compression)
 	}
-
-	clientConn, _, err := hijacker.Hijack()
+	clientConn, err := client.Establish(established)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("[req %s] Establishing tunnel: %v", reqID, err)
 		return
 	}
 	defer clientConn.Close()
+	stream, multiplexed := clientConn.(*streamConn)
+
+	// Track the tunnel so admins can see it, and cut it if its certificate
+	// expires while it is open (when configured)
+	var certNotAfter time.Time
+	if t.Cert != nil {
+		certNotAfter = t.Cert.NotAfter
+	}
+	started := time.Now()
+	tunnelID := tunnels.Register(TunnelInfo{
+		RequestID:    reqID,
+		Username:     username,
+		ClientAddr:   t.ClientAddr,
+		Target:       net.JoinHostPort(host, port),
+		Protocol:     t.Protocol,
+		Tag:          tag,
+		Reputation:   reputationString(reputation),
+		Route:        route.Name(),
+		Started:      started,
+		CertNotAfter: certNotAfter,
+	})
+	defer tunnels.Unregister(tunnelID)
+	if t.Cert != nil {
+		stopExpiryWatch := p.watchCertExpiry(tunnelID, reqID, t.ClientAddr, t.Cert, func() {
+			clientConn.Close()
+			conn.Close()
+		})
+		defer stopExpiryWatch()
+	}
 
-	// Send connection established message
-	clientConn.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n"))
+	// Close the tunnel once it has carried the user's transfer limit
+	transfer := p.Policy.TransferLimits.transferCap(username, tier, func() {
+		limit := p.Policy.TransferLimits.Limit(username, tier)
+		log.Printf("[req %s] Closing tunnel %d (%s -> %s:%s): transfer limit of %s reached",
+			reqID, tunnelID, username, host, port, formatBytes(limit))
+		if p.StatsDB != nil {
+			p.StatsDB.RecordUserEvent(username, EventTransferLimit, "policy", fmt.Sprintf("%s:%s: %s in one tunnel", host, port, formatBytes(limit)))
+		}
+		clientConn.Close()
+		conn.Close()
+	})
 
 	// 应用客户端连接优化
 	if netConn, ok := clientConn.(*net.TCPConn); ok {
@@ -490,6 +1075,26 @@ func (p *Proxy) handleConnectWithStats(w http.ResponseWriter, r *http.Request, u
 	clientWriter := NewCountingWriter(clientConn)
 	serverReader := NewCountingReader(conn)
 	serverWriter := NewCountingWriter(conn)
+	tunnels.setCounters(tunnelID, func() (uint64, uint64) {
+		return serverWriter.BytesWritten(), serverReader.BytesRead()
+	})
+	// Long tunnels report as they go; the target receives what the client
+	// sends, so its count never exceeds the upload reported at close
+	reporter := p.startTunnelReports(TrafficEvent{Username: username, Domain: host, Tag: tag, TargetIP: targetIP,
+		Country: geo.Country, CountryName: geo.CountryName, Continent: geo.Continent},
+		serverWriter.BytesWritten, serverReader.BytesRead)
+
+	// Compressed tunnels decode what the client sends and encode what it
+	// receives; the target sees the plain stream
+	var clientIn io.Reader = clientReader
+	clientOut := p.Fairness.Writer(username, clientWriter)
+	var compressedIn *compressedReader
+	var compressedOut *compressedWriter
+	if compression != "" {
+		compressedIn = newCompressedReader(clientReader)
+		compressedOut = newCompressedWriter(clientOut, p.Config.Proxy.TunnelCompression.Level)
+		clientIn, clientOut = compressedIn, compressedOut
+	}
 
 	// 每个方向独立 buffer，避免数据竞争
 	bufSize := p.getBufferSize()
@@ -499,13 +1104,46 @@ func (p *Proxy) handleConnectWithStats(w http.ResponseWriter, r *http.Request, u
 	// Set up traffic copying from client to server (upload)
 	done := make(chan struct{})
 	go func() {
-		io.CopyBuffer(serverWriter, clientReader, uploadBuf)
-		conn.Close()
-		close(done)
+		defer close(done)
+		defer conn.Close()
+		// The protocol policy inspects the first bytes the client sends
+		// (TLS-only users, SSH rules, P2P handshakes); they are forwarded
+		// before the rest. Sniffing here keeps server-first protocols
+		// flowing meanwhile.
+		var src io.Reader = clientIn
+		if protocols := p.Policy.Protocols; protocols.Enforced(username, port) {
+			head, proto := sniffClient(clientConn, clientIn, protocols.timeout)
+			if action, flag := protocols.ObserveP2P(username, host, port, proto, time.Now()); p.applyP2P(reqID, action, flag, throttle) {
+				clientConn.Close()
+				return
+			}
+			if rule, reason := protocols.Check(username, port, proto, time.Now()); rule != "" {
+				log.Printf("[req %s] Protocol violation (%s): %s sent %s to %s:%s, %s; closing tunnel", reqID, rule, username, proto, host, port, reason)
+				if p.StatsDB != nil {
+					p.StatsDB.RecordUserEvent(username, EventProtocolViolation, "policy", fmt.Sprintf("%s to %s:%s: %s", proto, host, port, reason))
+				}
+				clientConn.Close()
+				return
+			}
+			src = io.MultiReader(bytes.NewReader(head), clientIn)
+		}
+		if countryLimited {
+			src = p.Policy.CountryLimits.Reader(username, geo.Country, true, src)
+		}
+		io.CopyBuffer(p.Fairness.Writer(username, serverWriter), transfer.Reader(throttle.Reader(p.Policy.RateLimits.Reader(username, true, src))), uploadBuf)
 	}()
 
 	// Set up traffic copying from server to client (download)
-	io.CopyBuffer(clientWriter, serverReader, downloadBuf)
+	var dst io.Reader = serverReader
+	if countryLimited {
+		dst = p.Policy.CountryLimits.Reader(username, geo.Country, false, dst)
+	}
+	io.CopyBuffer(clientOut, transfer.Reader(throttle.Reader(p.Policy.RateLimits.Reader(username, false, dst))), downloadBuf)
+	if multiplexed {
+		// The client only learns the target closed once the handler
+		// returns and ends the stream, so stop waiting for its upload
+		stream.Close()
+	}
 
 	// Wait for the upload goroutine to finish
 	<-done
@@ -513,17 +1151,48 @@ func (p *Proxy) handleConnectWithStats(w http.ResponseWriter, r *http.Request, u
 	// Record traffic to legacy StatsManager in one shot (no per-read locking)
 	uploadBytes := clientReader.BytesRead()
 	downloadBytes := serverReader.BytesRead()
+	if compression != "" {
+		// Stats and quotas count the plain stream, as without compression
+		uploadBytes = compressedIn.read
+		compressionRawUp.Add(uploadBytes)
+		compressionWireUp.Add(clientReader.BytesRead())
+		compressionRawDown.Add(compressedOut.written)
+		compressionWireDown.Add(clientWriter.BytesWritten())
+		log.Printf("[req %s] Tunnel compressed (%s): up %d -> %d, down %d -> %d",
+			reqID, compression, uploadBytes, clientReader.BytesRead(), compressedOut.written, clientWriter.BytesWritten())
+	}
 	p.StatsManager.RecordTraffic(username, uploadBytes+downloadBytes)
-
-	// Emit TrafficEvent to the new async collector
+	duration := time.Since(started)
+	var ttfb time.Duration
+	if first := serverReader.FirstRead(); !first.IsZero() {
+		ttfb = first.Sub(started)
+	}
+	tunnelLatency.Observe(username, duration, ttfb)
+	log.Printf("[req %s] Tunnel closed: %s -> %s:%s, up %d, down %d, %s",
+		reqID, username, host, port, uploadBytes, downloadBytes, duration.Round(time.Millisecond))
+	access.Status, access.Upload, access.Download = http.StatusOK, uploadBytes, downloadBytes
+	access.DurationMS = duration.Milliseconds()
+	p.AccessLog.Log(access)
+	p.saveTunnelSamples(tunnelID, DBTunnelSamples{User: username, Target: net.JoinHostPort(host, port), Started: started, Ended: time.Now(),
+		Upload: serverWriter.BytesWritten(), Download: serverReader.BytesRead()}, throttle)
+
+	// Emit TrafficEvent to the new async collector, less what the tunnel
+	// reported while open
+	final := reporter.Close(TrafficEvent{
+		Username:    username,
+		Domain:      host,
+		Tag:         tag,
+		TargetIP:    targetIP,
+		Country:     geo.Country,
+		CountryName: geo.CountryName,
+		Continent:   geo.Continent,
+		Upload:      uploadBytes,
+		Download:    downloadBytes,
+		Duration:    duration,
+		TTFB:        ttfb,
+		Timestamp:   time.Now(),
+	})
 	if p.StatsCollector != nil {
-		p.StatsCollector.Record(TrafficEvent{
-			Username:  username,
-			Domain:    host,
-			TargetIP:  targetIP,
-			Upload:    uploadBytes,
-			Download:  downloadBytes,
-			Timestamp: time.Now(),
-		})
+		p.StatsCollector.Record(final)
 	}
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultMaintenanceMessage is shown to clients when no message is configured
+const defaultMaintenanceMessage = "Service temporarily unavailable for maintenance"
+
+// MaintenanceWindow is a scheduled period of maintenance
+type MaintenanceWindow struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Message string    `json:"message,omitempty"`
+}
+
+// MaintenanceStatus describes the current maintenance state
+type MaintenanceStatus struct {
+	Active      bool                `json:"active"`
+	Manual      bool                `json:"manual"`              // switched on through the API
+	Until       *time.Time          `json:"until,omitempty"`     // when the active period ends, if known
+	Message     string              `json:"message,omitempty"`   // shown to blocked clients
+	ExemptUsers []string            `json:"exempt_users"`        // users or patterns that may still connect
+	RetryAfter  int                 `json:"retry_after_seconds"` // Retry-After sent to blocked clients
+	Windows     []MaintenanceWindow `json:"windows"`             // upcoming and current scheduled windows
+	Next        *MaintenanceWindow  `json:"next,omitempty"`      // next scheduled window, if any
+}
+
+// MaintenanceUpdate is the body of POST /api/v2/maintenance. Omitted fields
+// are left unchanged.
+type MaintenanceUpdate struct {
+	Enabled *bool                `json:"enabled,omitempty"`
+	Until   time.Time            `json:"until,omitempty"`   // switch off automatically (with enabled=true)
+	Message string               `json:"message,omitempty"` // replaces the client message
+	Windows *[]MaintenanceWindow `json:"windows,omitempty"` // replaces the schedule
+}
+
+// MaintenanceMode blocks new proxy connections from non-exempt users while
+// switched on manually or during a scheduled window. Tunnels that are already
+// open are not touched and drain naturally.
+type MaintenanceMode struct {
+	mu          sync.RWMutex
+	manual      bool
+	manualUntil time.Time // zero: until switched off
+	message     string
+	windows     []MaintenanceWindow
+	exempt      *userPatterns
+	exemptList  []string
+	retryAfter  int
+}
+
+// NewMaintenanceMode creates the maintenance state from the configuration
+func NewMaintenanceMode(config *Config) *MaintenanceMode {
+	m := &MaintenanceMode{
+		message:    config.Maintenance.Message,
+		exemptList: append([]string(nil), config.Maintenance.ExemptUsers...),
+		retryAfter: config.Maintenance.RetryAfter,
+	}
+	var err error
+	if m.exempt, err = newUserPatterns(m.exemptList); err != nil {
+		log.Printf("Maintenance exempt_users: %v", err)
+	}
+	if m.retryAfter <= 0 {
+		m.retryAfter = 300
+	}
+	for _, w := range config.Maintenance.Windows {
+		if err := validateMaintenanceWindow(w); err != nil {
+			log.Printf("Ignoring maintenance window %s - %s: %v", w.Start, w.End, err)
+			continue
+		}
+		m.windows = append(m.windows, w)
+	}
+	sortMaintenanceWindows(m.windows)
+
+	metrics.Gauge("https_proxy_maintenance_active", "1 while maintenance mode blocks new connections", func() float64 {
+		if m.Status(time.Now()).Active {
+			return 1
+		}
+		return 0
+	})
+	return m
+}
+
+func validateMaintenanceWindow(w MaintenanceWindow) error {
+	if w.Start.IsZero() || w.End.IsZero() || !w.End.After(w.Start) {
+		return fmt.Errorf("maintenance window needs start before end")
+	}
+	return nil
+}
+
+func sortMaintenanceWindows(windows []MaintenanceWindow) {
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Start.Before(windows[j].Start) })
+}
+
+// SetManual switches manual maintenance on or off. A non-zero until switches
+// it off automatically; message replaces the configured client message.
+func (m *MaintenanceMode) SetManual(on bool, until time.Time, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.manual = on
+	m.manualUntil = time.Time{}
+	if on {
+		m.manualUntil = until
+	}
+	if message != "" {
+		m.message = message
+	}
+}
+
+// SetWindows replaces the maintenance schedule
+func (m *MaintenanceMode) SetWindows(windows []MaintenanceWindow) error {
+	for _, w := range windows {
+		if err := validateMaintenanceWindow(w); err != nil {
+			return err
+		}
+	}
+	sorted := append([]MaintenanceWindow(nil), windows...)
+	sortMaintenanceWindows(sorted)
+
+	m.mu.Lock()
+	m.windows = sorted
+	m.mu.Unlock()
+	return nil
+}
+
+// IsExempt reports whether username may connect during maintenance, either
+// listed by name or matching an exempt pattern such as "ops-*"
+func (m *MaintenanceMode) IsExempt(username string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.exempt.Match(username)
+	return ok
+}
+
+// Status returns the maintenance state at now
+func (m *MaintenanceMode) Status(now time.Time) MaintenanceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	st := MaintenanceStatus{
+		Message:     m.message,
+		RetryAfter:  m.retryAfter,
+		ExemptUsers: append([]string{}, m.exemptList...),
+		Windows:     []MaintenanceWindow{},
+	}
+	sort.Strings(st.ExemptUsers)
+
+	if m.manual && (m.manualUntil.IsZero() || now.Before(m.manualUntil)) {
+		st.Active, st.Manual = true, true
+		if !m.manualUntil.IsZero() {
+			until := m.manualUntil
+			st.Until = &until
+		}
+	}
+	for _, w := range m.windows {
+		if !now.Before(w.End) {
+			continue // past
+		}
+		st.Windows = append(st.Windows, w)
+		if !now.Before(w.Start) && !st.Active {
+			st.Active = true
+			end := w.End
+			st.Until = &end
+			if w.Message != "" {
+				st.Message = w.Message
+			}
+		} else if now.Before(w.Start) && st.Next == nil {
+			next := w
+			st.Next = &next
+		}
+	}
+	if st.Message == "" {
+		st.Message = defaultMaintenanceMessage
+	}
+	return st
+}
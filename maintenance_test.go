@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyEngine_Maintenance(t *testing.T) {
+	now := time.Now()
+	cfg := &Config{}
+	cfg.Maintenance.ExemptUsers = []string{"ops", "sre-*"}
+	cfg.Maintenance.Windows = []MaintenanceWindow{{Start: now.Add(time.Hour), End: now.Add(2 * time.Hour), Message: "upgrade"}}
+	engine := NewPolicyEngine(cfg, nil, nil)
+
+	if d := engine.Evaluate(PolicyRequest{Username: "alice", Time: now}); !d.Allowed {
+		t.Fatalf("blocked outside maintenance: %+v", d.Blocking)
+	}
+
+	// Inside the scheduled window
+	d := engine.Evaluate(PolicyRequest{Username: "alice", Time: now.Add(90 * time.Minute)})
+	if d.Allowed || d.Blocking.Rule != "maintenance" || d.Blocking.Status != http.StatusServiceUnavailable {
+		t.Fatalf("expected maintenance block, got %+v", d.Blocking)
+	}
+	if d.Blocking.Reason != "upgrade" || d.Blocking.RetryAfter != 300 {
+		t.Errorf("unexpected block details: %+v", d.Blocking)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "ops", Time: now.Add(90 * time.Minute)}); !d.Allowed {
+		t.Error("exempt user was blocked")
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "sre-oncall", Time: now.Add(90 * time.Minute)}); !d.Allowed {
+		t.Error("user matching an exempt pattern was blocked")
+	}
+
+	// Manual switch with automatic end
+	engine.Maintenance.SetManual(true, now.Add(10*time.Minute), "")
+	if d := engine.Evaluate(PolicyRequest{Username: "alice", Time: now}); d.Allowed || d.Blocking.Reason != defaultMaintenanceMessage {
+		t.Errorf("manual maintenance not enforced: %+v", d)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "alice", Time: now.Add(20 * time.Minute)}); !d.Allowed {
+		t.Error("manual maintenance did not end at its until time")
+	}
+}
+
+func TestV2API_Maintenance(t *testing.T) {
+	cfg := &Config{}
+	engine := NewPolicyEngine(cfg, nil, nil)
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, nil, engine, nil)
+
+	do := func(method, body string) (int, MaintenanceStatus) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, "/api/v2/maintenance", strings.NewReader(body)))
+		var resp struct {
+			Data MaintenanceStatus `json:"data"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp.Data
+	}
+
+	if code, st := do(http.MethodGet, ""); code != http.StatusOK || st.Active {
+		t.Fatalf("GET: %d %+v", code, st)
+	}
+	if code, st := do(http.MethodPost, `{"enabled":true,"message":"back soon"}`); code != http.StatusOK || !st.Active || !st.Manual || st.Message != "back soon" {
+		t.Fatalf("enable: %d %+v", code, st)
+	}
+	if code, _ := do(http.MethodPost, `{"windows":[{"start":"2030-01-02T00:00:00Z","end":"2030-01-01T00:00:00Z"}]}`); code != http.StatusBadRequest {
+		t.Errorf("inverted window: status %d, want 400", code)
+	}
+	if code, st := do(http.MethodPost, `{"enabled":false,"windows":[{"start":"2030-01-01T00:00:00Z","end":"2030-01-02T00:00:00Z"}]}`); code != http.StatusOK || st.Active || st.Next == nil {
+		t.Fatalf("schedule: %d %+v", code, st)
+	}
+	if code, _ := do(http.MethodDelete, ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: status %d, want 405", code)
+	}
+}
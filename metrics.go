@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MetricSample is a single labelled value of a metric. Suffix is appended
+// to the metric name, for the _bucket, _sum and _count series of histograms.
+type MetricSample struct {
+	Suffix string
+	Labels map[string]string
+	Value  float64
+}
+
+type registeredMetric struct {
+	name    string
+	help    string
+	kind    string // "gauge", "counter" or "histogram"
+	collect func() []MetricSample
+}
+
+// MetricsRegistry collects values from subsystems at scrape time and
+// renders them in the Prometheus text exposition format.
+type MetricsRegistry struct {
+	mu      sync.RWMutex
+	metrics map[string]*registeredMetric
+}
+
+// metrics is the process-wide registry served on the admin /metrics endpoint
+var metrics = NewMetricsRegistry()
+
+// NewMetricsRegistry creates an empty registry
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{metrics: make(map[string]*registeredMetric)}
+}
+
+// Gauge registers an unlabelled gauge read from fn at scrape time.
+// Registering the same name again replaces the previous metric.
+func (m *MetricsRegistry) Gauge(name, help string, fn func() float64) {
+	m.Collect(name, help, "gauge", func() []MetricSample { return []MetricSample{{Value: fn()}} })
+}
+
+// Counter registers an unlabelled counter read from fn at scrape time
+func (m *MetricsRegistry) Counter(name, help string, fn func() float64) {
+	m.Collect(name, help, "counter", func() []MetricSample { return []MetricSample{{Value: fn()}} })
+}
+
+// Collect registers a metric that may produce several labelled samples
+func (m *MetricsRegistry) Collect(name, help, kind string, fn func() []MetricSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics[name] = &registeredMetric{name: name, help: help, kind: kind, collect: fn}
+}
+
+// Render renders all metrics in the Prometheus text format
+func (m *MetricsRegistry) Render(w io.Writer) {
+	m.mu.RLock()
+	list := make([]*registeredMetric, 0, len(m.metrics))
+	for _, rm := range m.metrics {
+		list = append(list, rm)
+	}
+	m.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	for _, rm := range list {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", rm.name, rm.help, rm.name, rm.kind)
+		for _, s := range rm.collect() {
+			fmt.Fprintf(w, "%s%s%s %v\n", rm.name, s.Suffix, formatMetricLabels(s.Labels), s.Value)
+		}
+	}
+}
+
+func formatMetricLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[k])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, k, v))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// ServeHTTP serves the registry for Prometheus scrapers
+func (m *MetricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.Render(w)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// MultiplexConfig offers HTTP/2 to proxy clients, so one TLS session
+// carries many tunnels, each CONNECT on a stream of its own. Browsing opens
+// many short tunnels; without it every one costs a full handshake.
+type MultiplexConfig struct {
+	Enabled    bool `json:"enabled"`
+	MaxStreams int  `json:"max_streams"` // Concurrent tunnels per connection (default 100)
+}
+
+// multiplexedTunnels counts tunnels opened on HTTP/2 streams
+var multiplexedTunnels atomic.Uint64
+
+func init() {
+	metrics.Counter("https_proxy_multiplexed_tunnels_total", "Tunnels opened as streams of a multiplexed HTTP/2 connection.", func() float64 {
+		return float64(multiplexedTunnels.Load())
+	})
+}
+
+// Apply advertises h2 ahead of the profile's other protocols, and limits
+// the streams of a connection
+func (mc MultiplexConfig) Apply(server *http.Server) {
+	if !mc.Enabled {
+		return
+	}
+	if !slices.Contains(server.TLSConfig.NextProtos, "h2") {
+		server.TLSConfig.NextProtos = append([]string{"h2"}, server.TLSConfig.NextProtos...)
+	}
+	server.HTTP2 = &http.HTTP2Config{MaxConcurrentStreams: firstPositive(mc.MaxStreams, 100)}
+}
+
+// streamConn is the client side of a tunnel carried by an HTTP/2 stream:
+// the request body is what the client sends, the response what it receives
+type streamConn struct {
+	body   io.ReadCloser
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	local  net.Addr
+	remote net.Addr
+}
+
+// newStreamConn takes over the stream of an HTTP/2 CONNECT request
+func newStreamConn(w http.ResponseWriter, r *http.Request) *streamConn {
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		remote = &net.TCPAddr{}
+	}
+	return &streamConn{body: r.Body, w: w, rc: http.NewResponseController(w), local: local, remote: remote}
+}
+
+// Establish sends the 200 response opening the tunnel. The server's read
+// and write timeouts are meant for requests, not tunnels, so they are
+// lifted.
+func (c *streamConn) Establish(header http.Header) error {
+	for k, v := range header {
+		c.w.Header()[k] = v
+	}
+	c.w.WriteHeader(http.StatusOK)
+	c.rc.SetReadDeadline(time.Time{})
+	c.rc.SetWriteDeadline(time.Time{})
+	return c.rc.Flush()
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+// Write sends b to the client at once; tunnels are interactive
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.rc.Flush()
+}
+
+// Close stops reading from the client. The stream itself ends when the
+// handler returns.
+func (c *streamConn) Close() error {
+	return c.body.Close()
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.rc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.rc.SetReadDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.rc.SetWriteDeadline(t) }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStreamConn_TunnelsShareConnection(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.ProtoMajor != 2 {
+			http.Error(w, "want an HTTP/2 CONNECT", http.StatusBadRequest)
+			return
+		}
+		c := newStreamConn(w, r)
+		defer c.Close()
+		if err := c.Establish(http.Header{"X-Request-Id": {r.Host}}); err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(c, c) // echo
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	client := srv.Client()
+
+	tunnel := func(i int) {
+		target := fmt.Sprintf("site%d.example:443", i)
+		pr, pw := io.Pipe()
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Scheme: "https", Host: srv.Listener.Addr().String()},
+			Host:   target,
+			Header: make(http.Header),
+			Body:   pr,
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Request-Id") != target {
+			t.Errorf("%s: status %d, header %q", target, resp.StatusCode, resp.Header.Get("X-Request-Id"))
+			return
+		}
+		lines := bufio.NewReader(resp.Body)
+		for j := 0; j < 3; j++ {
+			msg := fmt.Sprintf("hello %s #%d\n", target, j)
+			io.WriteString(pw, msg)
+			if got, err := lines.ReadString('\n'); got != msg {
+				t.Errorf("echo = %q, %v; want %q", got, err, msg)
+			}
+		}
+		pw.Close()
+		if rest, _ := io.ReadAll(lines); len(rest) != 0 {
+			t.Errorf("unexpected trailing data %q", rest)
+		}
+	}
+	// The first tunnel sets up the connection the others share
+	tunnel(0)
+	var wg sync.WaitGroup
+	for i := 1; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tunnel(i)
+		}(i)
+	}
+	wg.Wait()
+
+	if n := conns.Load(); n != 1 {
+		t.Errorf("tunnels used %d connections, want 1", n)
+	}
+}
+
+func TestMultiplexConfig_Apply(t *testing.T) {
+	server := &http.Server{TLSConfig: &tls.Config{NextProtos: []string{"http/1.1"}}}
+	MultiplexConfig{}.Apply(server)
+	if len(server.TLSConfig.NextProtos) != 1 || server.HTTP2 != nil {
+		t.Fatalf("disabled multiplexing changed the server: %v", server.TLSConfig.NextProtos)
+	}
+
+	MultiplexConfig{Enabled: true}.Apply(server)
+	if got := server.TLSConfig.NextProtos; len(got) != 2 || got[0] != "h2" {
+		t.Errorf("NextProtos = %v, want h2 first", got)
+	}
+	if server.HTTP2 == nil || server.HTTP2.MaxConcurrentStreams != 100 {
+		t.Errorf("HTTP2 = %+v, want 100 streams", server.HTTP2)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPConfig controls OCSP for the server certificate and client certificates
+type OCSPConfig struct {
+	Staple         bool `json:"staple"`          // Staple the responder's answer for the server certificate
+	VerifyClients  bool `json:"verify_clients"`  // Ask the responder of each client certificate
+	HardFail       bool `json:"hard_fail"`       // Reject client certificates whose status cannot be learned
+	TimeoutSeconds int  `json:"timeout_seconds"` // Time allowed for a responder to answer (default 5)
+	CacheMinutes   int  `json:"cache_minutes"`   // Longest time a client certificate's status is kept (default 60)
+}
+
+const (
+	ocspRetry        = 5 * time.Minute // Time before retrying a failed staple fetch
+	ocspFailureCache = time.Minute     // Time a failed client lookup is remembered
+	ocspMaxResponse  = 1 << 20
+)
+
+var errOCSPUnavailable = errors.New("certificate status unavailable")
+
+// fetchOCSP asks the first OCSP responder named by cert about it
+func fetchOCSP(client *http.Client, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	if len(cert.OCSPServer) == 0 {
+		return nil, errors.New("certificate names no OCSP responder")
+	}
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s: %s", cert.OCSPServer[0], resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, ocspMaxResponse))
+	if err != nil {
+		return nil, err
+	}
+	return ocsp.ParseResponseForCert(body, cert, issuer)
+}
+
+// OCSPStapler keeps a fresh OCSP response for the server certificate and
+// staples it to handshakes
+type OCSPStapler struct {
+	client *http.Client
+	leaf   *x509.Certificate
+	issuer *x509.Certificate
+	cert   atomic.Pointer[tls.Certificate]
+
+	mu         sync.Mutex
+	nextUpdate time.Time
+}
+
+// NewOCSPStapler returns a stapler for cert, or nil if stapling is off or
+// cert cannot be stapled. The issuer is taken from the chain of the
+// certificate file, or else from server.certificates.ca_path.
+func NewOCSPStapler(config *Config, cert tls.Certificate) *OCSPStapler {
+	oc := config.Server.OCSP
+	if !oc.Staple {
+		return nil
+	}
+	if cert.Leaf == nil || len(cert.Leaf.OCSPServer) == 0 {
+		log.Printf("OCSP: the server certificate names no OCSP responder, not stapling")
+		return nil
+	}
+	issuer := ocspIssuer(cert, config.Server.Certificates.CAPath)
+	if issuer == nil {
+		log.Printf("OCSP: issuer of the server certificate not found in its chain or ca_path, not stapling")
+		return nil
+	}
+	s := &OCSPStapler{
+		client: &http.Client{Timeout: time.Duration(firstPositive(oc.TimeoutSeconds, 5)) * time.Second},
+		leaf:   cert.Leaf,
+		issuer: issuer,
+	}
+	s.cert.Store(&cert)
+
+	metrics.Gauge("https_proxy_ocsp_staple_valid", "1 if a current OCSP response is stapled to the server certificate.", func() float64 {
+		if s.Stapled(time.Now()) {
+			return 1
+		}
+		return 0
+	})
+	return s
+}
+
+// ocspIssuer returns the certificate that signed the leaf of cert
+func ocspIssuer(cert tls.Certificate, caPath string) *x509.Certificate {
+	var candidates []*x509.Certificate
+	for _, der := range cert.Certificate[1:] {
+		if c, err := x509.ParseCertificate(der); err == nil {
+			candidates = append(candidates, c)
+		}
+	}
+	if cas, err := readCertificates(caPath); err == nil {
+		candidates = append(candidates, cas...)
+	}
+	for _, c := range candidates {
+		if cert.Leaf.CheckSignatureFrom(c) == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// Install serves the certificate of cfg through the stapler. It must run
+// after the certificate chain was trimmed and before cfg is cloned.
+func (s *OCSPStapler) Install(cfg *tls.Config) {
+	if s == nil || len(cfg.Certificates) == 0 {
+		return
+	}
+	cert := cfg.Certificates[0]
+	s.cert.Store(&cert)
+	cfg.Certificates = nil
+	cfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return s.cert.Load(), nil
+	}
+}
+
+// Run fetches a response now, and a new one halfway to the expiry of
+// each, forever
+func (s *OCSPStapler) Run() {
+	if s == nil {
+		return
+	}
+	for {
+		time.Sleep(time.Until(s.Refresh(time.Now())))
+	}
+}
+
+// Refresh fetches a response and staples it if the certificate is good. It
+// returns when to refresh next. A failed fetch keeps the current staple
+// until its next update.
+func (s *OCSPStapler) Refresh(now time.Time) time.Time {
+	resp, err := fetchOCSP(s.client, s.leaf, s.issuer)
+	if err != nil {
+		log.Printf("OCSP: fetching the server certificate status: %v", err)
+		s.expire(now)
+		return now.Add(ocspRetry)
+	}
+	if resp.Status != ocsp.Good {
+		log.Printf("OCSP: the responder reports the server certificate as %s; not stapling", ocspStatus(resp.Status))
+		s.staple(nil, time.Time{})
+		return now.Add(ocspRetry)
+	}
+
+	s.staple(resp.Raw, resp.NextUpdate)
+	if resp.NextUpdate.IsZero() {
+		return now.Add(time.Hour)
+	}
+	next := resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	if next.Before(now.Add(ocspRetry)) {
+		next = now.Add(ocspRetry)
+	}
+	return next
+}
+
+// expire drops a staple past its next update, which clients would refuse
+func (s *OCSPStapler) expire(now time.Time) {
+	s.mu.Lock()
+	stale := !s.nextUpdate.IsZero() && now.After(s.nextUpdate)
+	s.mu.Unlock()
+	if stale {
+		s.staple(nil, time.Time{})
+	}
+}
+
+func (s *OCSPStapler) staple(raw []byte, nextUpdate time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cert := *s.cert.Load()
+	cert.OCSPStaple = raw
+	s.cert.Store(&cert)
+	s.nextUpdate = nextUpdate
+}
+
+// Stapled reports whether a response valid at now is stapled
+func (s *OCSPStapler) Stapled(now time.Time) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cert.Load().OCSPStaple != nil && (s.nextUpdate.IsZero() || now.Before(s.nextUpdate))
+}
+
+func ocspStatus(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	}
+	return "unknown"
+}
+
+// ocspEntry is the cached status of a client certificate
+type ocspEntry struct {
+	err     error // nil, errCertRevoked or errOCSPUnavailable
+	expires time.Time
+}
+
+// OCSPVerifier checks client certificates with the OCSP responder named in
+// their authority information access extension. Answers are cached until
+// their next update, at most cache_minutes, so a client opening many
+// tunnels does not cost a lookup each.
+type OCSPVerifier struct {
+	client   *http.Client
+	hardFail bool
+	maxAge   time.Duration
+
+	mu    sync.Mutex
+	cache map[string]ocspEntry // issuer DER + serial number
+
+	lookups  atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// NewOCSPVerifier returns nil unless server.ocsp.verify_clients is set
+func NewOCSPVerifier(config *Config) *OCSPVerifier {
+	oc := config.Server.OCSP
+	if !oc.VerifyClients {
+		return nil
+	}
+	v := &OCSPVerifier{
+		client:   &http.Client{Timeout: time.Duration(firstPositive(oc.TimeoutSeconds, 5)) * time.Second},
+		hardFail: oc.HardFail,
+		maxAge:   time.Duration(firstPositive(oc.CacheMinutes, 60)) * time.Minute,
+		cache:    make(map[string]ocspEntry),
+	}
+
+	metrics.Counter("https_proxy_ocsp_client_lookups_total", "OCSP requests made for client certificates.", func() float64 {
+		return float64(v.lookups.Load())
+	})
+	metrics.Counter("https_proxy_ocsp_client_rejected_total", "Client certificates rejected after an OCSP check.", func() float64 {
+		return float64(v.rejected.Load())
+	})
+	return v
+}
+
+// Check returns errCertRevoked if the responder reports cert as revoked.
+// A certificate naming no responder passes. One whose status cannot be
+// learned passes too, unless hard_fail is set, when it gets
+// errOCSPUnavailable.
+func (v *OCSPVerifier) Check(cert, issuer *x509.Certificate) error {
+	return v.check(cert, issuer, time.Now())
+}
+
+func (v *OCSPVerifier) check(cert, issuer *x509.Certificate, now time.Time) error {
+	if v == nil || len(cert.OCSPServer) == 0 {
+		return nil
+	}
+	key := string(cert.RawIssuer) + cert.SerialNumber.String()
+	v.mu.Lock()
+	entry, ok := v.cache[key]
+	v.mu.Unlock()
+	if !ok || !now.Before(entry.expires) {
+		entry = v.lookup(cert, issuer, now)
+		v.mu.Lock()
+		v.sweep(now)
+		v.cache[key] = entry
+		v.mu.Unlock()
+	}
+
+	if entry.err == errOCSPUnavailable && !v.hardFail {
+		return nil
+	}
+	if entry.err != nil {
+		v.rejected.Add(1)
+	}
+	return entry.err
+}
+
+// lookup asks the responder about cert
+func (v *OCSPVerifier) lookup(cert, issuer *x509.Certificate, now time.Time) ocspEntry {
+	v.lookups.Add(1)
+	resp, err := fetchOCSP(v.client, cert, issuer)
+	if err != nil {
+		log.Printf("OCSP: status of the certificate of %s (serial %s): %v", cert.Subject.CommonName, cert.SerialNumber, err)
+		return ocspEntry{err: errOCSPUnavailable, expires: now.Add(ocspFailureCache)}
+	}
+	expires := now.Add(v.maxAge)
+	if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(expires) {
+		expires = resp.NextUpdate
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return ocspEntry{expires: expires}
+	case ocsp.Revoked:
+		return ocspEntry{err: errCertRevoked, expires: expires}
+	}
+	log.Printf("OCSP: the responder does not know the certificate of %s (serial %s)", cert.Subject.CommonName, cert.SerialNumber)
+	return ocspEntry{err: errOCSPUnavailable, expires: expires}
+}
+
+// sweep drops expired entries; v.mu must be held
+func (v *OCSPVerifier) sweep(now time.Time) {
+	for key, entry := range v.cache {
+		if !now.Before(entry.expires) {
+			delete(v.cache, key)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspResponder answers for the certificates of ca with the status set in
+// statuses, or fails while down is set
+type ocspResponder struct {
+	*httptest.Server
+	ca       *IssuedCert
+	statuses map[string]int
+	down     atomic.Bool
+	hits     atomic.Int32
+}
+
+func newOCSPResponder(t *testing.T, ca *IssuedCert) *ocspResponder {
+	o := &ocspResponder{ca: ca, statuses: make(map[string]int)}
+	o.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o.hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil || o.down.Load() {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		status, ok := o.statuses[req.SerialNumber.String()]
+		if !ok {
+			status = ocsp.Unknown
+		}
+		resp, err := ocsp.CreateResponse(ca.Cert, ca.Cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   now,
+			NextUpdate:   now.Add(time.Hour),
+			RevokedAt:    now,
+		}, ca.Key)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+	t.Cleanup(o.Close)
+	return o
+}
+
+// issueWithOCSP issues a certificate of ca naming responder for its status
+func issueWithOCSP(t *testing.T, ca *IssuedCert, cn string, usage x509.ExtKeyUsage, responder string) *IssuedCert {
+	c, err := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: cn, DNSNames: []string{cn}, ExtKeyUsage: []x509.ExtKeyUsage{usage}, Validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := *c.Cert
+	tmpl.OCSPServer = []string{responder}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, ca.Cert, c.Key.Public(), ca.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Cert, _ = x509.ParseCertificate(der)
+	c.CertPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return c
+}
+
+func TestOCSPVerifier(t *testing.T) {
+	ca, err := GenerateCA("Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder := newOCSPResponder(t, ca)
+	bob := issueWithOCSP(t, ca, "bob", x509.ExtKeyUsageClientAuth, responder.URL)
+	carol := issueWithOCSP(t, ca, "carol", x509.ExtKeyUsageClientAuth, responder.URL)
+	dave, _ := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: "dave", ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, Validity: time.Hour})
+	responder.statuses[bob.Cert.SerialNumber.String()] = ocsp.Good
+	responder.statuses[carol.Cert.SerialNumber.String()] = ocsp.Revoked
+
+	if NewOCSPVerifier(&Config{}) != nil {
+		t.Fatal("verifier built with verify_clients off")
+	}
+	cfg := &Config{}
+	cfg.Server.OCSP.VerifyClients = true
+	v := NewOCSPVerifier(cfg)
+	now := time.Now()
+	if err := v.check(bob.Cert, ca.Cert, now); err != nil {
+		t.Errorf("good certificate: %v", err)
+	}
+	if err := v.check(carol.Cert, ca.Cert, now); err != errCertRevoked {
+		t.Errorf("revoked certificate: %v", err)
+	}
+	if err := v.check(dave.Cert, ca.Cert, now); err != nil || responder.hits.Load() != 2 {
+		t.Errorf("certificate without a responder: %v after %d lookups", err, responder.hits.Load())
+	}
+
+	// Answers are cached until their next update
+	responder.down.Store(true)
+	if err := v.check(carol.Cert, ca.Cert, now.Add(time.Minute)); err != errCertRevoked || responder.hits.Load() != 2 {
+		t.Errorf("cached revocation: %v after %d lookups", err, responder.hits.Load())
+	}
+
+	// An unreachable responder lets clients through unless hard_fail is set
+	if err := v.check(bob.Cert, ca.Cert, now.Add(2*time.Hour)); err != nil || responder.hits.Load() != 3 {
+		t.Errorf("soft fail: %v after %d lookups", err, responder.hits.Load())
+	}
+	cfg.Server.OCSP.HardFail = true
+	hard := NewOCSPVerifier(cfg)
+	if err := hard.check(bob.Cert, ca.Cert, now); err != errOCSPUnavailable {
+		t.Errorf("hard fail: %v", err)
+	}
+	responder.down.Store(false)
+	if err := hard.check(bob.Cert, ca.Cert, now.Add(30*time.Second)); err != errOCSPUnavailable {
+		t.Errorf("failure not cached: %v", err)
+	}
+	if err := hard.check(bob.Cert, ca.Cert, now.Add(2*ocspFailureCache)); err != nil {
+		t.Errorf("recovered responder: %v", err)
+	}
+
+	// Revoked clients get a structured error instead of their tunnel
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	sm := NewStatsManager(cfg)
+	p := &Proxy{Config: cfg, CACertPool: pool, StatsManager: sm, Policy: NewPolicyEngine(cfg, sm, nil), OCSP: v}
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{carol.Cert}}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	var e ProxyError
+	if json.NewDecoder(w.Body).Decode(&e); w.Code != http.StatusMethodNotAllowed || e.Code != ErrCodeCertRevoked {
+		t.Errorf("revoked CONNECT: %d %+v", w.Code, e)
+	}
+}
+
+func TestOCSPStapler(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := GenerateCA("Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder := newOCSPResponder(t, ca)
+	server := issueWithOCSP(t, ca, "proxy.example", x509.ExtKeyUsageServerAuth, responder.URL)
+	responder.statuses[server.Cert.SerialNumber.String()] = ocsp.Good
+
+	// The issuer is found in the chain of the certificate file
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	os.WriteFile(certPath, append(server.CertPEM, ca.CertPEM...), 0644)
+	os.WriteFile(keyPath, server.KeyPEM, 0600)
+	cert, err := loadKeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{}
+	cfg.Server.OCSP.Staple = true
+	s := NewOCSPStapler(cfg, cert)
+	if s == nil || !s.issuer.Equal(ca.Cert) {
+		t.Fatalf("stapler = %+v", s)
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	cfg.Server.TLS.Chain = TLSChainLeaf
+	cfg.Server.TLS.Apply(tlsConfig)
+	s.Install(tlsConfig)
+	now := time.Now()
+	if next := s.Refresh(now); !s.Stapled(now) || next.Before(now.Add(29*time.Minute)) {
+		t.Fatalf("staple refreshed at %v, stapled %v", next, s.Stapled(now))
+	}
+
+	front := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	front.TLS = tlsConfig
+	front.StartTLS()
+	defer front.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	conn, err := tls.Dial("tcp", front.Listener.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "proxy.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := conn.ConnectionState()
+	conn.Close()
+	resp, err := ocsp.ParseResponseForCert(state.OCSPResponse, server.Cert, ca.Cert)
+	if err != nil || resp.Status != ocsp.Good || len(state.PeerCertificates) != 1 {
+		t.Errorf("stapled response %+v, %v, chain of %d", resp, err, len(state.PeerCertificates))
+	}
+
+	// A failed refresh keeps the staple until its next update
+	responder.down.Store(true)
+	if s.Refresh(now.Add(time.Minute)); !s.Stapled(now.Add(time.Minute)) {
+		t.Error("staple dropped by a failed refresh")
+	}
+	if s.Refresh(now.Add(2 * time.Hour)); s.Stapled(now.Add(2 * time.Hour)) {
+		t.Error("expired staple kept")
+	}
+
+	if NewOCSPStapler(&Config{}, cert) != nil {
+		t.Error("stapler built with staple off")
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// P2P policy actions for users flagged by the heuristics
+const (
+	P2POff      = "off"
+	P2PWarn     = "warn"     // log and record a user event
+	P2PThrottle = "throttle" // also cap the user's tunnels to throttle_kbps
+	P2PBlock    = "block"    // also close the tunnel and refuse new ones
+)
+
+// P2P heuristics, used as the reason and metric label of a flag
+const (
+	p2pHandshake = "handshake"       // BitTorrent handshake or tracker request in the tunnel
+	p2pPorts     = "bittorrent_port" // peer on a default BitTorrent port
+	p2pFanout    = "fanout"          // many distinct peers on high ports
+)
+
+// P2PConfig flags likely BitTorrent and other peer-to-peer use
+type P2PConfig struct {
+	Action        string            `json:"action"`         // Action for users not listed (default off)
+	Users         map[string]string `json:"users"`          // Action per user or CN pattern
+	FanoutPeers   int               `json:"fanout_peers"`   // Distinct IP:high-port targets in the window that flag a user (default 30)
+	WindowSeconds int               `json:"window_seconds"` // Fan-out window and how long a flag lasts (default 300)
+	ThrottleKBps  int               `json:"throttle_kbps"`  // Per-direction tunnel rate of throttled users in KB/s (default 64)
+}
+
+// P2PFlag is a user currently flagged for likely P2P traffic
+type P2PFlag struct {
+	Username  string    `json:"username"`
+	Heuristic string    `json:"heuristic"`
+	Detail    string    `json:"detail"`
+	Action    string    `json:"action"`
+	Since     time.Time `json:"since"`
+	Until     time.Time `json:"until"`
+}
+
+// AnomaliesResponse is the payload of /api/v2/anomalies
+type AnomaliesResponse struct {
+	Flagged []P2PFlag   `json:"flagged"`
+	Events  []UserEvent `json:"events"`
+}
+
+// p2pPeer is a tunnel target seen for the fan-out heuristic
+type p2pPeer struct {
+	target string
+	seen   time.Time
+}
+
+// p2pDetector applies the P2P heuristics per user
+type p2pDetector struct {
+	defaultAction string
+	users         *userPatterns
+	actions       map[string]string // by users entry
+	fanout        int
+	window        time.Duration
+	throttleRate  int64 // bytes per second
+
+	mu      sync.Mutex
+	peers   map[string][]p2pPeer
+	flagged map[string]*P2PFlag
+	flags   map[string]uint64 // by heuristic
+}
+
+// newP2PDetector parses proxy.protocols.p2p; it returns nil if no user is
+// checked
+func newP2PDetector(pc P2PConfig) *p2pDetector {
+	if (pc.Action == "" || pc.Action == P2POff) && len(pc.Users) == 0 {
+		return nil
+	}
+	d := &p2pDetector{
+		defaultAction: P2POff,
+		actions:       make(map[string]string),
+		fanout:        pc.FanoutPeers,
+		window:        time.Duration(pc.WindowSeconds) * time.Second,
+		throttleRate:  int64(pc.ThrottleKBps) * 1024,
+		peers:         make(map[string][]p2pPeer),
+		flagged:       make(map[string]*P2PFlag),
+		flags:         make(map[string]uint64),
+	}
+	if validP2PAction(pc.Action) {
+		d.defaultAction = pc.Action
+	} else if pc.Action != "" {
+		log.Printf("Protocols p2p.action: unknown action %q, using off", pc.Action)
+	}
+	var entries []string
+	for entry, action := range pc.Users {
+		if !validP2PAction(action) {
+			log.Printf("Protocols p2p.users: unknown action %q for %s, ignored", action, entry)
+			continue
+		}
+		entries = append(entries, entry)
+		d.actions[entry] = action
+	}
+	var err error
+	if d.users, err = newUserPatterns(entries); err != nil {
+		log.Printf("Protocols p2p.users: %v", err)
+	}
+	if d.fanout <= 0 {
+		d.fanout = 30
+	}
+	if d.window <= 0 {
+		d.window = 5 * time.Minute
+	}
+	if d.throttleRate <= 0 {
+		d.throttleRate = 64 * 1024
+	}
+
+	metrics.Collect("https_proxy_p2p_flags_total", "P2P heuristic hits, by heuristic.", "counter", func() []MetricSample {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		names := make([]string, 0, len(d.flags))
+		for name := range d.flags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		samples := make([]MetricSample, 0, len(names))
+		for _, name := range names {
+			samples = append(samples, MetricSample{Labels: map[string]string{"heuristic": name}, Value: float64(d.flags[name])})
+		}
+		return samples
+	})
+	metrics.Gauge("https_proxy_p2p_flagged_users", "Users currently flagged for likely P2P traffic", func() float64 {
+		return float64(len(d.Flagged(time.Now())))
+	})
+	return d
+}
+
+func validP2PAction(action string) bool {
+	return action == P2POff || action == P2PWarn || action == P2PThrottle || action == P2PBlock
+}
+
+// action returns the P2P action that applies to username
+func (d *p2pDetector) action(username string) string {
+	if entry, ok := d.users.Match(username); ok {
+		return d.actions[entry]
+	}
+	return d.defaultAction
+}
+
+// Observe feeds a tunnel of username to host:port to the heuristics; proto
+// is the sniffed protocol, or "" when the tunnel is opened. It returns the
+// action to apply if the user is flagged, and the new flag if this tunnel
+// caused it.
+func (d *p2pDetector) Observe(username, host, port, proto string, now time.Time) (string, *P2PFlag) {
+	action := d.action(username)
+	if action == P2POff {
+		return "", nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var heuristic, detail string
+	switch {
+	case proto == ProtoBitTorrent:
+		heuristic, detail = p2pHandshake, "BitTorrent handshake to "+net.JoinHostPort(host, port)
+	case proto != "":
+	case isBitTorrentPort(port) && net.ParseIP(host) != nil:
+		heuristic, detail = p2pPorts, "peer "+net.JoinHostPort(host, port)
+	default:
+		if n := d.countPeer(username, host, port, now); n >= d.fanout {
+			heuristic, detail = p2pFanout, fmt.Sprintf("%d peers on high ports in %s", n, d.window)
+		}
+	}
+
+	flag := d.flagged[username]
+	if flag != nil && !now.Before(flag.Until) {
+		delete(d.flagged, username)
+		flag = nil
+	}
+	if heuristic == "" {
+		if flag == nil {
+			return "", nil
+		}
+		return flag.Action, nil
+	}
+	d.flags[heuristic]++
+	if flag != nil {
+		flag.Until = now.Add(d.window)
+		return flag.Action, nil
+	}
+	flag = &P2PFlag{Username: username, Heuristic: heuristic, Detail: detail, Action: action, Since: now, Until: now.Add(d.window)}
+	d.flagged[username] = flag
+	copied := *flag
+	return action, &copied
+}
+
+// countPeer records a target that looks like a peer (an IP address on a
+// high port) and returns the user's distinct peers in the window
+func (d *p2pDetector) countPeer(username, host, port string, now time.Time) int {
+	n, err := strconv.Atoi(port)
+	if net.ParseIP(host) == nil || err != nil || n < 1024 {
+		return 0
+	}
+	target := net.JoinHostPort(host, port)
+	cutoff := now.Add(-d.window)
+	peers := d.peers[username][:0]
+	distinct := map[string]bool{target: true}
+	for _, p := range d.peers[username] {
+		if p.seen.After(cutoff) && p.target != target {
+			peers = append(peers, p)
+			distinct[p.target] = true
+		}
+	}
+	d.peers[username] = append(peers, p2pPeer{target: target, seen: now})
+	return len(distinct)
+}
+
+// Sniffs reports whether username's tunnels are checked for P2P handshakes
+func (d *p2pDetector) Sniffs(username string) bool {
+	return d != nil && d.action(username) != P2POff
+}
+
+// Flagged returns the users flagged at now, most recent first
+func (d *p2pDetector) Flagged(now time.Time) []P2PFlag {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []P2PFlag
+	for _, f := range d.flagged {
+		if now.Before(f.Until) {
+			out = append(out, *f)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Since.After(out[j].Since) })
+	return out
+}
+
+// isBitTorrentPort reports whether port is in the range BitTorrent clients
+// listen on by default
+func isBitTorrentPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n >= 6881 && n <= 6889
+}
+
+// tunnelThrottle caps a tunnel's throughput once switched on. Both copy
+// directions share it, each limited to the rate on its own.
+type tunnelThrottle struct {
+	rate atomic.Int64 // bytes per second; 0 while off
+}
+
+// Limit switches the throttle on at rate bytes per second
+func (t *tunnelThrottle) Limit(rate int64) {
+	t.rate.Store(rate)
+}
+
+// Reader wraps r so reads are paced to the throttle's rate
+func (t *tunnelThrottle) Reader(r io.Reader) io.Reader {
+	return &throttledReader{r: r, t: t}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *tunnelThrottle
+}
+
+func (tr *throttledReader) Read(b []byte) (int, error) {
+	rate := tr.t.rate.Load()
+	if rate <= 0 {
+		return tr.r.Read(b)
+	}
+	if int64(len(b)) > rate {
+		b = b[:rate]
+	}
+	start := time.Now()
+	n, err := tr.r.Read(b)
+	if wait := time.Duration(n)*time.Second/time.Duration(rate) - time.Since(start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// applyP2P carries out the P2P action for a tunnel, logging and recording
+// flag if the tunnel just got its user flagged. It reports whether the
+// tunnel must be refused or closed.
+func (p *Proxy) applyP2P(reqID, action string, flag *P2PFlag, throttle *tunnelThrottle) bool {
+	if flag != nil {
+		log.Printf("[req %s] Likely P2P traffic from %s (%s): %s, action %s", reqID, flag.Username, flag.Heuristic, flag.Detail, flag.Action)
+		if p.StatsDB != nil {
+			p.StatsDB.RecordUserEvent(flag.Username, EventP2PSuspected, "policy", fmt.Sprintf("%s: %s (%s)", flag.Heuristic, flag.Detail, flag.Action))
+		}
+	}
+	switch action {
+	case P2PThrottle:
+		throttle.Limit(p.Policy.Protocols.p2p.throttleRate)
+	case P2PBlock:
+		return true
+	}
+	return false
+}
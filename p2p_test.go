@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestP2PDetector(t *testing.T) {
+	if newP2PDetector(P2PConfig{}) != nil {
+		t.Fatal("detector without actions should be nil")
+	}
+	d := newP2PDetector(P2PConfig{
+		Action:      P2PWarn,
+		Users:       map[string]string{"guest-*": P2PBlock, "ops": P2POff},
+		FanoutPeers: 3,
+	})
+	now := time.Now()
+
+	if action, flag := d.Observe("ops", "10.0.0.1", "6881", "", now); action != "" || flag != nil {
+		t.Errorf("off user flagged: %s %+v", action, flag)
+	}
+	// Hostnames and well-known ports are not peers
+	for _, target := range [][2]string{{"example.com", "51413"}, {"10.0.0.1", "443"}, {"10.0.0.2", "443"}, {"10.0.0.3", "443"}} {
+		if action, _ := d.Observe("alice", target[0], target[1], "", now); action != "" {
+			t.Errorf("%v flagged alice", target)
+		}
+	}
+	// Fan-out: the third distinct IP on a high port flags the user once
+	d.Observe("alice", "10.0.0.1", "51413", "", now)
+	d.Observe("alice", "10.0.0.1", "51413", "", now)
+	d.Observe("alice", "10.0.0.2", "40000", "", now)
+	action, flag := d.Observe("alice", "10.0.0.3", "50000", "", now)
+	if action != P2PWarn || flag == nil || flag.Heuristic != p2pFanout {
+		t.Fatalf("fan-out: %s %+v", action, flag)
+	}
+	if action, flag := d.Observe("alice", "example.com", "443", "", now.Add(time.Minute)); action != P2PWarn || flag != nil {
+		t.Errorf("flag should last the window without a new event: %s %+v", action, flag)
+	}
+	if action, _ := d.Observe("alice", "example.com", "443", "", now.Add(6*time.Minute)); action != "" {
+		t.Errorf("flag outlived the window: %s", action)
+	}
+
+	action, flag = d.Observe("guest-1", "example.com", "443", ProtoBitTorrent, now)
+	if action != P2PBlock || flag == nil || flag.Heuristic != p2pHandshake {
+		t.Errorf("handshake: %s %+v", action, flag)
+	}
+	if action, flag := d.Observe("bob", "192.0.2.1", "6882", "", now); action != P2PWarn || flag == nil || flag.Heuristic != p2pPorts {
+		t.Errorf("BitTorrent port: %s %+v", action, flag)
+	}
+	if got := d.Flagged(now); len(got) != 2 {
+		t.Errorf("flagged = %+v", got)
+	}
+}
+
+func TestSniffBitTorrent(t *testing.T) {
+	tests := []struct {
+		data     string
+		complete bool
+		want     string
+	}{
+		{"\x13BitTorrent protocol", true, ProtoBitTorrent},
+		{"\x13BitTor", false, ProtoUnknown},
+		{"GET /announce?info_hash=", true, ProtoBitTorrent},
+		{"GET /ann", false, ProtoHTTP},
+		{"GET / HTTP/1.1", true, ProtoHTTP},
+	}
+	for _, tt := range tests {
+		b := []byte(tt.data)
+		if len(b) > sniffBytes {
+			b = b[:sniffBytes]
+		}
+		if sniffComplete(b) != tt.complete || sniffProtocol(b) != tt.want {
+			t.Errorf("%q: complete %v, protocol %s", tt.data, sniffComplete(b), sniffProtocol(b))
+		}
+	}
+}
+
+func TestTunnelThrottle(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3000)
+	throttle := &tunnelThrottle{}
+	start := time.Now()
+	io.Copy(io.Discard, throttle.Reader(bytes.NewReader(data)))
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("unthrottled copy took %s", time.Since(start))
+	}
+
+	throttle.Limit(10000) // bytes per second
+	start = time.Now()
+	n, _ := io.Copy(io.Discard, throttle.Reader(bytes.NewReader(data)))
+	if elapsed := time.Since(start); n != 3000 || elapsed < 250*time.Millisecond {
+		t.Errorf("throttled copy of %d bytes took %s", n, elapsed)
+	}
+}
+
+func TestV2API_Anomalies(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	db.RecordUserEvent("alice", EventP2PSuspected, "policy", "fanout: 30 peers on high ports in 5m0s (warn)")
+	db.RecordUserEvent("bob", EventProtocolViolation, "policy", "http to example.com:443")
+	db.RecordUserEvent("bob", EventUserDisabled, "web:admin", "")
+
+	cfg := &Config{}
+	cfg.Proxy.Protocols.P2P = P2PConfig{Action: P2PThrottle}
+	engine := NewPolicyEngine(cfg, nil, db)
+	engine.Protocols.ObserveP2P("carol", "192.0.2.1", "6881", "", time.Now())
+
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, db, engine, nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/anomalies", nil))
+
+	var resp struct {
+		Data AnomaliesResponse `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	got := resp.Data
+	if rec.Code != http.StatusOK || len(got.Events) != 2 || got.Events[0].User != "bob" || got.Events[1].Type != EventP2PSuspected {
+		t.Errorf("events = %d %+v", rec.Code, got.Events)
+	}
+	if len(got.Flagged) != 1 || got.Flagged[0].Username != "carol" || got.Flagged[0].Action != P2PThrottle {
+		t.Errorf("flagged = %s", fmt.Sprint(got.Flagged))
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// unknownUserHash is compared against for names without a login, so that
+// they take as long to refuse as wrong passwords
+var unknownUserHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+	return hash
+})
+
+// passwordLogins checks name and password logins against bcrypt hashes.
+// A password that passed is remembered as an HMAC under a key of this
+// process, so clients sending it with every request pay bcrypt's cost
+// once.
+type passwordLogins struct {
+	hashes map[string][]byte
+	key    []byte
+
+	mu     sync.Mutex
+	passed map[string][]byte // HMAC of the password that last passed, by name
+}
+
+func newPasswordLogins() *passwordLogins {
+	key := make([]byte, sha256.Size)
+	rand.Read(key)
+	return &passwordLogins{hashes: make(map[string][]byte), key: key, passed: make(map[string][]byte)}
+}
+
+// Add adds the login of name with its bcrypt hash, reporting false if the
+// hash is not one
+func (l *passwordLogins) Add(name, hash string) bool {
+	if name == "" {
+		return false
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return false
+	}
+	l.hashes[name] = []byte(hash)
+	return true
+}
+
+// Len returns the number of logins
+func (l *passwordLogins) Len() int {
+	return len(l.hashes)
+}
+
+// Check reports whether password is that of the user called name
+func (l *passwordLogins) Check(name string, password []byte) bool {
+	hash, ok := l.hashes[name]
+	if !ok {
+		bcrypt.CompareHashAndPassword(unknownUserHash(), password)
+		return false
+	}
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write(password)
+	sum := mac.Sum(nil)
+
+	l.mu.Lock()
+	passed := l.passed[name]
+	l.mu.Unlock()
+	if passed != nil && hmac.Equal(passed, sum) {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, password) != nil {
+		return false
+	}
+	l.mu.Lock()
+	l.passed[name] = sum
+	l.mu.Unlock()
+	return true
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordLogins(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	l := newPasswordLogins()
+	if l.Add("alice", "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8") || l.Add("", string(hash)) {
+		t.Error("added a login without a bcrypt hash or a name")
+	}
+	if !l.Add("alice", string(hash)) || l.Len() != 1 {
+		t.Fatalf("%d logins", l.Len())
+	}
+
+	for i := 0; i < 2; i++ {
+		// The second time round, the password that passed is remembered
+		if !l.Check("alice", []byte("secret")) {
+			t.Errorf("check %d: password refused", i)
+		}
+		if l.Check("alice", []byte("guess")) || l.Check("bob", []byte("secret")) {
+			t.Errorf("check %d: wrong password or user accepted", i)
+		}
+	}
+}
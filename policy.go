@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/tls"
+	"math"
+	"net"
+	"net/http"
+	"time"
+)
+
+// PolicyRequest describes a real or hypothetical proxy request that is
+// evaluated against the access rules.
+type PolicyRequest struct {
+	Username string    `json:"user"`
+	Host     string    `json:"host"`
+	Port     string    `json:"port"`
+	ClientIP string    `json:"client_ip"`
+	Time     time.Time `json:"time"`
+	// Resumed is set when the TLS session was resumed rather than
+	// established with a full handshake
+	Resumed bool `json:"resumed"`
+	// Tier is the service tier named by the client certificate
+	Tier string `json:"tier,omitempty"`
+}
+
+// newPolicyRequest builds a PolicyRequest from an incoming proxy request
+func newPolicyRequest(r *http.Request, username string) PolicyRequest {
+	host, port := r.URL.Hostname(), r.URL.Port()
+	if host == "" {
+		host = r.Host
+		if h, p, err := net.SplitHostPort(r.Host); err == nil {
+			host, port = h, p
+		}
+	}
+	if port == "" {
+		port = "443"
+	}
+
+	clientIP := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientIP = h
+	}
+
+	return PolicyRequest{
+		Username: username,
+		Host:     host,
+		Port:     port,
+		ClientIP: clientIP,
+		Time:     time.Now(),
+		Resumed:  r.TLS != nil && r.TLS.DidResume,
+		Tier:     requestTier(r),
+	}
+}
+
+// PolicyCheck is the outcome of a single rule evaluation.
+type PolicyCheck struct {
+	Rule    string `json:"rule"`
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+	Code    string `json:"code,omitempty"` // machine-readable reason sent to blocked clients
+	Status  int    `json:"-"`              // HTTP status used when the check blocks a request
+	// RetryAfter, if set, is sent as the Retry-After header (seconds)
+	RetryAfter int `json:"-"`
+}
+
+// PolicyDecision is the combined result of all checks. Allowed is false if
+// any check blocks the request; Blocking points at the first such check.
+type PolicyDecision struct {
+	Allowed  bool          `json:"allowed"`
+	Checks   []PolicyCheck `json:"checks"`
+	Blocking *PolicyCheck  `json:"blocking,omitempty"`
+}
+
+// PolicyEngine evaluates the access rules that apply to authenticated proxy
+// requests. The same evaluation backs both enforcement in ServeHTTP and the
+// dry-run simulation endpoint.
+type PolicyEngine struct {
+	Config       *Config
+	StatsManager *StatsManager
+	StatsDB      *StatsDB
+	Maintenance  *MaintenanceMode
+	ServingHours *ServingHours
+	Protocols    *ProtocolPolicy // checked on the tunnel's first bytes
+	Trials       *TrialAccounts
+	Reputation   *ReputationFeeds // destination IP/domain feeds
+	DNSBL        *DNSBL           // client address blocklists
+	Gate         *KnockGate       // knock checked before authentication
+	// Bytes a single tunnel may carry, enforced while it is open
+	TransferLimits *TunnelTransferLimits
+	// Limit bundles assigned by client certificate
+	Tiers *ServiceTiers
+	// Bandwidth each user's tunnels share, enforced while they are open
+	RateLimits *UserRateLimits
+	// Bandwidth of tunnels to targets in some countries
+	CountryLimits *CountryRateLimits
+	// Traffic per day, week or month set for users through the API
+	Quotas *UserQuotas
+	// Groups whose rate limits, quotas and serving hours members inherit
+	Groups *UserGroups
+	// Allow and deny rules for target hosts
+	ACL *DomainACL
+}
+
+// NewPolicyEngine creates a policy engine
+func NewPolicyEngine(config *Config, statsManager *StatsManager, statsDB *StatsDB) *PolicyEngine {
+	groups := NewUserGroups(config, statsDB)
+	return &PolicyEngine{
+		Config:         config,
+		StatsManager:   statsManager,
+		StatsDB:        statsDB,
+		Maintenance:    NewMaintenanceMode(config),
+		ServingHours:   NewServingHours(config),
+		Protocols:      NewProtocolPolicy(config),
+		Trials:         NewTrialAccounts(config, statsDB),
+		Reputation:     NewReputationFeeds(config),
+		DNSBL:          NewDNSBL(config),
+		Gate:           NewKnockGate(config),
+		TransferLimits: NewTunnelTransferLimits(config),
+		Tiers:          NewServiceTiers(config),
+		RateLimits:     NewUserRateLimits(config, groups),
+		CountryLimits:  NewCountryRateLimits(config, statsDB),
+		Quotas:         NewUserQuotas(config, statsDB, groups),
+		Groups:         groups,
+		ACL:            NewDomainACL(config, statsDB, groups),
+	}
+}
+
+// Evaluate runs every rule against req and records why each one allowed or
+// blocked it. All rules are evaluated even after one blocks, so simulations
+// show the full picture.
+func (e *PolicyEngine) Evaluate(req PolicyRequest) PolicyDecision {
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+
+	decision := PolicyDecision{Allowed: true}
+	for _, rule := range []func(PolicyRequest) PolicyCheck{
+		e.checkUserStatus,
+		e.checkMaintenance,
+		e.checkServingHours,
+		e.checkTrial,
+		e.checkTier,
+		e.checkQuota,
+		e.checkACL,
+		e.checkReputation,
+		e.checkDNSBL,
+	} {
+		decision.Checks = append(decision.Checks, rule(req))
+	}
+
+	for i := range decision.Checks {
+		if !decision.Checks[i].Allowed {
+			decision.Allowed = false
+			decision.Blocking = &decision.Checks[i]
+			break
+		}
+	}
+	return decision
+}
+
+// TLSConfig applies the checks made during the TLS handshake, DNSBL
+// reauthentication and the knock gate, to base. Each listener applies them
+// to its own config: the configs they pick per client derive from base,
+// so later changes to a copy of the result would be lost.
+func (e *PolicyEngine) TLSConfig(base *tls.Config) *tls.Config {
+	if e == nil {
+		return base
+	}
+	return e.Gate.TLSConfig(e.DNSBL.TLSConfig(base))
+}
+
+// reached reports whether the checks before rule all allowed the request,
+// so that rule took part in the decision
+func (d PolicyDecision) reached(rule string) bool {
+	for _, c := range d.Checks {
+		if c.Rule == rule {
+			return true
+		}
+		if !c.Allowed {
+			return false
+		}
+	}
+	return false
+}
+
+// checkUserStatus blocks disabled users (checks the new DB first, then legacy)
+func (e *PolicyEngine) checkUserStatus(req PolicyRequest) PolicyCheck {
+	check := PolicyCheck{Rule: "user_status", Allowed: true}
+
+	disabled := false
+	if e.StatsDB != nil {
+		disabled = e.StatsDB.IsUserDisabled(req.Username)
+	} else if e.StatsManager != nil {
+		disabled = e.StatsManager.IsUserDisabled(req.Username)
+	}
+	if disabled {
+		check.Allowed = false
+		check.Reason = "Access denied: Your account has been disabled"
+		check.Code = ErrCodeUserDisabled
+		check.Status = http.StatusForbidden
+	}
+	return check
+}
+
+// checkMaintenance blocks new connections from non-exempt users while
+// maintenance mode is active at the request time
+func (e *PolicyEngine) checkMaintenance(req PolicyRequest) PolicyCheck {
+	check := PolicyCheck{Rule: "maintenance", Allowed: true}
+	if e.Maintenance == nil || e.Maintenance.IsExempt(req.Username) {
+		return check
+	}
+	if st := e.Maintenance.Status(req.Time); st.Active {
+		check.Allowed = false
+		check.Reason = st.Message
+		check.Code = ErrCodeMaintenance
+		check.Status = http.StatusServiceUnavailable
+		check.RetryAfter = st.RetryAfter
+	}
+	return check
+}
+
+// checkServingHours blocks new connections from non-exempt users during a
+// configured curfew. A group's serving hours replace the server-wide ones
+// for its members.
+func (e *PolicyEngine) checkServingHours(req PolicyRequest) PolicyCheck {
+	check := PolicyCheck{Rule: "serving_hours", Allowed: true}
+	hours := e.ServingHours
+	if groupHours, _, ok := e.Groups.ServingHours(req.Username); ok {
+		hours = groupHours
+	}
+	if hours == nil || hours.IsExempt(req.Username) || e.ServingHours.IsExempt(req.Username) {
+		return check
+	}
+	if closed, until := hours.Closed(req.Time); closed {
+		check.Allowed = false
+		check.Reason = hours.message
+		check.Code = ErrCodeOutsideHours
+		check.Status = http.StatusServiceUnavailable
+		check.RetryAfter = int(math.Ceil(until.Sub(req.Time).Seconds()))
+	}
+	return check
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicyEngine_UserStatus(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+
+	engine := NewPolicyEngine(&Config{}, nil, db)
+
+	decision := engine.Evaluate(PolicyRequest{Username: "alice", Host: "example.com", Port: "443"})
+	if !decision.Allowed {
+		t.Fatalf("alice should be allowed, blocked by %+v", decision.Blocking)
+	}
+
+	db.SetUserDisabled("alice", true)
+	decision = engine.Evaluate(PolicyRequest{Username: "alice", Host: "example.com", Port: "443"})
+	if decision.Allowed {
+		t.Fatal("disabled alice should be blocked")
+	}
+	if decision.Blocking == nil || decision.Blocking.Rule != "user_status" {
+		t.Errorf("Blocking = %+v, want user_status", decision.Blocking)
+	}
+}
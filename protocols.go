@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Protocols recognised in the first bytes a client sends through a tunnel
+const (
+	ProtoTLS     = "tls"
+	ProtoSSH     = "ssh"
+	ProtoHTTP    = "http"
+	ProtoUnknown = "unknown"
+	ProtoNone    = "none" // nothing was sent before the sniff timeout
+	// BitTorrent peer handshake or plaintext tracker request
+	ProtoBitTorrent = "bittorrent"
+)
+
+// sniffBytes is how much of the client's first data is inspected, and
+// sniffMinBytes how much is enough unless it may start a longer signature
+const (
+	sniffBytes    = 16
+	sniffMinBytes = 8
+)
+
+// bitTorrentPrefixes start BitTorrent handshakes and tracker requests
+var bitTorrentPrefixes = [][]byte{
+	[]byte("\x13BitTorrent"), []byte("GET /announce"), []byte("GET /scrape"),
+}
+
+// defaultSniffTimeout bounds the wait for the client's first bytes
+const defaultSniffTimeout = 10 * time.Second
+
+// httpMethodPrefixes are the first bytes of plaintext HTTP/1.x requests and
+// of the HTTP/2 cleartext preface
+var httpMethodPrefixes = [][]byte{
+	[]byte("GET "), []byte("POST"), []byte("HEAD"), []byte("PUT "), []byte("DELE"),
+	[]byte("OPTI"), []byte("PATC"), []byte("CONN"), []byte("TRAC"), []byte("PRI "),
+}
+
+// sniffProtocol classifies the first bytes of a tunnel
+func sniffProtocol(b []byte) string {
+	switch {
+	case len(b) == 0:
+		return ProtoNone
+	// TLS handshake record, SSL 3.0 to TLS 1.3 record versions
+	case len(b) >= 3 && b[0] == 0x16 && b[1] == 0x03 && b[2] <= 0x04:
+		return ProtoTLS
+	case bytes.HasPrefix(b, []byte("SSH-")):
+		return ProtoSSH
+	}
+	for _, m := range bitTorrentPrefixes {
+		if bytes.HasPrefix(b, m) {
+			return ProtoBitTorrent
+		}
+	}
+	for _, m := range httpMethodPrefixes {
+		if bytes.HasPrefix(b, m) {
+			return ProtoHTTP
+		}
+	}
+	return ProtoUnknown
+}
+
+// sniffClient reads the start of what the client sends on conn through r
+// (a counting wrapper of conn), waiting at most timeout. The bytes read must
+// be forwarded ahead of the rest of the stream.
+func sniffClient(conn net.Conn, r io.Reader, timeout time.Duration) ([]byte, string) {
+	buf := make([]byte, sniffBytes)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	n := 0
+	for !sniffComplete(buf[:n]) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			break
+		}
+	}
+	return buf[:n], sniffProtocol(buf[:n])
+}
+
+// sniffComplete reports whether b is enough to classify a tunnel
+func sniffComplete(b []byte) bool {
+	if len(b) >= sniffBytes {
+		return true
+	}
+	if len(b) < sniffMinBytes {
+		return false
+	}
+	for _, m := range bitTorrentPrefixes {
+		if len(b) < len(m) && bytes.HasPrefix(m, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// ProtocolsConfig restricts what selected users may tunnel
+type ProtocolsConfig struct {
+	TLSOnlyUsers        []string  `json:"tls_only_users"`        // Users or CN patterns whose tunnels must start with a TLS ClientHello
+	Allowed             []string  `json:"allowed"`               // Protocols accepted besides TLS for those users, e.g. ["ssh"]
+	Ports               []string  `json:"ports"`                 // Target ports enforced (default ["443"]; ["*"] for all)
+	SniffTimeoutSeconds int       `json:"sniff_timeout_seconds"` // Wait for the client's first bytes (default 10)
+	SSH                 SSHConfig `json:"ssh"`                   // SSH-over-proxy policy, on any port
+	P2P                 P2PConfig `json:"p2p"`                   // BitTorrent / P2P heuristics and actions
+}
+
+// SSH policy actions
+const (
+	SSHPermit = "permit"
+	SSHBlock  = "block"
+	SSHLimit  = "limit" // at most max_sessions_per_hour
+)
+
+// SSHConfig decides what happens to tunnels carrying SSH
+type SSHConfig struct {
+	Default            string            `json:"default"`               // Action for users not listed (default permit)
+	Users              map[string]string `json:"users"`                 // Action per user or CN pattern
+	MaxSessionsPerHour int               `json:"max_sessions_per_hour"` // Sessions allowed by "limit" (default 10)
+}
+
+// ProtocolPolicy enforces proxy.protocols on open tunnels
+type ProtocolPolicy struct {
+	tlsOnly *userPatterns
+	allowed map[string]bool
+	ports   map[string]bool
+	timeout time.Duration
+
+	sshDefault  string
+	sshUsers    *userPatterns
+	sshActions  map[string]string // by sshUsers entry
+	sshPerHour  int
+	sshSessions map[string][]time.Time // starts of "limit" users' sessions in the last hour
+
+	p2p *p2pDetector
+
+	mu         sync.Mutex
+	violations map[[2]string]uint64 // by rule and detected protocol
+}
+
+// NewProtocolPolicy parses proxy.protocols; it returns nil if no user is
+// restricted
+func NewProtocolPolicy(config *Config) *ProtocolPolicy {
+	pc := config.Proxy.Protocols
+	p2p := newP2PDetector(pc.P2P)
+	if len(pc.TLSOnlyUsers) == 0 && (pc.SSH.Default == "" || pc.SSH.Default == SSHPermit) && len(pc.SSH.Users) == 0 && p2p == nil {
+		return nil
+	}
+	pp := &ProtocolPolicy{
+		allowed:     map[string]bool{ProtoTLS: true},
+		ports:       make(map[string]bool),
+		timeout:     time.Duration(pc.SniffTimeoutSeconds) * time.Second,
+		sshDefault:  SSHPermit,
+		sshActions:  make(map[string]string),
+		sshPerHour:  pc.SSH.MaxSessionsPerHour,
+		sshSessions: make(map[string][]time.Time),
+		p2p:         p2p,
+		violations:  make(map[[2]string]uint64),
+	}
+	var err error
+	if pp.tlsOnly, err = newUserPatterns(pc.TLSOnlyUsers); err != nil {
+		log.Printf("Protocols tls_only_users: %v", err)
+	}
+	if validSSHAction(pc.SSH.Default) {
+		pp.sshDefault = pc.SSH.Default
+	} else if pc.SSH.Default != "" {
+		log.Printf("Protocols ssh.default: unknown action %q, using permit", pc.SSH.Default)
+	}
+	var entries []string
+	for entry, action := range pc.SSH.Users {
+		if !validSSHAction(action) {
+			log.Printf("Protocols ssh.users: unknown action %q for %s, ignored", action, entry)
+			continue
+		}
+		entries = append(entries, entry)
+		pp.sshActions[entry] = action
+	}
+	if pp.sshUsers, err = newUserPatterns(entries); err != nil {
+		log.Printf("Protocols ssh.users: %v", err)
+	}
+	if pp.sshPerHour <= 0 {
+		pp.sshPerHour = 10
+	}
+	for _, proto := range pc.Allowed {
+		pp.allowed[proto] = true
+	}
+	ports := pc.Ports
+	if len(ports) == 0 {
+		ports = []string{"443"}
+	}
+	for _, port := range ports {
+		pp.ports[port] = true
+	}
+	if pp.timeout <= 0 {
+		pp.timeout = defaultSniffTimeout
+	}
+
+	metrics.Collect("https_proxy_protocol_violations_total", "Tunnels closed by the protocol policy, by rule and detected protocol.", "counter", func() []MetricSample {
+		pp.mu.Lock()
+		defer pp.mu.Unlock()
+		keys := make([][2]string, 0, len(pp.violations))
+		for key := range pp.violations {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i][0]+"/"+keys[i][1] < keys[j][0]+"/"+keys[j][1]
+		})
+		samples := make([]MetricSample, 0, len(keys))
+		for _, key := range keys {
+			samples = append(samples, MetricSample{Labels: map[string]string{"rule": key[0], "protocol": key[1]}, Value: float64(pp.violations[key])})
+		}
+		return samples
+	})
+	return pp
+}
+
+func validSSHAction(action string) bool {
+	return action == SSHPermit || action == SSHBlock || action == SSHLimit
+}
+
+// tlsOnlyFor reports whether username's tunnels to port must carry TLS
+func (pp *ProtocolPolicy) tlsOnlyFor(username, port string) bool {
+	if !(pp.ports["*"] || pp.ports[port]) {
+		return false
+	}
+	_, ok := pp.tlsOnly.Match(username)
+	return ok
+}
+
+// sshAction returns the SSH policy action that applies to username
+func (pp *ProtocolPolicy) sshAction(username string) string {
+	if entry, ok := pp.sshUsers.Match(username); ok {
+		return pp.sshActions[entry]
+	}
+	return pp.sshDefault
+}
+
+// Enforced reports whether the tunnel of username to port must be sniffed
+func (pp *ProtocolPolicy) Enforced(username, port string) bool {
+	if pp == nil {
+		return false
+	}
+	return pp.tlsOnlyFor(username, port) || pp.sshAction(username) != SSHPermit || pp.p2p.Sniffs(username)
+}
+
+// ObserveP2P feeds a tunnel to the P2P heuristics, see p2pDetector.Observe
+func (pp *ProtocolPolicy) ObserveP2P(username, host, port, proto string, now time.Time) (string, *P2PFlag) {
+	if pp == nil || pp.p2p == nil {
+		return "", nil
+	}
+	return pp.p2p.Observe(username, host, port, proto, now)
+}
+
+// P2PFlagged returns the users currently flagged for likely P2P traffic
+func (pp *ProtocolPolicy) P2PFlagged(now time.Time) []P2PFlag {
+	if pp == nil {
+		return nil
+	}
+	return pp.p2p.Flagged(now)
+}
+
+// Check decides whether a tunnel that starts with proto may continue. It
+// returns the rule that closes it ("tls_only" or "ssh") and why.
+func (pp *ProtocolPolicy) Check(username, port, proto string, now time.Time) (rule, reason string) {
+	switch {
+	case pp.tlsOnlyFor(username, port) && !pp.allowed[proto]:
+		rule, reason = "tls_only", proto+" is not allowed for TLS-only users"
+	case proto == ProtoSSH && pp.sshAction(username) == SSHBlock:
+		rule, reason = "ssh", "SSH is blocked"
+	case proto == ProtoSSH && pp.sshAction(username) == SSHLimit && !pp.takeSSHSession(username, now):
+		rule, reason = "ssh", fmt.Sprintf("more than %d SSH sessions in the last hour", pp.sshPerHour)
+	default:
+		return "", ""
+	}
+	pp.mu.Lock()
+	pp.violations[[2]string{rule, proto}]++
+	pp.mu.Unlock()
+	return rule, reason
+}
+
+// takeSSHSession counts a new SSH session of a "limit" user, reporting
+// false if the hourly allowance is used up
+func (pp *ProtocolPolicy) takeSSHSession(username string, now time.Time) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	cutoff := now.Add(-time.Hour)
+	recent := pp.sshSessions[username][:0]
+	for _, t := range pp.sshSessions[username] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= pp.sshPerHour {
+		pp.sshSessions[username] = recent
+		return false
+	}
+	pp.sshSessions[username] = append(recent, now)
+	return true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSniffProtocol(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want string
+	}{
+		{[]byte{0x16, 0x03, 0x01, 0x02, 0x00}, ProtoTLS},
+		{[]byte{0x16, 0x03, 0x07}, ProtoUnknown},
+		{[]byte("SSH-2.0-OpenSSH_9.6"), ProtoSSH},
+		{[]byte("GET / HTTP/1.1\r\n"), ProtoHTTP},
+		{[]byte("PRI * HTTP/2.0"), ProtoHTTP},
+		{[]byte("EHLO mail"), ProtoUnknown},
+		{nil, ProtoNone},
+	}
+	for _, tt := range tests {
+		if got := sniffProtocol(tt.data); got != tt.want {
+			t.Errorf("sniffProtocol(%q) = %s, want %s", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestSniffClient(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte("SSH-2.0-client\r\n"))
+	head, proto := sniffClient(server, server, time.Second)
+	if proto != ProtoSSH || string(head) != "SSH-2.0-client\r\n" {
+		t.Errorf("sniffed %q as %s", head, proto)
+	}
+
+	// A client that sends less than a full sniff waits for the timeout
+	client, server = net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte{0x16, 0x03})
+	start := time.Now()
+	head, proto = sniffClient(server, server, 50*time.Millisecond)
+	if len(head) != 2 || proto != ProtoUnknown || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("short read: %q as %s after %s", head, proto, time.Since(start))
+	}
+}
+
+func TestProtocolPolicy(t *testing.T) {
+	cfg := &Config{}
+	if NewProtocolPolicy(cfg) != nil {
+		t.Fatal("policy without restrictions should be nil")
+	}
+	cfg.Proxy.Protocols = ProtocolsConfig{TLSOnlyUsers: []string{"ci-*"}, Allowed: []string{ProtoSSH}}
+	pp := NewProtocolPolicy(cfg)
+	now := time.Now()
+
+	if !pp.Enforced("ci-build", "443") || pp.Enforced("ci-build", "22") || pp.Enforced("alice", "443") {
+		t.Error("enforced for the wrong users or ports")
+	}
+	for proto, closed := range map[string]bool{ProtoTLS: false, ProtoSSH: false, ProtoHTTP: true, ProtoNone: true} {
+		if rule, _ := pp.Check("ci-build", "443", proto, now); (rule == "tls_only") != closed {
+			t.Errorf("%s: rule = %q", proto, rule)
+		}
+	}
+	if pp.violations[[2]string{"tls_only", ProtoHTTP}] != 1 || pp.violations[[2]string{"tls_only", ProtoNone}] != 1 {
+		t.Errorf("violations = %v", pp.violations)
+	}
+}
+
+func TestProtocolPolicy_SSH(t *testing.T) {
+	cfg := &Config{}
+	cfg.Proxy.Protocols.SSH = SSHConfig{
+		Default:            SSHLimit,
+		Users:              map[string]string{"ops-*": SSHPermit, "guest": SSHBlock, "bob": "maybe"},
+		MaxSessionsPerHour: 2,
+	}
+	pp := NewProtocolPolicy(cfg)
+	if pp == nil {
+		t.Fatal("SSH policy should not be nil")
+	}
+	if pp.Enforced("ops-1", "22") || !pp.Enforced("guest", "22") || !pp.Enforced("bob", "8022") {
+		t.Error("enforced for the wrong users")
+	}
+	now := time.Now()
+	if rule, _ := pp.Check("guest", "22", ProtoSSH, now); rule != "ssh" {
+		t.Errorf("blocked user: rule = %q", rule)
+	}
+	if rule, _ := pp.Check("guest", "443", ProtoTLS, now); rule != "" {
+		t.Errorf("blocked user's TLS tunnel closed by %q", rule)
+	}
+
+	// "limit" allows max_sessions_per_hour sessions in any hour
+	for i, want := range []string{"", "", "ssh"} {
+		if rule, _ := pp.Check("alice", "22", ProtoSSH, now.Add(time.Duration(i)*time.Minute)); rule != want {
+			t.Errorf("session %d: rule = %q, want %q", i+1, rule, want)
+		}
+	}
+	if rule, _ := pp.Check("alice", "22", ProtoSSH, now.Add(61*time.Minute)); rule != "" {
+		t.Errorf("session after the first expired: rule = %q", rule)
+	}
+	if rule, _ := pp.Check("bob", "22", ProtoSSH, now); rule != "" {
+		t.Errorf("invalid action should fall back to the default: rule = %q", rule)
+	}
+	if pp.violations[[2]string{"ssh", ProtoSSH}] != 2 {
+		t.Errorf("violations = %v", pp.violations)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ProvisioningConfig enables QR-code provisioning of mobile clients: the
+// admin API shows a QR code with the connection settings and a one-time
+// link from which the phone downloads a freshly issued certificate bundle
+type ProvisioningConfig struct {
+	Enabled    bool   `json:"enabled"`
+	PublicURL  string `json:"public_url"`  // Base URL phones reach the proxy on (default https://<host>:<server.port>)
+	TTLMinutes int    `json:"ttl_minutes"` // How long an unused link stays valid (default 15)
+	CertDays   int    `json:"cert_days"`   // Validity of the issued certificate (default 365)
+	CAKeyPath  string `json:"ca_key_path"` // CA private key issuing the certificates (default ca.key next to the CA certificate)
+}
+
+// provisionPath is where the proxy serves the one-time bundle downloads;
+// other paths, and unknown or used tokens, get the camouflage site
+const provisionPath = "/provision/"
+
+// provisionLink is a one-time bundle download waiting to be used
+type provisionLink struct {
+	username string
+	password string
+	expires  time.Time
+}
+
+// ProvisionLink is a new one-time download and the QR payload carrying it
+type ProvisionLink struct {
+	Username  string    `json:"username"`
+	URL       string    `json:"url"`
+	Password  string    `json:"password"` // Protects the PKCS#12 bundle
+	ExpiresAt time.Time `json:"expires_at"`
+	// Payload is encoded in the QR code:
+	// https-proxy://<user>@<host>:<port>?bundle=<url>&password=<password>
+	Payload string `json:"payload"`
+}
+
+// Provisioner hands out one-time certificate bundle downloads
+type Provisioner struct {
+	config    *Config
+	ttl       time.Duration
+	downloads atomic.Int64
+
+	mu    sync.Mutex
+	links map[string]provisionLink // by token
+}
+
+// provisioner is the process-wide provisioner, nil unless
+// provisioning.enabled is set
+var provisioner *Provisioner
+
+// NewProvisioner returns nil when provisioning is disabled
+func NewProvisioner(config *Config) *Provisioner {
+	pc := config.Provisioning
+	if !pc.Enabled {
+		return nil
+	}
+	p := &Provisioner{
+		config: config,
+		ttl:    time.Duration(firstPositive(pc.TTLMinutes, 15)) * time.Minute,
+		links:  make(map[string]provisionLink),
+	}
+	metrics.Counter("https_proxy_provisioning_downloads_total", "Certificate bundles downloaded through one-time provisioning links.", func() float64 {
+		return float64(p.downloads.Load())
+	})
+	return p
+}
+
+// Create makes a one-time link for username's bundle. host is the proxy
+// host phones connect to.
+func (p *Provisioner) Create(username, host string, now time.Time) (*ProvisionLink, error) {
+	token, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	password, err := randomHex(6)
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(p.config.Server.Port))
+	base := strings.TrimSuffix(p.config.Provisioning.PublicURL, "/")
+	if base == "" {
+		base = "https://" + addr
+	}
+	link := &ProvisionLink{
+		Username:  username,
+		URL:       base + provisionPath + token,
+		Password:  password,
+		ExpiresAt: now.Add(p.ttl),
+	}
+	link.Payload = (&url.URL{
+		Scheme:   "https-proxy",
+		User:     url.User(username),
+		Host:     addr,
+		RawQuery: url.Values{"bundle": {link.URL}, "password": {password}}.Encode(),
+	}).String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for t, l := range p.links {
+		if now.After(l.expires) {
+			delete(p.links, t)
+		}
+	}
+	p.links[token] = provisionLink{username: username, password: password, expires: link.ExpiresAt}
+	return link, nil
+}
+
+// redeem returns the link of token and removes it, so it works only once
+func (p *Provisioner) redeem(token string, now time.Time) (provisionLink, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.links[token]
+	if !ok {
+		return provisionLink{}, false
+	}
+	delete(p.links, token)
+	return l, now.Before(l.expires)
+}
+
+// ServeBundle serves a one-time bundle download and reports whether r was
+// one. The certificate is issued at download time, so no key is kept while
+// the link waits.
+func (p *Provisioner) ServeBundle(w http.ResponseWriter, r *http.Request) bool {
+	if p == nil || r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, provisionPath) {
+		return false
+	}
+	link, ok := p.redeem(strings.TrimPrefix(r.URL.Path, provisionPath), time.Now())
+	if !ok {
+		return false
+	}
+
+	caPath := p.config.Server.Certificates.CAPath
+	keyPath := p.config.Provisioning.CAKeyPath
+	if keyPath == "" {
+		keyPath = filepath.Join(filepath.Dir(caPath), "ca.key")
+	}
+	p12, err := func() ([]byte, error) {
+		ca, caKey, err := LoadCA(caPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("load CA: %w", err)
+		}
+		issued, err := IssueCert(ca, caKey, CertRequest{
+			CommonName:  link.username,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			Validity:    time.Duration(firstPositive(p.config.Provisioning.CertDays, 365)) * 24 * time.Hour,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := appendCALog(caLogPath(caPath), issued.Cert, CALogProvisioning, "", time.Now()); err != nil {
+			return nil, err
+		}
+		return pkcs12.Modern.Encode(issued.Key, issued.Cert, []*x509.Certificate{ca}, link.password)
+	}()
+	if err != nil {
+		log.Printf("[req %s] Provisioning bundle for %s: %v", requestID(r), link.username, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return true
+	}
+
+	p.downloads.Add(1)
+	log.Printf("[req %s] Provisioning bundle for %s downloaded from %s", requestID(r), link.username, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/x-pkcs12")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", link.username+".p12"))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(p12)
+	return true
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// handleProvision serves /api/v2/users/{name}/provision.png: a QR code
+// with a new one-time link, valid until the X-Provision-Expires time, or
+// the link itself with ?format=json
+func handleProvision(w http.ResponseWriter, r *http.Request, cfg *Config, p *Provisioner, username string) {
+	if r.Method != http.MethodGet {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+	if p == nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Provisioning is not enabled"}, http.StatusNotFound)
+		return
+	}
+	link, err := p.Create(username, clientConfigHost(cfg, r), time.Now())
+	if err != nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Provisioning link for %s created by %s, expires %s", username, adminName(r), link.ExpiresAt.Format(time.RFC3339))
+	if r.URL.Query().Get("format") == "json" {
+		writeJSONResponse(w, WebResponse{Success: true, Data: link}, http.StatusOK)
+		return
+	}
+	q, err := encodeQR([]byte(link.Payload))
+	if err != nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	img, err := q.PNG(8)
+	if err != nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Provision-Expires", link.ExpiresAt.UTC().Format(time.RFC3339))
+	w.Write(img)
+}
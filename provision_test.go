@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestProvisioner_OneTimeBundle(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := GenerateCA("Test CA", 365*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.WriteFiles(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{}
+	cfg.Server.Port = 8443
+	cfg.Server.Certificates.CAPath = filepath.Join(dir, "ca.pem")
+	cfg.Provisioning = ProvisioningConfig{Enabled: true, CertDays: 30}
+	p := NewProvisioner(cfg)
+
+	now := time.Now()
+	link, err := p.Create("alice", "proxy.example.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := url.Parse(link.Payload)
+	if err != nil || payload.User.Username() != "alice" || payload.Host != "proxy.example.com:8443" ||
+		payload.Query().Get("bundle") != link.URL || payload.Query().Get("password") != link.Password {
+		t.Fatalf("payload = %q (%v)", link.Payload, err)
+	}
+	path := strings.TrimPrefix(link.URL, "https://proxy.example.com:8443")
+
+	rec := httptest.NewRecorder()
+	if !p.ServeBundle(rec, httptest.NewRequest(http.MethodGet, path, nil)) || rec.Code != http.StatusOK {
+		t.Fatalf("download: %d %s", rec.Code, rec.Body)
+	}
+	_, cert, _, err := pkcs12.DecodeChain(rec.Body.Bytes(), link.Password)
+	if err != nil {
+		t.Fatalf("decode bundle: %v", err)
+	}
+	if cert.Subject.CommonName != "alice" || cert.NotAfter.Sub(now) > 31*24*time.Hour {
+		t.Errorf("cert CN %q, expires %s", cert.Subject.CommonName, cert.NotAfter)
+	}
+
+	// The link works once; expired and unknown tokens fall through to the
+	// camouflage site
+	if p.ServeBundle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil)) {
+		t.Error("link served twice")
+	}
+	expired, _ := p.Create("bob", "proxy.example.com", now.Add(-time.Hour))
+	if p.ServeBundle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, strings.TrimPrefix(expired.URL, "https://proxy.example.com:8443"), nil)) {
+		t.Error("expired link served")
+	}
+	if p.ServeBundle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/index.html", nil)) {
+		t.Error("ordinary request taken for a download")
+	}
+	var disabled *Provisioner
+	if disabled.ServeBundle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil)) {
+		t.Error("disabled provisioner served a download")
+	}
+}
+
+func TestV2API_ProvisionQR(t *testing.T) {
+	cfg := &Config{}
+	cfg.Server.Port = 8443
+	cfg.Provisioning = ProvisioningConfig{Enabled: true, PublicURL: "https://get.example.com/"}
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, nil, nil, nil)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/users/alice/provision.png", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("disabled: status %d", rec.Code)
+	}
+
+	provisioner = NewProvisioner(cfg)
+	defer func() { provisioner = nil }()
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/users/alice/provision.png", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" || rec.Header().Get("X-Provision-Expires") == "" {
+		t.Fatalf("QR: %d %v", rec.Code, rec.Header())
+	}
+	if !strings.HasPrefix(rec.Body.String(), "\x89PNG") {
+		t.Error("body is not a PNG")
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/users/alice/provision.png?format=json&host=proxy.example.com", nil))
+	var resp struct {
+		Data ProvisionLink `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if !strings.HasPrefix(resp.Data.URL, "https://get.example.com/provision/") || !strings.Contains(resp.Data.Payload, "@proxy.example.com:8443") {
+		t.Errorf("link = %+v", resp.Data)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyAuthConfig lets clients that cannot present a certificate, but
+// follow the standard proxy login, log in with Basic credentials: their
+// CONNECT requests without a certificate are answered with 407 Proxy
+// Authentication Required rather than refused.
+type ProxyAuthConfig struct {
+	Enabled bool `json:"enabled"`
+	// Port of a listener of its own in this mode, on
+	// server.bind_addresses. 0 puts the main listener in it, which tells
+	// anyone sending a CONNECT that it is a proxy.
+	Port  int    `json:"port"`
+	TLS   bool   `json:"tls"`   // Serve port over TLS with the server certificate; plain HTTP otherwise
+	Realm string `json:"realm"` // Sent in the challenge (default "proxy")
+	// Users log in with a name and password. Over a listener without TLS
+	// the password crosses the network in the clear.
+	Users []ProxyAuthUserConfig `json:"users"`
+}
+
+// ProxyAuthUserConfig is a Basic login, a virtual user the tunnels count
+// towards as a certificate CN does
+type ProxyAuthUserConfig struct {
+	Name           string `json:"name"`
+	PasswordBcrypt string `json:"password_bcrypt"` // bcrypt hash of the password; the password itself is not stored
+	// Quota applies when the user has none set through the API; it needs
+	// stats.enabled
+	Quota *GroupQuotaConfig `json:"quota,omitempty"`
+}
+
+// ProxyAuth checks the Basic credentials of CONNECT requests on the
+// listeners in the compatibility mode
+type ProxyAuth struct {
+	port  int
+	tls   bool
+	realm string
+	users *passwordLogins
+
+	accepted atomic.Uint64
+	failed   atomic.Uint64
+}
+
+// NewProxyAuth returns nil unless server.proxy_auth is enabled with users
+func NewProxyAuth(config *Config) *ProxyAuth {
+	pc := config.Server.ProxyAuth
+	if !pc.Enabled {
+		return nil
+	}
+	a := &ProxyAuth{
+		port:  pc.Port,
+		tls:   pc.TLS,
+		realm: pc.Realm,
+		users: newPasswordLogins(),
+	}
+	if a.realm == "" {
+		a.realm = "proxy"
+	}
+	for _, u := range pc.Users {
+		if !a.users.Add(u.Name, u.PasswordBcrypt) {
+			log.Printf("server.proxy_auth.users %q: needs a name and a bcrypt password_bcrypt, ignored", u.Name)
+		}
+	}
+	if a.users.Len() == 0 {
+		log.Printf("server.proxy_auth: no users to log in; Basic authentication disabled")
+		return nil
+	}
+
+	metrics.Collect("https_proxy_basic_auth_total", "CONNECT requests logging in with Basic credentials, by result.", "counter", func() []MetricSample {
+		return []MetricSample{
+			{Labels: map[string]string{"result": "accepted"}, Value: float64(a.accepted.Load())},
+			{Labels: map[string]string{"result": "failed"}, Value: float64(a.failed.Load())},
+		}
+	})
+	return a
+}
+
+// Port returns the port of the compatibility listener, 0 for the main one
+func (a *ProxyAuth) Port() int {
+	if a == nil {
+		return 0
+	}
+	return a.port
+}
+
+// TLS reports whether the compatibility listener serves TLS
+func (a *ProxyAuth) TLS() bool {
+	return a != nil && a.tls
+}
+
+type proxyAuthKey struct{}
+
+// Handler marks the requests next serves as coming from a listener in the
+// compatibility mode
+func (a *ProxyAuth) Handler(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyAuthKey{}, a)))
+	})
+}
+
+// proxyAuthFor returns the compatibility mode of the listener r came from,
+// nil if it is not in it
+func proxyAuthFor(r *http.Request) *ProxyAuth {
+	a, _ := r.Context().Value(proxyAuthKey{}).(*ProxyAuth)
+	return a
+}
+
+// Login returns the user whose credentials r carries in
+// Proxy-Authorization, or false
+func (a *ProxyAuth) Login(r *http.Request) (string, bool) {
+	if a == nil {
+		return "", false
+	}
+	name, password, ok := parseProxyBasicAuth(r.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return "", false
+	}
+	if !a.users.Check(name, []byte(password)) {
+		a.failed.Add(1)
+		return "", false
+	}
+	a.accepted.Add(1)
+	return name, true
+}
+
+// parseProxyBasicAuth decodes Basic credentials as http.Request.BasicAuth
+// does for Authorization
+func parseProxyBasicAuth(header string) (name, password string, ok bool) {
+	if header == "" {
+		return "", "", false
+	}
+	r := &http.Request{Header: http.Header{"Authorization": {header}}}
+	return r.BasicAuth()
+}
+
+// Challenge answers a CONNECT request without valid credentials
+func (a *ProxyAuth) Challenge(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Proxy-Authenticate", `Basic realm="`+strings.ReplaceAll(a.realm, `"`, "")+`", charset="UTF-8"`)
+	writeProxyError(w, r, http.StatusProxyAuthRequired, ErrCodeProxyAuthRequired, "Proxy authentication required")
+}
+
+// serveBasicConnect opens the tunnel of a CONNECT request without a
+// certificate that logs in with Basic credentials, or challenges the
+// client for them
+func (p *Proxy) serveBasicConnect(w http.ResponseWriter, r *http.Request, auth *ProxyAuth) {
+	reqID := requestID(r)
+	username, ok := auth.Login(r)
+	if !ok {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			log.Printf("[req %s] Basic login failed: %s", reqID, r.RemoteAddr)
+		}
+		auth.Challenge(w, r)
+		p.logRefused(r, "", http.StatusProxyAuthRequired, ErrCodeProxyAuthRequired)
+		return
+	}
+
+	// Tiers come from verified certificates, so a Basic login has none
+	req := newPolicyRequest(r, username)
+	req.Tier = ""
+	decision := p.authorize(reqID, r.RemoteAddr, req, true)
+	if !decision.Allowed {
+		writePolicyError(w, r, decision.Blocking, p.BlockPage)
+		p.logRefused(r, username, decision.Blocking.Status, decision.Blocking.Code)
+		return
+	}
+	p.Policy.Gate.Renew(r.RemoteAddr, time.Now())
+	p.StatsManager.RecordConnection(username)
+	log.Printf("[req %s] Authorized client: %s, user: %s (Basic)", reqID, r.RemoteAddr, username)
+	p.handleConnectWithStats(w, r, username, nil)
+}
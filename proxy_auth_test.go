@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestProxyAuth_BasicConnect(t *testing.T) {
+	// An echo server as the tunnels' target
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+
+	cfg := &Config{}
+	cfg.Stats.Enabled = true
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	cfg.Server.ProxyAuth = ProxyAuthConfig{Enabled: true, Realm: "corp", Users: []ProxyAuthUserConfig{
+		{Name: "printer", PasswordBcrypt: string(hash), Quota: &GroupQuotaConfig{QuotaMB: 10}},
+		{Name: "broken", PasswordBcrypt: "beef"},
+	}}
+	if NewProxyAuth(&Config{}) != nil {
+		t.Error("Basic authentication without proxy_auth")
+	}
+	sm := NewStatsManager(cfg)
+	p := &Proxy{Config: cfg, StatsManager: sm, Policy: NewPolicyEngine(cfg, sm, nil), ProxyAuth: NewProxyAuth(cfg)}
+	if p.ProxyAuth.users.Len() != 1 {
+		t.Fatalf("users = %v", p.ProxyAuth.users)
+	}
+	srv := httptest.NewServer(p.ProxyAuth.Handler(p))
+	defer srv.Close()
+
+	connect := func(credentials string) (net.Conn, *http.Response) {
+		t.Helper()
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		req := "CONNECT " + target.Addr().String() + " HTTP/1.1\r\nHost: " + target.Addr().String() + "\r\n"
+		if credentials != "" {
+			req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)) + "\r\n"
+		}
+		io.WriteString(conn, req+"\r\n")
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, resp
+	}
+
+	for _, credentials := range []string{"", "printer:wrong", "nobody:secret"} {
+		if _, resp := connect(credentials); resp.StatusCode != http.StatusProxyAuthRequired ||
+			resp.Header.Get("Proxy-Authenticate") != `Basic realm="corp", charset="UTF-8"` {
+			t.Errorf("%q: %d %v", credentials, resp.StatusCode, resp.Header)
+		}
+	}
+	conn, resp := connect("printer:secret")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("printer: %d", resp.StatusCode)
+	}
+	io.WriteString(conn, "ping")
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Errorf("echo = %q, %v", got, err)
+	}
+	conn.Close()
+	if s := sm.GetUserStatsByName("printer"); s == nil || s.ConnectionCount != 1 {
+		t.Errorf("printer's stats = %+v", s)
+	}
+
+	// Virtual users are refused like certificate users
+	sm.DisableUser("printer")
+	if _, resp := connect("printer:secret"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("disabled printer: %d", resp.StatusCode)
+	}
+
+	// Listeners not in the mode still want a certificate
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("printer:secret")))
+	p.ServeHTTP(rec, r)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("main listener: %d", rec.Code)
+	}
+
+	// Behind the knock gate, addresses that did not knock get no
+	// challenge
+	gateCfg := &Config{}
+	gateCfg.Gate = GateConfig{Enabled: true, Path: "/knock"}
+	p.Policy.Gate = NewKnockGate(gateCfg)
+	if _, resp := connect(""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("before the knock: %d", resp.StatusCode)
+	}
+	knock := httptest.NewRequest(http.MethodGet, "/knock", nil)
+	knock.RemoteAddr = "127.0.0.1:1"
+	p.Policy.Gate.Knock(knock, time.Now())
+	if _, resp := connect(""); resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("after the knock: %d", resp.StatusCode)
+	}
+	p.Policy.Gate = nil
+
+	// The login's quota applies unless one was set for the user
+	db := newExpiryTestDB(t)
+	quotas := NewUserQuotas(cfg, db, nil)
+	if st, ok := quotas.Status("printer", time.Now()); !ok || st.QuotaBytes != 10<<20 || st.Period != QuotaMonthly || st.SetBy != "proxy_auth" {
+		t.Errorf("printer's quota = %+v, %v", st, ok)
+	}
+	quotas.Set("printer", QuotaDaily, 1<<20, "test", time.Now())
+	if st, _ := quotas.Status("printer", time.Now()); st.QuotaBytes != 1<<20 {
+		t.Errorf("quota set through the API = %+v", st)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error codes sent to clients that presented a certificate
+const (
+	ErrCodeCertExpired        = "cert_expired"
+	ErrCodeCertInvalid        = "cert_invalid"
+	ErrCodeCertRevoked        = "cert_revoked"
+	ErrCodeUserDisabled       = "user_disabled"
+	ErrCodeMaintenance        = "maintenance"
+	ErrCodeOutsideHours       = "outside_serving_hours"
+	ErrCodeInvalidTag         = "invalid_tag"
+	ErrCodeP2PBlocked         = "p2p_blocked"
+	ErrCodeTrialQuota         = "trial_quota_exceeded"
+	ErrCodeTierQuota          = "tier_quota_exceeded"
+	ErrCodeQuotaExceeded      = "quota_exceeded"
+	ErrCodeDestinationBlocked = "destination_blocked"
+	ErrCodeDomainDenied       = "domain_denied"
+	ErrCodeClientBlocklisted  = "client_blocklisted"
+	ErrCodeReauthRequired     = "reauth_required"
+	ErrCodeProxyAuthRequired  = "proxy_auth_required"
+	ErrCodeDialTimeout        = "dial_timeout"
+	ErrCodeDNSFailure         = "dns_failure"
+	ErrCodeDialFailed         = "dial_failed"
+	ErrCodeInternalError      = "internal_error"
+)
+
+// ProxyError is the JSON body of errors generated by the proxy itself.
+// Unauthenticated clients never see it: they get the camouflage site, or
+// a 407 on listeners taking Basic logins.
+type ProxyError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Detail keeps the English message when Message was translated
+	Detail string `json:"detail,omitempty"`
+	// Rule and Contact are set for policy denials
+	Rule      string `json:"rule,omitempty"`
+	Contact   string `json:"contact,omitempty"`
+	RequestID string `json:"request_id"`
+
+	lang string // negotiated from Accept-Language
+}
+
+// newProxyError builds the error for r, translating the message by code
+// into the client's Accept-Language
+func newProxyError(r *http.Request, status int, code, message string) ProxyError {
+	e := ProxyError{Status: status, Code: code, Message: message, RequestID: requestID(r)}
+	e.lang = negotiateLanguage(r.Header.Get("Accept-Language"))
+	if text := translate(e.lang, code); text != "" {
+		e.Message, e.Detail = text, message
+	}
+	return e
+}
+
+// proxyStatusErrors maps error codes to RFC 9209 error types; the others
+// are http_request_denied
+var proxyStatusErrors = map[string]string{
+	ErrCodeDialTimeout:   "connection_timeout",
+	ErrCodeDNSFailure:    "dns_error",
+	ErrCodeDialFailed:    "destination_unavailable",
+	ErrCodeInternalError: "proxy_internal_error",
+}
+
+// proxyStatus returns the RFC 9209 Proxy-Status header value for e, which
+// CONNECT clients that ignore the body can parse
+func (e ProxyError) proxyStatus() string {
+	kind, ok := proxyStatusErrors[e.Code]
+	if !ok {
+		kind = "http_request_denied"
+	}
+	details := e.Message
+	if e.Detail != "" {
+		details = e.Detail
+	}
+	v := "https-proxy; error=" + kind + "; details=" + sfString(details) + "; code=" + sfString(e.Code)
+	if e.Rule != "" {
+		v += "; rule=" + sfString(e.Rule)
+	}
+	return v
+}
+
+// sfString quotes s as a structured field string (RFC 8941), dropping the
+// characters it cannot carry
+func sfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c >= 0x20 && c < 0x7f:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// setHeaders sets the headers of both the JSON error and the block page.
+// The request id is also set as the X-Request-Id header so clients that
+// only read headers (CONNECT) see it.
+func (e ProxyError) setHeaders(h http.Header) {
+	h.Set("Content-Language", e.lang)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("X-Request-Id", e.RequestID)
+	h.Set("Proxy-Status", e.proxyStatus())
+}
+
+// write sends e as JSON
+func (e ProxyError) write(w http.ResponseWriter) {
+	e.setHeaders(w.Header())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// writeProxyError sends a ProxyError
+func writeProxyError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	newProxyError(r, status, code, message).write(w)
+}
+
+// certErrorCode classifies a client certificate verification failure
+func certErrorCode(cert *x509.Certificate, err error, now time.Time) string {
+	if err == errCertRevoked {
+		return ErrCodeCertRevoked
+	}
+	if now.After(cert.NotAfter) {
+		return ErrCodeCertExpired
+	}
+	return ErrCodeCertInvalid
+}
+
+// dialError maps a failure to reach the tunnel target to a status and code
+func dialError(err error) (int, string) {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return http.StatusBadGateway, ErrCodeDNSFailure
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, ErrCodeDialTimeout
+	}
+	return http.StatusBadGateway, ErrCodeDialFailed
+}
+
+// writePolicyError sends the error for a blocking policy check: the block
+// page to browsers, JSON to other clients
+func writePolicyError(w http.ResponseWriter, r *http.Request, check *PolicyCheck, page *BlockPage) {
+	if check.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(check.RetryAfter))
+	}
+	e := newProxyError(r, check.Status, check.Code, check.Reason)
+	e.Rule = check.Rule
+	if page != nil {
+		e.Contact = page.contact
+		if wantsHTML(r) && page.write(w, e, check.RetryAfter) {
+			return
+		}
+	}
+	e.write(w)
+}
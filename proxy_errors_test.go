@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newErrorTestProxy returns a proxy trusting a fresh CA, with alice disabled,
+// and a function issuing client certificates from that CA
+func newErrorTestProxy(t *testing.T) (*Proxy, func(cn string, validity time.Duration) *x509.Certificate) {
+	t.Helper()
+	ca, err := GenerateCA("Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+
+	cfg := &Config{}
+	cfg.Proxy.Tags.Allowed = []string{"ci"}
+	sm := NewStatsManager(cfg)
+	sm.DisableUser("alice")
+	p := &Proxy{Config: cfg, CACertPool: pool, StatsManager: sm, Policy: NewPolicyEngine(cfg, sm, nil)}
+
+	issue := func(cn string, validity time.Duration) *x509.Certificate {
+		c, err := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: cn, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, Validity: validity})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Cert
+	}
+	return p, issue
+}
+
+func TestProxy_StructuredErrors(t *testing.T) {
+	p, issue := newErrorTestProxy(t)
+
+	tests := []struct {
+		name   string
+		cert   *x509.Certificate
+		tag    string
+		status int
+		code   string
+	}{
+		{"expired certificate", issue("bob", -time.Minute), "", http.StatusMethodNotAllowed, ErrCodeCertExpired},
+		{"disabled user", issue("alice", time.Hour), "", http.StatusForbidden, ErrCodeUserDisabled},
+		{"tag not allowed", issue("bob", time.Hour), "other", http.StatusBadRequest, ErrCodeInvalidTag},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tt.cert}}
+		if tt.tag != "" {
+			r.Header.Set("X-Proxy-Tag", tt.tag)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+
+		var e ProxyError
+		if err := json.NewDecoder(w.Body).Decode(&e); err != nil {
+			t.Errorf("%s: body is not JSON: %v", tt.name, err)
+			continue
+		}
+		if w.Code != tt.status || e.Status != tt.status || e.Code != tt.code {
+			t.Errorf("%s: got %d %+v, want %d %s", tt.name, w.Code, e, tt.status, tt.code)
+		}
+		if e.RequestID == "" || w.Header().Get("X-Request-Id") != e.RequestID {
+			t.Errorf("%s: request id missing or not in header: %+v", tt.name, e)
+		}
+	}
+}
+
+func TestProxy_CamouflageUnchanged(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<html>welcome</html>")
+	}))
+	defer site.Close()
+
+	p, _ := newErrorTestProxy(t)
+	p.Config.Proxy.DefaultSite = site.URL
+
+	// Unauthenticated clients still see the default site, not proxy errors
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Body.String() != "<html>welcome</html>" || w.Header().Get("X-Request-Id") != "" {
+		t.Errorf("camouflage response changed: %q %v", w.Body.String(), w.Header())
+	}
+}
+
+func TestDialError(t *testing.T) {
+	if status, code := dialError(&net.DNSError{Err: "no such host", Name: "nope.invalid", IsNotFound: true}); status != http.StatusBadGateway || code != ErrCodeDNSFailure {
+		t.Errorf("DNS error mapped to %d %s", status, code)
+	}
+
+	// A dial that cannot complete before its deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	_, err := (&net.Dialer{}).DialContext(ctx, "tcp", "192.0.2.1:443")
+	if status, code := dialError(err); status != http.StatusGatewayTimeout || code != ErrCodeDialTimeout {
+		t.Errorf("timeout %v mapped to %d %s", err, status, code)
+	}
+
+	if _, code := dialError(errors.New("connection refused")); code != ErrCodeDialFailed {
+		t.Errorf("generic error mapped to %s", code)
+	}
+}
+
+func TestProxy_RequestIDInLogs(t *testing.T) {
+	p, issue := newErrorTestProxy(t)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{issue("alice", time.Hour)}}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+
+	id := w.Header().Get("X-Request-Id")
+	if id == "" || !strings.Contains(logs.String(), "[req "+id+"] Policy user_status rejected") {
+		t.Errorf("rejection log does not carry request id %q:\n%s", id, logs.String())
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// pseudonymPrefix starts every pseudonym, e.g. u-3f2a9c0d41b7e865
+const pseudonymPrefix = "u-"
+
+// pseudonymPaths are the read-only endpoints whose JSON can be served with
+// pseudonyms, for tokens that may only see pseudonymized stats. Anything
+// else, like configuration, streams and metrics, stays closed to them.
+var pseudonymPaths = []string{
+	"/api/stats",
+	"/api/stats/user/",
+	"/api/v2/overview",
+	"/api/v2/users",
+	"/api/v2/users/",
+	"/api/v2/domains",
+	"/api/v2/trends",
+	"/api/v2/trends/countries",
+	"/api/v2/countries",
+	"/api/v2/tags",
+	"/api/v2/camouflage",
+	"/api/v2/latency",
+	"/api/v2/nodes",
+	"/api/v2/anomalies",
+	"/api/v2/connections",
+	"/api/v2/connections/interrupted",
+	"/api/v2/export/legacy-json",
+}
+
+// pseudonymFields hold a username wherever they appear, even one not
+// (or no longer) in the stats
+var pseudonymFields = map[string]bool{"username": true, "user": true}
+
+// pseudonyms replaces usernames with stable pseudonyms: an HMAC of the
+// name under admin.pseudonym_secret, so the same user keeps its pseudonym
+// across requests and restarts without the name being recoverable
+type pseudonyms struct {
+	key []byte
+}
+
+func newPseudonyms(secret string) pseudonyms {
+	if secret != "" {
+		return pseudonyms{key: []byte(secret)}
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	return pseudonyms{key: key}
+}
+
+// Name returns the pseudonym of username
+func (p pseudonyms) Name(username string) string {
+	m := hmac.New(sha256.New, p.key)
+	m.Write([]byte(username))
+	return pseudonymPrefix + hex.EncodeToString(m.Sum(nil)[:8])
+}
+
+// pseudonymizable reports whether path may be served pseudonymized
+func pseudonymizable(path string) bool {
+	for _, p := range pseudonymPaths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownUsers returns the pseudonym of every user in the stats
+func (a *AdminServer) knownUsers(ctx context.Context) map[string]string {
+	known := make(map[string]string)
+	if a.StatsManager != nil {
+		for name := range a.StatsManager.GetUserStats() {
+			known[name] = a.pseudonyms.Name(name)
+		}
+	}
+	if a.StatsDB != nil {
+		users, err := a.StatsDB.GetAllUsers(ctx)
+		if err != nil {
+			log.Printf("Pseudonymized request: listing users: %v", err)
+		}
+		for _, u := range users {
+			known[u.Username] = a.pseudonyms.Name(u.Username)
+		}
+	}
+	return known
+}
+
+// servePseudonymized serves a read-only request with every username
+// replaced by its pseudonym. Pseudonyms in the path and query are mapped
+// back first, so /api/v2/users/u-… works as it would with the name.
+func (a *AdminServer) servePseudonymized(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	known := a.knownUsers(r.Context())
+	names := make(map[string]string, len(known))
+	for name, pseudonym := range known {
+		names[pseudonym] = name
+	}
+	unmask := func(s string) string {
+		if name, ok := names[s]; ok {
+			return name
+		}
+		return s
+	}
+	r = r.Clone(r.Context())
+	segments := strings.Split(r.URL.Path, "/")
+	for i, s := range segments {
+		segments[i] = unmask(s)
+	}
+	r.URL.Path, r.URL.RawPath = strings.Join(segments, "/"), ""
+	q := r.URL.Query()
+	for _, values := range q {
+		for i, v := range values {
+			values[i] = unmask(v)
+		}
+	}
+	r.URL.RawQuery = q.Encode()
+
+	rec := &pseudonymWriter{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(rec, r)
+
+	var body any
+	dec := json.NewDecoder(&rec.body)
+	dec.UseNumber()
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") || dec.Decode(&body) != nil {
+		log.Printf("Admin %s: %s cannot be pseudonymized", adminName(r), r.URL.Path)
+		w.Header().Del("Content-Disposition")
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Response cannot be pseudonymized"}, http.StatusForbidden)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(rec.status)
+	json.NewEncoder(w).Encode(a.pseudonyms.mask(body, known))
+}
+
+// mask replaces the usernames in a decoded JSON value: strings naming a
+// known user, object keys naming one, and any string in a username field
+func (p pseudonyms) mask(v any, known map[string]string) any {
+	switch v := v.(type) {
+	case string:
+		if pseudonym, ok := known[v]; ok {
+			return pseudonym
+		}
+		return v
+	case []any:
+		for i := range v {
+			v[i] = p.mask(v[i], known)
+		}
+		return v
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			if s, ok := item.(string); ok && s != "" && pseudonymFields[k] {
+				item = p.Name(s)
+			}
+			if pseudonym, ok := known[k]; ok {
+				k = pseudonym
+			}
+			out[k] = p.mask(item, known)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// pseudonymWriter holds a response back until its usernames are replaced
+type pseudonymWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *pseudonymWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *pseudonymWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *pseudonymWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
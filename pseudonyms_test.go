@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPseudonyms_Name(t *testing.T) {
+	p := newPseudonyms("secret")
+	if p.Name("alice") != newPseudonyms("secret").Name("alice") {
+		t.Error("pseudonyms are not stable for the same secret")
+	}
+	if p.Name("alice") == newPseudonyms("other").Name("alice") || p.Name("alice") == p.Name("bob") {
+		t.Error("pseudonyms collide")
+	}
+	if name := p.Name("alice"); !strings.HasPrefix(name, pseudonymPrefix) || len(name) != len(pseudonymPrefix)+16 {
+		t.Errorf("pseudonym %q", name)
+	}
+}
+
+func TestAdminAuthenticate_Pseudonymized(t *testing.T) {
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	db.SetUserDisabled("bob", true)
+
+	sum := sha256.Sum256([]byte("partner"))
+	a := &AdminServer{
+		StatsDB:    db,
+		pseudonyms: newPseudonyms("secret"),
+		apiTokens: loadAPITokens([]APITokenConfig{
+			{Name: "partner", TokenSHA256: hex.EncodeToString(sum[:]), Scopes: []string{ScopeStatsPseudonymized}},
+		}),
+	}
+	mux := http.NewServeMux()
+	registerV2API(mux, &Config{}, nil, db, nil, nil)
+	handler := localizeErrors(a.authenticate(mux))
+	bob := a.pseudonyms.Name("bob")
+
+	get := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer partner")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec := get(http.MethodGet, "/api/v2/users")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"bob"`) || !strings.Contains(rec.Body.String(), bob) {
+		t.Errorf("users: %d %s", rec.Code, rec.Body)
+	}
+	// Pseudonyms address users as their names would
+	rec = get(http.MethodGet, "/api/v2/users/"+bob)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), `"bob"`) || !strings.Contains(rec.Body.String(), bob) {
+		t.Errorf("user by pseudonym: %d %s", rec.Code, rec.Body)
+	}
+
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodGet, "/api/v2/events"},
+		{http.MethodGet, "/api/config"},
+		{http.MethodGet, "/metrics"},
+		{http.MethodPost, "/api/v2/users/bulk"},
+	} {
+		if rec := get(tc.method, tc.path); rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s: status %d, want 403", tc.method, tc.path, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// qrCode is a QR code symbol in byte mode at error correction level M,
+// enough for the provisioning links the admin API hands to phones
+type qrCode struct {
+	size       int
+	modules    [][]bool // [y][x], true is dark
+	isFunction [][]bool
+}
+
+// qrEccM and qrBlocksM are the error correction codewords per block and the
+// number of blocks of each version (index 1-40) at level M
+var qrEccM = [41]int{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26,
+	26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+var qrBlocksM = [41]int{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16,
+	17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+
+// errQRTooLong is returned for data that does not fit in version 40
+var errQRTooLong = errors.New("data too long for a QR code")
+
+// encodeQR returns the smallest QR code holding data
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 0
+	for v := 1; v <= 40; v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= qrDataCodewords(v)*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+
+	// Mode indicator, character count, data, terminator and padding
+	var bits qrBits
+	bits.append(0x4, 4)
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := qrDataCodewords(version) * 8
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i>>3] |= 1 << (7 - i&7)
+		}
+	}
+
+	size := version*4 + 17
+	q := &qrCode{size: size, modules: make([][]bool, size), isFunction: make([][]bool, size)}
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.isFunction[i] = make([]bool, size)
+	}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrAddEcc(codewords, version))
+
+	// Keep the mask with the lowest penalty
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // XOR again to undo
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+	return q, nil
+}
+
+// qrBits is a bit buffer, most significant bit first
+type qrBits []bool
+
+func (b *qrBits) append(val, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, val>>i&1 != 0)
+	}
+}
+
+// qrRawModules is the number of modules of a version available for data
+// and error correction codewords
+func qrRawModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+func qrDataCodewords(version int) int {
+	return qrRawModules(version)/8 - qrEccM[version]*qrBlocksM[version]
+}
+
+// qrAddEcc splits data into blocks, appends Reed-Solomon codewords to each
+// and interleaves them
+func qrAddEcc(data []byte, version int) []byte {
+	numBlocks, eccLen := qrBlocksM[version], qrEccM[version]
+	raw := qrRawModules(version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+
+	divisor := qrRSDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		block := append([]byte(nil), data[k:k+n]...)
+		k += n
+		ecc := qrRSRemainder(block, divisor)
+		if i < numShort {
+			block = append(block, 0) // placeholder keeping columns aligned
+		}
+		blocks[i] = append(block, ecc...)
+	}
+
+	out := make([]byte, 0, raw)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			// Short blocks have no data codeword in this column
+			if i != shortLen-eccLen || j >= numShort {
+				out = append(out, block[i])
+			}
+		}
+	}
+	return out
+}
+
+// qrMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func qrMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x1D
+		z ^= (y >> i & 1) * x
+	}
+	return z
+}
+
+// qrRSDivisor returns the Reed-Solomon generator polynomial of degree n,
+// without its leading coefficient
+func qrRSDivisor(n int) []byte {
+	result := make([]byte, n)
+	result[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := range result {
+			result[j] = qrMul(result[j], root)
+			if j+1 < n {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrMul(root, 0x02)
+	}
+	return result
+}
+
+func qrRSRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= qrMul(d, factor)
+		}
+	}
+	return result
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.isFunction[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < q.size && y >= 0 && y < q.size {
+					d := max(abs(dx), abs(dy))
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	pos := qrAlignmentPositions(version)
+	for i, x := range pos {
+		for j, y := range pos {
+			// Skip the corners taken by finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	q.drawFormatBits(0) // reserves the area; redrawn once the mask is known
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 != 0
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// qrAlignmentPositions returns the centre coordinates of the alignment
+// patterns of a version
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := 26
+	if version != 32 {
+		step = (version*4 + n*2 + 1) / (n*2 - 2) * 2
+	}
+	pos := make([]int, n)
+	pos[0] = 6
+	for i, p := n-1, version*4+10; i >= 1; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+// qrFormatBits returns the 15 format bits for level M and mask
+func qrFormatBits(mask int) int {
+	data := 0<<3 | mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (q *qrCode) drawFormatBits(mask int) {
+	bits := qrFormatBits(mask)
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true) // dark module
+}
+
+// drawCodewords places the codewords in the zigzag order of the standard
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.isFunction[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i>>3]>>(7-i&7)&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.isFunction[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol by the four rules of the standard: long runs,
+// 2x2 blocks, finder-like patterns and dark/light imbalance
+func (q *qrCode) penalty() int {
+	n := q.size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	finderLike := []bool{true, false, true, true, true, false, true}
+	light := func(line, from int, transpose bool) bool {
+		for i := from; i < from+4; i++ {
+			if i >= 0 && i < n && at(i, line, transpose) {
+				return false
+			}
+		}
+		return true
+	}
+
+	score := 0
+	for _, transpose := range []bool{false, true} {
+		for line := 0; line < n; line++ {
+			run := 1
+			for i := 1; i <= n; i++ {
+				if i < n && at(i, line, transpose) == at(i-1, line, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+			for i := 0; i+7 <= n; i++ {
+				match := true
+				for k, dark := range finderLike {
+					if at(i+k, line, transpose) != dark {
+						match = false
+						break
+					}
+				}
+				if match && (light(line, i-4, transpose) || light(line, i+7, transpose)) {
+					score += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					score += 3
+				}
+			}
+		}
+	}
+	score += abs(dark*20-n*n*10) / (n * n) * 10
+	return score
+}
+
+// PNG renders the symbol with scale pixels per module and the standard
+// four-module quiet zone
+func (q *qrCode) PNG(scale int) ([]byte, error) {
+	const border = 4
+	dim := (q.size + 2*border) * scale
+	img := image.NewGray(image.Rect(0, 0, dim, dim))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetGray((x+border)*scale+dx, (y+border)*scale+dy, color.Gray{})
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
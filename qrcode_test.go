@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestQRReedSolomon(t *testing.T) {
+	// "HELLO WORLD" at 1-M, from the worked example of the standard
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := qrRSRemainder(data, qrRSDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("ECC = %v, want %v", got, want)
+	}
+}
+
+func TestQRFormatAndVersionBits(t *testing.T) {
+	for mask, want := range []int{0x5412, 0x5125, 0x5E7C, 0x5B4B, 0x45F9, 0x40CE, 0x4F97, 0x4AA0} {
+		if got := qrFormatBits(mask); got != want {
+			t.Errorf("format bits M/%d = %#x, want %#x", mask, got, want)
+		}
+	}
+	q := &qrCode{}
+	*q = qrCode{size: 45, modules: make([][]bool, 45), isFunction: make([][]bool, 45)}
+	for i := range q.modules {
+		q.modules[i] = make([]bool, 45)
+		q.isFunction[i] = make([]bool, 45)
+	}
+	q.drawFunctionPatterns(7)
+	// Version 7 information is 000111110010010100, least significant bit
+	// first in the top-right block
+	var got int
+	for i := 17; i >= 0; i-- {
+		got <<= 1
+		if q.modules[i/3][q.size-11+i%3] {
+			got |= 1
+		}
+	}
+	if got != 0x07C94 {
+		t.Errorf("version bits = %#x, want 0x7c94", got)
+	}
+}
+
+func TestEncodeQR(t *testing.T) {
+	for _, tc := range []struct {
+		n, version int
+	}{{14, 1}, {15, 2}, {213, 10}, {214, 11}} {
+		q, err := encodeQR([]byte(strings.Repeat("a", tc.n)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.size != tc.version*4+17 {
+			t.Errorf("%d bytes: size %d, want version %d", tc.n, q.size, tc.version)
+		}
+	}
+	if _, err := encodeQR(make([]byte, 3000)); err != errQRTooLong {
+		t.Errorf("3000 bytes: %v", err)
+	}
+
+	q, _ := encodeQR([]byte("https://proxy.example.com:8443/provision/abc"))
+	data, err := q.PNG(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dim := img.Bounds().Dx(); dim != (q.size+8)*4 {
+		t.Errorf("image width %d", dim)
+	}
+}
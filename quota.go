@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Quota periods. Usage is counted from the start of the local day, the
+// week (from Monday) or the calendar month, and resets at the next one.
+const (
+	QuotaDaily   = "daily"
+	QuotaWeekly  = "weekly"
+	QuotaMonthly = "monthly"
+)
+
+// quotaPeriod returns the bounds of the period t falls in
+func quotaPeriod(period string, t time.Time) (start, end time.Time) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch period {
+	case QuotaDaily:
+		return day, day.AddDate(0, 0, 1)
+	case QuotaWeekly:
+		start = day.AddDate(0, 0, -(int(t.Weekday())+6)%7)
+		return start, start.AddDate(0, 0, 7)
+	default:
+		return calendarMonth(t)
+	}
+}
+
+// QuotaStatus is a user's quota and what they used of it this period
+type QuotaStatus struct {
+	UserQuota
+	Group       string    `json:"group,omitempty"` // set if the quota is inherited from a group
+	UsedBytes   uint64    `json:"used_bytes"`
+	PeriodStart time.Time `json:"period_start"`
+	ResetsAt    time.Time `json:"resets_at"`
+	Exceeded    bool      `json:"exceeded"`
+	// Pool is set if the user shares their group's quota. QuotaBytes is
+	// then their cap in it, or the whole pool without one, and Exceeded is
+	// set once either is used up.
+	Pool *QuotaPool `json:"pool,omitempty"`
+}
+
+// QuotaPool is the usage of a group quota shared by its members
+type QuotaPool struct {
+	Group      string `json:"group"`
+	QuotaBytes uint64 `json:"quota_bytes"`
+	UsedBytes  uint64 `json:"used_bytes"`
+	Exceeded   bool   `json:"exceeded"`
+}
+
+// GroupQuotaStatus is a pooled group quota with what each member used of it
+// this period
+type GroupQuotaStatus struct {
+	QuotaPool
+	Period      string             `json:"period"`
+	PeriodStart time.Time          `json:"period_start"`
+	ResetsAt    time.Time          `json:"resets_at"`
+	Members     []GroupQuotaMember `json:"members"` // most used first
+}
+
+// GroupQuotaMember is a member's share of a pooled group quota
+type GroupQuotaMember struct {
+	Username   string `json:"username"`
+	UsedBytes  uint64 `json:"used_bytes"`
+	QuotaBytes uint64 `json:"quota_bytes,omitempty"` // their cap, if any
+	Exceeded   bool   `json:"exceeded"`
+}
+
+// poolUsageTTL is how long the usage of a pooled quota is reused; it is
+// summed over every user's traffic of the period
+const poolUsageTTL = 10 * time.Second
+
+// poolUsage is the traffic of the members of a pooled quota, by username
+type poolUsage struct {
+	start time.Time // of the period
+	at    time.Time
+	used  map[string]uint64
+}
+
+// UserQuotas holds the per-user traffic quotas set through the admin API.
+// They are kept in the stats database, so they need stats enabled. Users
+// without a quota of their own get the one of their Basic login, if any,
+// or inherit their groups' quota, which members of a pooled group share.
+type UserQuotas struct {
+	db     *StatsDB
+	groups *UserGroups
+	logins map[string]UserQuota // From server.proxy_auth.users
+
+	mu       sync.RWMutex
+	quotas   map[string]UserQuota
+	exceeded map[string]time.Time // start of the period a user was last found over quota
+	pools    map[string]poolUsage // by group
+	poolTTL  time.Duration
+}
+
+// NewUserQuotas loads the quotas; it returns nil without a stats database
+func NewUserQuotas(config *Config, db *StatsDB, groups *UserGroups) *UserQuotas {
+	if db == nil {
+		return nil
+	}
+	uq := &UserQuotas{db: db, groups: groups, logins: make(map[string]UserQuota), quotas: make(map[string]UserQuota), exceeded: make(map[string]time.Time),
+		pools: make(map[string]poolUsage), poolTTL: poolUsageTTL}
+	for _, u := range config.Server.ProxyAuth.Users {
+		if u.Quota == nil {
+			continue
+		}
+		if q := u.Quota.userQuota("server.proxy_auth.users "+u.Name+" quota", "proxy_auth"); q != nil {
+			q.Username = u.Name
+			uq.logins[u.Name] = *q
+		}
+	}
+	quotas, err := db.GetUserQuotas(context.Background())
+	if err != nil {
+		log.Printf("User quotas: %v", err)
+	}
+	for _, q := range quotas {
+		uq.quotas[q.Username] = q
+	}
+	metrics.Gauge("https_proxy_quota_users", "Users with a traffic quota", func() float64 {
+		uq.mu.RLock()
+		defer uq.mu.RUnlock()
+		return float64(len(uq.quotas))
+	})
+	return uq
+}
+
+// Get returns username's own quota
+func (uq *UserQuotas) Get(username string) (UserQuota, bool) {
+	if uq == nil {
+		return UserQuota{}, false
+	}
+	uq.mu.RLock()
+	defer uq.mu.RUnlock()
+	q, ok := uq.quotas[username]
+	return q, ok
+}
+
+// effective returns the quota that applies to username: their own, their
+// Basic login's, or else the one inherited from their groups
+func (uq *UserQuotas) effective(username string) (q UserQuota, group string, ok bool) {
+	if q, ok = uq.Get(username); ok {
+		return q, "", true
+	}
+	if uq == nil {
+		return q, "", false
+	}
+	if q, ok = uq.logins[username]; ok {
+		return q, "", true
+	}
+	return uq.groups.Quota(username)
+}
+
+// Status returns the quota that applies to username and their usage at now
+func (uq *UserQuotas) Status(username string, now time.Time) (QuotaStatus, bool) {
+	q, group, ok := uq.effective(username)
+	if !ok {
+		return QuotaStatus{}, false
+	}
+	start, end := quotaPeriod(q.Period, now.Local())
+	st := QuotaStatus{UserQuota: q, Group: group, PeriodStart: start, ResetsAt: end}
+	if pool := uq.groups.pool(group); pool != nil {
+		used := uq.poolUsage(group, start, now)
+		st.Pool = &QuotaPool{Group: group, QuotaBytes: q.QuotaBytes}
+		for _, b := range used {
+			st.Pool.UsedBytes += b
+		}
+		st.Pool.Exceeded = st.Pool.UsedBytes >= q.QuotaBytes
+		if c := pool.capOf(username); c > 0 {
+			st.QuotaBytes = c
+		}
+		st.UsedBytes = used[username]
+		st.Exceeded = st.Pool.Exceeded || st.UsedBytes >= st.QuotaBytes
+		return st, true
+	}
+	st.UsedBytes = uq.db.UserTrafficSince(username, start)
+	st.Exceeded = st.UsedBytes >= q.QuotaBytes
+	return st, true
+}
+
+// poolUsage returns the traffic of the users sharing group's quota since
+// start, reusing the last sum for poolTTL. Members with a quota of their
+// own, or inheriting another group's, do not count.
+func (uq *UserQuotas) poolUsage(group string, start, now time.Time) map[string]uint64 {
+	uq.mu.RLock()
+	cached, ok := uq.pools[group]
+	uq.mu.RUnlock()
+	if ok && cached.start.Equal(start) && !now.Before(cached.at) && now.Sub(cached.at) < uq.poolTTL {
+		return cached.used
+	}
+
+	all, err := uq.db.UsersTrafficSince(context.Background(), start)
+	if err != nil {
+		log.Printf("Group %s quota: %v", group, err)
+	}
+	used := make(map[string]uint64)
+	for username, b := range all {
+		if _, g, ok := uq.effective(username); ok && g == group {
+			used[username] = b
+		}
+	}
+	uq.mu.Lock()
+	uq.pools[group] = poolUsage{start: start, at: now, used: used}
+	uq.mu.Unlock()
+	return used
+}
+
+var errNotPooled = errors.New("group has no pooled quota")
+
+// GroupStatus returns the pooled quota of group and each member's usage at
+// now. Members are those who used some of it and those known by name.
+func (uq *UserQuotas) GroupStatus(group string, now time.Time) (GroupQuotaStatus, error) {
+	if uq.groups == nil || uq.groups.group(group) == nil {
+		return GroupQuotaStatus{}, errUnknownGroup
+	}
+	pool := uq.groups.pool(group)
+	if pool == nil {
+		return GroupQuotaStatus{}, errNotPooled
+	}
+	q := *uq.groups.group(group).quota
+	start, end := quotaPeriod(q.Period, now.Local())
+	st := GroupQuotaStatus{QuotaPool: QuotaPool{Group: group, QuotaBytes: q.QuotaBytes}, Period: q.Period, PeriodStart: start, ResetsAt: end, Members: []GroupQuotaMember{}}
+
+	used := uq.poolUsage(group, start, now)
+	names := uq.groups.knownMembers(group)
+	for username := range used {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+	for _, username := range slices.Compact(names) {
+		if _, g, ok := uq.effective(username); !ok || g != group {
+			continue
+		}
+		m := GroupQuotaMember{Username: username, UsedBytes: used[username], QuotaBytes: pool.capOf(username)}
+		m.Exceeded = m.QuotaBytes > 0 && m.UsedBytes >= m.QuotaBytes
+		st.UsedBytes += m.UsedBytes
+		st.Members = append(st.Members, m)
+	}
+	st.Exceeded = st.UsedBytes >= st.QuotaBytes
+	sort.SliceStable(st.Members, func(i, j int) bool { return st.Members[i].UsedBytes > st.Members[j].UsedBytes })
+	return st, nil
+}
+
+// List returns every quota set for a user or their Basic login with its
+// usage at now
+func (uq *UserQuotas) List(now time.Time) []QuotaStatus {
+	uq.mu.RLock()
+	names := make([]string, 0, len(uq.quotas)+len(uq.logins))
+	for name := range uq.quotas {
+		names = append(names, name)
+	}
+	for name := range uq.logins {
+		if _, ok := uq.quotas[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	uq.mu.RUnlock()
+	sort.Strings(names)
+	out := make([]QuotaStatus, 0, len(names))
+	for _, name := range names {
+		if st, ok := uq.Status(name, now); ok {
+			out = append(out, st)
+		}
+	}
+	return out
+}
+
+var errQuotaPeriod = errors.New("period must be daily, weekly or monthly")
+
+// Set gives username a quota of quotaBytes per period, replacing any other
+func (uq *UserQuotas) Set(username, period string, quotaBytes uint64, actor string, now time.Time) (UserQuota, error) {
+	switch period {
+	case QuotaDaily, QuotaWeekly, QuotaMonthly:
+	default:
+		return UserQuota{}, errQuotaPeriod
+	}
+	q := UserQuota{Username: username, Period: period, QuotaBytes: quotaBytes, SetBy: actor, SetAt: now}
+	if err := uq.db.SetUserQuota(q); err != nil {
+		return UserQuota{}, err
+	}
+	uq.mu.Lock()
+	uq.quotas[username] = q
+	delete(uq.exceeded, username)
+	uq.mu.Unlock()
+
+	detail := fmt.Sprintf("%s %s", formatBytes(quotaBytes), period)
+	uq.db.RecordUserEvent(username, EventQuotaSet, actor, detail)
+	changeFeed.Publish(ChangeEvent{Type: ChangeQuota, User: username, Actor: actor, Detail: "quota: " + detail})
+	return q, nil
+}
+
+// Delete removes username's quota
+func (uq *UserQuotas) Delete(username, actor string) error {
+	if _, ok := uq.Get(username); !ok {
+		return errNoQuota
+	}
+	if err := uq.db.DeleteUserQuota(username); err != nil {
+		return err
+	}
+	uq.mu.Lock()
+	delete(uq.quotas, username)
+	delete(uq.exceeded, username)
+	uq.mu.Unlock()
+
+	uq.db.RecordUserEvent(username, EventQuotaSet, actor, "removed")
+	changeFeed.Publish(ChangeEvent{Type: ChangeQuota, User: username, Actor: actor, Detail: "quota removed"})
+	return nil
+}
+
+var errNoQuota = errors.New("no quota set")
+
+// Record notes that username was refused for being over quota, recording a
+// user event the first time in each period
+func (uq *UserQuotas) Record(reqID, username string, now time.Time) {
+	q, _, ok := uq.effective(username)
+	if !ok {
+		return
+	}
+	start, end := quotaPeriod(q.Period, now.Local())
+	uq.mu.Lock()
+	first := !uq.exceeded[username].Equal(start)
+	uq.exceeded[username] = start
+	uq.mu.Unlock()
+	if !first {
+		return
+	}
+	log.Printf("[req %s] %s used up their %s quota of %s; refused until %s", reqID, username, q.Period, formatBytes(q.QuotaBytes), end.Format(time.RFC3339))
+	uq.db.RecordUserEvent(username, EventQuotaExceeded, "policy", fmt.Sprintf("%s %s used up, resets %s", formatBytes(q.QuotaBytes), q.Period, end.Format(time.RFC3339)))
+}
+
+// checkQuota blocks users over their quota until the period resets
+func (e *PolicyEngine) checkQuota(req PolicyRequest) PolicyCheck {
+	check := PolicyCheck{Rule: "quota", Allowed: true}
+	st, ok := e.Quotas.Status(req.Username, req.Time)
+	if !ok || !st.Exceeded {
+		return check
+	}
+	check.Allowed = false
+	if st.Pool != nil && st.Pool.Exceeded {
+		check.Reason = fmt.Sprintf("Shared traffic quota of %s %s%s used up", formatBytes(st.Pool.QuotaBytes), st.Period, groupDetail(st.Group))
+	} else {
+		check.Reason = fmt.Sprintf("Traffic quota of %s %s%s used up", formatBytes(st.QuotaBytes), st.Period, groupDetail(st.Group))
+	}
+	check.Code = ErrCodeQuotaExceeded
+	check.Status = http.StatusForbidden
+	check.RetryAfter = int(math.Ceil(st.ResetsAt.Sub(req.Time).Seconds()))
+	return check
+}
+
+// handleUserQuota serves /api/v2/users/{username}/quota: GET returns the
+// quota and this period's usage, PUT {"period": "monthly", "quota_mb":
+// 10240} sets it and DELETE removes it
+func handleUserQuota(w http.ResponseWriter, r *http.Request, quotas *UserQuotas, username string) {
+	if quotas == nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Quotas not available"}, http.StatusServiceUnavailable)
+		return
+	}
+	actor := "api:" + adminName(r)
+	switch r.Method {
+	case http.MethodGet:
+		st, ok := quotas.Status(username, time.Now())
+		if !ok {
+			writeJSONResponse(w, WebResponse{Success: false, Error: errNoQuota.Error()}, http.StatusNotFound)
+			return
+		}
+		writeJSONResponse(w, WebResponse{Success: true, Data: st}, http.StatusOK)
+	case http.MethodPut:
+		var req struct {
+			Period  string `json:"period"`
+			QuotaMB int64  `json:"quota_mb"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "invalid JSON: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if req.QuotaMB <= 0 {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "quota_mb must be positive"}, http.StatusBadRequest)
+			return
+		}
+		if req.Period == "" {
+			req.Period = QuotaMonthly
+		}
+		now := time.Now()
+		if _, err := quotas.Set(username, req.Period, uint64(req.QuotaMB)<<20, actor, now); err != nil {
+			status := http.StatusInternalServerError
+			if err == errQuotaPeriod {
+				status = http.StatusBadRequest
+			}
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, status)
+			return
+		}
+		log.Printf("Quota of %s set to %d MB %s by %s", username, req.QuotaMB, req.Period, actor)
+		st, _ := quotas.Status(username, now)
+		writeJSONResponse(w, WebResponse{Success: true, Data: st}, http.StatusOK)
+	case http.MethodDelete:
+		if err := quotas.Delete(username, actor); err != nil {
+			status := http.StatusInternalServerError
+			if err == errNoQuota {
+				status = http.StatusNotFound
+			}
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, status)
+			return
+		}
+		log.Printf("Quota of %s removed by %s", username, actor)
+		writeJSONResponse(w, WebResponse{Success: true}, http.StatusOK)
+	default:
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+	}
+}
+
+// handleGroupQuota serves /api/v2/groups/{name}/quota: GET returns the
+// group's pooled quota and what each member used of it this period
+func handleGroupQuota(w http.ResponseWriter, r *http.Request, quotas *UserQuotas, group string) {
+	if quotas == nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Quotas not available"}, http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+	st, err := quotas.GroupStatus(group, time.Now())
+	if err != nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusNotFound)
+		return
+	}
+	writeJSONResponse(w, WebResponse{Success: true, Data: st}, http.StatusOK)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotaPeriod(t *testing.T) {
+	now := time.Date(2026, 10, 17, 15, 30, 0, 0, time.Local) // a Saturday
+	for period, want := range map[string][2]time.Time{
+		QuotaDaily:   {time.Date(2026, 10, 17, 0, 0, 0, 0, time.Local), time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local)},
+		QuotaWeekly:  {time.Date(2026, 10, 12, 0, 0, 0, 0, time.Local), time.Date(2026, 10, 19, 0, 0, 0, 0, time.Local)},
+		QuotaMonthly: {time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local), time.Date(2026, 11, 1, 0, 0, 0, 0, time.Local)},
+	} {
+		if start, end := quotaPeriod(period, now); !start.Equal(want[0]) || !end.Equal(want[1]) {
+			t.Errorf("%s: %v - %v, want %v - %v", period, start, end, want[0], want[1])
+		}
+	}
+	if start, _ := quotaPeriod(QuotaWeekly, time.Date(2026, 10, 12, 0, 0, 0, 0, time.Local)); start.Day() != 12 {
+		t.Errorf("week starting on a Monday begins %v", start)
+	}
+}
+
+func TestUserQuotas(t *testing.T) {
+	db := newExpiryTestDB(t)
+	engine := NewPolicyEngine(&Config{}, nil, db)
+	mux := http.NewServeMux()
+	registerV2API(mux, &Config{}, nil, db, engine, nil)
+	do := func(method, path, body string) (int, QuotaStatus) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, path, bytes.NewBufferString(body)))
+		var resp struct {
+			Data QuotaStatus `json:"data"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp.Data
+	}
+
+	if code, _ := do(http.MethodGet, "/api/v2/users/alice/quota", ""); code != http.StatusNotFound {
+		t.Errorf("GET without a quota: %d", code)
+	}
+	if code, _ := do(http.MethodPut, "/api/v2/users/alice/quota", `{"period": "hourly", "quota_mb": 1}`); code != http.StatusBadRequest {
+		t.Errorf("unknown period: %d", code)
+	}
+	if code, _ := do(http.MethodPut, "/api/v2/users/alice/quota", `{"period": "daily"}`); code != http.StatusBadRequest {
+		t.Errorf("missing quota_mb: %d", code)
+	}
+	code, st := do(http.MethodPut, "/api/v2/users/alice/quota", `{"period": "daily", "quota_mb": 1}`)
+	if code != http.StatusOK || st.Period != QuotaDaily || st.QuotaBytes != 1<<20 || st.Exceeded || !st.ResetsAt.After(time.Now()) {
+		t.Fatalf("PUT: %d %+v", code, st)
+	}
+
+	// Yesterday's traffic does not count, this hour's does
+	now := time.Now()
+	yesterday := now.AddDate(0, 0, -1)
+	if err := db.BatchUpsert([]TrafficRecord{
+		{Username: "alice", Domain: "example.com", Download: 2 << 20, ConnCount: 1, Hour: yesterday.Format("2006-01-02T15:00:00"), Timestamp: yesterday},
+		{Username: "alice", Domain: "example.com", Download: 600 << 10, ConnCount: 1, Hour: now.Format("2006-01-02T15:00:00"), Timestamp: now},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "alice", Time: now}); !d.Allowed {
+		t.Errorf("under quota blocked: %+v", d.Blocking)
+	}
+	db.BatchUpsert([]TrafficRecord{{Username: "alice", Domain: "example.com", Upload: 500 << 10, ConnCount: 1, Hour: now.Format("2006-01-02T15:00:00"), Timestamp: now}})
+	d := engine.Evaluate(PolicyRequest{Username: "alice", Time: now})
+	if d.Allowed || d.Blocking.Rule != "quota" || d.Blocking.Code != ErrCodeQuotaExceeded || d.Blocking.Status != http.StatusForbidden || d.Blocking.RetryAfter <= 0 {
+		t.Fatalf("over quota: %+v", d.Blocking)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "bob", Time: now}); !d.Allowed {
+		t.Errorf("user without a quota blocked: %+v", d.Blocking)
+	}
+
+	// Being refused is recorded once per period
+	engine.Quotas.Record("r1", "alice", now)
+	engine.Quotas.Record("r2", "alice", now)
+	var exceeded int
+	db.sqlDB().QueryRow(`SELECT COUNT(*) FROM user_events WHERE user = ? AND type = ?`, "alice", EventQuotaExceeded).Scan(&exceeded)
+	if exceeded != 1 {
+		t.Errorf("%d quota_exceeded events, want 1", exceeded)
+	}
+
+	// Quotas survive a restart
+	if q, ok := NewUserQuotas(&Config{}, db, nil).Get("alice"); !ok || q.QuotaBytes != 1<<20 {
+		t.Errorf("reloaded quota = %+v, %v", q, ok)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/quotas", nil))
+	var list struct {
+		Data []QuotaStatus `json:"data"`
+	}
+	if json.NewDecoder(rec.Body).Decode(&list); len(list.Data) != 1 || !list.Data[0].Exceeded || list.Data[0].UsedBytes != 1100<<10 {
+		t.Errorf("list = %+v", list.Data)
+	}
+
+	if code, _ := do(http.MethodDelete, "/api/v2/users/alice/quota", ""); code != http.StatusOK {
+		t.Errorf("DELETE: %d", code)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "alice", Time: now}); !d.Allowed {
+		t.Errorf("blocked after the quota was removed: %+v", d.Blocking)
+	}
+	if code, _ := do(http.MethodDelete, "/api/v2/users/alice/quota", ""); code != http.StatusNotFound {
+		t.Errorf("second DELETE: %d", code)
+	}
+}
+
+func TestGroupQuotaPool(t *testing.T) {
+	db := newExpiryTestDB(t)
+	cfg := &Config{}
+	cfg.Groups = map[string]GroupConfig{
+		"family": {Members: []string{"mum", "dad", "kid"}, Quota: &GroupQuotaConfig{QuotaMB: 3, Pooled: true, MemberQuotasMB: map[string]int64{"kid": 1}}},
+		"team":   {Members: []string{"solo"}, Quota: &GroupQuotaConfig{QuotaMB: 1}},
+	}
+	engine := NewPolicyEngine(cfg, nil, db)
+	engine.Quotas.poolTTL = 0
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, db, engine, nil)
+	now := time.Now()
+	use := func(username string, kb uint64) {
+		t.Helper()
+		if err := db.BatchUpsert([]TrafficRecord{{Username: username, Domain: "example.com", Download: kb << 10, ConnCount: 1, Hour: now.Format("2006-01-02T15:00:00"), Timestamp: now}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A member over their cap is refused while the others go on
+	use("kid", 1536)
+	if d := engine.Evaluate(PolicyRequest{Username: "kid", Time: now}); d.Allowed || d.Blocking.Rule != "quota" || strings.HasPrefix(d.Blocking.Reason, "Shared") {
+		t.Errorf("kid over their cap: %+v", d.Blocking)
+	}
+	st, ok := engine.Quotas.Status("mum", now)
+	if !ok || st.Exceeded || st.QuotaBytes != 3<<20 || st.Pool == nil || st.Pool.UsedBytes != 1536<<10 || st.Pool.Group != "family" {
+		t.Fatalf("mum = %+v, %v", st, ok)
+	}
+
+	// Once the pool is used up every member is refused
+	use("dad", 1024)
+	use("mum", 600)
+	if d := engine.Evaluate(PolicyRequest{Username: "mum", Time: now}); d.Allowed || !strings.HasPrefix(d.Blocking.Reason, "Shared traffic quota") || d.Blocking.RetryAfter <= 0 {
+		t.Errorf("mum with the pool used up: %+v", d.Blocking)
+	}
+
+	// A member with a quota of their own leaves the pool
+	if _, err := engine.Quotas.Set("dad", QuotaMonthly, 10<<20, "test", now); err != nil {
+		t.Fatal(err)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "mum", Time: now}); !d.Allowed {
+		t.Errorf("mum after dad left the pool: %+v", d.Blocking)
+	}
+
+	get := func(path string) (int, GroupQuotaStatus) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp struct {
+			Data GroupQuotaStatus `json:"data"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp.Data
+	}
+	code, gs := get("/api/v2/groups/family/quota")
+	if code != http.StatusOK || gs.QuotaBytes != 3<<20 || gs.UsedBytes != 2136<<10 || gs.Exceeded || gs.Period != QuotaMonthly || len(gs.Members) != 2 {
+		t.Fatalf("family quota: %d %+v", code, gs)
+	}
+	if m := gs.Members[0]; m.Username != "kid" || m.QuotaBytes != 1<<20 || !m.Exceeded {
+		t.Errorf("most used member = %+v", m)
+	}
+	if m := gs.Members[1]; m.Username != "mum" || m.QuotaBytes != 0 || m.Exceeded || m.UsedBytes != 600<<10 {
+		t.Errorf("second member = %+v", m)
+	}
+	for _, path := range []string{"/api/v2/groups/team/quota", "/api/v2/groups/nope/quota", "/api/v2/groups/family"} {
+		if code, _ := get(path); code != http.StatusNotFound {
+			t.Errorf("GET %s: %d", path, code)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UserRateLimitConfig caps each user's bandwidth across all of their
+// tunnels, so one heavy user cannot saturate the uplink for everyone
+type UserRateLimitConfig struct {
+	Default RateLimitRule            `json:"default"` // For users not listed
+	Users   map[string]RateLimitRule `json:"users"`   // By username or CN pattern, e.g. a team's "team-*"
+	// By the ISO code of the target's country, shared by each user's
+	// tunnels there on top of their own limit
+	Countries map[string]RateLimitRule `json:"countries"`
+}
+
+// RateLimitRule is the bandwidth of a user or group of users in KB/s.
+// kbps and burst_kb apply to both directions unless the upload_ and
+// download_ fields override them; upload is from the client. A rate of 0
+// is unlimited, a burst of 0 one second's worth of the rate.
+type RateLimitRule struct {
+	KBps            int `json:"kbps,omitempty"`
+	BurstKB         int `json:"burst_kb,omitempty"`
+	UploadKBps      int `json:"upload_kbps,omitempty"`
+	UploadBurstKB   int `json:"upload_burst_kb,omitempty"`
+	DownloadKBps    int `json:"download_kbps,omitempty"`
+	DownloadBurstKB int `json:"download_burst_kb,omitempty"`
+}
+
+func (r RateLimitRule) validate() error {
+	for _, v := range []int{r.KBps, r.BurstKB, r.UploadKBps, r.UploadBurstKB, r.DownloadKBps, r.DownloadBurstKB} {
+		if v < 0 {
+			return errors.New("rates and bursts must be 0 or more")
+		}
+	}
+	return nil
+}
+
+// RateDirection is the rate of one direction of a user's tunnels
+type RateDirection struct {
+	RateBytes  int64 `json:"rate_bytes"` // Per second; 0 is unlimited
+	BurstBytes int64 `json:"burst_bytes"`
+}
+
+func newRateDirection(kbps, burstKB int) RateDirection {
+	d := RateDirection{RateBytes: int64(kbps) * 1024, BurstBytes: int64(burstKB) * 1024}
+	if d.RateBytes == 0 {
+		d.BurstBytes = 0
+	} else if d.BurstBytes == 0 {
+		d.BurstBytes = d.RateBytes
+	}
+	return d
+}
+
+// directions resolves the rule's overrides into its upload and download
+// rates
+func (r RateLimitRule) directions() (up, down RateDirection) {
+	return newRateDirection(firstPositive(r.UploadKBps, r.KBps), firstPositive(r.UploadBurstKB, r.BurstKB)),
+		newRateDirection(firstPositive(r.DownloadKBps, r.KBps), firstPositive(r.DownloadBurstKB, r.BurstKB))
+}
+
+// String describes the rule for change events
+func (r RateLimitRule) String() string {
+	up, down := r.directions()
+	if up == down {
+		return describeRate(up)
+	}
+	return "upload " + describeRate(up) + ", download " + describeRate(down)
+}
+
+func describeRate(d RateDirection) string {
+	if d.RateBytes == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d KB/s (burst %d KB)", d.RateBytes/1024, d.BurstBytes/1024)
+}
+
+// tokenBucket paces the reads of every tunnel of a user in one direction,
+// or of a client address on the camouflage site.
+// Reads take their bytes from the bucket, which refills at rate up to
+// burst; a read that overdraws it waits until the debt is paid.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second; 0 while unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// setRate changes the bucket's rate, keeping what it holds up to the new
+// burst
+func (b *tokenBucket) setRate(d RateDirection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate, b.burst = float64(d.RateBytes), float64(d.BurstBytes)
+	if b.last.IsZero() || b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// chunk returns the most a single read may take, 0 while unlimited
+func (b *tokenBucket) chunk() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	return int(b.burst)
+}
+
+// take removes n bytes from the bucket at now and returns how long the
+// reader must wait for them
+func (b *tokenBucket) take(n int, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// userBuckets are a user's upload and download buckets
+type userBuckets struct {
+	up, down tokenBucket
+}
+
+// UserRateLimit is the rate a user's tunnels share in each direction
+type UserRateLimit struct {
+	Username string        `json:"username"`
+	Upload   RateDirection `json:"upload"`
+	Download RateDirection `json:"download"`
+	// Source is the proxy.rate_limit.users entry that applies, the
+	// "group:<name>" it is inherited from, or "default"
+	Source string `json:"source"`
+}
+
+// UserRateLimits enforces proxy.rate_limit. Unlike most policies it is built
+// even without limits, so the admin API can add them at runtime.
+type UserRateLimits struct {
+	mu      sync.Mutex
+	def     RateLimitRule
+	rules   map[string]RateLimitRule // by users entry
+	users   *userPatterns
+	buckets map[string]*userBuckets // by username
+	groups  *UserGroups
+
+	waitNanos atomic.Int64
+}
+
+// NewUserRateLimits parses proxy.rate_limit. Users without an entry of
+// their own inherit their groups' rate limit before the default.
+func NewUserRateLimits(config *Config, groups *UserGroups) *UserRateLimits {
+	rc := config.Proxy.RateLimit
+	l := &UserRateLimits{
+		rules:   make(map[string]RateLimitRule),
+		buckets: make(map[string]*userBuckets),
+		groups:  groups,
+	}
+	if err := rc.Default.validate(); err != nil {
+		log.Printf("Default rate limit: %v, ignored", err)
+	} else {
+		l.def = rc.Default
+	}
+	for entry, rule := range rc.Users {
+		if err := rule.validate(); err != nil {
+			log.Printf("Rate limit for %s: %v, ignored", entry, err)
+			continue
+		}
+		l.rules[entry] = rule
+	}
+	if err := l.rebuildLocked(); err != nil {
+		log.Printf("Rate limits: %v", err)
+	}
+	metrics.Counter("https_proxy_rate_limit_wait_seconds_total", "Time tunnel reads waited for their user's rate limit.", func() float64 {
+		return time.Duration(l.waitNanos.Load()).Seconds()
+	})
+	return l
+}
+
+// rebuildLocked rebuilds the matcher from rules and applies the rates to
+// the users' buckets. Must be called with mu held.
+func (l *UserRateLimits) rebuildLocked() error {
+	entries := make([]string, 0, len(l.rules))
+	for entry := range l.rules {
+		entries = append(entries, entry)
+	}
+	users, err := newUserPatterns(entries)
+	l.users = users
+	for username, b := range l.buckets {
+		l.applyLocked(username, b)
+	}
+	return err
+}
+
+// applyLocked sets the rates of username's buckets. Must be called with mu
+// held.
+func (l *UserRateLimits) applyLocked(username string, b *userBuckets) {
+	limit := l.limitLocked(username)
+	b.up.setRate(limit.Upload)
+	b.down.setRate(limit.Download)
+}
+
+func (l *UserRateLimits) limitLocked(username string) UserRateLimit {
+	rule, source := l.def, "default"
+	if entry, ok := l.users.Match(username); ok {
+		rule, source = l.rules[entry], entry
+	} else if groupRule, group, ok := l.groups.RateLimit(username); ok {
+		rule, source = groupRule, "group:"+group
+	}
+	up, down := rule.directions()
+	return UserRateLimit{Username: username, Upload: up, Download: down, Source: source}
+}
+
+// Limit returns the rates that apply to username
+func (l *UserRateLimits) Limit(username string) UserRateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limitLocked(username)
+}
+
+// Set gives username, or the users matching the pattern, their own rule,
+// taking effect on their open tunnels too; a zero rule lifts every limit
+func (l *UserRateLimits) Set(username string, rule RateLimitRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev, had := l.rules[username]
+	l.rules[username] = rule
+	if err := l.rebuildLocked(); err != nil {
+		if had {
+			l.rules[username] = prev
+		} else {
+			delete(l.rules, username)
+		}
+		l.rebuildLocked()
+		return err
+	}
+	return nil
+}
+
+// Clear removes username's own entry, so a pattern or the default applies
+// again
+func (l *UserRateLimits) Clear(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.rules, username)
+	l.rebuildLocked()
+}
+
+// Refresh re-applies username's rates to their open tunnels, after their
+// groups changed
+func (l *UserRateLimits) Refresh(username string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b := l.buckets[username]; b != nil {
+		l.applyLocked(username, b)
+	}
+}
+
+// entries returns a copy of the users entries, for the config file
+func (l *UserRateLimits) entries() map[string]RateLimitRule {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make(map[string]RateLimitRule, len(l.rules))
+	for entry, rule := range l.rules {
+		entries[entry] = rule
+	}
+	return entries
+}
+
+// Reader wraps r, read by a tunnel of username in the given direction, so
+// its reads draw on the user's shared bucket
+func (l *UserRateLimits) Reader(username string, upload bool, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	l.mu.Lock()
+	b := l.buckets[username]
+	if b == nil {
+		b = &userBuckets{}
+		l.applyLocked(username, b)
+		l.buckets[username] = b
+	}
+	l.mu.Unlock()
+	bucket := &b.down
+	if upload {
+		bucket = &b.up
+	}
+	return &rateLimitedReader{r: r, b: bucket, waited: &l.waitNanos}
+}
+
+// rateLimitedReader draws its reads from b, adding the time spent waiting
+// to waited
+type rateLimitedReader struct {
+	r      io.Reader
+	b      *tokenBucket
+	waited *atomic.Int64
+}
+
+func (rr *rateLimitedReader) Read(p []byte) (int, error) {
+	if chunk := rr.b.chunk(); chunk > 0 && len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := rr.r.Read(p)
+	if wait := rr.b.take(n, time.Now()); wait > 0 {
+		rr.waited.Add(int64(wait))
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// handleUserRateLimit serves /api/v2/users/{username}/rate-limit: GET
+// returns the rates that apply, PUT sets the user's own rule, e.g.
+// {"download_kbps": 12800, "upload_kbps": 1280, "persist": true}, and
+// DELETE (?persist=true) removes it. persist also writes
+// proxy.rate_limit.users to the config file.
+func handleUserRateLimit(w http.ResponseWriter, r *http.Request, config *Config, history *ConfigHistory, limits *UserRateLimits, username string) {
+	if limits == nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Policy engine not available"}, http.StatusServiceUnavailable)
+		return
+	}
+	actor := "api:" + adminName(r)
+	var persist bool
+	switch r.Method {
+	case http.MethodGet:
+		writeJSONResponse(w, WebResponse{Success: true, Data: limits.Limit(username)}, http.StatusOK)
+		return
+	case http.MethodPut:
+		var req struct {
+			RateLimitRule
+			Persist bool `json:"persist"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "invalid JSON: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if err := limits.Set(username, req.RateLimitRule); err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		persist = req.Persist
+		detail := "rate limit: " + req.RateLimitRule.String()
+		log.Printf("Rate limit of %s set to %s by %s", username, req.RateLimitRule, actor)
+		changeFeed.Publish(ChangeEvent{Type: ChangeQuota, User: username, Actor: actor, Detail: detail})
+	case http.MethodDelete:
+		limits.Clear(username)
+		persist = r.URL.Query().Get("persist") == "true"
+		log.Printf("Rate limit of %s cleared by %s", username, actor)
+		changeFeed.Publish(ChangeEvent{Type: ChangeQuota, User: username, Actor: actor, Detail: "rate limit cleared"})
+	default:
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+
+	if persist {
+		entries := limits.entries()
+		err := editConfigFile(config, history, actor, func(set func(value interface{}, keys ...string)) {
+			set(entries, "proxy", "rate_limit", "users")
+		})
+		if err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "rate limit applied but not saved: " + err.Error()}, http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSONResponse(w, WebResponse{Success: true, Data: limits.Limit(username)}, http.StatusOK)
+}
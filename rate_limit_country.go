@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CountryRateLimits paces tunnels by the country their target is in, for
+// proxy.rate_limit.countries. A country's rule is shared by each user's
+// tunnels to it and applies on top of the user's own rate limit, so
+// whichever is tighter wins.
+type CountryRateLimits struct {
+	rules map[string]RateLimitRule // by ISO country code
+	db    *StatsDB
+
+	mu      sync.Mutex
+	buckets map[countryBucketKey]*userBuckets
+
+	hitsMu sync.Mutex
+	hits   map[countryHitKey]*countryHitAgg
+
+	waitNanos atomic.Int64
+}
+
+type countryBucketKey struct {
+	User, Country string
+}
+
+// countryHitKey counts the tunnels a country's rule paced per hour
+type countryHitKey struct {
+	Country string
+	Hour    string // Local, "2006-01-02T15:00:00"
+}
+
+type countryHitAgg struct {
+	Hits    uint64
+	LastHit time.Time
+}
+
+// NewCountryRateLimits parses proxy.rate_limit.countries. It returns nil
+// without any, which paces nothing.
+func NewCountryRateLimits(config *Config, db *StatsDB) *CountryRateLimits {
+	rules := make(map[string]RateLimitRule)
+	for code, rule := range config.Proxy.RateLimit.Countries {
+		if len(code) != 2 {
+			log.Printf("Rate limit for country %q: not an ISO 3166-1 alpha-2 code, ignored", code)
+			continue
+		}
+		if err := rule.validate(); err != nil {
+			log.Printf("Rate limit for country %s: %v, ignored", code, err)
+			continue
+		}
+		rules[strings.ToUpper(code)] = rule
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	c := &CountryRateLimits{
+		rules:   rules,
+		db:      db,
+		buckets: make(map[countryBucketKey]*userBuckets),
+		hits:    make(map[countryHitKey]*countryHitAgg),
+	}
+	metrics.Counter("https_proxy_country_rate_limit_wait_seconds_total", "Time tunnel reads waited for the rate limit of their target's country.", func() float64 {
+		return time.Duration(c.waitNanos.Load()).Seconds()
+	})
+	return c
+}
+
+// Hit reports whether country has a rule, counting a tunnel paced by it
+// at now for the stats
+func (c *CountryRateLimits) Hit(country string, now time.Time) bool {
+	if c == nil {
+		return false
+	}
+	if _, ok := c.rules[country]; !ok {
+		return false
+	}
+	if c.db == nil {
+		return true
+	}
+	key := countryHitKey{Country: country, Hour: now.Format("2006-01-02T15:00:00")}
+	c.hitsMu.Lock()
+	defer c.hitsMu.Unlock()
+	agg, ok := c.hits[key]
+	if !ok {
+		agg = &countryHitAgg{}
+		c.hits[key] = agg
+	}
+	agg.Hits++
+	if now.After(agg.LastHit) {
+		agg.LastHit = now
+	}
+	return true
+}
+
+// Reader wraps r, read by a tunnel of username to a target in country in
+// the given direction, so its reads draw on the user's bucket for the
+// country. r is returned as is for countries without a rule.
+func (c *CountryRateLimits) Reader(username, country string, upload bool, r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	rule, ok := c.rules[country]
+	if !ok {
+		return r
+	}
+	key := countryBucketKey{User: username, Country: country}
+	c.mu.Lock()
+	b := c.buckets[key]
+	if b == nil {
+		b = &userBuckets{}
+		up, down := rule.directions()
+		b.up.setRate(up)
+		b.down.setRate(down)
+		c.buckets[key] = b
+	}
+	c.mu.Unlock()
+	bucket := &b.down
+	if upload {
+		bucket = &b.up
+	}
+	return &rateLimitedReader{r: r, b: bucket, waited: &c.waitNanos}
+}
+
+// Flush writes the buffered hits. They are kept for the next flush if the
+// write fails.
+func (c *CountryRateLimits) Flush(ctx context.Context) error {
+	if c == nil || c.db == nil {
+		return nil
+	}
+	c.hitsMu.Lock()
+	pending := c.hits
+	c.hits = make(map[countryHitKey]*countryHitAgg)
+	c.hitsMu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := c.db.UpsertCountryRateHits(ctx, pending); err != nil {
+		c.hitsMu.Lock()
+		for key, agg := range pending {
+			if cur, ok := c.hits[key]; ok {
+				cur.Hits += agg.Hits
+				if agg.LastHit.After(cur.LastHit) {
+					cur.LastHit = agg.LastHit
+				}
+			} else {
+				c.hits[key] = agg
+			}
+		}
+		c.hitsMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Run flushes the buffered hits every minute, forever
+func (c *CountryRateLimits) Run() {
+	if c == nil || c.db == nil || c.db.ReadOnly() {
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.Flush(context.Background()); err != nil {
+			log.Printf("Country rate limit hits: %v", err)
+		}
+	}
+}
+
+// CountryRateLimit is a country's rule with the tunnels it paced recently
+type CountryRateLimit struct {
+	Country     string        `json:"country"`
+	Upload      RateDirection `json:"upload"`
+	Download    RateDirection `json:"download"`
+	Hits        uint64        `json:"hits"` // Tunnels, in the window
+	HitsPerHour float64       `json:"hits_per_hour"`
+	LastHit     *time.Time    `json:"last_hit,omitempty"`
+}
+
+// HitRates returns every country's rule with the tunnels it paced in the
+// hours up to now, by country. Hits are only counted with the stats
+// database.
+func (c *CountryRateLimits) HitRates(ctx context.Context, hours int, now time.Time) ([]CountryRateLimit, error) {
+	out := []CountryRateLimit{}
+	if c == nil {
+		return out, nil
+	}
+	var counts map[string]DBCountryRateHits
+	if c.db != nil {
+		if err := c.Flush(ctx); err != nil {
+			log.Printf("Country rate limit hits: %v", err)
+		}
+		var err error
+		since := now.Add(-time.Duration(hours-1) * time.Hour).Format("2006-01-02T15:00:00")
+		if counts, err = c.db.GetCountryRateHits(ctx, since); err != nil {
+			return nil, err
+		}
+	}
+	for country, rule := range c.rules {
+		l := CountryRateLimit{Country: country}
+		l.Upload, l.Download = rule.directions()
+		if h, ok := counts[country]; ok {
+			l.Hits = h.Hits
+			last := h.LastHit
+			l.LastHit = &last
+		}
+		l.HitsPerHour = float64(l.Hits) / float64(hours)
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Country < out[j].Country })
+	return out, nil
+}
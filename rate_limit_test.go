@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUserRateLimits(t *testing.T) {
+	cfg := &Config{}
+	cfg.Proxy.RateLimit = UserRateLimitConfig{
+		Default: RateLimitRule{KBps: 100},
+		Users: map[string]RateLimitRule{
+			"vip-*":  {},
+			"bulk":   {KBps: 10},
+			"team-*": {DownloadKBps: 1000, UploadKBps: 100, UploadBurstKB: 400},
+			"bad":    {UploadKBps: -1},
+		},
+	}
+	l := NewUserRateLimits(cfg, nil)
+	for user, want := range map[string]UserRateLimit{
+		"alice":  {Username: "alice", Upload: RateDirection{100 << 10, 100 << 10}, Download: RateDirection{100 << 10, 100 << 10}, Source: "default"},
+		"vip-eu": {Username: "vip-eu", Source: "vip-*"},
+		"bulk":   {Username: "bulk", Upload: RateDirection{10 << 10, 10 << 10}, Download: RateDirection{10 << 10, 10 << 10}, Source: "bulk"},
+		"team-a": {Username: "team-a", Upload: RateDirection{100 << 10, 400 << 10}, Download: RateDirection{1000 << 10, 1000 << 10}, Source: "team-*"},
+		"bad":    {Username: "bad", Upload: RateDirection{100 << 10, 100 << 10}, Download: RateDirection{100 << 10, 100 << 10}, Source: "default"},
+	} {
+		if got := l.Limit(user); got != want {
+			t.Errorf("Limit(%s) = %+v, want %+v", user, got, want)
+		}
+	}
+
+	// Both tunnels of a user draw on the same bucket: one second's worth
+	// passes at once, the next read waits for it to refill
+	l.Reader("bulk", false, bytes.NewReader(nil))
+	b := &l.buckets["bulk"].down
+	now := time.Now()
+	if wait := b.take(10<<10, now); wait != 0 {
+		t.Errorf("burst waited %v", wait)
+	}
+	if wait := b.take(5<<10, now); wait != 500*time.Millisecond {
+		t.Errorf("second tunnel waits %v, want 500ms", wait)
+	}
+	if wait := b.take(5<<10, now.Add(time.Second)); wait != 0 {
+		t.Errorf("after refilling waits %v", wait)
+	}
+
+	// Changes apply to the open tunnels
+	if err := l.Set("bulk", RateLimitRule{}); err != nil {
+		t.Fatal(err)
+	}
+	if wait := b.take(1<<20, now.Add(2*time.Second)); wait != 0 {
+		t.Errorf("lifted limit waits %v", wait)
+	}
+	if chunk := b.chunk(); chunk != 0 {
+		t.Errorf("unlimited reads capped to %d", chunk)
+	}
+	if err := l.Set("bad[", RateLimitRule{KBps: 1}); err == nil || l.Limit("alice").Source != "default" {
+		t.Errorf("invalid pattern: %v", err)
+	}
+
+	// A user's own rule narrows one direction only
+	up := &l.buckets["bulk"].up
+	if err := l.Set("bulk", RateLimitRule{UploadKBps: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if up.chunk() != 1<<10 || b.chunk() != 0 {
+		t.Errorf("upload chunk %d, download chunk %d", up.chunk(), b.chunk())
+	}
+
+	r := l.Reader("vip-eu", true, bytes.NewReader(make([]byte, 1<<20)))
+	if n, _ := io.Copy(io.Discard, r); n != 1<<20 {
+		t.Errorf("unlimited user copied %d bytes", n)
+	}
+}
+
+func TestV2API_UserRateLimit(t *testing.T) {
+	cfg := &Config{}
+	cfg.Proxy.RateLimit.Default.KBps = 256
+	engine := NewPolicyEngine(cfg, nil, nil)
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, nil, engine, nil)
+	do := func(method, body string) (int, UserRateLimit) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, "/api/v2/users/alice/rate-limit", bytes.NewBufferString(body)))
+		var resp struct {
+			Data UserRateLimit `json:"data"`
+		}
+		json.NewDecoder(rec.Body).Decode(&resp)
+		return rec.Code, resp.Data
+	}
+
+	if code, l := do(http.MethodGet, ""); code != http.StatusOK || l.Download.RateBytes != 256<<10 || l.Source != "default" {
+		t.Errorf("GET: %d %+v", code, l)
+	}
+	if code, l := do(http.MethodPut, `{"kbps": 64, "upload_kbps": 8, "upload_burst_kb": 32}`); code != http.StatusOK ||
+		l.Download != (RateDirection{64 << 10, 64 << 10}) || l.Upload != (RateDirection{8 << 10, 32 << 10}) || l.Source != "alice" {
+		t.Errorf("PUT: %d %+v", code, l)
+	}
+	if code, _ := do(http.MethodPut, `{"download_burst_kb": -1}`); code != http.StatusBadRequest {
+		t.Errorf("negative rate: %d", code)
+	}
+	if code, _ := do(http.MethodPut, `{"kbps": 64, "persist": true}`); code != http.StatusInternalServerError {
+		t.Errorf("persist without a config file: %d", code)
+	}
+	if code, l := do(http.MethodDelete, ""); code != http.StatusOK || l.Source != "default" {
+		t.Errorf("DELETE: %d %+v", code, l)
+	}
+}
+
+func TestCountryRateLimits(t *testing.T) {
+	cfg := &Config{}
+	cfg.Proxy.RateLimit.Countries = map[string]RateLimitRule{
+		"xx":  {DownloadKBps: 10},
+		"YY":  {KBps: 5, UploadKBps: -1},
+		"ZZZ": {KBps: 5},
+	}
+	if NewCountryRateLimits(&Config{}, nil) != nil {
+		t.Error("country rate limits without any configured")
+	}
+	db := newExpiryTestDB(t)
+	c := NewCountryRateLimits(cfg, db)
+	now := time.Now()
+	if !c.Hit("XX", now) || !c.Hit("XX", now) || c.Hit("YY", now) || c.Hit("", now) {
+		t.Fatal("hits")
+	}
+
+	// A user's tunnels to the country share a bucket, others have their own
+	r := bytes.NewReader(nil)
+	if got := c.Reader("alice", "DE", false, r); got != io.Reader(r) {
+		t.Error("country without a rule paced")
+	}
+	c.Reader("alice", "XX", false, r)
+	c.Reader("alice", "XX", false, r)
+	c.Reader("bob", "XX", false, r)
+	b := c.buckets[countryBucketKey{User: "alice", Country: "XX"}]
+	if len(c.buckets) != 2 || b.down.take(10<<10, now) != 0 || b.down.take(5<<10, now) != 500*time.Millisecond {
+		t.Errorf("%d buckets", len(c.buckets))
+	}
+	if chunk := b.up.chunk(); chunk != 0 {
+		t.Errorf("upload capped to %d", chunk)
+	}
+
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, db, &PolicyEngine{CountryLimits: c}, nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/rate-limits/countries?hours=2", nil))
+	var resp struct {
+		Data []CountryRateLimit `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Data) != 1 {
+		t.Fatalf("limits = %+v", resp.Data)
+	}
+	if l := resp.Data[0]; l.Country != "XX" || l.Download.RateBytes != 10<<10 || l.Upload.RateBytes != 0 || l.Hits != 2 || l.HitsPerHour != 1 || l.LastHit == nil {
+		t.Errorf("XX = %+v", l)
+	}
+}
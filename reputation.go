@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reputation actions for tunnels to listed destinations
+const (
+	ReputationFlag  = "flag"  // log, record a user event and mark the tunnel
+	ReputationBlock = "block" // refuse the tunnel
+)
+
+// maxFeedSize caps a downloaded reputation feed
+const maxFeedSize = 64 << 20
+
+// ReputationConfig contains the IP/domain reputation feeds checked against
+// tunnel destinations
+type ReputationConfig struct {
+	Feeds          []ReputationFeed `json:"feeds"`
+	Action         string           `json:"action"`          // Action for feeds without their own (default flag)
+	RefreshMinutes int              `json:"refresh_minutes"` // How often feeds are downloaded again (default 60)
+	ExemptUsers    []string         `json:"exempt_users"`    // Users or CN patterns never checked
+}
+
+// ReputationFeed is a list of IP addresses, CIDR ranges or domains, one per
+// line. Comments after # or ;, hosts-file lines ("0.0.0.0 domain") and JSON
+// lines with a "cidr", "ip" or "domain" field are understood, which covers
+// the abuse.ch and Spamhaus DROP formats.
+type ReputationFeed struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`    // http(s) URL or local file path
+	Action string `json:"action"` // flag or block (default: reputation.action)
+}
+
+// ReputationMatch is a destination found on a feed
+type ReputationMatch struct {
+	Feed   string `json:"feed"`
+	Entry  string `json:"entry"`
+	Action string `json:"action"`
+}
+
+// String describes the match for logs and the connection list
+func (m *ReputationMatch) String() string {
+	return fmt.Sprintf("%s: %s (%s)", m.Feed, m.Entry, m.Action)
+}
+
+// reputationString describes m, or returns "" for no match
+func reputationString(m *ReputationMatch) string {
+	if m == nil {
+		return ""
+	}
+	return m.String()
+}
+
+// FeedStatus is the state of a feed, as shown by /api/v2/reputation
+type FeedStatus struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Action  string    `json:"action"`
+	Entries int       `json:"entries"`
+	Updated time.Time `json:"updated,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// feedList is the parsed content of a feed
+type feedList struct {
+	addrs    map[netip.Addr]bool
+	prefixes []netip.Prefix
+	domains  map[string]bool
+}
+
+func (l *feedList) size() int {
+	return len(l.addrs) + len(l.prefixes) + len(l.domains)
+}
+
+// lookup returns the entry of l that lists host, or ip when host is a name
+func (l *feedList) lookup(host string, ip netip.Addr) (string, bool) {
+	if a, err := netip.ParseAddr(host); err == nil {
+		ip, host = a, ""
+	}
+	if ip.IsValid() {
+		ip = ip.Unmap()
+		if l.addrs[ip] {
+			return ip.String(), true
+		}
+		for _, p := range l.prefixes {
+			if p.Contains(ip) {
+				return p.String(), true
+			}
+		}
+	}
+	// A listed domain covers its subdomains
+	for name := strings.ToLower(strings.TrimSuffix(host, ".")); name != ""; {
+		if l.domains[name] {
+			return name, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return "", false
+}
+
+// parseFeed reads a feed in any of the formats ReputationFeed accepts
+func parseFeed(r io.Reader) (*feedList, error) {
+	l := &feedList{addrs: make(map[netip.Addr]bool), domains: make(map[string]bool)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var entry string
+		if strings.HasPrefix(line, "{") {
+			var obj struct{ CIDR, IP, Domain string }
+			if json.Unmarshal([]byte(line), &obj) != nil {
+				continue
+			}
+			entry = obj.CIDR + obj.IP + obj.Domain
+		} else {
+			if i := strings.IndexAny(line, "#;"); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			entry = fields[0]
+			if len(fields) > 1 && (entry == "0.0.0.0" || entry == "127.0.0.1") {
+				entry = fields[1]
+			}
+		}
+		if p, err := netip.ParsePrefix(entry); err == nil {
+			l.prefixes = append(l.prefixes, p.Masked())
+		} else if a, err := netip.ParseAddr(entry); err == nil {
+			l.addrs[a.Unmap()] = true
+		} else if name := strings.ToLower(strings.TrimSuffix(entry, ".")); strings.Contains(name, ".") {
+			l.domains[name] = true
+		}
+	}
+	return l, scanner.Err()
+}
+
+// ReputationFeeds keeps the reputation feeds up to date and matches tunnel
+// destinations against them
+type ReputationFeeds struct {
+	feeds    []ReputationFeed // with their action resolved
+	exempt   *userPatterns
+	interval time.Duration
+	client   *http.Client
+
+	mu      sync.RWMutex
+	lists   map[string]*feedList // by feed name
+	status  map[string]*FeedStatus
+	matches map[[2]string]uint64 // by feed and action
+}
+
+// NewReputationFeeds parses the reputation settings; it returns nil if no
+// feed is configured. Feeds are loaded by Run.
+func NewReputationFeeds(config *Config) *ReputationFeeds {
+	rc := config.Reputation
+	if len(rc.Feeds) == 0 {
+		return nil
+	}
+	rf := &ReputationFeeds{
+		interval: time.Duration(rc.RefreshMinutes) * time.Minute,
+		client:   &http.Client{Timeout: time.Minute},
+		lists:    make(map[string]*feedList),
+		status:   make(map[string]*FeedStatus),
+		matches:  make(map[[2]string]uint64),
+	}
+	if rf.interval <= 0 {
+		rf.interval = time.Hour
+	}
+	defaultAction := ReputationFlag
+	if rc.Action == ReputationBlock {
+		defaultAction = ReputationBlock
+	} else if rc.Action != "" && rc.Action != ReputationFlag {
+		log.Printf("Reputation action: unknown action %q, using flag", rc.Action)
+	}
+	for i, feed := range rc.Feeds {
+		if feed.Name == "" {
+			feed.Name = fmt.Sprintf("feed%d", i+1)
+		}
+		if _, dup := rf.status[feed.Name]; dup || feed.URL == "" {
+			log.Printf("Reputation feed %s: duplicate name or no url, ignored", feed.Name)
+			continue
+		}
+		switch feed.Action {
+		case ReputationFlag, ReputationBlock:
+		case "":
+			feed.Action = defaultAction
+		default:
+			log.Printf("Reputation feed %s: unknown action %q, using %s", feed.Name, feed.Action, defaultAction)
+			feed.Action = defaultAction
+		}
+		rf.feeds = append(rf.feeds, feed)
+		rf.status[feed.Name] = &FeedStatus{Name: feed.Name, URL: feed.URL, Action: feed.Action}
+	}
+	var err error
+	if rf.exempt, err = newUserPatterns(rc.ExemptUsers); err != nil {
+		log.Printf("Reputation exempt_users: %v", err)
+	}
+
+	metrics.Collect("https_proxy_reputation_entries", "Entries loaded from each reputation feed.", "gauge", func() []MetricSample {
+		var samples []MetricSample
+		for _, st := range rf.Status() {
+			samples = append(samples, MetricSample{Labels: map[string]string{"feed": st.Name}, Value: float64(st.Entries)})
+		}
+		return samples
+	})
+	metrics.Collect("https_proxy_reputation_matches_total", "Tunnels to destinations on a reputation feed, by feed and action.", "counter", func() []MetricSample {
+		rf.mu.RLock()
+		defer rf.mu.RUnlock()
+		keys := make([][2]string, 0, len(rf.matches))
+		for key := range rf.matches {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i][0]+"/"+keys[i][1] < keys[j][0]+"/"+keys[j][1]
+		})
+		samples := make([]MetricSample, 0, len(keys))
+		for _, key := range keys {
+			samples = append(samples, MetricSample{Labels: map[string]string{"feed": key[0], "action": key[1]}, Value: float64(rf.matches[key])})
+		}
+		return samples
+	})
+	return rf
+}
+
+// Run loads the feeds and refreshes them every interval, forever
+func (rf *ReputationFeeds) Run() {
+	if rf == nil {
+		return
+	}
+	rf.Refresh()
+	ticker := time.NewTicker(rf.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		rf.Refresh()
+	}
+}
+
+// Refresh downloads every feed. A feed that fails keeps its previous
+// entries.
+func (rf *ReputationFeeds) Refresh() {
+	for _, feed := range rf.feeds {
+		list, err := rf.fetch(feed.URL)
+		rf.mu.Lock()
+		st := rf.status[feed.Name]
+		if err != nil {
+			st.Error = err.Error()
+			log.Printf("Reputation feed %s: %v", feed.Name, err)
+		} else {
+			rf.lists[feed.Name] = list
+			st.Entries, st.Updated, st.Error = list.size(), time.Now(), ""
+		}
+		rf.mu.Unlock()
+	}
+}
+
+// fetch downloads or reads a feed
+func (rf *ReputationFeeds) fetch(url string) (*feedList, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		f, err := os.Open(url)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseFeed(f)
+	}
+	resp, err := rf.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return parseFeed(io.LimitReader(resp.Body, maxFeedSize))
+}
+
+// Match looks host and the address it resolved to (if known) up on the
+// feeds for username's tunnel. A block match wins over a flag match.
+func (rf *ReputationFeeds) Match(username, host string, ip netip.Addr) *ReputationMatch {
+	if rf == nil {
+		return nil
+	}
+	if _, exempt := rf.exempt.Match(username); exempt {
+		return nil
+	}
+	rf.mu.RLock()
+	defer rf.mu.RUnlock()
+	var found *ReputationMatch
+	for _, feed := range rf.feeds {
+		list := rf.lists[feed.Name]
+		if list == nil {
+			continue
+		}
+		if entry, ok := list.lookup(host, ip); ok {
+			if feed.Action == ReputationBlock {
+				return &ReputationMatch{Feed: feed.Name, Entry: entry, Action: feed.Action}
+			}
+			if found == nil {
+				found = &ReputationMatch{Feed: feed.Name, Entry: entry, Action: feed.Action}
+			}
+		}
+	}
+	return found
+}
+
+// Record counts a match on a tunnel to target, logs it and records it as a
+// user event for security review
+func (rf *ReputationFeeds) Record(reqID, username, target string, m *ReputationMatch, db *StatsDB) {
+	if m == nil {
+		return
+	}
+	rf.mu.Lock()
+	rf.matches[[2]string{m.Feed, m.Action}]++
+	rf.mu.Unlock()
+	log.Printf("[req %s] Reputation match: %s -> %s listed by %s", reqID, username, target, m)
+	if db != nil {
+		db.RecordUserEvent(username, EventReputationMatch, "policy", target+" listed by "+m.String())
+	}
+}
+
+// Status returns the state of every feed
+func (rf *ReputationFeeds) Status() []FeedStatus {
+	if rf == nil {
+		return []FeedStatus{}
+	}
+	rf.mu.RLock()
+	defer rf.mu.RUnlock()
+	out := make([]FeedStatus, 0, len(rf.feeds))
+	for _, feed := range rf.feeds {
+		out = append(out, *rf.status[feed.Name])
+	}
+	return out
+}
+
+// checkReputation blocks requests to destinations on a "block" feed
+func (e *PolicyEngine) checkReputation(req PolicyRequest) PolicyCheck {
+	check := PolicyCheck{Rule: "reputation", Allowed: true}
+	m := e.Reputation.Match(req.Username, req.Host, netip.Addr{})
+	if m == nil {
+		return check
+	}
+	check.Reason = req.Host + " is listed by " + m.String()
+	if m.Action == ReputationBlock {
+		check.Allowed = false
+		check.Code = ErrCodeDestinationBlocked
+		check.Status = http.StatusForbidden
+	}
+	return check
+}
+
+// handleReputation serves /api/v2/reputation: GET returns the feeds and,
+// with ?host=, whether that destination is listed; POST refreshes the feeds
+func handleReputation(w http.ResponseWriter, r *http.Request, rf *ReputationFeeds) {
+	switch r.Method {
+	case http.MethodGet:
+		data := map[string]interface{}{"feeds": rf.Status()}
+		if host := r.URL.Query().Get("host"); host != "" {
+			data["match"] = rf.Match("", host, netip.Addr{})
+		}
+		writeJSONResponse(w, WebResponse{Success: true, Data: data}, http.StatusOK)
+	case http.MethodPost:
+		if rf == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "No reputation feeds configured"}, http.StatusNotFound)
+			return
+		}
+		rf.Refresh()
+		writeJSONResponse(w, WebResponse{Success: true, Data: rf.Status()}, http.StatusOK)
+	default:
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+	}
+}
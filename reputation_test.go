@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFeed(t *testing.T) {
+	feed := `# Spamhaus DROP
+1.10.16.0/20 ; SBL256894
+{"cidr":"2001:db8::/32","sblid":"SBL1"}
+# abuse.ch
+198.51.100.7
+0.0.0.0 malware.example.
+127.0.0.1	phish.example.org # comment
+bad.example.net
+garbage
+`
+	l, err := parseFeed(strings.NewReader(feed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.size() != 6 {
+		t.Errorf("entries = %d, want 6", l.size())
+	}
+	tests := []struct {
+		host  string
+		ip    string
+		entry string
+	}{
+		{"1.10.20.30", "", "1.10.16.0/20"},
+		{"cdn.example.com", "1.10.31.255", "1.10.16.0/20"},
+		{"2001:db8::1", "", "2001:db8::/32"},
+		{"host", "::ffff:198.51.100.7", "198.51.100.7"},
+		{"www.MALWARE.example", "", "malware.example"},
+		{"phish.example.org", "", "phish.example.org"},
+		{"example.org", "", ""},
+		{"notmalware.example", "", ""},
+		{"1.10.32.0", "", ""},
+	}
+	for _, tt := range tests {
+		var ip netip.Addr
+		if tt.ip != "" {
+			ip = netip.MustParseAddr(tt.ip)
+		}
+		if entry, _ := l.lookup(tt.host, ip); entry != tt.entry {
+			t.Errorf("lookup(%s, %s) = %q, want %q", tt.host, tt.ip, entry, tt.entry)
+		}
+	}
+}
+
+func TestReputationPolicy(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "flag.txt"), []byte("192.0.2.0/24\nflagged.example\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "block.txt"), []byte("blocked.example\n192.0.2.66\n"), 0644)
+	cfg := &Config{}
+	cfg.Reputation = ReputationConfig{
+		Feeds: []ReputationFeed{
+			{Name: "watch", URL: filepath.Join(dir, "flag.txt")},
+			{Name: "drop", URL: filepath.Join(dir, "block.txt"), Action: ReputationBlock},
+			{Name: "missing", URL: filepath.Join(dir, "none.txt")},
+		},
+		ExemptUsers: []string{"sec-*"},
+	}
+	engine := NewPolicyEngine(cfg, nil, nil)
+	engine.Reputation.Refresh()
+
+	d := engine.Evaluate(PolicyRequest{Username: "alice", Host: "www.blocked.example"})
+	if d.Allowed || d.Blocking.Rule != "reputation" || d.Blocking.Code != ErrCodeDestinationBlocked {
+		t.Fatalf("expected reputation block, got %+v", d.Blocking)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "sec-team", Host: "blocked.example"}); !d.Allowed {
+		t.Error("exempt user blocked")
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "alice", Host: "flagged.example"}); !d.Allowed {
+		t.Error("flag feed blocked the request")
+	}
+
+	// The resolved address is checked too, and a block feed wins
+	if m := engine.Reputation.Match("alice", "cdn.example", netip.MustParseAddr("192.0.2.66")); m == nil || m.Feed != "drop" {
+		t.Errorf("match = %+v", m)
+	}
+	if m := engine.Reputation.Match("alice", "cdn.example", netip.MustParseAddr("192.0.2.1")); m == nil || m.Action != ReputationFlag {
+		t.Errorf("match = %+v", m)
+	}
+
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, nil, engine, nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/reputation?host=flagged.example", nil))
+	var resp struct {
+		Data struct {
+			Feeds []FeedStatus     `json:"feeds"`
+			Match *ReputationMatch `json:"match"`
+		} `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	feeds := resp.Data.Feeds
+	if len(feeds) != 3 || feeds[0].Entries != 2 || feeds[2].Error == "" || resp.Data.Match == nil || resp.Data.Match.Feed != "watch" {
+		t.Errorf("reputation = %+v", resp.Data)
+	}
+}
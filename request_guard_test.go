@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMalformedRequest(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want string
+	}{
+		{"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", ""},
+		{"CONNECT [2001:db8::1]:443 HTTP/1.1\r\nHost: [2001:db8::1]:443\r\n\r\n", ""},
+		{"CONNECT example.com:443 HTTP/1.1\r\n\r\n", ""},
+		{"CONNECT example.com:443 HTTP/1.1\r\nHost: EXAMPLE.com\r\n\r\n", ""},
+		{"CONNECT /internal HTTP/1.1\r\nHost: example.com:443\r\n\r\n", MalformedConnectTarget},
+		{"CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n", MalformedConnectTarget},
+		{"CONNECT example.com:0 HTTP/1.1\r\n\r\n", MalformedConnectTarget},
+		{"CONNECT example.com:65536 HTTP/1.1\r\n\r\n", MalformedConnectTarget},
+		{"CONNECT user@example.com:443 HTTP/1.1\r\n\r\n", MalformedConnectTarget},
+		{"CONNECT :443 HTTP/1.1\r\n\r\n", MalformedConnectTarget},
+		{"CONNECT example.com:443 HTTP/1.1\r\nHost: internal.example.net:443\r\n\r\n", ""}, // Host is ignored
+		{"CONNECT example.com:443 HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello", MalformedConnectBody},
+		{"CONNECT example.com:443 HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", MalformedConnectBody},
+		{"GET * HTTP/1.1\r\nHost: example.com\r\n\r\n", MalformedAsteriskForm},
+		{"OPTIONS * HTTP/1.1\r\nHost: example.com\r\n\r\n", ""},
+		{"GET http://example.com/x HTTP/1.1\r\nHost: example.com\r\n\r\n", ""},
+	} {
+		r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tc.raw)))
+		if err != nil {
+			t.Fatalf("%q: %v", tc.raw, err)
+		}
+		if got := malformedRequest(r); got != tc.want {
+			t.Errorf("%q: reason %q, want %q", tc.raw, got, tc.want)
+		}
+	}
+}
+
+// TestProxy_SmugglingPayloads sends known smuggling payloads to the front
+// listener: each must be refused, or forwarded with framing of the proxy's
+// own, never reaching the camouflage site as a request of its own.
+func TestProxy_SmugglingPayloads(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		seen = append(seen, r.Method+" "+r.RequestURI+" "+string(body))
+		mu.Unlock()
+		w.Write([]byte("site"))
+	}))
+	defer site.Close()
+
+	p, _ := newErrorTestProxy(t)
+	p.Config.Proxy.DefaultSite = site.URL
+	front := httptest.NewUnstartedServer(p)
+	front.Config.MaxHeaderBytes = 1024
+	front.Start()
+	defer front.Close()
+
+	// send writes raw on a fresh connection and returns the status of each
+	// response read before the proxy closes it
+	send := func(raw string) []int {
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.WriteString(conn, raw); err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(conn)
+		var statuses []int
+		for {
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				return statuses
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			statuses = append(statuses, resp.StatusCode)
+			if resp.Close {
+				return statuses
+			}
+		}
+	}
+	smuggled := "GET /smuggled HTTP/1.1\r\nHost: x\r\n\r\n"
+
+	before := malformedRequests[MalformedConnectTarget].Load()
+	for _, tc := range []struct {
+		name string
+		raw  string
+		want int
+	}{
+		{"CL.CL", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\nContent-Length: 37\r\n\r\n" + smuggled, http.StatusBadRequest},
+		{"TE obfuscated value", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 37\r\nTransfer-Encoding: xchunked\r\n\r\n" + smuggled, http.StatusNotImplemented},
+		{"TE chunked then identity", "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked, identity\r\n\r\n0\r\n\r\n" + smuggled, http.StatusNotImplemented},
+		{"TE space before colon", "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 37\r\nTransfer-Encoding : chunked\r\n\r\n" + smuggled, http.StatusBadRequest},
+		{"duplicate Host", "GET / HTTP/1.1\r\nHost: x\r\nHost: y\r\n\r\n", http.StatusBadRequest},
+		{"oversized headers", "GET / HTTP/1.1\r\nHost: x\r\nX-Pad: " + strings.Repeat("a", 8192) + "\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"CONNECT path form", "CONNECT /smuggled HTTP/1.1\r\nHost: example.com:443\r\n\r\n", http.StatusBadRequest},
+		{"CONNECT with body", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nContent-Length: 37\r\n\r\n" + smuggled, http.StatusBadRequest},
+		{"asterisk form", "GET * HTTP/1.1\r\nHost: x\r\n\r\n", http.StatusBadRequest},
+	} {
+		if got := send(tc.raw); len(got) != 1 || got[0] != tc.want {
+			t.Errorf("%s: statuses %v, want [%d] and the connection closed", tc.name, got, tc.want)
+		}
+	}
+	if n := malformedRequests[MalformedConnectTarget].Load() - before; n != 1 {
+		t.Errorf("connect_target counted %d times, want 1", n)
+	}
+	mu.Lock()
+	if len(seen) != 0 {
+		t.Errorf("refused payloads reached the site: %q", seen)
+	}
+	mu.Unlock()
+
+	// CL.TE: chunked wins, Content-Length is dropped and the connection
+	// closed, so what follows the body is never read as a request
+	got := send("POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n" + smuggled)
+	if len(got) != 1 || got[0] != http.StatusOK {
+		t.Errorf("CL.TE: statuses %v, want [200] and the connection closed", got)
+	}
+	// An absolute-form target only passes its path to the site
+	send("GET http://internal.example.net/path?q=1 HTTP/1.1\r\nHost: internal.example.net\r\nConnection: close\r\n\r\n")
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"POST / ", "GET /path?q=1 "}
+	if strings.Join(seen, "|") != strings.Join(want, "|") {
+		t.Errorf("site saw %q, want %q", seen, want)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+type requestIDKey struct{}
+
+// newRequestID returns a random identifier for a request or tunnel
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestID attaches a new request id to r. The id appears in the log
+// lines, error responses and tunnel listing of the request so a failure a
+// user reports can be found in every subsystem.
+func withRequestID(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, newRequestID()))
+}
+
+// requestID returns the id attached by withRequestID, or a fresh one for
+// requests that did not pass through the proxy handler
+func requestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return newRequestID()
+}
@@ -0,0 +1,207 @@
+// Command geodata builds the IP-to-country dataset embedded in https-proxy
+// (geodata/countries.bin.gz) from free CSV datasets, such as IP2Location
+// LITE DB1 (IPv4 and IPv6 files) or DB-IP IP to Country Lite. Each line
+// holds the first and last address of a range, as addresses or decimal
+// numbers, then the country code:
+//
+//	go run ./scripts/geodata -source "IP2Location LITE https://lite.ip2location.com" \
+//		-out geodata/countries.bin.gz IP2LOCATION-LITE-DB1.CSV IP2LOCATION-LITE-DB1.IPV6.CSV
+//
+// Without input files it writes an empty dataset.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	magic = "HPGEO1"
+	none  = 0xFFFF
+)
+
+// span is an address range of a country; IPv6 addresses are cut to their
+// first 64 bits
+type span struct {
+	first, last uint64
+	code        string
+}
+
+// entry starts a range of the dataset
+type entry struct {
+	first   uint64
+	country uint16
+}
+
+func main() {
+	out := flag.String("out", "geodata/countries.bin.gz", "dataset to write")
+	source := flag.String("source", "", "attribution of the input data, kept in the dataset")
+	flag.Parse()
+
+	var v4, v6 []span
+	for _, path := range flag.Args() {
+		a, b, err := readCSV(path)
+		if err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
+		v4, v6 = append(v4, a...), append(v6, b...)
+	}
+	if len(*source) > math.MaxUint8 {
+		log.Fatalf("-source is longer than %d bytes", math.MaxUint8)
+	}
+
+	codes := map[string]uint16{}
+	var names []string
+	index := func(code string) uint16 {
+		if i, ok := codes[code]; ok {
+			return i
+		}
+		codes[code] = uint16(len(names))
+		names = append(names, code)
+		return codes[code]
+	}
+	e4 := build(v4, math.MaxUint32, index)
+	e6 := build(v6, math.MaxUint64, index)
+	if len(names) >= none {
+		log.Fatalf("%d countries, at most %d fit", len(names), none-1)
+	}
+
+	var raw bytes.Buffer
+	raw.WriteString(magic)
+	write := func(v any) { binary.Write(&raw, binary.BigEndian, v) }
+	write(time.Now().Unix())
+	write(uint8(len(*source)))
+	raw.WriteString(*source)
+	write(uint16(len(names)))
+	for _, code := range names {
+		raw.WriteString(code)
+	}
+	write(uint32(len(e4)))
+	for _, e := range e4 {
+		write(uint32(e.first))
+		write(e.country)
+	}
+	write(uint32(len(e6)))
+	for _, e := range e6 {
+		write(e.first)
+		write(e.country)
+	}
+
+	var gz bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+	zw.Write(raw.Bytes())
+	zw.Close()
+	if err := os.WriteFile(*out, gz.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%s: %d countries, %d IPv4 and %d IPv6 ranges, %d bytes", *out, len(names), len(e4), len(e6), gz.Len())
+}
+
+// build sorts the spans and turns them into range starts, merging
+// neighbours of the same country and marking the gaps between them
+func build(spans []span, max uint64, index func(string) uint16) []entry {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].first < spans[j].first })
+	var out []entry
+	next := uint64(0) // First address not covered yet
+	done := false     // The last span reached max
+	for _, s := range spans {
+		if done || s.last < next {
+			continue // within a range already covered, e.g. after IPv6 truncation
+		}
+		if s.first < next {
+			s.first = next
+		}
+		if s.first > next {
+			out = append(out, entry{next, none})
+		}
+		country := index(s.code)
+		if len(out) == 0 || out[len(out)-1].country != country {
+			out = append(out, entry{s.first, country})
+		}
+		if s.last == max {
+			done = true
+		} else {
+			next = s.last + 1
+		}
+	}
+	if !done && len(out) > 0 {
+		out = append(out, entry{next, none})
+	}
+	return out
+}
+
+// readCSV reads the IPv4 and IPv6 spans of a CSV file. Unassigned ranges
+// ("-" or an empty code) are left out.
+func readCSV(path string) (v4, v6 []span, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return v4, v6, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rec) < 3 {
+			return nil, nil, fmt.Errorf("line %d: want first, last, country", line)
+		}
+		code := strings.ToUpper(strings.TrimSpace(rec[2]))
+		if code == "-" || code == "" || code == "ZZ" {
+			continue
+		}
+		if len(code) != 2 {
+			return nil, nil, fmt.Errorf("line %d: country code %q", line, code)
+		}
+		first, err1 := parseAddr(rec[0])
+		last, err2 := parseAddr(rec[1])
+		if err := errors.Join(err1, err2); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if f4, l4 := first.To4(), last.To4(); f4 != nil && l4 != nil {
+			v4 = append(v4, span{uint64(binary.BigEndian.Uint32(f4)), uint64(binary.BigEndian.Uint32(l4)), code})
+		} else if f4 == nil && l4 == nil {
+			v6 = append(v6, span{binary.BigEndian.Uint64(first[:8]), binary.BigEndian.Uint64(last[:8]), code})
+		} else {
+			return nil, nil, fmt.Errorf("line %d: range mixes IPv4 and IPv6", line)
+		}
+	}
+}
+
+// parseAddr reads an address written out or as a decimal number. Numbers
+// below 2^32, and IPv4-mapped ones, are IPv4 addresses.
+func parseAddr(s string) (net.IP, error) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, nil
+	}
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 128 {
+		return nil, fmt.Errorf("address %q", s)
+	}
+	ip := make(net.IP, net.IPv6len)
+	n.FillBytes(ip)
+	if n.BitLen() <= 32 {
+		return net.IPv4(ip[12], ip[13], ip[14], ip[15]), nil
+	}
+	return ip, nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config values holding keys and passwords may refer to the secret instead
+// of containing it:
+//
+//	env:NAME          the environment variable NAME
+//	file:/path        the file's contents, refused if group or others can read it
+//	vault:path#field  a field of a HashiCorp Vault KV secret, v1 or v2
+//	                  (e.g. vault:secret/data/proxy#pseudonym_secret)
+//
+// Other values are used as they are. Key paths (server.certificates.key_path,
+// ca_key_path, ...) take references too, resolving to the PEM key itself.
+const (
+	secretEnvPrefix   = "env:"
+	secretFilePrefix  = "file:"
+	secretVaultPrefix = "vault:"
+)
+
+// SecretsConfig configures where vault: references are fetched from
+type SecretsConfig struct {
+	Vault struct {
+		Address      string `json:"address"`       // Default $VAULT_ADDR
+		Token        string `json:"token"`         // Default $VAULT_TOKEN; may be an env: or file: reference
+		Namespace    string `json:"namespace"`     // Vault Enterprise namespace, if any
+		RenewMinutes int    `json:"renew_minutes"` // How often the token is renewed and secrets re-read (default 30)
+	} `json:"vault"`
+}
+
+// secretStore resolves secret references and caches the values, so a
+// reference is fetched once and then refreshed by renew
+type secretStore struct {
+	mu     sync.RWMutex
+	config SecretsConfig
+	values map[string][]byte // by reference
+	client *http.Client
+	renew  sync.Once
+}
+
+// secrets resolves the references of the loaded configuration
+var secrets = &secretStore{
+	values: make(map[string][]byte),
+	client: &http.Client{Timeout: 10 * time.Second},
+}
+
+// isSecretRef reports whether v refers to a secret rather than being one
+func isSecretRef(v string) bool {
+	return strings.HasPrefix(v, secretEnvPrefix) || strings.HasPrefix(v, secretFilePrefix) || strings.HasPrefix(v, secretVaultPrefix)
+}
+
+// Configure sets where vault: references are fetched from
+func (s *secretStore) Configure(cfg SecretsConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = cfg
+}
+
+// Resolve returns the secret v refers to, or v itself if it is no reference
+func (s *secretStore) Resolve(v string) ([]byte, error) {
+	if !isSecretRef(v) {
+		return []byte(v), nil
+	}
+	s.mu.RLock()
+	value, ok := s.values[v]
+	s.mu.RUnlock()
+	if ok {
+		return value, nil
+	}
+	value, err := s.fetch(v)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.values[v] = value
+	s.mu.Unlock()
+	if strings.HasPrefix(v, secretVaultPrefix) {
+		s.renew.Do(func() { go s.renewLoop() })
+	}
+	return value, nil
+}
+
+func (s *secretStore) fetch(ref string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(ref, secretEnvPrefix):
+		name := strings.TrimPrefix(ref, secretEnvPrefix)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		return []byte(value), nil
+	case strings.HasPrefix(ref, secretFilePrefix):
+		return readSecretFile(strings.TrimPrefix(ref, secretFilePrefix))
+	default:
+		path, field, ok := strings.Cut(strings.TrimPrefix(ref, secretVaultPrefix), "#")
+		if !ok || path == "" || field == "" {
+			return nil, fmt.Errorf("%s: want vault:path#field", ref)
+		}
+		return s.vaultRead(path, field)
+	}
+}
+
+// readSecretFile reads a secret file that only its owner may read. A
+// trailing newline, as left by most editors, is not part of the secret.
+func readSecretFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	// Windows has no Unix permission bits to check
+	if perm := info.Mode().Perm(); runtime.GOOS != "windows" && perm&0077 != 0 {
+		return nil, fmt.Errorf("%s can be read by group or others (mode %04o); chmod 600 it", path, perm)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(data, "\r\n"), nil
+}
+
+// readKeyFile reads a PEM key from keyPath, which may be a secret reference
+func readKeyFile(keyPath string) ([]byte, error) {
+	if isSecretRef(keyPath) {
+		return secrets.Resolve(keyPath)
+	}
+	return os.ReadFile(keyPath)
+}
+
+// loadKeyPair is tls.LoadX509KeyPair with the key read by readKeyFile
+func loadKeyPair(certPath, keyPath string) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := readKeyFile(keyPath)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// secretValue returns the secret a config value refers to. References are
+// checked when the config is loaded, so a failure here only follows a
+// secret that has since gone away; it is logged and the value is empty.
+func secretValue(v string) string {
+	value, err := secrets.Resolve(v)
+	if err != nil {
+		log.Printf("Secrets: %v", err)
+		return ""
+	}
+	return string(value)
+}
+
+// checkSecrets resolves every secret reference of the configuration, so a
+// missing or unreadable secret stops startup instead of a later request
+func (cfg *Config) checkSecrets() error {
+	fields := map[string]string{
+		"server.certificates.key_path":    cfg.Server.Certificates.KeyPath,
+		"admin.pseudonym_secret":          cfg.Admin.PseudonymSecret,
+		"gate.token_secret":               cfg.Gate.TokenSecret,
+		"provisioning.ca_key_path":        cfg.Provisioning.CAKeyPath,
+		"trials.ca_key_path":              cfg.Trials.CAKeyPath,
+		"stats.archive.secret_access_key": cfg.Stats.Archive.SecretAccessKey,
+	}
+	if cfg.Admin.Certificates != nil {
+		fields["admin.certificates.key_path"] = cfg.Admin.Certificates.KeyPath
+	}
+	for name, v := range fields {
+		if _, err := secrets.Resolve(v); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// vaultRequest calls the Vault HTTP API
+func (s *secretStore) vaultRequest(method, path string) (map[string]interface{}, error) {
+	s.mu.RLock()
+	vc := s.config.Vault
+	s.mu.RUnlock()
+	addr := vc.Address
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return nil, errors.New("vault address not set (secrets.vault.address or VAULT_ADDR)")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if vc.Token != "" {
+		if strings.HasPrefix(vc.Token, secretVaultPrefix) {
+			return nil, errors.New("the vault token cannot itself come from vault")
+		}
+		t, err := s.Resolve(vc.Token)
+		if err != nil {
+			return nil, fmt.Errorf("vault token: %v", err)
+		}
+		token = string(t)
+	}
+	if token == "" {
+		return nil, errors.New("vault token not set (secrets.vault.token or VAULT_TOKEN)")
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if vc.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vc.Namespace)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("vault: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault %s %s: %s", method, path, resp.Status)
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, fmt.Errorf("vault %s: %v", path, err)
+	}
+	return out, nil
+}
+
+// vaultRead returns a string field of a KV secret
+func (s *secretStore) vaultRead(path, field string) ([]byte, error) {
+	out, err := s.vaultRequest(http.MethodGet, path)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := out["data"].(map[string]interface{})
+	// KV v2 nests the secret under data.data, beside data.metadata
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, v2 := data["metadata"]; v2 {
+			data = inner
+		}
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("vault %s has no string field %q", path, field)
+	}
+	return []byte(value), nil
+}
+
+// renewLoop keeps the Vault token alive and re-reads the cached vault:
+// secrets, so components reading a secret on use (CA keys for issuing
+// certificates) pick up rotated values. Failures keep the cached values.
+func (s *secretStore) renewLoop() {
+	s.mu.RLock()
+	minutes := s.config.Vault.RenewMinutes
+	s.mu.RUnlock()
+	ticker := time.NewTicker(time.Duration(firstPositive(minutes, 30)) * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.renewOnce()
+	}
+}
+
+func (s *secretStore) renewOnce() {
+	if _, err := s.vaultRequest(http.MethodPost, "auth/token/renew-self"); err != nil {
+		log.Printf("Secrets: renewing vault token: %v", err)
+	}
+	s.mu.RLock()
+	var refs []string
+	for ref := range s.values {
+		if strings.HasPrefix(ref, secretVaultPrefix) {
+			refs = append(refs, ref)
+		}
+	}
+	s.mu.RUnlock()
+	changed := 0
+	for _, ref := range refs {
+		value, err := s.fetch(ref)
+		if err != nil {
+			log.Printf("Secrets: refreshing %s: %v", ref, err)
+			continue
+		}
+		s.mu.Lock()
+		if !bytes.Equal(s.values[ref], value) {
+			s.values[ref] = value
+			changed++
+		}
+		s.mu.Unlock()
+	}
+	if changed > 0 {
+		log.Printf("Secrets: %d vault secrets changed", changed)
+	}
+}
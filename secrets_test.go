@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func newTestSecretStore() *secretStore {
+	return &secretStore{values: make(map[string][]byte), client: &http.Client{Timeout: time.Second}}
+}
+
+func TestSecretStore_EnvAndFile(t *testing.T) {
+	s := newTestSecretStore()
+	t.Setenv("PROXY_TEST_SECRET", "from-env")
+	if v, err := s.Resolve("env:PROXY_TEST_SECRET"); err != nil || string(v) != "from-env" {
+		t.Errorf("env: %q, %v", v, err)
+	}
+	if _, err := s.Resolve("env:PROXY_TEST_UNSET"); err == nil {
+		t.Error("unset variable resolved")
+	}
+	if v, _ := s.Resolve("plain"); string(v) != "plain" {
+		t.Errorf("plain value = %q", v)
+	}
+
+	path := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(path, []byte("from-file\n"), 0600)
+	if v, err := s.Resolve("file:" + path); err != nil || string(v) != "from-file" {
+		t.Errorf("file: %q, %v", v, err)
+	}
+	if runtime.GOOS != "windows" {
+		open := filepath.Join(t.TempDir(), "open")
+		os.WriteFile(open, []byte("x"), 0644)
+		if _, err := s.Resolve("file:" + open); err == nil {
+			t.Error("world-readable secret file accepted")
+		}
+	}
+}
+
+func TestSecretStore_Vault(t *testing.T) {
+	value := "v1"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/proxy":
+			w.Write([]byte(`{"data":{"data":{"gate":"` + value + `"},"metadata":{"version":1}}}`))
+		case "/v1/kv/proxy":
+			w.Write([]byte(`{"data":{"gate":"kv1"}}`))
+		case "/v1/auth/token/renew-self":
+			w.Write([]byte(`{"auth":{"client_token":"root"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	s := newTestSecretStore()
+	s.renew.Do(func() {}) // renewal is driven by hand below
+	var cfg SecretsConfig
+	cfg.Vault.Address = srv.URL
+	cfg.Vault.Token = "env:PROXY_TEST_VAULT_TOKEN"
+	t.Setenv("PROXY_TEST_VAULT_TOKEN", "root")
+	s.Configure(cfg)
+
+	if v, err := s.Resolve("vault:secret/data/proxy#gate"); err != nil || string(v) != "v1" {
+		t.Errorf("kv v2: %q, %v", v, err)
+	}
+	if v, err := s.Resolve("vault:kv/proxy#gate"); err != nil || string(v) != "kv1" {
+		t.Errorf("kv v1: %q, %v", v, err)
+	}
+	if _, err := s.Resolve("vault:secret/data/proxy#missing"); err == nil {
+		t.Error("missing field resolved")
+	}
+
+	// Renewal picks up a rotated value
+	value = "v2"
+	s.renewOnce()
+	if v, _ := s.Resolve("vault:secret/data/proxy#gate"); string(v) != "v2" {
+		t.Errorf("after renewal: %q, want v2", v)
+	}
+}
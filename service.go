@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+const (
+	serviceName        = "https-proxy"
+	serviceDisplayName = "HTTPS Proxy"
+	serviceDescription = "Certificate-authenticated HTTPS proxy server"
+	launchdLabel       = "com.proxy.https"
+	launchdPlistPath   = "/Library/LaunchDaemons/" + launchdLabel + ".plist"
+)
+
+// serviceCommand returns the absolute executable path and the arguments the
+// supervisor should start it with
+func serviceCommand(configPath string) (string, []string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", nil, fmt.Errorf("locate executable: %v", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", nil, fmt.Errorf("resolve executable: %v", err)
+	}
+	absConfig, err := filepath.Abs(configPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("resolve config path: %v", err)
+	}
+	return exe, []string{"-config", absConfig}, nil
+}
+
+// launchdPlistTemplate escapes every value, since paths may contain XML
+// metacharacters such as &
+var launchdPlistTemplate = template.Must(template.New("plist").Funcs(template.FuncMap{
+	"xml": func(s string) (string, error) {
+		var buf bytes.Buffer
+		err := xml.EscapeText(&buf, []byte(s))
+		return buf.String(), err
+	},
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+    <key>Label</key>
+    <string>{{xml .Label}}</string>
+    <key>ProgramArguments</key>
+    <array>
+        <string>{{xml .Exe}}</string>
+{{- range .Args}}
+        <string>{{xml .}}</string>
+{{- end}}
+    </array>
+    <key>RunAtLoad</key>
+    <true/>
+    <key>KeepAlive</key>
+    <true/>
+    <key>WorkingDirectory</key>
+    <string>{{xml .WorkDir}}</string>
+    <key>StandardErrorPath</key>
+    <string>/var/log/https-proxy/error.log</string>
+    <key>StandardOutPath</key>
+    <string>/var/log/https-proxy/output.log</string>
+    <key>ThrottleInterval</key>
+    <integer>5</integer>
+</dict>
+</plist>
+`))
+
+// launchdPlist generates a launchd daemon definition that runs this binary
+// with the given config, matching deploy/launchd/com.proxy.https.plist
+func launchdPlist(configPath string) ([]byte, error) {
+	exe, args, err := serviceCommand(configPath)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = launchdPlistTemplate.Execute(&buf, struct {
+		Label   string
+		Exe     string
+		Args    []string
+		WorkDir string
+	}{launchdLabel, exe, args, filepath.Dir(exe)})
+	return buf.Bytes(), err
+}
+
+// ControlService handles the -service flag. "plist" prints a launchd
+// definition on any platform; install/uninstall/start/stop are implemented
+// per platform.
+func ControlService(action, configPath string) error {
+	if action == "plist" {
+		plist, err := launchdPlist(configPath)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(plist)
+		return err
+	}
+
+	switch action {
+	case "install", "uninstall", "start", "stop":
+		return controlPlatformService(action, configPath)
+	default:
+		return fmt.Errorf("unknown service action %q (want install, uninstall, start, stop, or plist)", action)
+	}
+}
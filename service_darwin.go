@@ -0,0 +1,55 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// controlPlatformService manages the launchd daemon definition
+func controlPlatformService(action, configPath string) error {
+	switch action {
+	case "install":
+		plist, err := launchdPlist(configPath)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll("/var/log/https-proxy", 0755); err != nil {
+			return fmt.Errorf("create log directory: %v", err)
+		}
+		if err := os.WriteFile(launchdPlistPath, plist, 0644); err != nil {
+			return fmt.Errorf("write %s: %v", launchdPlistPath, err)
+		}
+		fmt.Printf("Installed %s\n", launchdPlistPath)
+		return launchctl("load", "-w", launchdPlistPath)
+	case "uninstall":
+		launchctl("unload", "-w", launchdPlistPath)
+		if err := os.Remove(launchdPlistPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s: %v", launchdPlistPath, err)
+		}
+		fmt.Printf("Removed %s\n", launchdPlistPath)
+		return nil
+	case "start":
+		return launchctl("start", launchdLabel)
+	case "stop":
+		return launchctl("stop", launchdLabel)
+	}
+	return nil
+}
+
+func launchctl(args ...string) error {
+	cmd := exec.Command("launchctl", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("launchctl %v: %v", args, err)
+	}
+	return nil
+}
+
+// runAsService is a no-op: launchd supervises the process directly
+func runAsService(run func()) bool {
+	return false
+}
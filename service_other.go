@@ -0,0 +1,16 @@
+//go:build !windows && !darwin
+
+package main
+
+import "fmt"
+
+// controlPlatformService is not implemented here; Linux hosts use the
+// systemd unit in deploy/systemd
+func controlPlatformService(action, configPath string) error {
+	return fmt.Errorf("-service %s is not supported on this platform; use deploy/systemd/https-proxy.service", action)
+}
+
+// runAsService is a no-op: the process is supervised externally
+func runAsService(run func()) bool {
+	return false
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLaunchdPlist(t *testing.T) {
+	// A directory name with XML metacharacters must still yield a valid plist
+	dir := filepath.Join(t.TempDir(), "R&D <proxy>")
+	configPath := filepath.Join(dir, "config.json")
+
+	plist, err := launchdPlist(configPath)
+	if err != nil {
+		t.Fatalf("launchdPlist: %v", err)
+	}
+
+	var doc struct {
+		Dict struct {
+			Keys    []string `xml:"key"`
+			Strings []string `xml:"string"`
+			Args    []string `xml:"array>string"`
+		} `xml:"dict"`
+	}
+	if err := xml.Unmarshal(plist, &doc); err != nil {
+		t.Fatalf("plist is not valid XML: %v\n%s", err, plist)
+	}
+
+	exe, _ := os.Executable()
+	exe, _ = filepath.EvalSymlinks(exe)
+	wantArgs := []string{exe, "-config", configPath}
+	if strings.Join(doc.Dict.Args, "\n") != strings.Join(wantArgs, "\n") {
+		t.Errorf("ProgramArguments = %q, want %q", doc.Dict.Args, wantArgs)
+	}
+	if len(doc.Dict.Strings) < 2 || doc.Dict.Strings[0] != launchdLabel || doc.Dict.Strings[1] != filepath.Dir(exe) {
+		t.Errorf("Label/WorkingDirectory = %q, want %q and %q", doc.Dict.Strings, launchdLabel, filepath.Dir(exe))
+	}
+	for _, key := range []string{"Label", "ProgramArguments", "RunAtLoad", "KeepAlive", "WorkingDirectory"} {
+		found := false
+		for _, k := range doc.Dict.Keys {
+			found = found || k == key
+		}
+		if !found {
+			t.Errorf("plist is missing key %s", key)
+		}
+	}
+}
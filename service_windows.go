@@ -0,0 +1,158 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// controlPlatformService manages the Windows service registration
+func controlPlatformService(action, configPath string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect to service manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	if action == "install" {
+		exe, args, err := serviceCommand(configPath)
+		if err != nil {
+			return err
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: serviceDisplayName,
+			Description: serviceDescription,
+			StartType:   mgr.StartAutomatic,
+		}, args...)
+		if err != nil {
+			return fmt.Errorf("create service: %v", err)
+		}
+		defer s.Close()
+		if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			s.Delete()
+			return fmt.Errorf("register event log source: %v", err)
+		}
+		fmt.Printf("Service %s installed\n", serviceName)
+		return nil
+	}
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("open service %s: %v", serviceName, err)
+	}
+	defer s.Close()
+
+	switch action {
+	case "uninstall":
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("delete service: %v", err)
+		}
+		eventlog.Remove(serviceName)
+		fmt.Printf("Service %s uninstalled\n", serviceName)
+	case "start":
+		if err := s.Start(); err != nil {
+			return fmt.Errorf("start service: %v", err)
+		}
+		fmt.Printf("Service %s started\n", serviceName)
+	case "stop":
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return fmt.Errorf("stop service: %v", err)
+		}
+		for deadline := time.Now().Add(30 * time.Second); status.State != svc.Stopped; {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out waiting for service to stop")
+			}
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				return fmt.Errorf("query service: %v", err)
+			}
+		}
+		fmt.Printf("Service %s stopped\n", serviceName)
+	}
+	return nil
+}
+
+// eventLogWriter sends each log line to the Windows event log
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\r\n")
+	if strings.Contains(strings.ToLower(msg), "error") || strings.Contains(msg, "failed") {
+		w.elog.Error(1, msg)
+	} else {
+		w.elog.Info(1, msg)
+	}
+	return len(p), nil
+}
+
+// serviceStopTimeout bounds how long a stop request waits for shutdown
+const serviceStopTimeout = 30 * time.Second
+
+// proxyService adapts the proxy to the Windows service control handler
+type proxyService struct {
+	run func()
+}
+
+func (s *proxyService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	go s.run()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for c := range r {
+		switch c.Cmd {
+		case svc.Interrogate:
+			changes <- c.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			changes <- svc.Status{State: svc.StopPending, WaitHint: uint32(serviceStopTimeout / time.Millisecond)}
+			shutdownSignals <- os.Interrupt
+			// Report Stopped only once stats are flushed; returning lets
+			// svc.Run tell the service manager, after which main exits
+			select {
+			case <-shutdownComplete:
+			case <-time.After(serviceStopTimeout):
+				log.Printf("Timed out waiting for graceful shutdown")
+			}
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// runAsService runs the proxy under the Windows service manager if the
+// process was started by it. It returns false for interactive sessions.
+func runAsService(run func()) bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+
+	// Services start in System32; resolve relative config paths next to the binary
+	if exe, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(exe))
+	}
+
+	if elog, err := eventlog.Open(serviceName); err == nil {
+		defer elog.Close()
+		log.SetOutput(eventLogWriter{elog: elog})
+		log.SetFlags(0)
+	}
+
+	// Execute returns after shutdown so the manager sees a clean stop
+	exitOnShutdown = false
+	if err := svc.Run(serviceName, &proxyService{run: run}); err != nil {
+		log.Printf("Service failed: %v", err)
+	}
+	return true
+}
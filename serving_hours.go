@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// defaultCurfewMessage is shown to clients during a curfew when no message
+// is configured
+const defaultCurfewMessage = "Service not available at this time"
+
+// CurfewWindow is a daily period during which the proxy accepts no new
+// connections, e.g. {"start": "00:00", "end": "05:00"}
+type CurfewWindow struct {
+	Start string   `json:"start"`          // HH:MM
+	End   string   `json:"end"`            // HH:MM; at or before start crosses midnight
+	Days  []string `json:"days,omitempty"` // mon..sun the curfew starts on; empty: every day
+}
+
+// ServingHoursConfig contains the server-wide curfews
+type ServingHoursConfig struct {
+	Timezone    string         `json:"timezone"`     // IANA zone of the curfew times (default local time)
+	Curfews     []CurfewWindow `json:"curfews"`      // Daily periods with no new connections
+	Message     string         `json:"message"`      // Body of the 503 sent to blocked clients
+	ExemptUsers []string       `json:"exempt_users"` // Users or CN patterns that may connect anyway
+}
+
+// curfew is a parsed CurfewWindow, times in minutes after midnight
+type curfew struct {
+	start, end int
+	days       [7]bool // by time.Weekday
+}
+
+// ServingHours blocks new proxy connections during the configured curfews.
+// Open tunnels are not touched and the admin server stays reachable.
+type ServingHours struct {
+	loc     *time.Location
+	curfews []curfew
+	message string
+	exempt  *userPatterns
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// NewServingHours parses the serving hours configuration. Invalid curfews
+// are logged and ignored; it returns nil if no curfew is configured.
+func NewServingHours(config *Config) *ServingHours {
+	h := parseServingHours(config.ServingHours, "Serving hours")
+	if h == nil {
+		return nil
+	}
+
+	metrics.Gauge("https_proxy_curfew_active", "1 while a serving hours curfew blocks new connections", func() float64 {
+		if closed, _ := h.Closed(time.Now()); closed {
+			return 1
+		}
+		return 0
+	})
+	return h
+}
+
+// parseServingHours parses sc, logging problems under what; it returns nil
+// if sc has no valid curfew
+func parseServingHours(sc ServingHoursConfig, what string) *ServingHours {
+	if len(sc.Curfews) == 0 {
+		return nil
+	}
+	h := &ServingHours{loc: time.Local, message: sc.Message}
+	if sc.Timezone != "" {
+		loc, err := time.LoadLocation(sc.Timezone)
+		if err != nil {
+			log.Printf("%s: unknown timezone %q, using local time: %v", what, sc.Timezone, err)
+		} else {
+			h.loc = loc
+		}
+	}
+	if h.message == "" {
+		h.message = defaultCurfewMessage
+	}
+	var err error
+	if h.exempt, err = newUserPatterns(sc.ExemptUsers); err != nil {
+		log.Printf("%s exempt_users: %v", what, err)
+	}
+	for _, w := range sc.Curfews {
+		c, err := parseCurfew(w)
+		if err != nil {
+			log.Printf("%s: ignoring curfew %s - %s: %v", what, w.Start, w.End, err)
+			continue
+		}
+		h.curfews = append(h.curfews, c)
+	}
+	if len(h.curfews) == 0 {
+		return nil
+	}
+	return h
+}
+
+func parseCurfew(w CurfewWindow) (curfew, error) {
+	var c curfew
+	var err error
+	if c.start, err = parseClock(w.Start); err != nil {
+		return c, err
+	}
+	if c.end, err = parseClock(w.End); err != nil {
+		return c, err
+	}
+	if c.end <= c.start {
+		c.end += 24 * 60
+	}
+	if len(w.Days) == 0 {
+		c.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, d := range w.Days {
+		wd, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return c, fmt.Errorf("unknown day %q", d)
+		}
+		c.days[wd] = true
+	}
+	return c, nil
+}
+
+// parseClock parses HH:MM (00:00 to 24:00) into minutes after midnight
+func parseClock(s string) (int, error) {
+	var hh, mm int
+	if n, _ := fmt.Sscanf(s, "%d:%d", &hh, &mm); n != 2 || len(s) != 5 || hh < 0 || mm < 0 || mm > 59 || hh*60+mm > 24*60 {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return hh*60 + mm, nil
+}
+
+// Closed reports whether now falls in a curfew and, if so, when new
+// connections are accepted again. Back-to-back curfews are followed through.
+func (h *ServingHours) Closed(now time.Time) (bool, time.Time) {
+	if h == nil {
+		return false, time.Time{}
+	}
+	until, closed := now, false
+	// A chain of curfews cannot be longer than a week of back-to-back periods
+	for i := 0; i < 7*len(h.curfews)+1; i++ {
+		end, ok := h.curfewEnd(until)
+		if !ok {
+			break
+		}
+		until, closed = end, true
+	}
+	return closed, until
+}
+
+// curfewEnd returns the end of the curfew containing t, if any
+func (h *ServingHours) curfewEnd(t time.Time) (time.Time, bool) {
+	t = t.In(h.loc)
+	var latest time.Time
+	for _, c := range h.curfews {
+		// Curfews starting today or, crossing midnight, yesterday
+		for _, back := range []int{0, 1} {
+			day := time.Date(t.Year(), t.Month(), t.Day()-back, 0, 0, 0, 0, h.loc)
+			if !c.days[day.Weekday()] {
+				continue
+			}
+			start := time.Date(day.Year(), day.Month(), day.Day(), 0, c.start, 0, 0, h.loc)
+			end := time.Date(day.Year(), day.Month(), day.Day(), 0, c.end, 0, 0, h.loc)
+			if !t.Before(start) && t.Before(end) && end.After(latest) {
+				latest = end
+			}
+		}
+	}
+	return latest, !latest.IsZero()
+}
+
+// IsExempt reports whether username may connect during a curfew
+func (h *ServingHours) IsExempt(username string) bool {
+	if h == nil {
+		return false
+	}
+	_, ok := h.exempt.Match(username)
+	return ok
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServingHours_Closed(t *testing.T) {
+	cfg := &Config{}
+	cfg.ServingHours = ServingHoursConfig{
+		Timezone: "Europe/Berlin",
+		Curfews: []CurfewWindow{
+			{Start: "23:30", End: "02:00"},
+			{Start: "02:00", End: "05:00", Days: []string{"Mon", "tue"}},
+			{Start: "7:00", End: "08:00"}, // invalid, ignored
+		},
+	}
+	h := NewServingHours(cfg)
+	if h == nil || len(h.curfews) != 2 {
+		t.Fatalf("curfews = %+v", h)
+	}
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	at := func(day, hour, min int) time.Time { return time.Date(2026, 3, day, hour, min, 0, 0, berlin) }
+
+	tests := []struct {
+		name   string
+		now    time.Time
+		closed bool
+		until  time.Time
+	}{
+		{"before curfew", at(1, 23, 0), false, time.Time{}},
+		{"Sunday night, crossing midnight", at(1, 23, 45), true, at(2, 5, 0)}, // runs into Monday's curfew
+		{"Monday early morning", at(2, 3, 0), true, at(2, 5, 0)},
+		{"Monday morning", at(2, 5, 0), false, time.Time{}},
+		{"Tuesday night", at(3, 23, 30), true, at(4, 2, 0)}, // Wednesday has no second curfew
+		{"same instant in UTC", at(4, 1, 0).UTC(), true, at(4, 2, 0)},
+	}
+	for _, tt := range tests {
+		closed, until := h.Closed(tt.now)
+		if closed != tt.closed || (closed && !until.Equal(tt.until)) {
+			t.Errorf("%s: closed = %v until %v, want %v until %v", tt.name, closed, until, tt.closed, tt.until)
+		}
+	}
+
+	if NewServingHours(&Config{}) != nil {
+		t.Error("serving hours without curfews should be nil")
+	}
+}
+
+func TestPolicyEngine_ServingHours(t *testing.T) {
+	now := time.Now()
+	cfg := &Config{}
+	cfg.ServingHours = ServingHoursConfig{
+		Timezone:    "UTC",
+		Curfews:     []CurfewWindow{{Start: "00:00", End: "05:00"}},
+		Message:     "closed for backups",
+		ExemptUsers: []string{"ops-*"},
+	}
+	engine := NewPolicyEngine(cfg, nil, nil)
+	night := time.Date(now.Year(), now.Month(), now.Day(), 4, 30, 0, 0, time.UTC)
+
+	d := engine.Evaluate(PolicyRequest{Username: "alice", Time: night})
+	if d.Allowed || d.Blocking.Rule != "serving_hours" || d.Blocking.Code != ErrCodeOutsideHours {
+		t.Fatalf("expected curfew block, got %+v", d.Blocking)
+	}
+	if d.Blocking.Status != http.StatusServiceUnavailable || d.Blocking.Reason != "closed for backups" || d.Blocking.RetryAfter != 1800 {
+		t.Errorf("unexpected block details: %+v", d.Blocking)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "ops-1", Time: night}); !d.Allowed {
+		t.Error("exempt user was blocked")
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "alice", Time: night.Add(time.Hour)}); !d.Allowed {
+		t.Errorf("blocked outside curfew: %+v", d.Blocking)
+	}
+}
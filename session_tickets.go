@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SessionTicketsConfig rotates the keys that encrypt TLS session tickets.
+// Without it Go rotates its own keys daily and accepts them for a week.
+type SessionTicketsConfig struct {
+	RotateMinutes int `json:"rotate_minutes"` // New encryption key every N minutes; 0 keeps Go's default
+	Keep          int `json:"keep"`           // Previous keys still accepted for resumption (default 2)
+}
+
+// ticketKey is a session ticket key and when it was created
+type ticketKey struct {
+	key     [32]byte
+	created time.Time
+}
+
+// TicketKeys encrypts session tickets with keys it rotates: the newest key
+// encrypts, the previous ones still decrypt so sessions resume across a
+// rotation
+type TicketKeys struct {
+	interval time.Duration
+	keep     int
+
+	mu      sync.Mutex
+	keyring *tls.Config // holds the keys; only its ticket methods are used
+	keys    []ticketKey // newest first
+	next    time.Time
+}
+
+// TicketKeyStatus describes a key without revealing it
+type TicketKeyStatus struct {
+	ID      string    `json:"id"` // first bytes of the key's SHA-256
+	Created time.Time `json:"created"`
+	Encrypt bool      `json:"encrypt"`
+	// Retires is when the key stops being accepted
+	Retires time.Time `json:"retires"`
+}
+
+// TicketKeysStatus is the payload of /api/v2/tls/tickets
+type TicketKeysStatus struct {
+	RotateMinutes int               `json:"rotate_minutes"`
+	NextRotation  time.Time         `json:"next_rotation"`
+	Keys          []TicketKeyStatus `json:"keys"`
+}
+
+// sessionTickets is the process-wide ticket key rotation, nil unless
+// server.session_tickets.rotate_minutes is set
+var sessionTickets *TicketKeys
+
+// NewTicketKeys creates the rotation with its first key; it returns nil
+// when rotation is off
+func NewTicketKeys(sc SessionTicketsConfig) *TicketKeys {
+	if sc.RotateMinutes <= 0 {
+		return nil
+	}
+	tk := &TicketKeys{
+		interval: time.Duration(sc.RotateMinutes) * time.Minute,
+		keep:     sc.Keep,
+		keyring:  &tls.Config{},
+	}
+	if tk.keep <= 0 {
+		tk.keep = 2
+	}
+	tk.Rotate(time.Now())
+
+	metrics.Gauge("https_proxy_session_ticket_key_age_seconds", "Age of the key encrypting new session tickets", func() float64 {
+		tk.mu.Lock()
+		defer tk.mu.Unlock()
+		return time.Since(tk.keys[0].created).Seconds()
+	})
+	return tk
+}
+
+// Install makes cfg, and every config cloned from it afterwards, use the
+// rotated keys
+func (tk *TicketKeys) Install(cfg *tls.Config) {
+	if tk == nil {
+		return
+	}
+	cfg.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+		tk.mu.Lock()
+		keyring := tk.keyring
+		tk.mu.Unlock()
+		return keyring.EncryptTicket(cs, ss)
+	}
+	cfg.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+		tk.mu.Lock()
+		keyring := tk.keyring
+		tk.mu.Unlock()
+		return keyring.DecryptTicket(identity, cs)
+	}
+}
+
+// Run rotates the keys when due, forever. A rotation requested through the
+// API restarts the interval.
+func (tk *TicketKeys) Run() {
+	if tk == nil {
+		return
+	}
+	for {
+		tk.mu.Lock()
+		next := tk.next
+		tk.mu.Unlock()
+		if wait := time.Until(next); wait > 0 {
+			time.Sleep(wait)
+			continue
+		}
+		tk.Rotate(time.Now())
+	}
+}
+
+// Rotate adds a new encryption key and retires keys beyond keep
+func (tk *TicketKeys) Rotate(now time.Time) {
+	var k ticketKey
+	if _, err := rand.Read(k.key[:]); err != nil {
+		log.Printf("Session tickets: generating key: %v", err)
+		return
+	}
+	k.created = now
+
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	tk.keys = append([]ticketKey{k}, tk.keys...)
+	if len(tk.keys) > tk.keep+1 {
+		tk.keys = tk.keys[:tk.keep+1]
+	}
+	raw := make([][32]byte, len(tk.keys))
+	for i, k := range tk.keys {
+		raw[i] = k.key
+	}
+	// A fresh keyring, so handshakes in flight keep the one they read
+	keyring := &tls.Config{}
+	keyring.SetSessionTicketKeys(raw)
+	tk.keyring = keyring
+	tk.next = now.Add(tk.interval)
+	log.Printf("Session tickets: rotated to key %s, %d previous keys accepted", keyID(k.key), len(tk.keys)-1)
+}
+
+// keyID identifies a key in logs and the API
+func keyID(key [32]byte) string {
+	sum := sha256.Sum256(key[:])
+	return hex.EncodeToString(sum[:4])
+}
+
+// Status returns the rotation schedule and the keys in use
+func (tk *TicketKeys) Status() TicketKeysStatus {
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	st := TicketKeysStatus{RotateMinutes: int(tk.interval / time.Minute), NextRotation: tk.next}
+	for i, k := range tk.keys {
+		// A key is replaced after its own interval, then stays accepted
+		// for keep more rotations
+		st.Keys = append(st.Keys, TicketKeyStatus{
+			ID:      keyID(k.key),
+			Created: k.created,
+			Encrypt: i == 0,
+			Retires: tk.next.Add(time.Duration(tk.keep-i) * tk.interval),
+		})
+	}
+	return st
+}
+
+// handleSessionTickets serves /api/v2/tls/tickets: GET returns the rotation
+// status, POST rotates now (e.g. after a suspected key leak)
+func handleSessionTickets(w http.ResponseWriter, r *http.Request, tk *TicketKeys) {
+	if tk == nil {
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Session ticket key rotation is not enabled"}, http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		tk.Rotate(time.Now())
+		log.Printf("Session ticket keys rotated by api:%s", adminName(r))
+	default:
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSONResponse(w, WebResponse{Success: true, Data: tk.Status()}, http.StatusOK)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTicketKeys_Rotation(t *testing.T) {
+	ca, err := GenerateCA("Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: "proxy", ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, Validity: time.Hour})
+	serverCfg := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leaf.Cert.Raw}, PrivateKey: leaf.Key}},
+		MaxVersion:   tls.VersionTLS12, // tickets arrive within the handshake
+	}
+	tk := NewTicketKeys(SessionTicketsConfig{RotateMinutes: 60, Keep: 1})
+	tk.Install(serverCfg)
+	derived := serverCfg.Clone() // like the configs the gate derives per handshake
+
+	cache := tls.NewLRUClientSessionCache(4)
+	resumed := func() bool {
+		c, s := net.Pipe()
+		defer c.Close()
+		defer s.Close()
+		go tls.Server(s, derived).Handshake()
+		conn := tls.Client(c, &tls.Config{InsecureSkipVerify: true, ServerName: "proxy", ClientSessionCache: cache})
+		if err := conn.Handshake(); err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		return conn.ConnectionState().DidResume
+	}
+
+	if resumed() {
+		t.Fatal("first handshake resumed")
+	}
+	tk.Rotate(time.Now())
+	if !resumed() {
+		t.Error("session did not resume with the previous key")
+	}
+	// The resumption issued a ticket under the new key; two rotations
+	// retire it with keep 1
+	tk.Rotate(time.Now())
+	tk.Rotate(time.Now())
+	if resumed() {
+		t.Error("session resumed with a retired key")
+	}
+
+	mux := http.NewServeMux()
+	sessionTickets = tk
+	defer func() { sessionTickets = nil }()
+	registerV2API(mux, &Config{}, nil, nil, nil, nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v2/tls/tickets", nil))
+	var resp struct {
+		Data TicketKeysStatus `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	st := resp.Data
+	if rec.Code != http.StatusOK || len(st.Keys) != 2 || !st.Keys[0].Encrypt || st.Keys[1].Encrypt || st.Keys[0].ID == st.Keys[1].ID {
+		t.Fatalf("status = %d %+v", rec.Code, st)
+	}
+	if !st.Keys[1].Retires.Equal(st.NextRotation) || !st.Keys[0].Retires.Equal(st.NextRotation.Add(time.Hour)) {
+		t.Errorf("retirement schedule = %+v", st)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// p12Password protects the browser-importable client bundle, matching
+// scripts/generate_certs.sh
+const p12Password = "changeit"
+
+// SetupOptions holds the -setup parameters. Empty values are asked for
+// interactively unless AssumeDefaults is set.
+type SetupOptions struct {
+	ConfigPath     string
+	CertDir        string
+	Host           string
+	ClientCN       string
+	DefaultSite    string
+	Port           int
+	AdminPort      int
+	AssumeDefaults bool
+	Force          bool
+}
+
+// setupWizard walks through first-run setup: certificates, config, and the
+// stats database.
+type setupWizard struct {
+	opts SetupOptions
+	in   *bufio.Reader
+	out  io.Writer
+}
+
+// RunSetup generates the CA/server/admin/client certificates, writes a
+// starter config, initialises the SQLite stats database, and prints client
+// setup instructions.
+func RunSetup(opts SetupOptions) error {
+	w := &setupWizard{opts: opts, in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	return w.run()
+}
+
+// ask prompts for a value, returning def on empty input or when defaults are
+// assumed
+func (w *setupWizard) ask(label, def string) string {
+	if w.opts.AssumeDefaults {
+		return def
+	}
+	fmt.Fprintf(w.out, "%s [%s]: ", label, def)
+	line, err := w.in.ReadString('\n')
+	if err != nil && line == "" {
+		return def
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+	return def
+}
+
+func (w *setupWizard) askInt(label string, def int) int {
+	for {
+		v := w.ask(label, strconv.Itoa(def))
+		n, err := strconv.Atoi(v)
+		if err == nil && n > 0 && n < 65536 {
+			return n
+		}
+		fmt.Fprintf(w.out, "Invalid port %q\n", v)
+	}
+}
+
+func (w *setupWizard) run() error {
+	o := &w.opts
+	// An existing config references its own certificates and database, so
+	// new ones would be orphaned; only replace it when forced
+	if _, err := os.Stat(o.ConfigPath); err == nil && !o.Force {
+		return fmt.Errorf("%s already exists (use -setup-force to overwrite)", o.ConfigPath)
+	}
+
+	fmt.Fprintln(w.out, "HTTPS Proxy first-run setup")
+	fmt.Fprintln(w.out)
+
+	if o.Host == "" {
+		o.Host = w.ask("Server hostname or IP clients will connect to", "localhost")
+	}
+	if o.Port == 0 {
+		o.Port = w.askInt("Proxy port", 8443)
+	}
+	if o.AdminPort == 0 {
+		o.AdminPort = w.askInt("Admin panel port", 9444)
+	}
+	if o.ClientCN == "" {
+		o.ClientCN = w.ask("First client username (certificate CN)", "client."+o.Host)
+	}
+	if o.DefaultSite == "" {
+		o.DefaultSite = w.ask("Camouflage site for unauthenticated visitors", "https://www.lapo.it")
+	}
+	if o.CertDir == "" {
+		o.CertDir = w.ask("Certificate directory", "./certs")
+	}
+
+	paths := map[string]string{
+		"ca":          filepath.Join(o.CertDir, "ca.pem"),
+		"ca_key":      filepath.Join(o.CertDir, "ca.key"),
+		"trustroot":   filepath.Join(o.CertDir, "trustroot.pem"),
+		"server":      filepath.Join(o.CertDir, "cert.pem"),
+		"server_key":  filepath.Join(o.CertDir, "key.pem"),
+		"admin":       filepath.Join(o.CertDir, "admin_cert.pem"),
+		"admin_key":   filepath.Join(o.CertDir, "admin_key.pem"),
+		"client":      filepath.Join(o.CertDir, "client.pem"),
+		"client_key":  filepath.Join(o.CertDir, "client.key"),
+		"client_p12":  filepath.Join(o.CertDir, "client.p12"),
+		"client_comb": filepath.Join(o.CertDir, "client_combined.pem"),
+	}
+	if !o.Force {
+		for _, p := range paths {
+			if _, err := os.Stat(p); err == nil {
+				return fmt.Errorf("%s already exists (use -setup-force to overwrite)", p)
+			}
+		}
+	}
+	if err := os.MkdirAll(o.CertDir, 0755); err != nil {
+		return fmt.Errorf("create certificate directory: %v", err)
+	}
+
+	if err := w.generateCerts(paths); err != nil {
+		return err
+	}
+
+	cfg := w.starterConfig(paths)
+	if err := cfg.SaveConfig(o.ConfigPath); err != nil {
+		return err
+	}
+
+	db, err := NewStatsDB(cfg.Stats.DBPath)
+	if err != nil {
+		return fmt.Errorf("init stats database: %v", err)
+	}
+	db.Close()
+	fmt.Fprintf(w.out, "Stats database initialised: %s\n", cfg.Stats.DBPath)
+
+	w.printInstructions(paths)
+	return nil
+}
+
+func (w *setupWizard) generateCerts(paths map[string]string) error {
+	o := w.opts
+	const validity = 365 * 24 * time.Hour
+
+	ca, err := GenerateCA("HTTPS Proxy CA", 10*validity)
+	if err != nil {
+		return err
+	}
+	if err := ca.WriteFiles(paths["ca"], paths["ca_key"]); err != nil {
+		return err
+	}
+	if err := os.WriteFile(paths["trustroot"], ca.CertPEM, 0644); err != nil {
+		return err
+	}
+
+	dnsNames, ips := []string{"localhost"}, []net.IP{net.ParseIP("127.0.0.1")}
+	if ip := net.ParseIP(o.Host); ip != nil {
+		ips = append(ips, ip)
+	} else if o.Host != "localhost" {
+		dnsNames = append(dnsNames, o.Host)
+	}
+
+	server, err := IssueCert(ca.Cert, ca.Key, CertRequest{
+		CommonName:  o.Host,
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		Validity:    validity,
+	})
+	if err != nil {
+		return err
+	}
+	if err := server.WriteFiles(paths["server"], paths["server_key"]); err != nil {
+		return err
+	}
+
+	admin, err := IssueCert(ca.Cert, ca.Key, CertRequest{
+		CommonName:  "admin." + o.Host,
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		Validity:    validity,
+	})
+	if err != nil {
+		return err
+	}
+	if err := admin.WriteFiles(paths["admin"], paths["admin_key"]); err != nil {
+		return err
+	}
+
+	client, err := IssueCert(ca.Cert, ca.Key, CertRequest{
+		CommonName:  o.ClientCN,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Validity:    validity,
+	})
+	if err != nil {
+		return err
+	}
+	if err := client.WriteFiles(paths["client"], paths["client_key"]); err != nil {
+		return err
+	}
+	combined := append(append([]byte{}, client.CertPEM...), client.KeyPEM...)
+	if err := os.WriteFile(paths["client_comb"], combined, 0600); err != nil {
+		return err
+	}
+	p12, err := pkcs12.Modern.Encode(client.Key, client.Cert, []*x509.Certificate{ca.Cert}, p12Password)
+	if err != nil {
+		return fmt.Errorf("encode client PKCS#12: %v", err)
+	}
+	if err := os.WriteFile(paths["client_p12"], p12, 0600); err != nil {
+		return err
+	}
+
+	// Record the CA and the certificates it signed in the issuance log
+	logPath := caLogPath(paths["trustroot"])
+	for _, c := range []*IssuedCert{ca, server, admin, client} {
+		if err := appendCALog(logPath, c.Cert, CALogSetup, "", time.Now()); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(w.out, "Certificates written to %s\n", o.CertDir)
+	return nil
+}
+
+// starterConfig builds the initial configuration referencing the generated
+// certificates
+func (w *setupWizard) starterConfig(paths map[string]string) *Config {
+	o := w.opts
+	cfg := &Config{}
+	cfg.Server.Port = o.Port
+	cfg.Server.Certificates.CertPath = paths["server"]
+	cfg.Server.Certificates.KeyPath = paths["server_key"]
+	cfg.Server.Certificates.CAPath = paths["trustroot"]
+	cfg.Server.Performance.BufferSize = DefaultBufferSize
+	cfg.Server.Performance.TCPKeepAlive = 30
+	cfg.Server.Performance.MaxConcurrentConns = 1000
+	cfg.Server.Performance.NoDelay = true
+
+	cfg.Proxy.DefaultSite = o.DefaultSite
+
+	cfg.Stats.Enabled = true
+	cfg.Stats.DBPath = "./stats/proxy_stats.db"
+	cfg.Stats.FlushInterval = 30
+	cfg.Stats.Retention.MinuteStatsDays = 7
+	cfg.Stats.Retention.HourlyStatsDays = 90
+
+	cfg.Admin.Enabled = true
+	cfg.Admin.Port = o.AdminPort
+	cfg.Admin.Language = "en"
+	cfg.Admin.Interfaces.Web = true
+	cfg.Admin.Interfaces.API = true
+	cfg.Admin.Certificates = &struct {
+		CertPath string `json:"cert_path"`
+		KeyPath  string `json:"key_path"`
+		CAPath   string `json:"ca_path"`
+	}{
+		CertPath: paths["admin"],
+		KeyPath:  paths["admin_key"],
+		CAPath:   paths["trustroot"],
+	}
+	return cfg
+}
+
+func (w *setupWizard) printInstructions(paths map[string]string) {
+	o := w.opts
+	proxyAddr := net.JoinHostPort(o.Host, strconv.Itoa(o.Port))
+
+	fmt.Fprintf(w.out, `
+Setup complete!
+
+Start the proxy:
+  ./https-proxy -config %[1]s
+
+Test with curl:
+  curl --proxy https://%[2]s --proxy-cert %[3]s --proxy-key %[4]s --proxy-cacert %[5]s https://example.com
+
+Browser / OS setup:
+  1. Import %[6]s (password: %[7]s) into your browser or OS keychain,
+     and trust %[5]s as a certificate authority.
+  2. Chrome/Edge: start with --proxy-server=https://%[2]s
+  3. Firefox or OS settings: use a PAC file containing
+       function FindProxyForURL(url, host) { return "HTTPS %[2]s"; }
+  4. Select the "%[8]s" certificate when prompted.
+
+Admin panel:
+  https://%[9]s/ (authenticate with %[10]s / %[11]s)
+`,
+		o.ConfigPath, proxyAddr, paths["client"], paths["client_key"], paths["ca"],
+		paths["client_p12"], p12Password, o.ClientCN,
+		net.JoinHostPort(o.Host, strconv.Itoa(o.AdminPort)), paths["admin"], paths["admin_key"])
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func runTestSetup(t *testing.T, force bool) error {
+	t.Helper()
+	w := &setupWizard{
+		opts: SetupOptions{
+			ConfigPath:     "config.json",
+			Host:           "proxy.example.com",
+			ClientCN:       "alice",
+			AssumeDefaults: true,
+			Force:          force,
+		},
+		in:  bufio.NewReader(strings.NewReader("")),
+		out: io.Discard,
+	}
+	return w.run()
+}
+
+func TestRunSetup_NonInteractive(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	if err := runTestSetup(t, false); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	data, err := os.ReadFile("config.json")
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("decode config: %v", err)
+	}
+	if cfg.Server.Port != 8443 || cfg.Admin.Port != 9444 || !cfg.Stats.Enabled {
+		t.Errorf("unexpected defaults: port=%d admin=%d stats=%v", cfg.Server.Port, cfg.Admin.Port, cfg.Stats.Enabled)
+	}
+	if _, err := os.Stat(cfg.Stats.DBPath); err != nil {
+		t.Errorf("stats database not created at %s: %v", cfg.Stats.DBPath, err)
+	}
+
+	// The client certificate must chain to the CA the config trusts
+	caPEM, err := os.ReadFile(cfg.Server.Certificates.CAPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("config CA is not a PEM certificate")
+	}
+	pair, err := tls.LoadX509KeyPair("certs/client.pem", "certs/client.key")
+	if err != nil {
+		t.Fatalf("load client cert: %v", err)
+	}
+	clientCert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientCert.Subject.CommonName != "alice" {
+		t.Errorf("client CN = %q, want alice", clientCert.Subject.CommonName)
+	}
+	if _, err := clientCert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("client certificate does not verify against the configured CA: %v", err)
+	}
+	if _, err := os.Stat("certs/client.p12"); err != nil {
+		t.Errorf("PKCS#12 bundle missing: %v", err)
+	}
+}
+
+func TestRunSetup_RefusesExistingConfig(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	if err := runTestSetup(t, false); err != nil {
+		t.Fatalf("first setup: %v", err)
+	}
+	caBefore, _ := os.ReadFile("certs/ca.pem")
+
+	if err := runTestSetup(t, false); err == nil || !strings.Contains(err.Error(), "config.json already exists") {
+		t.Fatalf("second setup: got %v, want existing config error", err)
+	}
+	if caAfter, _ := os.ReadFile("certs/ca.pem"); !bytes.Equal(caBefore, caAfter) {
+		t.Error("refused setup must not replace the CA")
+	}
+
+	if err := runTestSetup(t, true); err != nil {
+		t.Fatalf("forced setup: %v", err)
+	}
+	if caAfter, _ := os.ReadFile("certs/ca.pem"); bytes.Equal(caBefore, caAfter) {
+		t.Error("forced setup should issue a new CA")
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// SOCKS5Config controls the SOCKS5 listener for clients that cannot speak
+// HTTP CONNECT. Its tunnels count towards the same users, policies and
+// stats as the HTTPS proxy's.
+type SOCKS5Config struct {
+	Enabled bool `json:"enabled"`
+	Port    int  `json:"port"` // Listens on server.bind_addresses (default 1080)
+	// TLS wraps the listener in TLS with the server certificate; clients
+	// presenting a certificate from ca_path need no password
+	TLS bool `json:"tls"`
+	// Users log in with a name and password (RFC 1929). Over a listener
+	// without TLS the password crosses the network in the clear.
+	Users                   []SOCKS5UserConfig `json:"users"`
+	HandshakeTimeoutSeconds int                `json:"handshake_timeout_seconds"` // Time allowed for TLS and the SOCKS handshake (default 10)
+}
+
+// SOCKS5UserConfig is a password login of the SOCKS5 listener
+type SOCKS5UserConfig struct {
+	Name           string `json:"name"`            // The user the tunnels count towards, as a certificate CN does
+	PasswordBcrypt string `json:"password_bcrypt"` // bcrypt hash of the password; the password itself is not stored
+}
+
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socks5Version         = 0x05
+	socks5AuthNone        = 0x00
+	socks5AuthPassword    = 0x02
+	socks5AuthNoMethod    = 0xFF
+	socks5PasswordVer     = 0x01
+	socks5CmdConnect      = 0x01
+	socks5AddrIPv4        = 0x01
+	socks5AddrDomain      = 0x03
+	socks5AddrIPv6        = 0x04
+	socks5Succeeded       = 0x00
+	socks5Failure         = 0x01
+	socks5NotAllowed      = 0x02
+	socks5HostUnreach     = 0x04
+	socks5ConnRefused     = 0x05
+	socks5TTLExpired      = 0x06
+	socks5CmdUnsupported  = 0x07
+	socks5AddrUnsupported = 0x08
+)
+
+// SOCKS5Server accepts SOCKS5 clients and opens their tunnels through the
+// proxy
+type SOCKS5Server struct {
+	proxy     *Proxy
+	port      int
+	tlsConfig *tls.Config // nil without TLS
+	users     *passwordLogins
+	timeout   time.Duration
+
+	accepted   atomic.Uint64
+	handshake  atomic.Uint64
+	authFailed atomic.Uint64
+	refused    atomic.Uint64
+}
+
+// NewSOCKS5Server returns nil unless server.socks5 is enabled with a way
+// to log in. tlsConfig is the HTTPS server's before the policy's checks;
+// the listener uses a copy without its HTTP protocols, with the checks.
+func NewSOCKS5Server(config *Config, proxy *Proxy, tlsConfig *tls.Config) *SOCKS5Server {
+	sc := config.Server.SOCKS5
+	if !sc.Enabled {
+		return nil
+	}
+	s := &SOCKS5Server{
+		proxy:   proxy,
+		port:    firstPositive(sc.Port, 1080),
+		users:   newPasswordLogins(),
+		timeout: time.Duration(firstPositive(sc.HandshakeTimeoutSeconds, 10)) * time.Second,
+	}
+	for _, u := range sc.Users {
+		if !s.users.Add(u.Name, u.PasswordBcrypt) {
+			log.Printf("server.socks5.users %q: needs a name and a bcrypt password_bcrypt, ignored", u.Name)
+		}
+	}
+	if sc.TLS {
+		c := tlsConfig.Clone()
+		c.NextProtos = nil
+		s.tlsConfig = proxy.Policy.TLSConfig(c)
+	}
+	if s.tlsConfig == nil && s.users.Len() == 0 {
+		log.Printf("server.socks5: without tls, users are needed to log in; SOCKS5 disabled")
+		return nil
+	}
+
+	metrics.Counter("https_proxy_socks5_accepted_total", "SOCKS5 clients that logged in.", func() float64 {
+		return float64(s.accepted.Load())
+	})
+	metrics.Collect("https_proxy_socks5_rejected_total", "SOCKS5 connections closed before a tunnel was requested.", "counter", func() []MetricSample {
+		return []MetricSample{
+			{Labels: map[string]string{"reason": "handshake"}, Value: float64(s.handshake.Load())},
+			{Labels: map[string]string{"reason": "auth"}, Value: float64(s.authFailed.Load())},
+			{Labels: map[string]string{"reason": "policy"}, Value: float64(s.refused.Load())},
+		}
+	})
+	return s
+}
+
+// Port returns the port the listener is meant to use
+func (s *SOCKS5Server) Port() int {
+	return s.port
+}
+
+// Serve accepts clients on ln until it is closed
+func (s *SOCKS5Server) Serve(ln net.Listener) error {
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn logs a client in and opens the tunnel it asks for
+func (s *SOCKS5Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	clientAddr := conn.RemoteAddr().String()
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	// A client certificate from the CA logs the client in; anything else
+	// needs a password
+	var cert *x509.Certificate
+	resumed, sni := false, ""
+	if s.tlsConfig != nil {
+		tc := tls.Server(conn, s.tlsConfig)
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		err := tc.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			s.handshake.Add(1)
+			return
+		}
+		state := tc.ConnectionState()
+		if len(state.PeerCertificates) > 0 {
+			cert = state.PeerCertificates[0]
+			if err := s.proxy.verifyClientCert(cert); err != nil {
+				log.Printf("SOCKS5 client %s: invalid certificate (CN: %s): %v", clientAddr, cert.Subject.CommonName, err)
+				s.authFailed.Add(1)
+				return
+			}
+		}
+		resumed, sni = state.DidResume, state.ServerName
+		conn = tc
+	}
+
+	username, err := s.login(conn, cert)
+	if err != nil {
+		log.Printf("SOCKS5 client %s: %v", clientAddr, err)
+		s.authFailed.Add(1)
+		return
+	}
+	host, port, err := s.readRequest(conn)
+	if err != nil {
+		log.Printf("SOCKS5 client %s (%s): %v", clientAddr, username, err)
+		s.handshake.Add(1)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.accepted.Add(1)
+
+	// The same checks as for a CONNECT request, disabled users first
+	p := s.proxy
+	reqID := newRequestID()
+	tier := ""
+	if cert != nil {
+		p.observeClientCert(username, cert)
+		tier = certTier(cert)
+	}
+	clientIP, _, _ := net.SplitHostPort(clientAddr)
+	decision := p.authorize(reqID, clientAddr, PolicyRequest{
+		Username: username,
+		Host:     host,
+		Port:     port,
+		ClientIP: clientIP,
+		Time:     time.Now(),
+		Resumed:  resumed,
+		Tier:     tier,
+	}, true)
+	if !decision.Allowed {
+		s.refused.Add(1)
+		writeSOCKS5Reply(conn, socks5NotAllowed)
+		p.AccessLog.Log(AccessLogEntry{RequestID: reqID, Method: "SOCKS5", User: username, RemoteIP: clientIP, SNI: sni,
+			Host: net.JoinHostPort(host, port), Status: decision.Blocking.Status, Code: decision.Blocking.Code})
+		return
+	}
+	p.StatsManager.RecordConnection(username)
+	log.Printf("[req %s] Authorized SOCKS5 client: %s, user: %s, target: %s", reqID, clientAddr, username, net.JoinHostPort(host, port))
+
+	p.tunnel(tunnelRequest{
+		ID:         reqID,
+		Username:   username,
+		ClientAddr: clientAddr,
+		Host:       host,
+		Port:       port,
+		Tier:       tier,
+		Cert:       cert,
+		Protocol:   "socks5",
+		SNI:        sni,
+	}, socks5Client{conn})
+}
+
+// login negotiates the authentication method and returns the user. A
+// client with a verified certificate needs none; others send a password.
+func (s *SOCKS5Server) login(conn net.Conn, cert *x509.Certificate) (string, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return "", fmt.Errorf("reading greeting: %w", err)
+	}
+	if head[0] != socks5Version {
+		return "", fmt.Errorf("unsupported SOCKS version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", fmt.Errorf("reading methods: %w", err)
+	}
+	offers := func(method byte) bool {
+		for _, m := range methods {
+			if m == method {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case cert != nil && offers(socks5AuthNone):
+		_, err := conn.Write([]byte{socks5Version, socks5AuthNone})
+		return getUsernameFromCert(cert), err
+	case s.users.Len() > 0 && offers(socks5AuthPassword):
+		if _, err := conn.Write([]byte{socks5Version, socks5AuthPassword}); err != nil {
+			return "", err
+		}
+	default:
+		conn.Write([]byte{socks5Version, socks5AuthNoMethod})
+		return "", errors.New("no acceptable authentication method")
+	}
+
+	// RFC 1929: version, name and password, each with a length byte
+	var ver [2]byte
+	if _, err := io.ReadFull(conn, ver[:]); err != nil {
+		return "", fmt.Errorf("reading login: %w", err)
+	}
+	name := make([]byte, ver[1])
+	if _, err := io.ReadFull(conn, name); err != nil {
+		return "", fmt.Errorf("reading login: %w", err)
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(conn, plen[:]); err != nil {
+		return "", fmt.Errorf("reading login: %w", err)
+	}
+	password := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", fmt.Errorf("reading login: %w", err)
+	}
+	if ver[0] != socks5PasswordVer || !s.checkPassword(string(name), password) {
+		conn.Write([]byte{socks5PasswordVer, 0x01})
+		return "", fmt.Errorf("login failed for %q", name)
+	}
+	_, err := conn.Write([]byte{socks5PasswordVer, 0x00})
+	return string(name), err
+}
+
+// checkPassword reports whether password is that of the user called name
+func (s *SOCKS5Server) checkPassword(name string, password []byte) bool {
+	return s.users.Check(name, password)
+}
+
+// readRequest reads a CONNECT request and returns its target. Other
+// commands and unknown address types are answered with an error.
+func (s *SOCKS5Server) readRequest(conn net.Conn) (host, port string, err error) {
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return "", "", fmt.Errorf("reading request: %w", err)
+	}
+	if head[0] != socks5Version {
+		return "", "", fmt.Errorf("unsupported SOCKS version %d", head[0])
+	}
+	switch head[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if head[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", "", fmt.Errorf("reading address: %w", err)
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", "", fmt.Errorf("reading address: %w", err)
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", "", fmt.Errorf("reading address: %w", err)
+		}
+		host = string(name)
+	default:
+		writeSOCKS5Reply(conn, socks5AddrUnsupported)
+		return "", "", fmt.Errorf("unsupported address type %d", head[3])
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(conn, p[:]); err != nil {
+		return "", "", fmt.Errorf("reading port: %w", err)
+	}
+	if head[1] != socks5CmdConnect {
+		writeSOCKS5Reply(conn, socks5CmdUnsupported)
+		return "", "", fmt.Errorf("unsupported command %d", head[1])
+	}
+	return host, strconv.Itoa(int(binary.BigEndian.Uint16(p[:]))), nil
+}
+
+// writeSOCKS5Reply answers a request. The bound address is not disclosed.
+func writeSOCKS5Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socks5Version, rep, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socks5Client is the client of a SOCKS5 CONNECT request
+type socks5Client struct {
+	conn net.Conn
+}
+
+// Refuse answers with the SOCKS reply closest to the proxy error code
+func (c socks5Client) Refuse(status int, code, message string) {
+	rep := byte(socks5Failure)
+	switch {
+	case code == ErrCodeDNSFailure:
+		rep = socks5HostUnreach
+	case code == ErrCodeDialTimeout:
+		rep = socks5TTLExpired
+	case code == ErrCodeDialFailed:
+		rep = socks5ConnRefused
+	case status == http.StatusForbidden:
+		rep = socks5NotAllowed
+	}
+	writeSOCKS5Reply(c.conn, rep)
+}
+
+// Establish reports success; SOCKS has no headers to send
+func (c socks5Client) Establish(http.Header) (net.Conn, error) {
+	if err := writeSOCKS5Reply(c.conn, socks5Succeeded); err != nil {
+		return nil, err
+	}
+	return c.conn, nil
+}
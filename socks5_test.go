@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// socks5Connect logs in over conn (with a password unless user is empty)
+// and asks for a tunnel to target; it returns the reply code
+func socks5Connect(t *testing.T, conn net.Conn, user, password, target string) byte {
+	t.Helper()
+	if user == "" {
+		conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	} else {
+		conn.Write([]byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword})
+	}
+	var method [2]byte
+	if _, err := io.ReadFull(conn, method[:]); err != nil {
+		t.Fatalf("method: %v", err)
+	}
+	if method[1] == socks5AuthNoMethod {
+		return socks5AuthNoMethod
+	}
+	if method[1] == socks5AuthPassword {
+		login := append([]byte{socks5PasswordVer, byte(len(user))}, user...)
+		login = append(append(login, byte(len(password))), password...)
+		conn.Write(login)
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil || status[1] != 0 {
+			return socks5AuthNoMethod
+		}
+	}
+
+	host, port, _ := net.SplitHostPort(target)
+	req := []byte{socks5Version, socks5CmdConnect, 0, socks5AddrDomain, byte(len(host))}
+	req = append(req, host...)
+	var p uint16
+	for _, c := range port {
+		p = p*10 + uint16(c-'0')
+	}
+	req = binary.BigEndian.AppendUint16(req, p)
+	conn.Write(req)
+	var reply [10]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	return reply[1]
+}
+
+func TestSOCKS5Server(t *testing.T) {
+	// An echo server as the tunnels' target
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+	targetAddr := "localhost:" + func() string { _, p, _ := net.SplitHostPort(target.Addr().String()); return p }()
+
+	ca, err := GenerateCA("Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: "localhost", DNSNames: []string{"localhost"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, Validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := IssueCert(ca.Cert, ca.Key, CertRequest{CommonName: "carol", ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, Validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	serverPair, _ := tls.X509KeyPair(server.CertPEM, server.KeyPEM)
+	clientPair, _ := tls.X509KeyPair(client.CertPEM, client.KeyPEM)
+
+	cfg := &Config{}
+	cfg.Stats.Enabled = true
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	cfg.Server.SOCKS5 = SOCKS5Config{Enabled: true, Users: []SOCKS5UserConfig{{Name: "alice", PasswordBcrypt: string(hash)}}}
+	sm := NewStatsManager(cfg)
+	p := &Proxy{Config: cfg, CACertPool: pool, StatsManager: sm, Policy: NewPolicyEngine(cfg, sm, nil)}
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{serverPair}, ClientCAs: pool, ClientAuth: tls.RequestClientCert, NextProtos: []string{"h2"}}
+
+	serve := func(s *SOCKS5Server) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go s.Serve(ln)
+		return ln.Addr().String()
+	}
+	echo := func(conn net.Conn) {
+		t.Helper()
+		conn.Write([]byte("ping"))
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, []byte("ping")) {
+			t.Errorf("echo = %q, %v", got, err)
+		}
+	}
+
+	// Without TLS only password logins exist
+	if NewSOCKS5Server(&Config{Server: ServerConfig{SOCKS5: SOCKS5Config{Enabled: true}}}, p, serverTLS) != nil {
+		t.Error("server without a way to log in")
+	}
+	plain := serve(NewSOCKS5Server(cfg, p, serverTLS))
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	if rep := socks5Connect(t, dial(), "alice", "wrong", targetAddr); rep != socks5AuthNoMethod {
+		t.Errorf("wrong password: reply %d", rep)
+	}
+	if rep := socks5Connect(t, dial(), "", "", targetAddr); rep != socks5AuthNoMethod {
+		t.Errorf("no login: reply %d", rep)
+	}
+	conn := dial()
+	if rep := socks5Connect(t, conn, "alice", "secret", targetAddr); rep != socks5Succeeded {
+		t.Fatalf("alice: reply %d", rep)
+	}
+	echo(conn)
+	conn.Close()
+	if s := sm.GetUserStatsByName("alice"); s == nil || s.ConnectionCount != 1 {
+		t.Errorf("alice's stats = %+v", s)
+	}
+
+	// Disabled users are refused like over CONNECT
+	sm.DisableUser("alice")
+	if rep := socks5Connect(t, dial(), "alice", "secret", targetAddr); rep != socks5NotAllowed {
+		t.Errorf("disabled alice: reply %d", rep)
+	}
+
+	// Over TLS a client certificate logs in
+	cfg.Server.SOCKS5.TLS = true
+	secure := serve(NewSOCKS5Server(cfg, p, serverTLS))
+	tc, err := tls.Dial("tcp", secure, &tls.Config{RootCAs: pool, ServerName: "localhost", Certificates: []tls.Certificate{clientPair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	if rep := socks5Connect(t, tc, "", "", targetAddr); rep != socks5Succeeded {
+		t.Fatalf("carol: reply %d", rep)
+	}
+	echo(tc)
+	if list := tunnels.List(time.Now(), "carol", false); len(list) != 1 || list[0].Protocol != "socks5" {
+		t.Errorf("carol's tunnels = %+v", list)
+	}
+	tc.Close()
+
+	// Behind the knock gate, addresses that did not knock are not asked
+	// for their certificate
+	gateCfg := &Config{}
+	gateCfg.Gate = GateConfig{Enabled: true, Path: "/knock"}
+	p.Policy.Gate = NewKnockGate(gateCfg)
+	defer func() { p.Policy.Gate = nil }()
+	gated := serve(NewSOCKS5Server(cfg, p, serverTLS))
+	dialGated := func() net.Conn {
+		conn, err := tls.Dial("tcp", gated, &tls.Config{RootCAs: pool, ServerName: "localhost", Certificates: []tls.Certificate{clientPair}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	if rep := socks5Connect(t, dialGated(), "", "", targetAddr); rep != socks5AuthNoMethod {
+		t.Errorf("carol before the knock: reply %d", rep)
+	}
+	knock := httptest.NewRequest("GET", "/knock", nil)
+	knock.RemoteAddr = "127.0.0.1:1"
+	p.Policy.Gate.Knock(knock, time.Now())
+	if rep := socks5Connect(t, dialGated(), "", "", targetAddr); rep != socks5Succeeded {
+		t.Errorf("carol after the knock: reply %d", rep)
+	}
+}
@@ -6,10 +6,15 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DefaultMaxUsersInMemory caps StatsManager.UserStats when not configured
+const DefaultMaxUsersInMemory = 10000
+
 // UserStats represents statistics for a single user
 type UserStats struct {
 	Username        string    `json:"username"`
@@ -29,16 +34,47 @@ type StatsManager struct {
 	ticker     *time.Ticker
 	done       chan bool
 	dirtyStats bool // Flag indicating if there have been changes since last save
+	maxUsers   int  // Cap on in-memory users; least recently active are evicted
+	evictions  atomic.Uint64
+
+	saveMu     sync.Mutex            // Serialises stats file writes, taken without the main lock
+	spillMu    sync.Mutex            // Serialises spill store writes
+	spill      *spillStore           // Evicted users on disk; nil without a stats file
+	spilling   map[string]*UserStats // Evicted users whose spill files are being written
+	reloaded   map[string]struct{}   // Users seeded from the spill store since the last save
+	spillGen   uint64                // Bumped whenever a spill write completes
+	evictAfter time.Time             // Eviction backs off until then after a failed spill
 }
 
+// evictRetryInterval is how long eviction pauses after a spill write fails
+const evictRetryInterval = 30 * time.Second
+
 // NewStatsManager creates a new statistics manager
 func NewStatsManager(config *Config) *StatsManager {
 	sm := &StatsManager{
 		Config:    config,
 		UserStats: make(map[string]*UserStats),
 		done:      make(chan bool),
+		maxUsers:  config.Stats.MaxUsersInMemory,
+		spilling:  make(map[string]*UserStats),
+		reloaded:  make(map[string]struct{}),
+	}
+	if sm.maxUsers <= 0 {
+		sm.maxUsers = DefaultMaxUsersInMemory
+	}
+	if config.Stats.FilePath != "" {
+		sm.spill = newSpillStore(config.Stats.FilePath)
 	}
 
+	metrics.Gauge("https_proxy_stats_users_in_memory", "Users currently held by the legacy stats manager.", func() float64 {
+		sm.RLock()
+		defer sm.RUnlock()
+		return float64(len(sm.UserStats))
+	})
+	metrics.Counter("https_proxy_stats_users_evicted_total", "Users evicted from the legacy stats manager after being saved.", func() float64 {
+		return float64(sm.evictions.Load())
+	})
+
 	if config.Stats.Enabled {
 		// Try to load previous statistics from file
 		sm.loadStats()
@@ -59,76 +95,198 @@ func (sm *StatsManager) RecordTraffic(username string, bytesCount uint64) {
 		return
 	}
 
-	sm.Lock()
-	defer sm.Unlock()
-
-	sm.dirtyStats = true
+	sm.update(username, func(stats *UserStats, _ bool) {
+		stats.TotalBytes += bytesCount
+		stats.LastAccess = time.Now()
+	})
+}
 
-	// Get or create user statistics
-	stats, ok := sm.UserStats[username]
-	if !ok {
-		stats = &UserStats{
-			Username:       username,
-			ConnectedSince: time.Now(),
-		}
-		sm.UserStats[username] = stats
+// RecordRequest records a request for a user
+func (sm *StatsManager) RecordRequest(username string) {
+	if !sm.Config.Stats.Enabled {
+		return
 	}
 
-	// Update statistics
-	stats.TotalBytes += bytesCount
-	stats.LastAccess = time.Now()
+	sm.update(username, func(stats *UserStats, _ bool) {
+		stats.RequestsCount++
+		stats.LastAccess = time.Now()
+	})
 }
 
-// RecordRequest records a request for a user
-func (sm *StatsManager) RecordRequest(username string) {
+// RecordConnection records a connection for a user
+func (sm *StatsManager) RecordConnection(username string) {
 	if !sm.Config.Stats.Enabled {
 		return
 	}
 
-	sm.Lock()
-	defer sm.Unlock()
+	sm.update(username, func(stats *UserStats, _ bool) {
+		stats.ConnectionCount++
+		stats.LastAccess = time.Now()
+	})
+}
 
-	sm.dirtyStats = true
+// update applies fn to the stats entry for username, creating it if needed.
+// A user evicted earlier resumes from their spilled record. Disk I/O for the
+// lookup and for any eviction it triggers happens outside the lock.
+func (sm *StatsManager) update(username string, fn func(stats *UserStats, created bool)) {
+	for {
+		sm.Lock()
+		if stats, ok := sm.UserStats[username]; ok {
+			fn(stats, false)
+			sm.dirtyStats = true
+			sm.Unlock()
+			return
+		}
+		gen := sm.spillGen
+		sm.Unlock()
+
+		var saved *UserStats
+		if sm.spill != nil {
+			var err error
+			if saved, err = sm.spill.Read(username); err != nil {
+				log.Printf("Failed to read evicted stats for %s: %v", username, err)
+			}
+		}
 
-	// Get or create user statistics
-	stats, ok := sm.UserStats[username]
-	if !ok {
-		stats = &UserStats{
-			Username:       username,
-			ConnectedSince: time.Now(),
+		sm.Lock()
+		_, exists := sm.UserStats[username]
+		_, pending := sm.spilling[username]
+		if !exists && !pending && sm.spillGen != gen {
+			// A spill finished while we were reading; the file may now
+			// hold this user, so look again
+			sm.Unlock()
+			continue
 		}
-		sm.UserStats[username] = stats
+		stats, victims := sm.userLocked(username, saved)
+		fn(stats, !exists && !pending && saved == nil)
+		sm.dirtyStats = true
+		sm.Unlock()
+
+		if len(victims) > 0 {
+			sm.spillUsers(victims)
+		}
+		return
+	}
+}
+
+// userLocked returns the stats entry for username, creating it from saved
+// (or from a record still being spilled) if it is not in memory. Creating an
+// entry beyond maxUsers evicts the least recently active users, which are
+// returned for the caller to spill once the lock is released. Must be called
+// with the write lock held.
+func (sm *StatsManager) userLocked(username string, saved *UserStats) (*UserStats, []*UserStats) {
+	if stats, ok := sm.UserStats[username]; ok {
+		return stats, nil
+	}
+
+	var victims []*UserStats
+	if len(sm.UserStats) >= sm.maxUsers && time.Now().After(sm.evictAfter) {
+		victims = sm.evictLocked()
 	}
 
-	// Update statistics
-	stats.RequestsCount++
-	stats.LastAccess = time.Now()
+	stats := &UserStats{
+		Username:       username,
+		ConnectedSince: time.Now(),
+	}
+	if pending, ok := sm.spilling[username]; ok {
+		copied := *pending
+		stats = &copied
+		sm.reloaded[username] = struct{}{}
+	} else if saved != nil {
+		stats = saved
+		sm.reloaded[username] = struct{}{}
+	}
+	sm.UserStats[username] = stats
+	return stats, victims
 }
 
-// RecordConnection records a connection for a user
-func (sm *StatsManager) RecordConnection(username string) {
-	if !sm.Config.Stats.Enabled {
-		return
+// evictLocked removes the least recently active tenth of the users from
+// memory and returns them. With a stats file they are kept in spilling until
+// spillUsers has written them; without one they are dropped. Disabled users
+// are never evicted because the flag gates access.
+func (sm *StatsManager) evictLocked() []*UserStats {
+	candidates := make([]*UserStats, 0, len(sm.UserStats))
+	for _, stats := range sm.UserStats {
+		if !stats.Disabled {
+			candidates = append(candidates, stats)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
 	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastAccess.Before(candidates[j].LastAccess)
+	})
 
-	sm.Lock()
-	defer sm.Unlock()
+	n := sm.maxUsers / 10
+	if n < 1 {
+		n = 1
+	}
+	if n > len(candidates) {
+		n = len(candidates)
+	}
 
-	sm.dirtyStats = true
+	victims := candidates[:n]
+	for _, stats := range victims {
+		delete(sm.UserStats, stats.Username)
+		if sm.spill != nil {
+			sm.spilling[stats.Username] = stats
+		}
+	}
+	sm.evictions.Add(uint64(n))
+	log.Printf("Evicted %d least recently active users from in-memory stats (cap %d)", n, sm.maxUsers)
 
-	// Get or create user statistics
-	stats, ok := sm.UserStats[username]
-	if !ok {
-		stats = &UserStats{
-			Username:       username,
-			ConnectedSince: time.Now(),
+	if sm.spill == nil {
+		return nil
+	}
+	return victims
+}
+
+// spillUsers writes evicted users to the spill store. Users that could not
+// be written go back into memory and eviction pauses for a while, so a
+// failing disk does not turn every new user into another write attempt.
+func (sm *StatsManager) spillUsers(victims []*UserStats) {
+	// Batches for the same user can overlap when it returns and is evicted
+	// again; writes are serialised and only the latest record is written
+	sm.spillMu.Lock()
+	defer sm.spillMu.Unlock()
+
+	var failed []*UserStats
+	var firstErr error
+	for _, stats := range victims {
+		sm.RLock()
+		latest := sm.spilling[stats.Username] == stats
+		sm.RUnlock()
+		if !latest {
+			continue
+		}
+		if err := sm.spill.Write(stats); err != nil {
+			failed = append(failed, stats)
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
-		sm.UserStats[username] = stats
 	}
 
-	// Update statistics
-	stats.ConnectionCount++
-	stats.LastAccess = time.Now()
+	sm.Lock()
+	defer sm.Unlock()
+	for _, stats := range failed {
+		// A user re-created meanwhile was seeded from this record already
+		if _, ok := sm.UserStats[stats.Username]; !ok && sm.spilling[stats.Username] == stats {
+			sm.UserStats[stats.Username] = stats
+		}
+	}
+	for _, stats := range victims {
+		if sm.spilling[stats.Username] == stats {
+			delete(sm.spilling, stats.Username)
+		}
+	}
+	sm.spillGen++
+
+	if firstErr != nil {
+		sm.evictAfter = time.Now().Add(evictRetryInterval)
+		log.Printf("Failed to save %d evicted users, keeping them in memory: %v", len(failed), firstErr)
+	}
 }
 
 // GetUserStats returns a map of all user statistics
@@ -192,35 +350,113 @@ func (sm *StatsManager) SaveStats() {
 		return
 	}
 
-	sm.Lock()
-	defer sm.Unlock()
+	if err := sm.save(); err != nil {
+		log.Printf("Failed to save stats: %v", err)
+		return
+	}
+
+	log.Printf("Statistics saved to %s", sm.Config.Stats.FilePath)
+}
 
-	// Mark as not dirty before saving
+// save writes the in-memory users to the stats file. Evicted users live in
+// the spill store, so the file stays bounded by maxUsers. The snapshot is
+// taken under the lock; encoding and writing happen outside it.
+func (sm *StatsManager) save() error {
+	sm.saveMu.Lock()
+	defer sm.saveMu.Unlock()
+
+	sm.Lock()
+	snapshot := make(map[string]*UserStats, len(sm.UserStats))
+	for k, v := range sm.UserStats {
+		copied := *v
+		snapshot[k] = &copied
+	}
+	// Reloaded users still in memory are about to be in the file; those
+	// evicted again have a current spill file that must be kept
+	var written []string
+	for name := range sm.reloaded {
+		if _, ok := snapshot[name]; ok {
+			written = append(written, name)
+		}
+	}
+	sm.reloaded = make(map[string]struct{})
 	sm.dirtyStats = false
+	sm.Unlock()
 
-	filePath := sm.Config.Stats.FilePath
-	dirPath := filepath.Dir(filePath)
+	if err := writeStatsFile(sm.Config.Stats.FilePath, snapshot); err != nil {
+		sm.Lock()
+		sm.dirtyStats = true
+		for _, name := range written {
+			sm.reloaded[name] = struct{}{}
+		}
+		sm.Unlock()
+		return err
+	}
 
-	// Ensure directory exists
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
-		log.Printf("Failed to create directory for stats file: %v", err)
+	sm.dropSpilled(written)
+	return nil
+}
+
+// dropSpilled removes the spill files of users the stats file now holds.
+// Without this a user who returns and is evicted again would replace their
+// spill file, and replacing files is far slower than creating them on
+// filesystems that flush on rename (ext4 auto_da_alloc).
+func (sm *StatsManager) dropSpilled(names []string) {
+	if len(names) == 0 {
 		return
 	}
 
+	// Holding spillMu keeps a concurrent eviction from writing a newer
+	// record between the check and the removal
+	sm.spillMu.Lock()
+	defer sm.spillMu.Unlock()
+	for _, name := range names {
+		sm.RLock()
+		_, inMemory := sm.UserStats[name]
+		sm.RUnlock()
+		if !inMemory {
+			continue
+		}
+		if err := sm.spill.Remove(name); err != nil {
+			log.Printf("Failed to remove evicted stats for %s: %v", name, err)
+		}
+	}
+}
+
+// writeStatsFile encodes stats and atomically replaces the stats file
+func writeStatsFile(filePath string, stats map[string]*UserStats) error {
+	// Ensure directory exists
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("create directory for stats file: %v", err)
+	}
+
 	// Encode statistics as JSON
-	data, err := json.MarshalIndent(sm.UserStats, "", "  ")
+	data, err := json.MarshalIndent(stats, "", "  ")
 	if err != nil {
-		log.Printf("Failed to encode stats data: %v", err)
-		return
+		return fmt.Errorf("encode stats data: %v", err)
 	}
 
 	// Write to file
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
-		log.Printf("Failed to write stats file: %v", err)
-		return
+	if err := writeFileAtomic(filePath, data, 0644); err != nil {
+		return fmt.Errorf("write stats file: %v", err)
 	}
+	return nil
+}
 
-	log.Printf("Statistics saved to %s", filePath)
+// readStatsFile decodes the stats file; a missing file yields nil, nil
+func readStatsFile(filePath string) (map[string]*UserStats, error) {
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read stats file: %v", err)
+	}
+	var stats map[string]*UserStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, fmt.Errorf("decode stats data: %v", err)
+	}
+	return stats, nil
 }
 
 // loadStats loads user statistics from a file
@@ -231,28 +467,109 @@ func (sm *StatsManager) loadStats() {
 
 	filePath := sm.Config.Stats.FilePath
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	stats, err := readStatsFile(filePath)
+	if err != nil {
+		log.Printf("Failed to load stats: %v", err)
+		return
+	}
+	if stats == nil {
 		log.Printf("Stats file does not exist, starting with empty stats")
 		return
 	}
 
-	// Read file
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		log.Printf("Failed to read stats file: %v", err)
-		return
+	// Keep only the most recently active users in memory and move the rest
+	// to the spill store. Files written before eviction existed can hold
+	// every user ever seen.
+	if len(stats) > sm.maxUsers {
+		list := make([]*UserStats, 0, len(stats))
+		for _, us := range stats {
+			list = append(list, us)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Disabled != list[j].Disabled {
+				return list[i].Disabled
+			}
+			return list[i].LastAccess.After(list[j].LastAccess)
+		})
+
+		spilled := 0
+		for _, us := range list[sm.maxUsers:] {
+			if us.Disabled {
+				continue
+			}
+			// Never replace a newer record evicted after the file was written
+			if saved, err := sm.spill.Read(us.Username); err == nil && saved != nil && saved.LastAccess.After(us.LastAccess) {
+				delete(stats, us.Username)
+				spilled++
+				continue
+			}
+			if err := sm.spill.Write(us); err != nil {
+				log.Printf("Failed to move %s to the evicted stats store, keeping in memory: %v", us.Username, err)
+				continue
+			}
+			delete(stats, us.Username)
+			spilled++
+		}
+		if spilled > 0 {
+			if err := writeStatsFile(filePath, stats); err != nil {
+				log.Printf("Failed to rewrite stats file after moving %d users out: %v", spilled, err)
+			}
+		}
 	}
 
-	// Decode JSON data
-	var stats map[string]*UserStats
-	if err := json.Unmarshal(data, &stats); err != nil {
-		log.Printf("Failed to decode stats data: %v", err)
-		return
+	// A user evicted after the file was last written has a newer spilled
+	// record; prefer it. Either way the next save makes the spill file
+	// redundant.
+	for name, us := range stats {
+		saved, err := sm.spill.Read(name)
+		if err != nil || saved == nil {
+			continue
+		}
+		if saved.LastAccess.After(us.LastAccess) {
+			saved.Disabled = us.Disabled
+			stats[name] = saved
+		}
+		sm.reloaded[name] = struct{}{}
 	}
 
 	sm.UserStats = stats
-	log.Printf("Statistics loaded from %s", filePath)
+	log.Printf("Statistics loaded from %s (%d users in memory)", filePath, len(stats))
+}
+
+// ForEachSavedUser calls fn with every user in the stats file and the spill
+// store, one record per user, streaming the spill store so the full history
+// is never held in memory at once. It is meant for one-off exports such as
+// the SQLite migration.
+func (sm *StatsManager) ForEachSavedUser(fn func(*UserStats) error) error {
+	if sm.Config.Stats.FilePath == "" {
+		return nil
+	}
+
+	main, err := readStatsFile(sm.Config.Stats.FilePath)
+	if err != nil {
+		return err
+	}
+
+	// Users in both places keep whichever record is newer
+	if err := sm.spill.ForEach(func(us *UserStats) error {
+		if cur, ok := main[us.Username]; ok {
+			if us.LastAccess.After(cur.LastAccess) {
+				us.Disabled = cur.Disabled
+				main[us.Username] = us
+			}
+			return nil
+		}
+		return fn(us)
+	}); err != nil {
+		return err
+	}
+
+	for _, us := range main {
+		if err := fn(us); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Stop stops the statistics manager and saves data if needed
@@ -336,7 +653,8 @@ func (w *UserTrafficWriter) Close() error {
 // CountingReader is a Reader that counts bytes read
 type CountingReader struct {
 	reader    interface{ Read([]byte) (int, error) }
-	bytesRead uint64
+	bytesRead atomic.Uint64 // read by tunnel checkpoints while the tunnel runs
+	firstRead time.Time
 }
 
 // NewCountingReader creates a new counting Reader
@@ -347,19 +665,27 @@ func NewCountingReader(reader interface{ Read([]byte) (int, error) }) *CountingR
 // Read reads data and counts bytes
 func (r *CountingReader) Read(p []byte) (n int, err error) {
 	n, err = r.reader.Read(p)
-	r.bytesRead += uint64(n)
+	if n > 0 && r.bytesRead.Load() == 0 {
+		r.firstRead = time.Now()
+	}
+	r.bytesRead.Add(uint64(n))
 	return
 }
 
 // BytesRead returns the number of bytes read
 func (r *CountingReader) BytesRead() uint64 {
-	return r.bytesRead
+	return r.bytesRead.Load()
+}
+
+// FirstRead returns when the first byte was read, or the zero time
+func (r *CountingReader) FirstRead() time.Time {
+	return r.firstRead
 }
 
 // CountingWriter is a Writer that counts bytes written
 type CountingWriter struct {
 	writer       interface{ Write([]byte) (int, error) }
-	bytesWritten uint64
+	bytesWritten atomic.Uint64
 }
 
 // NewCountingWriter creates a new counting Writer
@@ -370,13 +696,13 @@ func NewCountingWriter(writer interface{ Write([]byte) (int, error) }) *Counting
 // Write writes data and counts bytes
 func (w *CountingWriter) Write(p []byte) (n int, err error) {
 	n, err = w.writer.Write(p)
-	w.bytesWritten += uint64(n)
+	w.bytesWritten.Add(uint64(n))
 	return
 }
 
 // BytesWritten returns the number of bytes written
 func (w *CountingWriter) BytesWritten() uint64 {
-	return w.bytesWritten
+	return w.bytesWritten.Load()
 }
 
 // PrintStats prints statistics for debugging
@@ -411,56 +737,20 @@ func (sm *StatsManager) IsUserDisabled(username string) bool {
 
 // DisableUser disables a specified user
 func (sm *StatsManager) DisableUser(username string) bool {
-	sm.Lock()
-	defer sm.Unlock()
-
-	sm.dirtyStats = true
-
-	stats, ok := sm.UserStats[username]
-	if !ok {
-		// User does not exist, create one and disable it
-		stats = &UserStats{
-			Username:       username,
-			ConnectedSince: time.Now(),
-			Disabled:       true,
-		}
-		sm.UserStats[username] = stats
-		return true
-	}
-
-	// Already disabled, return false
-	if stats.Disabled {
-		return false
-	}
-
-	stats.Disabled = true
-	return true
+	changed := false
+	sm.update(username, func(stats *UserStats, created bool) {
+		changed = created || !stats.Disabled
+		stats.Disabled = true
+	})
+	return changed
 }
 
 // EnableUser enables a specified user
 func (sm *StatsManager) EnableUser(username string) bool {
-	sm.Lock()
-	defer sm.Unlock()
-
-	sm.dirtyStats = true
-
-	stats, ok := sm.UserStats[username]
-	if !ok {
-		// User does not exist, create one and enable it
-		stats = &UserStats{
-			Username:       username,
-			ConnectedSince: time.Now(),
-			Disabled:       false,
-		}
-		sm.UserStats[username] = stats
-		return true
-	}
-
-	// Already enabled, return false
-	if !stats.Disabled {
-		return false
-	}
-
-	stats.Disabled = false
-	return true
+	changed := false
+	sm.update(username, func(stats *UserStats, created bool) {
+		changed = created || stats.Disabled
+		stats.Disabled = false
+	})
+	return changed
 }
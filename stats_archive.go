@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StatsArchiveConfig moves complete months of aggregates out of the stats
+// database into S3-compatible object storage, keeping the live database
+// small while the history stays available for analytics
+type StatsArchiveConfig struct {
+	Endpoint        string `json:"endpoint"` // e.g. https://s3.eu-west-1.amazonaws.com or a MinIO URL; empty disables archiving
+	Region          string `json:"region"`   // Default us-east-1
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"` // Key prefix, e.g. "proxy-eu/"
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"` // May be a secret reference
+	KeepMonths      int    `json:"keep_months"`       // Complete months kept locally besides the current one (default 1)
+}
+
+// StatsArchiver uploads each complete month older than the kept ones as
+// gzipped CSV, then deletes its rows from the stats database
+type StatsArchiver struct {
+	db     *StatsDB
+	cfg    StatsArchiveConfig
+	keep   int
+	client *http.Client
+
+	failures atomic.Uint64
+}
+
+// NewStatsArchiver returns nil when no archive endpoint is configured
+func NewStatsArchiver(config *Config, db *StatsDB) *StatsArchiver {
+	ac := config.Stats.Archive
+	if db == nil || ac.Endpoint == "" {
+		return nil
+	}
+	if ac.Bucket == "" {
+		log.Printf("Stats archive: no bucket configured, archiving disabled")
+		return nil
+	}
+	if ac.Region == "" {
+		ac.Region = "us-east-1"
+	}
+	a := &StatsArchiver{
+		db:     db,
+		cfg:    ac,
+		keep:   firstPositive(ac.KeepMonths, 1),
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+	metrics.Counter("https_proxy_stats_archive_failures_total", "Stats archive runs that failed to upload or prune a month.", func() float64 {
+		return float64(a.failures.Load())
+	})
+	return a
+}
+
+// Run archives whatever is due now and then every six hours, forever
+func (a *StatsArchiver) Run() {
+	if a == nil {
+		return
+	}
+	for {
+		if err := a.Archive(context.Background(), time.Now()); err != nil {
+			a.failures.Add(1)
+			log.Printf("Stats archive: %v", err)
+		}
+		time.Sleep(6 * time.Hour)
+	}
+}
+
+// Archive moves every month before the kept ones, oldest first, stopping at
+// the first failure so no month is pruned without its upload
+func (a *StatsArchiver) Archive(ctx context.Context, now time.Time) error {
+	if a.db.ReadOnly() {
+		return nil
+	}
+	current, _ := calendarMonth(now.Local())
+	cutoff := current.AddDate(0, -a.keep, 0)
+	for {
+		start, ok, err := a.db.oldestArchivable(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok || !start.Before(cutoff) {
+			return nil
+		}
+		if err := a.archiveMonth(ctx, start, now); err != nil {
+			return fmt.Errorf("%s: %w", start.Format("2006-01"), err)
+		}
+	}
+}
+
+// archiveMonth uploads and prunes the month beginning at start
+func (a *StatsArchiver) archiveMonth(ctx context.Context, start, now time.Time) error {
+	_, end := calendarMonth(start)
+	month := start.Format("2006-01")
+	report := ArchiveReport{Time: now, Month: month}
+
+	for _, part := range []struct {
+		name  string
+		write func(io.Writer) (int64, error)
+		rows  *int64
+	}{
+		{"user_hourly", func(w io.Writer) (int64, error) { return a.db.writeUserHourlyCSV(ctx, w, start, end) }, &report.UserRows},
+		{"domains", func(w io.Writer) (int64, error) { return a.db.writeDomainCSV(ctx, w, end) }, &report.DomainRows},
+	} {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		n, err := part.write(zw)
+		if err != nil {
+			return fmt.Errorf("export %s: %w", part.name, err)
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		key := a.cfg.Prefix + month + "/" + part.name + ".csv.gz"
+		if err := a.put(ctx, key, buf.Bytes(), now); err != nil {
+			return err
+		}
+		*part.rows = n
+		report.Objects = append(report.Objects, key)
+	}
+
+	if err := a.db.pruneArchived(ctx, start, end, report); err != nil {
+		return fmt.Errorf("prune: %w", err)
+	}
+	log.Printf("Stats archive: moved %s to %s (%d hourly rows, %d domain rows)", month, a.cfg.Bucket, report.UserRows, report.DomainRows)
+	return nil
+}
+
+// put uploads body as the object key, path-style so any S3-compatible
+// store accepts it
+func (a *StatsArchiver) put(ctx context.Context, key string, body []byte, now time.Time) error {
+	url := strings.TrimSuffix(a.cfg.Endpoint, "/") + "/" + a.cfg.Bucket + "/" + key
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	signS3(req, body, a.cfg.Region, a.cfg.AccessKeyID, secretValue(a.cfg.SecretAccessKey), now)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("upload %s: %s: %s", key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// signS3 signs req with AWS Signature Version 4, covering the host, the
+// date and the payload hash
+func signS3(req *http.Request, payload []byte, region, accessKey, secretKey string, now time.Time) {
+	sum := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(sum[:])
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{amzDate[:8], region, "s3", "aws4_request", toSign} {
+		m := hmac.New(sha256.New, key)
+		m.Write([]byte(part))
+		key = m.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, hex.EncodeToString(key)))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsArchiver(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	fail := true
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		if r.Method != http.MethodPut || r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) ||
+			!strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+			return
+		}
+		objects[r.URL.Path] = body
+	}))
+	defer s3.Close()
+
+	db := newExpiryTestDB(t)
+	cfg := &Config{}
+	if NewStatsArchiver(cfg, db) != nil {
+		t.Fatal("archiver built without an endpoint")
+	}
+	cfg.Stats.Archive = StatsArchiveConfig{Endpoint: s3.URL, Bucket: "stats", Prefix: "eu/", AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	a := NewStatsArchiver(cfg, db)
+
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	at := func(month time.Month, day int) time.Time { return time.Date(2026, month, day, 9, 0, 0, 0, time.Local) }
+	var records []TrafficRecord
+	for _, ts := range []time.Time{at(7, 30), at(8, 2), at(9, 5), at(10, 1)} {
+		records = append(records, TrafficRecord{Username: "alice", Domain: "example.com", Upload: 100, ConnCount: 1,
+			Hour: ts.Format("2006-01-02T15:00:00"), Timestamp: ts})
+	}
+	records = append(records, TrafficRecord{Username: "bob", Domain: "old.example", Download: 50, ConnCount: 1,
+		Hour: at(8, 3).Format("2006-01-02T15:00:00"), Timestamp: at(8, 3)})
+	if err := db.BatchUpsert(records); err != nil {
+		t.Fatal(err)
+	}
+	hourlyRows := func() (n int) {
+		db.sqlDB().QueryRow(`SELECT COUNT(*) FROM hourly_stats`).Scan(&n)
+		return n
+	}
+
+	// Nothing is pruned while uploads fail
+	if err := a.Archive(context.Background(), now); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Fatalf("failed upload: %v", err)
+	}
+	if n := hourlyRows(); n != 5 {
+		t.Fatalf("%d hourly rows after a failed upload, want 5", n)
+	}
+
+	// July and August go; September is kept as the last complete month
+	fail = false
+	if err := a.Archive(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	if n := hourlyRows(); n != 2 {
+		t.Errorf("%d hourly rows left, want 2", n)
+	}
+	var domains int
+	db.sqlDB().QueryRow(`SELECT COUNT(*) FROM domain_stats`).Scan(&domains)
+	if domains != 1 {
+		t.Errorf("%d domain rows left, want alice's still visited one", domains)
+	}
+
+	read := func(key string) [][]string {
+		zr, err := gzip.NewReader(bytes.NewReader(objects["/stats/eu/"+key]))
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		recs, _ := csv.NewReader(zr).ReadAll()
+		return recs
+	}
+	if recs := read("2026-08/user_hourly.csv.gz"); len(recs) != 3 || recs[1][0] != "alice" || recs[2][0] != "bob" || recs[2][2] != "0" || recs[2][3] != "50" {
+		t.Errorf("August hourly = %v", recs)
+	}
+	if recs := read("2026-08/domains.csv.gz"); len(recs) != 2 || recs[1][1] != "old.example" {
+		t.Errorf("August domains = %v", recs)
+	}
+	if len(objects) != 4 {
+		t.Errorf("objects = %d, want 2 per month", len(objects))
+	}
+	if r := db.LastArchive(); r == nil || r.Month != "2026-08" || r.UserRows != 2 || r.DomainRows != 1 {
+		t.Errorf("last archive = %+v", r)
+	}
+}
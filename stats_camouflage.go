@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// camouflagePathMax caps the length of recorded camouflage paths; scanners
+// send long ones
+const camouflagePathMax = 128
+
+// camouflageOtherPath collects the paths beyond the collector's buffer cap
+const camouflageOtherPath = "(other)"
+
+// camouflageKey identifies a camouflage aggregation bucket
+type camouflageKey struct {
+	Hour    string
+	Path    string
+	Country string
+}
+
+// camouflageAgg accumulates the requests of a camouflage bucket
+type camouflageAgg struct {
+	Requests    uint64
+	Upload      uint64 // Request bytes
+	Download    uint64 // Response bytes
+	CountryName string
+}
+
+// camouflagePath returns the path recorded for a camouflage request: no
+// query, and at most camouflagePathMax bytes
+func camouflagePath(r *http.Request) string {
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	if len(path) > camouflagePathMax {
+		path = path[:camouflagePathMax]
+	}
+	return path
+}
+
+// observeCamouflage adds a camouflage request to m. Past max buckets, new
+// paths are counted under camouflageOtherPath so scans of random paths
+// cannot grow the buffer.
+func observeCamouflage(m map[camouflageKey]*camouflageAgg, ev TrafficEvent, hour string, max int) {
+	key := camouflageKey{Hour: hour, Path: ev.Path, Country: ev.Country}
+	agg, ok := m[key]
+	if !ok && len(m) >= max {
+		key.Path = camouflageOtherPath
+		agg, ok = m[key]
+	}
+	if !ok {
+		agg = &camouflageAgg{CountryName: ev.CountryName}
+		m[key] = agg
+	}
+	agg.Requests++
+	agg.Upload += ev.Upload
+	agg.Download += ev.Download
+}
+
+// camouflageWriter counts the bytes of a camouflage response
+type camouflageWriter struct {
+	http.ResponseWriter
+	written uint64
+	status  int
+}
+
+func (w *camouflageWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Status returns the status of the response, 200 if the header was
+// written implicitly
+func (w *camouflageWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *camouflageWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += uint64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection's writer
+func (w *camouflageWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// recordCamouflage records a request answered on behalf of the camouflage
+// site, with the bytes of its body and of the response
+func (p *Proxy) recordCamouflage(r *http.Request, upload, download uint64) {
+	if p.StatsCollector == nil {
+		return
+	}
+	clientIP := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientIP = h
+	}
+	p.StatsCollector.Record(TrafficEvent{
+		Camouflage: true,
+		Path:       camouflagePath(r),
+		ClientIP:   clientIP,
+		Upload:     upload,
+		Download:   download,
+		Timestamp:  time.Now(),
+	})
+}
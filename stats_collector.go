@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DefaultMaxBufferEntries caps the collector's aggregation buffer when not
+// configured
+const DefaultMaxBufferEntries = 5000
+
 // TrafficEvent is emitted when a CONNECT tunnel closes, carrying per-connection
-// traffic information with domain and directional byte counts.
+// traffic information with domain and directional byte counts. Long tunnels
+// also emit partial events while open; the closing event then carries only
+// the bytes not reported yet.
 type TrafficEvent struct {
 	Username    string
 	Domain      string
+	Tag         string // Client-supplied connection tag, if any
 	TargetIP    string
 	Upload      uint64
 	Download    uint64
@@ -18,12 +29,24 @@ type TrafficEvent struct {
 	Country     string
 	CountryName string
 	Continent   string
+	Duration    time.Duration // how long the tunnel was open
+	TTFB        time.Duration // until the target's first byte; zero if it sent nothing
+	Partial     bool          // traffic of a still open tunnel; not counted as a connection
+	// A request answered on behalf of the camouflage site; Upload and
+	// Download are its request and response bytes, located by ClientIP
+	Camouflage bool
+	Path       string
+	ClientIP   string
+	// A CONNECT whose dial failed with this error code, e.g. dial_timeout;
+	// no tunnel was opened and no bytes were carried
+	DialError string
 }
 
 // bufferKey uniquely identifies an aggregation bucket.
 type bufferKey struct {
 	Username string
 	Domain   string
+	Tag      string
 	Country  string
 	Minute   string
 	Hour     string
@@ -46,30 +69,71 @@ type StatsCollector struct {
 	geoIP   *GeoIPService
 	eventCh chan TrafficEvent
 
-	mu     sync.Mutex
-	buffer map[bufferKey]*aggregatedEvent
+	mu      sync.Mutex
+	buffer  map[bufferKey]*aggregatedEvent
+	latency map[latencyKey]*LatencyHistogram // per user and domain, since the last flush
+	// camouflage requests since the last flush
+	camouflage map[camouflageKey]*camouflageAgg
+	// failed dials since the last flush
+	dialFailures map[dialFailureKey]*dialFailureAgg
 
 	flushInterval time.Duration
+	intervalCh    chan time.Duration // flush interval changes for the loop
 	maxBuffer     int
 	done          chan struct{}
 	wg            sync.WaitGroup
+
+	evicted       atomic.Uint64 // buckets flushed early by LRU eviction
+	droppedEvents atomic.Uint64 // events lost to a full channel
+	droppedBucket atomic.Uint64 // buckets discarded while the DB was failing
+	writeErrors   atomic.Uint64 // failed database writes
+
+	shutdownTimeout atomic.Int64 // bound on the last flush, see SetShutdownTimeout
 }
 
 // NewStatsCollector creates a new collector. flushSeconds controls
-// how often the buffer is written to disk (default 30s).
-func NewStatsCollector(db *StatsDB, geoIP *GeoIPService, flushSeconds int) *StatsCollector {
+// how often the buffer is written to disk (default 30s); maxBuffer caps the
+// number of in-memory aggregation buckets (default 5000).
+func NewStatsCollector(db *StatsDB, geoIP *GeoIPService, flushSeconds, maxBuffer int) *StatsCollector {
 	if flushSeconds <= 0 {
 		flushSeconds = 30
 	}
+	if maxBuffer <= 0 {
+		maxBuffer = DefaultMaxBufferEntries
+	}
 	sc := &StatsCollector{
 		db:            db,
 		geoIP:         geoIP,
 		eventCh:       make(chan TrafficEvent, 10000),
 		buffer:        make(map[bufferKey]*aggregatedEvent),
+		latency:       make(map[latencyKey]*LatencyHistogram),
+		camouflage:    make(map[camouflageKey]*camouflageAgg),
+		dialFailures:  make(map[dialFailureKey]*dialFailureAgg),
 		flushInterval: time.Duration(flushSeconds) * time.Second,
-		maxBuffer:     5000,
+		intervalCh:    make(chan time.Duration, 1),
+		maxBuffer:     maxBuffer,
 		done:          make(chan struct{}),
 	}
+
+	metrics.Gauge("https_proxy_collector_buffer_entries", "Aggregation buckets waiting to be flushed to the stats database.", func() float64 {
+		return float64(sc.bufferLen())
+	})
+	metrics.Counter("https_proxy_collector_evicted_total", "Aggregation buckets flushed early because the buffer reached its cap.", func() float64 {
+		return float64(sc.evicted.Load())
+	})
+	metrics.Counter("https_proxy_collector_dropped_events_total", "Traffic events dropped because the collector channel was full.", func() float64 {
+		return float64(sc.droppedEvents.Load())
+	})
+	metrics.Counter("https_proxy_collector_write_errors_total", "Failed writes of aggregation buckets to the stats database.", func() float64 {
+		return float64(sc.writeErrors.Load())
+	})
+	metrics.Counter("https_proxy_collector_dropped_buckets_total", "Aggregation buckets discarded because the buffer stayed over its cap while the database was failing.", func() float64 {
+		return float64(sc.droppedBucket.Load())
+	})
+
+	sc.shutdownTimeout.Store(int64(DefaultCollectorShutdownTimeout))
+	sc.restoreSpill()
+
 	sc.wg.Add(1)
 	go sc.loop()
 	return sc
@@ -78,9 +142,14 @@ func NewStatsCollector(db *StatsDB, geoIP *GeoIPService, flushSeconds int) *Stat
 // Record sends a TrafficEvent into the collector. Non-blocking – if the
 // channel is full the event is silently dropped (and logged).
 func (sc *StatsCollector) Record(ev TrafficEvent) {
-	// Enrich with GeoIP if not already set
-	if ev.Country == "" && ev.TargetIP != "" && sc.geoIP != nil {
-		if geo := sc.geoIP.Lookup(ev.TargetIP); geo != nil {
+	// Enrich with GeoIP if not already set: the target's country, or the
+	// client's for camouflage requests
+	ip := ev.TargetIP
+	if ev.Camouflage {
+		ip = ev.ClientIP
+	}
+	if ev.Country == "" && ip != "" && sc.geoIP != nil {
+		if geo := sc.geoIP.Lookup(ip); geo != nil {
 			ev.Country = geo.Country
 			ev.CountryName = geo.CountryName
 			ev.Continent = geo.Continent
@@ -90,11 +159,30 @@ func (sc *StatsCollector) Record(ev TrafficEvent) {
 	select {
 	case sc.eventCh <- ev:
 	default:
+		sc.droppedEvents.Add(1)
 		log.Printf("[StatsCollector] Channel full, dropping event for %s/%s", ev.Username, ev.Domain)
 	}
 }
 
+// SetFlushInterval changes how often the buffer is written. The next flush
+// happens one new interval after the call.
+func (sc *StatsCollector) SetFlushInterval(d time.Duration) {
+	for {
+		select {
+		case sc.intervalCh <- d:
+			return
+		default:
+			// Replace a change the loop has not picked up yet
+			select {
+			case <-sc.intervalCh:
+			default:
+			}
+		}
+	}
+}
+
 // Stop flushes remaining data and shuts down the background goroutine.
+// Data not written within the shutdown timeout is spilled to disk.
 func (sc *StatsCollector) Stop() {
 	close(sc.done)
 	sc.wg.Wait()
@@ -105,16 +193,24 @@ func (sc *StatsCollector) loop() {
 	ticker := time.NewTicker(sc.flushInterval)
 	defer ticker.Stop()
 
+	// After a failed eviction write the buffer stays full; wait for the next
+	// tick instead of sorting and retrying the write on every event
+	evictPaused := false
+
 	for {
 		select {
 		case ev := <-sc.eventCh:
 			sc.aggregate(ev)
-			// Force flush if buffer is too large
-			if sc.bufferLen() >= sc.maxBuffer {
-				sc.flush()
+			// Flush the least recently updated buckets if the buffer is full
+			if !evictPaused && sc.bufferLen() >= sc.maxBuffer {
+				evictPaused = !sc.evictOldest()
 			}
 		case <-ticker.C:
 			sc.flush()
+			evictPaused = false
+		case d := <-sc.intervalCh:
+			sc.flushInterval = d
+			ticker.Reset(d)
 		case <-sc.done:
 			// Drain remaining events
 			for {
@@ -122,7 +218,7 @@ func (sc *StatsCollector) loop() {
 				case ev := <-sc.eventCh:
 					sc.aggregate(ev)
 				default:
-					sc.flush()
+					sc.finalFlush()
 					return
 				}
 			}
@@ -138,9 +234,23 @@ func (sc *StatsCollector) aggregate(ev TrafficEvent) {
 	minute := t.Truncate(time.Minute).Format("2006-01-02T15:04:00")
 	hour := t.Truncate(time.Hour).Format("2006-01-02T15:00:00")
 
+	if ev.Camouflage {
+		sc.mu.Lock()
+		observeCamouflage(sc.camouflage, ev, hour, sc.maxBuffer)
+		sc.mu.Unlock()
+		return
+	}
+	if ev.DialError != "" {
+		sc.mu.Lock()
+		observeDialFailure(sc.dialFailures, ev, t, sc.maxBuffer)
+		sc.mu.Unlock()
+		return
+	}
+
 	key := bufferKey{
 		Username: ev.Username,
 		Domain:   ev.Domain,
+		Tag:      ev.Tag,
 		Country:  ev.Country,
 		Minute:   minute,
 		Hour:     hour,
@@ -159,10 +269,14 @@ func (sc *StatsCollector) aggregate(ev TrafficEvent) {
 	}
 	agg.Upload += ev.Upload
 	agg.Download += ev.Download
-	agg.ConnCount++
 	if t.After(agg.LastSeen) {
 		agg.LastSeen = t
 	}
+	if ev.Partial {
+		return
+	}
+	agg.ConnCount++
+	observeTunnel(sc.latency, ev.Username, ev.Domain, ev.Duration, ev.TTFB)
 }
 
 func (sc *StatsCollector) bufferLen() int {
@@ -171,22 +285,158 @@ func (sc *StatsCollector) bufferLen() int {
 	return len(sc.buffer)
 }
 
+// evictOldest writes the least recently updated tenth of the buffer to the
+// database, keeping hot buckets in memory to aggregate further. It reports
+// whether the write succeeded.
+func (sc *StatsCollector) evictOldest() bool {
+	sc.mu.Lock()
+	keys := make([]bufferKey, 0, len(sc.buffer))
+	for key := range sc.buffer {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return sc.buffer[keys[i]].LastSeen.Before(sc.buffer[keys[j]].LastSeen)
+	})
+	n := sc.maxBuffer / 10
+	if n < 1 {
+		n = 1
+	}
+	if n > len(keys) {
+		n = len(keys)
+	}
+	buf := make(map[bufferKey]*aggregatedEvent, n)
+	for _, key := range keys[:n] {
+		buf[key] = sc.buffer[key]
+		delete(sc.buffer, key)
+	}
+	sc.mu.Unlock()
+
+	sc.evicted.Add(uint64(n))
+	return sc.write(buf)
+}
+
 func (sc *StatsCollector) flush() {
 	sc.mu.Lock()
-	if len(sc.buffer) == 0 {
+	if len(sc.buffer) == 0 && len(sc.latency) == 0 && len(sc.camouflage) == 0 && len(sc.dialFailures) == 0 {
 		sc.mu.Unlock()
 		return
 	}
-	// Swap out the buffer under lock
+	// Swap out the buffers under lock
 	buf := sc.buffer
 	sc.buffer = make(map[bufferKey]*aggregatedEvent, len(buf))
+	lat := sc.latency
+	sc.latency = make(map[latencyKey]*LatencyHistogram, len(lat))
+	cam := sc.camouflage
+	sc.camouflage = make(map[camouflageKey]*camouflageAgg, len(cam))
+	dial := sc.dialFailures
+	sc.dialFailures = make(map[dialFailureKey]*dialFailureAgg, len(dial))
 	sc.mu.Unlock()
 
+	if len(buf) > 0 {
+		sc.write(buf)
+	}
+	sc.writeLatency(lat)
+	sc.writeCamouflage(cam)
+	sc.writeDialFailures(dial)
+}
+
+// writeDialFailures adds the failed-dial buckets to the database, merging
+// them back for the next flush on failure while there is room
+func (sc *StatsCollector) writeDialFailures(dial map[dialFailureKey]*dialFailureAgg) {
+	if err := sc.db.UpsertDialFailuresContext(context.Background(), dial); err != nil {
+		if !errors.Is(err, errStatsReadOnly) {
+			sc.writeErrors.Add(1)
+			log.Printf("[StatsCollector] Dial failure flush error: %v (will retry next cycle)", err)
+		}
+		sc.mu.Lock()
+		for key, agg := range dial {
+			if existing, ok := sc.dialFailures[key]; ok {
+				existing.merge(agg)
+			} else if len(sc.dialFailures) < 2*sc.maxBuffer {
+				sc.dialFailures[key] = agg
+			}
+		}
+		sc.mu.Unlock()
+	}
+}
+
+// writeCamouflage adds the camouflage buckets to the database, merging
+// them back for the next flush on failure while there is room
+func (sc *StatsCollector) writeCamouflage(cam map[camouflageKey]*camouflageAgg) {
+	if err := sc.db.UpsertCamouflageContext(context.Background(), cam); err != nil {
+		if !errors.Is(err, errStatsReadOnly) {
+			sc.writeErrors.Add(1)
+			log.Printf("[StatsCollector] Camouflage flush error: %v (will retry next cycle)", err)
+		}
+		sc.mu.Lock()
+		for key, agg := range cam {
+			if existing, ok := sc.camouflage[key]; ok {
+				existing.Requests += agg.Requests
+				existing.Upload += agg.Upload
+				existing.Download += agg.Download
+			} else if len(sc.camouflage) < 2*sc.maxBuffer {
+				sc.camouflage[key] = agg
+			}
+		}
+		sc.mu.Unlock()
+	}
+}
+
+// writeLatency adds the latency histograms to the database, merging them
+// back for the next flush on failure
+func (sc *StatsCollector) writeLatency(lat map[latencyKey]*LatencyHistogram) {
+	if err := sc.db.UpsertLatency(lat); err != nil {
+		if !errors.Is(err, errStatsReadOnly) {
+			sc.writeErrors.Add(1)
+			log.Printf("[StatsCollector] Latency flush error: %v (will retry next cycle)", err)
+		}
+		sc.mu.Lock()
+		for key, h := range lat {
+			if existing, ok := sc.latency[key]; ok {
+				existing.merge(h)
+			} else {
+				sc.latency[key] = h
+			}
+		}
+		sc.mu.Unlock()
+	}
+}
+
+// write upserts buf into the database, putting it back into the buffer on
+// failure.
+func (sc *StatsCollector) write(buf map[bufferKey]*aggregatedEvent) bool {
+	if err := sc.db.BatchUpsert(trafficRecords(buf)); err != nil {
+		// While the database is read-only the buffer waits quietly
+		if !errors.Is(err, errStatsReadOnly) {
+			sc.writeErrors.Add(1)
+			log.Printf("[StatsCollector] Flush error: %v (will retry next cycle)", err)
+		}
+		// Re-add to buffer so data isn't lost
+		sc.mu.Lock()
+		for key, agg := range buf {
+			if existing, ok := sc.buffer[key]; ok {
+				existing.Upload += agg.Upload
+				existing.Download += agg.Download
+				existing.ConnCount += agg.ConnCount
+			} else {
+				sc.buffer[key] = agg
+			}
+		}
+		sc.trimLocked()
+		sc.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+// trafficRecords converts buffered buckets to database records
+func trafficRecords(buf map[bufferKey]*aggregatedEvent) []TrafficRecord {
 	records := make([]TrafficRecord, 0, len(buf))
 	for key, agg := range buf {
 		records = append(records, TrafficRecord{
 			Username:    key.Username,
 			Domain:      key.Domain,
+			Tag:         key.Tag,
 			Upload:      agg.Upload,
 			Download:    agg.Download,
 			ConnCount:   agg.ConnCount,
@@ -198,20 +448,27 @@ func (sc *StatsCollector) flush() {
 			Timestamp:   agg.LastSeen,
 		})
 	}
+	return records
+}
 
-	if err := sc.db.BatchUpsert(records); err != nil {
-		log.Printf("[StatsCollector] Flush error: %v (will retry next cycle)", err)
-		// Re-add to buffer so data isn't lost
-		sc.mu.Lock()
-		for key, agg := range buf {
-			if existing, ok := sc.buffer[key]; ok {
-				existing.Upload += agg.Upload
-				existing.Download += agg.Download
-				existing.ConnCount += agg.ConnCount
-			} else {
-				sc.buffer[key] = agg
-			}
-		}
-		sc.mu.Unlock()
+// trimLocked bounds memory while the database is failing: beyond twice the
+// cap, the oldest buckets are discarded. Must be called with mu held.
+func (sc *StatsCollector) trimLocked() {
+	hardCap := 2 * sc.maxBuffer
+	if len(sc.buffer) <= hardCap {
+		return
+	}
+	keys := make([]bufferKey, 0, len(sc.buffer))
+	for key := range sc.buffer {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return sc.buffer[keys[i]].LastSeen.Before(sc.buffer[keys[j]].LastSeen)
+	})
+	drop := len(keys) - hardCap
+	for _, key := range keys[:drop] {
+		delete(sc.buffer, key)
 	}
+	sc.droppedBucket.Add(uint64(drop))
+	log.Printf("[StatsCollector] Buffer over hard cap %d, discarded %d oldest buckets", hardCap, drop)
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// DefaultCollectorShutdownTimeout bounds the collector's last flush when not
+// configured
+const DefaultCollectorShutdownTimeout = 10 * time.Second
+
+// collectorSpillGrace is how long the last flush gets to roll back once the
+// shutdown timeout has cancelled it, so a write that committed after all is
+// not spilled as well
+const collectorSpillGrace = time.Second
+
+// collectorSpill is what the collector could not write before shutdown,
+// kept in <db_path>.spill.json and written on the next start
+type collectorSpill struct {
+	SchemaVersion int                 `json:"schema_version"` // TrafficSchemaVersion of the records
+	Records       []TrafficRecordWire `json:"records"`
+	Latency       []spilledLatency    `json:"latency,omitempty"`
+}
+
+type spilledLatency struct {
+	Key  latencyKey       `json:"key"`
+	Hist LatencyHistogram `json:"hist"`
+}
+
+// SetShutdownTimeout bounds how long Stop waits for the last flush; what is
+// not written by then goes to the spill file
+func (sc *StatsCollector) SetShutdownTimeout(d time.Duration) {
+	if d > 0 {
+		sc.shutdownTimeout.Store(int64(d))
+	}
+}
+
+func (sc *StatsCollector) spillPath() string {
+	return sc.db.Path() + ".spill.json"
+}
+
+// finalFlush writes the buffers before shutdown. A database locked by
+// another process can hold the write indefinitely, so it is cancelled after
+// the shutdown timeout and whatever it did not commit is spilled to disk.
+func (sc *StatsCollector) finalFlush() {
+	sc.mu.Lock()
+	buf, lat, cam, dial := sc.buffer, sc.latency, sc.camouflage, sc.dialFailures
+	sc.buffer = make(map[bufferKey]*aggregatedEvent)
+	sc.latency = make(map[latencyKey]*LatencyHistogram)
+	sc.camouflage = make(map[camouflageKey]*camouflageAgg)
+	sc.dialFailures = make(map[dialFailureKey]*dialFailureAgg)
+	sc.mu.Unlock()
+	if len(buf) == 0 && len(lat) == 0 && len(cam) == 0 && len(dial) == 0 {
+		return
+	}
+
+	timeout := time.Duration(sc.shutdownTimeout.Load())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	type result struct{ records, latency error }
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		if len(buf) > 0 {
+			res.records = sc.db.BatchUpsertContext(ctx, trafficRecords(buf))
+		}
+		res.latency = sc.db.UpsertLatencyContext(ctx, lat)
+		// Camouflage and failed-dial counts are not worth a spill; they are
+		// lost on failure
+		if err := sc.db.UpsertCamouflageContext(ctx, cam); err != nil && !errors.Is(err, errStatsReadOnly) {
+			log.Printf("[StatsCollector] Final flush lost %d camouflage buckets: %v", len(cam), err)
+		}
+		if err := sc.db.UpsertDialFailuresContext(ctx, dial); err != nil && !errors.Is(err, errStatsReadOnly) {
+			log.Printf("[StatsCollector] Final flush lost %d failed-dial buckets: %v", len(dial), err)
+		}
+		done <- res
+	}()
+
+	var res result
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		select {
+		case res = <-done:
+		case <-time.After(collectorSpillGrace):
+			res = result{ctx.Err(), ctx.Err()}
+		}
+	}
+	reason := res.records
+	if reason == nil {
+		buf = nil
+		reason = res.latency
+	}
+	if res.latency == nil {
+		lat = nil
+	}
+	if len(buf) == 0 && len(lat) == 0 {
+		return
+	}
+
+	spill := collectorSpill{SchemaVersion: TrafficSchemaVersion}
+	for _, r := range trafficRecords(buf) {
+		spill.Records = append(spill.Records, r.Wire())
+	}
+	for key, h := range lat {
+		spill.Latency = append(spill.Latency, spilledLatency{Key: key, Hist: *h})
+	}
+	data, err := json.Marshal(spill)
+	if err == nil {
+		err = writeFileAtomic(sc.spillPath(), data, 0644)
+	}
+	if err != nil {
+		log.Printf("[StatsCollector] Final flush failed (%v); lost %d buckets and %d latency histograms: %v", reason, len(spill.Records), len(spill.Latency), err)
+		return
+	}
+	log.Printf("[StatsCollector] Final flush failed (%v); spilled %d buckets and %d latency histograms to %s for the next start", reason, len(spill.Records), len(spill.Latency), sc.spillPath())
+}
+
+// restoreSpill loads the buckets spilled by the last shutdown into the
+// buffers and flushes them. The file is removed either way: what fails to
+// be written stays buffered, and is spilled again at the next shutdown.
+func (sc *StatsCollector) restoreSpill() {
+	data, err := os.ReadFile(sc.spillPath())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("[StatsCollector] Read spill file: %v", err)
+		return
+	}
+	var spill collectorSpill
+	if err := json.Unmarshal(data, &spill); err != nil {
+		log.Printf("[StatsCollector] Ignoring spill file %s: %v", sc.spillPath(), err)
+		return
+	}
+	records, err := spill.records(data)
+	if err != nil {
+		// Left in place for the build that wrote it
+		log.Printf("[StatsCollector] Ignoring spill file %s: %v", sc.spillPath(), err)
+		return
+	}
+
+	sc.mu.Lock()
+	for _, r := range records {
+		key := bufferKey{Username: r.Username, Domain: r.Domain, Tag: r.Tag, Country: r.Country, Minute: r.Minute, Hour: r.Hour}
+		sc.buffer[key] = &aggregatedEvent{
+			Upload:      r.Upload,
+			Download:    r.Download,
+			ConnCount:   r.ConnCount,
+			CountryName: r.CountryName,
+			Continent:   r.Continent,
+			LastSeen:    r.Timestamp,
+		}
+	}
+	for _, l := range spill.Latency {
+		h := l.Hist
+		sc.latency[l.Key] = &h
+	}
+	sc.mu.Unlock()
+
+	if err := os.Remove(sc.spillPath()); err != nil {
+		log.Printf("[StatsCollector] Remove spill file: %v", err)
+	}
+	log.Printf("[StatsCollector] Restored %d buckets and %d latency histograms spilled at the last shutdown", len(records), len(spill.Latency))
+	sc.flush()
+}
+
+// records returns the spilled records. Files written before the records
+// were versioned hold them under their Go field names; those of a newer
+// schema are refused.
+func (spill *collectorSpill) records(data []byte) ([]TrafficRecord, error) {
+	if spill.SchemaVersion == 0 {
+		var legacy struct {
+			Records []TrafficRecord `json:"records"`
+		}
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, err
+		}
+		return legacy.Records, nil
+	}
+	if err := checkTrafficSchema(spill.SchemaVersion, 1); err != nil {
+		return nil, err
+	}
+	records := make([]TrafficRecord, len(spill.Records))
+	for i, w := range spill.Records {
+		records[i] = w.Record()
+	}
+	return records, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import "time"
+
+// dialFailureOtherDomain collects the destinations beyond the collector's
+// buffer cap
+const dialFailureOtherDomain = "(other)"
+
+// dialFailureKey identifies a failed-dial aggregation bucket
+type dialFailureKey struct {
+	Username string
+	Domain   string
+	Class    string // error code sent to the client, e.g. dial_timeout
+}
+
+// dialFailureAgg accumulates the failed dials of a bucket
+type dialFailureAgg struct {
+	Count     uint64
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// observeDialFailure adds a failed dial to m. Past max buckets, new
+// destinations are counted under dialFailureOtherDomain so a client trying
+// random hosts cannot grow the buffer.
+func observeDialFailure(m map[dialFailureKey]*dialFailureAgg, ev TrafficEvent, t time.Time, max int) {
+	key := dialFailureKey{Username: ev.Username, Domain: ev.Domain, Class: ev.DialError}
+	agg, ok := m[key]
+	if !ok && len(m) >= max {
+		key.Domain = dialFailureOtherDomain
+		agg, ok = m[key]
+	}
+	if !ok {
+		agg = &dialFailureAgg{FirstSeen: t}
+		m[key] = agg
+	}
+	agg.Count++
+	if t.After(agg.LastSeen) {
+		agg.LastSeen = t
+	}
+}
+
+// merge adds o's failures to a
+func (a *dialFailureAgg) merge(o *dialFailureAgg) {
+	a.Count += o.Count
+	if o.FirstSeen.Before(a.FirstSeen) {
+		a.FirstSeen = o.FirstSeen
+	}
+	if o.LastSeen.After(a.LastSeen) {
+		a.LastSeen = o.LastSeen
+	}
+}
+
+// recordDialFailure records a CONNECT of username to host that failed with
+// the error code class before a tunnel was opened
+func (p *Proxy) recordDialFailure(username, host, class string) {
+	if p.StatsCollector == nil {
+		return
+	}
+	p.StatsCollector.Record(TrafficEvent{
+		Username:  username,
+		Domain:    host,
+		DialError: class,
+		Timestamp: time.Now(),
+	})
+}
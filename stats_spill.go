@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// spillStore keeps users evicted from StatsManager on disk, one small JSON
+// file per user, so a returning user can resume from their saved totals
+// without the whole history being loaded or rewritten. Files are sharded
+// into subdirectories by the first byte of the username hash.
+type spillStore struct {
+	dir string
+}
+
+// newSpillStore returns the store that sits next to the stats file, e.g.
+// stats.json -> stats.json.evicted/
+func newSpillStore(statsFile string) *spillStore {
+	return &spillStore{dir: statsFile + ".evicted"}
+}
+
+func (s *spillStore) path(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	name := hex.EncodeToString(sum[:16])
+	return filepath.Join(s.dir, name[:2], name+".json")
+}
+
+// Read returns the saved record for username, or nil if there is none
+func (s *spillStore) Read(username string) (*UserStats, error) {
+	data, err := os.ReadFile(s.path(username))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stats UserStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return nil, fmt.Errorf("decode %s: %v", s.path(username), err)
+	}
+	// Guard against hash collisions
+	if stats.Username != username {
+		return nil, nil
+	}
+	return &stats, nil
+}
+
+// Write saves stats, replacing any earlier record for the same user
+func (s *spillStore) Write(stats *UserStats) error {
+	path := s.path(stats.Username)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// Remove deletes the saved record for username, if any
+func (s *spillStore) Remove(username string) error {
+	err := os.Remove(s.path(username))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ForEach calls fn for every saved record, reading one file at a time
+func (s *spillStore) ForEach(fn func(*UserStats) error) error {
+	shards, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(s.dir, shard.Name()))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if filepath.Ext(f.Name()) != ".json" {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(s.dir, shard.Name(), f.Name()))
+			if err != nil {
+				return err
+			}
+			var stats UserStats
+			if err := json.Unmarshal(data, &stats); err != nil {
+				continue
+			}
+			if err := fn(&stats); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path,
+// so readers never see a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatsManager_EvictsLeastRecentlyActive(t *testing.T) {
+	cfg := &Config{}
+	cfg.Stats.Enabled = true
+	cfg.Stats.FilePath = filepath.Join(t.TempDir(), "stats.json")
+	cfg.Stats.MaxUsersInMemory = 10
+
+	sm := NewStatsManager(cfg)
+	sm.DisableUser("blocked")
+	for i := 0; i < 9; i++ {
+		sm.RecordTraffic(string(rune('a'+i)), 100)
+		time.Sleep(time.Millisecond)
+	}
+
+	// Cap reached: the next new user evicts the oldest active user ("a")
+	sm.RecordTraffic("new", 100)
+
+	if sm.GetUserStatsByName("a") != nil {
+		t.Error("least recently active user should have been evicted")
+	}
+	if !sm.IsUserDisabled("blocked") {
+		t.Error("disabled users must never be evicted")
+	}
+	if sm.GetUserStatsByName("new") == nil {
+		t.Error("new user should be in memory")
+	}
+
+	// The evicted user was saved and survives subsequent saves
+	sm.SaveStats()
+	saved := make(map[string]*UserStats)
+	if err := sm.ForEachSavedUser(func(us *UserStats) error {
+		saved[us.Username] = us
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEachSavedUser: %v", err)
+	}
+	if saved["a"] == nil || saved["a"].TotalBytes != 100 {
+		t.Errorf("evicted user not preserved: %+v", saved["a"])
+	}
+	if len(saved) != 11 {
+		t.Errorf("saved %d users, want all 11", len(saved))
+	}
+
+	// The stats file itself only holds the in-memory users
+	data, err := os.ReadFile(cfg.Stats.FilePath)
+	if err != nil {
+		t.Fatalf("read stats file: %v", err)
+	}
+	var file map[string]*UserStats
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("decode stats file: %v", err)
+	}
+	if _, ok := file["a"]; ok || len(file) != 10 {
+		t.Errorf("stats file holds %d users (a present: %v), want the 10 in memory", len(file), ok)
+	}
+}
+
+func TestStatsManager_ReturningUserKeepsTotals(t *testing.T) {
+	cfg := &Config{}
+	cfg.Stats.Enabled = true
+	cfg.Stats.FilePath = filepath.Join(t.TempDir(), "stats.json")
+	cfg.Stats.MaxUsersInMemory = 10
+
+	sm := NewStatsManager(cfg)
+	sm.RecordTraffic("alice", 1000)
+	time.Sleep(time.Millisecond)
+	for i := 0; i < 10; i++ {
+		sm.RecordTraffic(string(rune('a'+i)), 1)
+		time.Sleep(time.Millisecond)
+	}
+	if sm.GetUserStatsByName("alice") != nil {
+		t.Fatal("alice should have been evicted")
+	}
+
+	// alice comes back and resumes from her saved totals
+	sm.RecordTraffic("alice", 5)
+	if got := sm.GetUserStatsByName("alice"); got == nil || got.TotalBytes != 1005 {
+		t.Fatalf("alice after return = %+v, want 1005 bytes", got)
+	}
+	sm.SaveStats()
+
+	reloaded := NewStatsManager(cfg)
+	if got := reloaded.GetUserStatsByName("alice"); got == nil || got.TotalBytes != 1005 {
+		t.Errorf("alice after reload = %+v, want 1005 bytes", got)
+	}
+}
+
+func TestStatsManager_LoadTrimsLegacyFile(t *testing.T) {
+	cfg := &Config{}
+	cfg.Stats.Enabled = true
+	cfg.Stats.FilePath = filepath.Join(t.TempDir(), "stats.json")
+	cfg.Stats.MaxUsersInMemory = 10
+
+	// A file written before eviction existed, holding every user
+	legacy := make(map[string]*UserStats)
+	base := time.Now().Add(-time.Hour)
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("user%02d", i)
+		legacy[name] = &UserStats{Username: name, TotalBytes: uint64(i), LastAccess: base.Add(time.Duration(i) * time.Minute)}
+	}
+	if err := writeStatsFile(cfg.Stats.FilePath, legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	sm := NewStatsManager(cfg)
+	if n := len(sm.GetUserStats()); n != 10 {
+		t.Errorf("%d users in memory, want 10", n)
+	}
+	if sm.GetUserStatsByName("user24") == nil || sm.GetUserStatsByName("user00") != nil {
+		t.Error("the most recently active users should be kept in memory")
+	}
+
+	// Migration sees every user exactly once
+	seen := make(map[string]int)
+	if err := sm.ForEachSavedUser(func(us *UserStats) error {
+		seen[us.Username]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 25 {
+		t.Errorf("ForEachSavedUser saw %d users, want 25", len(seen))
+	}
+	for name, n := range seen {
+		if n != 1 {
+			t.Errorf("%s seen %d times", name, n)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tunnelReporter reports an open tunnel's traffic to the collector every
+// stats.tunnel_report_seconds, so a call or download lasting hours shows up
+// in the minute stats as it happens rather than all at once when it closes
+type tunnelReporter struct {
+	collector *StatsCollector
+	event     TrafficEvent // identifies the tunnel; byte counts are filled in
+	upload    func() uint64
+	download  func() uint64
+
+	mu                       sync.Mutex
+	reportedUp, reportedDown uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startTunnelReports starts reporting the tunnel described by event, whose
+// byte counts so far upload and download return. It returns nil when the
+// reports are disabled or there is no collector.
+func (p *Proxy) startTunnelReports(event TrafficEvent, upload, download func() uint64) *tunnelReporter {
+	if p.StatsCollector == nil || p.Config == nil || p.Config.Stats.TunnelReportSeconds <= 0 {
+		return nil
+	}
+	tr := &tunnelReporter{
+		collector: p.StatsCollector,
+		event:     event,
+		upload:    upload,
+		download:  download,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go tr.loop(time.Duration(p.Config.Stats.TunnelReportSeconds) * time.Second)
+	return tr
+}
+
+func (tr *tunnelReporter) loop(interval time.Duration) {
+	defer close(tr.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tr.stop:
+			return
+		case now := <-ticker.C:
+			tr.report(now)
+		}
+	}
+}
+
+// report emits the traffic since the last report as a partial event
+func (tr *tunnelReporter) report(now time.Time) {
+	up, down := tr.upload(), tr.download()
+	tr.mu.Lock()
+	ev := tr.event
+	ev.Upload, ev.Download = up-tr.reportedUp, down-tr.reportedDown
+	tr.reportedUp, tr.reportedDown = up, down
+	tr.mu.Unlock()
+	if ev.Upload == 0 && ev.Download == 0 {
+		return
+	}
+	ev.Partial = true
+	ev.Timestamp = now
+	tr.collector.Record(ev)
+}
+
+// Close stops the reports and returns the tunnel's closing event with the
+// bytes already reported taken off, so nothing is counted twice
+func (tr *tunnelReporter) Close(final TrafficEvent) TrafficEvent {
+	if tr == nil {
+		return final
+	}
+	close(tr.stop)
+	<-tr.done
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	final.Upload -= min(final.Upload, tr.reportedUp)
+	final.Download -= min(final.Download, tr.reportedDown)
+	return final
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+)
+
+// defaultTagHeader is the CONNECT header clients use to tag a tunnel
+const defaultTagHeader = "X-Proxy-Tag"
+
+// maxTagLength bounds the size of a tag stored in the stats database
+const maxTagLength = 64
+
+// connectionTag returns the validated tag a client attached to a CONNECT
+// request, or "" when none was sent or tagging is not configured. Tags must
+// match one of proxy.tags.allowed (glob patterns) so clients cannot create
+// unbounded stats cardinality.
+func (p *Proxy) connectionTag(r *http.Request) (string, error) {
+	cfg := p.Config.Proxy.Tags
+	header := cfg.Header
+	if header == "" {
+		header = defaultTagHeader
+	}
+	tag := r.Header.Get(header)
+	if tag == "" || len(cfg.Allowed) == 0 {
+		return "", nil
+	}
+	if len(tag) > maxTagLength || !isValidTag(tag) {
+		return "", fmt.Errorf("invalid %s value", header)
+	}
+	for _, pattern := range cfg.Allowed {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return tag, nil
+		}
+	}
+	return "", fmt.Errorf("%s %q is not allowed", header, tag)
+}
+
+// isValidTag allows letters, digits, '.', '_' and '-'
+func isValidTag(tag string) bool {
+	for _, c := range tag {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
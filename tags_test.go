@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxy_ConnectionTag(t *testing.T) {
+	cfg := &Config{}
+	cfg.Proxy.Tags.Allowed = []string{"workload-a", "batch-*"}
+	p := &Proxy{Config: cfg}
+
+	tests := []struct {
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"workload-a", "workload-a", false},
+		{"batch-42", "batch-42", false},
+		{"workload-b", "", true},
+		{"batch-1 2", "", true},
+		{"batch-é", "", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+		if tt.tag != "" {
+			r.Header.Set("X-Proxy-Tag", tt.tag)
+		}
+		got, err := p.connectionTag(r)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("tag %q: got %q, %v; want %q, error %v", tt.tag, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	// Tagging is off without an allowlist: tags are ignored, not rejected
+	p.Config = &Config{}
+	r := httptest.NewRequest(http.MethodConnect, "example.com:443", nil)
+	r.Header.Set("X-Proxy-Tag", "anything")
+	if got, err := p.connectionTag(r); got != "" || err != nil {
+		t.Errorf("tagging disabled: got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tierOUPrefix marks the client certificate OU naming the user's service
+// tier, e.g. OU=tier-pro
+const tierOUPrefix = "tier-"
+
+// TierConfig is a bundle of limits for the users whose certificate names the
+// tier, so issuing the certificate is all it takes to provision them
+type TierConfig struct {
+	MonthlyQuotaMB int64 `json:"monthly_quota_mb"` // Traffic per calendar month, then refused with 403 (0: unlimited)
+	RateKBps       int   `json:"rate_kbps"`        // Per-direction tunnel rate in KB/s (0: unlimited)
+	TunnelLimitMB  int64 `json:"tunnel_limit_mb"`  // Bytes a single tunnel may carry; replaces tunnel_transfer_limit (0: that limit)
+}
+
+// Tier is a configured tier with its limits in bytes
+type Tier struct {
+	Name        string `json:"name"`
+	QuotaBytes  uint64 `json:"quota_bytes"`
+	RateBytes   int64  `json:"rate_bytes"`
+	TunnelBytes uint64 `json:"tunnel_bytes"`
+}
+
+// ServiceTiers maps the tier named by client certificates to its limits
+type ServiceTiers struct {
+	tiers map[string]*Tier
+}
+
+// NewServiceTiers parses proxy.tiers; it returns nil if none is configured
+func NewServiceTiers(config *Config) *ServiceTiers {
+	st := &ServiceTiers{tiers: make(map[string]*Tier)}
+	for name, tc := range config.Proxy.Tiers {
+		if tc.MonthlyQuotaMB < 0 || tc.RateKBps < 0 || tc.TunnelLimitMB < 0 {
+			log.Printf("Tier %q: negative limits, ignored", name)
+			continue
+		}
+		st.tiers[name] = &Tier{
+			Name:        name,
+			QuotaBytes:  uint64(tc.MonthlyQuotaMB) << 20,
+			RateBytes:   int64(tc.RateKBps) * 1024,
+			TunnelBytes: uint64(tc.TunnelLimitMB) << 20,
+		}
+	}
+	if len(st.tiers) == 0 {
+		return nil
+	}
+	return st
+}
+
+// certTier returns the tier named by cert's OUs, or ""
+func certTier(cert *x509.Certificate) string {
+	for _, ou := range cert.Subject.OrganizationalUnit {
+		if name, ok := strings.CutPrefix(ou, tierOUPrefix); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// requestTier returns the tier named by r's client certificate, or ""
+func requestTier(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return certTier(r.TLS.PeerCertificates[0])
+}
+
+// Get returns the tier called name; a certificate naming an undefined tier
+// gets no tier limits
+func (st *ServiceTiers) Get(name string) (*Tier, bool) {
+	if st == nil || name == "" {
+		return nil, false
+	}
+	t, ok := st.tiers[name]
+	return t, ok
+}
+
+// calendarMonth returns the bounds of the calendar month t falls in
+func calendarMonth(t time.Time) (start, end time.Time) {
+	start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	return start, start.AddDate(0, 1, 0)
+}
+
+// checkTier blocks users whose tier's monthly quota is used up, until the
+// next month
+func (e *PolicyEngine) checkTier(req PolicyRequest) PolicyCheck {
+	check := PolicyCheck{Rule: "tier", Allowed: true}
+	t, ok := e.Tiers.Get(req.Tier)
+	if !ok || t.QuotaBytes == 0 || e.StatsDB == nil {
+		return check
+	}
+	start, end := calendarMonth(req.Time.Local())
+	if used := e.StatsDB.UserTrafficSince(req.Username, start); used >= t.QuotaBytes {
+		check.Allowed = false
+		check.Reason = fmt.Sprintf("Monthly traffic quota of %s for tier %s used up", formatBytes(t.QuotaBytes), t.Name)
+		check.Code = ErrCodeTierQuota
+		check.Status = http.StatusForbidden
+		check.RetryAfter = int(math.Ceil(end.Sub(req.Time).Seconds()))
+	}
+	return check
+}
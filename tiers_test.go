@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServiceTiers(t *testing.T) {
+	cfg := &Config{}
+	if NewServiceTiers(cfg) != nil {
+		t.Fatal("tiers built without configuration")
+	}
+	cfg.Proxy.Tiers = map[string]TierConfig{
+		"basic": {MonthlyQuotaMB: 1, RateKBps: 64},
+		"pro":   {TunnelLimitMB: 10},
+		"bad":   {RateKBps: -1},
+	}
+	db := newExpiryTestDB(t)
+	engine := NewPolicyEngine(cfg, nil, db)
+
+	r := httptest.NewRequest("CONNECT", "example.com:443", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"staff", "tier-basic"}}}}}
+	req := newPolicyRequest(r, "alice")
+	if req.Tier != "basic" {
+		t.Fatalf("tier = %q", req.Tier)
+	}
+	if _, ok := engine.Tiers.Get("bad"); ok {
+		t.Error("tier with negative limits kept")
+	}
+
+	// The quota counts this month's traffic only
+	const hour = "2006-01-02T15:00:00"
+	month, _ := calendarMonth(time.Now())
+	db.BatchUpsert([]TrafficRecord{{Username: "alice", Upload: 4 << 20, ConnCount: 1, Hour: month.Add(-time.Hour).Format(hour), Timestamp: month.Add(-time.Hour)}})
+	if d := engine.Evaluate(req); !d.Allowed {
+		t.Fatalf("blocked by last month's traffic: %+v", d.Blocking)
+	}
+	db.BatchUpsert([]TrafficRecord{{Username: "alice", Download: 1 << 20, ConnCount: 1, Hour: time.Now().Format(hour), Timestamp: time.Now()}})
+	d := engine.Evaluate(req)
+	if d.Allowed || d.Blocking.Rule != "tier" || d.Blocking.Code != ErrCodeTierQuota || d.Blocking.RetryAfter <= 0 {
+		t.Fatalf("expected tier quota block, got %+v", d.Blocking)
+	}
+	req.Tier = "pro"
+	if d := engine.Evaluate(req); !d.Allowed {
+		t.Errorf("tier without quota blocked: %+v", d.Blocking)
+	}
+
+	// A tier's tunnel limit replaces tunnel_transfer_limit
+	pro, _ := engine.Tiers.Get("pro")
+	basic, _ := engine.Tiers.Get("basic")
+	if l := engine.TransferLimits; l.Limit("alice", pro) != 10<<20 || l.Limit("alice", basic) != 0 {
+		t.Errorf("tunnel limits = %d, %d", l.Limit("alice", pro), l.Limit("alice", basic))
+	}
+}
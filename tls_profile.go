@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"slices"
+)
+
+// TLS profile presets, named after the web server whose handshake they
+// resemble
+const (
+	TLSProfileGo    = "go" // Go's defaults
+	TLSProfileNginx = "nginx"
+	TLSProfileCaddy = "caddy"
+)
+
+// Certificate chain shapes sent to clients
+const (
+	TLSChainFull = "full" // every certificate in cert_path
+	TLSChainLeaf = "leaf" // the server certificate only
+)
+
+// TLSProfileConfig tunes the proxy's TLS handshake so it resembles a popular
+// web server's to scanners comparing fingerprints. A preset fills in the
+// fields left empty.
+type TLSProfileConfig struct {
+	Preset       string   `json:"preset"`        // go (default), nginx or caddy
+	MinVersion   string   `json:"min_version"`   // "1.2" or "1.3"
+	MaxVersion   string   `json:"max_version"`   // "1.2" or "1.3"
+	CipherSuites []string `json:"cipher_suites"` // TLS 1.2 suites offered, IANA names
+	Curves       []string `json:"curves"`        // Key exchange groups: X25519MLKEM768, X25519, P-256, P-384, P-521
+	ALPN         []string `json:"alpn"`          // Protocols advertised (default ["http/1.1"])
+	Chain        string   `json:"chain"`         // full (default) or leaf
+}
+
+// tlsPresets holds the settings of each preset. nginx is a distribution
+// build on OpenSSL 3 with the Mozilla "intermediate" configuration; caddy
+// is its default configuration.
+var tlsPresets = map[string]TLSProfileConfig{
+	TLSProfileGo: {},
+	TLSProfileNginx: {
+		MinVersion: "1.2",
+		CipherSuites: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256", "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+		},
+		Curves: []string{"X25519", "P-256", "P-521", "P-384"},
+	},
+	TLSProfileCaddy: {
+		MinVersion: "1.2",
+		CipherSuites: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256", "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+		},
+		Curves: []string{"X25519MLKEM768", "X25519", "P-256", "P-384"},
+	},
+}
+
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"X25519":         tls.X25519,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+}
+
+// tlsVersion parses a version setting; 0 leaves Go's default
+func tlsVersion(version string) uint16 {
+	v, ok := tlsVersions[version]
+	if !ok && version != "" {
+		log.Printf("TLS profile: unknown version %q, ignored", version)
+	}
+	return v
+}
+
+// resolve fills the fields left empty from the preset
+func (tc TLSProfileConfig) resolve() TLSProfileConfig {
+	if tc.Preset == "" {
+		tc.Preset = TLSProfileGo
+	}
+	preset, ok := tlsPresets[tc.Preset]
+	if !ok {
+		log.Printf("TLS profile: unknown preset %q, using go", tc.Preset)
+		tc.Preset = TLSProfileGo
+	}
+	if tc.MinVersion == "" {
+		tc.MinVersion = preset.MinVersion
+	}
+	if tc.MaxVersion == "" {
+		tc.MaxVersion = preset.MaxVersion
+	}
+	if len(tc.CipherSuites) == 0 {
+		tc.CipherSuites = preset.CipherSuites
+	}
+	if len(tc.Curves) == 0 {
+		tc.Curves = preset.Curves
+	}
+	if len(tc.ALPN) == 0 {
+		tc.ALPN = []string{"http/1.1"}
+	}
+	if tc.Chain == "" {
+		tc.Chain = TLSChainFull
+	}
+	return tc
+}
+
+// Apply sets the profile's handshake parameters on cfg, including the shape
+// of the certificate chains in cfg.Certificates. Unknown names are logged
+// and skipped. Go picks the order of suites and groups itself, so the
+// profile decides which are offered, not their order.
+func (tc TLSProfileConfig) Apply(cfg *tls.Config) {
+	tc = tc.resolve()
+	cfg.MinVersion = tlsVersion(tc.MinVersion)
+	cfg.MaxVersion = tlsVersion(tc.MaxVersion)
+
+	cfg.CipherSuites = nil
+	for _, name := range tc.CipherSuites {
+		i := slices.IndexFunc(tls.CipherSuites(), func(s *tls.CipherSuite) bool { return s.Name == name })
+		if i < 0 {
+			log.Printf("TLS profile: unknown or insecure cipher suite %q, ignored", name)
+			continue
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, tls.CipherSuites()[i].ID)
+	}
+
+	cfg.CurvePreferences = nil
+	for _, name := range tc.Curves {
+		if id, ok := tlsCurves[name]; ok {
+			cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+		} else {
+			log.Printf("TLS profile: unknown curve %q, ignored", name)
+		}
+	}
+
+	cfg.NextProtos = tc.ALPN
+
+	switch tc.Chain {
+	case TLSChainFull:
+	case TLSChainLeaf:
+		for i := range cfg.Certificates {
+			cfg.Certificates[i].Certificate = cfg.Certificates[i].Certificate[:1]
+		}
+	default:
+		log.Printf("TLS profile: unknown chain %q, sending the full chain", tc.Chain)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTLSProfile_Apply(t *testing.T) {
+	cfg := &tls.Config{}
+	TLSProfileConfig{}.Apply(cfg)
+	if cfg.MinVersion != 0 || cfg.CipherSuites != nil || cfg.CurvePreferences != nil || len(cfg.NextProtos) != 1 {
+		t.Errorf("go preset changed the defaults: %+v", cfg)
+	}
+
+	cfg = &tls.Config{}
+	TLSProfileConfig{Preset: TLSProfileNginx, MaxVersion: "1.2", Curves: []string{"P-256", "brainpool"}}.Apply(cfg)
+	if cfg.MinVersion != tls.VersionTLS12 || cfg.MaxVersion != tls.VersionTLS12 || len(cfg.CipherSuites) != 6 {
+		t.Errorf("nginx preset: versions %x-%x, %d suites", cfg.MinVersion, cfg.MaxVersion, len(cfg.CipherSuites))
+	}
+	if len(cfg.CurvePreferences) != 1 || cfg.CurvePreferences[0] != tls.CurveP256 {
+		t.Errorf("curves = %v, want the override without the unknown name", cfg.CurvePreferences)
+	}
+}
+
+func TestTLSProfile_Handshake(t *testing.T) {
+	ca, err := GenerateCA("Test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := IssueCert(ca.Cert, ca.Key, CertRequest{
+		CommonName:  "proxy.example.com",
+		DNSNames:    []string{"proxy.example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		Validity:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{leaf.Cert.Raw, ca.Cert.Raw}, PrivateKey: leaf.Key}
+
+	handshake := func(profile TLSProfileConfig) tls.ConnectionState {
+		t.Helper()
+		cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+		profile.Apply(cfg)
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go tls.Server(server, cfg).Handshake()
+		conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}})
+		if err := conn.Handshake(); err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+		return conn.ConnectionState()
+	}
+
+	st := handshake(TLSProfileConfig{Preset: TLSProfileCaddy, MaxVersion: "1.2"})
+	if st.Version != tls.VersionTLS12 || st.NegotiatedProtocol != "http/1.1" || len(st.PeerCertificates) != 2 {
+		t.Errorf("caddy preset: version %x, ALPN %q, chain %d", st.Version, st.NegotiatedProtocol, len(st.PeerCertificates))
+	}
+	if name := tls.CipherSuiteName(st.CipherSuite); name != "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384" && name != "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256" && name != "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256" {
+		t.Errorf("cipher suite %s is not in the preset", name)
+	}
+
+	st = handshake(TLSProfileConfig{Chain: TLSChainLeaf, ALPN: []string{"h2", "http/1.1"}})
+	if len(st.PeerCertificates) != 1 || st.NegotiatedProtocol != "h2" {
+		t.Errorf("leaf chain: chain %d, ALPN %q", len(st.PeerCertificates), st.NegotiatedProtocol)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// TrafficSchemaVersion is the version of the wire format of traffic events
+// and records, carried in their schema_version field. Consumers accept the
+// fields they know and ignore the rest, so adding a field keeps the
+// version; it is bumped when a field is removed or changes meaning, and
+// the converters below then read the older versions too.
+//
+// Version 1 is the first versioned format. Spill files written before it
+// (version 0) hold TrafficRecords under their Go field names.
+const TrafficSchemaVersion = 1
+
+// TrafficEventWire is a TrafficEvent as written for other programs
+type TrafficEventWire struct {
+	SchemaVersion int       `json:"schema_version"`
+	Username      string    `json:"username"`
+	Domain        string    `json:"domain,omitempty"`
+	Tag           string    `json:"tag,omitempty"`
+	TargetIP      string    `json:"target_ip,omitempty"`
+	Upload        uint64    `json:"upload"`
+	Download      uint64    `json:"download"`
+	Timestamp     time.Time `json:"timestamp"`
+	Country       string    `json:"country,omitempty"`
+	CountryName   string    `json:"country_name,omitempty"`
+	Continent     string    `json:"continent,omitempty"`
+	DurationMs    int64     `json:"duration_ms,omitempty"`
+	TTFBMs        int64     `json:"ttfb_ms,omitempty"`
+	Partial       bool      `json:"partial,omitempty"`
+	Camouflage    bool      `json:"camouflage,omitempty"`
+	Path          string    `json:"path,omitempty"`
+	ClientIP      string    `json:"client_ip,omitempty"`
+	DialError     string    `json:"dial_error,omitempty"`
+}
+
+// Wire converts e to the current wire format
+func (e TrafficEvent) Wire() TrafficEventWire {
+	return TrafficEventWire{
+		SchemaVersion: TrafficSchemaVersion,
+		Username:      e.Username,
+		Domain:        e.Domain,
+		Tag:           e.Tag,
+		TargetIP:      e.TargetIP,
+		Upload:        e.Upload,
+		Download:      e.Download,
+		Timestamp:     e.Timestamp.UTC(),
+		Country:       e.Country,
+		CountryName:   e.CountryName,
+		Continent:     e.Continent,
+		DurationMs:    e.Duration.Milliseconds(),
+		TTFBMs:        e.TTFB.Milliseconds(),
+		Partial:       e.Partial,
+		Camouflage:    e.Camouflage,
+		Path:          e.Path,
+		ClientIP:      e.ClientIP,
+		DialError:     e.DialError,
+	}
+}
+
+// Event converts w back to a TrafficEvent
+func (w TrafficEventWire) Event() TrafficEvent {
+	return TrafficEvent{
+		Username:    w.Username,
+		Domain:      w.Domain,
+		Tag:         w.Tag,
+		TargetIP:    w.TargetIP,
+		Upload:      w.Upload,
+		Download:    w.Download,
+		Timestamp:   w.Timestamp,
+		Country:     w.Country,
+		CountryName: w.CountryName,
+		Continent:   w.Continent,
+		Duration:    time.Duration(w.DurationMs) * time.Millisecond,
+		TTFB:        time.Duration(w.TTFBMs) * time.Millisecond,
+		Partial:     w.Partial,
+		Camouflage:  w.Camouflage,
+		Path:        w.Path,
+		ClientIP:    w.ClientIP,
+		DialError:   w.DialError,
+	}
+}
+
+// DecodeTrafficEvent reads an event of any version up to the current one
+func DecodeTrafficEvent(data []byte) (TrafficEvent, error) {
+	var w TrafficEventWire
+	if err := json.Unmarshal(data, &w); err != nil {
+		return TrafficEvent{}, err
+	}
+	if err := checkTrafficSchema(w.SchemaVersion, 1); err != nil {
+		return TrafficEvent{}, err
+	}
+	return w.Event(), nil
+}
+
+// TrafficRecordWire is a TrafficRecord as written for other programs and
+// to the collector's spill file
+type TrafficRecordWire struct {
+	SchemaVersion int       `json:"schema_version"`
+	Username      string    `json:"username"`
+	Domain        string    `json:"domain"`
+	Tag           string    `json:"tag,omitempty"`
+	Upload        uint64    `json:"upload"`
+	Download      uint64    `json:"download"`
+	Connections   int       `json:"connections"`
+	Country       string    `json:"country,omitempty"`
+	CountryName   string    `json:"country_name,omitempty"`
+	Continent     string    `json:"continent,omitempty"`
+	Minute        string    `json:"minute"` // "2006-01-02T15:04:00"
+	Hour          string    `json:"hour"`   // "2006-01-02T15:00:00"
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// Wire converts r to the current wire format
+func (r TrafficRecord) Wire() TrafficRecordWire {
+	return TrafficRecordWire{
+		SchemaVersion: TrafficSchemaVersion,
+		Username:      r.Username,
+		Domain:        r.Domain,
+		Tag:           r.Tag,
+		Upload:        r.Upload,
+		Download:      r.Download,
+		Connections:   r.ConnCount,
+		Country:       r.Country,
+		CountryName:   r.CountryName,
+		Continent:     r.Continent,
+		Minute:        r.Minute,
+		Hour:          r.Hour,
+		Timestamp:     r.Timestamp.UTC(),
+	}
+}
+
+// Record converts w back to a TrafficRecord
+func (w TrafficRecordWire) Record() TrafficRecord {
+	return TrafficRecord{
+		Username:    w.Username,
+		Domain:      w.Domain,
+		Tag:         w.Tag,
+		Upload:      w.Upload,
+		Download:    w.Download,
+		ConnCount:   w.Connections,
+		Country:     w.Country,
+		CountryName: w.CountryName,
+		Continent:   w.Continent,
+		Minute:      w.Minute,
+		Hour:        w.Hour,
+		Timestamp:   w.Timestamp,
+	}
+}
+
+// DecodeTrafficRecord reads a record of any version up to the current one
+func DecodeTrafficRecord(data []byte) (TrafficRecord, error) {
+	var w TrafficRecordWire
+	if err := json.Unmarshal(data, &w); err != nil {
+		return TrafficRecord{}, err
+	}
+	if err := checkTrafficSchema(w.SchemaVersion, 1); err != nil {
+		return TrafficRecord{}, err
+	}
+	return w.Record(), nil
+}
+
+// checkTrafficSchema returns an error for a version this build cannot
+// read: one newer than TrafficSchemaVersion, or older than oldest
+func checkTrafficSchema(version, oldest int) error {
+	if version > TrafficSchemaVersion {
+		return fmt.Errorf("traffic schema version %d is newer than this build's %d", version, TrafficSchemaVersion)
+	}
+	if version < oldest {
+		return fmt.Errorf("traffic schema version %d is not supported", version)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrafficSchema_RoundTrip(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 30, 0, 0, time.UTC)
+	ev := TrafficEvent{Username: "alice", Domain: "example.com", Tag: "ci", Upload: 10, Download: 20,
+		Timestamp: now, Country: "DE", Duration: 1500 * time.Millisecond, TTFB: 40 * time.Millisecond, Partial: true}
+	data, err := json.Marshal(ev.Wire())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"schema_version":1`) || !strings.Contains(string(data), `"duration_ms":1500`) {
+		t.Errorf("wire event = %s", data)
+	}
+	got, err := DecodeTrafficEvent(data)
+	if err != nil || got != ev {
+		t.Errorf("decoded %+v, %v; want %+v", got, err, ev)
+	}
+
+	rec := TrafficRecord{Username: "bob", Domain: "example.net", Upload: 1, Download: 2, ConnCount: 3,
+		Minute: "2026-05-01T12:30:00", Hour: "2026-05-01T12:00:00", Timestamp: now}
+	data, _ = json.Marshal(rec.Wire())
+	if r, err := DecodeTrafficRecord(data); err != nil || r != rec {
+		t.Errorf("decoded %+v, %v; want %+v", r, err, rec)
+	}
+
+	// A consumer refuses what a newer build wrote, and unknown fields of
+	// its own version are ignored
+	if _, err := DecodeTrafficEvent([]byte(`{"schema_version":2,"username":"alice"}`)); err == nil {
+		t.Error("newer schema accepted")
+	}
+	if _, err := DecodeTrafficRecord([]byte(`{"username":"alice"}`)); err == nil {
+		t.Error("unversioned record accepted")
+	}
+	if e, err := DecodeTrafficEvent([]byte(`{"schema_version":1,"username":"alice","node":"eu-1"}`)); err != nil || e.Username != "alice" {
+		t.Errorf("added field: %+v, %v", e, err)
+	}
+}
+
+func TestStatsCollector_SpillVersions(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "stats.db")
+	db, err := NewStatsDB(dbPath)
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	defer db.Close()
+	spillPath := dbPath + ".spill.json"
+
+	// A spill file from before versioning is still restored
+	legacy := `{"records":[{"Username":"alice","Domain":"example.com","Tag":"","Upload":100,"Download":5,"ConnCount":1,` +
+		`"Country":"","CountryName":"","Continent":"","Minute":"2026-05-01T12:30:00","Hour":"2026-05-01T12:00:00","Timestamp":"2026-05-01T12:30:10Z"}]}`
+	os.WriteFile(spillPath, []byte(legacy), 0644)
+	NewStatsCollector(db, nil, 3600, 0).Stop()
+	if u, err := db.GetUser(context.Background(), "alice"); err != nil || u.TotalUpload != 100 {
+		t.Errorf("legacy spill: %+v, %v", u, err)
+	}
+
+	// One from a newer build is left for it
+	os.WriteFile(spillPath, []byte(`{"schema_version":99,"records":[{"username":"bob","upload":1}]}`), 0644)
+	NewStatsCollector(db, nil, 3600, 0).Stop()
+	if _, err := os.Stat(spillPath); err != nil {
+		t.Errorf("newer spill file removed: %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrialConfig contains the presets applied to trial accounts created with
+// POST /api/v2/users/trial
+type TrialConfig struct {
+	Days      int    `json:"days"`        // Trial length; the user and its certificate expire after it (default 7)
+	QuotaMB   int    `json:"quota_mb"`    // Traffic allowed over the whole trial (default 1024)
+	RateKBps  int    `json:"rate_kbps"`   // Per-direction tunnel rate cap in KB/s (default 256)
+	CAKeyPath string `json:"ca_key_path"` // CA private key issuing trial certificates (default ca.key next to the CA certificate)
+}
+
+// TrialAccounts keeps the trial accounts and applies their limits
+type TrialAccounts struct {
+	config *Config
+	db     *StatsDB
+
+	mu     sync.RWMutex
+	trials map[string]Trial
+}
+
+// NewTrialAccounts loads the trial accounts; it returns nil without a stats
+// database, where they are stored
+func NewTrialAccounts(config *Config, db *StatsDB) *TrialAccounts {
+	if db == nil {
+		return nil
+	}
+	ta := &TrialAccounts{config: config, db: db, trials: make(map[string]Trial)}
+	trials, err := db.GetTrials(context.Background())
+	if err != nil {
+		log.Printf("Trial accounts: %v", err)
+	}
+	for _, t := range trials {
+		ta.trials[t.Username] = t
+	}
+	metrics.Gauge("https_proxy_trial_users", "Trial accounts", func() float64 {
+		ta.mu.RLock()
+		defer ta.mu.RUnlock()
+		return float64(len(ta.trials))
+	})
+	return ta
+}
+
+// Get returns username's trial, if it is a trial account
+func (ta *TrialAccounts) Get(username string) (Trial, bool) {
+	if ta == nil {
+		return Trial{}, false
+	}
+	ta.mu.RLock()
+	defer ta.mu.RUnlock()
+	t, ok := ta.trials[username]
+	return t, ok
+}
+
+// List returns the trial accounts, oldest first
+func (ta *TrialAccounts) List() []Trial {
+	ta.mu.RLock()
+	defer ta.mu.RUnlock()
+	out := make([]Trial, 0, len(ta.trials))
+	for _, t := range ta.trials {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// TrialRequest is the body of POST /api/v2/users/trial. Unset limits take
+// the configured presets.
+type TrialRequest struct {
+	Username string `json:"username"`
+	Days     int    `json:"days"`
+	QuotaMB  int    `json:"quota_mb"`
+	RateKBps int    `json:"rate_kbps"`
+}
+
+// TrialCreated is returned when a trial account is created. The key is
+// not stored anywhere else.
+type TrialCreated struct {
+	Trial
+	ExpiresAt time.Time `json:"expires_at"`
+	CertPEM   string    `json:"cert_pem"`
+	KeyPEM    string    `json:"key_pem"`
+}
+
+// errTrialExists is returned for usernames already in use
+var errTrialExists = fmt.Errorf("user already exists")
+
+// Create issues a client certificate for a new trial account, valid for the
+// trial length, and records the account with its limits and expiry date
+func (ta *TrialAccounts) Create(ctx context.Context, req TrialRequest, actor string, now time.Time) (*TrialCreated, error) {
+	if req.Username == "" || len(req.Username) > 64 || strings.ContainsAny(req.Username, "/\\*?[]") {
+		return nil, fmt.Errorf("invalid username %q", req.Username)
+	}
+	if _, ok := ta.Get(req.Username); ok {
+		return nil, errTrialExists
+	}
+	if _, err := ta.db.GetUser(ctx, req.Username); err == nil {
+		return nil, errTrialExists
+	}
+
+	tc := ta.config.Trials
+	days := firstPositive(req.Days, tc.Days, 7)
+	trial := Trial{
+		Username:   req.Username,
+		CreatedAt:  now,
+		CreatedBy:  actor,
+		QuotaBytes: uint64(firstPositive(req.QuotaMB, tc.QuotaMB, 1024)) << 20,
+		RateBytes:  int64(firstPositive(req.RateKBps, tc.RateKBps, 256)) * 1024,
+	}
+
+	caPath := ta.config.Server.Certificates.CAPath
+	keyPath := tc.CAKeyPath
+	if keyPath == "" {
+		keyPath = filepath.Join(filepath.Dir(caPath), "ca.key")
+	}
+	ca, caKey, err := LoadCA(caPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("load CA: %w", err)
+	}
+	issued, err := IssueCert(ca, caKey, CertRequest{
+		CommonName:  req.Username,
+		OrgUnits:    []string{"trial"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Validity:    time.Duration(days) * 24 * time.Hour,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// A certificate that is not in the issuance log is not handed out
+	if err := appendCALog(caLogPath(caPath), issued.Cert, CALogTrial, actor, now); err != nil {
+		return nil, err
+	}
+
+	if err := ta.db.CreateTrial(trial); err != nil {
+		return nil, err
+	}
+	if err := ta.db.SetUserExpiry(req.Username, issued.Cert.NotAfter, ExpirySourceTrial); err != nil {
+		return nil, err
+	}
+	limits := fmt.Sprintf("%d days, %s quota, %s/s", days, formatBytes(trial.QuotaBytes), formatBytes(uint64(trial.RateBytes)))
+	ta.db.RecordUserEvent(req.Username, EventTrialCreated, actor, limits)
+	changeFeed.Publish(ChangeEvent{Type: ChangeQuota, User: req.Username, Actor: actor, Detail: "trial: " + limits})
+	ta.mu.Lock()
+	ta.trials[req.Username] = trial
+	ta.mu.Unlock()
+
+	return &TrialCreated{Trial: trial, ExpiresAt: issued.Cert.NotAfter, CertPEM: string(issued.CertPEM), KeyPEM: string(issued.KeyPEM)}, nil
+}
+
+// Convert turns a trial account into a regular user: its limits are lifted
+// and the trial expiry date is removed
+func (ta *TrialAccounts) Convert(username, actor string) error {
+	if _, ok := ta.Get(username); !ok {
+		return fmt.Errorf("%s is not a trial account", username)
+	}
+	if err := ta.db.DeleteTrial(username); err != nil {
+		return err
+	}
+	// The trial is already deleted: the expiry is cleared even if the
+	// request has gone away meanwhile
+	if e, _ := ta.db.GetUserExpiry(context.Background(), username, time.Now()); e != nil && e.Source == ExpirySourceTrial {
+		ta.db.ClearUserExpiry(username)
+	}
+	ta.db.RecordUserEvent(username, EventTrialConverted, actor, "")
+	changeFeed.Publish(ChangeEvent{Type: ChangeQuota, User: username, Actor: actor, Detail: "trial limits lifted"})
+	ta.mu.Lock()
+	delete(ta.trials, username)
+	ta.mu.Unlock()
+	return nil
+}
+
+// firstPositive returns the first value above zero
+func firstPositive(values ...int) int {
+	for _, v := range values {
+		if v > 0 {
+			return v
+		}
+	}
+	return 0
+}
+
+// checkTrial blocks trial accounts that used up their traffic quota
+func (e *PolicyEngine) checkTrial(req PolicyRequest) PolicyCheck {
+	check := PolicyCheck{Rule: "trial", Allowed: true}
+	t, ok := e.Trials.Get(req.Username)
+	if !ok {
+		return check
+	}
+	if used := e.StatsDB.UserTraffic(req.Username); used >= t.QuotaBytes {
+		check.Allowed = false
+		check.Reason = fmt.Sprintf("Trial traffic quota of %s used up", formatBytes(t.QuotaBytes))
+		check.Code = ErrCodeTrialQuota
+		check.Status = http.StatusForbidden
+	}
+	return check
+}
+
+// handleTrials serves /api/v2/users/trial: GET lists the trial accounts,
+// POST creates one, and DELETE ?username= converts one to a regular user
+func handleTrials(w http.ResponseWriter, r *http.Request, trials *TrialAccounts) {
+	actor := "api:" + adminName(r)
+	switch r.Method {
+	case http.MethodGet:
+		writeJSONResponse(w, WebResponse{Success: true, Data: trials.List()}, http.StatusOK)
+	case http.MethodPost:
+		var req TrialRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "invalid JSON: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		created, err := trials.Create(r.Context(), req, actor, time.Now())
+		switch {
+		case err == errTrialExists:
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusConflict)
+		case err != nil && strings.HasPrefix(err.Error(), "invalid username"):
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusBadRequest)
+		case err != nil:
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+		default:
+			log.Printf("Trial account %s created by %s, expires %s", created.Username, actor, created.ExpiresAt.Format(time.RFC3339))
+			writeJSONResponse(w, WebResponse{Success: true, Data: created}, http.StatusCreated)
+		}
+	case http.MethodDelete:
+		if err := trials.Convert(r.URL.Query().Get("username"), actor); err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusNotFound)
+			return
+		}
+		writeJSONResponse(w, WebResponse{Success: true}, http.StatusOK)
+	default:
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestV2API_TrialAccounts(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := GenerateCA("Test CA", 365*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.WriteFiles(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+	db := newExpiryTestDB(t)
+	cfg := &Config{}
+	cfg.Server.Certificates.CAPath = filepath.Join(dir, "ca.pem")
+	cfg.Trials = TrialConfig{Days: 3, QuotaMB: 1}
+	engine := NewPolicyEngine(cfg, nil, db)
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, db, engine, nil)
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v2/users/trial", bytes.NewBufferString(body)))
+		return rec
+	}
+
+	rec := post(`{"username": "prospect", "rate_kbps": 32}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Data TrialCreated `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	created := resp.Data
+	if created.QuotaBytes != 1<<20 || created.RateBytes != 32*1024 {
+		t.Errorf("limits = %+v", created.Trial)
+	}
+	block, _ := pem.Decode([]byte(created.CertPEM))
+	if block == nil {
+		t.Fatal("no certificate returned")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || cert.Subject.CommonName != "prospect" || cert.NotAfter.After(time.Now().Add(3*24*time.Hour+time.Minute)) {
+		t.Fatalf("certificate = %v, %v", cert.Subject, err)
+	}
+	if e, _ := db.GetUserExpiry(context.Background(), "prospect", time.Now()); e == nil || e.Source != ExpirySourceTrial || !e.ExpiresAt.Equal(created.ExpiresAt) {
+		t.Errorf("expiry = %+v", e)
+	}
+	db.SetUserExpiry("prospect", time.Now().Add(90*24*time.Hour), ExpirySourceCert)
+	if e, _ := db.GetUserExpiry(context.Background(), "prospect", time.Now()); e.Source != ExpirySourceTrial {
+		t.Error("certificate date replaced the trial expiry")
+	}
+
+	if rec := post(`{"username": "prospect"}`); rec.Code != http.StatusConflict {
+		t.Errorf("duplicate trial: %d", rec.Code)
+	}
+	if rec := post(`{"username": "a/b"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid username: %d", rec.Code)
+	}
+
+	// The quota blocks the trial once used up, and no longer once converted
+	if d := engine.Evaluate(PolicyRequest{Username: "prospect"}); !d.Allowed {
+		t.Fatalf("blocked before using the quota: %+v", d.Blocking)
+	}
+	db.BatchUpsert([]TrafficRecord{{Username: "prospect", Upload: 1 << 20, ConnCount: 1, Timestamp: time.Now()}})
+	d := engine.Evaluate(PolicyRequest{Username: "prospect"})
+	if d.Allowed || d.Blocking.Rule != "trial" || d.Blocking.Code != ErrCodeTrialQuota {
+		t.Fatalf("expected trial quota block, got %+v", d.Blocking)
+	}
+	if users, _ := db.GetAllUsers(context.Background()); len(users) != 1 || !users[0].Trial {
+		t.Errorf("users = %+v", users)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/v2/users/trial?username=prospect", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("DELETE: %d %s", rec.Code, rec.Body)
+	}
+	if d := engine.Evaluate(PolicyRequest{Username: "prospect"}); !d.Allowed {
+		t.Errorf("converted user blocked: %+v", d.Blocking)
+	}
+	if e, _ := db.GetUserExpiry(context.Background(), "prospect", time.Now()); e != nil {
+		t.Errorf("trial expiry kept after conversion: %+v", e)
+	}
+}
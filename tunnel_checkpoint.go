@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// TunnelCheckpointConfig saves the open tunnels periodically, so the ones
+// cut by a crash or restart can be listed afterwards with their last-known
+// byte counts instead of vanishing
+type TunnelCheckpointConfig struct {
+	File            string `json:"file"`             // Checkpoint file; empty disables checkpoints
+	IntervalSeconds int    `json:"interval_seconds"` // How often it is written (default 30)
+}
+
+// tunnelCheckpoint is the content of the checkpoint file
+type tunnelCheckpoint struct {
+	Time    time.Time    `json:"time"`
+	Tunnels []TunnelInfo `json:"tunnels"`
+}
+
+// InterruptedTunnel is a tunnel that was open at the last checkpoint of the
+// previous run. Its byte counts are those of that checkpoint; what it
+// carried afterwards is not known.
+type InterruptedTunnel struct {
+	TunnelInfo
+	LastCheckpoint time.Time `json:"last_checkpoint"`
+}
+
+// StartCheckpoints loads the tunnels the previous run left open, then saves
+// the open tunnels to the checkpoint file every interval
+func (reg *tunnelRegistry) StartCheckpoints(cfg TunnelCheckpointConfig) {
+	if cfg.File == "" {
+		return
+	}
+	if data, err := os.ReadFile(cfg.File); err == nil {
+		var cp tunnelCheckpoint
+		if err := json.Unmarshal(data, &cp); err != nil {
+			log.Printf("Tunnel checkpoint %s: %v", cfg.File, err)
+		} else if len(cp.Tunnels) > 0 {
+			interrupted := make([]InterruptedTunnel, 0, len(cp.Tunnels))
+			for _, t := range cp.Tunnels {
+				interrupted = append(interrupted, InterruptedTunnel{TunnelInfo: t, LastCheckpoint: cp.Time})
+			}
+			reg.mu.Lock()
+			reg.interrupted = interrupted
+			reg.mu.Unlock()
+			log.Printf("%d tunnels were open at the last checkpoint (%s) and have been interrupted; see /api/v2/connections/interrupted",
+				len(interrupted), cp.Time.Format(time.RFC3339))
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Tunnel checkpoint %s: %v", cfg.File, err)
+	}
+
+	reg.mu.Lock()
+	reg.checkpointFile = cfg.File
+	reg.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(time.Duration(firstPositive(cfg.IntervalSeconds, 30)) * time.Second)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			reg.Checkpoint(now)
+		}
+	}()
+}
+
+// Checkpoint saves the open tunnels, if checkpoints are on. At shutdown it
+// records the tunnels the exit is about to cut.
+func (reg *tunnelRegistry) Checkpoint(now time.Time) {
+	reg.mu.Lock()
+	file := reg.checkpointFile
+	reg.mu.Unlock()
+	if file == "" {
+		return
+	}
+	data, err := json.Marshal(tunnelCheckpoint{Time: now.UTC(), Tunnels: reg.List(now, "", false)})
+	if err == nil {
+		err = writeFileAtomic(file, data, 0600)
+	}
+	if err != nil {
+		log.Printf("Tunnel checkpoint %s: %v", file, err)
+	}
+}
+
+// Interrupted returns the tunnels the previous run left open, optionally
+// limited to one user
+func (reg *tunnelRegistry) Interrupted(username string) []InterruptedTunnel {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	list := []InterruptedTunnel{}
+	for _, t := range reg.interrupted {
+		if username == "" || t.Username == username {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// handleInterruptedTunnels serves /api/v2/connections/interrupted: GET lists
+// the tunnels cut by the last crash or restart, DELETE dismisses them
+func handleInterruptedTunnels(w http.ResponseWriter, r *http.Request, reg *tunnelRegistry) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSONResponse(w, WebResponse{Success: true, Data: reg.Interrupted(r.URL.Query().Get("user"))}, http.StatusOK)
+	case http.MethodDelete:
+		reg.mu.Lock()
+		reg.interrupted = nil
+		reg.mu.Unlock()
+		log.Printf("Interrupted tunnels dismissed by %s", adminName(r))
+		writeJSONResponse(w, WebResponse{Success: true}, http.StatusOK)
+	default:
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// TunnelCompressionConfig lets cooperating clients compress the tunnel
+// stream between them and the proxy, for expensive client links
+type TunnelCompressionConfig struct {
+	Enabled bool `json:"enabled"`
+	Level   int  `json:"level"` // DEFLATE level 1-9 (default 1)
+}
+
+// tunnelCompressionHeader carries the negotiation: the client lists the
+// algorithms it supports on the CONNECT request, and the proxy names the
+// one it chose in the 200 response. Without it in the response the tunnel
+// is a plain byte stream.
+const tunnelCompressionHeader = "X-Proxy-Compression"
+
+// tunnelCompressionDeflate is the only algorithm offered so far
+const tunnelCompressionDeflate = "deflate"
+
+// Tunnel frames: a type byte and a big-endian uint16 payload length, then
+// the payload. Each deflate frame is compressed on its own, so frames can
+// be decoded as they arrive.
+const (
+	frameRaw     = 0
+	frameDeflate = 1
+
+	frameHeaderSize = 3
+	maxFramePayload = 1<<16 - 1
+)
+
+const (
+	// minCompressFrame is the smallest frame worth compressing
+	minCompressFrame = 256
+	// incompressibleBackoff is how many frames are sent raw after one did
+	// not shrink, so encrypted or already compressed traffic costs little CPU
+	incompressibleBackoff = 16
+)
+
+var errFrameTooLarge = errors.New("compressed tunnel frame inflates beyond its limit")
+
+// Bytes through compressed tunnels, before and after compression
+var (
+	compressionRawUp, compressionWireUp     atomic.Uint64
+	compressionRawDown, compressionWireDown atomic.Uint64
+)
+
+func init() {
+	metrics.Collect("https_proxy_tunnel_compression_bytes_total", "Bytes through compressed tunnels, by direction and whether counted before (raw) or after (wire) compression.", "counter", func() []MetricSample {
+		return []MetricSample{
+			{Labels: map[string]string{"direction": "upload", "stage": "raw"}, Value: float64(compressionRawUp.Load())},
+			{Labels: map[string]string{"direction": "upload", "stage": "wire"}, Value: float64(compressionWireUp.Load())},
+			{Labels: map[string]string{"direction": "download", "stage": "raw"}, Value: float64(compressionRawDown.Load())},
+			{Labels: map[string]string{"direction": "download", "stage": "wire"}, Value: float64(compressionWireDown.Load())},
+		}
+	})
+}
+
+// negotiateTunnelCompression returns the algorithm to use for the tunnel
+// requested by r, or "" to leave it uncompressed
+func (p *Proxy) negotiateTunnelCompression(r *http.Request) string {
+	if !p.Config.Proxy.TunnelCompression.Enabled {
+		return ""
+	}
+	for _, offer := range strings.Split(r.Header.Get(tunnelCompressionHeader), ",") {
+		if strings.EqualFold(strings.TrimSpace(offer), tunnelCompressionDeflate) {
+			return tunnelCompressionDeflate
+		}
+	}
+	return ""
+}
+
+// compressedWriter frames what is written to it, deflating frames that
+// shrink
+type compressedWriter struct {
+	w       io.Writer
+	fw      *flate.Writer
+	buf     bytes.Buffer
+	skip    int // frames left to send raw after an incompressible one
+	written uint64
+}
+
+func newCompressedWriter(w io.Writer, level int) *compressedWriter {
+	if level < flate.BestSpeed || level > flate.BestCompression {
+		level = flate.BestSpeed
+	}
+	fw, _ := flate.NewWriter(nil, level)
+	return &compressedWriter{w: w, fw: fw}
+}
+
+func (c *compressedWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), maxFramePayload)]
+		if err := c.writeFrame(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		c.written += uint64(len(chunk))
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *compressedWriter) writeFrame(chunk []byte) error {
+	kind, payload := byte(frameRaw), chunk
+	if c.skip > 0 {
+		c.skip--
+	} else if len(chunk) >= minCompressFrame {
+		c.buf.Reset()
+		c.fw.Reset(&c.buf)
+		c.fw.Write(chunk)
+		c.fw.Close()
+		if c.buf.Len() < len(chunk) {
+			kind, payload = frameDeflate, c.buf.Bytes()
+		} else {
+			c.skip = incompressibleBackoff
+		}
+	}
+	frame := make([]byte, frameHeaderSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint16(frame[1:], uint16(len(payload)))
+	copy(frame[frameHeaderSize:], payload)
+	_, err := c.w.Write(frame)
+	return err
+}
+
+// compressedReader reads what a compressedWriter framed
+type compressedReader struct {
+	r       io.Reader
+	fr      io.ReadCloser
+	header  [frameHeaderSize]byte
+	payload []byte
+	out     []byte // decoded and not yet read
+	read    uint64
+}
+
+func newCompressedReader(r io.Reader) *compressedReader {
+	return &compressedReader{r: r, fr: flate.NewReader(nil), payload: make([]byte, maxFramePayload)}
+}
+
+func (c *compressedReader) Read(b []byte) (int, error) {
+	for len(c.out) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.out)
+	c.out = c.out[n:]
+	c.read += uint64(n)
+	return n, nil
+}
+
+func (c *compressedReader) readFrame() error {
+	if _, err := io.ReadFull(c.r, c.header[:]); err != nil {
+		return err
+	}
+	payload := c.payload[:binary.BigEndian.Uint16(c.header[1:])]
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	switch c.header[0] {
+	case frameRaw:
+		c.out = payload
+	case frameDeflate:
+		c.fr.(flate.Resetter).Reset(bytes.NewReader(payload), nil)
+		var out bytes.Buffer
+		if _, err := io.Copy(&out, io.LimitReader(c.fr, maxFramePayload+1)); err != nil {
+			return fmt.Errorf("inflate tunnel frame: %w", err)
+		}
+		if out.Len() > maxFramePayload {
+			return errFrameTooLarge
+		}
+		c.out = out.Bytes()
+	default:
+		return fmt.Errorf("unknown tunnel frame type %d", c.header[0])
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTunnelCompression_RoundTrip(t *testing.T) {
+	text := []byte(strings.Repeat("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n", 4000))
+	noise := make([]byte, 100000)
+	rand.Read(noise)
+
+	var wire bytes.Buffer
+	cw := newCompressedWriter(&wire, 1)
+	for _, b := range [][]byte{text, noise, []byte("tiny")} {
+		if _, err := cw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := append(append(append([]byte{}, text...), noise...), "tiny"...)
+	if cw.written != uint64(len(want)) {
+		t.Errorf("written = %d, want %d", cw.written, len(want))
+	}
+	// The text shrinks; the noise costs only frame headers
+	if limit := len(noise) + len(text)/4; wire.Len() > limit {
+		t.Errorf("wire = %d bytes, want at most %d", wire.Len(), limit)
+	}
+
+	cr := newCompressedReader(&wire)
+	got, err := io.ReadAll(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("decoded stream differs from the original")
+	}
+	if cr.read != uint64(len(want)) {
+		t.Errorf("read = %d, want %d", cr.read, len(want))
+	}
+}
+
+func TestTunnelCompression_BadFrames(t *testing.T) {
+	frame := func(kind byte, payload []byte) []byte {
+		b := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+		b[0] = kind
+		binary.BigEndian.PutUint16(b[1:], uint16(len(payload)))
+		return append(b, payload...)
+	}
+
+	// A frame inflating beyond the frame limit is refused
+	var bomb bytes.Buffer
+	cw := newCompressedWriter(&bomb, 9)
+	cw.fw.Reset(&bomb)
+	cw.fw.Write(make([]byte, 4*maxFramePayload))
+	cw.fw.Close()
+	if _, err := io.ReadAll(newCompressedReader(bytes.NewReader(frame(frameDeflate, bomb.Bytes())))); err != errFrameTooLarge {
+		t.Errorf("bomb: err = %v, want errFrameTooLarge", err)
+	}
+
+	if _, err := io.ReadAll(newCompressedReader(bytes.NewReader(frame(7, []byte("x"))))); err == nil {
+		t.Error("unknown frame type accepted")
+	}
+	if _, err := io.ReadAll(newCompressedReader(bytes.NewReader(frame(frameRaw, []byte("abc"))[:4]))); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated frame: err = %v, want unexpected EOF", err)
+	}
+}
+
+func TestTunnelCompression_Negotiate(t *testing.T) {
+	cfg := &Config{}
+	p := &Proxy{Config: cfg}
+	r, _ := http.NewRequest(http.MethodConnect, "https://example.com:443", nil)
+	r.Header.Set(tunnelCompressionHeader, "zstd, Deflate")
+	if got := p.negotiateTunnelCompression(r); got != "" {
+		t.Errorf("disabled: got %q", got)
+	}
+
+	cfg.Proxy.TunnelCompression.Enabled = true
+	if got := p.negotiateTunnelCompression(r); got != tunnelCompressionDeflate {
+		t.Errorf("got %q, want deflate", got)
+	}
+	r.Header.Set(tunnelCompressionHeader, "zstd")
+	if got := p.negotiateTunnelCompression(r); got != "" {
+		t.Errorf("unsupported offer: got %q", got)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// TunnelTransferLimitConfig caps the bytes a single tunnel may carry, so
+// one runaway transfer cannot use up a user's quota unnoticed
+type TunnelTransferLimitConfig struct {
+	DefaultMB int64            `json:"default_mb"` // Limit for users not listed (0: none)
+	Users     map[string]int64 `json:"users"`      // Limit per user or CN pattern, in MB (0: none)
+}
+
+// TunnelTransferLimits enforces proxy.tunnel_transfer_limit
+type TunnelTransferLimits struct {
+	defaultBytes uint64
+	users        *userPatterns
+	limits       map[string]uint64 // by users entry
+
+	closed atomic.Uint64
+}
+
+// NewTunnelTransferLimits parses proxy.tunnel_transfer_limit; it returns
+// nil if no tunnel is limited, by it or by a tier
+func NewTunnelTransferLimits(config *Config) *TunnelTransferLimits {
+	cfg := config.Proxy.TunnelTransferLimit
+	l := &TunnelTransferLimits{limits: make(map[string]uint64)}
+	if cfg.DefaultMB > 0 {
+		l.defaultBytes = uint64(cfg.DefaultMB) << 20
+	}
+	entries := make([]string, 0, len(cfg.Users))
+	for entry, mb := range cfg.Users {
+		if mb < 0 {
+			log.Printf("Tunnel transfer limit for %s: %d MB is negative, ignored", entry, mb)
+			continue
+		}
+		l.limits[entry] = uint64(mb) << 20
+		entries = append(entries, entry)
+	}
+	tiered := false
+	for _, tc := range config.Proxy.Tiers {
+		tiered = tiered || tc.TunnelLimitMB > 0
+	}
+	if l.defaultBytes == 0 && len(entries) == 0 && !tiered {
+		return nil
+	}
+	var err error
+	if l.users, err = newUserPatterns(entries); err != nil {
+		log.Printf("Tunnel transfer limit: %v", err)
+	}
+
+	metrics.Counter("https_proxy_tunnel_transfer_limit_closed_total", "Tunnels closed for carrying more than their transfer limit.", func() float64 {
+		return float64(l.closed.Load())
+	})
+	return l
+}
+
+// Limit returns the bytes a tunnel of username may carry, set by the user's
+// tier if it has one; 0 means no limit
+func (l *TunnelTransferLimits) Limit(username string, tier *Tier) uint64 {
+	if l == nil {
+		return 0
+	}
+	if tier != nil && tier.TunnelBytes > 0 {
+		return tier.TunnelBytes
+	}
+	if entry, ok := l.users.Match(username); ok {
+		return l.limits[entry]
+	}
+	return l.defaultBytes
+}
+
+// transferCap counts both directions of one tunnel against its limit and
+// closes the tunnel once the limit is reached
+type transferCap struct {
+	limit    uint64
+	used     atomic.Uint64
+	once     sync.Once
+	exceeded func()
+}
+
+// transferCap returns the cap for a tunnel of username, calling exceeded
+// once when the tunnel reaches it; nil if the user's tunnels are not limited
+func (l *TunnelTransferLimits) transferCap(username string, tier *Tier, exceeded func()) *transferCap {
+	limit := l.Limit(username, tier)
+	if limit == 0 {
+		return nil
+	}
+	return &transferCap{limit: limit, exceeded: func() {
+		l.closed.Add(1)
+		exceeded()
+	}}
+}
+
+// Reader wraps r so what is read through it counts against the cap
+func (c *transferCap) Reader(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return &cappedReader{r: r, c: c}
+}
+
+type cappedReader struct {
+	r io.Reader
+	c *transferCap
+}
+
+func (cr *cappedReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	if cr.c.used.Add(uint64(n)) >= cr.c.limit {
+		// What was read is still forwarded; closing the tunnel ends both
+		// directions' copies
+		cr.c.once.Do(cr.c.exceeded)
+	}
+	return n, err
+}
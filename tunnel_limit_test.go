@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestTunnelTransferLimits(t *testing.T) {
+	cfg := &Config{}
+	if NewTunnelTransferLimits(cfg) != nil {
+		t.Fatal("limits enabled without configuration")
+	}
+	cfg.Proxy.TunnelTransferLimit.DefaultMB = 1
+	cfg.Proxy.TunnelTransferLimit.Users = map[string]int64{"backup-*": 0, "alice": 2}
+	l := NewTunnelTransferLimits(cfg)
+	for user, want := range map[string]uint64{"bob": 1 << 20, "alice": 2 << 20, "backup-eu": 0} {
+		if got := l.Limit(user, nil); got != want {
+			t.Errorf("Limit(%s) = %d, want %d", user, got, want)
+		}
+	}
+	if l.transferCap("backup-eu", nil, func() {}) != nil {
+		t.Error("unlimited user got a cap")
+	}
+
+	// Both directions count against the same cap
+	closed := 0
+	c := l.transferCap("bob", nil, func() { closed++ })
+	up := c.Reader(bytes.NewReader(make([]byte, 600<<10)))
+	down := c.Reader(bytes.NewReader(make([]byte, 600<<10)))
+	io.Copy(io.Discard, up)
+	if closed != 0 {
+		t.Fatal("tunnel closed below its limit")
+	}
+	io.Copy(io.Discard, down)
+	if closed != 1 {
+		t.Errorf("tunnel closed %d times after reaching its limit, want once", closed)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// TunnelSamplesConfig keeps the throughput of large tunnels over time, so
+// the user detail page can show whether a slow tunnel ran at its rate
+// limit or was held back by the target
+type TunnelSamplesConfig struct {
+	Enabled         bool `json:"enabled"`
+	IntervalSeconds int  `json:"interval_seconds"` // Width of a sample (default 10)
+	MinMB           int  `json:"min_mb"`           // Tunnels that carried less are not kept (default 1)
+}
+
+// tunnelSamplesMax bounds the samples of a tunnel; longer tunnels get
+// wider ones
+const tunnelSamplesMax = 360
+
+// throughputSamples are the bytes a tunnel carried in each interval
+type throughputSamples struct {
+	Interval time.Duration
+	Buckets  [][2]uint64 // Upload and download
+
+	ticks     int // Ticks added to the last bucket
+	perBucket int // Ticks a bucket spans
+	up, down  uint64
+}
+
+func newThroughputSamples(interval time.Duration) *throughputSamples {
+	return &throughputSamples{Interval: interval, perBucket: 1}
+}
+
+// tick adds what the tunnel carried since the last tick, given its byte
+// counts so far. Once the samples are full, pairs of them are merged and
+// the interval doubles.
+func (s *throughputSamples) tick(up, down uint64) {
+	if s.ticks == 0 {
+		if len(s.Buckets) == tunnelSamplesMax {
+			for i := 0; i < len(s.Buckets)/2; i++ {
+				a, b := s.Buckets[2*i], s.Buckets[2*i+1]
+				s.Buckets[i] = [2]uint64{a[0] + b[0], a[1] + b[1]}
+			}
+			s.Buckets = s.Buckets[:len(s.Buckets)/2]
+			s.Interval *= 2
+			s.perBucket *= 2
+		}
+		s.Buckets = append(s.Buckets, [2]uint64{})
+	}
+	last := &s.Buckets[len(s.Buckets)-1]
+	last[0] += up - s.up
+	last[1] += down - s.down
+	s.up, s.down = up, down
+	if s.ticks++; s.ticks == s.perBucket {
+		s.ticks = 0
+	}
+}
+
+// finish adds what the tunnel carried since the last tick, given its final
+// byte counts, as a last and likely shorter sample
+func (s *throughputSamples) finish(up, down uint64) [][2]uint64 {
+	if up > s.up || down > s.down || len(s.Buckets) == 0 {
+		s.ticks = 0
+		s.tick(up, down)
+	}
+	return s.Buckets
+}
+
+// StartSampling samples the throughput of the tunnels opened from now on
+// every interval
+func (reg *tunnelRegistry) StartSampling(cfg TunnelSamplesConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	interval := time.Duration(firstPositive(cfg.IntervalSeconds, 10)) * time.Second
+	reg.mu.Lock()
+	reg.sampleInterval = interval
+	reg.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			reg.sample()
+		}
+	}()
+}
+
+// sample adds a tick to the samples of every open tunnel
+func (reg *tunnelRegistry) sample() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, t := range reg.tunnels {
+		if t.samples != nil && t.counters != nil {
+			t.samples.tick(t.counters())
+		}
+	}
+}
+
+// takeSamples returns the samples of a closing tunnel, or nil if it was
+// not sampled
+func (reg *tunnelRegistry) takeSamples(id uint64) *throughputSamples {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	t, ok := reg.tunnels[id]
+	if !ok {
+		return nil
+	}
+	s := t.samples
+	t.samples = nil
+	return s
+}
+
+// saveTunnelSamples keeps the throughput of a closed tunnel that carried
+// at least stats.tunnel_samples.min_mb, with the tightest rate limits that
+// applied to it
+func (p *Proxy) saveTunnelSamples(id uint64, t DBTunnelSamples, throttle *tunnelThrottle) {
+	s := tunnels.takeSamples(id)
+	if s == nil || p.StatsDB == nil {
+		return
+	}
+	if t.Upload+t.Download < uint64(firstPositive(p.Config.Stats.TunnelSamples.MinMB, 1))<<20 {
+		return
+	}
+	t.IntervalSeconds = int(s.Interval / time.Second)
+	t.Samples = s.finish(t.Upload, t.Download)
+	limit := p.Policy.RateLimits.Limit(t.User)
+	t.UploadCap = tightestRate(limit.Upload.RateBytes, throttle.rate.Load())
+	t.DownloadCap = tightestRate(limit.Download.RateBytes, throttle.rate.Load())
+	if err := p.StatsDB.RecordTunnelSamples(t); err != nil && err != errStatsReadOnly {
+		log.Printf("Tunnel samples: %v", err)
+	}
+}
+
+// tightestRate returns the lowest of the rates that are set, or 0 if none
+// is
+func tightestRate(rates ...int64) int64 {
+	var min int64
+	for _, r := range rates {
+		if r > 0 && (min == 0 || r < min) {
+			min = r
+		}
+	}
+	return min
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThroughputSamples(t *testing.T) {
+	s := newThroughputSamples(10 * time.Second)
+	var up, down uint64
+	for i := 0; i < tunnelSamplesMax; i++ {
+		up, down = up+1, down+10
+		s.tick(up, down)
+	}
+	if len(s.Buckets) != tunnelSamplesMax || s.Buckets[0] != [2]uint64{1, 10} {
+		t.Fatalf("%d samples, first %v", len(s.Buckets), s.Buckets[0])
+	}
+
+	// Once full, pairs merge and later samples span two ticks
+	up, down = up+1, down+10
+	s.tick(up, down)
+	if len(s.Buckets) != tunnelSamplesMax/2+1 || s.Interval != 20*time.Second || s.Buckets[0] != [2]uint64{2, 20} {
+		t.Fatalf("%d samples of %v, first %v", len(s.Buckets), s.Interval, s.Buckets[0])
+	}
+	up, down = up+1, down+10
+	s.tick(up, down)
+	if last := s.Buckets[len(s.Buckets)-1]; len(s.Buckets) != tunnelSamplesMax/2+1 || last != [2]uint64{2, 20} {
+		t.Errorf("%d samples, last %v", len(s.Buckets), last)
+	}
+
+	// What the tunnel carried after the last tick is a last sample
+	buckets := s.finish(up+5, down)
+	if last := buckets[len(buckets)-1]; len(buckets) != tunnelSamplesMax/2+2 || last != [2]uint64{5, 0} {
+		t.Errorf("%d samples, last %v", len(buckets), last)
+	}
+
+	if got := tightestRate(0, 2048, 1024); got != 1024 {
+		t.Errorf("tightestRate = %d", got)
+	}
+}
+
+func TestTunnelSamples_Saved(t *testing.T) {
+	db := newExpiryTestDB(t)
+	cfg := &Config{}
+	cfg.Stats.TunnelSamples = TunnelSamplesConfig{Enabled: true, MinMB: 1}
+	p := &Proxy{Config: cfg, StatsDB: db, Policy: NewPolicyEngine(cfg, nil, db)}
+
+	reg := tunnels
+	reg.mu.Lock()
+	reg.sampleInterval = 10 * time.Second
+	reg.mu.Unlock()
+	defer func() {
+		reg.mu.Lock()
+		reg.sampleInterval = 0
+		reg.mu.Unlock()
+	}()
+
+	var up, down uint64
+	small := reg.Register(TunnelInfo{Username: "alice"})
+	big := reg.Register(TunnelInfo{Username: "alice"})
+	defer reg.Unregister(small)
+	defer reg.Unregister(big)
+	reg.setCounters(small, func() (uint64, uint64) { return 1, 1 })
+	reg.setCounters(big, func() (uint64, uint64) { return up, down })
+	for _, d := range []uint64{1 << 20, 2 << 20} {
+		down += d
+		reg.sample()
+	}
+
+	started := time.Now().Add(-25 * time.Second)
+	throttle := &tunnelThrottle{}
+	throttle.Limit(512 << 10)
+	p.saveTunnelSamples(small, DBTunnelSamples{User: "alice", Target: "example.com:443", Started: started, Ended: time.Now(), Upload: 1, Download: 1}, throttle)
+	p.saveTunnelSamples(big, DBTunnelSamples{User: "alice", Target: "example.net:443", Started: started, Ended: started.Add(23 * time.Second), Upload: 100, Download: down}, throttle)
+
+	mux := http.NewServeMux()
+	registerV2API(mux, cfg, nil, db, p.Policy, nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/users/alice/throughput", nil))
+	var resp struct {
+		Data []DBTunnelSamples `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Data) != 1 {
+		t.Fatalf("saved tunnels = %+v", resp.Data)
+	}
+	got := resp.Data[0]
+	want := [][2]uint64{{0, 1 << 20}, {0, 2 << 20}, {100, 0}}
+	if got.Target != "example.net:443" || got.IntervalSeconds != 10 || got.DownloadCap != 512<<10 || len(got.Samples) != len(want) {
+		t.Fatalf("saved = %+v", got)
+	}
+	for i := range want {
+		if got.Samples[i] != want[i] {
+			t.Errorf("sample %d = %v, want %v", i, got.Samples[i], want[i])
+		}
+	}
+
+	// Pruned with the hourly stats
+	db.CleanupOldData(1, 0)
+	if list, _ := db.GetTunnelSamples(context.Background(), "alice", 10); len(list) != 0 {
+		t.Errorf("%d tunnels left after cleanup", len(list))
+	}
+}
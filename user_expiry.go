@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UserExpiryConfig contains the automatic user expiry settings. Expiry dates
+// are set per user through the API or taken from the client certificate.
+type UserExpiryConfig struct {
+	FromCert             bool `json:"from_cert"`              // Use the client certificate's NotAfter when no date is set
+	WarnDays             int  `json:"warn_days"`              // Warn this many days ahead (default 7)
+	CheckIntervalSeconds int  `json:"check_interval_seconds"` // How often expiries are checked (default 300)
+}
+
+// UserExpiryJob disables users once their expiry date has passed and warns
+// ahead of it
+type UserExpiryJob struct {
+	sm       *StatsManager
+	db       *StatsDB
+	fromCert bool
+	warn     time.Duration
+	interval time.Duration
+
+	mu       sync.Mutex
+	certSeen map[string]time.Time // NotAfter last recorded per user
+
+	expiringSoon atomic.Int64
+}
+
+// NewUserExpiryJob creates the expiry job; it returns nil without a stats
+// database, where expiry dates are stored
+func NewUserExpiryJob(config *Config, sm *StatsManager, db *StatsDB) *UserExpiryJob {
+	if db == nil {
+		return nil
+	}
+	ec := config.UserExpiry
+	j := &UserExpiryJob{
+		sm:       sm,
+		db:       db,
+		fromCert: ec.FromCert,
+		warn:     time.Duration(ec.WarnDays) * 24 * time.Hour,
+		interval: time.Duration(ec.CheckIntervalSeconds) * time.Second,
+		certSeen: make(map[string]time.Time),
+	}
+	if j.warn <= 0 {
+		j.warn = 7 * 24 * time.Hour
+	}
+	if j.interval <= 0 {
+		j.interval = 5 * time.Minute
+	}
+	metrics.Gauge("https_proxy_users_expiring_soon", "Users whose expiry date falls within the warning period", func() float64 {
+		return float64(j.expiringSoon.Load())
+	})
+	return j
+}
+
+// Run checks expiries every interval, forever
+func (j *UserExpiryJob) Run() {
+	if j == nil {
+		return
+	}
+	j.Check(time.Now())
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		j.Check(now)
+	}
+}
+
+// Check warns users entering the warning period and disables expired ones.
+// Each happens once per expiry date, so an admin can re-enable an expired
+// user without the job disabling them again.
+func (j *UserExpiryJob) Check(now time.Time) {
+	expiries, err := j.db.UserExpiries(context.Background(), now)
+	if err != nil {
+		log.Printf("User expiry: %v", err)
+		return
+	}
+	var soon int64
+	for name, e := range expiries {
+		switch {
+		case e.Expired:
+		case !now.Before(e.ExpiresAt):
+			if _, err := setUserDisabled(j.sm, j.db, name, true, "expiry"); err != nil {
+				log.Printf("User expiry: disabling %s: %v", name, err)
+				continue
+			}
+			j.db.markExpired(name)
+			log.Printf("User %s expired at %s and was disabled", name, e.ExpiresAt.Format(time.RFC3339))
+		case e.ExpiresAt.Sub(now) <= j.warn:
+			soon++
+			if e.Warned {
+				continue
+			}
+			j.db.markExpiryWarned(name)
+			j.db.RecordUserEvent(name, EventExpiryWarning, "expiry", fmt.Sprintf("expires at %s, in %d days (%s)", e.ExpiresAt.Format(time.RFC3339), e.DaysRemaining, e.Source))
+			log.Printf("Warning: user %s expires at %s (in %d days)", name, e.ExpiresAt.Format(time.RFC3339), e.DaysRemaining)
+		}
+	}
+	j.expiringSoon.Store(soon)
+}
+
+// ObserveCert records the NotAfter of username's certificate as the expiry
+// date when from_cert is on and no admin set one
+func (j *UserExpiryJob) ObserveCert(username string, notAfter time.Time) {
+	if j == nil || !j.fromCert {
+		return
+	}
+	j.mu.Lock()
+	seen := j.certSeen[username].Equal(notAfter)
+	j.certSeen[username] = notAfter
+	j.mu.Unlock()
+	if seen {
+		return
+	}
+	if err := j.db.SetUserExpiry(username, notAfter, ExpirySourceCert); err != nil {
+		log.Printf("User expiry: recording certificate expiry of %s: %v", username, err)
+	}
+}
+
+// handleUserExpiry serves /api/v2/users/{name}/expiry: GET returns the
+// expiry, PUT {"expires_at": "2026-12-31T00:00:00Z"} (or a YYYY-MM-DD date,
+// midnight UTC) sets it and DELETE clears it
+func handleUserExpiry(w http.ResponseWriter, r *http.Request, db *StatsDB, username string) {
+	actor := "web:" + adminName(r)
+	switch r.Method {
+	case http.MethodGet:
+		e, err := db.GetUserExpiry(r.Context(), username, time.Now())
+		if err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		if e == nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "no expiry set"}, http.StatusNotFound)
+			return
+		}
+		writeJSONResponse(w, WebResponse{Success: true, Data: e}, http.StatusOK)
+	case http.MethodPut:
+		var req struct {
+			ExpiresAt string `json:"expires_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: "invalid JSON: " + err.Error()}, http.StatusBadRequest)
+			return
+		}
+		at, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			if at, err = time.Parse("2006-01-02", req.ExpiresAt); err != nil {
+				writeJSONResponse(w, WebResponse{Success: false, Error: "expires_at must be RFC3339 or YYYY-MM-DD"}, http.StatusBadRequest)
+				return
+			}
+		}
+		if err := db.SetUserExpiry(username, at, ExpirySourceAPI); err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		db.RecordUserEvent(username, EventExpirySet, actor, at.UTC().Format(time.RFC3339))
+		e, _ := db.GetUserExpiry(r.Context(), username, time.Now())
+		writeJSONResponse(w, WebResponse{Success: true, Data: e}, http.StatusOK)
+	case http.MethodDelete:
+		if err := db.ClearUserExpiry(username); err != nil {
+			writeJSONResponse(w, WebResponse{Success: false, Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		db.RecordUserEvent(username, EventExpirySet, actor, "cleared")
+		writeJSONResponse(w, WebResponse{Success: true}, http.StatusOK)
+	default:
+		writeJSONResponse(w, WebResponse{Success: false, Error: "Method not allowed"}, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newExpiryTestDB(t *testing.T) *StatsDB {
+	t.Helper()
+	db, err := NewStatsDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStatsDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestStatsDB_UserExpiry(t *testing.T) {
+	db := newExpiryTestDB(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	certDate := now.Add(90 * 24 * time.Hour)
+	adminDate := now.Add(30*24*time.Hour + time.Hour)
+
+	db.SetUserExpiry("alice", certDate, ExpirySourceCert)
+	db.SetUserExpiry("alice", adminDate, ExpirySourceAPI)
+	db.SetUserExpiry("alice", certDate.Add(time.Hour), ExpirySourceCert) // does not replace the admin's date
+	e, err := db.GetUserExpiry(context.Background(), "alice", now)
+	if err != nil || e == nil || !e.ExpiresAt.Equal(adminDate) || e.Source != ExpirySourceAPI || e.DaysRemaining != 30 {
+		t.Fatalf("expiry = %+v, %v", e, err)
+	}
+
+	db.markExpired("alice")
+	db.SetUserExpiry("alice", adminDate.Add(24*time.Hour), ExpirySourceAPI)
+	if e, _ := db.GetUserExpiry(context.Background(), "alice", now); e.Expired || e.Warned {
+		t.Errorf("moving the date should re-arm the job: %+v", e)
+	}
+
+	db.ClearUserExpiry("alice")
+	if e, _ := db.GetUserExpiry(context.Background(), "alice", now); e != nil {
+		t.Errorf("cleared expiry = %+v", e)
+	}
+}
+
+func TestUserExpiryJob(t *testing.T) {
+	db := newExpiryTestDB(t)
+	cfg := &Config{}
+	cfg.UserExpiry = UserExpiryConfig{FromCert: true, WarnDays: 3}
+	sm := NewStatsManager(&Config{})
+	job := NewUserExpiryJob(cfg, sm, db)
+	now := time.Now()
+
+	db.SetUserExpiry("alice", now.Add(time.Hour), ExpirySourceAPI)
+	db.SetUserExpiry("bob", now.Add(-time.Minute), ExpirySourceAPI)
+	db.SetUserExpiry("carol", now.Add(10*24*time.Hour), ExpirySourceAPI)
+	job.ObserveCert("dave", now.Add(48*time.Hour))
+
+	job.Check(now)
+	job.Check(now.Add(time.Minute))
+	if !db.IsUserDisabled("bob") || db.IsUserDisabled("alice") || db.IsUserDisabled("carol") {
+		t.Error("wrong users disabled")
+	}
+	if got := job.expiringSoon.Load(); got != 2 {
+		t.Errorf("expiring soon = %d, want 2 (alice, dave)", got)
+	}
+	events := map[string]int{}
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		timeline, _ := db.GetUserTimeline(context.Background(), name, 10)
+		for _, e := range timeline {
+			events[name+" "+e.Type]++
+		}
+	}
+	if events["alice expiry_warning"] != 1 || events["dave expiry_warning"] != 1 || events["bob user_disabled"] != 1 || events["carol expiry_warning"] != 0 {
+		t.Errorf("events = %v", events)
+	}
+
+	// An admin re-enabling an expired user is not undone
+	setUserDisabled(sm, db, "bob", false, "web:admin")
+	job.Check(now.Add(2 * time.Minute))
+	if db.IsUserDisabled("bob") {
+		t.Error("re-enabled user was disabled again")
+	}
+}
+
+func TestV2API_UserExpiry(t *testing.T) {
+	db := newExpiryTestDB(t)
+	db.BatchUpsert([]TrafficRecord{{Username: "alice", Upload: 1, ConnCount: 1, Timestamp: time.Now()}})
+	mux := http.NewServeMux()
+	registerV2API(mux, &Config{}, nil, db, nil, nil)
+	do := func(method, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, "/api/v2/users/alice/expiry", bytes.NewBufferString(body)))
+		return rec
+	}
+
+	if rec := do(http.MethodPut, `{"expires_at": "next week"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid date: %d", rec.Code)
+	}
+	date := time.Now().AddDate(0, 0, 20).UTC().Format("2006-01-02")
+	if rec := do(http.MethodPut, `{"expires_at": "`+date+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", rec.Code, rec.Body)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v2/users", nil))
+	var resp struct {
+		Data []DBUserStats `json:"data"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if len(resp.Data) != 1 || resp.Data[0].DaysRemaining == nil || *resp.Data[0].DaysRemaining != 19 {
+		t.Errorf("users = %+v", resp.Data)
+	}
+
+	if rec := do(http.MethodDelete, ""); rec.Code != http.StatusOK {
+		t.Errorf("DELETE: %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE: %d", rec.Code)
+	}
+}
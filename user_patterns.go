@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// userPatterns matches usernames (certificate CNs) against the user entries of
+// a policy list. Entries are exact names or glob patterns such as "dev-*" or
+// "*@corp.example", so certificates issued with structured names pick up the
+// right policy without being listed one by one.
+type userPatterns struct {
+	exact map[string]bool
+	globs []string // most specific first
+}
+
+// newUserPatterns builds a matcher from policy entries. Invalid patterns are
+// returned as an error and left out of the matcher.
+func newUserPatterns(entries []string) (*userPatterns, error) {
+	u := &userPatterns{exact: make(map[string]bool)}
+	var bad []string
+	for _, e := range entries {
+		switch {
+		case e == "":
+		case !isUserPattern(e):
+			u.exact[e] = true
+		default:
+			if _, err := path.Match(e, ""); err != nil {
+				bad = append(bad, e)
+				continue
+			}
+			u.globs = append(u.globs, e)
+		}
+	}
+	sort.SliceStable(u.globs, func(i, j int) bool {
+		return patternSpecificity(u.globs[i]) > patternSpecificity(u.globs[j])
+	})
+	if len(bad) > 0 {
+		return u, fmt.Errorf("invalid user patterns: %s", strings.Join(bad, ", "))
+	}
+	return u, nil
+}
+
+// Match returns the entry that applies to username: the exact name if it is
+// listed, otherwise the most specific matching pattern
+func (u *userPatterns) Match(username string) (string, bool) {
+	if u == nil || username == "" {
+		return "", false
+	}
+	if u.exact[username] {
+		return username, true
+	}
+	for _, g := range u.globs {
+		if ok, _ := path.Match(g, username); ok {
+			return g, true
+		}
+	}
+	return "", false
+}
+
+// isUserPattern reports whether a policy entry is a glob rather than a name
+func isUserPattern(entry string) bool {
+	return strings.ContainsAny(entry, "*?[")
+}
+
+// patternSpecificity counts the literal characters of a glob, so
+// "dev-eu-*" is preferred over "dev-*" when both match
+func patternSpecificity(pattern string) int {
+	n := 0
+	for _, c := range pattern {
+		if c != '*' && c != '?' {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestUserPatterns_Match(t *testing.T) {
+	u, err := newUserPatterns([]string{"dev-*", "*@corp.example", "dev-eu-*", "alice", "[bad"})
+	if err == nil {
+		t.Error("expected invalid pattern to be reported")
+	}
+
+	cases := []struct {
+		user, want string
+		ok         bool
+	}{
+		{"alice", "alice", true},
+		{"dev-bob", "dev-*", true},
+		{"dev-eu-carol", "dev-eu-*", true}, // more specific pattern wins
+		{"dave@corp.example", "*@corp.example", true},
+		{"dave@corp.example.org", "", false},
+		{"alice2", "", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		got, ok := u.Match(c.user)
+		if got != c.want || ok != c.ok {
+			t.Errorf("Match(%q) = %q, %v; want %q, %v", c.user, got, ok, c.want, c.ok)
+		}
+	}
+
+	// Exact names win over patterns that also match
+	u, _ = newUserPatterns([]string{"*", "dev-1"})
+	if got, _ := u.Match("dev-1"); got != "dev-1" {
+		t.Errorf("exact entry should win, got %q", got)
+	}
+}
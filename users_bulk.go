@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+)
+
+// maxBulkUsers caps how many users a single bulk request may touch
+const maxBulkUsers = 10000
+
+// BulkUserRequest applies one action to a list of users or to every user
+// matching Filter. DryRun reports the matched users without changing them.
+type BulkUserRequest struct {
+	Action    string          `json:"action"`
+	Usernames []string        `json:"usernames,omitempty"`
+	Filter    *BulkUserFilter `json:"filter,omitempty"`
+	DryRun    bool            `json:"dry_run,omitempty"`
+}
+
+// BulkUserFilter selects users from the stats database. All set fields must
+// match.
+type BulkUserFilter struct {
+	Username     string `json:"username,omitempty"`      // glob pattern, e.g. "team-*"
+	InactiveDays int    `json:"inactive_days,omitempty"` // no access for at least this many days
+	Disabled     *bool  `json:"disabled,omitempty"`
+}
+
+// BulkUserResult is the outcome for one user
+type BulkUserResult struct {
+	Username string `json:"username"`
+	OK       bool   `json:"ok"`
+	Changed  bool   `json:"changed"`
+	Error    string `json:"error,omitempty"`
+}
+
+// runBulkUserAction resolves the target users and applies the action to each
+// of them. A request-level error (bad action, bad filter) is returned as err;
+// per-user failures are reported in the results.
+func runBulkUserAction(ctx context.Context, req BulkUserRequest, sm *StatsManager, db *StatsDB, actor string) ([]BulkUserResult, error) {
+	var disable bool
+	switch req.Action {
+	case "disable":
+		disable = true
+	case "enable":
+	default:
+		return nil, fmt.Errorf("unsupported action %q (want disable or enable)", req.Action)
+	}
+
+	users, err := bulkTargets(ctx, req, db)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BulkUserResult, 0, len(users))
+	for _, username := range users {
+		res := BulkUserResult{Username: username, OK: true}
+		if !req.DryRun {
+			res.Changed, err = setUserDisabled(sm, db, username, disable, actor)
+			if err != nil {
+				res.OK = false
+				res.Error = err.Error()
+			}
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// bulkTargets returns the deduplicated usernames a bulk request applies to
+func bulkTargets(ctx context.Context, req BulkUserRequest, db *StatsDB) ([]string, error) {
+	if (len(req.Usernames) > 0) == (req.Filter != nil) {
+		return nil, fmt.Errorf("exactly one of usernames or filter is required")
+	}
+
+	var users []string
+	if req.Filter != nil {
+		if _, err := path.Match(req.Filter.Username, ""); err != nil {
+			return nil, fmt.Errorf("invalid username pattern: %v", err)
+		}
+		all, err := db.GetAllUsers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range all {
+			if req.Filter.matches(u) {
+				users = append(users, u.Username)
+			}
+		}
+	} else {
+		seen := make(map[string]bool, len(req.Usernames))
+		for _, name := range req.Usernames {
+			if name == "" {
+				return nil, fmt.Errorf("empty username in list")
+			}
+			if !seen[name] {
+				seen[name] = true
+				users = append(users, name)
+			}
+		}
+	}
+
+	if len(users) > maxBulkUsers {
+		return nil, fmt.Errorf("request matches %d users, limit is %d", len(users), maxBulkUsers)
+	}
+	return users, nil
+}
+
+func (f *BulkUserFilter) matches(u DBUserStats) bool {
+	if f.Username != "" {
+		if ok, _ := path.Match(f.Username, u.Username); !ok {
+			return false
+		}
+	}
+	if f.Disabled != nil && *f.Disabled != u.Disabled {
+		return false
+	}
+	if f.InactiveDays > 0 {
+		last, err := time.Parse(time.RFC3339, normalizeTimelineTime(u.LastAccess))
+		if err == nil && time.Since(last) < time.Duration(f.InactiveDays)*24*time.Hour {
+			return false
+		}
+	}
+	return true
+}
+
+// setUserDisabled persists the new state first so a failed write leaves the
+// in-memory state untouched, then updates memory and records the admin event.
+// changed reports whether the in-memory state changed.
+func setUserDisabled(sm *StatsManager, db *StatsDB, username string, disabled bool, actor string) (changed bool, err error) {
+	if db != nil {
+		if err := db.SetUserDisabled(username, disabled); err != nil {
+			return false, err
+		}
+	}
+	event := EventUserEnabled
+	if disabled {
+		event = EventUserDisabled
+	}
+	if sm != nil {
+		if disabled {
+			changed = sm.DisableUser(username)
+		} else {
+			changed = sm.EnableUser(username)
+		}
+	}
+	if db != nil {
+		db.RecordUserEvent(username, event, actor, "")
+	}
+	changeFeed.Publish(ChangeEvent{Type: event, User: username, Actor: actor})
+	return changed, nil
+}